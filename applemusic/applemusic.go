@@ -0,0 +1,203 @@
+// Package applemusic copies Spotify tracks into an Apple Music library,
+// matching them to the Apple Music catalog by ISRC, for people who keep their
+// library on both services.
+package applemusic
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	baseURL = "https://api.music.apple.com/v1"
+	// isrcChunk is the most ISRCs the catalog accepts in one filter
+	isrcChunk = 25
+	// addChunk is the most songs potentials-utils adds to the library or a
+	// playlist in one request
+	addChunk = 100
+)
+
+// Config configures access to an Apple Music account
+type Config struct {
+	// DeveloperToken is a MusicKit JWT signed with your Apple Developer
+	// MusicKit key
+	DeveloperToken string `yaml:"developerToken"`
+	// UserToken is the Music User Token of the account to export into, as
+	// issued by MusicKit JS to a signed in user
+	UserToken string `yaml:"userToken"`
+	// Storefront is the country code of the account's storefront, us if empty
+	Storefront string `yaml:"storefront"`
+}
+
+// Client calls the Apple Music API
+type Client struct {
+	baseURL    string
+	storefront string
+	developer  string
+	user       string
+	http       *http.Client
+}
+
+// New creates a Client for the account described by cfg
+func New(cfg Config) (*Client, error) {
+	if cfg.DeveloperToken == "" || cfg.UserToken == "" {
+		return nil, errors.New("appleMusic.developerToken and appleMusic.userToken are required")
+	}
+	storefront := cfg.Storefront
+	if storefront == "" {
+		storefront = "us"
+	}
+	return &Client{
+		baseURL:    baseURL,
+		storefront: storefront,
+		developer:  cfg.DeveloperToken,
+		user:       cfg.UserToken,
+		http:       &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// Song is a song in the Apple Music catalog
+type Song struct {
+	ID         string `json:"id"`
+	Attributes struct {
+		Name       string `json:"name"`
+		ArtistName string `json:"artistName"`
+		ISRC       string `json:"isrc"`
+	} `json:"attributes"`
+}
+
+// SongsByISRC looks songs up in the catalog by ISRC, returning the first
+// song found for each. ISRCs with no song are missing from the result.
+func (c *Client) SongsByISRC(isrcs ...string) (map[string]Song, error) {
+	songs := map[string]Song{}
+	for start := 0; start < len(isrcs); start += isrcChunk {
+		end := start + isrcChunk
+		if end > len(isrcs) {
+			end = len(isrcs)
+		}
+		q := url.Values{"filter[isrc]": {strings.Join(isrcs[start:end], ",")}}
+		var resp struct {
+			Data []Song `json:"data"`
+		}
+		if err := c.do(http.MethodGet, fmt.Sprintf("/catalog/%s/songs?%s", c.storefront, q.Encode()), nil, &resp); err != nil {
+			return nil, err
+		}
+		for _, s := range resp.Data {
+			isrc := strings.ToUpper(s.Attributes.ISRC)
+			if _, ok := songs[isrc]; !ok {
+				songs[isrc] = s
+			}
+		}
+	}
+	return songs, nil
+}
+
+// AddToLibrary adds catalog songs to the user's library
+func (c *Client) AddToLibrary(songIDs ...string) error {
+	for start := 0; start < len(songIDs); start += addChunk {
+		end := start + addChunk
+		if end > len(songIDs) {
+			end = len(songIDs)
+		}
+		q := url.Values{"ids[songs]": {strings.Join(songIDs[start:end], ",")}}
+		if err := c.do(http.MethodPost, "/me/library?"+q.Encode(), nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resource identifies a song in a request body
+type resource struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+func songResources(songIDs []string) []resource {
+	data := []resource{}
+	for _, id := range songIDs {
+		data = append(data, resource{ID: id, Type: "songs"})
+	}
+	return data
+}
+
+// CreatePlaylist creates a playlist in the user's library holding songs,
+// returning its library ID
+func (c *Client) CreatePlaylist(name, description string, songIDs ...string) (string, error) {
+	first := songIDs
+	if len(first) > addChunk {
+		first = first[:addChunk]
+	}
+	body := map[string]interface{}{
+		"attributes": map[string]string{"name": name, "description": description},
+		"relationships": map[string]interface{}{
+			"tracks": map[string]interface{}{"data": songResources(first)},
+		},
+	}
+	var resp struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := c.do(http.MethodPost, "/me/library/playlists", body, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.Data) == 0 {
+		return "", errors.New("apple music didn't return the created playlist")
+	}
+	id := resp.Data[0].ID
+	for start := addChunk; start < len(songIDs); start += addChunk {
+		end := start + addChunk
+		if end > len(songIDs) {
+			end = len(songIDs)
+		}
+		body := map[string]interface{}{"data": songResources(songIDs[start:end])}
+		if err := c.do(http.MethodPost, fmt.Sprintf("/me/library/playlists/%s/tracks", id), body, nil); err != nil {
+			return id, err
+		}
+	}
+	return id, nil
+}
+
+// do sends a request to path, decoding the response into result if not nil
+func (c *Client) do(method, path string, body, result interface{}) error {
+	var reqBody []byte
+	if body != nil {
+		var err error
+		if reqBody, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, c.baseURL+path, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.developer)
+	req.Header.Set("Music-User-Token", c.user)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	slurp, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("apple music %s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(slurp)))
+	}
+	if result == nil || len(slurp) == 0 {
+		return nil
+	}
+	return json.Unmarshal(slurp, result)
+}
@@ -0,0 +1,159 @@
+package applemusic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"potentials-utils/backup"
+	"potentials-utils/spotifyclient"
+	"potentials-utils/spotifytest"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// fakeAppleMusic serves a catalog in which every ISRC but those ending in 7
+// is a song, and records the songs added to the library and playlists
+type fakeAppleMusic struct {
+	mu        sync.Mutex
+	requests  []string
+	library   []string
+	playlists map[string][]string
+}
+
+func (f *fakeAppleMusic) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	if r.Header.Get("Authorization") != "Bearer dev" || r.Header.Get("Music-User-Token") != "user" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var body struct {
+		Data          []resource `json:"data"`
+		Relationships struct {
+			Tracks struct {
+				Data []resource `json:"data"`
+			} `json:"tracks"`
+		} `json:"relationships"`
+	}
+	if r.Method == http.MethodPost && r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&body)
+	}
+	ids := func(data []resource) []string {
+		songIDs := []string{}
+		for _, d := range data {
+			songIDs = append(songIDs, d.ID)
+		}
+		return songIDs
+	}
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/catalog/gb/songs":
+		isrcs := strings.Split(r.URL.Query().Get("filter[isrc]"), ",")
+		if len(isrcs) > isrcChunk {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		data := []map[string]interface{}{}
+		for _, isrc := range isrcs {
+			if !strings.HasSuffix(isrc, "7") {
+				data = append(data, map[string]interface{}{"id": "am" + isrc, "attributes": map[string]string{"isrc": isrc}})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	case r.Method == http.MethodPost && r.URL.Path == "/me/library":
+		f.library = append(f.library, strings.Split(r.URL.Query().Get("ids[songs]"), ",")...)
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodPost && r.URL.Path == "/me/library/playlists":
+		id := fmt.Sprintf("p.%d", len(f.playlists)+1)
+		f.playlists[id] = ids(body.Relationships.Tracks.Data)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": []map[string]string{{"id": id}}})
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/me/library/playlists/"):
+		id := strings.Split(r.URL.Path, "/")[4]
+		f.playlists[id] = append(f.playlists[id], ids(body.Data)...)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestExport(t *testing.T) {
+	ctx := context.Background()
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	tracks := []spotify.FullTrack{}
+	for ix := 0; ix < 130; ix++ {
+		track := spotifytest.Track(fmt.Sprintf("t%d", ix), fmt.Sprintf("Song %d", ix), "Album", "Artist")
+		if ix%10 != 5 {
+			track.ExternalIDs = map[string]string{"isrc": fmt.Sprintf("usabc%07d", ix)}
+		}
+		tracks = append(tracks, track)
+	}
+	srv.AddSavedTracks(tracks[:30]...)
+	srv.AddPlaylist("potentials", "Potentials", tracks...)
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err := backup.New(spotifyclient.New(srv.HTTPClient()), dir).All(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+
+	fake := &fakeAppleMusic{playlists: map[string][]string{}}
+	am := httptest.NewServer(fake)
+	defer am.Close()
+	client, err := New(Config{DeveloperToken: "dev", UserToken: "user", Storefront: "gb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.baseURL = am.URL
+	e := NewExporter(client, dir)
+
+	e.DryRun = true
+	r, err := e.Playlist("potentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 13 tracks have no ISRC and 13 more aren't in the catalog
+	if r.Tracks != 130 || r.Matched != 104 || len(r.Unmatched) != 26 || r.PlaylistID != "" {
+		t.Errorf("unexpected dry run report %+v", r)
+	}
+	for _, req := range fake.requests {
+		if req[:3] != "GET" {
+			t.Errorf("expected a dry run not to modify Apple Music, got %s", req)
+		}
+	}
+
+	e.DryRun = false
+	r, err = e.Playlist("potentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if songs := fake.playlists[r.PlaylistID]; len(songs) != 104 || songs[0] != "amUSABC0000000" || songs[103] != "amUSABC0000129" {
+		t.Errorf("expected the 104 matched songs in order in the created playlist, got %v", songs)
+	}
+	if u := r.Unmatched[0]; u.Track.ID != "t5" || u.Reason != "no ISRC" {
+		t.Errorf("unexpected first unmatched track %+v", u)
+	}
+
+	r, err = e.Library()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Matched != 24 || len(fake.library) != 24 {
+		t.Errorf("expected 24 saved tracks added to the library, got %+v %v", r, fake.library)
+	}
+
+	if _, err := e.Playlist("missing"); err == nil {
+		t.Errorf("expected an error exporting a playlist which wasn't backed up")
+	}
+}
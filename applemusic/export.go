@@ -0,0 +1,130 @@
+package applemusic
+
+import (
+	"fmt"
+	"strings"
+
+	"potentials-utils/backup"
+	"potentials-utils/library"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// Unmatched is a Spotify track which couldn't be found on Apple Music
+type Unmatched struct {
+	Track  spotify.FullTrack
+	Reason string
+}
+
+// Report describes the export of one playlist or of the saved tracks
+type Report struct {
+	Name    string
+	Tracks  int
+	Matched int
+	// Unmatched are the tracks left out of the export
+	Unmatched []Unmatched
+	// PlaylistID is the Apple Music library ID of the playlist created, empty
+	// for saved tracks and dry runs
+	PlaylistID string
+}
+
+// Exporter copies playlists and saved tracks from a backup into Apple Music
+type Exporter struct {
+	// DryRun matches tracks without modifying the Apple Music library
+	DryRun bool
+
+	client *Client
+	backup *backup.Backup
+}
+
+// NewExporter creates an Exporter from the backup in dir into the Apple Music
+// account client is authenticated as
+func NewExporter(client *Client, dir string) *Exporter {
+	return &Exporter{client: client, backup: backup.New(nil, dir)}
+}
+
+// Playlist creates an Apple Music playlist holding the tracks of the backed up
+// playlist id which are in the Apple Music catalog
+func (e *Exporter) Playlist(id spotify.ID) (*Report, error) {
+	manifest, err := e.backup.LoadManifest()
+	if err != nil {
+		return nil, err
+	}
+	entry, ok := manifest.Playlists[id]
+	if !ok {
+		return nil, fmt.Errorf("%s holds no backup of playlist %s", e.backup.Dir, id)
+	}
+	p, err := e.backup.LoadPlaylist(entry)
+	if err != nil {
+		return nil, err
+	}
+	tracks := []spotify.FullTrack{}
+	for _, t := range p.Tracks {
+		tracks = append(tracks, t.Track)
+	}
+	r := &Report{Name: p.Name}
+	songIDs, err := e.match(tracks, r)
+	if err != nil || e.DryRun || len(songIDs) == 0 {
+		return r, err
+	}
+	r.PlaylistID, err = e.client.CreatePlaylist(p.Name, p.Description, songIDs...)
+	return r, err
+}
+
+// Library adds the backed up saved tracks which are in the Apple Music catalog
+// to the Apple Music library
+func (e *Exporter) Library() (*Report, error) {
+	manifest, err := e.backup.LoadManifest()
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Library.File == "" {
+		return nil, fmt.Errorf("%s holds no backup of saved tracks", e.backup.Dir)
+	}
+	l, err := e.backup.LoadLibrary(manifest.Library)
+	if err != nil {
+		return nil, err
+	}
+	tracks := []spotify.FullTrack{}
+	for _, t := range l.Tracks {
+		tracks = append(tracks, t.FullTrack)
+	}
+	r := &Report{Name: "Saved tracks"}
+	songIDs, err := e.match(tracks, r)
+	if err != nil || e.DryRun {
+		return r, err
+	}
+	return r, e.client.AddToLibrary(songIDs...)
+}
+
+// match finds tracks in the Apple Music catalog by ISRC, returning the IDs of
+// the songs found in order and recording the rest in r
+func (e *Exporter) match(tracks []spotify.FullTrack, r *Report) ([]string, error) {
+	isrcs := []string{}
+	for _, t := range tracks {
+		if isrc := library.ISRC(t); isrc != "" {
+			isrcs = append(isrcs, strings.ToUpper(isrc))
+		}
+	}
+	songs, err := e.client.SongsByISRC(isrcs...)
+	if err != nil {
+		return nil, err
+	}
+	songIDs := []string{}
+	for _, t := range tracks {
+		r.Tracks++
+		isrc := strings.ToUpper(library.ISRC(t))
+		if isrc == "" {
+			r.Unmatched = append(r.Unmatched, Unmatched{Track: t, Reason: "no ISRC"})
+			continue
+		}
+		song, ok := songs[isrc]
+		if !ok {
+			r.Unmatched = append(r.Unmatched, Unmatched{Track: t, Reason: "not in the Apple Music catalog"})
+			continue
+		}
+		r.Matched++
+		songIDs = append(songIDs, song.ID)
+	}
+	return songIDs, nil
+}
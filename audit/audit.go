@@ -0,0 +1,161 @@
+// Package audit keeps an append-only log of everything potentials-utils
+// changes: tracks added to and removed from playlists and the library, with
+// the playlist versions the changes produced, authentication and library
+// cache rebuilds. Each event is a line of JSON, kept apart from the
+// application log so it can be kept for as long as it's needed. A nil Log
+// records nothing, so a Log can be passed around whether or not one is
+// configured.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/zmb3/spotify/v2"
+)
+
+// Config configures the audit log
+type Config struct {
+	// Path is the file events are appended to. Nothing is recorded if empty.
+	Path string `yaml:"path"`
+}
+
+// Kinds of event
+const (
+	PlaylistAdd    = "playlist.add"
+	PlaylistRemove = "playlist.remove"
+	PlaylistCreate = "playlist.create"
+	LibrarySave    = "library.save"
+	LibraryRemove  = "library.remove"
+	AuthLogin      = "auth.login"
+	AuthForget     = "auth.forget"
+	CacheRebuild   = "cache.rebuild"
+	// LibraryUnlike is a batch of saved tracks un-liked by library remove,
+	// recorded so the batch can be undone
+	LibraryUnlike = "library.unlike"
+	// LibraryUndoUnlike is tracks of an un-liked batch saved again
+	LibraryUndoUnlike = "library.undo-unlike"
+)
+
+// Event is a change potentials-utils made, or tried to make
+type Event struct {
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+	// Command is what was being run, e.g. clean --force
+	Command    string     `json:"command,omitempty"`
+	PlaylistID spotify.ID `json:"playlistID,omitempty"`
+	// SnapshotID is the version of the playlist the change produced
+	SnapshotID string       `json:"snapshotID,omitempty"`
+	Tracks     []spotify.ID `json:"tracks,omitempty"`
+	// Positions are where in the playlist tracks were removed from or
+	// inserted at, if the change was positional
+	Positions []int `json:"positions,omitempty"`
+	// Batch groups the changes of one operation which can be undone as a
+	// whole, e.g. a library remove
+	Batch string `json:"batch,omitempty"`
+	// AddedAt are when each of the tracks was originally saved, for tracks
+	// un-liked from the library
+	AddedAt []string `json:"addedAt,omitempty"`
+	// Detail describes the change further, e.g. how potentials-utils
+	// authenticated
+	Detail string `json:"detail,omitempty"`
+	// Error is why the change failed, if it did. Failed changes are recorded
+	// too as Spotify may have made them anyway, e.g. if the call timed out.
+	Error string `json:"error,omitempty"`
+}
+
+// Log appends events to a JSON lines file
+type Log struct {
+	// Command is recorded with every event which doesn't say
+	Command string
+
+	path string
+	mu   sync.Mutex
+	now  func() time.Time
+}
+
+// New creates a Log appending to the file at path, which is created along
+// with its directory on the first event
+func New(path string) *Log {
+	return &Log{path: path, now: time.Now}
+}
+
+// Record appends e to the log, timestamped now if it isn't already
+func (l *Log) Record(e Event) error {
+	if l == nil {
+		return nil
+	}
+	if e.Time.IsZero() {
+		e.Time = l.now().UTC()
+	}
+	if e.Command == "" {
+		e.Command = l.Command
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(l.path), 0700); err != nil {
+		return err
+	}
+	// Appending each event with one write keeps lines whole even if more than
+	// one potentials-utils is recording at once
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// RecordOrWarn records e, logging rather than returning a failure to, as the
+// change being recorded has already been made
+func (l *Log) RecordOrWarn(e Event) {
+	if err := l.Record(e); err != nil {
+		log.WithFields(log.Fields{"kind": e.Kind, "auditLog": l.path, "err": err}).Warn("failed to record an audit event")
+	}
+}
+
+// Events reads back every event recorded, oldest first. A nil Log has none.
+func (l *Log) Events() ([]Event, error) {
+	if l == nil {
+		return nil, nil
+	}
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	events := []Event{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, scanner.Err()
+}
+
+// ErrorString is err's message, or empty if nil, for Event.Error
+func ErrorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,48 @@
+package audit
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+func TestRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l := New(filepath.Join(dir, "logs", "audit.jsonl"))
+	l.Command = "clean"
+	at := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return at }
+
+	// A nil log records nothing
+	var none *Log
+	if err := none.Record(Event{Kind: AuthLogin}); err != nil {
+		t.Errorf("expected a nil log to record nothing, got %v", err)
+	}
+	l.RecordOrWarn(Event{Kind: PlaylistRemove, PlaylistID: "potentials", SnapshotID: "s2", Tracks: []spotify.ID{"t1"}})
+	l.RecordOrWarn(Event{Kind: LibraryRemove, Command: "library remove", Tracks: []spotify.ID{"t2"}, Error: ErrorString(errors.New("rate limited"))})
+
+	events, err := l.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Event{
+		{Time: at, Kind: PlaylistRemove, Command: "clean", PlaylistID: "potentials", SnapshotID: "s2", Tracks: []spotify.ID{"t1"}},
+		{Time: at, Kind: LibraryRemove, Command: "library remove", Tracks: []spotify.ID{"t2"}, Error: "rate limited"},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected %+v, got %+v", expected, events)
+	}
+	if info, err := os.Stat(l.path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected the audit log readable only by its owner, got %v, %v", info, err)
+	}
+}
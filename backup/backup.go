@@ -0,0 +1,325 @@
+// Package backup snapshots the playlists a user owns and their saved tracks
+// into a directory of JSON files, for safekeeping or for restoring into
+// another account.
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/zmb3/spotify/v2"
+)
+
+// FormatVersion is the version of the backup file format written by this
+// package. It's recorded in every file so later versions can read older
+// backups.
+const FormatVersion = 1
+
+const (
+	manifestFile = "manifest.json"
+	libraryFile  = "library.json"
+	playlistsDir = "playlists"
+)
+
+// API is the view of the Spotify API needed to back up an account
+type API interface {
+	CurrentUser(ctx context.Context) (*spotify.PrivateUser, error)
+	Playlists(ctx context.Context) (*spotify.SimplePlaylistPage, error)
+	NextPlaylists(ctx context.Context, page *spotify.SimplePlaylistPage) error
+	GetPlaylist(ctx context.Context, playlistID spotify.ID) (*spotify.FullPlaylist, error)
+	NextPlaylistTracks(ctx context.Context, page *spotify.PlaylistTrackPage) error
+	SavedTracks(ctx context.Context) (*spotify.SavedTrackPage, error)
+	NextSavedTracks(ctx context.Context, page *spotify.SavedTrackPage) error
+}
+
+// Manifest describes the contents of a backup directory
+type Manifest struct {
+	Version   int       `json:"version"`
+	User      string    `json:"user"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	Library   Entry     `json:"library"`
+	// Playlists are the backed up playlists by ID
+	Playlists map[spotify.ID]PlaylistEntry `json:"playlists"`
+}
+
+// Entry describes one file of a backup
+type Entry struct {
+	// File is the path of the file relative to the backup directory
+	File       string    `json:"file"`
+	Tracks     int       `json:"tracks"`
+	BackedUpAt time.Time `json:"backedUpAt"`
+}
+
+// PlaylistEntry describes the backup of one playlist
+type PlaylistEntry struct {
+	Entry
+	Name       string `json:"name"`
+	SnapshotID string `json:"snapshotID"`
+	// RemovedAt is when the playlist was found to be gone from the account.
+	// Its last backup is kept.
+	RemovedAt *time.Time `json:"removedAt,omitempty"`
+}
+
+// Playlist is the backup of one playlist
+type Playlist struct {
+	Version       int                     `json:"version"`
+	ID            spotify.ID              `json:"id"`
+	Name          string                  `json:"name"`
+	Description   string                  `json:"description,omitempty"`
+	Public        bool                    `json:"public"`
+	Collaborative bool                    `json:"collaborative"`
+	SnapshotID    string                  `json:"snapshotID"`
+	BackedUpAt    time.Time               `json:"backedUpAt"`
+	Tracks        []spotify.PlaylistTrack `json:"tracks"`
+}
+
+// Library is the backup of the user's saved tracks
+type Library struct {
+	Version    int                  `json:"version"`
+	BackedUpAt time.Time            `json:"backedUpAt"`
+	Tracks     []spotify.SavedTrack `json:"tracks"`
+}
+
+// Summary counts what a backup wrote
+type Summary struct {
+	PlaylistsWritten   int
+	PlaylistsUnchanged int
+	PlaylistsRemoved   int
+	LibraryWritten     bool
+}
+
+// Backup writes backups of an account into a directory
+type Backup struct {
+	Dir    string
+	client API
+}
+
+// New creates a Backup of the account client is authenticated as into dir
+func New(client API, dir string) *Backup {
+	return &Backup{Dir: dir, client: client}
+}
+
+// All backs up the saved tracks and every playlist the user owns. If
+// incremental, playlists whose snapshot ID hasn't changed since the last
+// backup are left alone, as are saved tracks if their count and most recently
+// saved track are unchanged.
+func (b *Backup) All(ctx context.Context, incremental bool) (*Summary, error) {
+	user, err := b.client.CurrentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := b.LoadManifest()
+	if err != nil {
+		return nil, err
+	}
+	if manifest.User != "" && manifest.User != user.ID {
+		return nil, fmt.Errorf("%s holds a backup of %s, not %s", b.Dir, manifest.User, user.ID)
+	}
+	manifest.User = user.ID
+	summary := &Summary{}
+
+	owned, err := b.ownedPlaylists(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, p := range owned {
+		last, ok := manifest.Playlists[p.ID]
+		if incremental && ok && last.RemovedAt == nil && last.SnapshotID == p.SnapshotID && b.exists(last.File) {
+			summary.PlaylistsUnchanged++
+			continue
+		}
+		entry, err := b.backupPlaylist(ctx, p.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to back up playlist %s: %w", p.Name, err)
+		}
+		log.WithFields(log.Fields{"playlistID": p.ID, "tracks": entry.Tracks}).Info("backed up playlist")
+		manifest.Playlists[p.ID] = *entry
+		summary.PlaylistsWritten++
+	}
+	for id, entry := range manifest.Playlists {
+		if _, ok := owned[id]; !ok && entry.RemovedAt == nil {
+			entry.RemovedAt = &now
+			manifest.Playlists[id] = entry
+			summary.PlaylistsRemoved++
+		}
+	}
+
+	written, err := b.backupLibrary(ctx, manifest, incremental)
+	if err != nil {
+		return nil, fmt.Errorf("failed to back up saved tracks: %w", err)
+	}
+	summary.LibraryWritten = written
+	manifest.UpdatedAt = now
+	if err := b.write(manifestFile, manifest); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// LoadManifest reads the backup directory's manifest, which is empty if
+// nothing has been backed up there yet
+func (b *Backup) LoadManifest() (*Manifest, error) {
+	m := &Manifest{Version: FormatVersion, Playlists: map[spotify.ID]PlaylistEntry{}}
+	if err := b.read(manifestFile, m); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if m.Version > FormatVersion {
+		return nil, fmt.Errorf("backup format version %d is newer than this potentials-utils supports (%d)", m.Version, FormatVersion)
+	}
+	if m.Playlists == nil {
+		m.Playlists = map[spotify.ID]PlaylistEntry{}
+	}
+	return m, nil
+}
+
+// LoadPlaylist reads the backup of a playlist described by the manifest
+func (b *Backup) LoadPlaylist(entry PlaylistEntry) (*Playlist, error) {
+	p := &Playlist{}
+	if err := b.read(entry.File, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// LoadLibrary reads the backup of the saved tracks described by the manifest
+func (b *Backup) LoadLibrary(entry Entry) (*Library, error) {
+	l := &Library{}
+	if err := b.read(entry.File, l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// ownedPlaylists returns every playlist owned by user by ID
+func (b *Backup) ownedPlaylists(ctx context.Context, user string) (map[spotify.ID]spotify.SimplePlaylist, error) {
+	owned := map[spotify.ID]spotify.SimplePlaylist{}
+	page, err := b.client.Playlists(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		for _, p := range page.Playlists {
+			if p.Owner.ID == user {
+				owned[p.ID] = p
+			}
+		}
+		if err := b.client.NextPlaylists(ctx, page); err == spotify.ErrNoMorePages {
+			return owned, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (b *Backup) backupPlaylist(ctx context.Context, id spotify.ID) (*PlaylistEntry, error) {
+	full, err := b.client.GetPlaylist(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	p := Playlist{
+		Version:       FormatVersion,
+		ID:            full.ID,
+		Name:          full.Name,
+		Description:   full.Description,
+		Public:        full.IsPublic,
+		Collaborative: full.Collaborative,
+		SnapshotID:    full.SnapshotID,
+		BackedUpAt:    time.Now(),
+	}
+	page := &full.Tracks
+	for {
+		p.Tracks = append(p.Tracks, page.Tracks...)
+		if err := b.client.NextPlaylistTracks(ctx, page); err == spotify.ErrNoMorePages {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	file := filepath.Join(playlistsDir, string(id)+".json")
+	if err := b.write(file, p); err != nil {
+		return nil, err
+	}
+	return &PlaylistEntry{
+		Entry:      Entry{File: file, Tracks: len(p.Tracks), BackedUpAt: p.BackedUpAt},
+		Name:       p.Name,
+		SnapshotID: p.SnapshotID,
+	}, nil
+}
+
+// backupLibrary writes the saved tracks, returning false if incremental and
+// they're unchanged since the last backup
+func (b *Backup) backupLibrary(ctx context.Context, manifest *Manifest, incremental bool) (bool, error) {
+	page, err := b.client.SavedTracks(ctx)
+	if err != nil {
+		return false, err
+	}
+	if incremental && manifest.Library.File != "" && b.exists(manifest.Library.File) {
+		var last Library
+		if err := b.read(manifest.Library.File, &last); err != nil {
+			return false, err
+		}
+		if len(last.Tracks) == int(page.Total) && (page.Total == 0 || len(page.Tracks) > 0 && page.Tracks[0].ID == last.Tracks[0].ID) {
+			return false, nil
+		}
+	}
+	l := Library{Version: FormatVersion, BackedUpAt: time.Now()}
+	for {
+		l.Tracks = append(l.Tracks, page.Tracks...)
+		if err := b.client.NextSavedTracks(ctx, page); err == spotify.ErrNoMorePages {
+			break
+		} else if err != nil {
+			return false, err
+		}
+	}
+	if err := b.write(libraryFile, l); err != nil {
+		return false, err
+	}
+	manifest.Library = Entry{File: libraryFile, Tracks: len(l.Tracks), BackedUpAt: l.BackedUpAt}
+	return true, nil
+}
+
+func (b *Backup) exists(file string) bool {
+	_, err := os.Stat(filepath.Join(b.Dir, file))
+	return err == nil
+}
+
+func (b *Backup) read(file string, v interface{}) error {
+	slurp, err := ioutil.ReadFile(filepath.Join(b.Dir, file))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(slurp, v)
+}
+
+// write replaces file with v as JSON, atomically so an interrupted backup
+// never leaves a file half written
+func (b *Backup) write(file string, v interface{}) error {
+	bytes, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(b.Dir, file)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".backup-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(bytes); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,168 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"potentials-utils/spotifyclient"
+	"potentials-utils/spotifytest"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+func TestAll(t *testing.T) {
+	ctx := context.Background()
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	tracks := []spotify.FullTrack{}
+	for ix := 0; ix < 130; ix++ {
+		tracks = append(tracks, spotifytest.Track(fmt.Sprintf("t%d", ix), fmt.Sprintf("Song %d", ix), "Album", "Artist"))
+	}
+	srv.AddSavedTracks(tracks[:60]...)
+	srv.AddPlaylist("potentials", "Potentials", tracks...)
+	srv.AddPlaylist("mix", "Mix", tracks[:5]...)
+	srv.AddPlaylist("theirs", "Someone Else's", tracks[:3]...)
+	srv.SetPlaylistOwner("theirs", "someoneelse")
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b := New(spotifyclient.New(srv.HTTPClient()), dir)
+
+	testCases := []struct {
+		name        string
+		change      func()
+		incremental bool
+		expected    Summary
+	}{
+		{
+			name:        "first backup",
+			incremental: true,
+			expected:    Summary{PlaylistsWritten: 2, LibraryWritten: true},
+		},
+		{
+			name:        "nothing changed",
+			incremental: true,
+			expected:    Summary{PlaylistsUnchanged: 2},
+		},
+		{
+			name:        "playlist changed",
+			change:      func() { srv.AddPlaylist("mix", "Mix", tracks[:6]...) },
+			incremental: true,
+			expected:    Summary{PlaylistsWritten: 1, PlaylistsUnchanged: 1},
+		},
+		{
+			name:        "track saved",
+			change:      func() { srv.AddSavedTracks(tracks[100]) },
+			incremental: true,
+			expected:    Summary{PlaylistsUnchanged: 2, LibraryWritten: true},
+		},
+		{
+			name:     "full backup",
+			expected: Summary{PlaylistsWritten: 2, LibraryWritten: true},
+		},
+	}
+	for _, tc := range testCases {
+		if tc.change != nil {
+			tc.change()
+		}
+		summary, err := b.All(ctx, tc.incremental)
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		if *summary != tc.expected {
+			t.Errorf("%s failed: expected %+v, got %+v", tc.name, tc.expected, *summary)
+		}
+	}
+
+	m, err := b.LoadManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.User != spotifytest.UserID || len(m.Playlists) != 2 || m.Library.Tracks != 61 {
+		t.Errorf("unexpected manifest %+v", m)
+	}
+	var p Playlist
+	if err := b.read(m.Playlists["potentials"].File, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Version != FormatVersion || len(p.Tracks) != 130 || p.Tracks[129].Track.ID != "t129" {
+		t.Errorf("expected all 130 Potentials tracks to be backed up, got %d", len(p.Tracks))
+	}
+}
+
+func TestRestore(t *testing.T) {
+	ctx := context.Background()
+	from := spotifytest.NewServer()
+	defer from.Close()
+	tracks := []spotify.FullTrack{}
+	for ix := 0; ix < 130; ix++ {
+		tracks = append(tracks, spotifytest.Track(fmt.Sprintf("t%d", ix), fmt.Sprintf("Song %d", ix), "Album", "Artist"))
+	}
+	from.AddSavedTracks(tracks[:60]...)
+	from.AddPlaylist("potentials", "Potentials", tracks...)
+	from.AddPlaylist("mix", "Mix", tracks[:5]...)
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err := New(spotifyclient.New(from.HTTPClient()), dir).All(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+
+	to := spotifytest.NewServer()
+	defer to.Close()
+	to.AddTracks(tracks...)
+	r := NewRestore(spotifyclient.New(to.HTTPClient()), dir)
+
+	r.DryRun = true
+	summary, err := r.All(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := RestoreSummary{PlaylistsCreated: 2, TracksAdded: 135, TracksSaved: 60}
+	if *summary != expected {
+		t.Errorf("expected dry run to report %+v, got %+v", expected, *summary)
+	}
+	for _, req := range to.Requests() {
+		if req[:3] != "GET" {
+			t.Errorf("expected a dry run not to modify Spotify, got %s", req)
+		}
+	}
+
+	// Fail part way through the Potentials playlist
+	r.DryRun = false
+	to.Fault = func(req *http.Request) int {
+		if req.Method == http.MethodPost && len(to.PlaylistTrackIDs("created2")) == 100 {
+			return http.StatusBadGateway
+		}
+		return 0
+	}
+	if _, err := r.All(ctx); err == nil {
+		t.Fatal("expected the restore to fail part way")
+	}
+	to.Fault = nil
+	if _, err := r.All(ctx); err != nil {
+		t.Fatal(err)
+	}
+	summary, err = r.All(ctx)
+	if err != nil || *summary != (RestoreSummary{}) {
+		t.Errorf("expected a finished restore to do nothing when run again, got %+v %v", summary, err)
+	}
+
+	if ids := to.PlaylistTrackIDs("created1"); len(ids) != 5 || ids[4] != "t4" {
+		t.Errorf("expected Mix to be restored, got %v", ids)
+	}
+	if ids := to.PlaylistTrackIDs("created2"); len(ids) != 130 || ids[129] != "t129" {
+		t.Errorf("expected all 130 Potentials tracks to be restored once, got %d", len(ids))
+	}
+	if ids := to.SavedTrackIDs(); len(ids) != 60 || ids[0] != "t0" || ids[59] != "t59" {
+		t.Errorf("expected the saved tracks to be restored in order, got %v", ids)
+	}
+}
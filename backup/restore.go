@@ -0,0 +1,243 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/zmb3/spotify/v2"
+)
+
+const (
+	// playlistChunk and libraryChunk are the most tracks Spotify accepts per
+	// call when adding to a playlist and saving to the library
+	playlistChunk = 100
+	libraryChunk  = 50
+)
+
+// RestoreAPI is the view of the Spotify API needed to restore a backup into
+// an account
+type RestoreAPI interface {
+	CurrentUser(ctx context.Context) (*spotify.PrivateUser, error)
+	CreatePlaylistForUser(ctx context.Context, userID, playlistName, description string, public bool) (*spotify.FullPlaylist, error)
+	AddTracksToPlaylist(ctx context.Context, playlistID spotify.ID, trackIDs ...spotify.ID) (string, error)
+	AddTracksToLibrary(ctx context.Context, ids ...spotify.ID) error
+}
+
+// Progress records how far a restore into one account got, so a restore
+// which failed part way can be run again without duplicating anything
+type Progress struct {
+	Version int    `json:"version"`
+	User    string `json:"user"`
+	// Playlists are the restored playlists by the ID they were backed up
+	// under
+	Playlists map[spotify.ID]RestoredPlaylist `json:"playlists"`
+	// SavedTracks is how many of the backed up saved tracks, oldest first,
+	// have been saved again
+	SavedTracks int       `json:"savedTracks"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// RestoredPlaylist is the progress of restoring one playlist
+type RestoredPlaylist struct {
+	// ID is the ID of the playlist created in the account restored into
+	ID spotify.ID `json:"id"`
+	// Tracks is how many of the backed up tracks have been added to it
+	Tracks int `json:"tracks"`
+}
+
+// RestoreSummary counts what a restore did, or would do in a dry run
+type RestoreSummary struct {
+	PlaylistsCreated int
+	TracksAdded      int
+	TracksSaved      int
+	// TracksSkipped are local files and tracks no longer on Spotify, which
+	// can't be restored
+	TracksSkipped int
+}
+
+// Restore pushes a backup into an account, which needn't be the one it was
+// taken of
+type Restore struct {
+	// DryRun counts what would be restored without modifying the account
+	DryRun bool
+	// IncludeRemoved also restores playlists which had been deleted from the
+	// backed up account
+	IncludeRemoved bool
+	// SkipLibrary leaves the account's saved tracks alone
+	SkipLibrary bool
+
+	backup *Backup
+	client RestoreAPI
+}
+
+// NewRestore creates a Restore of the backup in dir into the account client
+// is authenticated as
+func NewRestore(client RestoreAPI, dir string) *Restore {
+	return &Restore{backup: &Backup{Dir: dir}, client: client}
+}
+
+// All recreates every backed up playlist and saves every backed up track.
+// Progress is recorded in the backup directory, so running All again after a
+// failure picks up where it left off, and running it again after a success
+// does nothing.
+func (r *Restore) All(ctx context.Context) (*RestoreSummary, error) {
+	user, err := r.client.CurrentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := r.backup.LoadManifest()
+	if err != nil {
+		return nil, err
+	}
+	if manifest.User == "" {
+		return nil, fmt.Errorf("%s doesn't hold a backup", r.backup.Dir)
+	}
+	progress, err := r.loadProgress(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	summary := &RestoreSummary{}
+
+	// Restore in a stable order so a dry run lists what a real run would do
+	ids := []spotify.ID{}
+	for id, entry := range manifest.Playlists {
+		if entry.RemovedAt == nil || r.IncludeRemoved {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		if err := r.restorePlaylist(ctx, manifest.Playlists[id], id, user.ID, progress, summary); err != nil {
+			return summary, fmt.Errorf("failed to restore playlist %s: %w", manifest.Playlists[id].Name, err)
+		}
+	}
+	if !r.SkipLibrary && manifest.Library.File != "" {
+		if err := r.restoreLibrary(ctx, manifest.Library, progress, summary); err != nil {
+			return summary, fmt.Errorf("failed to restore saved tracks: %w", err)
+		}
+	}
+	return summary, nil
+}
+
+func (r *Restore) restorePlaylist(ctx context.Context, entry PlaylistEntry, id spotify.ID, user string, progress *Progress, summary *RestoreSummary) error {
+	p, err := r.backup.LoadPlaylist(entry)
+	if err != nil {
+		return err
+	}
+	trackIDs, skipped := restorableIDs(p.Tracks)
+	restored, ok := progress.Playlists[id]
+	if !ok {
+		summary.TracksSkipped += skipped
+		summary.PlaylistsCreated++
+		if !r.DryRun {
+			created, err := r.client.CreatePlaylistForUser(ctx, user, p.Name, p.Description, p.Public)
+			if err != nil {
+				return err
+			}
+			restored = RestoredPlaylist{ID: created.ID}
+			if err := r.record(progress, id, restored); err != nil {
+				return err
+			}
+			log.WithFields(log.Fields{"playlistID": id, "createdID": created.ID}).Info("created playlist")
+		}
+	}
+	for restored.Tracks < len(trackIDs) {
+		chunk := trackIDs[restored.Tracks:min(restored.Tracks+playlistChunk, len(trackIDs))]
+		summary.TracksAdded += len(chunk)
+		restored.Tracks += len(chunk)
+		if r.DryRun {
+			continue
+		}
+		if _, err := r.client.AddTracksToPlaylist(ctx, restored.ID, chunk...); err != nil {
+			return err
+		}
+		if err := r.record(progress, id, restored); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreLibrary saves the backed up tracks oldest first, so they end up in
+// the same order in the library
+func (r *Restore) restoreLibrary(ctx context.Context, entry Entry, progress *Progress, summary *RestoreSummary) error {
+	l, err := r.backup.LoadLibrary(entry)
+	if err != nil {
+		return err
+	}
+	ids := []spotify.ID{}
+	for ix := len(l.Tracks) - 1; ix >= 0; ix-- {
+		if l.Tracks[ix].ID != "" {
+			ids = append(ids, l.Tracks[ix].ID)
+		}
+	}
+	if progress.SavedTracks == 0 {
+		summary.TracksSkipped += len(l.Tracks) - len(ids)
+	}
+	for progress.SavedTracks < len(ids) {
+		chunk := ids[progress.SavedTracks:min(progress.SavedTracks+libraryChunk, len(ids))]
+		summary.TracksSaved += len(chunk)
+		if r.DryRun {
+			progress.SavedTracks += len(chunk)
+			continue
+		}
+		if err := r.client.AddTracksToLibrary(ctx, chunk...); err != nil {
+			return err
+		}
+		progress.SavedTracks += len(chunk)
+		if err := r.saveProgress(progress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restorableIDs returns the IDs of the tracks which can be added to a
+// playlist, and how many can't
+func restorableIDs(tracks []spotify.PlaylistTrack) ([]spotify.ID, int) {
+	ids := []spotify.ID{}
+	for _, t := range tracks {
+		if !t.IsLocal && t.Track.ID != "" {
+			ids = append(ids, t.Track.ID)
+		}
+	}
+	return ids, len(tracks) - len(ids)
+}
+
+func progressFile(user string) string {
+	return fmt.Sprintf("restored-%s.json", user)
+}
+
+// loadProgress reads the progress of restoring into user's account, which is
+// empty if nothing has been restored there yet
+func (r *Restore) loadProgress(user string) (*Progress, error) {
+	p := &Progress{Version: FormatVersion, User: user, Playlists: map[spotify.ID]RestoredPlaylist{}}
+	if err := r.backup.read(progressFile(user), p); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if p.Playlists == nil {
+		p.Playlists = map[spotify.ID]RestoredPlaylist{}
+	}
+	return p, nil
+}
+
+func (r *Restore) record(progress *Progress, id spotify.ID, restored RestoredPlaylist) error {
+	progress.Playlists[id] = restored
+	return r.saveProgress(progress)
+}
+
+func (r *Restore) saveProgress(progress *Progress) error {
+	progress.UpdatedAt = time.Now()
+	return r.backup.write(progressFile(progress.User), progress)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -1,3 +1,3 @@
 #!/bin/bash
 
-bin/potentials-utils --runserver
+bin/potentials-utils serve
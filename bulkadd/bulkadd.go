@@ -0,0 +1,153 @@
+// Package bulkadd adds lists of tracks, e.g. links pasted from chats, to a
+// playlist, skipping tracks which are already saved or in the playlist.
+package bulkadd
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/url"
+	"strings"
+
+	"potentials-utils/dedupe"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// API is the view of the Spotify API needed to add tracks to a playlist
+type API interface {
+	GetPlaylist(ctx context.Context, playlistID spotify.ID) (*spotify.FullPlaylist, error)
+	NextPlaylistTracks(ctx context.Context, page *spotify.PlaylistTrackPage) error
+	AddTracksToPlaylist(ctx context.Context, playlistID spotify.ID, trackIDs ...spotify.ID) (string, error)
+}
+
+// ParseTrackIDs reads one track per line as an open.spotify.com link, a
+// spotify:track: URI or a bare ID, returning the IDs in order without
+// repeats. Blank lines and lines starting with # are ignored. Lines which
+// aren't tracks, such as links to albums, are returned as invalid.
+func ParseTrackIDs(r io.Reader) (ids []spotify.ID, invalid []string, err error) {
+	seen := map[spotify.ID]bool{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, ok := ParseTrackID(line)
+		if !ok {
+			invalid = append(invalid, line)
+			continue
+		}
+		if !seen[id] {
+			ids = append(ids, id)
+			seen[id] = true
+		}
+	}
+	return ids, invalid, scanner.Err()
+}
+
+// ParseTrackID returns the ID of the track an open.spotify.com link,
+// spotify:track: URI or bare ID refers to
+func ParseTrackID(s string) (spotify.ID, bool) {
+	var id string
+	switch {
+	case strings.HasPrefix(s, "spotify:track:"):
+		id = strings.TrimPrefix(s, "spotify:track:")
+	case strings.Contains(s, "://"):
+		u, err := url.Parse(s)
+		if err != nil || u.Host != "open.spotify.com" {
+			return "", false
+		}
+		// Links may have a locale before the type, e.g. /intl-de/track/ID
+		parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+		if len(parts) < 2 || parts[len(parts)-2] != "track" {
+			return "", false
+		}
+		id = parts[len(parts)-1]
+	default:
+		id = s
+	}
+	if !isBase62(id) {
+		return "", false
+	}
+	return spotify.ID(id), true
+}
+
+// isBase62 returns whether s looks like a Spotify ID
+func isBase62(s string) bool {
+	if len(s) != 22 {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// Result is what Add did with each track
+type Result struct {
+	Added      []spotify.ID
+	InLibrary  []spotify.ID
+	InPlaylist []spotify.ID
+}
+
+// Add adds the tracks with the given IDs to a playlist, skipping those saved
+// in lib or already in the playlist. Tracks are added in order, 100 at a time.
+// Nothing is added on a dry run.
+func Add(ctx context.Context, client API, lib dedupe.Library, playlistID spotify.ID, ids []spotify.ID, dryRun bool) (Result, error) {
+	r := Result{}
+	inPlaylist, err := playlistTrackIDs(ctx, client, playlistID)
+	if err != nil {
+		return r, err
+	}
+	toAdd := []spotify.ID{}
+	for _, id := range ids {
+		saved, err := lib.GetByID(id)
+		if err != nil {
+			return r, err
+		}
+		switch {
+		case saved != nil:
+			r.InLibrary = append(r.InLibrary, id)
+		case inPlaylist[id]:
+			r.InPlaylist = append(r.InPlaylist, id)
+		default:
+			toAdd = append(toAdd, id)
+		}
+	}
+	if dryRun {
+		r.Added = toAdd
+		return r, nil
+	}
+	for len(toAdd) > 0 {
+		var chunk []spotify.ID
+		chunk, toAdd = dedupe.FirstNIDs(toAdd, 100)
+		if _, err := client.AddTracksToPlaylist(ctx, playlistID, chunk...); err != nil {
+			return r, err
+		}
+		r.Added = append(r.Added, chunk...)
+	}
+	return r, nil
+}
+
+// playlistTrackIDs returns the IDs of every track in a playlist
+func playlistTrackIDs(ctx context.Context, client API, playlistID spotify.ID) (map[spotify.ID]bool, error) {
+	ids := map[spotify.ID]bool{}
+	playlist, err := client.GetPlaylist(ctx, playlistID)
+	if err != nil {
+		return nil, err
+	}
+	page := &playlist.Tracks
+	for {
+		for _, t := range page.Tracks {
+			ids[t.Track.ID] = true
+		}
+		if err := client.NextPlaylistTracks(ctx, page); err == spotify.ErrNoMorePages {
+			return ids, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
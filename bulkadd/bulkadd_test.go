@@ -0,0 +1,94 @@
+package bulkadd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"potentials-utils/library"
+	"potentials-utils/spotifyclient"
+	"potentials-utils/spotifytest"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+func TestParseTrackIDs(t *testing.T) {
+	in := strings.Join([]string{
+		"# from the group chat",
+		"https://open.spotify.com/track/4uLU6hMCjMI75M1A2tKUQC?si=abc123",
+		"",
+		"  spotify:track:7GhIk7Il098yCjg4BQjzvb  ",
+		"https://open.spotify.com/intl-de/track/0VjIjW4GlUZAMYd2vXMi3b",
+		"4uLU6hMCjMI75M1A2tKUQC",
+		"https://open.spotify.com/album/4aawyAB9vmqN3uQ7FjRGTy",
+		"https://example.com/track/4uLU6hMCjMI75M1A2tKUQC",
+		"spotify:track:tooshort",
+	}, "\n")
+	ids, invalid, err := ParseTrackIDs(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []spotify.ID{"4uLU6hMCjMI75M1A2tKUQC", "7GhIk7Il098yCjg4BQjzvb", "0VjIjW4GlUZAMYd2vXMi3b"}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("expected %v, got %v", expected, ids)
+	}
+	if len(invalid) != 3 {
+		t.Errorf("expected the album, other site and short ID to be invalid, got %q", invalid)
+	}
+}
+
+func TestAdd(t *testing.T) {
+	ctx := context.Background()
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	srv.AddSavedTracks(spotifytest.Track("saved", "Saved", "Album", "Artist"))
+	srv.AddPlaylist("potentials", "Potentials", spotifytest.Track("queued", "Queued", "Album", "Artist"))
+	dir, err := ioutil.TempDir("", "bulkadd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := spotifyclient.New(srv.HTTPClient())
+	lib, err := library.NewLibraryService(client, library.CacheConfig{CacheDir: dir, Lifetime: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []spotify.ID{"saved", "queued"}
+	for ix := 0; ix < 150; ix++ {
+		ids = append(ids, spotify.ID(fmt.Sprintf("new%d", ix)))
+	}
+	r, err := Add(ctx, client, lib, "potentials", ids, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Added) != 150 || len(srv.PlaylistTrackIDs("potentials")) != 1 {
+		t.Errorf("expected a dry run to add nothing but report 150 tracks, got %d", len(r.Added))
+	}
+
+	r, err = Add(ctx, client, lib, "potentials", ids, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r.InLibrary, []spotify.ID{"saved"}) || !reflect.DeepEqual(r.InPlaylist, []spotify.ID{"queued"}) {
+		t.Errorf("expected the saved and queued tracks to be skipped, got %+v", r)
+	}
+	got := srv.PlaylistTrackIDs("potentials")
+	if len(r.Added) != 150 || len(got) != 151 || got[1] != "new0" || got[150] != "new149" {
+		t.Errorf("expected 150 tracks added in order, got %d: %v", len(r.Added), got)
+	}
+	adds := 0
+	for _, req := range srv.Requests() {
+		if strings.HasPrefix(req, "POST /v1/playlists/potentials/tracks") {
+			adds++
+		}
+	}
+	if adds != 2 {
+		t.Errorf("expected tracks to be added 100 at a time, got %d requests", adds)
+	}
+}
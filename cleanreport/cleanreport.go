@@ -0,0 +1,115 @@
+// Package cleanreport records what cleans decided to do with every duplicate
+// and writes it as JSON, CSV or a text table, so proposed removals can be
+// reviewed and diffed before cleaning for real.
+package cleanreport
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"potentials-utils/dedupe"
+	"potentials-utils/library"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// Formats are the formats a report can be written in
+var Formats = []string{"json", "csv", "text"}
+
+// Entry is what a clean decided to do with one duplicate
+type Entry struct {
+	PlaylistID spotify.ID `json:"playlistID"`
+	// Position is the 0-based position of the track in the playlist when it
+	// was found
+	Position int        `json:"position"`
+	TrackID  spotify.ID `json:"trackID"`
+	Track    string     `json:"track"`
+	Artists  []string   `json:"artists"`
+	Album    string     `json:"album"`
+	Matcher  string     `json:"matcher"`
+	Reason   string     `json:"reason"`
+	Score    float64    `json:"score"`
+	Action   string     `json:"action"`
+}
+
+// Recorder is dedupe.Decisions keeping every decision for a report
+type Recorder struct {
+	mu      sync.Mutex
+	entries []Entry
+}
+
+// Decided records the action decided for a duplicate
+func (r *Recorder) Decided(playlistID spotify.ID, d dedupe.Duplicate, action dedupe.Action) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, Entry{
+		PlaylistID: playlistID,
+		Position:   d.Position,
+		TrackID:    d.Track.Track.ID,
+		Track:      d.Track.Track.Name,
+		Artists:    library.ArtistNames(d.Track.Track.SimpleTrack),
+		Album:      d.Track.Track.Album.Name,
+		Matcher:    d.Matcher,
+		Reason:     d.Reason,
+		Score:      d.Score,
+		Action:     string(action),
+	})
+}
+
+// Entries returns every decision recorded, by playlist and position, so
+// reports of the same playlist diff cleanly
+func (r *Recorder) Entries() []Entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entries := append([]Entry{}, r.entries...)
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].PlaylistID != entries[j].PlaylistID {
+			return entries[i].PlaylistID < entries[j].PlaylistID
+		}
+		return entries[i].Position < entries[j].Position
+	})
+	return entries
+}
+
+// CheckFormat returns an error unless format is one of Formats
+func CheckFormat(format string) error {
+	for _, f := range Formats {
+		if f == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown report format %q, expected %s", format, strings.Join(Formats, ", "))
+}
+
+// Write writes entries to w in format
+func Write(w io.Writer, format string, entries []Entry) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"playlist_id", "position", "track_id", "track", "artists", "album", "matcher", "reason", "score", "action"})
+		for _, e := range entries {
+			cw.Write([]string{string(e.PlaylistID), strconv.Itoa(e.Position), string(e.TrackID), e.Track, strings.Join(e.Artists, ", "), e.Album, e.Matcher, e.Reason, strconv.FormatFloat(e.Score, 'f', -1, 64), e.Action})
+		}
+		cw.Flush()
+		return cw.Error()
+	case "text":
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "Playlist\tPosition\tTrack\tArtists\tMatcher\tReason\tAction\t")
+		for _, e := range entries {
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t\n", e.PlaylistID, e.Position, e.Track, strings.Join(e.Artists, ", "), e.Matcher, e.Reason, e.Action)
+		}
+		return tw.Flush()
+	}
+	return CheckFormat(format)
+}
@@ -0,0 +1,69 @@
+package cleanreport
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"potentials-utils/dedupe"
+	"potentials-utils/spotifytest"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+func TestWrite(t *testing.T) {
+	r := &Recorder{}
+	duplicate := func(id string, position int) dedupe.Duplicate {
+		return dedupe.Duplicate{
+			Track:       spotify.PlaylistTrack{Track: spotifytest.Track(id, "Song, "+id, "Album", "Artist")},
+			Position:    position,
+			MatchResult: dedupe.MatchResult{Matcher: "id", Reason: "same ID", Score: 1},
+		}
+	}
+	r.Decided("potentials", duplicate("t2", 7), dedupe.ActionRemove)
+	r.Decided("potentials", duplicate("t1", 3), dedupe.ActionSkip)
+	r.Decided("another", duplicate("t3", 9), dedupe.ActionArchive)
+
+	testCases := []struct {
+		format   string
+		expected string
+	}{
+		{
+			format: "csv",
+			expected: "playlist_id,position,track_id,track,artists,album,matcher,reason,score,action\n" +
+				"another,9,t3,\"Song, t3\",Artist,Album,id,same ID,1,archive\n" +
+				"potentials,3,t1,\"Song, t1\",Artist,Album,id,same ID,1,skip\n" +
+				"potentials,7,t2,\"Song, t2\",Artist,Album,id,same ID,1,remove\n",
+		},
+		{
+			format: "text",
+			expected: "Playlist    Position  Track     Artists  Matcher  Reason   Action   \n" +
+				"another     9         Song, t3  Artist   id       same ID  archive  \n",
+		},
+	}
+	for _, tc := range testCases {
+		out := &bytes.Buffer{}
+		if err := Write(out, tc.format, r.Entries()); err != nil {
+			t.Fatalf("%s failed: %v", tc.format, err)
+		}
+		if !strings.HasPrefix(out.String(), tc.expected) {
+			t.Errorf("%s failed: expected %q, got %q", tc.format, tc.expected, out.String())
+		}
+	}
+
+	out := &bytes.Buffer{}
+	if err := Write(out, "json", r.Entries()); err != nil {
+		t.Fatal(err)
+	}
+	var entries []Entry
+	if err := json.Unmarshal(out.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[1].TrackID != "t1" || entries[1].Action != "skip" || entries[1].Position != 3 {
+		t.Errorf("unexpected JSON report %+v", entries)
+	}
+	if err := Write(out, "xml", nil); err == nil {
+		t.Error("expected an unknown format to fail")
+	}
+}
@@ -0,0 +1,2113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"potentials-utils/applemusic"
+	"potentials-utils/audit"
+	"potentials-utils/backup"
+	"potentials-utils/bulkadd"
+	"potentials-utils/coverage"
+	"potentials-utils/dedupe"
+	"potentials-utils/digest"
+	"potentials-utils/journal"
+	"potentials-utils/library"
+	"potentials-utils/listenbrainz"
+	"potentials-utils/onrepeat"
+	"potentials-utils/player"
+	"potentials-utils/preflight"
+	"potentials-utils/review"
+	"potentials-utils/reviewqueue"
+	"potentials-utils/selfupdate"
+	"potentials-utils/spotifyauth"
+	"potentials-utils/spotifyclient"
+	"potentials-utils/state"
+	"potentials-utils/throughput"
+	"potentials-utils/unlike"
+	"potentials-utils/version"
+	"potentials-utils/youtubemusic"
+
+	"github.com/apex/log"
+	"github.com/zmb3/spotify/v2"
+	spotifyoauth "github.com/zmb3/spotify/v2/auth"
+)
+
+// subcommand is an operation run by naming it as the first argument
+type subcommand struct {
+	// run is passed the arguments following the subcommand's name
+	run func(args []string) error
+	// summary says what the subcommand does in the list of subcommands
+	summary string
+}
+
+// subcommands are run when named as the first argument
+var subcommands = map[string]subcommand{
+	"clean":              {runClean, "remove tracks already saved in your library from the Potentials playlist"},
+	"serve":              {runServe, "run the HTTP server, which cleans on request"},
+	"serverless":         {runServerless, "clean once per invocation as an AWS Lambda or Google Cloud Function, configured by environment variables"},
+	"auth":               {runAuth, "authorize potentials-utils with Spotify and report the permissions granted, or with status check the stored token"},
+	"demo":               {runDemoCommand, "clean a generated playlist held in memory, no Spotify account needed"},
+	"version":            {runVersion, "print the version of potentials-utils"},
+	"self-update":        {runSelfUpdate, "replace potentials-utils with the latest release"},
+	"explain":            {runExplain, "show how a clean would decide what to do with a track"},
+	"compare":            {runCompare, "compare two tracks as every matcher would"},
+	"cache":              {runCache, "inspect, verify or rebuild the library cache"},
+	"backup":             {runBackup, "back up your saved tracks and playlists"},
+	"restore":            {runRestore, "restore a backup or the tracks recent cleans removed"},
+	"export":             {runExport, "export the Potentials playlist to another service"},
+	"crosscheck":         {runCrosscheck, "look Potentials tracks up in other services' libraries"},
+	"trash":              {runTrash, "list or purge tracks removed by cleans"},
+	"restore-from-trash": {runRestoreFromTrash, "put trashed tracks back in their playlists"},
+	"library":            {runLibrary, "look up, remove or restore saved tracks"},
+	"report":             {runReport, "report on your library and Potentials"},
+	"stats":              {runStats, "show how tracks move through Potentials"},
+	"add":                {runAdd, "add tracks to a playlist, skipping those already saved"},
+	"doctor":             {runDoctor, "diagnose your setup and Spotify access"},
+	"state":              {runState, "export or import everything potentials-utils keeps on disk"},
+	"review":             {runReview, "queue unreviewed Potentials tracks to your player and record which you skip"},
+	"player":             {runPlayer, "list your Spotify devices, or play or pause a track on one"},
+	"digest":             {runDigest, "write or send a digest of the past week in Potentials"},
+	"open":               {runOpen, "open a track in the Spotify client"},
+}
+
+// runSubcommand runs the subcommand named by args[0], if any. Returns false if
+// args don't name a subcommand. A --dry-run before the subcommand's name
+// applies to it.
+func runSubcommand(args []string) bool {
+	args = globalDryRun(args)
+	if len(args) == 0 {
+		return false
+	}
+	if args[0] == "help" {
+		var cmd subcommand
+		ok := len(args) > 1
+		if ok {
+			cmd, ok = subcommands[args[1]]
+		}
+		if !ok {
+			printUsage()
+			return true
+		}
+		// Subcommands print their flags for -h, those with subcommands of
+		// their own list them in their usage error
+		if err := cmd.run([]string{"-h"}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return true
+	}
+	cmd, ok := subcommands[args[0]]
+	if !ok {
+		return false
+	}
+	if err := cmd.run(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		os.Exit(1)
+	}
+	return true
+}
+
+// printUsage lists every subcommand
+func printUsage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintln(w, "Usage: potentials-utils [--dry-run] <command> [flags]")
+	fmt.Fprintln(w, "\nCommands:")
+	names := []string{}
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "  %s\t%s\n", name, subcommands[name].summary)
+	}
+	tw.Flush()
+	fmt.Fprintln(w, "\nRun potentials-utils help <command> for a command's flags.")
+	fmt.Fprintln(w, "Without a command, potentials-utils cleans with clean's flags, or serves with --runserver.")
+}
+
+// runDemoCommand runs the demo
+func runDemoCommand(args []string) error {
+	runDemo()
+	return nil
+}
+
+// globalDryRun sets dryRun if args start with --dry-run, returning the rest
+func globalDryRun(args []string) []string {
+	for len(args) > 0 {
+		switch args[0] {
+		case "-dry-run", "--dry-run", "-dry-run=true", "--dry-run=true":
+			dryRun = true
+		case "-dry-run=false", "--dry-run=false":
+			dryRun = false
+		default:
+			return args
+		}
+		args = args[1:]
+	}
+	return args
+}
+
+// dryRunFlag defines a subcommand's -dry-run flag, which defaults to the
+// global --dry-run
+func dryRunFlag(fs *flag.FlagSet, usage string) *bool {
+	return fs.Bool("dry-run", dryRun, usage)
+}
+
+// linksFlag defines a subcommand's -links flag, which adds an open.spotify.com
+// link to each track it lists
+func linksFlag(fs *flag.FlagSet) *bool {
+	return fs.Bool("links", false, "print an open.spotify.com link to each track listed")
+}
+
+// linkCell returns a table cell holding a track's open.spotify.com link if
+// links is set, and nothing otherwise. An empty id gives the column's header.
+func linkCell(links bool, id spotify.ID) string {
+	switch {
+	case !links:
+		return ""
+	case id == "":
+		return "Link\t"
+	}
+	return library.TrackLink(id) + "\t"
+}
+
+// linkSuffix returns a track's open.spotify.com link to follow it on a line
+// if links is set, and nothing otherwise
+func linkSuffix(links bool, id spotify.ID) string {
+	if !links {
+		return ""
+	}
+	return " " + library.TrackLink(id)
+}
+
+// configFlag defines a subcommand's -config flag, which defaults to the config
+// file of the recipe running the subcommand, if any
+func configFlag(fs *flag.FlagSet) *string {
+	return fs.String("config", configPath, "path to potentials-utils config file")
+}
+
+// runVersion prints the build info of the binary
+func runVersion(args []string) error {
+	fmt.Println(version.Get())
+	return nil
+}
+
+// runSelfUpdate replaces the running binary with the latest GitHub release
+func runSelfUpdate(args []string) error {
+	fs := flag.NewFlagSet("self-update", flag.ExitOnError)
+	check := fs.Bool("check", dryRun, "only report whether an update is available, implied by --dry-run")
+	force := fs.Bool("force", false, "install the latest release even if it isn't newer, e.g. over a dev build")
+	fs.Parse(args)
+
+	u, err := selfupdate.New(version.Version)
+	if err != nil {
+		return err
+	}
+	u.Force = *force
+	if *check {
+		r, err := u.Latest()
+		if err != nil {
+			return err
+		}
+		if u.NeedsUpdate(r) {
+			fmt.Printf("%s is available, you're running %s\n", r.Tag, version.Version)
+		} else {
+			fmt.Printf("%s is up to date\n", version.Version)
+		}
+		return nil
+	}
+	if u.PublicKey == nil {
+		fmt.Fprintln(os.Stderr, "warning: this build has no release signing key, only checksums will be verified")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	r, err := u.Update(exe)
+	if err == selfupdate.ErrUpToDate {
+		fmt.Printf("%s is up to date\n", version.Version)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Updated %s from %s to %s\n", exe, version.Version, r.Tag)
+	return nil
+}
+
+// connect loads the config file at cfgPath and authenticates with Spotify,
+// returning a client which refuses to modify Spotify
+func connect(cfgPath string) (*PotentialsUtilsConfig, spotifyclient.API, error) {
+	return connectWritable(cfgPath, true)
+}
+
+// connectWritable is connect for the few subcommands which modify Spotify.
+// The client is read-only on a dry run, so a dry run which tried to modify
+// Spotify would fail rather than do so. scopes are requested on top of those
+// every command needs, those modifying Spotify only if it isn't a dry run.
+func connectWritable(cfgPath string, dryRun bool, scopes ...string) (*PotentialsUtilsConfig, spotifyclient.API, error) {
+	log.SetLevel(logLevel)
+	config, err := loadConfig(cfgPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load config file %s: %w", cfgPath, err)
+	}
+	auditLog := newAuditLog(config)
+	config.Cache.Audit = auditLog
+	auth := spotifyauth.New(config.Spotify.AuthConfig(auditLog), config.Scopes(!dryRun, scopes...)...)
+	if _, err := auth.AuthenticateWithServer(context.Background(), serverAddr); err != nil {
+		return nil, nil, fmt.Errorf("failed to authenticate with Spotify: %w", err)
+	}
+	cache := spotifyclient.NewPlaylistCache(path.Join(config.Cache.CacheDir, "playlists"))
+	retrier, err := spotifyclient.NewRetrier(config.Spotify.Retry)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid spotify.retry config: %w", err)
+	}
+	httpClient := retrier.HTTPClient(auth.HTTPClient())
+	client := spotifyclient.WithPlaylistCache(spotifyclient.Audited(spotifyclient.New(httpClient), auditLog), cache, config.Cache.Metrics)
+	client = spotifyclient.Coalesce(spotifyclient.WithEntityCache(client, newEntityCache(config)))
+	if dryRun || config.ReadOnly {
+		client = spotifyclient.ReadOnly(client)
+	}
+	return config, client, nil
+}
+
+// runExplain shows how a clean would decide what to do with one track of the
+// Potentials playlist
+func runExplain(args []string) error {
+	ctx := context.Background()
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	trackID := fs.String("playlist-track", "", "ID of the Potentials playlist track to explain")
+	links := linksFlag(fs)
+	fs.Parse(args)
+	if *trackID == "" {
+		return errors.New("--playlist-track is required")
+	}
+
+	config, client, err := connect(*cfgPath)
+	if err != nil {
+		return err
+	}
+	cleaner, err := newCleaner(ctx, config, client)
+	if err != nil {
+		return err
+	}
+	t, err := findPlaylistTrack(ctx, client, config.Spotify.PotentialsPlaylistID, spotify.ID(*trackID))
+	if err != nil {
+		return err
+	}
+	e, err := cleaner.Explain(ctx, *t)
+	if err != nil {
+		return err
+	}
+	printExplanation(os.Stdout, e, *links)
+	return nil
+}
+
+// findPlaylistTrack pages through a playlist for the track with the given ID
+func findPlaylistTrack(ctx context.Context, client spotifyclient.API, playlistID, trackID spotify.ID) (*spotify.PlaylistTrack, error) {
+	playlist, err := client.GetPlaylist(ctx, playlistID)
+	if err != nil {
+		return nil, err
+	}
+	page := &playlist.Tracks
+	for {
+		for ix := range page.Tracks {
+			if page.Tracks[ix].Track.ID == trackID {
+				return &page.Tracks[ix], nil
+			}
+		}
+		if err := client.NextPlaylistTracks(ctx, page); err == spotify.ErrNoMorePages {
+			return nil, fmt.Errorf("track %s is not in playlist %s", trackID, playlist.Name)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// runCompare compares two tracks field by field and shows what each matcher
+// would conclude were the first saved and the second in Potentials
+func runCompare(args []string) error {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: potentials-utils compare [-config path] <saved track ID> <playlist track ID>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("expected two track IDs")
+	}
+
+	config, client, err := connect(*cfgPath)
+	if err != nil {
+		return err
+	}
+	pipeline, err := dedupe.NewRegistry().Pipeline(config.Duplicates.MatcherConfigs())
+	if err != nil {
+		return fmt.Errorf("invalid duplicates.matchers config: %w", err)
+	}
+	if pipeline.Normalizer, err = library.NewCollatingNormalizer(config.Cache.Normalize, config.Cache.Collation); err != nil {
+		return err
+	}
+	if pipeline.IndexKey, err = config.Cache.NewIndexKey(); err != nil {
+		return err
+	}
+	ids := []spotify.ID{spotify.ID(fs.Arg(0)), spotify.ID(fs.Arg(1))}
+	tracks, err := client.GetTracks(context.Background(), ids...)
+	if err != nil {
+		return err
+	}
+	for ix, t := range tracks {
+		if t == nil {
+			return fmt.Errorf("track %s not found", ids[ix])
+		}
+	}
+	stages, err := pipeline.Compare(*tracks[0], *tracks[1])
+	if err != nil {
+		return err
+	}
+	printComparison(os.Stdout, *tracks[0], *tracks[1], stages)
+	return nil
+}
+
+// printComparison writes a field by field comparison of two tracks followed by
+// the verdict of each matcher stage
+func printComparison(w io.Writer, a, b spotify.FullTrack, stages []dedupe.StageExplanation) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "\t%s\t%s\t\n", a.ID, b.ID)
+	for _, f := range []struct {
+		name string
+		get  func(t spotify.FullTrack) string
+	}{
+		{"Title", func(t spotify.FullTrack) string { return t.Name }},
+		{"Album", func(t spotify.FullTrack) string { return t.Album.Name }},
+		{"Artists", func(t spotify.FullTrack) string { return strings.Join(library.ArtistNames(t.SimpleTrack), ", ") }},
+		{"ISRC", func(t spotify.FullTrack) string { return library.ISRC(t) }},
+		{"Duration", func(t spotify.FullTrack) string { return t.TimeDuration().Round(time.Second).String() }},
+		{"Popularity", func(t spotify.FullTrack) string { return fmt.Sprint(t.Popularity) }},
+	} {
+		va, vb := f.get(a), f.get(b)
+		same := "same"
+		if va != vb {
+			same = "differs"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", f.name, va, vb, same)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nMatchers, were %s saved and %s in Potentials:\n", a.ID, b.ID)
+	for _, s := range stages {
+		if s.Matched {
+			fmt.Fprintf(w, "  %s: match, score %.2f: %s\n", s.Stage, s.Score, s.Reason)
+		} else {
+			fmt.Fprintf(w, "  %s: no match\n", s.Stage)
+		}
+	}
+}
+
+// runCache runs the cache subcommand named by args[0]
+func runCache(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "verify":
+			return runCacheVerify(args[1:])
+		case "info":
+			return runCacheInfo(args[1:])
+		case "rebuild":
+			return runCacheRebuild(args[1:])
+		}
+	}
+	return errors.New("usage: potentials-utils cache verify|info|rebuild [-config path] [-sample n]")
+}
+
+// runCacheRebuild throws the library cache away and fetches the whole library
+// from Spotify again, refreshing tracks an incremental update would keep
+func runCacheRebuild(args []string) error {
+	fs := flag.NewFlagSet("cache rebuild", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	fs.Parse(args)
+
+	config, client, err := connect(*cfgPath)
+	if err != nil {
+		return err
+	}
+	if err := library.ExpireStoredLibrary(config.Cache.CacheDir); err != nil {
+		return err
+	}
+	config.Cache.AllowStale = false
+	config.Cache.FullRebuild = true
+	lib, err := library.NewLibraryService(client, config.Cache)
+	if err != nil {
+		return err
+	}
+	status := lib.Status()
+	fmt.Printf("Rebuilt the library cache: %d tracks, fresh until %s\n", status.Tracks, status.ExpiresAt.Format(time.RFC3339))
+	return nil
+}
+
+// runCacheInfo reports how fresh the library cache is and how many entities
+// are cached, without calling Spotify
+func runCacheInfo(args []string) error {
+	fs := flag.NewFlagSet("cache info", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	fs.Parse(args)
+
+	log.SetLevel(logLevel)
+	config, err := loadConfig(*cfgPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config file %s: %w", *cfgPath, err)
+	}
+	entities := newEntityCache(config)
+	fmt.Printf("Cached entities: %d album labels, %d artist genres, %d tracks\n",
+		entities.Len(spotifyclient.AlbumLabelsEntity), entities.Len(spotifyclient.ArtistGenresEntity), entities.Len(spotifyclient.TracksEntity))
+	stored, err := library.LoadStoredLibrary(config.Cache.CacheDir)
+	if os.IsNotExist(err) {
+		fmt.Println("No library cache, it will be built on the next clean.")
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read the library cache: %w", err)
+	}
+	now := time.Now()
+	status := stored.Status(now)
+	fmt.Printf("Saved tracks: %d\n", status.Tracks)
+	fmt.Printf("Indexed at: %s\n", status.IndexedAt.Format(time.RFC3339))
+	expiresIn := status.ExpiresIn(now).Round(time.Second)
+	if status.Alive {
+		fmt.Printf("Expires at: %s, in %s\n", status.ExpiresAt.Format(time.RFC3339), expiresIn)
+	} else {
+		fmt.Printf("Expired at: %s, %s ago, it will be rebuilt on the next clean\n", status.ExpiresAt.Format(time.RFC3339), -expiresIn)
+	}
+	return nil
+}
+
+// runCacheVerify checks the cached library against the live one, failing if
+// it has drifted
+func runCacheVerify(args []string) error {
+	fs := flag.NewFlagSet("cache verify", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	sample := fs.Int("sample", 100, "number of cached tracks to re-fetch, or 0 for all of them")
+	fs.Parse(args)
+
+	config, client, err := connect(*cfgPath)
+	if err != nil {
+		return err
+	}
+	stored, err := library.LoadStoredLibrary(config.Cache.CacheDir)
+	if err != nil {
+		return fmt.Errorf("failed to read the library cache: %w", err)
+	}
+	d, err := library.Verify(context.Background(), stored, client, *sample, rand.New(rand.NewSource(time.Now().UnixNano())))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Library cache indexed at %s, expires at %s\n", stored.IndexedAt.Format(time.RFC3339), stored.Expiration.Format(time.RFC3339))
+	fmt.Printf("Saved tracks: %d cached, %d on Spotify\n", d.CachedTracks, d.SpotifyTracks)
+	fmt.Printf("Re-fetched %d cached tracks: %d no longer saved, %d unavailable, %d changed fields\n",
+		d.Sampled, len(d.Unsaved), len(d.Unavailable), len(d.Changed))
+	for _, id := range d.Unsaved {
+		fmt.Printf("  unsaved: %s\n", id)
+	}
+	for _, id := range d.Unavailable {
+		fmt.Printf("  unavailable: %s\n", id)
+	}
+	for _, c := range d.Changed {
+		fmt.Printf("  changed: %s %s %q -> %q\n", c.ID, c.Field, c.Cached, c.Live)
+	}
+	if d.Drifted() {
+		return fmt.Errorf("library cache has drifted from Spotify, delete %s to rebuild it on the next run", library.OpenStore(config.Cache.CacheDir).Path())
+	}
+	fmt.Println("Library cache matches Spotify.")
+	return nil
+}
+
+// runBackup runs the backup subcommand named by args[0]
+func runBackup(args []string) error {
+	if len(args) == 0 || args[0] != "all" {
+		return errors.New("usage: potentials-utils backup all --out dir [-incremental] [-config path]")
+	}
+	return runBackupAll(args[1:])
+}
+
+// runBackupAll backs up the user's saved tracks and every playlist they own
+func runBackupAll(args []string) error {
+	fs := flag.NewFlagSet("backup all", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	out := fs.String("out", "", "directory to write the backup to")
+	incremental := fs.Bool("incremental", false, "only rewrite playlists and saved tracks which changed since the last backup to --out")
+	fs.Parse(args)
+	if *out == "" {
+		return errors.New("--out is required")
+	}
+
+	_, client, err := connect(*cfgPath)
+	if err != nil {
+		return err
+	}
+	summary, err := backup.New(client, *out).All(context.Background(), *incremental)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Backed up to %s: %d playlists written, %d unchanged, %d no longer in your account\n",
+		*out, summary.PlaylistsWritten, summary.PlaylistsUnchanged, summary.PlaylistsRemoved)
+	if summary.LibraryWritten {
+		fmt.Println("Saved tracks written.")
+	} else {
+		fmt.Println("Saved tracks unchanged.")
+	}
+	return nil
+}
+
+// runAdd adds the tracks linked in a file to a playlist, skipping those
+// already saved or in the playlist
+func runAdd(args []string) error {
+	fs := flag.NewFlagSet("add", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	playlistID := fs.String("playlist", "", "ID of the playlist to add to, the Potentials playlist if empty")
+	fromFile := fs.String("from-file", "", "file of track links, URIs or IDs, one per line")
+	dryRun := dryRunFlag(fs, "report which tracks would be added without adding them")
+	fs.Parse(args)
+	if *fromFile == "" {
+		return errors.New("--from-file is required")
+	}
+	f, err := os.Open(*fromFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	ids, invalid, err := bulkadd.ParseTrackIDs(f)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", *fromFile, err)
+	}
+	for _, line := range invalid {
+		fmt.Printf("[SKIPPED] not a track: %s\n", line)
+	}
+
+	config, client, err := connectWritable(*cfgPath, *dryRun)
+	if err != nil {
+		return err
+	}
+	if *playlistID == "" {
+		*playlistID = string(config.Spotify.PotentialsPlaylistID)
+	}
+	lib, err := library.NewLibraryService(client, config.Cache)
+	if err != nil {
+		return fmt.Errorf("failed to start the potentials-utils library service: %w", err)
+	}
+	r, err := bulkadd.Add(context.Background(), client, lib, spotify.ID(*playlistID), ids, *dryRun)
+	verb := "Added"
+	if *dryRun {
+		verb = "Would add"
+	}
+	fmt.Printf("%s %d tracks to %s, skipped %d already saved, %d already in the playlist and %d lines which aren't tracks\n",
+		verb, len(r.Added), *playlistID, len(r.InLibrary), len(r.InPlaylist), len(invalid))
+	return err
+}
+
+// runRestore runs the restore subcommand named by args[0]
+func runRestore(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "all":
+			return runRestoreAll(args[1:])
+		case "removals":
+			return runRestoreRemovals(args[1:])
+		}
+	}
+	return errors.New("usage: potentials-utils restore all --from dir [-dry-run] [-include-removed] [-skip-library] [-config path] | removals [-runs n] [-list] [-dry-run] [-config path]")
+}
+
+// runRestoreAll pushes a backup into the account the config authenticates
+// as, recreating its playlists and saving its saved tracks
+func runRestoreAll(args []string) error {
+	fs := flag.NewFlagSet("restore all", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	from := fs.String("from", "", "directory holding the backup to restore")
+	dryRun := dryRunFlag(fs, "report what would be restored without modifying Spotify")
+	includeRemoved := fs.Bool("include-removed", false, "also restore playlists which had been deleted from the backed up account")
+	skipLibrary := fs.Bool("skip-library", false, "don't restore saved tracks")
+	fs.Parse(args)
+	if *from == "" {
+		return errors.New("--from is required")
+	}
+
+	_, client, err := connectWritable(*cfgPath, *dryRun, libraryModifyScopes...)
+	if err != nil {
+		return err
+	}
+	r := backup.NewRestore(client, *from)
+	r.DryRun, r.IncludeRemoved, r.SkipLibrary = *dryRun, *includeRemoved, *skipLibrary
+	summary, err := r.All(context.Background())
+	if summary != nil {
+		verb := "Restored"
+		if *dryRun {
+			verb = "Would restore"
+		}
+		fmt.Printf("%s from %s: %d playlists created, %d tracks added to playlists, %d tracks saved, %d local or unavailable tracks skipped\n",
+			verb, *from, summary.PlaylistsCreated, summary.TracksAdded, summary.TracksSaved, summary.TracksSkipped)
+	}
+	if err != nil {
+		return fmt.Errorf("%w; run again to pick up where this left off", err)
+	}
+	return nil
+}
+
+// runRestoreRemovals puts the tracks removed by the last few cleans back
+// where they were, or lists the cleans which can be undone
+func runRestoreRemovals(args []string) error {
+	fs := flag.NewFlagSet("restore removals", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	runs := fs.Int("runs", 1, "how many of the most recent cleans to undo")
+	list := fs.Bool("list", false, "list the cleans removals were recorded for instead")
+	dryRun := dryRunFlag(fs, "report what would be restored without restoring it")
+	fs.Parse(args)
+	if *runs < 1 {
+		return errors.New("--runs must be at least 1")
+	}
+
+	if *list {
+		config, err := loadConfig(*cfgPath)
+		if err != nil {
+			return err
+		}
+		entries, err := newRemovalJournal(config).Entries()
+		if err != nil {
+			return err
+		}
+		printRemovalRuns(os.Stdout, entries)
+		return nil
+	}
+	config, client, err := connectWritable(*cfgPath, *dryRun)
+	if err != nil {
+		return err
+	}
+	j := newRemovalJournal(config)
+	j.DryRun = *dryRun
+	restored, err := j.Restore(context.Background(), client, *runs)
+	verb := "Restored"
+	if *dryRun {
+		verb = "Would restore"
+	}
+	for _, e := range restored {
+		fmt.Printf("%s %s to %s at position %d\n", verb, e.Track, e.PlaylistID, e.Position)
+	}
+	if err != nil {
+		return fmt.Errorf("%w; run again to restore the rest", err)
+	}
+	if len(restored) == 0 {
+		fmt.Println("Nothing removed by those cleans left to restore.")
+	}
+	return nil
+}
+
+// printRemovalRuns writes a table of the cleans in the journal, newest first,
+// with how many tracks each removed and how many of those are still removed
+func printRemovalRuns(w io.Writer, entries []journal.Entry) {
+	type run struct {
+		id               string
+		at               time.Time
+		removed, pending int
+	}
+	runs := []*run{}
+	byID := map[string]*run{}
+	for _, e := range entries {
+		r, ok := byID[e.Run]
+		if !ok {
+			r = &run{id: e.Run, at: e.RemovedAt}
+			byID[e.Run] = r
+			runs = append(runs, r)
+		}
+		r.removed++
+		if e.RestoredAt == nil {
+			r.pending++
+		}
+	}
+	if len(runs) == 0 {
+		fmt.Fprintln(w, "No removals recorded.")
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "Run\tRemoved at\tRemoved\tStill removed\t")
+	for ix := len(runs) - 1; ix >= 0; ix-- {
+		r := runs[ix]
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%d\t\n", len(runs)-ix, r.at.Local().Format(time.RFC3339), r.removed, r.pending)
+	}
+	tw.Flush()
+}
+
+// runExport runs the export subcommand named by args[0]
+func runExport(args []string) error {
+	if len(args) == 0 || args[0] != "applemusic" {
+		return errors.New("usage: potentials-utils export applemusic --from dir [-playlist id] [-library] [-dry-run] [-config path]")
+	}
+	return runExportAppleMusic(args[1:])
+}
+
+// runExportAppleMusic copies a backed up playlist, and optionally the saved
+// tracks, into Apple Music
+func runExportAppleMusic(args []string) error {
+	fs := flag.NewFlagSet("export applemusic", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	from := fs.String("from", "", "directory holding the backup to export, written by backup all")
+	playlistID := fs.String("playlist", "", "ID of the backed up playlist to export, the Potentials playlist if empty")
+	withLibrary := fs.Bool("library", false, "also add the backed up saved tracks to the Apple Music library")
+	dryRun := dryRunFlag(fs, "report which tracks would be exported without modifying Apple Music")
+	fs.Parse(args)
+	if *from == "" {
+		return errors.New("--from is required")
+	}
+
+	log.SetLevel(logLevel)
+	config, err := loadConfig(*cfgPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config file %s: %w", *cfgPath, err)
+	}
+	client, err := applemusic.New(config.AppleMusic)
+	if err != nil {
+		return err
+	}
+	if *playlistID == "" {
+		*playlistID = string(config.Spotify.PotentialsPlaylistID)
+	}
+	e := applemusic.NewExporter(client, *from)
+	e.DryRun = *dryRun
+	r, err := e.Playlist(spotify.ID(*playlistID))
+	if r != nil {
+		printExportReport(os.Stdout, r)
+	}
+	if err != nil || !*withLibrary {
+		return err
+	}
+	r, err = e.Library()
+	if r != nil {
+		printExportReport(os.Stdout, r)
+	}
+	return err
+}
+
+// printExportReport writes r for people to read
+func printExportReport(w io.Writer, r *applemusic.Report) {
+	fmt.Fprintf(w, "%s: %d of %d tracks found on Apple Music\n", r.Name, r.Matched, r.Tracks)
+	if r.PlaylistID != "" {
+		fmt.Fprintf(w, "Created Apple Music playlist %s\n", r.PlaylistID)
+	}
+	for _, u := range r.Unmatched {
+		fmt.Fprintf(w, "  skipped %s: %s\n", library.TrackString(u.Track), u.Reason)
+	}
+}
+
+// crossCheck is what one Potentials track was found to duplicate
+type crossCheck struct {
+	track   spotify.FullTrack
+	spotify *dedupe.MatchResult
+	youtube *youtubemusic.Song
+}
+
+// runCrosscheck reports which Potentials tracks are already in the Spotify
+// library, liked on YouTube Music, or both
+func runCrosscheck(args []string) error {
+	ctx := context.Background()
+	fs := flag.NewFlagSet("crosscheck", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	all := fs.Bool("all", false, "list every Potentials track, not only those found in a library")
+	links := linksFlag(fs)
+	fs.Parse(args)
+
+	config, client, err := connect(*cfgPath)
+	if err != nil {
+		return err
+	}
+	if !config.YouTubeMusic.Enabled() {
+		return errors.New("no youtubeMusic account in config")
+	}
+	yt, err := youtubemusic.New(config.YouTubeMusic)
+	if err != nil {
+		return err
+	}
+	liked, err := yt.LikedSongs()
+	if err != nil {
+		return fmt.Errorf("failed to read YouTube Music likes: %w", err)
+	}
+	ytLibrary := youtubemusic.NewLibrary(liked)
+	cleaner, err := newCleaner(ctx, config, client)
+	if err != nil {
+		return err
+	}
+
+	checks := []crossCheck{}
+	playlist, err := client.GetPlaylist(ctx, config.Spotify.PotentialsPlaylistID)
+	if err != nil {
+		return err
+	}
+	page := &playlist.Tracks
+	for {
+		duplicates, err := cleaner.Duplicates(page.Tracks)
+		if err != nil {
+			return err
+		}
+		matches := map[spotify.ID]dedupe.MatchResult{}
+		for _, d := range duplicates {
+			matches[d.Track.Track.ID] = d.MatchResult
+		}
+		for _, t := range page.Tracks {
+			c := crossCheck{track: t.Track}
+			if m, ok := matches[t.Track.ID]; ok {
+				c.spotify = &m
+			}
+			if s, ok := ytLibrary.Find(t.Track); ok {
+				c.youtube = &s
+			}
+			checks = append(checks, c)
+		}
+		if err := client.NextPlaylistTracks(ctx, page); err == spotify.ErrNoMorePages {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	printCrossChecks(os.Stdout, checks, *all, *links)
+	return nil
+}
+
+// printCrossChecks writes a table of which library each track was found in,
+// followed by totals
+func printCrossChecks(w io.Writer, checks []crossCheck, all, links bool) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "Track\tSpotify library\tYouTube Music\t"+linkCell(links, ""))
+	inSpotify, inYouTube, inBoth := 0, 0, 0
+	for _, c := range checks {
+		sp, yt := "-", "-"
+		if c.spotify != nil {
+			sp = fmt.Sprintf("%s match", c.spotify.Matcher)
+			inSpotify++
+		}
+		if c.youtube != nil {
+			yt = "liked " + c.youtube.VideoID
+			inYouTube++
+		}
+		if c.spotify != nil && c.youtube != nil {
+			inBoth++
+		}
+		if all || c.spotify != nil || c.youtube != nil {
+			fmt.Fprintf(tw, "%s - %s\t%s\t%s\t%s\n", c.track.Name, strings.Join(library.ArtistNames(c.track.SimpleTrack), ", "), sp, yt, linkCell(links, c.track.ID))
+		}
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\n%d Potentials tracks: %d in your Spotify library, %d liked on YouTube Music, %d in both, %d in neither\n",
+		len(checks), inSpotify, inYouTube, inBoth, len(checks)-inSpotify-inYouTube+inBoth)
+}
+
+// runTrash runs the trash subcommand named by args[0]
+func runTrash(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "list":
+			return runTrashList(args[1:])
+		case "purge":
+			return runTrashPurge(args[1:])
+		}
+	}
+	return errors.New("usage: potentials-utils trash list|purge [-dry-run] [-config path]")
+}
+
+// runState runs the state subcommand named by args[0]
+func runState(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "export":
+			return runStateExport(args[1:])
+		case "import":
+			return runStateImport(args[1:])
+		}
+	}
+	return errors.New("usage: potentials-utils state export|import [-config path] [-tokens] state.tar.gz")
+}
+
+// runStateExport archives the cache directory, and optionally the config
+// file, without calling Spotify
+func runStateExport(args []string) error {
+	fs := flag.NewFlagSet("state export", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	tokens := fs.Bool("tokens", false, "include the config file and the stored Spotify token, with the credentials they hold")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: potentials-utils state export [-config path] [-tokens] state.tar.gz")
+	}
+
+	log.SetLevel(logLevel)
+	config, err := loadConfig(*cfgPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config file %s: %w", *cfgPath, err)
+	}
+	opts := state.ExportOptions{ExportedBy: version.Version}
+	if *tokens {
+		opts.ConfigPath = *cfgPath
+	} else {
+		opts.Exclude = []string{tokenFile}
+	}
+	out, err := os.OpenFile(fs.Arg(0), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	m, err := state.Export(out, config.Cache.CacheDir, opts)
+	if err != nil {
+		out.Close()
+		os.Remove(fs.Arg(0))
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("Exported %d files from %s to %s\n", len(m.Files), config.Cache.CacheDir, fs.Arg(0))
+	if m.Config {
+		fmt.Printf("%s includes %s, keep it as safe as your credentials.\n", fs.Arg(0), *cfgPath)
+	}
+	return nil
+}
+
+// runStateImport restores an archive written by state export into the cache
+// directory, and optionally the config file
+func runStateImport(args []string) error {
+	fs := flag.NewFlagSet("state import", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	cacheDir := fs.String("cache-dir", "", "directory to import the cache into, defaulting to cache.cacheDir from the config file")
+	tokens := fs.Bool("tokens", false, "also import the archived config file to -config and the stored Spotify token, with the credentials they hold")
+	force := fs.Bool("force", false, "replace existing state and config")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: potentials-utils state import [-config path] [-cache-dir dir] [-tokens] [-force] state.tar.gz")
+	}
+
+	log.SetLevel(logLevel)
+	if *cacheDir == "" {
+		config, err := loadConfig(*cfgPath)
+		if err != nil {
+			return fmt.Errorf("failed to load config file %s, pass -cache-dir to import without one: %w", *cfgPath, err)
+		}
+		*cacheDir = config.Cache.CacheDir
+	}
+	opts := state.ImportOptions{Overwrite: *force}
+	if *tokens {
+		opts.ConfigPath = *cfgPath
+	} else {
+		opts.Exclude = []string{tokenFile}
+	}
+	in, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	m, err := state.Import(in, *cacheDir, opts)
+	if err == state.ErrNotEmpty {
+		return fmt.Errorf("%s already holds potentials-utils state, pass -force to replace it", *cacheDir)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d files exported by %s at %s into %s\n", len(m.Files), m.ExportedBy, m.ExportedAt.Format(time.RFC3339), *cacheDir)
+	if m.Config && *tokens {
+		fmt.Printf("Imported the config file to %s.\n", *cfgPath)
+	} else if m.Config {
+		fmt.Println("The archive includes a config file, pass -tokens to import it too.")
+	}
+	return nil
+}
+
+// runReview runs the review subcommand named by args[0]
+func runReview(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "start":
+			return runReviewStart(args[1:])
+		case "status":
+			return runReviewStatus(args[1:])
+		case "duplicates":
+			return runReviewDuplicates(args[1:])
+		}
+	}
+	return errors.New("usage: potentials-utils review start|status|duplicates [-config path]")
+}
+
+// runReviewStart queues the next unreviewed Potentials tracks to the active
+// Spotify device, then watches what's playing to record which are skipped
+// and which finished, until they've all been played or it's interrupted
+func runReviewStart(args []string) error {
+	ctx := context.Background()
+	fs := flag.NewFlagSet("review start", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	n := fs.Int("n", 10, "number of unreviewed tracks to queue")
+	poll := fs.Duration("poll", 5*time.Second, "how often to check what's playing")
+	dryRun := dryRunFlag(fs, "print the tracks which would be queued without queueing them")
+	links := linksFlag(fs)
+	fs.Parse(args)
+	if *n < 1 {
+		return errors.New("-n must be at least 1")
+	}
+
+	config, client, err := connectWritable(*cfgPath, *dryRun, playerScopes...)
+	if err != nil {
+		return err
+	}
+	reviews := newReviewLog(config)
+	verdicts, err := reviews.Verdicts()
+	if err != nil {
+		return err
+	}
+	tracks, err := review.Unreviewed(ctx, client, config.Spotify.PotentialsPlaylistID, verdicts, *n)
+	if err != nil {
+		return err
+	}
+	if len(tracks) == 0 {
+		fmt.Println("Every Potentials track has been reviewed.")
+		return nil
+	}
+	if *dryRun {
+		for _, t := range tracks {
+			fmt.Printf("Would queue %s%s\n", library.TrackString(t), linkSuffix(*links, t.ID))
+		}
+		return nil
+	}
+	device, err := review.Queue(ctx, client, tracks)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Queued %d tracks to %s, listen through or skip them. Press Ctrl-C to stop reviewing.\n", len(tracks), device.Name)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	session := review.NewSession(tracks)
+	err = session.Watch(ctx, client, reviews, *poll, func(v review.Verdict) {
+		fmt.Printf("%s %s\n", v.Outcome, v.Track)
+	})
+	if err == context.Canceled {
+		fmt.Println("Stopped reviewing, tracks not played yet stay unreviewed.")
+		return nil
+	}
+	return err
+}
+
+// runReviewStatus prints how every reviewed track was listened to, without
+// calling Spotify
+func runReviewStatus(args []string) error {
+	fs := flag.NewFlagSet("review status", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	links := linksFlag(fs)
+	fs.Parse(args)
+
+	log.SetLevel(logLevel)
+	config, err := loadConfig(*cfgPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config file %s: %w", *cfgPath, err)
+	}
+	verdicts, err := newReviewLog(config).Verdicts()
+	if err != nil {
+		return err
+	}
+	ids := []string{}
+	for id := range verdicts {
+		ids = append(ids, string(id))
+	}
+	sort.Strings(ids)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "Track ID\tTrack\tSkipped\tFinished\tLast reviewed\t"+linkCell(*links, ""))
+	for _, id := range ids {
+		vs := verdicts[spotify.ID(id)]
+		skipped, finished := review.Counts(vs)
+		last := vs[len(vs)-1]
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%s\n", id, last.Track, skipped, finished, last.At.Format("2006-01-02"), linkCell(*links, spotify.ID(id)))
+	}
+	return tw.Flush()
+}
+
+// runReviewDuplicates works through the duplicates queued for review, asking
+// whether to remove or keep each, or every track by its artist or on its
+// album. Later cleans remove or keep the tracks as decided.
+func runReviewDuplicates(args []string) error {
+	fs := flag.NewFlagSet("review duplicates", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	list := fs.Bool("list", false, "list the queued duplicates without reviewing them")
+	forget := fs.String("forget", "", "forget the decision for a track ID, so it's queued again")
+	rules := fs.Bool("rules", false, "list the decisions made for every track by an artist or on an album")
+	forgetArtist := fs.String("forget-artist", "", "forget the decision for every track by an artist")
+	forgetAlbum := fs.String("forget-album", "", "forget the decision for every track on an album ID")
+	links := linksFlag(fs)
+	fs.Parse(args)
+
+	log.SetLevel(logLevel)
+	config, err := loadConfig(*cfgPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config file %s: %w", *cfgPath, err)
+	}
+	queue := newReviewQueue(config)
+	if *forget != "" {
+		forgotten, err := queue.Forget(spotify.ID(*forget))
+		if err != nil {
+			return err
+		}
+		if !forgotten {
+			return fmt.Errorf("no decision recorded for %s", *forget)
+		}
+		fmt.Printf("Forgot the decision for %s.\n", *forget)
+		return nil
+	}
+	if *forgetArtist != "" || *forgetAlbum != "" {
+		scope, key := reviewqueue.ScopeArtist, *forgetArtist
+		if *forgetAlbum != "" {
+			scope, key = reviewqueue.ScopeAlbum, *forgetAlbum
+		}
+		forgotten, err := queue.ForgetRule(scope, key)
+		if err != nil {
+			return err
+		}
+		if !forgotten {
+			return fmt.Errorf("no decision recorded for %s %s", scope, key)
+		}
+		fmt.Printf("Forgot the decision for %s %s.\n", scope, key)
+		return nil
+	}
+	if *rules {
+		recorded, err := queue.Rules()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "Scope\tArtist or album\tAlbum ID\tDecision\tDecided\t")
+		for _, r := range recorded {
+			name := r.Artist
+			if r.Scope == reviewqueue.ScopeAlbum {
+				name = r.Album
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t\n", r.Scope, name, r.AlbumID, r.Decision, r.DecidedAt.Format("2006-01-02"))
+		}
+		return tw.Flush()
+	}
+	pending, err := queue.Pending()
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		fmt.Println("No duplicates are waiting for review.")
+		return nil
+	}
+	if *list {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "Playlist\tTrack ID\tTrack\tMatcher\tScore\tReason\t"+linkCell(*links, ""))
+		for _, it := range pending {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%.2f\t%s\t%s\n", it.PlaylistID, it.TrackID, it.Track, it.Matcher, it.Score, it.Reason, linkCell(*links, it.TrackID))
+		}
+		return tw.Flush()
+	}
+	decided, made := 0, []reviewqueue.Rule{}
+	for ix, it := range pending {
+		if decidedByRule(made, it) {
+			continue
+		}
+		decision, scope, ok, err := promptReview(ix+1, len(pending), it)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if decision == "" {
+			continue
+		}
+		rule, n, err := queue.DecideAll(it.TrackID, decision, scope)
+		if err != nil {
+			return err
+		}
+		if scope != reviewqueue.ScopeTrack {
+			made = append(made, rule)
+			fmt.Printf("Will %s %s from now on, %d queued duplicates decided.\n", decision, rule, n)
+		}
+		decided += n
+	}
+	fmt.Printf("Reviewed %d duplicates, the next clean will remove or keep them as decided.\n", decided)
+	return nil
+}
+
+// decidedByRule returns whether any of rules decides a queued duplicate
+func decidedByRule(rules []reviewqueue.Rule, it reviewqueue.Item) bool {
+	for _, r := range rules {
+		if r.MatchesItem(it) {
+			return true
+		}
+	}
+	return false
+}
+
+// runPlayer runs the player subcommand named by args[0]
+func runPlayer(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "devices":
+			return runPlayerDevices(args[1:])
+		case "play":
+			return runPlayerPlay(args[1:])
+		case "pause":
+			return runPlayerPause(args[1:])
+		}
+	}
+	return errors.New("usage: potentials-utils player devices|play|pause [-config path]")
+}
+
+// runPlayerDevices lists the devices Spotify can play on
+func runPlayerDevices(args []string) error {
+	fs := flag.NewFlagSet("player devices", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	fs.Parse(args)
+
+	_, client, err := connectWritable(*cfgPath, true, playerScopes...)
+	if err != nil {
+		return err
+	}
+	devices, err := client.PlayerDevices(context.Background())
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "Device ID\tName\tType\tActive\t")
+	for _, d := range devices {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%t\t\n", d.ID, d.Name, d.Type, d.Active)
+	}
+	return tw.Flush()
+}
+
+// runPlayerPlay plays a track on a device, to audition it
+func runPlayerPlay(args []string) error {
+	fs := flag.NewFlagSet("player play", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	device := fs.String("device", "", "ID or name of the device to play on, defaulting to the active device")
+	from := fs.Duration("from", 0, "how far into the track to start playing")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: potentials-utils player play [-config path] [-device device] [-from 30s] <track ID>")
+	}
+	trackID, ok := bulkadd.ParseTrackID(fs.Arg(0))
+	if !ok {
+		return fmt.Errorf("%s isn't a track", fs.Arg(0))
+	}
+
+	_, client, err := connectWritable(*cfgPath, false, playerScopes...)
+	if err != nil {
+		return err
+	}
+	d, err := player.Play(context.Background(), client, *device, trackID, int(*from/time.Millisecond))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Playing %s on %s\n", trackID, d.Name)
+	return nil
+}
+
+// runPlayerPause pauses playback on a device
+func runPlayerPause(args []string) error {
+	fs := flag.NewFlagSet("player pause", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	device := fs.String("device", "", "ID or name of the device to pause, defaulting to the active device")
+	fs.Parse(args)
+
+	_, client, err := connectWritable(*cfgPath, false, playerScopes...)
+	if err != nil {
+		return err
+	}
+	return player.Pause(context.Background(), client, *device)
+}
+
+// runTrashList prints every track in the trash
+func runTrashList(args []string) error {
+	fs := flag.NewFlagSet("trash list", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	links := linksFlag(fs)
+	fs.Parse(args)
+
+	log.SetLevel(logLevel)
+	config, err := loadConfig(*cfgPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config file %s: %w", *cfgPath, err)
+	}
+	items, err := newTrash(config, nil).Items()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "Trashed\tTrack ID\tTrack\tReason\t"+linkCell(*links, ""))
+	for _, i := range items {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", i.TrashedAt.Format("2006-01-02"), i.TrackID, i.Track, i.Reason, linkCell(*links, i.TrackID))
+	}
+	return tw.Flush()
+}
+
+// runTrashPurge empties the trash of tracks kept longer than the retention
+// period
+func runTrashPurge(args []string) error {
+	fs := flag.NewFlagSet("trash purge", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	dryRun := dryRunFlag(fs, "report how many tracks would be purged without purging them")
+	fs.Parse(args)
+
+	config, client, err := connectWritable(*cfgPath, *dryRun)
+	if err != nil {
+		return err
+	}
+	if config.Duplicates.TrashRetentionDays <= 0 {
+		return errors.New("duplicates.trashRetentionDays isn't set, so nothing is trashed")
+	}
+	t := newTrash(config, client)
+	t.DryRun = *dryRun
+	purged, err := t.Purge(context.Background())
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		fmt.Printf("Would purge %d tracks trashed more than %d days ago.\n", purged, config.Duplicates.TrashRetentionDays)
+	} else {
+		fmt.Printf("Purged %d tracks trashed more than %d days ago.\n", purged, config.Duplicates.TrashRetentionDays)
+	}
+	return nil
+}
+
+// runRestoreFromTrash puts trashed tracks back in the playlists they were
+// removed from
+func runRestoreFromTrash(args []string) error {
+	fs := flag.NewFlagSet("restore-from-trash", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	all := fs.Bool("all", false, "restore everything in the trash")
+	keepPositions := fs.Bool("keep-positions", false, "put tracks back where they were in their playlists instead of at the end")
+	dryRun := dryRunFlag(fs, "report what would be restored without restoring it")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: potentials-utils restore-from-trash [-config path] [-dry-run] [-keep-positions] -all | <track ID>...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *all == (fs.NArg() > 0) {
+		fs.Usage()
+		return errors.New("expected -all or track IDs")
+	}
+
+	config, client, err := connectWritable(*cfgPath, *dryRun)
+	if err != nil {
+		return err
+	}
+	ids := []spotify.ID{}
+	for _, id := range fs.Args() {
+		ids = append(ids, spotify.ID(id))
+	}
+	t := newTrash(config, client)
+	t.DryRun, t.KeepPositions = *dryRun, *keepPositions
+	restored, err := t.Restore(context.Background(), ids...)
+	if err != nil {
+		return err
+	}
+	verb := "Restored"
+	if *dryRun {
+		verb = "Would restore"
+	}
+	for _, i := range restored {
+		fmt.Printf("%s %s to %s\n", verb, i.Track, i.From)
+	}
+	if len(restored) == 0 {
+		fmt.Println("Nothing in the trash to restore.")
+	}
+	return nil
+}
+
+// runLibrary runs the library subcommand named by args[0]
+func runLibrary(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "whois":
+			return runLibraryWhois(args[1:])
+		case "remove":
+			return runLibraryRemove(args[1:])
+		case "undo-remove":
+			return runLibraryUndoRemove(args[1:])
+		}
+	}
+	return errors.New("usage: potentials-utils library whois|remove|undo-remove [-config path]")
+}
+
+// filterFlags collects every -filter given
+type filterFlags []unlike.Filter
+
+func (f *filterFlags) String() string {
+	exprs := []string{}
+	for _, filter := range *f {
+		exprs = append(exprs, filter.String())
+	}
+	return strings.Join(exprs, ", ")
+}
+
+func (f *filterFlags) Set(expr string) error {
+	filter, err := unlike.ParseFilter(expr)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, filter)
+	return nil
+}
+
+// newUnlikeLog returns the audit log library remove records the tracks it
+// un-likes in, so they can be undone: the one configured, or one in the cache
+// directory if none is
+func newUnlikeLog(config *PotentialsUtilsConfig) *audit.Log {
+	if l := newAuditLog(config); l != nil {
+		return l
+	}
+	return commandAuditLog(path.Join(config.Cache.CacheDir, "audit.jsonl"))
+}
+
+// runLibraryRemove un-likes saved tracks listed in a file or matching
+// filters. With -plan the tracks are only written to a plan file, which
+// -apply un-likes later.
+func runLibraryRemove(args []string) error {
+	ctx := context.Background()
+	fs := flag.NewFlagSet("library remove", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	fromFile := fs.String("from-file", "", "file of track links, URIs or IDs to remove, one per line")
+	var filters filterFlags
+	fs.Var(&filters, "filter", "remove only saved tracks matching `expr`, e.g. artist=Drake, name~remix, added<2018-01-01 or popularity<10; may be repeated")
+	planPath := fs.String("plan", "", "write the tracks which would be removed to this file instead of removing them")
+	applyPath := fs.String("apply", "", "remove the tracks in a plan file written by -plan")
+	dryRun := dryRunFlag(fs, "report which tracks would be removed without removing them")
+	links := linksFlag(fs)
+	fs.Parse(args)
+	if *applyPath != "" && (*fromFile != "" || len(filters) > 0 || *planPath != "") {
+		return errors.New("--apply can't be combined with --from-file, --filter or --plan")
+	}
+	if *applyPath == "" && *fromFile == "" && len(filters) == 0 {
+		return errors.New("--from-file, --filter or --apply is required")
+	}
+	var ids []spotify.ID
+	if *fromFile != "" {
+		f, err := os.Open(*fromFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		var invalid []string
+		ids, invalid, err = bulkadd.ParseTrackIDs(f)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", *fromFile, err)
+		}
+		for _, line := range invalid {
+			fmt.Printf("[SKIPPED] not a track: %s\n", line)
+		}
+		if len(ids) == 0 {
+			return fmt.Errorf("no tracks found in %s", *fromFile)
+		}
+	}
+
+	// Only applying modifies Spotify
+	config, client, err := connectWritable(*cfgPath, *dryRun || *planPath != "", libraryModifyScopes...)
+	if err != nil {
+		return err
+	}
+	var plan *unlike.Plan
+	if *applyPath != "" {
+		if plan, err = unlike.LoadPlan(*applyPath); err != nil {
+			return fmt.Errorf("failed to read plan %s: %w", *applyPath, err)
+		}
+	} else if plan, err = unlike.NewPlan(ctx, client, ids, filters); err != nil {
+		return err
+	}
+	for _, id := range plan.NotSaved {
+		fmt.Printf("[SKIPPED] not saved: %s\n", id)
+	}
+	if *planPath != "" {
+		if err := plan.Save(*planPath); err != nil {
+			return err
+		}
+		fmt.Printf("Planned removing %d tracks to %s, run library remove --apply %s to remove them\n", len(plan.Tracks), *planPath, *planPath)
+		return nil
+	}
+
+	batch, removed, err := unlike.Apply(ctx, client, newUnlikeLog(config), plan, *dryRun)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, t := range removed {
+		fmt.Fprintf(w, "%s\t%s\tsaved %s%s\n", t.ID, t.Track, t.AddedAt, linkSuffix(*links, t.ID))
+	}
+	w.Flush()
+	if *dryRun {
+		fmt.Printf("Would remove %d tracks from your library\n", len(removed))
+		return nil
+	}
+	if len(removed) > 0 {
+		if err := library.ExpireStoredLibrary(config.Cache.CacheDir); err != nil {
+			log.WithFields(log.Fields{"err": err}).Warn("failed to expire the library cache")
+		}
+		fmt.Printf("Removed %d tracks from your library as batch %s, run library undo-remove -batch %s to save them again\n", len(removed), batch, batch)
+	}
+	if err != nil {
+		return fmt.Errorf("%w; %d of %d tracks were removed", err, len(removed), len(plan.Tracks))
+	}
+	return nil
+}
+
+// runLibraryUndoRemove saves the tracks un-liked by a library remove again
+func runLibraryUndoRemove(args []string) error {
+	fs := flag.NewFlagSet("library undo-remove", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	batch := fs.String("batch", "", "batch of removals to undo, the most recent if empty")
+	dryRun := dryRunFlag(fs, "report which tracks would be saved again without saving them")
+	fs.Parse(args)
+
+	config, client, err := connectWritable(*cfgPath, *dryRun, libraryModifyScopes...)
+	if err != nil {
+		return err
+	}
+	auditLog := newUnlikeLog(config)
+	if *batch == "" {
+		if *batch, err = unlike.LastBatch(auditLog); err != nil {
+			return err
+		}
+		if *batch == "" {
+			return errors.New("no tracks have been removed")
+		}
+	}
+	undone, err := unlike.Undo(context.Background(), client, auditLog, *batch, *dryRun)
+	verb := "Saved"
+	if *dryRun {
+		verb = "Would save"
+	} else if len(undone) > 0 {
+		if err := library.ExpireStoredLibrary(config.Cache.CacheDir); err != nil {
+			log.WithFields(log.Fields{"err": err}).Warn("failed to expire the library cache")
+		}
+	}
+	fmt.Printf("%s %d tracks removed by batch %s to your library again\n", verb, len(undone), *batch)
+	return err
+}
+
+// runLibraryWhois reports everything potentials-utils knows about a track
+// from its local state: when it was saved, the cached playlists holding it,
+// its tags and whether it's in the trash. Spotify isn't called.
+func runLibraryWhois(args []string) error {
+	fs := flag.NewFlagSet("library whois", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	links := linksFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("expected a track ID")
+	}
+	id := spotify.ID(fs.Arg(0))
+
+	log.SetLevel(logLevel)
+	config, err := loadConfig(*cfgPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config file %s: %w", *cfgPath, err)
+	}
+	stored, err := library.LoadStoredLibrary(config.Cache.CacheDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var saved *spotify.SavedTrack
+	if stored != nil {
+		for _, t := range stored.Tracks {
+			if t.ID == id {
+				st := t.SavedTrack()
+				saved = &st
+				break
+			}
+		}
+	}
+	playlists, err := spotifyclient.NewPlaylistCache(path.Join(config.Cache.CacheDir, "playlists")).List()
+	if err != nil {
+		return err
+	}
+	tags, err := dedupe.NewFileTagStore(path.Join(config.Cache.CacheDir, "tags.json")).Tags(id)
+	if err != nil {
+		return err
+	}
+	trashed, err := newTrash(config, nil).Items()
+	if err != nil {
+		return err
+	}
+
+	var track *spotify.FullTrack
+	if saved != nil {
+		track = &saved.FullTrack
+	}
+	w := os.Stdout
+	found := []string{}
+	for _, p := range playlists {
+		for ix, t := range p.Tracks {
+			if t.Track.ID != id {
+				continue
+			}
+			if track == nil {
+				track = &p.Tracks[ix].Track
+			}
+			found = append(found, fmt.Sprintf("  %s, position %d, added %s (as of %s)", p.Name, ix+1, t.AddedAt, p.CachedAt.Format(time.RFC3339)))
+		}
+	}
+	if track != nil {
+		fmt.Fprintf(w, "Track: %s\n", library.TrackString(*track))
+	} else {
+		fmt.Fprintf(w, "Track: %s, not found in the library cache or any cached playlist\n", id)
+	}
+	if *links {
+		fmt.Fprintf(w, "Link: %s\n", library.TrackLink(id))
+	}
+	switch {
+	case saved != nil:
+		fmt.Fprintf(w, "Saved to your library %s\n", saved.AddedAt)
+	case stored != nil:
+		fmt.Fprintf(w, "Not in your library as of %s\n", stored.IndexedAt.Format(time.RFC3339))
+	default:
+		fmt.Fprintln(w, "Your library hasn't been cached yet, run a clean first")
+	}
+	if len(found) > 0 {
+		fmt.Fprintln(w, "In cached playlists:")
+		for _, f := range found {
+			fmt.Fprintln(w, f)
+		}
+	} else {
+		fmt.Fprintln(w, "Not in any cached playlist")
+	}
+	if len(tags) > 0 {
+		fmt.Fprintf(w, "Tags: %s\n", strings.Join(tags, ", "))
+	}
+	for _, i := range trashed {
+		if i.TrackID == id {
+			fmt.Fprintf(w, "Trashed from %s %s: %s\n", i.From, i.TrashedAt.Format(time.RFC3339), i.Reason)
+		}
+	}
+	return nil
+}
+
+// runOpen opens a track in the Spotify client, or its open.spotify.com link
+// in the browser, with the desktop's handler for them
+func runOpen(args []string) error {
+	fs := flag.NewFlagSet("open", flag.ExitOnError)
+	web := fs.Bool("web", false, "open the track's open.spotify.com link in the browser instead")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("expected a track ID, spotify:track: URI or open.spotify.com link")
+	}
+	id, ok := bulkadd.ParseTrackID(strings.TrimSpace(fs.Arg(0)))
+	if !ok {
+		return fmt.Errorf("%q is not a Spotify track", fs.Arg(0))
+	}
+	target := "spotify:track:" + string(id)
+	if *web {
+		target = library.TrackLink(id)
+	}
+	name, cmdArgs := openCommand(runtime.GOOS, target)
+	if err := exec.Command(name, cmdArgs...).Run(); err != nil {
+		return fmt.Errorf("failed to open %s with %s: %w", target, name, err)
+	}
+	return nil
+}
+
+// openCommand returns the command which opens target with the default
+// handler on goos
+func openCommand(goos, target string) (string, []string) {
+	switch goos {
+	case "darwin":
+		return "open", []string{target}
+	case "windows":
+		// start treats its first quoted argument as the window title
+		return "cmd", []string{"/c", "start", "", target}
+	}
+	return "xdg-open", []string{target}
+}
+
+// runReport runs the report subcommand named by args[0]
+func runReport(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "coverage":
+			return runReportCoverage(args[1:])
+		case "artists":
+			return runReportArtists(args[1:])
+		}
+	}
+	return errors.New("usage: potentials-utils report coverage|artists [-config path]")
+}
+
+// runReportCoverage reports which of an artist's songs are in the library,
+// which are in Potentials and which are in neither
+func runReportCoverage(args []string) error {
+	fs := flag.NewFlagSet("report coverage", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	artistID := fs.String("artist", "", "ID of the artist to report on")
+	links := linksFlag(fs)
+	fs.Parse(args)
+	if *artistID == "" {
+		return errors.New("-artist is required")
+	}
+
+	config, client, err := connect(*cfgPath)
+	if err != nil {
+		return err
+	}
+	lib, err := library.NewLibraryService(client, config.Cache)
+	if err != nil {
+		return fmt.Errorf("failed to start the potentials-utils library service: %w", err)
+	}
+	r, err := coverage.Artist(context.Background(), client, lib, config.Spotify.PotentialsPlaylistID, spotify.ID(*artistID))
+	if err != nil {
+		return err
+	}
+	if len(r.Songs) == 0 {
+		fmt.Printf("No songs found for artist %s.\n", *artistID)
+		return nil
+	}
+	fmt.Printf("%s: %d songs, %d in the library, %d in Potentials, %d in both, %d in neither\n\n",
+		r.Artist, len(r.Songs), r.Count(coverage.StatusLibrary), r.Count(coverage.StatusPlaylist),
+		r.Count(coverage.StatusBoth), r.Count(coverage.StatusNeither))
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "Song\tIn\tTrack ID\tReleases\t"+linkCell(*links, ""))
+	for _, s := range r.Songs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", s.Name, s.Status, s.ID, strings.Join(s.Releases, ", "), linkCell(*links, s.ID))
+	}
+	return tw.Flush()
+}
+
+// runReportArtists reports which artists' tracks in a playlist are most often
+// already in the library
+func runReportArtists(args []string) error {
+	ctx := context.Background()
+	fs := flag.NewFlagSet("report artists", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	playlistID := fs.String("playlist", "", "ID of the playlist to report on, the Potentials playlist if empty")
+	top := fs.Int("top", 0, "only report the n most duplicated artists, every artist if 0")
+	fs.Parse(args)
+
+	config, client, err := connect(*cfgPath)
+	if err != nil {
+		return err
+	}
+	if *playlistID == "" {
+		*playlistID = string(config.Spotify.PotentialsPlaylistID)
+	}
+	cleaner, err := newCleaner(ctx, config, client)
+	if err != nil {
+		return err
+	}
+	report, err := cleaner.DuplicatesByArtist(ctx, spotify.ID(*playlistID))
+	if err != nil {
+		return err
+	}
+	if len(report) == 0 {
+		fmt.Printf("No duplicates found in %s.\n", *playlistID)
+		return nil
+	}
+	if *top > 0 && len(report) > *top {
+		report = report[:*top]
+	}
+	printArtistDuplicates(os.Stdout, report)
+	return nil
+}
+
+// printArtistDuplicates writes a table of duplicates per artist
+func printArtistDuplicates(w io.Writer, report []dedupe.ArtistDuplicates) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "Artist\tDuplicates\tTracks\tShare\tMatchers\t")
+	for _, a := range report {
+		matchers := []string{}
+		for m, n := range a.Matchers {
+			matchers = append(matchers, fmt.Sprintf("%s %d", m, n))
+		}
+		sort.Strings(matchers)
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.0f%%\t%s\t\n", a.Artist, len(a.Duplicates), a.Tracks, a.Share()*100, strings.Join(matchers, ", "))
+	}
+	tw.Flush()
+}
+
+// spotifyAPIURL is requested to compare the local clock with Spotify's
+const spotifyAPIURL = "https://api.spotify.com/v1/"
+
+// runDoctor checks the config, credentials, cache, auth callback and clock,
+// then authenticates and checks the token, granted OAuth scopes, playlist
+// ownership and write access a clean needs, saying how to fix anything wrong
+func runDoctor(args []string) error {
+	ctx := context.Background()
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	fs.Parse(args)
+
+	log.SetLevel(logLevel)
+	config, err := loadConfig(*cfgPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config file %s: %w", *cfgPath, err)
+	}
+	checks := []preflight.Check{
+		checkConfig(config),
+		preflight.CheckCredentials(config.Spotify.ID, config.Spotify.Secret, spotifyoauth.TokenURL),
+		preflight.CheckCache(config.Cache.CacheDir),
+		preflight.CheckCallback(config.Spotify.CallbackURL, serverAddr),
+		preflight.CheckClock(spotifyAPIURL),
+	}
+	auth := spotifyauth.New(config.Spotify.AuthConfig(newAuditLog(config)), config.Scopes(true)...)
+	if _, err := auth.AuthenticateWithServer(ctx, serverAddr); err != nil {
+		checks = append(checks, preflight.Check{
+			Name:    "auth",
+			Problem: fmt.Sprintf("failed to authenticate with Spotify: %v", err),
+			Remedy:  "fix the checks above, then open the printed URL and approve potentials-utils",
+		})
+	} else {
+		checks = append(checks, preflight.CheckToken(auth.Token()))
+		client := spotifyclient.New(auth.HTTPClient())
+		if playlists, err := config.Spotify.CleanPlaylists(ctx, client); err != nil {
+			checks = append(checks, preflight.Check{Name: "playlists", Problem: err.Error(), Remedy: "check the playlists listed in spotify.playlists"})
+		} else {
+			checks = append(checks, preflight.Run(ctx, client, preflightOptions(config, auth, playlists, config.ReadOnly))...)
+		}
+	}
+	printChecks(os.Stdout, checks)
+	failed := 0
+	for _, c := range checks {
+		if !c.OK() {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	return nil
+}
+
+// checkConfig checks the config has what a clean needs and that its matchers,
+// policy and normalization are valid
+func checkConfig(config *PotentialsUtilsConfig) preflight.Check {
+	check := preflight.Check{Name: "config"}
+	problems := []string{}
+	if config.Spotify.PotentialsPlaylistID == "" && len(config.Spotify.Playlists) == 0 {
+		problems = append(problems, "neither spotify.potentialsPlaylistID nor spotify.playlists is set")
+	}
+	registry := dedupe.NewRegistry()
+	if config.ListenBrainz.Enabled() {
+		listens, err := listenbrainz.New(config.ListenBrainz)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("invalid listenBrainz: %v", err))
+		} else {
+			registry.Register(listenbrainz.MatcherName, listenbrainz.NewMatcherFactory(listens))
+		}
+	}
+	registry.Register(review.MatcherName, review.NewMatcherFactory(newReviewLog(config)))
+	// Only the options are checked, the playlists are read on the first match
+	registry.Register(onrepeat.MatcherName, onrepeat.NewMatcherFactory(nil))
+	if _, err := registry.Pipeline(config.Duplicates.MatcherConfigs()); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid duplicates.matchers: %v", err))
+	}
+	if _, err := dedupe.NewPolicy(config.Duplicates.Policy); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid duplicates.policy: %v", err))
+	}
+	if _, err := library.NewCollatingNormalizer(config.Cache.Normalize, config.Cache.Collation); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid cache.normalize: %v", err))
+	}
+	if _, err := config.Cache.NewIndexKey(); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid cache.indexKey: %v", err))
+	}
+	if _, err := library.NewStore(config.Cache); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid cache: %v", err))
+	}
+	if err := config.Schedule.Validate(); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid schedule: %v", err))
+	}
+	if _, err := newNotifier(config); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid notify: %v", err))
+	}
+	if len(problems) > 0 {
+		check.Problem = strings.Join(problems, "; ")
+		check.Remedy = "compare your config with config.yaml.tpl"
+	}
+	return check
+}
+
+// printChecks writes a pass/fail checklist, with the remedy for each failure
+func printChecks(w io.Writer, checks []preflight.Check) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "Check\tStatus\tDetail\t")
+	for _, c := range checks {
+		if c.OK() {
+			fmt.Fprintf(tw, "%s\tpass\t%s\t\n", c.Name, c.Detail)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\tFAIL\t%s\t\n", c.Name, c.Problem)
+	}
+	tw.Flush()
+	for _, c := range checks {
+		if !c.OK() {
+			fmt.Fprintf(w, "To fix %s: %s\n", c.Name, c.Remedy)
+		}
+	}
+}
+
+// runStats reports how fast tracks move through Potentials, from local state
+func runStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	fs.Parse(args)
+
+	log.SetLevel(logLevel)
+	config, err := loadConfig(*cfgPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config file %s: %w", *cfgPath, err)
+	}
+	stats, err := potentialsStats(config)
+	if err != nil {
+		return err
+	}
+	printStats(os.Stdout, stats)
+	return nil
+}
+
+// printStats writes throughput stats followed by the aging curve of the
+// tracks still in the playlist
+func printStats(w io.Writer, s throughput.Stats) {
+	if s.LastCleanedAt.IsZero() {
+		fmt.Fprintln(w, "Last clean: never")
+	} else {
+		fmt.Fprintf(w, "Last clean: %s\n", s.LastCleanedAt.Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "Promoted: %d, %d in the last 30 days, median %.1f days in Potentials\n", s.Promoted, s.PromotedLast30Days, s.MedianDaysToPromotion)
+	fmt.Fprintf(w, "Removed: %d, %d in the last 30 days, median %.1f days in Potentials\n", s.Removed, s.RemovedLast30Days, s.MedianDaysToRemoval)
+	fmt.Fprintf(w, "Pending: %d\n", s.Pending)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "  Added\tTracks\t")
+	min := 0
+	for _, a := range s.Ages {
+		if a.MaxDays == 0 {
+			fmt.Fprintf(tw, "  over %d days ago\t%d\t\n", min, a.Tracks)
+			continue
+		}
+		fmt.Fprintf(tw, "  %d-%d days ago\t%d\t\n", min, a.MaxDays, a.Tracks)
+		min = a.MaxDays
+	}
+	tw.Flush()
+}
+
+// runDigest writes the digest of recent Potentials activity, from local
+// state, or sends it to the configured webhooks and directory
+func runDigest(args []string) error {
+	fs := flag.NewFlagSet("digest", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	days := fs.Int("days", 0, "days the digest covers (default digest.days from the config, or 7)")
+	format := fs.String("format", "json", "digest format, one of "+strings.Join(digest.Formats, ", "))
+	out := fs.String("out", "", "file the digest is written to (default stdout)")
+	send := fs.Bool("send", false, "send the digest to the configured webhooks and directory instead of writing it")
+	due := fs.Bool("due", false, "send the digest only if one is due, for running from cron")
+	fs.Parse(args)
+
+	log.SetLevel(logLevel)
+	config, err := loadConfig(*cfgPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config file %s: %w", *cfgPath, err)
+	}
+	if *days > 0 {
+		config.Digest.Days = *days
+	}
+	now := time.Now()
+	if *send || *due {
+		if !config.Digest.Enabled() {
+			return errors.New("no digest webhooks or dir are configured")
+		}
+		if *due {
+			sent, err := publishDueDigest(config, now)
+			if err == nil && !sent {
+				fmt.Println("No digest due")
+			}
+			return err
+		}
+		d, err := compileDigest(config, now.Add(-config.Digest.Period()), now)
+		if err != nil {
+			return err
+		}
+		if err := digest.Publish(config.Digest, d); err != nil {
+			return err
+		}
+		return newDigestLog(config).Sent(now)
+	}
+	if err := digest.CheckFormat(*format); err != nil {
+		return err
+	}
+	d, err := compileDigest(config, now.Add(-config.Digest.Period()), now)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		return digest.Write(os.Stdout, *format, d)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := digest.Write(f, *format, d); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// printExplanation writes e for people to read, with links to the tracks if
+// links is set
+func printExplanation(w io.Writer, e *dedupe.Explanation, links bool) {
+	fmt.Fprintf(w, "Track: %s%s\n", library.TrackString(e.Track.Track), linkSuffix(links, e.Track.Track.ID))
+	for ix, s := range e.Stages {
+		fmt.Fprintf(w, "\nStage %d: %s\n", ix+1, s.Stage)
+		keys := []string{}
+		for k := range s.Keys {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "  %s: %q\n", k, s.Keys[k])
+		}
+		if s.Keys != nil {
+			fmt.Fprintf(w, "  candidates: %d\n", len(s.Candidates))
+		}
+		for _, c := range s.Candidates {
+			fmt.Fprintf(w, "    - %s%s\n", library.TrackString(c.FullTrack), linkSuffix(links, c.ID))
+		}
+		if s.Matched {
+			fmt.Fprintf(w, "  => match, score %.2f: %s\n", s.Score, s.Reason)
+		} else {
+			fmt.Fprintf(w, "  => no match\n")
+		}
+	}
+	fmt.Fprintln(w)
+	switch {
+	case e.Match == nil:
+		fmt.Fprintln(w, "Decision: not a duplicate, kept")
+	case e.Kept != "":
+		fmt.Fprintf(w, "Decision: duplicate by %s, kept because %s\n", e.Match.Matcher, e.Kept)
+	default:
+		fmt.Fprintf(w, "Decision: duplicate by %s, %s\n", e.Match.Matcher, e.Action)
+	}
+	if e.Label != "" {
+		fmt.Fprintf(w, "Label: %s\n", e.Label)
+	}
+	if len(e.Genres) > 0 {
+		fmt.Fprintf(w, "Genres: %v\n", e.Genres)
+	}
+}
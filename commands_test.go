@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+
+	"potentials-utils/spotifyclient"
+	"potentials-utils/spotifytest"
+
+	"github.com/zmb3/spotify/v2"
+	spotifyoauth "github.com/zmb3/spotify/v2/auth"
+)
+
+func TestGlobalDryRun(t *testing.T) {
+	testCases := []struct {
+		name         string
+		args         []string
+		expectedArgs []string
+		expectDryRun bool
+	}{
+		{
+			name:         "no flag",
+			args:         []string{"restore", "all", "--from", "backups"},
+			expectedArgs: []string{"restore", "all", "--from", "backups"},
+		},
+		{
+			name:         "flag before the subcommand",
+			args:         []string{"--dry-run", "restore", "all"},
+			expectedArgs: []string{"restore", "all"},
+			expectDryRun: true,
+		},
+		{
+			name:         "flag after the subcommand is the subcommand's",
+			args:         []string{"restore", "all", "-dry-run"},
+			expectedArgs: []string{"restore", "all", "-dry-run"},
+		},
+		{
+			name:         "flag turned off again",
+			args:         []string{"-dry-run", "--dry-run=false", "trash", "purge"},
+			expectedArgs: []string{"trash", "purge"},
+		},
+		{
+			name:         "only the flag",
+			args:         []string{"--dry-run"},
+			expectedArgs: []string{},
+			expectDryRun: true,
+		},
+	}
+	defer func() { dryRun = false }()
+	for _, tc := range testCases {
+		dryRun = false
+		args := globalDryRun(tc.args)
+		if !reflect.DeepEqual(args, tc.expectedArgs) || dryRun != tc.expectDryRun {
+			t.Errorf("%s failed: expected %v and dry run %v, got %v and %v", tc.name, tc.expectedArgs, tc.expectDryRun, args, dryRun)
+		}
+	}
+}
+
+func TestSubcommands(t *testing.T) {
+	for name, cmd := range subcommands {
+		if cmd.run == nil || cmd.summary == "" {
+			t.Errorf("%s failed: expected a run function and a summary", name)
+		}
+	}
+	for _, name := range []string{"clean", "serve", "auth"} {
+		if _, ok := subcommands[name]; !ok {
+			t.Errorf("expected a %s subcommand", name)
+		}
+	}
+}
+
+func TestCleanPlaylists(t *testing.T) {
+	ctx := context.Background()
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	srv.AddPlaylist("0123456789abcdefghijkl", "Potentials")
+	srv.AddPlaylist("toListen", "To Listen")
+	srv.AddPlaylist("dupe1", "Twice")
+	srv.AddPlaylist("dupe2", "Twice")
+	client := spotifyclient.New(srv.HTTPClient())
+	testCases := []struct {
+		name        string
+		config      SpotifyConfig
+		expected    []spotify.ID
+		expectedErr bool
+	}{
+		{
+			name:     "defaults to potentials",
+			config:   SpotifyConfig{PotentialsPlaylistID: "potentials"},
+			expected: []spotify.ID{"potentials"},
+		},
+		{
+			name:     "IDs and names",
+			config:   SpotifyConfig{Playlists: []string{"To Listen", "0123456789abcdefghijkl"}},
+			expected: []spotify.ID{"toListen", "0123456789abcdefghijkl"},
+		},
+		{
+			name:        "unknown name",
+			config:      SpotifyConfig{Playlists: []string{"Nope"}},
+			expectedErr: true,
+		},
+		{
+			name:        "ambiguous name",
+			config:      SpotifyConfig{Playlists: []string{"Twice"}},
+			expectedErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		ids, err := tc.config.CleanPlaylists(ctx, client)
+		if (err != nil) != tc.expectedErr {
+			t.Errorf("%s failed: expected error %t, got %v", tc.name, tc.expectedErr, err)
+			continue
+		}
+		if !tc.expectedErr && !reflect.DeepEqual(ids, tc.expected) {
+			t.Errorf("%s failed: expected %v, got %v", tc.name, tc.expected, ids)
+		}
+	}
+}
+
+func TestScopes(t *testing.T) {
+	read := []string{spotifyoauth.ScopeUserReadPrivate, spotifyoauth.ScopePlaylistReadPrivate, spotifyoauth.ScopeUserLibraryRead}
+	testCases := []struct {
+		name     string
+		config   PotentialsUtilsConfig
+		write    bool
+		extra    []string
+		expected []string
+	}{
+		{
+			name:     "read only command",
+			expected: read,
+		},
+		{
+			name:     "writing command",
+			write:    true,
+			expected: append(append([]string{}, read...), spotifyoauth.ScopePlaylistModifyPublic, spotifyoauth.ScopePlaylistModifyPrivate),
+		},
+		{
+			name:     "read-only config",
+			config:   PotentialsUtilsConfig{ReadOnly: true},
+			write:    true,
+			extra:    libraryModifyScopes,
+			expected: read,
+		},
+		{
+			name:     "dry run player",
+			extra:    playerScopes,
+			expected: append(append([]string{}, read...), spotifyoauth.ScopeUserReadPlaybackState, spotifyoauth.ScopeUserReadCurrentlyPlaying),
+		},
+		{
+			name:     "override",
+			config:   PotentialsUtilsConfig{Spotify: SpotifyConfig{Scopes: []string{spotifyoauth.ScopeUserReadPrivate}}},
+			write:    true,
+			extra:    libraryModifyScopes,
+			expected: []string{spotifyoauth.ScopeUserReadPrivate},
+		},
+	}
+	for _, tc := range testCases {
+		if got := tc.config.Scopes(tc.write, tc.extra...); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s failed: expected %v, got %v", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	env := map[string]string{
+		envConfig:        "spotify:\n    id: from-config\n    potentialsPlaylistID: configured\nduplicates:\n    aggressive: true\n",
+		envSpotifySecret: "secret",
+		envRefreshToken:  "refresh",
+		envPlaylistID:    "from-env",
+		envCacheDir:      "/tmp/potentials-cache",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	config, err := configFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Spotify.ID != "from-config" || config.Spotify.Secret != "secret" || !config.Duplicates.Aggressive {
+		t.Errorf("expected POTENTIALS_CONFIG merged with the environment, got %+v", config)
+	}
+	if config.Spotify.PotentialsPlaylistID != "from-env" {
+		t.Errorf("expected the playlist from the environment, got %s", config.Spotify.PotentialsPlaylistID)
+	}
+	if config.Spotify.TokenFile != "/tmp/potentials-cache/"+tokenFile {
+		t.Errorf("expected the token kept in the cache directory, got %s", config.Spotify.TokenFile)
+	}
+
+	os.Unsetenv(envRefreshToken)
+	if _, err := configFromEnv(); err == nil {
+		t.Errorf("expected a missing refresh token rejected")
+	}
+}
@@ -5,11 +5,271 @@ spotify:
     callbackURL: http://localhost:8080/callback/spotify
     potentialsPlaylistID: Your Potentials Playlist ID
     authTimeoutNs: 6.0e+11 # 10 Minutes
+    # Optional playlists to clean in place of just Potentials, by ID or name
+    # playlists:
+    #     - Your Potentials Playlist ID
+    #     - To Listen
+    # Requests Spotify rate limits are retried after its Retry-After, and those failing
+    # with a 500, 502, 503 or 504 after backing off exponentially from backoffMs
+    # retry:
+    #     maxRetries: 5 # -1 never retries
+    #     backoffMs: 1000
+    #     maxWaitSec: 60 # fail rather than wait longer to retry
+    # Scopes every command requests, in place of only those it needs
+    # scopes: [user-read-private, playlist-read-private, user-library-read]
 
 
 duplicates:
     aggressive: false
+    # Optionally ignore aggressive matches when the Potentials track's album
+    # was released this many days after the library track's, e.g. a new live
+    # album of a song you've saved. Also a metadata and expr matcher option.
+    # newerReleaseDays: 365
+    # Optionally also remove tracks whose names are within fuzzyMaxDistance
+    # edits of a library track by the same artist, ignoring case, punctuation,
+    # "(feat. X)" and version suffixes like "(Remastered)".
+    # fuzzy: false
+    # fuzzyMaxDistance: 2
+    # Optionally index your saved albums too and treat tracks on them as duplicates
+    # even if the tracks themselves aren't liked.
+    # includeSavedAlbums: false
+    # Optionally count the tracks on these playlists, by ID or name, as part of your library
+    # too, so tracks already on them are duplicates whether or not they're liked.
+    # referencePlaylists: [Archive 2023]
+    # Optionally remove tracks appearing in Potentials more than once, by ID or index key,
+    # keeping the earliest, whether or not they're in your library.
+    # removeRepeats: false
+    # Optionally exempt tracks by artists in these genres from cleaning, or
+    # only clean tracks by artists in these genres.
+    # skipGenres: [jazz]
+    # onlyGenres: [indie rock]
+    # Optionally only clean tracks within a 0-100 Spotify popularity range.
+    # minPopularity: 20
+    # maxPopularity: 0 # no maximum
+    # Optionally move removed duplicates to a "Potentials Trash" playlist
+    # instead, purging them after this many days.
+    # trashRetentionDays: 30
+    # Optionally only clean tracks you added yourself, so cleaning a collaborative
+    # playlist never removes a friend's additions.
+    # ownAdditionsOnly: false
+    # Optionally hold back cleans which would remove far more duplicates than
+    # past cleans did, e.g. after a matcher or config change gone wrong.
+    # Command line cleans ask before going ahead, a server's fail and report
+    # the clean to Sentry.
+    # anomalies:
+    #     enabled: true
+    #     minRuns: 5 # past cleans needed before judging
+    #     threshold: 5 # median absolute deviations above the median
+    #     minRemovals: 10 # smaller cleans are never held back
+    # Optional ordered pipeline of duplicate matchers, overrides aggressive.
+    # Built-in matchers are id, isrc, album, metadata, fuzzy and expr. album
+    # matches tracks on saved albums. expr evaluates a
+    # Starlark expression against library tracks by the same artist.
+    # matchers:
+    #     - name: id
+    #     - name: isrc
+    #     - name: metadata
+    #       options:
+    #           compilations: true # ignore album, compare primary artist on compilations
+    #           newerReleaseDays: 365
+    #     - name: fuzzy
+    #       options:
+    #           maxDistance: 2 # never more than a quarter of the name's length
+    #           maxDurationDiff: 5 # seconds, ignored if 0
+    #           score: 0.8 # for names equal once normalized, lower per edit
+    #     - name: expr
+    #       options:
+    #           expression: track.name.lower() == lib.name.lower() and duration_diff < 3
+    #           score: 0.8
+    #           maxSteps: 100000 # Starlark steps per library track before giving up
+    #     # Needs listenBrainz below. Matches tracks you've listened to at
+    #     # least minListens times in the last days days.
+    #     - name: listens
+    #       options:
+    #           minListens: 5
+    #           days: 365
+    #     # Matches tracks skipped at least minSkipped times and never finished
+    #     # in `review start` sessions, and, if minFinished is set, tracks
+    #     # finished at least that many times.
+    #     - name: review
+    #       options:
+    #           minSkipped: 2
+    #     # Matches tracks on the playlists Spotify generates from what you play
+    #     # most, if you follow them. playlists are name patterns, playlistIDs
+    #     # are matched whatever they're called.
+    #     - name: onRepeat
+    #       options:
+    #           playlists: [On Repeat, Repeat Rewind, Your Top Songs *]
+    #           playlistIDs: []
+    # Optional policy deciding what happens to each duplicate. Actions are
+    # remove, archive, tag, ask, queue, report and skip. The first matching
+    # rule wins. queue keeps the track for `review duplicates`, as does
+    # scoring below queueBelow, whatever the rules say.
+    # policy:
+    #     default: remove
+    #     archivePlaylistID: Your Archive Playlist ID
+    #     tag: duplicate
+    #     queueBelow: 0.9
+    #     rules:
+    #         - labels: [A Label You Follow Closely]
+    #           action: report
+    #         - matcher: id
+    #           action: remove
+    #         - minScore: 0.9
+    #           action: archive
+    #         - action: report
 
 cache: 
     cacheDir: .cache
     lifetimeNs: 8.64e+13 # 1 Day
+    # allowStale: false # use an expired cache instead of rebuilding it, always on with --offline
+    # When the cache expires only tracks saved since are fetched, unless tracks have been
+    # removed. fullRebuild fetches the whole library every time, as does `cache rebuild`.
+    # fullRebuild: false
+    # Pages of saved tracks fetched at once when the whole library is fetched. Rate limited
+    # pages are retried, backing off exponentially.
+    # indexParallelism: 4
+    # Albums' labels, artists' genres and tracks looked up from Spotify are cached in
+    # cacheDir/entities, for 30 days, 7 days and 1 day by default. 0 doesn't cache a kind.
+    # entityLifetimesNs:
+    #     albumLabels: 2.592e+15 # 30 Days
+    #     artistGenres: 6.048e+14 # 7 Days
+    #     tracks: 8.64e+13 # 1 Day
+    # json caches the library's tracks as readable JSON, gob as a binary encoding, in a
+    # smaller file which loads faster.
+    # format: json
+    # file caches the library in cacheDir/library.json or .gob, rewritten whole, bolt in a
+    # cacheDir/library.db database which only rewrites the tracks which changed.
+    # backend: file
+    # Normalization applied, in order, to track, album and artist names both when
+    # the library is indexed and when the metadata matcher looks tracks up. Steps are
+    # case, unicode (quotes, dashes and accents), suffixes (" - Remastered", "(Live)"),
+    # feat ("(feat. Someone)"), punctuation and space. Names are compared as they are
+    # if unset.
+    # normalize: [unicode, feat, suffixes, case, space]
+    # Language whose rules are used to compare letters along with normalize: tr and az
+    # lower I to ı and İ to i, de folds ß to ss and ü to ue, da and no fold å to aa and
+    # æ to ae, nl folds ĳ to ij.
+    # collation: tr
+    # Fields of the key the library is indexed under and the metadata matcher looks
+    # tracks up by, in order: name, album, artists, isrc and duration. Durations match
+    # within buckets indexDurationBucketSec wide, default 5. Drop album to match singles
+    # against album tracks, or add duration to tell edits apart.
+    # indexKey: [name, album, artists]
+    # indexDurationBucketSec: 5
+
+server:
+    maxConcurrentJobs: 1
+    # evictionWebhook: https://example.com/hooks/potentials # POSTed to each time the library index expires
+    # warmUp: true # serve from the cached library while rebuilding it in the background
+    # freshness: # per endpoint while warming up: stale serves the cached library, fresh waits
+    #     clean: fresh
+    #     add: stale
+    #     search: stale
+
+# Optionally have a running server clean Potentials and refresh the library by
+# itself. Schedules are cron expressions in local time (minute hour day month
+# weekday), @hourly, @daily, @weekly, @monthly or "@every 90m".
+# schedule:
+#     clean: "0 */6 * * *"
+#     refresh: "@daily"
+#     jitterSec: 300 # delay each run by up to 5 minutes
+#     dryRun: false
+
+# Optional OpenTelemetry tracing of clean runs, exported to an OTLP/HTTP
+# collector such as Jaeger or the OpenTelemetry Collector
+# tracing:
+#     endpoint: http://localhost:4318
+#     serviceName: potentials-utils
+
+# Optional pushing of each clean run's metrics, e.g. from cron, to a Prometheus
+# Pushgateway and/or a StatsD server
+# metrics:
+#     pushgatewayURL: http://localhost:9091
+#     job: potentials-utils
+#     statsdAddr: localhost:8125
+
+# Optional reporting of clean job errors and panics in server mode to Sentry,
+# or a compatible service such as GlitchTip
+# sentry:
+#     dsn: https://publicKey@o0.ingest.sentry.io/0
+#     environment: production
+
+# Optional Apple Music account for export applemusic, which copies backed up
+# playlists and saved tracks into Apple Music by ISRC
+# appleMusic:
+#     developerToken: Your MusicKit developer token
+#     userToken: Your Music User Token
+#     storefront: us
+
+# Optional YouTube Music account for crosscheck, which reports which Potentials
+# tracks you've already liked there. Needs a Google OAuth client with the
+# YouTube Data API enabled and a refresh token with the youtube.readonly scope.
+# youtubeMusic:
+#     clientID: Your Google OAuth client ID
+#     clientSecret: Your Google OAuth client secret
+#     refreshToken: Your refresh token
+
+# Optional ListenBrainz account. Its listen history feeds the listens matcher,
+# and with submitLoved every track removed from Potentials because it's in your
+# library is loved on ListenBrainz, which needs your user token.
+# listenBrainz:
+#     user: Your ListenBrainz user name
+#     token: Your ListenBrainz user token
+#     submitLoved: true
+
+# Optional digest of the week in Potentials, which a running server or
+# `potentials-utils digest --due` sends every days days. Each webhook is sent a
+# JSON POST, and dir gets the digest as JSON and HTML.
+# digest:
+#     webhooks:
+#         - https://example.com/hooks/potentials
+#     dir: digests
+#     days: 7
+
+# Optional channels a running server tells each time a job finishes. Events are
+# named by job kind and status, e.g. clean.succeeded or refresh.failed, and
+# events limits a channel to those matching any of its patterns.
+# notify:
+#     channels:
+#         - type: webhook # POSTed each event as JSON
+#           options:
+#               url: https://example.com/hooks/potentials
+#         - type: slack
+#           events: ["*.failed"]
+#           options:
+#               url: https://hooks.slack.com/services/...
+#         - type: email
+#           events: [clean.*]
+#           options:
+#               addr: smtp.example.com:587
+#               from: potentials@example.com
+#               to: you@example.com
+#               username: potentials@example.com
+#               password: Your SMTP password
+#         - type: telegram
+#           options:
+#               token: Your bot token
+#               chatID: Your chat ID
+#         - type: desktop # notify-send on Linux, osascript on macOS
+
+# Refuse every call which would modify Spotify, even outside dry-run mode. A
+# safety net while experimenting with new matchers or policies. Also --read-only.
+# readOnly: true
+
+# Optional append-only log of every change made to your playlists and library,
+# with the playlist versions they produced, logins and library cache rebuilds,
+# one JSON object per line. `library remove` records what it un-likes in
+# .cache/audit.jsonl if no path is set, so it can be undone.
+# audit:
+#     path: .cache/audit.jsonl
+
+# Optional named routines of subcommands, run with `potentials-utils run <name>`
+# recipes:
+#     weekly:
+#         steps:
+#             - clean --force
+#             - trash purge
+#             - backup all --out backups
+#         continueOnError: false # stop at the first step which fails
+#         webhook: https://example.com/hooks/potentials # POSTed how every step went
@@ -0,0 +1,193 @@
+// Package coverage reports how much of an artist's catalog is in the library
+// or queued up in a playlist, to help decide what to listen to next.
+package coverage
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"potentials-utils/dedupe"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// API is the view of the Spotify API needed to report coverage
+type API interface {
+	ArtistAlbums(ctx context.Context, artistID spotify.ID) (*spotify.SimpleAlbumPage, error)
+	NextArtistAlbums(ctx context.Context, page *spotify.SimpleAlbumPage) error
+	AlbumTracks(ctx context.Context, albumID spotify.ID) (*spotify.SimpleTrackPage, error)
+	NextAlbumTracks(ctx context.Context, page *spotify.SimpleTrackPage) error
+	GetPlaylist(ctx context.Context, playlistID spotify.ID) (*spotify.FullPlaylist, error)
+	NextPlaylistTracks(ctx context.Context, page *spotify.PlaylistTrackPage) error
+}
+
+// Status is where a song was found
+type Status string
+
+const (
+	StatusLibrary  Status = "library"
+	StatusPlaylist Status = "playlist"
+	StatusBoth     Status = "both"
+	StatusNeither  Status = "neither"
+)
+
+// Song is one of an artist's songs, which may have been released several
+// times, e.g. as a single and on an album
+type Song struct {
+	Name string
+	// Releases are the albums and singles the song is on
+	Releases []string
+	// ID is the ID of the song's first release
+	ID     spotify.ID
+	Status Status
+}
+
+// Report is the coverage of one artist's songs
+type Report struct {
+	Artist string
+	// Songs are ordered by name
+	Songs []Song
+}
+
+// Count returns how many songs have the given status
+func (r *Report) Count(s Status) int {
+	n := 0
+	for _, song := range r.Songs {
+		if song.Status == s {
+			n++
+		}
+	}
+	return n
+}
+
+// Artist reports which of an artist's songs are in lib, in the playlist, in
+// both or in neither. Songs are matched by ID, or by name against the saved
+// and playlist tracks credited to the artist, so a song saved from one
+// release covers every release of it.
+func Artist(ctx context.Context, client API, lib dedupe.Library, playlistID, artistID spotify.ID) (*Report, error) {
+	r := &Report{}
+	songs := map[string]*Song{}
+	albums, err := client.ArtistAlbums(ctx, artistID)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		for _, a := range albums.Albums {
+			if err := addAlbum(ctx, client, a, artistID, r, songs); err != nil {
+				return nil, err
+			}
+		}
+		if err := client.NextArtistAlbums(ctx, albums); err == spotify.ErrNoMorePages {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	inLibrary := map[string]bool{}
+	if r.Artist != "" {
+		saved, err := lib.GetByArtistName(r.Artist)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range saved {
+			inLibrary[songKey(t.Name)] = true
+		}
+	}
+	inPlaylist, err := playlistSongs(ctx, client, playlistID, artistID)
+	if err != nil {
+		return nil, err
+	}
+	for key, song := range songs {
+		library, playlist := inLibrary[key], inPlaylist[key]
+		if saved, err := lib.GetByID(song.ID); err != nil {
+			return nil, err
+		} else if saved != nil {
+			library = true
+		}
+		switch {
+		case library && playlist:
+			song.Status = StatusBoth
+		case library:
+			song.Status = StatusLibrary
+		case playlist:
+			song.Status = StatusPlaylist
+		default:
+			song.Status = StatusNeither
+		}
+		r.Songs = append(r.Songs, *song)
+	}
+	sort.Slice(r.Songs, func(i, j int) bool { return r.Songs[i].Name < r.Songs[j].Name })
+	return r, nil
+}
+
+// addAlbum adds the songs on an album credited to the artist
+func addAlbum(ctx context.Context, client API, a spotify.SimpleAlbum, artistID spotify.ID, r *Report, songs map[string]*Song) error {
+	tracks, err := client.AlbumTracks(ctx, a.ID)
+	if err != nil {
+		return err
+	}
+	for {
+		for _, t := range tracks.Tracks {
+			credited := false
+			for _, artist := range t.Artists {
+				if artist.ID == artistID {
+					credited = true
+					if r.Artist == "" {
+						r.Artist = artist.Name
+					}
+				}
+			}
+			if !credited {
+				continue
+			}
+			key := songKey(t.Name)
+			song, ok := songs[key]
+			if !ok {
+				song = &Song{Name: t.Name, ID: t.ID}
+				songs[key] = song
+			}
+			song.Releases = append(song.Releases, a.Name)
+		}
+		if err := client.NextAlbumTracks(ctx, tracks); err == spotify.ErrNoMorePages {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// playlistSongs returns the keys of the songs in a playlist credited to the
+// artist
+func playlistSongs(ctx context.Context, client API, playlistID, artistID spotify.ID) (map[string]bool, error) {
+	songs := map[string]bool{}
+	playlist, err := client.GetPlaylist(ctx, playlistID)
+	if err != nil {
+		return nil, err
+	}
+	page := &playlist.Tracks
+	for {
+		for _, t := range page.Tracks {
+			for _, a := range t.Track.Artists {
+				if a.ID == artistID {
+					songs[songKey(t.Track.Name)] = true
+				}
+			}
+		}
+		if err := client.NextPlaylistTracks(ctx, page); err == spotify.ErrNoMorePages {
+			return songs, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// songKey identifies a song across its releases by its name, ignoring case
+// and anything after " - ", e.g. " - Remastered 2011" or " - Single Version"
+func songKey(name string) string {
+	if ix := strings.Index(name, " - "); ix > 0 {
+		name = name[:ix]
+	}
+	return strings.ToLower(strings.TrimSpace(name))
+}
@@ -0,0 +1,70 @@
+package coverage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"potentials-utils/library"
+	"potentials-utils/spotifyclient"
+	"potentials-utils/spotifytest"
+)
+
+func TestArtist(t *testing.T) {
+	ctx := context.Background()
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	srv.AddSavedTracks(
+		spotifytest.Track("a1", "Song A", "First", "Band"),
+		spotifytest.Track("c2", "Song C - Single Version", "Song C", "Band"),
+	)
+	srv.AddPlaylist("potentials", "Potentials",
+		spotifytest.Track("b1", "Song B", "First", "Band"),
+		spotifytest.Track("c1", "Song C", "First", "Band"),
+		spotifytest.Track("x1", "Song X", "Other", "Someone Else"),
+	)
+	srv.AddTracks(spotifytest.Track("d1", "Song D", "First", "Band"))
+
+	dir, err := ioutil.TempDir("", "coverage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := spotifyclient.New(srv.HTTPClient())
+	lib, err := library.NewLibraryService(client, library.CacheConfig{CacheDir: dir, Lifetime: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Artist(ctx, client, lib, "potentials", "band")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Artist != "Band" {
+		t.Errorf("expected the artist's name, got %q", r.Artist)
+	}
+	expected := []struct {
+		name     string
+		status   Status
+		releases int
+	}{
+		{name: "Song A", status: StatusLibrary, releases: 1},
+		{name: "Song B", status: StatusPlaylist, releases: 1},
+		{name: "Song C", status: StatusBoth, releases: 2},
+		{name: "Song D", status: StatusNeither, releases: 1},
+	}
+	if len(r.Songs) != len(expected) {
+		t.Fatalf("expected %d songs, got %+v", len(expected), r.Songs)
+	}
+	for ix, e := range expected {
+		s := r.Songs[ix]
+		if s.Name != e.name || s.Status != e.status || len(s.Releases) != e.releases {
+			t.Errorf("%s failed: expected %s on %d releases, got %+v", e.name, e.status, e.releases, s)
+		}
+	}
+	if r.Count(StatusNeither) != 1 {
+		t.Errorf("expected 1 song in neither, got %d", r.Count(StatusNeither))
+	}
+}
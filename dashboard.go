@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+
+	"potentials-utils/dedupe"
+	"potentials-utils/jobs"
+	"potentials-utils/library"
+
+	"github.com/apex/log"
+	"github.com/zmb3/spotify/v2"
+)
+
+// dashboardJobs is how many of the most recent jobs the dashboard lists
+const dashboardJobs = 10
+
+// dashboardJob is a job as listed on the dashboard
+type dashboardJob struct {
+	ID        string
+	Kind      string
+	Status    jobs.Status
+	CreatedAt time.Time
+	// Summary describes the job's result, if it has one
+	Summary string
+	Error   string
+}
+
+// lastClean is the last clean of one of the playlists cleaned
+type lastClean struct {
+	PlaylistID spotify.ID
+	// Record is nil if the playlist has never been completely cleaned
+	Record *dedupe.CleanRecord
+}
+
+// dashboard is everything the dashboard shows
+type dashboard struct {
+	// Library is nil if the library can't report how fresh it is
+	Library   *library.IndexStatus
+	ExpiresIn time.Duration
+	// LastCleans are the last clean of each playlist cleaned, empty if
+	// cleans aren't recorded
+	LastCleans      []lastClean
+	Jobs            []dashboardJob
+	Stats           jobs.Stats
+	SpotifyAPICalls int64
+	Schedule        ScheduleConfig
+}
+
+var dashboardPage = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>potentials-utils</title></head>
+<body>
+<h1>potentials-utils</h1>
+<h2>Library</h2>
+{{with .Library}}<p>{{.Tracks}} tracks, indexed {{.IndexedAt.Format "Jan 2 15:04"}}.
+{{if .Warming}}Rebuilding in the background.{{else if .Alive}}Fresh, expires in {{$.ExpiresIn}}.{{else}}Stale since {{.ExpiresAt.Format "Jan 2 15:04"}}, rebuilt on the next lookup.{{end}}</p>
+{{else}}<p>Freshness unknown.</p>{{end}}
+<h2>Last clean</h2>
+{{$named := gt (len .LastCleans) 1}}{{range .LastCleans}}<p>{{if $named}}<code>{{.PlaylistID}}</code>: {{end}}{{with .Record}}{{.CleanedAt.Format "Jan 2 15:04"}}{{with .Result}}: {{.Summary}}{{end}}{{else}}Never cleaned.{{end}}</p>
+{{else}}<p>Never cleaned.</p>{{end}}
+<p>
+<button onclick="clean(true)">Dry run</button>
+<button onclick="if (confirm('Remove duplicates from Potentials?')) clean(false)">Clean</button>
+<span id="queued"></span>
+</p>
+{{if or .Schedule.Clean .Schedule.Refresh}}<p>Scheduled:{{with .Schedule.Clean}} cleans at <code>{{.}}</code>{{end}}{{with .Schedule.Refresh}} refreshes at <code>{{.}}</code>{{end}}{{if .Schedule.DryRun}}, as dry runs{{end}}.</p>{{end}}
+<h2>Jobs</h2>
+<p>{{.Stats.Queued}} queued, {{.Stats.Running}} running, {{.Stats.Succeeded}} succeeded, {{.Stats.Failed}} failed. {{.SpotifyAPICalls}} Spotify API calls.</p>
+<table>
+<tr><th>Created</th><th>Kind</th><th>Status</th><th>Result</th></tr>
+{{range .Jobs}}<tr><td><a href="/jobs/{{.ID}}">{{.CreatedAt.Format "Jan 2 15:04:05"}}</a></td><td>{{.Kind}}</td><td>{{.Status}}</td><td>{{.Summary}}{{with .Error}} {{.}}{{end}}</td></tr>
+{{else}}<tr><td colspan="4">None yet</td></tr>{{end}}
+</table>
+<script>
+function clean(dryRun) {
+	fetch("/spotify/cleanpotentials?dryRun=" + dryRun, {method: "POST"})
+		.then(function(resp) { return resp.json() })
+		.then(function(job) {
+			document.getElementById("queued").textContent = "Queued job " + job.id + ".";
+			setTimeout(function() { location.reload() }, 2000);
+		});
+}
+</script>
+</body>
+</html>
+`))
+
+// HandleDashboard serves an HTML dashboard of the library index's freshness,
+// the last clean and recent jobs at /, with buttons to queue a clean or a dry
+// run
+func (s *server) HandleDashboard(w http.ResponseWriter, r *http.Request) {
+	logger := log.FromContext(r.Context())
+	if r.URL.Path != "/" {
+		logger.WithFields(log.Fields{"url": r.URL.String()}).Debug("unhandled request")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	d, err := s.dashboard(r.Context())
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardPage.Execute(w, d); err != nil {
+		logger.WithFields(log.Fields{"err": err}).Error("failed to write dashboard")
+	}
+}
+
+// dashboard gathers what the dashboard shows
+func (s *server) dashboard(ctx context.Context) (dashboard, error) {
+	d := dashboard{
+		Stats:           s.jobs.Stats(),
+		SpotifyAPICalls: s.usage.Calls(),
+		Schedule:        s.config.Schedule,
+	}
+	if lib, ok := s.cleaner.Library().(watchedLibrary); ok {
+		status := lib.Status()
+		d.Library, d.ExpiresIn = &status, status.ExpiresIn(time.Now()).Round(time.Minute)
+	}
+	if s.cleaner.History != nil {
+		playlists, err := s.cleanPlaylists(ctx)
+		if err != nil {
+			return d, fmt.Errorf("failed to look up the playlists cleaned: %w", err)
+		}
+		for _, id := range playlists {
+			last, err := s.cleaner.History.LastClean(id)
+			if err != nil {
+				return d, fmt.Errorf("failed to read the clean history: %w", err)
+			}
+			d.LastCleans = append(d.LastCleans, lastClean{PlaylistID: id, Record: last})
+		}
+	}
+	listed := s.jobs.List()
+	for ix := len(listed) - 1; ix >= 0 && len(d.Jobs) < dashboardJobs; ix-- {
+		d.Jobs = append(d.Jobs, newDashboardJob(listed[ix]))
+	}
+	return d, nil
+}
+
+// newDashboardJob summarizes j for the dashboard
+func newDashboardJob(j jobs.Job) dashboardJob {
+	return dashboardJob{ID: j.ID, Kind: j.Kind, Status: j.Status, CreatedAt: j.CreatedAt, Summary: jobSummary(j), Error: j.Error}
+}
+
+// jobSummary describes j's result for people, empty if it has none
+func jobSummary(j jobs.Job) string {
+	switch result := j.Result.(type) {
+	case dedupe.Result:
+		return result.Summary()
+	case cleanResult:
+		return result.Summary()
+	case library.IndexStatus:
+		return fmt.Sprintf("%d tracks indexed.", result.Tracks)
+	}
+	return ""
+}
@@ -0,0 +1,121 @@
+package dedupe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/apex/log"
+	"github.com/zmb3/spotify/v2"
+)
+
+// AnomalyConfig holds back cleans which would remove far more duplicates than
+// past cleans of the same playlist did, as a broken matcher or config change
+// might
+type AnomalyConfig struct {
+	// Enabled compares each clean with past cleans
+	Enabled bool `yaml:"enabled"`
+	// MinRuns is how many past cleans there must be before any is judged an
+	// anomaly, default 5
+	MinRuns int `yaml:"minRuns"`
+	// Threshold is how many median absolute deviations above the median of
+	// past cleans a clean may remove before it's an anomaly, default 5
+	Threshold float64 `yaml:"threshold"`
+	// MinRemovals is the fewest removals an anomaly can have, so small
+	// cleans never are, default 10
+	MinRemovals int `yaml:"minRemovals"`
+}
+
+// ErrAnomalous is returned when a clean would remove far more duplicates than
+// usual and nobody confirmed it
+var ErrAnomalous = errors.New("clean would remove far more duplicates than usual")
+
+// Anomaly is a clean removing far more duplicates than past cleans
+type Anomaly struct {
+	Removals int
+	// Runs is how many past cleans it was compared with, Median the median
+	// removals of those and Limit the most a clean may remove before it's an
+	// anomaly
+	Runs   int
+	Median float64
+	Limit  float64
+}
+
+func (a Anomaly) String() string {
+	return fmt.Sprintf("%d duplicates to remove, where the last %d cleans removed %g on median and more than %.0f is unusual", a.Removals, a.Runs, a.Median, a.Limit)
+}
+
+// Check returns the anomaly if removing removals is one given the removals
+// of past cleans, otherwise nil
+func (c AnomalyConfig) Check(past []int, removals int) *Anomaly {
+	minRuns, threshold, minRemovals := c.MinRuns, c.Threshold, c.MinRemovals
+	if minRuns <= 0 {
+		minRuns = 5
+	}
+	if threshold <= 0 {
+		threshold = 5
+	}
+	if minRemovals <= 0 {
+		minRemovals = 10
+	}
+	if len(past) < minRuns || removals < minRemovals {
+		return nil
+	}
+	values := make([]float64, len(past))
+	for ix, n := range past {
+		values[ix] = float64(n)
+	}
+	m := median(values)
+	deviations := make([]float64, len(values))
+	for ix, v := range values {
+		deviations[ix] = math.Abs(v - m)
+	}
+	// Cleans removing the same number every time still allow a little slack
+	mad := math.Max(median(deviations), 1)
+	limit := m + threshold*mad
+	if float64(removals) <= limit {
+		return nil
+	}
+	return &Anomaly{Removals: removals, Runs: len(past), Median: m, Limit: limit}
+}
+
+// median returns the median of values, which it sorts
+func median(values []float64) float64 {
+	sort.Float64s(values)
+	mid := len(values) / 2
+	if len(values)%2 == 0 {
+		return (values[mid-1] + values[mid]) / 2
+	}
+	return values[mid]
+}
+
+// checkAnomaly returns an error wrapping ErrAnomalous if removing removals
+// duplicates from the playlist is an anomaly which isn't confirmed. Dry runs
+// only report anomalies.
+func (c *Cleaner) checkAnomaly(ctx context.Context, playlistID spotify.ID, removals int, dryRun bool) error {
+	if !c.Anomalies.Enabled || c.History == nil {
+		return nil
+	}
+	last, err := c.History.LastClean(playlistID)
+	if err != nil {
+		return err
+	}
+	a := c.Anomalies.Check(last.removals(), removals)
+	if a == nil {
+		return nil
+	}
+	log.FromContext(ctx).WithFields(log.Fields{"removals": removals, "runs": a.Runs, "median": a.Median, "limit": a.Limit}).Warn("clean would remove far more duplicates than usual")
+	fmt.Fprintf(c.Out, "[ANOMALY] %s\n", a)
+	if dryRun {
+		return nil
+	}
+	if c.ConfirmAnomaly != nil {
+		confirmed, err := c.ConfirmAnomaly(*a)
+		if err != nil || confirmed {
+			return err
+		}
+	}
+	return fmt.Errorf("%s: %w", a, ErrAnomalous)
+}
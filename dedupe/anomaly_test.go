@@ -0,0 +1,27 @@
+package dedupe
+
+import "testing"
+
+func TestCheckAnomaly(t *testing.T) {
+	testCases := []struct {
+		name     string
+		config   AnomalyConfig
+		past     []int
+		removals int
+		anomaly  bool
+	}{
+		{name: "usual", past: []int{10, 12, 9, 11, 10}, removals: 13, anomaly: false},
+		{name: "outlier", past: []int{10, 12, 9, 11, 10}, removals: 40, anomaly: true},
+		{name: "too few past cleans", past: []int{10, 12, 9}, removals: 40, anomaly: false},
+		{name: "too few removals", past: []int{0, 1, 0, 0, 1}, removals: 9, anomaly: false},
+		{name: "steady cleans allow some slack", past: []int{2, 2, 2, 2, 2}, removals: 7, anomaly: false},
+		{name: "wide spread", past: []int{5, 50, 10, 40, 20}, removals: 60, anomaly: false},
+		{name: "lower threshold", config: AnomalyConfig{Threshold: 1, MinRemovals: 1}, past: []int{10, 12, 9, 11, 10}, removals: 13, anomaly: true},
+	}
+	for _, tc := range testCases {
+		a := tc.config.Check(tc.past, tc.removals)
+		if (a != nil) != tc.anomaly {
+			t.Errorf("%s failed: expected anomaly %t, got %+v", tc.name, tc.anomaly, a)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package dedupe
+
+import (
+	"context"
+	"sort"
+
+	"potentials-utils/library"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// ArtistDuplicates counts the duplicates of the library in a playlist
+// credited to one artist
+type ArtistDuplicates struct {
+	// Artist is the primary artist of the tracks
+	Artist string `json:"artist"`
+	// Tracks is how many of the playlist's tracks are by the artist
+	Tracks int `json:"tracks"`
+	// Duplicates are the artist's tracks in the playlist already in the
+	// library
+	Duplicates []Duplicate `json:"-"`
+	// Matchers counts the duplicates by the matcher which found them
+	Matchers map[string]int `json:"matchers"`
+}
+
+// Share returns the fraction of the artist's tracks which are duplicates
+func (a ArtistDuplicates) Share() float64 {
+	if a.Tracks == 0 {
+		return 0
+	}
+	return float64(len(a.Duplicates)) / float64(a.Tracks)
+}
+
+// DuplicatesByArtist matches every track of a playlist against the library,
+// as a dry run clean would, and groups the duplicates by primary artist. Only
+// artists with duplicates are returned, most duplicated first. The policy and
+// filters aren't applied, so every duplicate is counted whatever would be
+// done with it.
+func (c *Cleaner) DuplicatesByArtist(ctx context.Context, playlistID spotify.ID) ([]ArtistDuplicates, error) {
+	playlist, err := c.client.GetPlaylist(ctx, playlistID)
+	if err != nil {
+		return nil, err
+	}
+	byArtist := map[string]*ArtistDuplicates{}
+	page := &playlist.Tracks
+	for {
+		duplicates, err := c.Duplicates(page.Tracks)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range page.Tracks {
+			artistFor(byArtist, t.Track.SimpleTrack).Tracks++
+		}
+		for _, d := range duplicates {
+			a := artistFor(byArtist, d.Track.Track.SimpleTrack)
+			a.Duplicates = append(a.Duplicates, d)
+			a.Matchers[d.Matcher]++
+		}
+		if err := c.client.NextPlaylistTracks(ctx, page); err == spotify.ErrNoMorePages {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	report := []ArtistDuplicates{}
+	for _, a := range byArtist {
+		if len(a.Duplicates) > 0 {
+			report = append(report, *a)
+		}
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if len(report[i].Duplicates) != len(report[j].Duplicates) {
+			return len(report[i].Duplicates) > len(report[j].Duplicates)
+		}
+		return report[i].Artist < report[j].Artist
+	})
+	return report, nil
+}
+
+// artistFor returns the counts of a track's primary artist, adding them if
+// new
+func artistFor(byArtist map[string]*ArtistDuplicates, t spotify.SimpleTrack) *ArtistDuplicates {
+	name := library.PrimaryArtist(t)
+	a, ok := byArtist[name]
+	if !ok {
+		a = &ArtistDuplicates{Artist: name, Matchers: map[string]int{}}
+		byArtist[name] = a
+	}
+	return a
+}
@@ -0,0 +1,70 @@
+package dedupe
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"potentials-utils/library"
+	"potentials-utils/spotifyclient"
+	"potentials-utils/spotifytest"
+)
+
+func TestDuplicatesByArtist(t *testing.T) {
+	ctx := context.Background()
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	a1 := spotifytest.Track("a1", "One", "Album", "A")
+	a2 := spotifytest.Track("a2", "Two", "Album", "A", "B")
+	b1 := spotifytest.Track("b1", "Three", "Album", "B")
+	b2 := spotifytest.Track("b2", "Four", "Album", "B")
+	c1 := spotifytest.Track("c1", "Five", "Album", "C")
+	srv.AddSavedTracks(a1, a2, b1)
+	srv.AddPlaylist("potentials", "Potentials", a1, a2, b1, b2, c1)
+	dir, err := ioutil.TempDir("", "dedupe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := spotifyclient.New(srv.HTTPClient())
+	lib, err := library.NewLibraryService(client, library.CacheConfig{CacheDir: dir, Lifetime: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := NewRegistry().Pipeline([]MatcherConfig{{Name: "id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCleaner(client, lib, pipeline, &Policy{}, nil)
+
+	report, err := c.DuplicatesByArtist(ctx, "potentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report) != 2 {
+		t.Fatalf("expected 2 artists with duplicates, got %+v", report)
+	}
+	testCases := []struct {
+		artist     string
+		tracks     int
+		duplicates int
+		share      float64
+	}{
+		{artist: "A", tracks: 2, duplicates: 2, share: 1},
+		{artist: "B", tracks: 2, duplicates: 1, share: 0.5},
+	}
+	for ix, tc := range testCases {
+		a := report[ix]
+		if a.Artist != tc.artist || a.Tracks != tc.tracks || len(a.Duplicates) != tc.duplicates || a.Share() != tc.share {
+			t.Errorf("%s failed: expected %d of %d tracks duplicated, got %s with %d of %d", tc.artist, tc.duplicates, tc.tracks, a.Artist, len(a.Duplicates), a.Tracks)
+		}
+		if a.Matchers["id"] != tc.duplicates {
+			t.Errorf("%s failed: expected every duplicate found by id, got %v", tc.artist, a.Matchers)
+		}
+	}
+	if ids := srv.PlaylistTrackIDs("potentials"); len(ids) != 5 {
+		t.Errorf("expected the playlist to be untouched, got %v", ids)
+	}
+}
@@ -0,0 +1,520 @@
+package dedupe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"potentials-utils/library"
+	"potentials-utils/metrics"
+	"potentials-utils/spotifyclient"
+	"potentials-utils/spotifytest"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// newTestCleaner starts a fake Spotify with a 30 track library and a 150
+// track playlist in which every tenth track is saved
+func newTestCleaner(t *testing.T) (*spotifytest.Server, *Cleaner, func()) {
+	srv := spotifytest.NewServer()
+	tracks := []spotify.FullTrack{}
+	for ix := 0; ix < 150; ix++ {
+		track := spotifytest.Track(fmt.Sprintf("t%d", ix), fmt.Sprintf("Song %d", ix), "Album", "Artist")
+		if ix%10 == 0 || ix >= 140 {
+			srv.AddSavedTracks(track)
+		}
+		tracks = append(tracks, track)
+	}
+	srv.AddPlaylist("potentials", "Potentials", tracks...)
+
+	dir, err := ioutil.TempDir("", "dedupe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := spotifyclient.New(srv.HTTPClient())
+	lib, err := library.NewLibraryService(client, library.CacheConfig{CacheDir: dir, Lifetime: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := NewRegistry().Pipeline([]MatcherConfig{{Name: "id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := NewPolicy(PolicyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCleaner(client, lib, pipeline, policy, metrics.NewRegistry())
+	c.Out = ioutil.Discard
+	return srv, c, func() {
+		srv.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestClean(t *testing.T) {
+	srv, c, cleanup := newTestCleaner(t)
+	defer cleanup()
+
+	result, err := c.Clean(context.Background(), "potentials", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.metrics.runs.Value("succeeded"); got != 1 {
+		t.Errorf("expected the clean counted as succeeded, got %g", got)
+	}
+	if got := c.metrics.tracksRemoved.Value(); got != 24 {
+		t.Errorf("expected 24 removals counted, got %g", got)
+	}
+	if result.Duration <= 0 {
+		t.Errorf("expected the clean's duration, got %v", result.Duration)
+	}
+	result.Duration = 0
+	expected := Result{Removed: 24, PagesScanned: 2, TracksScanned: 150, DuplicatesFound: 24, MatchedByID: 24, Complete: true}
+	if result != expected {
+		t.Errorf("expected %+v, got %+v", expected, result)
+	}
+	if remaining := len(srv.PlaylistTrackIDs("potentials")); remaining != 126 {
+		t.Errorf("expected 126 tracks left in the playlist, got %d", remaining)
+	}
+}
+
+func TestCleanRepeats(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	saved := spotifytest.Track("a", "Song A", "Album", "Artist")
+	b := spotifytest.Track("b", "Song B", "Album", "Artist")
+	c := spotifytest.Track("c", "Song C", "Album", "Artist")
+	srv.AddSavedTracks(saved)
+	srv.AddPlaylist("potentials", "Potentials", saved, b, c, b, saved,
+		spotifytest.Track("c2", "Song C", "Album", "Artist"), b, spotifytest.Track("e", "Song E", "Album", "Artist"))
+	dir, err := ioutil.TempDir("", "dedupe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := spotifyclient.New(srv.HTTPClient())
+	lib, err := library.NewLibraryService(client, library.CacheConfig{CacheDir: dir, Lifetime: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := NewRegistry().Pipeline([]MatcherConfig{{Name: "id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := NewPolicy(PolicyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleaner := NewCleaner(client, lib, pipeline, policy, nil)
+	cleaner.Out = ioutil.Discard
+	cleaner.RemoveRepeats = true
+
+	result, err := cleaner.Clean(context.Background(), "potentials", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.DuplicatesFound != 5 || result.MatchedByID != 2 || result.Repeats != 3 || result.Removed != 5 {
+		t.Errorf("expected 2 saved tracks and 3 repeats removed, got %+v", result)
+	}
+	if got := srv.PlaylistTrackIDs("potentials"); !reflect.DeepEqual(got, []spotify.ID{"b", "c", "e"}) {
+		t.Errorf("expected the earliest b and c left, got %v", got)
+	}
+}
+
+func TestCleanFollowedPlaylist(t *testing.T) {
+	srv, c, cleanup := newTestCleaner(t)
+	defer cleanup()
+	c.UserID = spotifytest.UserID
+	srv.SetPlaylistOwner("potentials", "someoneelse")
+
+	if _, err := c.Clean(context.Background(), "potentials", false); !errors.Is(err, ErrNotModifiable) {
+		t.Errorf("expected cleaning a followed playlist to be refused, got %v", err)
+	}
+	if remaining := len(srv.PlaylistTrackIDs("potentials")); remaining != 150 {
+		t.Errorf("expected the playlist to be untouched, got %d tracks", remaining)
+	}
+	if result, err := c.Clean(context.Background(), "potentials", true); err != nil || result.DuplicatesFound != 24 {
+		t.Errorf("expected a dry run of a followed playlist to find 24 duplicates, got %+v, %v", result, err)
+	}
+	srv.SetPlaylistCollaborative("potentials")
+	if result, err := c.Clean(context.Background(), "potentials", false); err != nil || result.Removed != 24 {
+		t.Errorf("expected a collaborative playlist to be cleaned, got %+v, %v", result, err)
+	}
+}
+
+func TestCleanOwnAdditionsOnly(t *testing.T) {
+	srv, c, cleanup := newTestCleaner(t)
+	defer cleanup()
+	c.UserID = spotifytest.UserID
+	c.OwnAdditionsOnly = true
+	srv.SetPlaylistCollaborative("potentials")
+	srv.SetAddedBy("potentials", "t0", "friend")
+	srv.SetAddedBy("potentials", "t10", "")
+
+	result, err := c.Clean(context.Background(), "potentials", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Removed != 22 || result.Kept != 2 {
+		t.Errorf("expected 22 duplicates removed and 2 kept, got %+v", result)
+	}
+	ids := srv.PlaylistTrackIDs("potentials")
+	if len(ids) != 128 || ids[0] != "t0" || ids[10] != "t10" {
+		t.Errorf("expected the friend's and the unknown additions kept, got %v", ids[:11])
+	}
+}
+
+func TestCleanOwnAdditionsOnlySharedTrack(t *testing.T) {
+	ctx := context.Background()
+	srv, c, cleanup := newTestCleaner(t)
+	defer cleanup()
+	c.UserID = spotifytest.UserID
+	c.OwnAdditionsOnly = true
+	srv.SetPlaylistCollaborative("potentials")
+	// The friend added t0 again after the user did
+	if _, err := c.client.AddTracksToPlaylist(ctx, "potentials", "t0"); err != nil {
+		t.Fatal(err)
+	}
+	srv.SetAddedByAt("potentials", 150, "friend")
+
+	result, err := c.Clean(context.Background(), "potentials", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Removed != 24 || result.Kept != 1 {
+		t.Errorf("expected the user's 24 duplicates removed and the friend's kept, got %+v", result)
+	}
+	ids := srv.PlaylistTrackIDs("potentials")
+	if len(ids) != 127 || ids[0] != "t1" || ids[126] != "t0" {
+		t.Errorf("expected only the friend's entry of t0 left, got %d tracks starting %v ending %v", len(ids), ids[0], ids[len(ids)-1])
+	}
+}
+
+func TestCleanInteractive(t *testing.T) {
+	srv, c, cleanup := newTestCleaner(t)
+	defer cleanup()
+	c.Interactive = true
+	asked := 0
+	c.Prompt = func(d Duplicate) (bool, error) {
+		asked++
+		if remaining := len(srv.PlaylistTrackIDs("potentials")); remaining != 150 {
+			t.Errorf("expected to be asked before anything was removed, got %d tracks left", remaining)
+		}
+		return d.Track.Track.ID != "t0" && d.Track.Track.ID != "t10", nil
+	}
+
+	if result, err := c.Clean(context.Background(), "potentials", true); err != nil || result.Removed != 24 || asked != 0 {
+		t.Errorf("expected a dry run to report 24 removals without asking, got %+v, %v, asked %d times", result, err, asked)
+	}
+	result, err := c.Clean(context.Background(), "potentials", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if asked != 24 || result.Removed != 22 || result.Kept != 2 {
+		t.Errorf("expected 24 duplicates asked about and 22 removed, got %+v, asked %d times", result, asked)
+	}
+	ids := srv.PlaylistTrackIDs("potentials")
+	if len(ids) != 128 || ids[0] != "t0" || ids[10] != "t10" {
+		t.Errorf("expected the declined duplicates kept, got %v", ids[:11])
+	}
+}
+
+func TestCleanIncomplete(t *testing.T) {
+	srv, c, cleanup := newTestCleaner(t)
+	defer cleanup()
+	srv.Fault = func(r *http.Request) int {
+		if r.URL.Path == "/v1/playlists/potentials/tracks" && r.Method == http.MethodGet {
+			return http.StatusBadGateway
+		}
+		return 0
+	}
+
+	result, err := c.Clean(context.Background(), "potentials", false)
+	var ce *CleanError
+	if !errors.As(err, &ce) || ce.Page != 2 {
+		t.Fatalf("expected a CleanError on page 2, got %v", err)
+	}
+	result.Duration = 0
+	expected := Result{Removed: 10, PagesScanned: 1, TracksScanned: 100, DuplicatesFound: 10, MatchedByID: 10, ResumeOffset: 90, Error: err.Error()}
+	if result != expected {
+		t.Errorf("expected %+v, got %+v", expected, result)
+	}
+
+	srv.Fault = nil
+	result, err = c.CleanFrom(context.Background(), "potentials", result.ResumeOffset, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Complete || result.Removed != 14 || result.TracksScanned != 50 {
+		t.Errorf("expected resumed clean to remove the remaining 14 duplicates, got %+v", result)
+	}
+	if remaining := len(srv.PlaylistTrackIDs("potentials")); remaining != 126 {
+		t.Errorf("expected 126 tracks left in the playlist, got %d", remaining)
+	}
+}
+
+// indexedLibrary is a Library last fetched from Spotify at a fixed time
+type indexedLibrary struct {
+	Library
+	at time.Time
+}
+
+func (l *indexedLibrary) IndexedAt() (time.Time, error) {
+	return l.at, nil
+}
+
+func TestCleanChanged(t *testing.T) {
+	srv, c, cleanup := newTestCleaner(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c.History = NewFileCleanHistory(dir + "/history.json")
+	lib := &indexedLibrary{Library: c.library, at: time.Now()}
+	c.library = lib
+
+	result, err := c.CleanChanged(context.Background(), "potentials", false)
+	if err != nil || result.Skipped || result.Removed != 24 {
+		t.Fatalf("expected the first clean to remove 24 tracks, got %+v %v", result, err)
+	}
+	record, err := c.History.LastClean("potentials")
+	if err != nil || record == nil || record.Result == nil || record.Result.Removed != 24 {
+		t.Errorf("expected the clean's result to be recorded, got %+v %v", record, err)
+	}
+
+	requests := len(srv.Requests())
+	result, err = c.CleanChanged(context.Background(), "potentials", false)
+	if err != nil || !result.Skipped || !result.Complete {
+		t.Errorf("expected an unchanged playlist to be skipped, got %+v %v", result, err)
+	}
+	if n := len(srv.Requests()) - requests; n != 1 {
+		t.Errorf("expected a skipped clean to make 1 request, got %d", n)
+	}
+
+	lib.at = time.Now().Add(time.Minute)
+	result, err = c.CleanChanged(context.Background(), "potentials", false)
+	if err != nil || result.Skipped || result.TracksScanned != 126 {
+		t.Errorf("expected a refreshed library to clean the playlist again, got %+v %v", result, err)
+	}
+
+	srv.AddPlaylist("potentials", "Potentials", spotifytest.Track("t0", "Song 0", "Album", "Artist"))
+	result, err = c.CleanChanged(context.Background(), "potentials", false)
+	if err != nil || result.Skipped || result.Removed != 1 {
+		t.Errorf("expected a changed playlist to be cleaned, got %+v %v", result, err)
+	}
+
+	result, err = c.Clean(context.Background(), "potentials", false)
+	if err != nil || result.Skipped {
+		t.Errorf("expected Clean never to skip, got %+v %v", result, err)
+	}
+}
+
+// recordedPromotions remembers every track it's told was promoted
+type recordedPromotions struct {
+	ids []spotify.ID
+}
+
+func (p *recordedPromotions) Promoted(ctx context.Context, duplicates []Duplicate) error {
+	for _, d := range duplicates {
+		p.ids = append(p.ids, d.Track.Track.ID)
+	}
+	return nil
+}
+
+func TestCleanPromotions(t *testing.T) {
+	_, c, cleanup := newTestCleaner(t)
+	defer cleanup()
+	promotions := &recordedPromotions{}
+	c.Promotions = promotions
+
+	if _, err := c.Clean(context.Background(), "potentials", true); err != nil {
+		t.Fatal(err)
+	}
+	if len(promotions.ids) != 0 {
+		t.Errorf("expected a dry run to promote nothing, got %v", promotions.ids)
+	}
+	if _, err := c.Clean(context.Background(), "potentials", false); err != nil {
+		t.Fatal(err)
+	}
+	if len(promotions.ids) != 24 || promotions.ids[0] != "t0" {
+		t.Errorf("expected the 24 removed duplicates to be promoted, got %v", promotions.ids)
+	}
+}
+
+// recordedTrash remembers every track put in it
+type recordedTrash struct {
+	ids       []spotify.ID
+	positions []int
+	purges    int
+}
+
+func (t *recordedTrash) Put(ctx context.Context, playlistID spotify.ID, duplicates []Duplicate) error {
+	for _, d := range duplicates {
+		t.ids = append(t.ids, d.Track.Track.ID)
+		t.positions = append(t.positions, d.Position)
+	}
+	return nil
+}
+
+func (t *recordedTrash) Purge(ctx context.Context) (int, error) {
+	t.purges++
+	return 0, nil
+}
+
+func TestCleanTrash(t *testing.T) {
+	srv, c, cleanup := newTestCleaner(t)
+	defer cleanup()
+	trash := &recordedTrash{}
+	c.Trash = trash
+
+	if _, err := c.Clean(context.Background(), "potentials", true); err != nil {
+		t.Fatal(err)
+	}
+	if len(trash.ids) != 0 || trash.purges != 0 {
+		t.Errorf("expected a dry run to leave the trash alone, got %v and %d purges", trash.ids, trash.purges)
+	}
+	if _, err := c.Clean(context.Background(), "potentials", false); err != nil {
+		t.Fatal(err)
+	}
+	if len(trash.ids) != 24 || trash.purges != 1 {
+		t.Errorf("expected the 24 removed duplicates trashed and one purge, got %v and %d purges", trash.ids, trash.purges)
+	}
+	// Every tenth track is saved, and the last ten, across both pages
+	if len(trash.positions) == 24 && (trash.positions[1] != 10 || trash.positions[10] != 100 || trash.positions[23] != 149) {
+		t.Errorf("expected the duplicates' playlist positions, got %v", trash.positions)
+	}
+	if remaining := len(srv.PlaylistTrackIDs("potentials")); remaining != 126 {
+		t.Errorf("expected 126 tracks left in the playlist, got %d", remaining)
+	}
+}
+
+// recordedDecisions remembers every decision
+type recordedDecisions struct {
+	positions []int
+	actions   []Action
+}
+
+func (r *recordedDecisions) Decided(playlistID spotify.ID, d Duplicate, action Action) {
+	r.positions = append(r.positions, d.Position)
+	r.actions = append(r.actions, action)
+}
+
+func TestCleanDecisions(t *testing.T) {
+	srv, c, cleanup := newTestCleaner(t)
+	defer cleanup()
+	decisions := &recordedDecisions{}
+	c.Decisions = decisions
+
+	if _, err := c.Clean(context.Background(), "potentials", true); err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions.actions) != 24 || decisions.actions[0] != ActionRemove || decisions.positions[1] != 10 {
+		t.Errorf("expected the 24 duplicates decided for removal, got %v at %v", decisions.actions, decisions.positions)
+	}
+	if remaining := len(srv.PlaylistTrackIDs("potentials")); remaining != 150 {
+		t.Errorf("expected a dry run to leave the playlist alone, got %d tracks", remaining)
+	}
+}
+
+// recordedReviews queues duplicates in memory, with reviewed tracks judged
+// duplicates or not
+type recordedReviews struct {
+	judged map[spotify.ID]bool
+	queued []spotify.ID
+}
+
+func (r *recordedReviews) Reviewed(t spotify.FullTrack) (bool, bool, error) {
+	remove, ok := r.judged[t.ID]
+	return ok, remove, nil
+}
+
+func (r *recordedReviews) Enqueue(playlistID spotify.ID, duplicates []Duplicate) error {
+	for _, d := range duplicates {
+		r.queued = append(r.queued, d.Track.Track.ID)
+	}
+	return nil
+}
+
+func TestCleanReviews(t *testing.T) {
+	srv, c, cleanup := newTestCleaner(t)
+	defer cleanup()
+	policy, err := NewPolicy(PolicyConfig{QueueBelow: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.policy = policy
+	reviews := &recordedReviews{judged: map[spotify.ID]bool{"t0": false, "t10": true}}
+	c.Reviews = reviews
+
+	if _, err := c.Clean(context.Background(), "potentials", true); err != nil {
+		t.Fatal(err)
+	}
+	if len(reviews.queued) != 0 {
+		t.Errorf("expected a dry run to queue nothing, got %v", reviews.queued)
+	}
+	result, err := c.Clean(context.Background(), "potentials", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Removed != 1 {
+		t.Errorf("expected only the track reviewed a duplicate removed, got %d", result.Removed)
+	}
+	if len(reviews.queued) != 22 || reviews.queued[0] != "t20" {
+		t.Errorf("expected the 22 unreviewed duplicates queued, got %v", reviews.queued)
+	}
+	if remaining := len(srv.PlaylistTrackIDs("potentials")); remaining != 149 {
+		t.Errorf("expected 149 tracks left in the playlist, got %d", remaining)
+	}
+}
+
+func TestCleanAnomaly(t *testing.T) {
+	srv, c, cleanup := newTestCleaner(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c.History = NewFileCleanHistory(dir + "/history.json")
+	c.Anomalies = AnomalyConfig{Enabled: true}
+	for _, removed := range []int{1, 2, 3, 2, 1} {
+		if err := c.History.RecordClean("potentials", CleanRecord{Result: &Result{Removed: removed}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := c.Clean(context.Background(), "potentials", false); !errors.Is(err, ErrAnomalous) {
+		t.Errorf("expected removing 24 duplicates to be held back, got %v", err)
+	}
+	if remaining := len(srv.PlaylistTrackIDs("potentials")); remaining != 150 {
+		t.Errorf("expected the playlist to be untouched, got %d tracks", remaining)
+	}
+	if result, err := c.Clean(context.Background(), "potentials", true); err != nil || result.Removed != 24 {
+		t.Errorf("expected a dry run only to report the anomaly, got %+v, %v", result, err)
+	}
+
+	var confirmed *Anomaly
+	c.ConfirmAnomaly = func(a Anomaly) (bool, error) {
+		confirmed = &a
+		return true, nil
+	}
+	if result, err := c.Clean(context.Background(), "potentials", false); err != nil || result.Removed != 24 {
+		t.Errorf("expected a confirmed anomaly to be cleaned, got %+v, %v", result, err)
+	}
+	if confirmed == nil || confirmed.Removals != 24 || confirmed.Runs != 5 {
+		t.Errorf("expected the anomaly compared with 5 past cleans confirmed, got %+v", confirmed)
+	}
+	record, err := c.History.LastClean("potentials")
+	if err != nil || len(record.Removals) != 6 || record.Removals[5] != 24 {
+		t.Errorf("expected the clean's removals recorded after the past cleans', got %+v, %v", record, err)
+	}
+}
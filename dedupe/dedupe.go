@@ -0,0 +1,950 @@
+// Package dedupe finds and removes tracks from a playlist which are already
+// saved in the user's library.
+package dedupe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"potentials-utils/library"
+	"potentials-utils/metrics"
+	"potentials-utils/progress"
+	"potentials-utils/tracing"
+
+	"github.com/apex/log"
+	"github.com/zmb3/spotify/v2"
+)
+
+// DuplicatesConfig holds config options for potentials-utils' duplicate
+// detection behavior
+type DuplicatesConfig struct {
+	// Aggressive controls cleaning aggression levels. If true, enables more
+	// aggressive cleaning which will remove tracks from Potentials which match
+	// the song name, album name, and all artist names of an existing track in
+	// your library. Tracks will onlly be removed by ID otherwise.
+	Aggressive bool `yaml:"aggressive"`
+	// Matchers is the ordered pipeline of matchers used to detect
+	// duplicates. Overrides Aggressive when set.
+	Matchers []MatcherConfig `yaml:"matchers"`
+	// NewerReleaseDays ignores aggressive matches when the playlist track's
+	// album was released more than this many days after the library
+	// track's, e.g. a new live album of a song already saved. Sets the
+	// newerReleaseDays option of the metadata matcher added by Aggressive.
+	// Disabled if zero.
+	NewerReleaseDays int `yaml:"newerReleaseDays"`
+	// Fuzzy removes tracks whose names are within a few edits of a library
+	// track by the same artist once case, punctuation and version suffixes
+	// are ignored, e.g. remastered reissues, by adding the fuzzy matcher
+	// after any others
+	Fuzzy bool `yaml:"fuzzy"`
+	// FuzzyMaxDistance is the most edits apart names matched by Fuzzy may
+	// be, default 2
+	FuzzyMaxDistance int `yaml:"fuzzyMaxDistance"`
+	// IncludeSavedAlbums indexes the user's saved albums and treats tracks
+	// on them as duplicates, even if the tracks themselves aren't saved, by
+	// adding the album matcher after the id matcher. With Matchers set,
+	// add the album matcher there instead.
+	IncludeSavedAlbums bool `yaml:"includeSavedAlbums"`
+	// ReferencePlaylists are playlists, by ID or by name, whose tracks count
+	// as part of the library, so tracks on them are duplicates whether or
+	// not they're saved, e.g. an archive of past favourites
+	ReferencePlaylists []string `yaml:"referencePlaylists"`
+	// RemoveRepeats removes tracks which repeat, by ID or by index key, a
+	// track earlier in the playlist, whether or not they're in the library,
+	// keeping the earliest occurrence
+	RemoveRepeats bool `yaml:"removeRepeats"`
+	// Policy decides what is done with each duplicate. Every duplicate is
+	// removed by default.
+	Policy PolicyConfig `yaml:"policy"`
+	// SkipGenres exempts duplicates by artists in any of these genres from
+	// cleaning
+	SkipGenres []string `yaml:"skipGenres"`
+	// OnlyGenres restricts cleaning to duplicates by artists in at least one
+	// of these genres
+	OnlyGenres []string `yaml:"onlyGenres"`
+	// MinPopularity exempts duplicates less popular than this from cleaning,
+	// e.g. to keep obscure versions in Potentials for closer listening
+	MinPopularity int `yaml:"minPopularity"`
+	// MaxPopularity exempts duplicates more popular than this from cleaning,
+	// ignored if zero
+	MaxPopularity int `yaml:"maxPopularity"`
+	// TrashRetentionDays moves removed duplicates to a trash playlist, where
+	// they're kept this many days before being purged, instead of removing
+	// them outright. Disabled if zero.
+	TrashRetentionDays int `yaml:"trashRetentionDays"`
+	// OwnAdditionsOnly exempts duplicates someone else added to the playlist
+	// from cleaning, so cleaning a collaborative playlist never removes a
+	// friend's additions
+	OwnAdditionsOnly bool `yaml:"ownAdditionsOnly"`
+	// Anomalies holds back cleans removing far more duplicates than usual
+	// until they're confirmed
+	Anomalies AnomalyConfig `yaml:"anomalies"`
+}
+
+// GenreFilter returns the configured genre restrictions
+func (c DuplicatesConfig) GenreFilter() GenreFilter {
+	return GenreFilter{Skip: c.SkipGenres, Only: c.OnlyGenres}
+}
+
+// PopularityFilter returns the configured popularity thresholds
+func (c DuplicatesConfig) PopularityFilter() PopularityFilter {
+	return PopularityFilter{Min: c.MinPopularity, Max: c.MaxPopularity}
+}
+
+// MatcherConfigs returns the configured matcher pipeline, defaulting to ID
+// matching plus saved album matching if saved albums are included, metadata
+// matching if aggressive cleaning is enabled and fuzzy matching if fuzzy
+// cleaning is
+func (c DuplicatesConfig) MatcherConfigs() []MatcherConfig {
+	if len(c.Matchers) > 0 {
+		return c.Matchers
+	}
+	cfgs := []MatcherConfig{{Name: "id"}}
+	if c.IncludeSavedAlbums {
+		cfgs = append(cfgs, MatcherConfig{Name: "album"})
+	}
+	if c.Aggressive {
+		metadata := MatcherConfig{Name: "metadata"}
+		if c.NewerReleaseDays > 0 {
+			metadata.Options = MatcherOptions{"newerReleaseDays": c.NewerReleaseDays}
+		}
+		cfgs = append(cfgs, metadata)
+	}
+	if c.Fuzzy {
+		fuzzy := MatcherConfig{Name: "fuzzy", Options: MatcherOptions{}}
+		if c.FuzzyMaxDistance > 0 {
+			fuzzy.Options["maxDistance"] = c.FuzzyMaxDistance
+		}
+		if c.NewerReleaseDays > 0 {
+			fuzzy.Options["newerReleaseDays"] = c.NewerReleaseDays
+		}
+		cfgs = append(cfgs, fuzzy)
+	}
+	return cfgs
+}
+
+// UsesSavedAlbums returns true if the matcher pipeline includes the album
+// matcher, so the library must index saved albums
+func (c DuplicatesConfig) UsesSavedAlbums() bool {
+	for _, m := range c.MatcherConfigs() {
+		if m.Name == "album" {
+			return true
+		}
+	}
+	return false
+}
+
+// Library is the view of the user's library needed to detect duplicates
+type Library interface {
+	GetByID(k spotify.ID) (*spotify.SavedTrack, error)
+	GetByISRC(isrc string) ([]*spotify.SavedTrack, error)
+	GetByArtistName(name string) ([]*spotify.SavedTrack, error)
+	GetBySongAlbumArtistNames(songName, albumName string, artistNames []string) ([]*spotify.SavedTrack, error)
+}
+
+// Playlists is the view of the Spotify API needed to clean playlists
+type Playlists interface {
+	GetPlaylist(ctx context.Context, playlistID spotify.ID) (*spotify.FullPlaylist, error)
+	PlaylistTracks(ctx context.Context, playlistID spotify.ID, offset int) (*spotify.PlaylistTrackPage, error)
+	NextPlaylistTracks(ctx context.Context, page *spotify.PlaylistTrackPage) error
+	AddTracksToPlaylist(ctx context.Context, playlistID spotify.ID, trackIDs ...spotify.ID) (string, error)
+	RemoveTracksFromPlaylist(ctx context.Context, playlistID spotify.ID, trackIDs ...spotify.ID) (string, error)
+}
+
+// Metadata looks up track metadata used by policy rules which isn't part of
+// the playlist track itself
+type Metadata interface {
+	AlbumLabels(ctx context.Context, ids ...spotify.ID) (map[spotify.ID]string, error)
+	ArtistGenres(ctx context.Context, ids ...spotify.ID) (map[spotify.ID][]string, error)
+}
+
+// Duplicate is a playlist track found to be a duplicate of the library
+type Duplicate struct {
+	Track spotify.PlaylistTrack
+	// Position is the 0-based position of the track in the playlist when it
+	// was found
+	Position int
+	MatchResult
+	// Label is the record label of the track's album. Only looked up when
+	// the policy has label rules.
+	Label string
+	// Genres are the genres of the track's artists. Only looked up when
+	// cleaning is filtered by genre.
+	Genres []string
+}
+
+// ErrNotModifiable is returned when cleaning a playlist the user follows but
+// neither owns nor collaborates on
+var ErrNotModifiable = errors.New("playlist is neither owned by the user nor collaborative")
+
+// checkModifiable returns an error wrapping ErrNotModifiable if the user can't
+// modify playlist
+func (c *Cleaner) checkModifiable(playlist *spotify.FullPlaylist) error {
+	if c.UserID == "" || playlist.Owner.ID == c.UserID || playlist.Collaborative {
+		return nil
+	}
+	return fmt.Errorf("refusing to clean %q, owned by %s: %w", playlist.Name, playlist.Owner.ID, ErrNotModifiable)
+}
+
+// CleanError is an error which stopped a clean, with where in the playlist it
+// happened
+type CleanError struct {
+	PlaylistID spotify.ID
+	// Page is the 1-based page of the playlist being cleaned, or zero if the
+	// error happened after every page was matched
+	Page int
+	// TrackID is the track being matched, if any
+	TrackID spotify.ID
+	Err     error
+}
+
+func (e *CleanError) Error() string {
+	msg := fmt.Sprintf("cleaning playlist %s", e.PlaylistID)
+	if e.Page > 0 {
+		msg += fmt.Sprintf(" page %d", e.Page)
+	}
+	if e.TrackID != "" {
+		msg += fmt.Sprintf(" track %s", e.TrackID)
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *CleanError) Unwrap() error {
+	return e.Err
+}
+
+// Promotions is told about tracks promoted out of a playlist, i.e. removed or
+// archived because they're already in the library
+type Promotions interface {
+	Promoted(ctx context.Context, duplicates []Duplicate) error
+}
+
+// MultiPromotions tells each of several Promotions in turn, returning the
+// first error once every one has been told
+type MultiPromotions []Promotions
+
+// Promoted tells each Promotions about duplicates
+func (m MultiPromotions) Promoted(ctx context.Context, duplicates []Duplicate) error {
+	var first error
+	for _, p := range m {
+		if err := p.Promoted(ctx, duplicates); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Decisions is told what a clean decided to do with each duplicate
+type Decisions interface {
+	Decided(playlistID spotify.ID, d Duplicate, action Action)
+}
+
+// Trash keeps removed duplicates for a while so they can be restored
+type Trash interface {
+	// Put keeps duplicates about to be removed from a playlist
+	Put(ctx context.Context, playlistID spotify.ID, duplicates []Duplicate) error
+	// Purge permanently drops everything kept longer than the retention
+	// period, returning how many tracks were dropped
+	Purge(ctx context.Context) (int, error)
+}
+
+// RemovalJournal records every track removed from a playlist, and where it
+// was, so removals can be undone
+type RemovalJournal interface {
+	// Removed records the duplicates removed from a playlist by a clean, as
+	// they were in the version snapshotID
+	Removed(ctx context.Context, playlistID spotify.ID, snapshotID string, removed []Duplicate) error
+}
+
+// ReviewQueue holds duplicates for someone to review later, and remembers
+// what was decided for each track reviewed
+type ReviewQueue interface {
+	// Reviewed returns whether a track has been reviewed, and if so whether
+	// it was judged a duplicate to remove
+	Reviewed(t spotify.FullTrack) (reviewed, remove bool, err error)
+	// Enqueue queues duplicates found in a playlist for review
+	Enqueue(playlistID spotify.ID, duplicates []Duplicate) error
+}
+
+// Cleaner removes tracks from playlists which are duplicated in a Library
+type Cleaner struct {
+	// Out is where a human-readable account of each clean is printed.
+	// Defaults to os.Stdout.
+	Out io.Writer
+	// Prompt asks the user whether a duplicate should be removed. Duplicates
+	// with the ask action are only reported if Prompt is nil.
+	Prompt func(d Duplicate) (bool, error)
+	// Interactive asks Prompt about every duplicate the policy would remove
+	// or archive too, before anything is removed, keeping those the user
+	// declines. Ignored on dry runs, or if Prompt is nil.
+	Interactive bool
+	// Tags records the tag action. Duplicates with the tag action are only
+	// reported if Tags is nil.
+	Tags TagStore
+	// Metadata looks up album labels for policy label rules and artist
+	// genres for the genre filter. Label rules never match, and the genre
+	// filter is ignored, if Metadata is nil.
+	Metadata Metadata
+	// GenreFilter restricts cleaning to or exempts it from particular genres
+	GenreFilter GenreFilter
+	// PopularityFilter exempts tracks outside a popularity range from
+	// cleaning
+	PopularityFilter PopularityFilter
+	// History records every complete clean so CleanChanged can skip
+	// playlists which haven't changed since. CleanChanged always cleans if
+	// History is nil.
+	History CleanHistory
+	// Promotions is told about the duplicates removed or archived by each
+	// clean. Failing to tell it is logged rather than failing the clean.
+	Promotions Promotions
+	// Trash keeps every duplicate removed, and is purged after every
+	// complete clean. Duplicates are removed outright if Trash is nil.
+	Trash Trash
+	// UserID is the ID of the user cleaning. Cleans which aren't dry runs
+	// are refused for playlists the user neither owns nor collaborates on.
+	// Ownership isn't checked if UserID is empty.
+	UserID string
+	// OwnAdditionsOnly exempts duplicates not added to the playlist by
+	// UserID from cleaning, including those whose adder Spotify doesn't
+	// know, and every duplicate if UserID is empty. The user's additions are
+	// removed by position, so a friend's entry of the same track stays.
+	OwnAdditionsOnly bool
+	// Progress is told how each clean is going. Defaults to a terminal
+	// progress bar.
+	Progress progress.Reporter
+	// Decisions, if set, is told the action decided for every duplicate
+	// left after filtering, including those skipped, on dry runs too
+	Decisions Decisions
+	// Reviews holds duplicates with the queue action for review, and
+	// overrides the policy for tracks already reviewed: those judged
+	// duplicates are removed, the rest skipped. Duplicates with the queue
+	// action are only reported if Reviews is nil.
+	Reviews ReviewQueue
+	// Journal records every duplicate removed or archived, so cleans can be
+	// undone. Failing to record removals is logged rather than failing the
+	// clean.
+	Journal RemovalJournal
+	// Anomalies holds back cleans which would remove far more duplicates
+	// than past cleans recorded in History. Ignored if History is nil.
+	Anomalies AnomalyConfig
+	// ConfirmAnomaly asks the user whether to go ahead with a clean held
+	// back as an anomaly. Such cleans fail with ErrAnomalous if it's nil or
+	// the user declines.
+	ConfirmAnomaly func(a Anomaly) (bool, error)
+	// RemoveRepeats removes tracks repeating an earlier track in the
+	// playlist which isn't duplicated in the library, whatever the policy
+	// says, leaving the earliest. Repeats are never put in the Trash nor
+	// told to Promotions, and are only reported if the client isn't
+	// PositionalPlaylists.
+	RemoveRepeats bool
+
+	client   Playlists
+	library  Library
+	pipeline *Pipeline
+	policy   *Policy
+	metrics  *cleanMetrics
+}
+
+// NewCleaner creates a Cleaner which acts on tracks the matcher pipeline finds
+// duplicated in lib, through client, as decided by policy. The metrics of
+// every clean are registered in r, if not nil.
+func NewCleaner(client Playlists, lib Library, pipeline *Pipeline, policy *Policy, r *metrics.Registry) *Cleaner {
+	return &Cleaner{
+		Out:      os.Stdout,
+		Progress: progress.NewBar(),
+		client:   client,
+		library:  lib,
+		pipeline: pipeline,
+		policy:   policy,
+		metrics:  newCleanMetrics(r),
+	}
+}
+
+// Library returns the library duplicates are detected in
+func (c *Cleaner) Library() Library {
+	return c.library
+}
+
+// Result summarises a clean
+type Result struct {
+	// Removed is the number of duplicates removed or archived, or which would
+	// have been on a dry run
+	Removed int `json:"numRemoved"`
+	// PagesScanned is the number of playlist pages matched against the
+	// library
+	PagesScanned int `json:"pagesScanned"`
+	// TracksScanned is the number of playlist tracks matched against the
+	// library
+	TracksScanned int `json:"tracksScanned"`
+	// DuplicatesFound is the number of duplicates found before filtering
+	DuplicatesFound int `json:"duplicatesFound"`
+	// MatchedByID is the number of duplicates found by the id matcher
+	MatchedByID int `json:"matchedByID"`
+	// MatchedByMetadata is the number of duplicates found by any other
+	// matcher, e.g. by ISRC or by name
+	MatchedByMetadata int `json:"matchedByMetadata"`
+	// Repeats is the number of duplicates found repeating an earlier track
+	// in the playlist, rather than one in the library
+	Repeats int `json:"repeats"`
+	// Kept is the number of duplicates left in the playlist, because the
+	// filters exempted them or the policy didn't remove or archive them
+	Kept int `json:"kept"`
+	// Complete is false if paging through the playlist failed part way, in
+	// which case only the duplicates in the pages scanned were acted on
+	Complete bool `json:"complete"`
+	// ResumeOffset is the playlist offset to pass to CleanFrom to pick up an
+	// incomplete clean where it stopped
+	ResumeOffset int `json:"resumeOffset,omitempty"`
+	// Skipped is true if CleanChanged found nothing had changed since the
+	// playlist was last cleaned
+	Skipped bool `json:"skipped,omitempty"`
+	// DryRun is true if the playlist was left untouched
+	DryRun bool `json:"dryRun"`
+	// Error is the error which stopped the clean, if any
+	Error string `json:"error,omitempty"`
+	// Duration is how long the clean took
+	Duration time.Duration `json:"durationNs"`
+}
+
+// Add totals o into r, to sum up the cleans of several playlists. Totals
+// start from a Result with Skipped set, and stay skipped only if every clean
+// was.
+func (r *Result) Add(o Result) {
+	r.Removed += o.Removed
+	r.PagesScanned += o.PagesScanned
+	r.TracksScanned += o.TracksScanned
+	r.DuplicatesFound += o.DuplicatesFound
+	r.MatchedByID += o.MatchedByID
+	r.MatchedByMetadata += o.MatchedByMetadata
+	r.Repeats += o.Repeats
+	r.Kept += o.Kept
+	r.Skipped = r.Skipped && o.Skipped
+	r.Duration += o.Duration
+}
+
+// Summary describes the result in a sentence
+func (r Result) Summary() string {
+	if r.Skipped {
+		return "Playlist unchanged since the last clean, skipped."
+	}
+	verb := "removed"
+	if r.DryRun {
+		verb = "would have been removed"
+	}
+	matched := fmt.Sprintf("%d by ID, %d by metadata", r.MatchedByID, r.MatchedByMetadata)
+	if r.Repeats > 0 {
+		matched += fmt.Sprintf(", %d repeated", r.Repeats)
+	}
+	s := fmt.Sprintf("Scanned %d tracks in %s: %d duplicates (%s), %d %s, %d kept.",
+		r.TracksScanned, r.Duration.Round(time.Millisecond), r.DuplicatesFound, matched, r.Removed, verb, r.Kept)
+	if !r.Complete && r.PagesScanned > 0 {
+		s += fmt.Sprintf(" Incomplete, resume from offset %d.", r.ResumeOffset)
+	}
+	if r.Error != "" {
+		s += " Error: " + r.Error
+	}
+	return s
+}
+
+// cleanMetrics are the metrics of every clean, exposed by a running server
+type cleanMetrics struct {
+	runs          *metrics.Counter
+	tracksScanned *metrics.Counter
+	tracksRemoved *metrics.Counter
+	duration      *metrics.Histogram
+	lastSucceeded *metrics.Gauge
+}
+
+func newCleanMetrics(r *metrics.Registry) *cleanMetrics {
+	return &cleanMetrics{
+		runs:          r.NewCounter("potentials_clean_runs_total", "Cleans run, dry runs included, by status: succeeded, skipped or failed.", "status"),
+		tracksScanned: r.NewCounter("potentials_clean_tracks_scanned_total", "Playlist tracks matched against the library by cleans."),
+		tracksRemoved: r.NewCounter("potentials_clean_duplicates_removed_total", "Duplicates removed or archived by cleans which weren't dry runs."),
+		duration:      r.NewHistogram("potentials_clean_duration_seconds", "How long cleans took.", []float64{1, 5, 15, 30, 60, 120, 300, 600}),
+		lastSucceeded: r.NewGauge("potentials_clean_last_success_timestamp_seconds", "When a clean last succeeded."),
+	}
+}
+
+// Clean acts on duplicate tracks in the given playlist according to the
+// policy. The playlist is left untouched if dryRun is true. Cleaning stops
+// early if ctx is cancelled. Errors other than cancellation are returned as a
+// *CleanError. Progress is logged to the logger from log.FromContext(ctx).
+//
+// If fetching a page of the playlist fails, the duplicates found in the pages
+// already scanned are still acted on, and the incomplete Result is returned
+// along with the error.
+func (c *Cleaner) Clean(ctx context.Context, playlistID spotify.ID, dryRun bool) (Result, error) {
+	return c.CleanFrom(ctx, playlistID, 0, dryRun)
+}
+
+// CleanFrom is Clean starting from the track at offset in the playlist
+func (c *Cleaner) CleanFrom(ctx context.Context, playlistID spotify.ID, offset int, dryRun bool) (Result, error) {
+	return c.clean(ctx, playlistID, offset, dryRun, false)
+}
+
+// CleanChanged is Clean, unless neither the playlist nor the library have
+// changed since the playlist was last cleaned, in which case nothing is
+// cleaned and the Result is Skipped. The library is only known to have
+// changed if it's an IndexedLibrary.
+func (c *Cleaner) CleanChanged(ctx context.Context, playlistID spotify.ID, dryRun bool) (Result, error) {
+	return c.clean(ctx, playlistID, 0, dryRun, c.History != nil)
+}
+
+func (c *Cleaner) clean(ctx context.Context, playlistID spotify.ID, offset int, dryRun, skipUnchanged bool) (result Result, err error) {
+	ctx, span := tracing.Start(ctx, "clean")
+	span.SetAttribute("playlist.id", string(playlistID))
+	span.SetAttribute("dry_run", dryRun)
+	span.SetAttribute("offset", offset)
+	page := 0
+	start := time.Now()
+	result.DryRun = dryRun
+	defer func() {
+		if err != nil && ctx.Err() == nil {
+			ce, ok := err.(*CleanError)
+			if !ok {
+				ce = &CleanError{Err: err}
+			}
+			ce.PlaylistID = playlistID
+			if ce.Page == 0 {
+				ce.Page = page
+			}
+			err = ce
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		result.Duration = time.Since(start)
+		c.metrics.record(result, err)
+		span.SetAttribute("duplicates.acted", result.Removed)
+		span.SetAttribute("complete", result.Complete)
+		span.RecordError(err)
+		span.End()
+	}()
+
+	// Fetch the Potentials playlist
+	_, getSpan := tracing.Start(ctx, "spotify.GetPlaylist")
+	playlist, err := c.client.GetPlaylist(ctx, playlistID)
+	getSpan.RecordError(err)
+	getSpan.End()
+	if err != nil {
+		return result, err
+	}
+	if !dryRun {
+		if err := c.checkModifiable(playlist); err != nil {
+			return result, err
+		}
+	}
+	pager := &playlist.Tracks
+	if offset > 0 {
+		_, getSpan := tracing.Start(ctx, "spotify.GetPlaylistTracks")
+		pager, err = c.client.PlaylistTracks(ctx, playlistID, offset)
+		getSpan.RecordError(err)
+		getSpan.End()
+		if err != nil {
+			return result, err
+		}
+	}
+	logger := log.FromContext(ctx)
+	var indexedAt time.Time
+	if c.History != nil {
+		if indexedAt, err = c.libraryIndexedAt(); err != nil {
+			return result, err
+		}
+	}
+	if skipUnchanged {
+		last, err := c.History.LastClean(playlistID)
+		if err != nil {
+			return result, err
+		}
+		if last != nil && last.SnapshotID == playlist.SnapshotID && last.LibraryIndexedAt.Equal(indexedAt) {
+			logger.WithFields(log.Fields{"playlistID": playlist.ID, "snapshotID": playlist.SnapshotID, "cleanedAt": last.CleanedAt}).Info("no changes since last clean")
+			fmt.Fprintf(c.Out, "No changes since last clean of %s at %s, skipping.\n", playlist.Name, last.CleanedAt.Format(time.RFC3339))
+			span.SetAttribute("skipped", true)
+			result.Complete, result.Skipped = true, true
+			return result, nil
+		}
+	}
+	logger.WithFields(log.Fields{"playlistID": playlist.ID, "offset": offset}).Info("cleaning Potentials playlist...")
+	fmt.Fprintf(c.Out, "Cleaning your Potentials playlist: %s...\n", playlist.Name)
+
+	// Clean the playlist page by page cross-referencing the library cache
+	cleaning := progress.Start(c.Progress, "clean", int(pager.Total))
+	cleaning.Set(offset)
+	duplicates := []Duplicate{}
+	seen := map[string]int{}
+	var pageErr error
+	for {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		page++
+		begin := time.Now()
+		_, matchSpan := tracing.Start(ctx, "match.page")
+		matchSpan.SetAttribute("page.offset", pager.Offset)
+		matchSpan.SetAttribute("page.tracks", len(pager.Tracks))
+		duplicatesInPage, err := c.Duplicates(pager.Tracks)
+		matchSpan.SetAttribute("page.duplicates", len(duplicatesInPage))
+		matchSpan.RecordError(err)
+		matchSpan.End()
+		if err != nil {
+			return result, err
+		}
+		logger.WithFields(log.Fields{"duration": time.Since(begin), "page": page}).Debug("getDuplicates")
+		for ix := range duplicatesInPage {
+			duplicatesInPage[ix].Position += int(pager.Offset)
+		}
+		if c.RemoveRepeats {
+			duplicatesInPage = append(duplicatesInPage, c.repeats(pager, duplicatesInPage, seen)...)
+		}
+		duplicates = append(duplicates, duplicatesInPage...)
+		result.PagesScanned++
+		result.TracksScanned += len(pager.Tracks)
+		_, pageSpan := tracing.Start(ctx, "spotify.NextPage")
+		err = c.client.NextPlaylistTracks(ctx, pager)
+		if err != spotify.ErrNoMorePages {
+			pageSpan.RecordError(err)
+		}
+		pageSpan.End()
+		if err == spotify.ErrNoMorePages {
+			break
+		}
+		if err != nil {
+			// Keep what was found so far rather than throwing the run away
+			pageErr = &CleanError{Page: page + 1, Err: err}
+			logger.WithFields(log.Fields{"err": err, "page": page + 1, "pagesScanned": result.PagesScanned}).Warn("failed to fetch playlist page, cleaning the pages scanned so far")
+			break
+		}
+		cleaning.Add(int(pager.Limit))
+	}
+	cleaning.Finish()
+	page = 0
+	result.DuplicatesFound = len(duplicates)
+	for _, d := range duplicates {
+		if d.Matcher == RepeatMatcher {
+			result.Repeats++
+		} else if d.Matcher == "id" {
+			result.MatchedByID++
+		} else {
+			result.MatchedByMetadata++
+		}
+	}
+	span.SetAttribute("duplicates.found", len(duplicates))
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+	if err := c.addLabels(ctx, duplicates); err != nil {
+		return result, err
+	}
+	if err := c.addGenres(ctx, duplicates); err != nil {
+		return result, err
+	}
+	duplicates = c.filter(duplicates)
+	snapshotID := playlist.SnapshotID
+	result.Removed, err = c.act(ctx, playlistID, duplicates, dryRun, &snapshotID)
+	if err != nil {
+		return result, err
+	}
+	result.Kept = result.DuplicatesFound - result.Removed
+	if pageErr != nil {
+		// Removing tracks shifts those after them towards the start of the
+		// playlist
+		result.ResumeOffset = offset + result.TracksScanned
+		if !dryRun {
+			result.ResumeOffset -= result.Removed
+		}
+		fmt.Fprintf(c.Out, "[INCOMPLETE] Scanned %d pages before paging failed, resume from offset %d\n", result.PagesScanned, result.ResumeOffset)
+		return result, pageErr
+	}
+	result.Complete = true
+	if c.History != nil && offset == 0 && !dryRun {
+		summary := result
+		summary.Duration = time.Since(start)
+		record := CleanRecord{SnapshotID: snapshotID, LibraryIndexedAt: indexedAt, CleanedAt: time.Now(), Result: &summary}
+		if err := c.History.RecordClean(playlistID, record); err != nil {
+			logger.WithFields(log.Fields{"err": err}).Warn("failed to record clean")
+		}
+	}
+	if c.Trash != nil && !dryRun {
+		if purged, err := c.Trash.Purge(ctx); err != nil {
+			logger.WithFields(log.Fields{"err": err}).Warn("failed to purge trash")
+		} else if purged > 0 {
+			fmt.Fprintf(c.Out, "Purged %d tracks from the trash.\n", purged)
+		}
+	}
+	return result, nil
+}
+
+// record counts a clean which finished with result and err
+func (m *cleanMetrics) record(result Result, err error) {
+	status := "succeeded"
+	if err != nil {
+		status = "failed"
+	} else if result.Skipped {
+		status = "skipped"
+	}
+	m.runs.Inc(status)
+	m.tracksScanned.Add(float64(result.TracksScanned))
+	if !result.DryRun {
+		m.tracksRemoved.Add(float64(result.Removed))
+	}
+	m.duration.Observe(result.Duration.Seconds())
+	if err == nil {
+		m.lastSucceeded.Set(float64(time.Now().Unix()))
+	}
+}
+
+// libraryIndexedAt returns when the library was last fetched from Spotify, or
+// the zero time if the library can't say
+func (c *Cleaner) libraryIndexedAt() (time.Time, error) {
+	lib, ok := c.library.(IndexedLibrary)
+	if !ok {
+		return time.Time{}, nil
+	}
+	return lib.IndexedAt()
+}
+
+// addLabels looks up the album label of each duplicate if the policy needs
+// them
+func (c *Cleaner) addLabels(ctx context.Context, duplicates []Duplicate) error {
+	if c.Metadata == nil || !c.policy.UsesLabels() || len(duplicates) == 0 {
+		return nil
+	}
+	albumIDs := []spotify.ID{}
+	seen := map[spotify.ID]bool{}
+	for _, d := range duplicates {
+		id := d.Track.Track.Album.ID
+		if id != "" && !seen[id] {
+			seen[id] = true
+			albumIDs = append(albumIDs, id)
+		}
+	}
+	_, span := tracing.Start(ctx, "spotify.AlbumLabels")
+	span.SetAttribute("albums", len(albumIDs))
+	labels, err := c.Metadata.AlbumLabels(ctx, albumIDs...)
+	span.RecordError(err)
+	span.End()
+	if err != nil {
+		return err
+	}
+	for ix := range duplicates {
+		duplicates[ix].Label = labels[duplicates[ix].Track.Track.Album.ID]
+	}
+	return nil
+}
+
+// decide returns the action to take for a duplicate: what it was reviewed to,
+// if it has been, otherwise what the policy decides. confirm is true if the
+// user should be asked before acting in Interactive mode, i.e. the policy
+// decided to remove or archive the duplicate.
+func (c *Cleaner) decide(d Duplicate) (action Action, confirm bool, err error) {
+	if c.Reviews != nil {
+		reviewed, remove, err := c.Reviews.Reviewed(d.Track.Track)
+		if err != nil {
+			return "", false, err
+		}
+		if reviewed && remove {
+			return ActionRemove, false, nil
+		} else if reviewed {
+			return ActionSkip, false, nil
+		}
+	}
+	action = c.policy.Decide(d)
+	return action, c.Interactive && (action == ActionRemove || action == ActionArchive), nil
+}
+
+// act carries out the policy's decision for each duplicate, updating
+// snapshotID to the playlist's version after removing tracks from it
+func (c *Cleaner) act(ctx context.Context, playlistID spotify.ID, duplicates []Duplicate, dryRun bool, snapshotID *string) (int, error) {
+	toRemove, toArchive, tagged := []spotify.ID{}, []spotify.ID{}, []spotify.ID{}
+	removed, trashed, queued, repeated, positioned := []Duplicate{}, []Duplicate{}, []Duplicate{}, []Duplicate{}, []Duplicate{}
+	_, positional := c.client.(PositionalPlaylists)
+	for _, d := range duplicates {
+		if d.Matcher == RepeatMatcher {
+			// The earliest occurrence stays in the playlist, so there's
+			// nothing for the policy to weigh up
+			action := ActionReport
+			if positional {
+				action = ActionRemove
+				repeated = append(repeated, d)
+			}
+			if c.Decisions != nil {
+				c.Decisions.Decided(playlistID, d, action)
+			}
+			fmt.Fprintf(c.Out, "[REPEAT][%s] %s (%s)\n", action, library.TrackString(d.Track.Track), d.Reason)
+			continue
+		}
+		action, confirm, err := c.decide(d)
+		if err != nil {
+			return 0, err
+		}
+		if confirm && c.Prompt != nil && !dryRun {
+			remove, err := c.Prompt(d)
+			if err != nil {
+				return 0, err
+			}
+			if !remove {
+				action = ActionReport
+			}
+		}
+		if action == ActionSkip {
+			if c.Decisions != nil {
+				c.Decisions.Decided(playlistID, d, action)
+			}
+			continue
+		}
+		if action == ActionAsk {
+			action = ActionReport
+			if c.Prompt != nil && !dryRun {
+				remove, err := c.Prompt(d)
+				if err != nil {
+					return 0, err
+				}
+				if remove {
+					action = ActionRemove
+				}
+			}
+		}
+		if action == ActionTag && c.Tags == nil {
+			action = ActionReport
+		}
+		if action == ActionQueue && c.Reviews == nil {
+			action = ActionReport
+		}
+		// Removing by ID would take a friend's entry of the same track too
+		if (action == ActionRemove || action == ActionArchive) && c.OwnAdditionsOnly && !positional {
+			action = ActionReport
+		}
+		if c.Decisions != nil {
+			c.Decisions.Decided(playlistID, d, action)
+		}
+		fmt.Fprintf(c.Out, "[DUPLICATE][%s] %s (%s)\n", action, library.TrackString(d.Track.Track), d.Reason)
+		id := d.Track.Track.ID
+		switch action {
+		case ActionRemove:
+			removed = append(removed, d)
+			trashed = append(trashed, d)
+		case ActionArchive:
+			toArchive = append(toArchive, id)
+			removed = append(removed, d)
+		case ActionTag:
+			tagged = append(tagged, id)
+		case ActionQueue:
+			queued = append(queued, d)
+		}
+		if action == ActionRemove || action == ActionArchive {
+			if c.OwnAdditionsOnly {
+				positioned = append(positioned, d)
+			} else {
+				toRemove = append(toRemove, id)
+			}
+		}
+	}
+	acted := len(removed) + len(repeated)
+	if err := c.checkAnomaly(ctx, playlistID, acted, dryRun); err != nil {
+		return 0, err
+	}
+	if dryRun {
+		return acted, nil
+	}
+	for _, id := range tagged {
+		if err := c.Tags.AddTag(id, c.policy.Tag()); err != nil {
+			return 0, err
+		}
+	}
+	if len(queued) > 0 {
+		if err := c.Reviews.Enqueue(playlistID, queued); err != nil {
+			return 0, err
+		}
+	}
+	if c.Trash != nil && len(trashed) > 0 {
+		_, span := tracing.Start(ctx, "trash.Put")
+		span.SetAttribute("tracks", len(trashed))
+		err := c.Trash.Put(ctx, playlistID, trashed)
+		span.RecordError(err)
+		span.End()
+		if err != nil {
+			return 0, err
+		}
+	}
+	removedFrom := *snapshotID
+	// Repeats and the user's own additions go first, while their positions
+	// are still those they were found at
+	if positioned = append(positioned, repeated...); len(positioned) > 0 {
+		if err := c.removeAt(ctx, playlistID, positioned, snapshotID); err != nil {
+			return 0, err
+		}
+	}
+	// Can only add or remove 100 tracks per request.
+	for ids := toArchive; len(ids) > 0; {
+		var chunk []spotify.ID
+		chunk, ids = FirstNIDs(ids, 100)
+		_, span := tracing.Start(ctx, "spotify.AddTracksToPlaylist")
+		span.SetAttribute("tracks", len(chunk))
+		_, err := c.client.AddTracksToPlaylist(ctx, c.policy.ArchivePlaylistID(), chunk...)
+		span.RecordError(err)
+		span.End()
+		if err != nil {
+			return 0, err
+		}
+	}
+	// Assuming this is atomic... the first returned value is the new playlist
+	// snapshot, only recorded in the clean history. When I use the snapshot
+	// in the next Request I get an error from spotify: "Invalid playlist Id"
+	for ids := toRemove; len(ids) > 0; {
+		var chunk []spotify.ID
+		chunk, ids = FirstNIDs(ids, 100)
+		_, span := tracing.Start(ctx, "spotify.RemoveTracksFromPlaylist")
+		span.SetAttribute("tracks", len(chunk))
+		snapshot, err := c.client.RemoveTracksFromPlaylist(ctx, playlistID, chunk...)
+		span.RecordError(err)
+		span.End()
+		if err != nil {
+			return 0, err
+		}
+		*snapshotID = snapshot
+	}
+	if c.Journal != nil && len(removed)+len(repeated) > 0 {
+		if err := c.Journal.Removed(ctx, playlistID, removedFrom, append(removed, repeated...)); err != nil {
+			log.FromContext(ctx).WithFields(log.Fields{"err": err, "tracks": len(removed) + len(repeated)}).Warn("failed to journal removed tracks")
+		}
+	}
+	if c.Promotions != nil && len(removed) > 0 {
+		if err := c.Promotions.Promoted(ctx, removed); err != nil {
+			log.FromContext(ctx).WithFields(log.Fields{"err": err, "tracks": len(removed)}).Warn("failed to record promoted tracks")
+		}
+	}
+	return acted, nil
+}
+
+// Duplicates runs every track in the provided list of playlist tracks
+// through the matcher pipeline and returns those which are duplicated in the
+// library. Their positions are within page.
+func (c *Cleaner) Duplicates(page []spotify.PlaylistTrack) ([]Duplicate, error) {
+	duplicateTracks := []Duplicate{}
+	for ix, playlistTrack := range page {
+		result, err := c.pipeline.Match(playlistTrack, c.library)
+		if err != nil {
+			return []Duplicate{}, &CleanError{TrackID: playlistTrack.Track.ID, Err: err}
+		}
+		if result != nil {
+			duplicateTracks = append(duplicateTracks, Duplicate{Track: playlistTrack, Position: ix, MatchResult: *result})
+		}
+	}
+
+	return duplicateTracks, nil
+}
+
+// Need to implement this because Go doesn't have generics. Returns the first n
+// IDs in the list and the rest of the list
+func FirstNIDs(ids []spotify.ID, n int) ([]spotify.ID, []spotify.ID) {
+	if len(ids) > n {
+		return ids[:n], ids[n:]
+	} else {
+		return ids, []spotify.ID{}
+	}
+}
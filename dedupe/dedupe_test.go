@@ -0,0 +1,31 @@
+package dedupe
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+func TestDuplicatesError(t *testing.T) {
+	boom := errors.New("boom")
+	r := NewRegistry()
+	r.Register("broken", func(MatcherOptions) (Matcher, error) {
+		return MatcherFunc(func(spotify.PlaylistTrack, Library) (bool, string, float64, error) {
+			return false, "", 0, boom
+		}), nil
+	})
+	p, err := r.Pipeline([]MatcherConfig{{Name: "broken"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCleaner(nil, &fakeLibrary{}, p, &Policy{}, nil)
+	_, err = c.Duplicates([]spotify.PlaylistTrack{{Track: fullTrack("1", "", "x", "y")}})
+	var ce *CleanError
+	if !errors.As(err, &ce) || ce.TrackID != "1" {
+		t.Fatalf("expected a CleanError for track 1, got %v", err)
+	}
+	if !errors.Is(err, boom) {
+		t.Errorf("expected CleanError to wrap the matcher error, got %v", err)
+	}
+}
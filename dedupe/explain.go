@@ -0,0 +1,116 @@
+package dedupe
+
+import (
+	"context"
+
+	"potentials-utils/library"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// Explainer is implemented by matchers which can show their working. Explain
+// returns the normalised strings a track is looked up in the library by, and
+// the library tracks considered as its duplicates.
+type Explainer interface {
+	Explain(t spotify.PlaylistTrack, index Library) (map[string]string, []*spotify.SavedTrack, error)
+}
+
+// StageExplanation is how one stage of the matcher pipeline decided whether a
+// track is a duplicate
+type StageExplanation struct {
+	Stage string `json:"stage"`
+	// Keys are the normalised strings the track was looked up by, nil if
+	// the matcher isn't an Explainer
+	Keys       map[string]string     `json:"keys,omitempty"`
+	Candidates []*spotify.SavedTrack `json:"candidates,omitempty"`
+	Matched    bool                  `json:"matched"`
+	Reason     string                `json:"reason,omitempty"`
+	Score      float64               `json:"score"`
+}
+
+// Explanation is every step of a Cleaner's decision about one track
+type Explanation struct {
+	Track  spotify.PlaylistTrack `json:"track"`
+	Stages []StageExplanation    `json:"stages"`
+	// Match is the result of the first matching stage, nil if the track
+	// isn't a duplicate
+	Match  *MatchResult `json:"match,omitempty"`
+	Label  string       `json:"label,omitempty"`
+	Genres []string     `json:"genres,omitempty"`
+	// Kept is why the genre, popularity or own additions filters exempt the
+	// duplicate from cleaning, if they do
+	Kept string `json:"kept,omitempty"`
+	// Action is what the policy, or an earlier review of the track, decided
+	// to do with the duplicate, empty if the track isn't a duplicate or was
+	// kept
+	Action Action `json:"action,omitempty"`
+}
+
+// Explain runs t through every stage of the pipeline, including those after
+// the first match, showing the working of each
+func (p *Pipeline) Explain(t spotify.PlaylistTrack, index Library) ([]StageExplanation, error) {
+	stages := []StageExplanation{}
+	for _, s := range p.stages {
+		e := StageExplanation{Stage: s.name}
+		var err error
+		if ex, ok := s.matcher.(Explainer); ok {
+			if e.Keys, e.Candidates, err = ex.Explain(t, index); err != nil {
+				return nil, err
+			}
+		}
+		if e.Matched, e.Reason, e.Score, err = s.matcher.Match(t, index); err != nil {
+			return nil, err
+		}
+		stages = append(stages, e)
+	}
+	return stages, nil
+}
+
+// Compare explains whether each stage of the pipeline would consider
+// candidate, found in a playlist, a duplicate of saved, were saved the only
+// track in the library
+func (p *Pipeline) Compare(saved, candidate spotify.FullTrack) ([]StageExplanation, error) {
+	index := library.NewSpotifyLibraryIndex(0)
+	index.SetNormalizer(p.Normalizer)
+	if p.IndexKey != nil {
+		index.SetIndexKey(p.IndexKey)
+	}
+	index.IndexTracks([]spotify.SavedTrack{{FullTrack: saved}})
+	return p.Explain(spotify.PlaylistTrack{Track: candidate}, index)
+}
+
+// Explain shows how a clean would decide what to do with t, without acting on
+// it
+func (c *Cleaner) Explain(ctx context.Context, t spotify.PlaylistTrack) (*Explanation, error) {
+	e := &Explanation{Track: t}
+	var err error
+	if e.Stages, err = c.pipeline.Explain(t, c.library); err != nil {
+		return nil, err
+	}
+	for _, s := range e.Stages {
+		if s.Matched {
+			e.Match = &MatchResult{Matcher: s.Stage, Reason: s.Reason, Score: s.Score}
+			break
+		}
+	}
+	if e.Match == nil {
+		return e, nil
+	}
+	duplicates := []Duplicate{{Track: t, MatchResult: *e.Match}}
+	if err := c.addLabels(ctx, duplicates); err != nil {
+		return nil, err
+	}
+	if err := c.addGenres(ctx, duplicates); err != nil {
+		return nil, err
+	}
+	d := duplicates[0]
+	e.Label, e.Genres = d.Label, d.Genres
+	if ok, reason := c.allows(d); !ok {
+		e.Kept = reason
+		return e, nil
+	}
+	if e.Action, _, err = c.decide(d); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
@@ -0,0 +1,140 @@
+package dedupe
+
+import (
+	"context"
+	"testing"
+
+	"potentials-utils/library"
+	"potentials-utils/spotifytest"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+func TestExplain(t *testing.T) {
+	_, c, cleanup := newTestCleaner(t)
+	defer cleanup()
+	pipeline, err := NewRegistry().Pipeline([]MatcherConfig{{Name: "id"}, {Name: "isrc"}, {Name: "metadata"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.pipeline = pipeline
+	c.PopularityFilter = PopularityFilter{Min: 50}
+
+	testCases := []struct {
+		name    string
+		track   spotify.FullTrack
+		matcher string
+		stages  []bool
+		kept    bool
+		action  Action
+	}{
+		{
+			name:    "saved",
+			track:   withPopularity(spotifytest.Track("t0", "Song 0", "Album", "Artist"), 80),
+			matcher: "id",
+			stages:  []bool{true, false, true},
+			action:  ActionRemove,
+		},
+		{
+			name:    "same metadata, unpopular",
+			track:   spotifytest.Track("other", "Song 10", "Album", "Artist"),
+			matcher: "metadata",
+			stages:  []bool{false, false, true},
+			kept:    true,
+		},
+		{
+			name:   "unsaved",
+			track:  spotifytest.Track("t1", "Song 1", "Album", "Artist"),
+			stages: []bool{false, false, false},
+		},
+	}
+	for _, tc := range testCases {
+		e, err := c.Explain(context.Background(), spotify.PlaylistTrack{Track: tc.track})
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		if len(e.Stages) != len(tc.stages) {
+			t.Fatalf("%s failed: expected %d stages, got %d", tc.name, len(tc.stages), len(e.Stages))
+		}
+		for ix, matched := range tc.stages {
+			if e.Stages[ix].Matched != matched {
+				t.Errorf("%s failed: expected stage %s matched=%v", tc.name, e.Stages[ix].Stage, matched)
+			}
+			if e.Stages[ix].Keys == nil {
+				t.Errorf("%s failed: expected stage %s to explain its keys", tc.name, e.Stages[ix].Stage)
+			}
+			if matched && len(e.Stages[ix].Candidates) == 0 {
+				t.Errorf("%s failed: expected stage %s to list candidates", tc.name, e.Stages[ix].Stage)
+			}
+		}
+		if tc.matcher == "" {
+			if e.Match != nil {
+				t.Errorf("%s failed: expected no match, got %+v", tc.name, e.Match)
+			}
+			continue
+		}
+		if e.Match == nil || e.Match.Matcher != tc.matcher {
+			t.Errorf("%s failed: expected a match by %s, got %+v", tc.name, tc.matcher, e.Match)
+		}
+		if (e.Kept != "") != tc.kept || e.Action != tc.action {
+			t.Errorf("%s failed: expected kept=%v action %q, got kept %q action %q", tc.name, tc.kept, tc.action, e.Kept, e.Action)
+		}
+	}
+}
+
+func withPopularity(t spotify.FullTrack, popularity int) spotify.FullTrack {
+	t.Popularity = spotify.Numeric(popularity)
+	return t
+}
+
+func TestCompare(t *testing.T) {
+	pipeline, err := NewRegistry().Pipeline([]MatcherConfig{{Name: "id"}, {Name: "isrc"}, {Name: "metadata"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := spotifytest.Track("a", "Song", "Album", "Artist")
+	saved.ExternalIDs = map[string]string{"isrc": "USABC0000001"}
+	remaster := spotifytest.Track("b", "Song - Remastered", "Album (Deluxe)", "Artist")
+	remaster.ExternalIDs = saved.ExternalIDs
+	reissue := spotifytest.Track("c", "Song", "Album", "Artist")
+
+	testCases := []struct {
+		name      string
+		candidate spotify.FullTrack
+		matched   []bool
+	}{
+		{name: "same track", candidate: saved, matched: []bool{true, true, true}},
+		{name: "remaster", candidate: remaster, matched: []bool{false, true, false}},
+		{name: "reissue", candidate: reissue, matched: []bool{false, false, true}},
+	}
+	for _, tc := range testCases {
+		stages, err := pipeline.Compare(saved, tc.candidate)
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		for ix, matched := range tc.matched {
+			if stages[ix].Matched != matched {
+				t.Errorf("%s failed: expected stage %s matched=%v", tc.name, stages[ix].Stage, matched)
+			}
+		}
+	}
+}
+
+func TestCompareIndexKey(t *testing.T) {
+	pipeline, err := NewRegistry().Pipeline([]MatcherConfig{{Name: "metadata", Options: MatcherOptions{"compilations": false}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pipeline.IndexKey, err = library.NewIndexKey([]string{library.KeyName, library.KeyArtists}, 0); err != nil {
+		t.Fatal(err)
+	}
+	saved := spotifytest.Track("a", "Song", "Album", "Artist")
+	single := spotifytest.Track("b", "Song", "Song - Single", "Artist")
+	stages, err := pipeline.Compare(saved, single)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stages[0].Matched || stages[0].Reason != "song and artists match library track a" {
+		t.Errorf("expected the single matched without comparing albums, got %+v", stages[0])
+	}
+}
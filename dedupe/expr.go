@@ -0,0 +1,124 @@
+package dedupe
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"potentials-utils/library"
+
+	"github.com/zmb3/spotify/v2"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// defaultExprMaxSteps is how many Starlark steps an expression may take per
+// candidate unless the maxSteps option says otherwise, far more than any
+// comparison of two tracks needs
+const defaultExprMaxSteps = 100000
+
+// exprMatcher evaluates a user-supplied Starlark expression against each
+// candidate library track. Candidates are the library tracks sharing at least
+// one artist with the playlist track. The expression sees:
+//
+//	track, lib     the playlist track and the candidate library track, each
+//	               with fields id, name, album, artists, isrc, duration_ms,
+//	               popularity, release_date and explicit
+//	duration_diff  the absolute difference between their durations in
+//	               whole seconds
+//
+// e.g. `track.name.lower() == lib.name.lower() and duration_diff < 3`
+//
+// Candidates are tried in order of ID, so the same one is reported each run
+// if several match.
+type exprMatcher struct {
+	src   string
+	fn    starlark.Value
+	score float64
+	// maxSteps bounds the Starlark steps evaluating the expression against
+	// one candidate may take, so a runaway expression fails rather than hangs
+	maxSteps uint64
+	// window suppresses matches against much older releases
+	window releaseWindow
+}
+
+func newExprMatcher(opts MatcherOptions) (Matcher, error) {
+	src := opts.String("expression", "")
+	if src == "" {
+		return nil, errors.New("expr matcher requires an expression option")
+	}
+	// Wrapping the expression in parens lets it span several YAML lines
+	program := fmt.Sprintf("def match(track, lib, duration_diff):\n    return (\n%s\n)\n", src)
+	globals, err := starlark.ExecFile(&starlark.Thread{Name: "expr"}, "expression", program, nil)
+	if err != nil {
+		return nil, err
+	}
+	maxSteps := opts.Float("maxSteps", defaultExprMaxSteps)
+	if maxSteps < 1 {
+		return nil, errors.New("expr matcher maxSteps must be at least 1")
+	}
+	return &exprMatcher{
+		src:      src,
+		fn:       globals["match"],
+		score:    opts.Float("score", 0.8),
+		maxSteps: uint64(maxSteps),
+		window:   newReleaseWindow(opts),
+	}, nil
+}
+
+func (m *exprMatcher) Match(t spotify.PlaylistTrack, index Library) (bool, string, float64, error) {
+	seen := map[spotify.ID]bool{}
+	candidates := []*spotify.SavedTrack{}
+	for _, name := range library.ArtistNames(t.Track.SimpleTrack) {
+		tracks, err := index.GetByArtistName(name)
+		if err != nil {
+			return false, "", 0, err
+		}
+		for _, c := range tracks {
+			if !seen[c.ID] {
+				seen[c.ID] = true
+				candidates = append(candidates, c)
+			}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].ID < candidates[j].ID })
+	track := trackValue(t.Track)
+	for _, c := range candidates {
+		diff := int(t.Track.Duration - c.Duration)
+		if diff < 0 {
+			diff = -diff
+		}
+		thread := &starlark.Thread{Name: "expr"}
+		thread.SetMaxExecutionSteps(m.maxSteps)
+		v, err := starlark.Call(thread, m.fn, starlark.Tuple{track, trackValue(c.FullTrack), starlark.MakeInt(diff / 1000)}, nil)
+		if err != nil && thread.ExecutionSteps() >= m.maxSteps {
+			return false, "", 0, fmt.Errorf("evaluating %q: gave up after %d steps, raise the maxSteps option if it really needs more", m.src, m.maxSteps)
+		}
+		if err != nil {
+			return false, "", 0, fmt.Errorf("evaluating %q: %w", m.src, err)
+		}
+		if bool(v.Truth()) && !m.window.suppresses(t.Track, c) {
+			return true, fmt.Sprintf("expression matched library track %s", c.ID), m.score, nil
+		}
+	}
+	return false, "", 0, nil
+}
+
+// trackValue exposes the fields of a track to Starlark expressions
+func trackValue(t spotify.FullTrack) starlark.Value {
+	artists := []starlark.Value{}
+	for _, a := range library.ArtistNames(t.SimpleTrack) {
+		artists = append(artists, starlark.String(a))
+	}
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"id":           starlark.String(t.ID),
+		"name":         starlark.String(t.Name),
+		"album":        starlark.String(t.Album.Name),
+		"artists":      starlark.NewList(artists),
+		"isrc":         starlark.String(library.ISRC(t)),
+		"duration_ms":  starlark.MakeInt(int(t.Duration)),
+		"popularity":   starlark.MakeInt(int(t.Popularity)),
+		"release_date": starlark.String(t.Album.ReleaseDate),
+		"explicit":     starlark.Bool(t.Explicit),
+	})
+}
@@ -0,0 +1,139 @@
+package dedupe
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"potentials-utils/library"
+	"potentials-utils/tracing"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// GenreFilter restricts cleaning by the genres of a track's artists. Genres
+// are compared ignoring case.
+type GenreFilter struct {
+	// Skip exempts tracks with any of these genres from cleaning
+	Skip []string
+	// Only restricts cleaning to tracks with at least one of these genres,
+	// ignored if empty
+	Only []string
+}
+
+// Enabled returns true if the filter restricts anything
+func (f GenreFilter) Enabled() bool {
+	return len(f.Skip) > 0 || len(f.Only) > 0
+}
+
+// Allows returns true if a track with the given genres may be cleaned, and
+// the reason if not
+func (f GenreFilter) Allows(genres []string) (bool, string) {
+	for _, g := range genres {
+		if containsFold(f.Skip, g) {
+			return false, fmt.Sprintf("genre %q is in skipGenres", g)
+		}
+	}
+	if len(f.Only) == 0 {
+		return true, ""
+	}
+	for _, g := range genres {
+		if containsFold(f.Only, g) {
+			return true, ""
+		}
+	}
+	return false, "no genre is in onlyGenres"
+}
+
+func containsFold(list []string, s string) bool {
+	for _, e := range list {
+		if strings.EqualFold(e, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// addGenres looks up the genres of each duplicate's artists if the genre
+// filter needs them
+func (c *Cleaner) addGenres(ctx context.Context, duplicates []Duplicate) error {
+	if c.Metadata == nil || !c.GenreFilter.Enabled() || len(duplicates) == 0 {
+		return nil
+	}
+	artistIDs := []spotify.ID{}
+	seen := map[spotify.ID]bool{}
+	for _, d := range duplicates {
+		for _, a := range d.Track.Track.Artists {
+			if a.ID != "" && !seen[a.ID] {
+				seen[a.ID] = true
+				artistIDs = append(artistIDs, a.ID)
+			}
+		}
+	}
+	_, span := tracing.Start(ctx, "spotify.ArtistGenres")
+	span.SetAttribute("artists", len(artistIDs))
+	genres, err := c.Metadata.ArtistGenres(ctx, artistIDs...)
+	span.RecordError(err)
+	span.End()
+	if err != nil {
+		return err
+	}
+	for ix := range duplicates {
+		for _, a := range duplicates[ix].Track.Track.Artists {
+			duplicates[ix].Genres = append(duplicates[ix].Genres, genres[a.ID]...)
+		}
+	}
+	return nil
+}
+
+// PopularityFilter restricts cleaning by Spotify's 0-100 popularity score of
+// a track
+type PopularityFilter struct {
+	// Min exempts tracks less popular than Min from cleaning
+	Min int
+	// Max exempts tracks more popular than Max from cleaning, ignored if
+	// zero
+	Max int
+}
+
+// Allows returns true if a track with the given popularity may be cleaned,
+// and the reason if not
+func (f PopularityFilter) Allows(popularity int) (bool, string) {
+	if popularity < f.Min {
+		return false, fmt.Sprintf("popularity %d is below minPopularity %d", popularity, f.Min)
+	}
+	if f.Max != 0 && popularity > f.Max {
+		return false, fmt.Sprintf("popularity %d is above maxPopularity %d", popularity, f.Max)
+	}
+	return true, ""
+}
+
+// filter drops duplicates the genre, popularity and own additions filters
+// exempt from cleaning
+func (c *Cleaner) filter(duplicates []Duplicate) []Duplicate {
+	kept := []Duplicate{}
+	for _, d := range duplicates {
+		if ok, reason := c.allows(d); !ok {
+			fmt.Fprintf(c.Out, "[KEPT] %s (%s)\n", library.TrackString(d.Track.Track), reason)
+			continue
+		}
+		kept = append(kept, d)
+	}
+	return kept
+}
+
+// allows returns true if the genre, popularity and own additions filters
+// allow d to be cleaned, and the reason if not
+func (c *Cleaner) allows(d Duplicate) (bool, string) {
+	ok, reason := c.PopularityFilter.Allows(int(d.Track.Track.Popularity))
+	if ok && c.Metadata != nil && c.GenreFilter.Enabled() {
+		ok, reason = c.GenreFilter.Allows(d.Genres)
+	}
+	if ok && c.OwnAdditionsOnly && (c.UserID == "" || d.Track.AddedBy.ID != c.UserID) {
+		ok, reason = false, "not added by you"
+		if d.Track.AddedBy.ID != "" {
+			reason = fmt.Sprintf("added by %s", d.Track.AddedBy.ID)
+		}
+	}
+	return ok, reason
+}
@@ -0,0 +1,81 @@
+package dedupe
+
+import (
+	"testing"
+)
+
+func TestGenreFilterAllows(t *testing.T) {
+	testCases := []struct {
+		name     string
+		filter   GenreFilter
+		genres   []string
+		expected bool
+	}{
+		{
+			name:     "empty filter allows everything",
+			genres:   []string{"jazz"},
+			expected: true,
+		},
+		{
+			name:   "skipped genre is exempt, ignoring case",
+			filter: GenreFilter{Skip: []string{"Jazz"}},
+			genres: []string{"rock", "jazz"},
+		},
+		{
+			name:     "only genre allows matching tracks",
+			filter:   GenreFilter{Only: []string{"indie rock"}},
+			genres:   []string{"indie rock", "shoegaze"},
+			expected: true,
+		},
+		{
+			name:   "only genre exempts tracks without genres",
+			filter: GenreFilter{Only: []string{"indie rock"}},
+		},
+		{
+			name:   "skip beats only",
+			filter: GenreFilter{Skip: []string{"shoegaze"}, Only: []string{"indie rock"}},
+			genres: []string{"indie rock", "shoegaze"},
+		},
+	}
+	for _, tc := range testCases {
+		if ok, _ := tc.filter.Allows(tc.genres); ok != tc.expected {
+			t.Errorf("%s failed: expected %v, got %v", tc.name, tc.expected, ok)
+		}
+	}
+}
+
+func TestPopularityFilterAllows(t *testing.T) {
+	testCases := []struct {
+		name       string
+		filter     PopularityFilter
+		popularity int
+		expected   bool
+	}{
+		{
+			name:       "zero filter allows everything",
+			popularity: 0,
+			expected:   true,
+		},
+		{
+			name:       "obscure tracks are kept",
+			filter:     PopularityFilter{Min: 20},
+			popularity: 5,
+		},
+		{
+			name:       "min is inclusive",
+			filter:     PopularityFilter{Min: 20},
+			popularity: 20,
+			expected:   true,
+		},
+		{
+			name:       "popular tracks are kept below max",
+			filter:     PopularityFilter{Max: 50},
+			popularity: 80,
+		},
+	}
+	for _, tc := range testCases {
+		if ok, _ := tc.filter.Allows(tc.popularity); ok != tc.expected {
+			t.Errorf("%s failed: expected %v, got %v", tc.name, tc.expected, ok)
+		}
+	}
+}
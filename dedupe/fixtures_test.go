@@ -0,0 +1,154 @@
+package dedupe
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"potentials-utils/library"
+	"potentials-utils/spotifyclient"
+	"potentials-utils/spotifytest"
+
+	"github.com/zmb3/spotify/v2"
+	"gopkg.in/yaml.v2"
+)
+
+// fixture is a duplicate detection case read from testdata/fixtures. Each
+// fixture describes a library, a playlist, the matcher pipeline to run, and
+// the playlist tracks expected to be found duplicated.
+type fixture struct {
+	Description string          `yaml:"description"`
+	Matchers    []MatcherConfig `yaml:"matchers"`
+	Library     []fixtureTrack  `yaml:"library"`
+	Playlist    []fixtureTrack  `yaml:"playlist"`
+	// Duplicates are the expected duplicates, every other playlist track
+	// must not match
+	Duplicates []fixtureDuplicate `yaml:"duplicates"`
+}
+
+type fixtureTrack struct {
+	ID           string   `yaml:"id"`
+	Name         string   `yaml:"name"`
+	Album        string   `yaml:"album"`
+	AlbumType    string   `yaml:"albumType"`
+	AlbumArtists []string `yaml:"albumArtists"`
+	Artists      []string `yaml:"artists"`
+	ISRC         string   `yaml:"isrc"`
+	DurationMs   int      `yaml:"durationMs"`
+	Popularity   int      `yaml:"popularity"`
+	ReleaseDate  string   `yaml:"releaseDate"`
+	Explicit     bool     `yaml:"explicit"`
+}
+
+type fixtureDuplicate struct {
+	Track   string `yaml:"track"`
+	Matcher string `yaml:"matcher"`
+}
+
+func (ft fixtureTrack) fullTrack() spotify.FullTrack {
+	t := spotifytest.Track(ft.ID, ft.Name, ft.Album, ft.Artists...)
+	t.Album.AlbumType = ft.AlbumType
+	t.Album.ReleaseDate = ft.ReleaseDate
+	if len(ft.AlbumArtists) > 0 {
+		t.Album.Artists = nil
+		for _, a := range ft.AlbumArtists {
+			t.Album.Artists = append(t.Album.Artists, spotify.SimpleArtist{Name: a})
+		}
+	}
+	if ft.ISRC != "" {
+		t.ExternalIDs = map[string]string{"isrc": ft.ISRC}
+	}
+	t.Duration = spotify.Numeric(ft.DurationMs)
+	t.Popularity = spotify.Numeric(ft.Popularity)
+	t.Explicit = ft.Explicit
+	return t
+}
+
+func loadFixture(path string) (*fixture, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &fixture{}
+	if err := yaml.UnmarshalStrict(b, f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// runFixture runs the fixture's playlist through its matcher pipeline
+// against a library index built from a fake Spotify, and returns the matcher
+// which found each duplicate keyed by track ID
+func runFixture(t *testing.T, f *fixture) map[string]string {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	for _, ft := range f.Library {
+		srv.AddSavedTracks(ft.fullTrack())
+	}
+	dir, err := ioutil.TempDir("", "fixture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lib, err := library.NewLibraryService(spotifyclient.New(srv.HTTPClient()), library.CacheConfig{CacheDir: dir, Lifetime: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := NewRegistry().Pipeline(f.Matchers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCleaner(nil, lib, pipeline, &Policy{}, nil)
+	page := []spotify.PlaylistTrack{}
+	for _, ft := range f.Playlist {
+		page = append(page, spotify.PlaylistTrack{Track: ft.fullTrack()})
+	}
+	duplicates, err := c.Duplicates(page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]string{}
+	for _, d := range duplicates {
+		found[string(d.Track.Track.ID)] = d.Matcher
+	}
+	return found
+}
+
+func TestFixtures(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "fixtures", "*.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no fixtures found")
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		name := filepath.Base(path)
+		f, err := loadFixture(path)
+		if err != nil {
+			t.Errorf("%s failed: %v", name, err)
+			continue
+		}
+		found := runFixture(t, f)
+		expected := map[string]string{}
+		for _, d := range f.Duplicates {
+			expected[d.Track] = d.Matcher
+		}
+		for id, matcher := range expected {
+			if got, ok := found[id]; !ok {
+				t.Errorf("%s failed: expected %s to be found by %s, it wasn't found (%s)", name, id, matcher, f.Description)
+			} else if got != matcher {
+				t.Errorf("%s failed: expected %s to be found by %s, got %s", name, id, matcher, got)
+			}
+		}
+		for id, matcher := range found {
+			if _, ok := expected[id]; !ok {
+				t.Errorf("%s failed: expected %s not to be a duplicate, got a match by %s (%s)", name, id, matcher, f.Description)
+			}
+		}
+	}
+}
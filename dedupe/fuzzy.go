@@ -0,0 +1,106 @@
+package dedupe
+
+import (
+	"fmt"
+	"time"
+
+	"potentials-utils/library"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// fuzzyNormalizer normalizes names for fuzzy matching with every step, so
+// case, punctuation, accents, featured artists and version suffixes such as
+// "(Remastered)" are all ignored
+var fuzzyNormalizer, _ = library.NewNormalizer(library.FuzzySteps)
+
+// fuzzyMatcher matches tracks whose normalized name is within a few edits of
+// a library track by the same artist, catching near-duplicates exact metadata
+// matching misses, like remastered reissues. Options are:
+//
+//	maxDistance       the most edits between names, default 2, though never
+//	                  more than a quarter of the name's length so short
+//	                  names must match exactly
+//	maxDurationDiff   the most seconds the durations may differ by, ignored
+//	                  if zero
+//	score             the score of an exact match once normalized, default
+//	                  0.8, lowered in proportion to the edits
+//	newerReleaseDays  as for the metadata matcher
+type fuzzyMatcher struct {
+	maxDistance     int
+	maxDurationDiff time.Duration
+	score           float64
+	window          releaseWindow
+}
+
+func newFuzzyMatcher(opts MatcherOptions) (Matcher, error) {
+	maxDistance := int(opts.Float("maxDistance", 2))
+	if maxDistance < 0 {
+		return nil, fmt.Errorf("maxDistance must not be negative, got %d", maxDistance)
+	}
+	return &fuzzyMatcher{
+		maxDistance:     maxDistance,
+		maxDurationDiff: time.Duration(opts.Float("maxDurationDiff", 0) * float64(time.Second)),
+		score:           opts.Float("score", 0.8),
+		window:          newReleaseWindow(opts),
+	}, nil
+}
+
+func (m *fuzzyMatcher) Match(t spotify.PlaylistTrack, index Library) (bool, string, float64, error) {
+	candidates, err := m.candidates(t, index)
+	if err != nil || len(candidates) == 0 {
+		return false, "", 0, err
+	}
+	best, name := candidates[0], fuzzyNormalizer.Normalize(t.Track.Name)
+	distance := library.EditDistance(name, fuzzyNormalizer.Normalize(best.Name))
+	for _, c := range candidates[1:] {
+		if d := library.EditDistance(name, fuzzyNormalizer.Normalize(c.Name)); d < distance {
+			best, distance = c, d
+		}
+	}
+	score := m.score * (1 - float64(distance)/float64(len([]rune(name))))
+	return true, fmt.Sprintf("song name %d edits from library track %s by the same artist", distance, best.ID), score, nil
+}
+
+func (m *fuzzyMatcher) Explain(t spotify.PlaylistTrack, index Library) (map[string]string, []*spotify.SavedTrack, error) {
+	keys := map[string]string{"name": fuzzyNormalizer.Normalize(t.Track.Name)}
+	candidates, err := m.candidates(t, index)
+	return keys, candidates, err
+}
+
+// candidates returns the library tracks by any of t's artists whose names are
+// close enough to t's
+func (m *fuzzyMatcher) candidates(t spotify.PlaylistTrack, index Library) ([]*spotify.SavedTrack, error) {
+	name := fuzzyNormalizer.Normalize(t.Track.Name)
+	max := len([]rune(name)) / 4
+	if max > m.maxDistance {
+		max = m.maxDistance
+	}
+	candidates := []*spotify.SavedTrack{}
+	for _, artist := range library.ArtistNames(t.Track.SimpleTrack) {
+		tracks, err := index.GetByArtistName(artist)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range tracks {
+			if containsTrack(candidates, c.ID) || m.window.suppresses(t.Track, c) {
+				continue
+			}
+			if m.maxDurationDiff > 0 && absDuration(int(t.Track.Duration-c.Duration)) > m.maxDurationDiff {
+				continue
+			}
+			if name != "" && library.EditDistance(name, fuzzyNormalizer.Normalize(c.Name)) <= max {
+				candidates = append(candidates, c)
+			}
+		}
+	}
+	return candidates, nil
+}
+
+// absDuration returns the absolute difference in milliseconds as a Duration
+func absDuration(ms int) time.Duration {
+	if ms < 0 {
+		ms = -ms
+	}
+	return time.Duration(ms) * time.Millisecond
+}
@@ -0,0 +1,133 @@
+package dedupe
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// CleanRecord is the state a playlist was left in by its last complete clean
+type CleanRecord struct {
+	// SnapshotID is the version of the playlist after the clean
+	SnapshotID string `json:"snapshotID"`
+	// LibraryIndexedAt is when the library the playlist was cleaned against
+	// was fetched from Spotify
+	LibraryIndexedAt time.Time `json:"libraryIndexedAt"`
+	CleanedAt        time.Time `json:"cleanedAt"`
+	// Result summarizes the clean, nil in records written before results
+	// were recorded
+	Result *Result `json:"result,omitempty"`
+	// Removals are how many duplicates each of the last complete cleans
+	// removed, oldest first and this clean last. FileCleanHistory carries
+	// them over from the last record.
+	Removals []int `json:"removals,omitempty"`
+}
+
+// maxRemovals is how many cleans' removals a record keeps
+const maxRemovals = 50
+
+// removals returns the removals of the cleans up to and including r, which
+// may be nil. Records written before removals were kept have their own.
+func (r *CleanRecord) removals() []int {
+	if r == nil {
+		return nil
+	}
+	if len(r.Removals) == 0 && r.Result != nil {
+		return []int{r.Result.Removed}
+	}
+	return r.Removals
+}
+
+// CleanHistory remembers the last complete clean of each playlist
+type CleanHistory interface {
+	// LastClean returns the record of the last clean of a playlist, or nil
+	// if it has never been cleaned
+	LastClean(id spotify.ID) (*CleanRecord, error)
+	RecordClean(id spotify.ID, r CleanRecord) error
+}
+
+// IndexedLibrary is a Library which knows when it was last fetched from
+// Spotify
+type IndexedLibrary interface {
+	Library
+	IndexedAt() (time.Time, error)
+}
+
+// FileCleanHistory is a CleanHistory persisted as a JSON file
+type FileCleanHistory struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileCleanHistory creates a CleanHistory persisted at path. The file is
+// created on the first write.
+func NewFileCleanHistory(path string) *FileCleanHistory {
+	return &FileCleanHistory{path: path}
+}
+
+// LastClean returns the record of the last clean of the playlist with the
+// given ID
+func (h *FileCleanHistory) LastClean(id spotify.ID) (*CleanRecord, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	records, err := h.load()
+	if err != nil {
+		return nil, err
+	}
+	r, ok := records[id]
+	if !ok {
+		return nil, nil
+	}
+	return &r, nil
+}
+
+// RecordClean records a clean of the playlist with the given ID, adding its
+// removals to those of the cleans before
+func (h *FileCleanHistory) RecordClean(id spotify.ID, r CleanRecord) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	records, err := h.load()
+	if err != nil {
+		return err
+	}
+	if r.Result != nil {
+		last, ok := records[id]
+		removals := []int{}
+		if ok {
+			removals = append(removals, last.removals()...)
+		}
+		removals = append(removals, r.Result.Removed)
+		if len(removals) > maxRemovals {
+			removals = removals[len(removals)-maxRemovals:]
+		}
+		r.Removals = removals
+	}
+	records[id] = r
+	bytes, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(h.path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(h.path, bytes, 0644)
+}
+
+func (h *FileCleanHistory) load() (map[spotify.ID]CleanRecord, error) {
+	records := map[spotify.ID]CleanRecord{}
+	slurp, err := ioutil.ReadFile(h.path)
+	if os.IsNotExist(err) {
+		return records, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(slurp, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
@@ -0,0 +1,460 @@
+package dedupe
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"potentials-utils/library"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// Matcher decides whether a playlist track is a duplicate of something in the
+// library. Match returns whether the track matched, a human-readable reason
+// for the decision, and a confidence score between 0 and 1.
+type Matcher interface {
+	Match(t spotify.PlaylistTrack, index Library) (bool, string, float64, error)
+}
+
+// MatcherFunc adapts an ordinary function to the Matcher interface
+type MatcherFunc func(t spotify.PlaylistTrack, index Library) (bool, string, float64, error)
+
+// Match calls f(t, index)
+func (f MatcherFunc) Match(t spotify.PlaylistTrack, index Library) (bool, string, float64, error) {
+	return f(t, index)
+}
+
+// MatcherOptions are the free-form options configured for a matcher in YAML
+type MatcherOptions map[string]interface{}
+
+// String returns the string option named key, or def if it isn't set
+func (o MatcherOptions) String(key, def string) string {
+	if v, ok := o[key]; ok {
+		return strings.TrimSpace(fmt.Sprint(v))
+	}
+	return def
+}
+
+// Float returns the numeric option named key, or def if it isn't set or isn't
+// a number
+func (o MatcherOptions) Float(key string, def float64) float64 {
+	switch v := o[key].(type) {
+	case int:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return def
+}
+
+// Bool returns the boolean option named key, or def if it isn't set or isn't
+// a boolean
+func (o MatcherOptions) Bool(key string, def bool) bool {
+	if v, ok := o[key].(bool); ok {
+		return v
+	}
+	return def
+}
+
+// Strings returns the list option named key, or def if it isn't set. A single
+// string is a list of one.
+func (o MatcherOptions) Strings(key string, def []string) []string {
+	switch v := o[key].(type) {
+	case string:
+		return []string{strings.TrimSpace(v)}
+	case []interface{}:
+		list := []string{}
+		for _, item := range v {
+			list = append(list, strings.TrimSpace(fmt.Sprint(item)))
+		}
+		return list
+	case []string:
+		return v
+	}
+	return def
+}
+
+// MatcherFactory builds a Matcher from its configured options
+type MatcherFactory func(opts MatcherOptions) (Matcher, error)
+
+// MatcherConfig configures a single stage of the matcher pipeline
+type MatcherConfig struct {
+	// Name is the name the matcher was registered under
+	Name    string         `yaml:"name"`
+	Options MatcherOptions `yaml:"options"`
+}
+
+// Registry maps matcher names to the factories which build them
+type Registry struct {
+	factories map[string]MatcherFactory
+}
+
+// NewRegistry creates a Registry holding the built-in matchers: "id",
+// "isrc", "album", "metadata", "fuzzy" and "expr"
+func NewRegistry() *Registry {
+	r := &Registry{factories: map[string]MatcherFactory{}}
+	r.Register("id", func(MatcherOptions) (Matcher, error) { return idMatcher{}, nil })
+	r.Register("album", func(MatcherOptions) (Matcher, error) { return albumMatcher{}, nil })
+	r.Register("isrc", func(MatcherOptions) (Matcher, error) { return isrcMatcher{}, nil })
+	r.Register("metadata", newMetadataMatcher)
+	r.Register("fuzzy", newFuzzyMatcher)
+	r.Register("expr", newExprMatcher)
+	return r
+}
+
+// Register adds a matcher factory under name, replacing any existing factory
+// with the same name
+func (r *Registry) Register(name string, f MatcherFactory) {
+	r.factories[name] = f
+}
+
+// Names returns the names of every registered matcher
+func (r *Registry) Names() []string {
+	names := []string{}
+	for n := range r.factories {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Pipeline builds a pipeline running the configured matchers in order
+func (r *Registry) Pipeline(cfgs []MatcherConfig) (*Pipeline, error) {
+	p := &Pipeline{}
+	for _, c := range cfgs {
+		f, ok := r.factories[c.Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown matcher %q, known matchers are %v", c.Name, r.Names())
+		}
+		m, err := f(c.Options)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create matcher %q: %w", c.Name, err)
+		}
+		p.stages = append(p.stages, stage{name: c.Name, matcher: m})
+	}
+	return p, nil
+}
+
+type stage struct {
+	name    string
+	matcher Matcher
+}
+
+// Pipeline runs a sequence of matchers against a track, stopping at the first
+// matcher which considers the track a duplicate
+type Pipeline struct {
+	// Normalizer normalizes names in the one track library Compare matches
+	// against, as the real library does. Names are compared as they are if
+	// nil.
+	Normalizer *library.Normalizer
+	// IndexKey is the key of the one track library Compare matches against,
+	// as the real library is keyed. Defaults to the song, album and artist
+	// names if nil.
+	IndexKey *library.IndexKey
+
+	stages []stage
+}
+
+// MatchResult describes why a track was considered a duplicate
+type MatchResult struct {
+	Matcher string  `json:"matcher"`
+	Reason  string  `json:"reason"`
+	Score   float64 `json:"score"`
+}
+
+// Match runs t through each stage of the pipeline. The result is nil if no
+// stage matched.
+func (p *Pipeline) Match(t spotify.PlaylistTrack, index Library) (*MatchResult, error) {
+	for _, s := range p.stages {
+		matched, reason, score, err := s.matcher.Match(t, index)
+		if err != nil {
+			return nil, fmt.Errorf("matcher %q: %w", s.name, err)
+		}
+		if matched {
+			return &MatchResult{Matcher: s.name, Reason: reason, Score: score}, nil
+		}
+	}
+	return nil, nil
+}
+
+// idMatcher matches tracks saved in the library under the same ID
+type idMatcher struct{}
+
+func (idMatcher) Match(t spotify.PlaylistTrack, index Library) (bool, string, float64, error) {
+	return matchByID(t, index)
+}
+
+func (idMatcher) Explain(t spotify.PlaylistTrack, index Library) (map[string]string, []*spotify.SavedTrack, error) {
+	keys := map[string]string{"id": string(t.Track.ID)}
+	libraryTrack, err := index.GetByID(t.Track.ID)
+	if err != nil || libraryTrack == nil {
+		return keys, nil, err
+	}
+	return keys, []*spotify.SavedTrack{libraryTrack}, nil
+}
+
+// isrcMatcher matches tracks with the same ISRC as a library track, e.g.
+// re-releases of a saved recording
+type isrcMatcher struct{}
+
+func (isrcMatcher) Match(t spotify.PlaylistTrack, index Library) (bool, string, float64, error) {
+	return matchByISRC(t, index)
+}
+
+func (isrcMatcher) Explain(t spotify.PlaylistTrack, index Library) (map[string]string, []*spotify.SavedTrack, error) {
+	isrc := library.ISRC(t.Track)
+	keys := map[string]string{"isrc": isrc}
+	if isrc == "" {
+		return keys, nil, nil
+	}
+	matches, err := index.GetByISRC(isrc)
+	return keys, matches, err
+}
+
+// AlbumLibrary is implemented by libraries which index the user's saved
+// albums
+type AlbumLibrary interface {
+	GetSavedAlbum(id spotify.ID) (*spotify.SavedAlbum, error)
+}
+
+// albumMatcher matches tracks on albums saved in the library, whether or not
+// the tracks themselves are saved. Nothing matches if the library doesn't
+// index saved albums.
+type albumMatcher struct{}
+
+func (albumMatcher) Match(t spotify.PlaylistTrack, index Library) (bool, string, float64, error) {
+	album, err := savedAlbum(t, index)
+	if err != nil || album == nil {
+		return false, "", 0, err
+	}
+	return true, fmt.Sprintf("album %q is saved in library", album.Name), 0.9, nil
+}
+
+func (albumMatcher) Explain(t spotify.PlaylistTrack, index Library) (map[string]string, []*spotify.SavedTrack, error) {
+	_, err := savedAlbum(t, index)
+	return map[string]string{"album": string(t.Track.Album.ID)}, nil, err
+}
+
+// savedAlbum returns the saved album t is on, or nil if it isn't saved
+func savedAlbum(t spotify.PlaylistTrack, index Library) (*spotify.SavedAlbum, error) {
+	albums, ok := index.(AlbumLibrary)
+	if !ok || t.Track.Album.ID == "" {
+		return nil, nil
+	}
+	return albums.GetSavedAlbum(t.Track.Album.ID)
+}
+
+func matchByID(t spotify.PlaylistTrack, index Library) (bool, string, float64, error) {
+	libraryTrack, err := index.GetByID(t.Track.ID)
+	if err != nil || libraryTrack == nil {
+		return false, "", 0, err
+	}
+	return true, "track ID is saved in library", 1, nil
+}
+
+func matchByISRC(t spotify.PlaylistTrack, index Library) (bool, string, float64, error) {
+	isrc := library.ISRC(t.Track)
+	if isrc == "" {
+		return false, "", 0, nil
+	}
+	matches, err := index.GetByISRC(isrc)
+	if err != nil || len(matches) == 0 {
+		return false, "", 0, err
+	}
+	return true, fmt.Sprintf("ISRC %s matches library track %s", isrc, matches[0].ID), 0.95, nil
+}
+
+// metadataMatcher matches tracks with the same song name, album name, and
+// artist names as a library track, or the same index key if the library is
+// indexed by a configured key. Unless the compilations option is false,
+// compilations are special-cased: when either track is on a compilation the
+// album is ignored and only the primary artist is compared, since compilation
+// album names and "Various Artists" credits rarely line up with the original
+// release.
+type metadataMatcher struct {
+	compilations bool
+	window       releaseWindow
+}
+
+func newMetadataMatcher(opts MatcherOptions) (Matcher, error) {
+	return &metadataMatcher{compilations: opts.Bool("compilations", true), window: newReleaseWindow(opts)}, nil
+}
+
+func (m *metadataMatcher) Match(t spotify.PlaylistTrack, index Library) (bool, string, float64, error) {
+	matches, fields, err := exactMatches(t, index)
+	if err != nil {
+		return false, "", 0, err
+	}
+	for _, c := range matches {
+		// Means we found at least one library track which is a
+		// name-album-artist duplicate
+		if !m.window.suppresses(t.Track, c) {
+			return true, fmt.Sprintf("%s match library track %s", describeKeyFields(fields), c.ID), 0.9, nil
+		}
+	}
+	if !m.compilations {
+		return false, "", 0, nil
+	}
+	primary := library.PrimaryArtist(t.Track.SimpleTrack)
+	if primary == "" {
+		return false, "", 0, nil
+	}
+	candidates, err := index.GetByArtistName(primary)
+	if err != nil {
+		return false, "", 0, err
+	}
+	for _, c := range candidates {
+		if (!library.IsCompilation(t.Track.Album) && !library.IsCompilation(c.Album)) || m.window.suppresses(t.Track, c) {
+			continue
+		}
+		if normalize(index, c.Name) == normalize(index, t.Track.Name) && strings.EqualFold(normalize(index, library.PrimaryArtist(c.SimpleTrack)), normalize(index, primary)) {
+			return true, fmt.Sprintf("compilation track, song and primary artist match library track %s", c.ID), 0.85, nil
+		}
+	}
+	return false, "", 0, nil
+}
+
+func (m *metadataMatcher) Explain(t spotify.PlaylistTrack, index Library) (map[string]string, []*spotify.SavedTrack, error) {
+	artists := library.ArtistNames(t.Track.SimpleTrack)
+	primary := library.PrimaryArtist(t.Track.SimpleTrack)
+	keys := map[string]string{
+		"index":         library.IndexString(normalize(index, t.Track.Name), normalize(index, t.Track.Album.Name), normalizeAll(index, artists)),
+		"primaryArtist": primary,
+	}
+	if k, ok := index.(KeyedLibrary); ok {
+		keys["index"] = k.IndexKey(t.Track)
+	}
+	candidates, _, err := exactMatches(t, index)
+	if err != nil || !m.compilations || primary == "" {
+		return keys, candidates, err
+	}
+	byArtist, err := index.GetByArtistName(primary)
+	if err != nil {
+		return keys, candidates, err
+	}
+	for _, c := range byArtist {
+		if normalize(index, c.Name) == normalize(index, t.Track.Name) && !containsTrack(candidates, c.ID) {
+			candidates = append(candidates, c)
+		}
+	}
+	return keys, candidates, nil
+}
+
+// exactMatches returns the library tracks with the same index key as t, or
+// the same song, album and artist names if the library isn't keyed, along
+// with the fields compared
+func exactMatches(t spotify.PlaylistTrack, index Library) ([]*spotify.SavedTrack, []string, error) {
+	if k, ok := index.(KeyedLibrary); ok {
+		matches, err := k.GetByKey(t.Track)
+		return matches, k.KeyFields(), err
+	}
+	matches, err := index.GetBySongAlbumArtistNames(t.Track.Name, t.Track.Album.Name, library.ArtistNames(t.Track.SimpleTrack))
+	return matches, library.DefaultKeyFields, err
+}
+
+// keyFieldNames are index key fields as described in match reasons
+var keyFieldNames = map[string]string{
+	library.KeyName:     "song",
+	library.KeyAlbum:    "album",
+	library.KeyArtists:  "artists",
+	library.KeyISRC:     "ISRC",
+	library.KeyDuration: "duration",
+}
+
+// describeKeyFields lists index key fields for people, e.g. "song, album and
+// artists"
+func describeKeyFields(fields []string) string {
+	names := []string{}
+	for _, f := range fields {
+		names = append(names, keyFieldNames[f])
+	}
+	if len(names) < 2 {
+		return strings.Join(names, "")
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+}
+
+// releaseWindow suppresses aggressive matches against library tracks released
+// long before the playlist track, e.g. a song saved from its studio album
+// queued again from a new live album, which is usually a deliberate re-listen.
+// Configured by the newerReleaseDays matcher option, disabled if zero.
+type releaseWindow time.Duration
+
+func newReleaseWindow(opts MatcherOptions) releaseWindow {
+	return releaseWindow(opts.Float("newerReleaseDays", 0) * float64(24*time.Hour))
+}
+
+// suppresses returns true if t's album was released more than the window
+// after c's. Tracks without a release date are never suppressed.
+func (w releaseWindow) suppresses(t spotify.FullTrack, c *spotify.SavedTrack) bool {
+	if w <= 0 {
+		return false
+	}
+	released, ok := releaseDate(t.Album)
+	if !ok {
+		return false
+	}
+	matched, ok := releaseDate(c.Album)
+	if !ok {
+		return false
+	}
+	return released.Sub(matched) > time.Duration(w)
+}
+
+// releaseDate parses an album's release date, which is as precise as Spotify
+// knows it: a year, a month or a day
+func releaseDate(a spotify.SimpleAlbum) (time.Time, bool) {
+	for _, layout := range []string{"2006-01-02", "2006-01", "2006"} {
+		if d, err := time.Parse(layout, a.ReleaseDate); err == nil {
+			return d, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// NormalizingLibrary is a Library which normalizes names before indexing and
+// looking them up
+type NormalizingLibrary interface {
+	Library
+	Normalize(name string) string
+}
+
+// KeyedLibrary is a Library which indexes tracks by a configurable composite
+// key, which exact metadata matching looks tracks up by
+type KeyedLibrary interface {
+	Library
+	// GetByKey returns every library track with the same index key as t
+	GetByKey(t spotify.FullTrack) ([]*spotify.SavedTrack, error)
+	// IndexKey returns the key t is indexed under
+	IndexKey(t spotify.FullTrack) string
+	// KeyFields returns the fields the key is made of
+	KeyFields() []string
+}
+
+// normalize normalizes name as index does, if it normalizes names at all
+func normalize(index Library, name string) string {
+	if n, ok := index.(NormalizingLibrary); ok {
+		return n.Normalize(name)
+	}
+	return name
+}
+
+// normalizeAll normalizes each of names as index does
+func normalizeAll(index Library, names []string) []string {
+	normalized := []string{}
+	for _, name := range names {
+		normalized = append(normalized, normalize(index, name))
+	}
+	return normalized
+}
+
+func containsTrack(tracks []*spotify.SavedTrack, id spotify.ID) bool {
+	for _, t := range tracks {
+		if t.ID == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,464 @@
+package dedupe
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"potentials-utils/library"
+	"potentials-utils/spotifyclient"
+	"potentials-utils/spotifytest"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// fakeLibrary is an in-memory Library keyed the same way as the real index
+type fakeLibrary struct {
+	tracks []*spotify.SavedTrack
+}
+
+func (l *fakeLibrary) GetByID(k spotify.ID) (*spotify.SavedTrack, error) {
+	for _, t := range l.tracks {
+		if t.ID == k {
+			return t, nil
+		}
+	}
+	return nil, nil
+}
+
+func (l *fakeLibrary) GetByISRC(isrc string) ([]*spotify.SavedTrack, error) {
+	var matches []*spotify.SavedTrack
+	for _, t := range l.tracks {
+		if t.ExternalIDs["isrc"] == isrc {
+			matches = append(matches, t)
+		}
+	}
+	return matches, nil
+}
+
+func (l *fakeLibrary) GetByArtistName(name string) ([]*spotify.SavedTrack, error) {
+	var matches []*spotify.SavedTrack
+	for _, t := range l.tracks {
+		for _, a := range t.Artists {
+			if strings.EqualFold(a.Name, name) {
+				matches = append(matches, t)
+				break
+			}
+		}
+	}
+	return matches, nil
+}
+
+func (l *fakeLibrary) GetBySongAlbumArtistNames(songName, albumName string, artistNames []string) ([]*spotify.SavedTrack, error) {
+	var matches []*spotify.SavedTrack
+	for _, t := range l.tracks {
+		if t.Name == songName && t.Album.Name == albumName {
+			matches = append(matches, t)
+		}
+	}
+	return matches, nil
+}
+
+func fullTrack(id, isrc, name, album string) spotify.FullTrack {
+	t := spotify.FullTrack{}
+	t.ID = spotify.ID(id)
+	t.Name = name
+	t.Album.Name = album
+	if isrc != "" {
+		t.ExternalIDs = map[string]string{"isrc": isrc}
+	}
+	return t
+}
+
+func TestPipeline(t *testing.T) {
+	lib := &fakeLibrary{tracks: []*spotify.SavedTrack{
+		{FullTrack: fullTrack("1", "USRC1", "Song", "Album")},
+	}}
+	testCases := []struct {
+		name            string
+		matchers        []MatcherConfig
+		track           spotify.FullTrack
+		expectedMatcher string
+	}{
+		{
+			name:            "ID match wins first",
+			matchers:        DuplicatesConfig{Aggressive: true}.MatcherConfigs(),
+			track:           fullTrack("1", "USRC1", "Song", "Album"),
+			expectedMatcher: "id",
+		},
+		{
+			name:     "metadata match ignored when not aggressive",
+			matchers: DuplicatesConfig{}.MatcherConfigs(),
+			track:    fullTrack("2", "", "Song", "Album"),
+		},
+		{
+			name:            "metadata match when aggressive",
+			matchers:        DuplicatesConfig{Aggressive: true}.MatcherConfigs(),
+			track:           fullTrack("2", "", "Song", "Album"),
+			expectedMatcher: "metadata",
+		},
+		{
+			name:            "ISRC match on a different release",
+			matchers:        []MatcherConfig{{Name: "id"}, {Name: "isrc"}},
+			track:           fullTrack("3", "USRC1", "Song (Remastered)", "Best Of"),
+			expectedMatcher: "isrc",
+		},
+		{
+			name:     "no match",
+			matchers: []MatcherConfig{{Name: "id"}, {Name: "isrc"}, {Name: "metadata"}},
+			track:    fullTrack("4", "USRC2", "Other Song", "Album"),
+		},
+	}
+	for _, tc := range testCases {
+		p, err := NewRegistry().Pipeline(tc.matchers)
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		result, err := p.Match(spotify.PlaylistTrack{Track: tc.track}, lib)
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		matcher := ""
+		if result != nil {
+			matcher = result.Matcher
+		}
+		if matcher != tc.expectedMatcher {
+			t.Errorf("%s failed: expected matcher %q, got %q", tc.name, tc.expectedMatcher, matcher)
+		}
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	if _, err := r.Pipeline([]MatcherConfig{{Name: "nope"}}); err == nil {
+		t.Errorf("expected an error building a pipeline with an unknown matcher")
+	}
+	r.Register("always", func(MatcherOptions) (Matcher, error) {
+		return MatcherFunc(func(spotify.PlaylistTrack, Library) (bool, string, float64, error) {
+			return true, "always matches", 0.5, nil
+		}), nil
+	})
+	p, err := r.Pipeline([]MatcherConfig{{Name: "id"}, {Name: "always"}})
+	if err != nil {
+		t.Fatalf("failed to build pipeline with a custom matcher: %v", err)
+	}
+	result, _ := p.Match(spotify.PlaylistTrack{Track: fullTrack("9", "", "x", "y")}, &fakeLibrary{})
+	if result == nil || result.Matcher != "always" || result.Score != 0.5 {
+		t.Errorf("expected custom matcher to match, got %+v", result)
+	}
+}
+
+func TestExprMatcher(t *testing.T) {
+	libTrack := fullTrack("1", "", "Song", "Album")
+	libTrack.Artists = []spotify.SimpleArtist{{Name: "Artist"}}
+	libTrack.Duration = 200000
+	lib := &fakeLibrary{tracks: []*spotify.SavedTrack{{FullTrack: libTrack}}}
+	testCases := []struct {
+		name        string
+		expression  string
+		trackName   string
+		duration    int
+		expectMatch bool
+	}{
+		{
+			name:        "case-insensitive title within duration tolerance",
+			expression:  "track.name.lower() == lib.name.lower() and duration_diff < 3",
+			trackName:   "SONG",
+			duration:    201000,
+			expectMatch: true,
+		},
+		{
+			name:       "outside duration tolerance",
+			expression: "track.name.lower() == lib.name.lower() and duration_diff < 3",
+			trackName:  "song",
+			duration:   260000,
+		},
+		{
+			name:        "artists are exposed as a list",
+			expression:  "'Artist' in lib.artists",
+			trackName:   "Anything",
+			expectMatch: true,
+		},
+	}
+	for _, tc := range testCases {
+		p, err := NewRegistry().Pipeline([]MatcherConfig{{Name: "expr", Options: MatcherOptions{"expression": tc.expression}}})
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		track := fullTrack("2", "", tc.trackName, "Other Album")
+		track.Artists = []spotify.SimpleArtist{{Name: "artist"}}
+		track.Duration = spotify.Numeric(tc.duration)
+		result, err := p.Match(spotify.PlaylistTrack{Track: track}, lib)
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		if (result != nil) != tc.expectMatch {
+			t.Errorf("%s failed: expected match %v, got %+v", tc.name, tc.expectMatch, result)
+		}
+	}
+	if _, err := NewRegistry().Pipeline([]MatcherConfig{{Name: "expr", Options: MatcherOptions{"expression": "track.name =="}}}); err == nil {
+		t.Errorf("expected an invalid expression to fail when building the pipeline")
+	}
+
+	// Several candidates match, the same is reported every time
+	other := fullTrack("0", "", "Other Song", "Album")
+	other.Artists = libTrack.Artists
+	lib.tracks = append(lib.tracks, &spotify.SavedTrack{FullTrack: other})
+	p, err := NewRegistry().Pipeline([]MatcherConfig{{Name: "expr", Options: MatcherOptions{"expression": "'Artist' in lib.artists"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	track := fullTrack("2", "", "Anything", "Other Album")
+	track.Artists = libTrack.Artists
+	for ix := 0; ix < 10; ix++ {
+		result, err := p.Match(spotify.PlaylistTrack{Track: track}, lib)
+		if err != nil || result == nil || !strings.Contains(result.Reason, "library track 0") {
+			t.Fatalf("expected library track 0 matched, got %+v, %v", result, err)
+		}
+	}
+
+	// A runaway expression fails rather than hangs
+	p, err = NewRegistry().Pipeline([]MatcherConfig{{Name: "expr", Options: MatcherOptions{"expression": "len([x for x in range(1000000000)]) > 0"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Match(spotify.PlaylistTrack{Track: track}, lib); err == nil || !strings.Contains(err.Error(), "steps") {
+		t.Errorf("expected the expression to run out of steps, got %v", err)
+	}
+}
+
+func TestMetadataMatcherCompilations(t *testing.T) {
+	original := fullTrack("1", "", "Song", "Album")
+	original.Artists = []spotify.SimpleArtist{{Name: "Artist"}}
+	lib := &fakeLibrary{tracks: []*spotify.SavedTrack{{FullTrack: original}}}
+
+	compilation := fullTrack("2", "", "Song", "Now That's What I Call Music 12")
+	compilation.Artists = []spotify.SimpleArtist{{Name: "Artist"}, {Name: "Featured"}}
+	compilation.Album.AlbumType = "compilation"
+
+	variousArtists := fullTrack("3", "", "Song", "Summer Hits")
+	variousArtists.Artists = []spotify.SimpleArtist{{Name: "Various Artists"}, {Name: "artist"}}
+	variousArtists.Album.Artists = []spotify.SimpleArtist{{Name: "Various Artists"}}
+
+	otherAlbum := fullTrack("4", "", "Song", "Live")
+	otherAlbum.Artists = []spotify.SimpleArtist{{Name: "Artist"}}
+
+	testCases := []struct {
+		name        string
+		options     MatcherOptions
+		track       spotify.FullTrack
+		expectMatch bool
+	}{
+		{
+			name:        "compilation album ignores album and extra artists",
+			track:       compilation,
+			expectMatch: true,
+		},
+		{
+			name:        "various artists credit is skipped for the primary artist",
+			track:       variousArtists,
+			expectMatch: true,
+		},
+		{
+			name:    "compilation handling can be disabled",
+			options: MatcherOptions{"compilations": false},
+			track:   compilation,
+		},
+		{
+			name:  "non-compilation on a different album does not match",
+			track: otherAlbum,
+		},
+	}
+	for _, tc := range testCases {
+		p, err := NewRegistry().Pipeline([]MatcherConfig{{Name: "metadata", Options: tc.options}})
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		result, err := p.Match(spotify.PlaylistTrack{Track: tc.track}, lib)
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		if (result != nil) != tc.expectMatch {
+			t.Errorf("%s failed: expected match %v, got %+v", tc.name, tc.expectMatch, result)
+		}
+	}
+}
+
+func TestNewerReleaseDays(t *testing.T) {
+	original := fullTrack("1", "", "Song", "Album")
+	original.Artists = []spotify.SimpleArtist{{Name: "Artist"}}
+	original.Album.ReleaseDate = "2010-05-01"
+	lib := &fakeLibrary{tracks: []*spotify.SavedTrack{{FullTrack: original}}}
+
+	testCases := []struct {
+		name        string
+		matcher     MatcherConfig
+		releaseDate string
+		expectMatch bool
+	}{
+		{
+			name:        "disabled by default",
+			matcher:     MatcherConfig{Name: "metadata"},
+			releaseDate: "2021",
+			expectMatch: true,
+		},
+		{
+			name:        "newer release suppressed",
+			matcher:     MatcherConfig{Name: "metadata", Options: MatcherOptions{"newerReleaseDays": 365}},
+			releaseDate: "2021-03",
+		},
+		{
+			name:        "release within the window matches",
+			matcher:     MatcherConfig{Name: "metadata", Options: MatcherOptions{"newerReleaseDays": 365}},
+			releaseDate: "2010-12-01",
+			expectMatch: true,
+		},
+		{
+			name:        "unknown release date matches",
+			matcher:     MatcherConfig{Name: "metadata", Options: MatcherOptions{"newerReleaseDays": 365}},
+			expectMatch: true,
+		},
+		{
+			name:        "expr matcher suppressed too",
+			matcher:     MatcherConfig{Name: "expr", Options: MatcherOptions{"expression": "track.name == lib.name", "newerReleaseDays": 365}},
+			releaseDate: "2021-03-01",
+		},
+		{
+			name:        "aggressive config",
+			matcher:     DuplicatesConfig{Aggressive: true, NewerReleaseDays: 365}.MatcherConfigs()[1],
+			releaseDate: "2021",
+		},
+	}
+	for _, tc := range testCases {
+		p, err := NewRegistry().Pipeline([]MatcherConfig{tc.matcher})
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		track := fullTrack("2", "", "Song", "Album")
+		track.Artists = []spotify.SimpleArtist{{Name: "Artist"}}
+		track.Album.ReleaseDate = tc.releaseDate
+		result, err := p.Match(spotify.PlaylistTrack{Track: track}, lib)
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		if (result != nil) != tc.expectMatch {
+			t.Errorf("%s failed: expected match %v, got %+v", tc.name, tc.expectMatch, result)
+		}
+	}
+}
+
+func TestAlbumMatcher(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	saved := spotifytest.Track("s1", "Saved", "Liked Album", "A")
+	onAlbum := spotifytest.Track("s2", "Not Liked", "Liked Album", "A")
+	other := spotifytest.Track("o1", "Other", "Other Album", "A")
+	srv.AddSavedTracks(saved)
+	srv.AddSavedAlbums(saved.Album)
+	dir, err := ioutil.TempDir("", "dedupe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := spotifyclient.New(srv.HTTPClient())
+	cfg := DuplicatesConfig{IncludeSavedAlbums: true}
+	if !cfg.UsesSavedAlbums() || (DuplicatesConfig{}).UsesSavedAlbums() {
+		t.Errorf("expected only includeSavedAlbums to use saved albums")
+	}
+	pipeline, err := NewRegistry().Pipeline(cfg.MatcherConfigs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheCfg := library.CacheConfig{CacheDir: dir, Lifetime: time.Hour, SavedAlbums: true}
+	lib, err := library.NewLibraryService(client, cacheCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A second service reads the saved albums back from the disk cache
+	cached, err := library.NewLibraryService(client, cacheCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	albumRequests := 0
+	for _, r := range srv.Requests() {
+		if strings.HasPrefix(r, "GET /v1/me/albums") {
+			albumRequests++
+		}
+	}
+	if albumRequests != 1 {
+		t.Errorf("expected saved albums fetched once, got %d requests", albumRequests)
+	}
+	testCases := []struct {
+		name    string
+		track   spotify.FullTrack
+		matcher string
+	}{
+		{name: "saved track", track: saved, matcher: "id"},
+		{name: "track on saved album", track: onAlbum, matcher: "album"},
+		{name: "unsaved album", track: other},
+	}
+	for _, index := range []Library{lib, cached} {
+		for _, tc := range testCases {
+			result, err := pipeline.Match(spotify.PlaylistTrack{Track: tc.track}, index)
+			if err != nil {
+				t.Fatalf("%s failed: %v", tc.name, err)
+			}
+			matcher := ""
+			if result != nil {
+				matcher = result.Matcher
+			}
+			if matcher != tc.matcher {
+				t.Errorf("%s failed: expected a match by %q, got %+v", tc.name, tc.matcher, result)
+			}
+		}
+	}
+}
+
+func TestFuzzyMatcher(t *testing.T) {
+	byArtist := func(id, name, artist string, durationMs int) spotify.FullTrack {
+		track := fullTrack(id, "", name, "Album")
+		track.Artists = []spotify.SimpleArtist{{Name: artist}}
+		track.Duration = spotify.Numeric(durationMs)
+		return track
+	}
+	lib := &fakeLibrary{tracks: []*spotify.SavedTrack{
+		{FullTrack: byArtist("lib1", "Don't Look Back in Anger", "Oasis", 289000)},
+		{FullTrack: byArtist("lib2", "Hey", "Pixies", 211000)},
+		{FullTrack: byArtist("lib3", "Colour and the Shape", "Foo Fighters", 200000)},
+	}}
+	testCases := []struct {
+		name     string
+		opts     MatcherOptions
+		track    spotify.FullTrack
+		expected bool
+	}{
+		{name: "remastered reissue", track: byArtist("p1", "Don’t Look Back In Anger - Remastered 2014", "Oasis", 289500), expected: true},
+		{name: "featured artist", track: byArtist("p2", "Dont Look Back in Anger (feat. Someone)", "Oasis", 289000), expected: true},
+		{name: "spelling within distance", track: byArtist("p3", "Color and the Shape", "Foo Fighters", 200000), expected: true},
+		{name: "spelling beyond maxDistance", opts: MatcherOptions{"maxDistance": 0}, track: byArtist("p4", "Color and the Shape", "Foo Fighters", 200000), expected: false},
+		{name: "short names must match exactly", track: byArtist("p5", "Hex", "Pixies", 211000), expected: false},
+		{name: "different artist", track: byArtist("p6", "Don't Look Back in Anger", "Someone Else", 289000), expected: false},
+		{name: "durations too far apart", opts: MatcherOptions{"maxDurationDiff": 5}, track: byArtist("p7", "Don't Look Back in Anger (Live)", "Oasis", 320000), expected: false},
+	}
+	for _, tc := range testCases {
+		m, err := newFuzzyMatcher(tc.opts)
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		matched, reason, score, err := m.Match(spotify.PlaylistTrack{Track: tc.track}, lib)
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		if matched != tc.expected {
+			t.Errorf("%s failed: expected matched %t, got %t (%s)", tc.name, tc.expected, matched, reason)
+		}
+		if matched && (score <= 0 || score > 0.8) {
+			t.Errorf("%s failed: expected a score up to 0.8, got %f", tc.name, score)
+		}
+	}
+	if cfgs := (DuplicatesConfig{Fuzzy: true, FuzzyMaxDistance: 3}).MatcherConfigs(); len(cfgs) != 2 || cfgs[1].Name != "fuzzy" || cfgs[1].Options["maxDistance"] != 3 {
+		t.Errorf("expected fuzzy to add the fuzzy matcher after id, got %v", cfgs)
+	}
+}
@@ -0,0 +1,152 @@
+package dedupe
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// Action is what a clean does with a duplicate track
+type Action string
+
+const (
+	// ActionRemove removes the track from the playlist
+	ActionRemove Action = "remove"
+	// ActionArchive moves the track to the archive playlist
+	ActionArchive Action = "archive"
+	// ActionTag records a local tag against the track and leaves it in place
+	ActionTag Action = "tag"
+	// ActionAsk asks the user whether to remove the track, falling back to
+	// ActionReport when nobody can be asked
+	ActionAsk Action = "ask"
+	// ActionQueue leaves the track in place and queues it for someone to
+	// review later, falling back to ActionReport when there's no queue
+	ActionQueue Action = "queue"
+	// ActionReport reports the track as a duplicate and leaves it in place
+	ActionReport Action = "report"
+	// ActionSkip silently leaves the track in place
+	ActionSkip Action = "skip"
+)
+
+var validActions = map[Action]bool{
+	ActionRemove:  true,
+	ActionArchive: true,
+	ActionTag:     true,
+	ActionAsk:     true,
+	ActionQueue:   true,
+	ActionReport:  true,
+	ActionSkip:    true,
+}
+
+// PolicyRule picks an action for duplicates found by a matcher within a score
+// range
+type PolicyRule struct {
+	// Matcher is the name of the matcher the rule applies to, or empty for
+	// every matcher
+	Matcher string `yaml:"matcher"`
+	// MinScore is the inclusive lower bound on match score
+	MinScore float64 `yaml:"minScore"`
+	// MaxScore is the exclusive upper bound on match score, ignored if zero
+	MaxScore float64 `yaml:"maxScore"`
+	// Labels restricts the rule to tracks released on one of these record
+	// labels, ignoring case
+	Labels []string `yaml:"labels"`
+	Action Action   `yaml:"action"`
+}
+
+func (r PolicyRule) matchesLabel(label string) bool {
+	if len(r.Labels) == 0 {
+		return true
+	}
+	for _, l := range r.Labels {
+		if strings.EqualFold(l, label) {
+			return true
+		}
+	}
+	return false
+}
+
+// PolicyConfig declares how a clean acts on each duplicate
+type PolicyConfig struct {
+	// Rules are evaluated in order, the first matching rule decides the
+	// action
+	Rules []PolicyRule `yaml:"rules"`
+	// Default is the action taken when no rule matches. Defaults to remove.
+	Default Action `yaml:"default"`
+	// ArchivePlaylistID is the playlist archived tracks are moved to
+	ArchivePlaylistID spotify.ID `yaml:"archivePlaylistID"`
+	// Tag is the tag recorded by the tag action. Defaults to "duplicate".
+	Tag string `yaml:"tag"`
+	// QueueBelow queues duplicates scoring below it for review, whatever
+	// the rules say. Ignored if zero.
+	QueueBelow float64 `yaml:"queueBelow"`
+}
+
+// Policy decides the action taken for each duplicate
+type Policy struct {
+	cfg PolicyConfig
+}
+
+// NewPolicy validates cfg and creates a Policy from it
+func NewPolicy(cfg PolicyConfig) (*Policy, error) {
+	if cfg.Default == "" {
+		cfg.Default = ActionRemove
+	}
+	if cfg.Tag == "" {
+		cfg.Tag = "duplicate"
+	}
+	actions := []Action{cfg.Default}
+	for _, r := range cfg.Rules {
+		actions = append(actions, r.Action)
+	}
+	for _, a := range actions {
+		if !validActions[a] {
+			return nil, fmt.Errorf("unknown policy action %q", a)
+		}
+		if a == ActionArchive && cfg.ArchivePlaylistID == "" {
+			return nil, fmt.Errorf("the archive action requires policy.archivePlaylistID")
+		}
+	}
+	return &Policy{cfg: cfg}, nil
+}
+
+// Decide returns the action to take for a duplicate
+func (p *Policy) Decide(d Duplicate) Action {
+	if d.Score < p.cfg.QueueBelow {
+		return ActionQueue
+	}
+	for _, r := range p.cfg.Rules {
+		if r.Matcher != "" && r.Matcher != d.Matcher {
+			continue
+		}
+		if d.Score < r.MinScore || (r.MaxScore != 0 && d.Score >= r.MaxScore) {
+			continue
+		}
+		if !r.matchesLabel(d.Label) {
+			continue
+		}
+		return r.Action
+	}
+	return p.cfg.Default
+}
+
+// UsesLabels returns true if any rule depends on a track's record label
+func (p *Policy) UsesLabels() bool {
+	for _, r := range p.cfg.Rules {
+		if len(r.Labels) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ArchivePlaylistID is the playlist archived tracks are moved to
+func (p *Policy) ArchivePlaylistID() spotify.ID {
+	return p.cfg.ArchivePlaylistID
+}
+
+// Tag is the tag recorded by the tag action
+func (p *Policy) Tag() string {
+	return p.cfg.Tag
+}
@@ -0,0 +1,76 @@
+package dedupe
+
+import (
+	"testing"
+)
+
+func TestPolicyDecide(t *testing.T) {
+	policy, err := NewPolicy(PolicyConfig{
+		Rules: []PolicyRule{
+			{Labels: []string{"Warp Records"}, Action: ActionSkip},
+			{Matcher: "id", Action: ActionRemove},
+			{MinScore: 0.9, Action: ActionArchive},
+			{MinScore: 0.5, MaxScore: 0.9, Action: ActionTag},
+		},
+		Default:           ActionReport,
+		ArchivePlaylistID: "archive",
+	})
+	if err != nil {
+		t.Fatalf("failed to create policy: %v", err)
+	}
+	testCases := []struct {
+		name     string
+		result   MatchResult
+		label    string
+		expected Action
+	}{
+		{
+			name:     "protected labels are skipped",
+			result:   MatchResult{Matcher: "id", Score: 1},
+			label:    "warp records",
+			expected: ActionSkip,
+		},
+		{
+			name:     "ID matches are removed",
+			result:   MatchResult{Matcher: "id", Score: 1},
+			expected: ActionRemove,
+		},
+		{
+			name:     "high confidence fuzzy matches are archived",
+			result:   MatchResult{Matcher: "expr", Score: 0.95},
+			expected: ActionArchive,
+		},
+		{
+			name:     "max score is exclusive",
+			result:   MatchResult{Matcher: "expr", Score: 0.9},
+			expected: ActionArchive,
+		},
+		{
+			name:     "medium confidence matches are tagged",
+			result:   MatchResult{Matcher: "expr", Score: 0.6},
+			expected: ActionTag,
+		},
+		{
+			name:     "low confidence matches fall through to the default",
+			result:   MatchResult{Matcher: "expr", Score: 0.2},
+			expected: ActionReport,
+		},
+	}
+	for _, tc := range testCases {
+		if action := policy.Decide(Duplicate{MatchResult: tc.result, Label: tc.label}); action != tc.expected {
+			t.Errorf("%s failed: expected %s, got %s", tc.name, tc.expected, action)
+		}
+	}
+}
+
+func TestNewPolicyValidation(t *testing.T) {
+	if p, err := NewPolicy(PolicyConfig{}); err != nil || p.Decide(Duplicate{}) != ActionRemove {
+		t.Errorf("expected an empty policy to remove everything, got err %v", err)
+	}
+	if _, err := NewPolicy(PolicyConfig{Default: "explode"}); err == nil {
+		t.Errorf("expected an unknown action to be rejected")
+	}
+	if _, err := NewPolicy(PolicyConfig{Rules: []PolicyRule{{Action: ActionArchive}}}); err == nil {
+		t.Errorf("expected archive without an archive playlist to be rejected")
+	}
+}
@@ -0,0 +1,93 @@
+package dedupe
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"potentials-utils/tracing"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// RepeatMatcher is the matcher of duplicates which repeat a track earlier in
+// the same playlist, rather than one in the library
+const RepeatMatcher = "repeat"
+
+// PositionalPlaylists is a Playlists which can remove particular occurrences
+// of a track from a playlist. Repeats are only reported if the Cleaner's
+// client isn't one.
+type PositionalPlaylists interface {
+	RemoveTracksFromPlaylistOpt(ctx context.Context, playlistID spotify.ID, tracks []spotify.TrackToRemove, snapshotID string) (string, error)
+}
+
+// repeats returns the tracks in page which repeat, by ID or by the library's
+// index key, a track earlier in the playlist. Tracks found duplicated in the
+// library, in duplicates, are left to the policy and never repeated. seen
+// holds the position of the first occurrence of each track in earlier pages,
+// and is updated with those in page.
+func (c *Cleaner) repeats(page *spotify.PlaylistTrackPage, duplicates []Duplicate, seen map[string]int) []Duplicate {
+	inLibrary := map[int]bool{}
+	for _, d := range duplicates {
+		inLibrary[d.Position] = true
+	}
+	keyed, _ := c.library.(KeyedLibrary)
+	repeats := []Duplicate{}
+	for ix, t := range page.Tracks {
+		position := int(page.Offset) + ix
+		if t.IsLocal || t.Track.ID == "" || inLibrary[position] {
+			continue
+		}
+		keys := []string{"id:" + string(t.Track.ID)}
+		if keyed != nil {
+			keys = append(keys, "key:"+keyed.IndexKey(t.Track))
+		}
+		first, repeated := -1, false
+		for _, k := range keys {
+			if first, repeated = seen[k]; repeated {
+				break
+			}
+		}
+		if !repeated {
+			for _, k := range keys {
+				seen[k] = position
+			}
+			continue
+		}
+		reason := fmt.Sprintf("repeats the track at position %d", first)
+		repeats = append(repeats, Duplicate{Track: t, Position: position, MatchResult: MatchResult{Matcher: RepeatMatcher, Reason: reason, Score: 1}})
+	}
+	return repeats
+}
+
+// removeAt removes each duplicate from its position in the version
+// snapshotID of the playlist, the furthest first so removing some never moves
+// the rest, updating snapshotID to the playlist's version after
+func (c *Cleaner) removeAt(ctx context.Context, playlistID spotify.ID, duplicates []Duplicate, snapshotID *string) error {
+	client := c.client.(PositionalPlaylists)
+	duplicates = append([]Duplicate{}, duplicates...)
+	sort.Slice(duplicates, func(i, j int) bool { return duplicates[i].Position > duplicates[j].Position })
+	from := *snapshotID
+	// Can only remove 100 tracks per request.
+	for len(duplicates) > 0 {
+		n := 100
+		if len(duplicates) < n {
+			n = len(duplicates)
+		}
+		tracks := []spotify.TrackToRemove{}
+		for _, d := range duplicates[:n] {
+			tracks = append(tracks, spotify.NewTrackToRemove(string(d.Track.Track.ID), []int{d.Position}))
+		}
+		duplicates = duplicates[n:]
+		_, span := tracing.Start(ctx, "spotify.RemoveTracksFromPlaylistOpt")
+		span.SetAttribute("tracks", len(tracks))
+		snapshot, err := client.RemoveTracksFromPlaylistOpt(ctx, playlistID, tracks, from)
+		span.RecordError(err)
+		span.End()
+		if err != nil {
+			return err
+		}
+		*snapshotID = snapshot
+	}
+	return nil
+}
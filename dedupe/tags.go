@@ -0,0 +1,80 @@
+package dedupe
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// TagStore records local tags against tracks
+type TagStore interface {
+	AddTag(id spotify.ID, tag string) error
+	Tags(id spotify.ID) ([]string, error)
+}
+
+// FileTagStore is a TagStore persisted as a JSON file
+type FileTagStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileTagStore creates a TagStore persisted at path. The file is created on
+// the first write.
+func NewFileTagStore(path string) *FileTagStore {
+	return &FileTagStore{path: path}
+}
+
+// AddTag records tag against the track with the given ID
+func (s *FileTagStore) AddTag(id spotify.ID, tag string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tags, err := s.load()
+	if err != nil {
+		return err
+	}
+	for _, t := range tags[id] {
+		if t == tag {
+			return nil
+		}
+	}
+	tags[id] = append(tags[id], tag)
+	sort.Strings(tags[id])
+	bytes, err := json.MarshalIndent(tags, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path, bytes, 0644)
+}
+
+// Tags returns every tag recorded against the track with the given ID
+func (s *FileTagStore) Tags(id spotify.ID) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tags, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return tags[id], nil
+}
+
+func (s *FileTagStore) load() (map[spotify.ID][]string, error) {
+	tags := map[spotify.ID][]string{}
+	slurp, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return tags, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(slurp, &tags); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
@@ -0,0 +1,123 @@
+// Package demo generates a synthetic library and Potentials playlist seeded
+// with every kind of duplicate potentials-utils detects, so the tool can be
+// tried out without a Spotify account.
+package demo
+
+import (
+	"fmt"
+	"math/rand"
+
+	"potentials-utils/dedupe"
+	"potentials-utils/library"
+	"potentials-utils/spotifytest"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// PlaylistID is the ID of the generated Potentials playlist
+const PlaylistID spotify.ID = "demopotentials"
+
+// Matchers is the pipeline the demo cleans with, enough to find every kind of
+// duplicate Populate plants
+var Matchers = []dedupe.MatcherConfig{{Name: "id"}, {Name: "isrc"}, {Name: "metadata"}}
+
+var (
+	artists = []string{"The Lanterns", "Mira Vale", "Cold Harbour", "Juniper Six", "Dalia Moreno", "Static Orchard"}
+	albums  = []string{
+		"Northern Lights", "Paper Boats", "Glass Houses", "Low Tide", "Neon Weather", "Small Hours",
+		"Open Water", "Quiet Machines", "Blue Hour", "Heatwave", "Second Nature", "Far Fields",
+		"Tin Roof", "Lantern Songs", "Overpass", "Daybreak", "Salt & Stone", "Afterglow",
+	}
+	words = []string{"Midnight", "River", "Echo", "Golden", "Satellite", "Wildfire", "Velvet", "Harbour", "Signal", "Summer", "Ghost", "Avenue"}
+)
+
+// Summary counts the duplicates planted in the generated playlist
+type Summary struct {
+	LibraryTracks  int
+	PlaylistTracks int
+	// SameID are saved tracks added to the playlist again
+	SameID int
+	// Remasters are re-releases of saved tracks sharing their ISRC
+	Remasters int
+	// SameMetadata are saved tracks under a different ID with identical
+	// song, album and artists
+	SameMetadata int
+	// Compilations are saved tracks appearing on a Various Artists
+	// compilation
+	Compilations int
+}
+
+// Populate fills srv with a library and the playlist PlaylistID, generated
+// deterministically from seed
+func Populate(srv *spotifytest.Server, seed int64) Summary {
+	r := rand.New(rand.NewSource(seed))
+	saved := []spotify.FullTrack{}
+	for ax, artist := range artists {
+		for bx := 0; bx < 3; bx++ {
+			album := albums[ax*3+bx]
+			for tx := 0; tx < 8; tx++ {
+				id := fmt.Sprintf("lib%d%d%d", ax, bx, tx)
+				name := words[r.Intn(len(words))] + " " + words[r.Intn(len(words))]
+				t := spotifytest.Track(id, name, album, artist)
+				t.ExternalIDs = map[string]string{"isrc": fmt.Sprintf("DEMO%02d%02d%02d", ax, bx, tx)}
+				t.Duration = spotify.Numeric(150000 + r.Intn(120000))
+				t.Popularity = spotify.Numeric(r.Intn(100))
+				t.Album.ReleaseDate = fmt.Sprintf("20%02d-01-01", 10+bx)
+				saved = append(saved, t)
+			}
+		}
+	}
+	srv.AddSavedTracks(saved...)
+
+	s := Summary{LibraryTracks: len(saved)}
+	playlist := []spotify.FullTrack{}
+	picked := r.Perm(len(saved))
+	next := func() spotify.FullTrack {
+		t := saved[picked[0]]
+		picked = picked[1:]
+		return t
+	}
+	for ix := 0; ix < 8; ix++ {
+		playlist = append(playlist, next())
+		s.SameID++
+	}
+	for ix := 0; ix < 6; ix++ {
+		t := next()
+		t.ID = spotify.ID(fmt.Sprintf("remaster%d", ix))
+		t.Name += " - Remastered"
+		t.Album.Name += " (Deluxe Edition)"
+		playlist = append(playlist, t)
+		s.Remasters++
+	}
+	for ix := 0; ix < 5; ix++ {
+		t := next()
+		t.ID = spotify.ID(fmt.Sprintf("reissue%d", ix))
+		t.ExternalIDs = nil
+		playlist = append(playlist, t)
+		s.SameMetadata++
+	}
+	for ix := 0; ix < 4; ix++ {
+		t := next()
+		t.ID = spotify.ID(fmt.Sprintf("compilation%d", ix))
+		t.ExternalIDs = nil
+		t.Album = spotify.SimpleAlbum{
+			ID:        "democompilation",
+			Name:      "Indie Anthems Vol. 3",
+			AlbumType: "compilation",
+			Artists:   []spotify.SimpleArtist{{Name: library.VariousArtists}},
+		}
+		playlist = append(playlist, t)
+		s.Compilations++
+	}
+	for ix := 0; ix < 37; ix++ {
+		artist := artists[r.Intn(len(artists))]
+		name := words[r.Intn(len(words))] + " " + words[r.Intn(len(words))] + " Part " + fmt.Sprint(ix+2)
+		t := spotifytest.Track(fmt.Sprintf("new%d", ix), name, name+" (Single)", artist)
+		t.Popularity = spotify.Numeric(r.Intn(100))
+		playlist = append(playlist, t)
+	}
+	r.Shuffle(len(playlist), func(i, j int) { playlist[i], playlist[j] = playlist[j], playlist[i] })
+	srv.AddPlaylist(PlaylistID, "Potentials (demo)", playlist...)
+	s.PlaylistTracks = len(playlist)
+	return s
+}
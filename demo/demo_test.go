@@ -0,0 +1,55 @@
+package demo
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"potentials-utils/dedupe"
+	"potentials-utils/library"
+	"potentials-utils/spotifyclient"
+	"potentials-utils/spotifytest"
+)
+
+func TestPopulate(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	planted := Populate(srv, 1)
+	if got := len(srv.PlaylistTrackIDs(PlaylistID)); got != planted.PlaylistTracks {
+		t.Fatalf("playlist has %d tracks, want %d", got, planted.PlaylistTracks)
+	}
+
+	dir, err := ioutil.TempDir("", "demo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := spotifyclient.New(srv.HTTPClient())
+	lib, err := library.NewLibraryService(client, library.CacheConfig{CacheDir: dir, Lifetime: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := dedupe.NewRegistry().Pipeline(Matchers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := dedupe.NewPolicy(dedupe.PolicyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleaner := dedupe.NewCleaner(client, lib, pipeline, policy, nil)
+	cleaner.Out = ioutil.Discard
+	res, err := cleaner.Clean(context.Background(), PlaylistID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := planted.SameID + planted.Remasters + planted.SameMetadata + planted.Compilations
+	if res.Removed != want {
+		t.Errorf("removed %d duplicates, want %d", res.Removed, want)
+	}
+	if got := len(srv.PlaylistTrackIDs(PlaylistID)); got != planted.PlaylistTracks-want {
+		t.Errorf("playlist has %d tracks after cleaning, want %d", got, planted.PlaylistTracks-want)
+	}
+}
@@ -0,0 +1,290 @@
+// Package digest compiles a period of Potentials activity, the tracks added,
+// the duplicates cleaned out of it, which of those were promoted to the
+// library and how the library grew, into a digest written as JSON or HTML
+// and sent to webhooks.
+package digest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"potentials-utils/library"
+	"potentials-utils/throughput"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// defaultDays is how many days a digest covers if not configured
+const defaultDays = 7
+
+// Formats are the formats a digest can be written in
+var Formats = []string{"json", "html"}
+
+// Config configures the digest the server compiles every period
+type Config struct {
+	// Webhooks are each sent a JSON POST of every digest
+	Webhooks []string `yaml:"webhooks"`
+	// Dir, if set, is where every digest is written as JSON and HTML
+	Dir string `yaml:"dir"`
+	// Days is how many days each digest covers, default 7
+	Days int `yaml:"days"`
+}
+
+// Enabled returns true if digests are sent anywhere
+func (c Config) Enabled() bool {
+	return len(c.Webhooks) > 0 || c.Dir != ""
+}
+
+// Period returns how long each digest covers
+func (c Config) Period() time.Duration {
+	days := c.Days
+	if days <= 0 {
+		days = defaultDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// Due returns whether a digest is due at now, given when the last was sent,
+// and when the next should start from. The first digest covers the period
+// before now.
+func (c Config) Due(last, now time.Time) (time.Time, bool) {
+	if last.IsZero() {
+		return now.Add(-c.Period()), true
+	}
+	return last, now.Sub(last) >= c.Period()
+}
+
+// Track is a track in a digest
+type Track struct {
+	ID spotify.ID `json:"id"`
+	// Track describes the track for people
+	Track string    `json:"track"`
+	At    time.Time `json:"at"`
+}
+
+// Digest is what happened in Potentials from From until To
+type Digest struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// Added are the tracks added to Potentials
+	Added []Track `json:"added"`
+	// Promoted are the tracks cleaned out having been saved to the library,
+	// Removed those cleaned out having been heard enough
+	Promoted []Track `json:"promoted"`
+	Removed  []Track `json:"removed"`
+	// Cleaned is how many duplicates were cleaned out, promoted or removed
+	Cleaned int `json:"cleaned"`
+	// LibrarySaved is how many tracks were saved to the library, out of
+	// LibraryTotal now saved, as of when the library was last indexed
+	LibrarySaved int `json:"librarySaved"`
+	LibraryTotal int `json:"libraryTotal"`
+}
+
+// Sources are what a digest is compiled from, all kept on disk so compiling
+// doesn't call Spotify
+type Sources struct {
+	// Events are the tracks which have left Potentials
+	Events []throughput.Event
+	// Pending are the tracks in Potentials when it was last cached
+	Pending []spotify.PlaylistTrack
+	// Library is the last indexed library, nil if it hasn't been indexed
+	Library *library.StoredLibrary
+}
+
+// Compile compiles the digest of sources from from until to
+func Compile(src Sources, from, to time.Time) Digest {
+	d := Digest{From: from, To: to, Added: []Track{}, Promoted: []Track{}, Removed: []Track{}}
+	within := func(t time.Time) bool {
+		return !t.Before(from) && t.Before(to)
+	}
+	added := map[spotify.ID]bool{}
+	for _, t := range src.Pending {
+		at, err := time.Parse(spotify.TimestampLayout, t.AddedAt)
+		if err != nil || !within(at) {
+			continue
+		}
+		added[t.Track.ID] = true
+		d.Added = append(d.Added, Track{ID: t.Track.ID, Track: library.TrackString(t.Track), At: at})
+	}
+	for _, e := range src.Events {
+		if within(e.AddedAt) && !added[e.TrackID] {
+			added[e.TrackID] = true
+			d.Added = append(d.Added, Track{ID: e.TrackID, Track: e.Track, At: e.AddedAt})
+		}
+		if !within(e.RemovedAt) {
+			continue
+		}
+		t := Track{ID: e.TrackID, Track: e.Track, At: e.RemovedAt}
+		if e.Promoted() {
+			d.Promoted = append(d.Promoted, t)
+		} else {
+			d.Removed = append(d.Removed, t)
+		}
+	}
+	d.Cleaned = len(d.Promoted) + len(d.Removed)
+	if src.Library != nil {
+		d.LibraryTotal = len(src.Library.Tracks)
+		for _, t := range src.Library.Tracks {
+			at, err := time.Parse(spotify.TimestampLayout, t.AddedAt)
+			if err == nil && within(at) {
+				d.LibrarySaved++
+			}
+		}
+	}
+	for _, tracks := range [][]Track{d.Added, d.Promoted, d.Removed} {
+		sort.SliceStable(tracks, func(i, j int) bool { return tracks[i].At.Before(tracks[j].At) })
+	}
+	return d
+}
+
+// CheckFormat returns an error unless format is one of Formats
+func CheckFormat(format string) error {
+	for _, f := range Formats {
+		if f == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown digest format %q, expected %s", format, strings.Join(Formats, ", "))
+}
+
+var page = template.Must(template.New("digest").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Potentials digest</title></head>
+<body>
+<h1>Potentials, {{.From.Format "Jan 2"}} to {{.To.Format "Jan 2 2006"}}</h1>
+<p>{{len .Added}} added, {{.Cleaned}} cleaned: {{len .Promoted}} promoted to the library and {{len .Removed}} heard enough.
+{{.LibrarySaved}} tracks saved to the library, {{.LibraryTotal}} in total.</p>
+{{define "tracks"}}<ul>{{range .}}<li>{{.Track}}</li>{{else}}<li>None</li>{{end}}</ul>{{end}}
+<h2>Added</h2>
+{{template "tracks" .Added}}
+<h2>Promoted</h2>
+{{template "tracks" .Promoted}}
+<h2>Heard enough</h2>
+{{template "tracks" .Removed}}
+</body>
+</html>
+`))
+
+// Write writes d to w in format
+func Write(w io.Writer, format string, d Digest) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(d)
+	case "html":
+		return page.Execute(w, d)
+	}
+	return CheckFormat(format)
+}
+
+// Publish writes d to the configured directory and sends it to every
+// configured webhook, returning the first error
+func Publish(cfg Config, d Digest) error {
+	var first error
+	if cfg.Dir != "" {
+		first = writeFiles(cfg.Dir, d)
+	}
+	for _, url := range cfg.Webhooks {
+		if err := send(url, d); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// writeFiles writes d to dir in every format, named by the day it ends
+func writeFiles(dir string, d Digest) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, format := range Formats {
+		buf := &bytes.Buffer{}
+		if err := Write(buf, format, d); err != nil {
+			return err
+		}
+		name := filepath.Join(dir, fmt.Sprintf("digest-%s.%s", d.To.Format("2006-01-02"), format))
+		if err := ioutil.WriteFile(name, buf.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send POSTs d to a webhook
+func send(url string, d Digest) error {
+	body, err := json.Marshal(map[string]interface{}{"event": "digest", "digest": d})
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to send digest to %s: %w", url, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("digest webhook %s responded %s", url, resp.Status)
+	}
+	return nil
+}
+
+// Log records when the last digest was sent, persisted as a JSON file
+type Log struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewLog creates a Log persisted at path. The file is created on the first
+// write.
+func NewLog(path string) *Log {
+	return &Log{path: path}
+}
+
+// sent is what's kept in the log file
+type sent struct {
+	// To is the end of the last digest sent
+	To time.Time `json:"to"`
+}
+
+// LastSent returns the end of the last digest sent, zero if none has been
+func (l *Log) LastSent() (time.Time, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var s sent
+	bytes, err := ioutil.ReadFile(l.path)
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	if err := json.Unmarshal(bytes, &s); err != nil {
+		return time.Time{}, err
+	}
+	return s.To, nil
+}
+
+// Sent records a digest ending at to as sent
+func (l *Log) Sent(to time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bytes, err := json.MarshalIndent(sent{To: to}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(l.path, bytes, 0644)
+}
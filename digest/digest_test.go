@@ -0,0 +1,127 @@
+package digest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"potentials-utils/library"
+	"potentials-utils/listenbrainz"
+	"potentials-utils/spotifytest"
+	"potentials-utils/throughput"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+func TestCompile(t *testing.T) {
+	to := time.Date(2021, 3, 8, 0, 0, 0, 0, time.UTC)
+	from := to.Add(-7 * 24 * time.Hour)
+	inWeek := to.Add(-48 * time.Hour)
+	before := from.Add(-time.Hour)
+	added := func(id, name string, at time.Time) spotify.PlaylistTrack {
+		return spotify.PlaylistTrack{AddedAt: at.Format(spotify.TimestampLayout), Track: spotifytest.Track(id, name, "Album", "Artist")}
+	}
+	saved := func(at time.Time) library.Track {
+		return library.Track{AddedAt: at.Format(spotify.TimestampLayout)}
+	}
+	src := Sources{
+		Events: []throughput.Event{
+			{TrackID: "promoted", Track: "Promoted", AddedAt: before, RemovedAt: inWeek},
+			{TrackID: "heard", Track: "Heard", Matcher: listenbrainz.MatcherName, AddedAt: inWeek, RemovedAt: inWeek.Add(time.Hour)},
+			{TrackID: "old", Track: "Old", AddedAt: before, RemovedAt: before},
+		},
+		Pending: []spotify.PlaylistTrack{added("new", "New", inWeek), added("waiting", "Waiting", before)},
+		Library: &library.StoredLibrary{Tracks: []library.Track{saved(inWeek), saved(before), saved(to)}},
+	}
+
+	d := Compile(src, from, to)
+	if len(d.Added) != 2 || d.Added[0].ID != "new" || d.Added[1].ID != "heard" {
+		t.Errorf("expected new and heard added, got %v", d.Added)
+	}
+	if len(d.Promoted) != 1 || d.Promoted[0].ID != "promoted" {
+		t.Errorf("expected promoted promoted, got %v", d.Promoted)
+	}
+	if len(d.Removed) != 1 || d.Removed[0].ID != "heard" {
+		t.Errorf("expected heard removed, got %v", d.Removed)
+	}
+	if d.Cleaned != 2 {
+		t.Errorf("expected 2 cleaned, got %d", d.Cleaned)
+	}
+	if d.LibrarySaved != 1 || d.LibraryTotal != 3 {
+		t.Errorf("expected 1 of 3 library tracks saved, got %d of %d", d.LibrarySaved, d.LibraryTotal)
+	}
+}
+
+func TestDue(t *testing.T) {
+	now := time.Date(2021, 3, 8, 0, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		name     string
+		cfg      Config
+		last     time.Time
+		from     time.Time
+		expected bool
+	}{
+		{name: "never sent", last: time.Time{}, from: now.Add(-7 * 24 * time.Hour), expected: true},
+		{name: "sent a week ago", last: now.Add(-7 * 24 * time.Hour), from: now.Add(-7 * 24 * time.Hour), expected: true},
+		{name: "sent yesterday", last: now.Add(-24 * time.Hour), from: now.Add(-24 * time.Hour), expected: false},
+		{name: "daily sent yesterday", cfg: Config{Days: 1}, last: now.Add(-24 * time.Hour), from: now.Add(-24 * time.Hour), expected: true},
+	}
+	for _, tc := range testCases {
+		from, due := tc.cfg.Due(tc.last, now)
+		if due != tc.expected {
+			t.Errorf("%s failed: expected due %t, got %t", tc.name, tc.expected, due)
+		}
+		if !from.Equal(tc.from) {
+			t.Errorf("%s failed: expected from %s, got %s", tc.name, tc.from, from)
+		}
+	}
+}
+
+func TestPublish(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var received map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer srv.Close()
+
+	to := time.Date(2021, 3, 8, 0, 0, 0, 0, time.UTC)
+	d := Digest{From: to.Add(-7 * 24 * time.Hour), To: to, Added: []Track{{ID: "t1", Track: "<One>"}}}
+	if err := Publish(Config{Webhooks: []string{srv.URL}, Dir: dir}, d); err != nil {
+		t.Fatal(err)
+	}
+	if received["event"] != "digest" {
+		t.Errorf("expected a digest event, got %v", received)
+	}
+	html, err := ioutil.ReadFile(filepath.Join(dir, "digest-2021-03-08.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(html), "&lt;One&gt;") {
+		t.Errorf("expected the added track escaped in the HTML digest, got %s", html)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "digest-2021-03-08.json")); err != nil {
+		t.Errorf("expected a JSON digest written, got %v", err)
+	}
+
+	sent := NewLog(filepath.Join(dir, "digest.json"))
+	if last, err := sent.LastSent(); err != nil || !last.IsZero() {
+		t.Fatalf("expected nothing sent yet, got %s, %v", last, err)
+	}
+	if err := sent.Sent(to); err != nil {
+		t.Fatal(err)
+	}
+	if last, err := sent.LastSent(); err != nil || !last.Equal(to) {
+		t.Errorf("expected last sent %s, got %s, %v", to, last, err)
+	}
+}
@@ -1,12 +1,14 @@
 module potentials-utils
 
-go 1.15
+go 1.16
 
 require (
 	github.com/apex/log v1.9.0
 	github.com/cheggaaa/pb/v3 v3.0.5
 	github.com/pkg/errors v0.9.1 // indirect
-	github.com/zmb3/spotify v0.0.0-20200525010707-bc712583571e
-	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
+	github.com/zmb3/spotify/v2 v2.4.3
+	go.etcd.io/bbolt v1.3.6
+	go.starlark.net v0.0.0-20230302034142-4b1e35fe2254
+	golang.org/x/oauth2 v0.0.0-20210810183815-faf39c7919d5
 	gopkg.in/yaml.v2 v2.3.0
 )
@@ -0,0 +1,338 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Status is the lifecycle state of a Job
+type Status string
+
+const (
+	StatusQueued    Status = "queued"
+	StatusRunning   Status = "running"
+	StatusSucceeded Status = "succeeded"
+	StatusFailed    Status = "failed"
+	StatusCancelled Status = "cancelled"
+)
+
+var (
+	// ErrJobNotFound is returned when a job ID is not known to the queue
+	ErrJobNotFound = errors.New("job not found")
+	// ErrJobFinished is returned when cancelling a job that has already
+	// finished
+	ErrJobFinished = errors.New("job already finished")
+)
+
+// Func is the unit of work run by a Job. Implementations should return
+// promptly once ctx is cancelled.
+type Func func(ctx context.Context) (interface{}, error)
+
+// Job is a snapshot of a unit of work submitted to a Queue
+type Job struct {
+	ID         string      `json:"id"`
+	Kind       string      `json:"kind"`
+	Key        string      `json:"key,omitempty"`
+	Status     Status      `json:"status"`
+	CreatedAt  time.Time   `json:"createdAt"`
+	StartedAt  time.Time   `json:"startedAt,omitempty"`
+	FinishedAt time.Time   `json:"finishedAt,omitempty"`
+	Result     interface{} `json:"result,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// Done returns true if the job has reached a terminal state
+func (j Job) Done() bool {
+	return j.Status == StatusSucceeded || j.Status == StatusFailed || j.Status == StatusCancelled
+}
+
+// Stats summarizes the current depth and history of a Queue
+type Stats struct {
+	MaxConcurrent int `json:"maxConcurrent"`
+	Queued        int `json:"queued"`
+	Running       int `json:"running"`
+	Succeeded     int `json:"succeeded"`
+	Failed        int `json:"failed"`
+	Cancelled     int `json:"cancelled"`
+}
+
+// Finished jobs are kept for DefaultRetention, and at most DefaultMaxFinished
+// of them, unless the Queue says otherwise
+const (
+	DefaultRetention   = 24 * time.Hour
+	DefaultMaxFinished = 500
+)
+
+type jobIDKey struct{}
+
+// IDFromContext returns the ID of the job whose Func was passed ctx, or the
+// empty string if ctx doesn't belong to a job
+func IDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(jobIDKey{}).(string)
+	return id
+}
+
+type entry struct {
+	job    Job
+	fn     Func
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Queue runs submitted jobs in-process with a bounded number of concurrent
+// jobs. Jobs sharing a non-empty key are serialized: at most one job per key
+// runs at a time, in submission order.
+type Queue struct {
+	// Retention is how long finished jobs are kept after they finish,
+	// forever if 0
+	Retention time.Duration
+	// MaxFinished is how many finished jobs are kept, the most recently
+	// finished, unlimited if 0
+	MaxFinished int
+
+	now           func() time.Time
+	mu            sync.Mutex
+	maxConcurrent int
+	entries       map[string]*entry
+	pending       []*entry
+	runningKeys   map[string]bool
+	running       int
+	finished      map[Status]int
+	wg            sync.WaitGroup
+	// listeners are told about every job which finishes
+	listeners []func(Job)
+}
+
+// NewQueue creates a Queue which runs at most maxConcurrent jobs at once. A
+// maxConcurrent less than 1 is treated as 1.
+func NewQueue(maxConcurrent int) *Queue {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	return &Queue{
+		Retention:     DefaultRetention,
+		MaxFinished:   DefaultMaxFinished,
+		now:           time.Now,
+		maxConcurrent: maxConcurrent,
+		entries:       map[string]*entry{},
+		runningKeys:   map[string]bool{},
+		finished:      map[Status]int{},
+	}
+}
+
+// Submit enqueues fn as a new job of the given kind. Jobs with the same key
+// will never run concurrently with each other.
+func (q *Queue) Submit(kind, key string, fn Func) Job {
+	id := newJobID()
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), jobIDKey{}, id))
+	e := &entry{
+		job: Job{
+			ID:        id,
+			Kind:      kind,
+			Key:       key,
+			Status:    StatusQueued,
+			CreatedAt: q.now(),
+		},
+		fn:     fn,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pruneLocked()
+	q.entries[e.job.ID] = e
+	q.pending = append(q.pending, e)
+	q.dispatchLocked()
+	return e.job
+}
+
+// Get returns a snapshot of the job with the given ID
+func (q *Queue) Get(id string) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pruneLocked()
+	e, ok := q.entries[id]
+	if !ok {
+		return Job{}, ErrJobNotFound
+	}
+	return e.job, nil
+}
+
+// List returns a snapshot of every job known to the queue, oldest first
+func (q *Queue) List() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pruneLocked()
+	jobs := make([]Job, 0, len(q.entries))
+	for _, e := range q.entries {
+		jobs = append(jobs, e.job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+	})
+	return jobs
+}
+
+// Cancel cancels a queued or running job. Queued jobs are cancelled
+// immediately, running jobs have their context cancelled and are marked
+// cancelled once their Func returns.
+func (q *Queue) Cancel(id string) (Job, error) {
+	job, finished, err := q.cancel(id)
+	if finished {
+		q.finish(job)
+	}
+	return job, err
+}
+
+// cancel cancels a job, returning true if it finished straight away
+func (q *Queue) cancel(id string) (Job, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e, ok := q.entries[id]
+	if !ok {
+		return Job{}, false, ErrJobNotFound
+	}
+	switch e.job.Status {
+	case StatusQueued:
+		for ix, p := range q.pending {
+			if p == e {
+				q.pending = append(q.pending[:ix], q.pending[ix+1:]...)
+				break
+			}
+		}
+		e.cancel()
+		e.job.Status = StatusCancelled
+		e.job.FinishedAt = q.now()
+		q.finished[StatusCancelled]++
+		return e.job, true, nil
+	case StatusRunning:
+		e.cancel()
+	default:
+		return e.job, false, ErrJobFinished
+	}
+	return e.job, false, nil
+}
+
+// OnFinish has fn called with every job once it has finished, whether it
+// succeeded, failed or was cancelled, from the goroutine which finished it
+func (q *Queue) OnFinish(fn func(Job)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.listeners = append(q.listeners, fn)
+}
+
+// finish tells the listeners job has finished
+func (q *Queue) finish(job Job) {
+	q.mu.Lock()
+	listeners := q.listeners
+	q.mu.Unlock()
+	for _, fn := range listeners {
+		fn(job)
+	}
+}
+
+// Stats returns the current queue depth and job counts
+func (q *Queue) Stats() Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return Stats{
+		MaxConcurrent: q.maxConcurrent,
+		Queued:        len(q.pending),
+		Running:       q.running,
+		Succeeded:     q.finished[StatusSucceeded],
+		Failed:        q.finished[StatusFailed],
+		Cancelled:     q.finished[StatusCancelled],
+	}
+}
+
+// Wait blocks until every job submitted so far has finished
+func (q *Queue) Wait() {
+	q.wg.Wait()
+}
+
+// dispatchLocked starts as many pending jobs as the concurrency limit and key
+// serialization allow. q.mu must be held.
+func (q *Queue) dispatchLocked() {
+	remaining := q.pending[:0]
+	for _, e := range q.pending {
+		if q.running >= q.maxConcurrent || (e.job.Key != "" && q.runningKeys[e.job.Key]) {
+			remaining = append(remaining, e)
+			continue
+		}
+		q.startLocked(e)
+	}
+	q.pending = remaining
+}
+
+func (q *Queue) startLocked(e *entry) {
+	q.running++
+	if e.job.Key != "" {
+		q.runningKeys[e.job.Key] = true
+	}
+	e.job.Status = StatusRunning
+	e.job.StartedAt = q.now()
+	q.wg.Add(1)
+	go q.run(e)
+}
+
+func (q *Queue) run(e *entry) {
+	defer q.wg.Done()
+	result, err := e.fn(e.ctx)
+
+	q.mu.Lock()
+	e.job.FinishedAt = q.now()
+	e.job.Result = result
+	switch {
+	case e.ctx.Err() != nil:
+		e.job.Status = StatusCancelled
+	case err != nil:
+		e.job.Status = StatusFailed
+	default:
+		e.job.Status = StatusSucceeded
+	}
+	if err != nil {
+		e.job.Error = err.Error()
+	}
+	e.cancel()
+	q.finished[e.job.Status]++
+	q.running--
+	delete(q.runningKeys, e.job.Key)
+	q.dispatchLocked()
+	job := e.job
+	q.mu.Unlock()
+	q.finish(job)
+}
+
+// pruneLocked forgets finished jobs which finished longer than Retention ago,
+// and the oldest beyond MaxFinished. q.mu must be held.
+func (q *Queue) pruneLocked() {
+	finished := []*entry{}
+	for id, e := range q.entries {
+		if !e.job.Done() {
+			continue
+		}
+		if q.Retention > 0 && q.now().Sub(e.job.FinishedAt) > q.Retention {
+			delete(q.entries, id)
+			continue
+		}
+		finished = append(finished, e)
+	}
+	if q.MaxFinished <= 0 || len(finished) <= q.MaxFinished {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].job.FinishedAt.Before(finished[j].job.FinishedAt)
+	})
+	for _, e := range finished[:len(finished)-q.MaxFinished] {
+		delete(q.entries, e.job.ID)
+	}
+}
+
+func newJobID() string {
+	return fmt.Sprintf("%x-%04x", time.Now().UnixNano(), rand.Intn(1<<16))
+}
@@ -0,0 +1,187 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimit(t *testing.T) {
+	testCases := []struct {
+		name          string
+		maxConcurrent int
+		keys          []string
+		expectedPeak  int
+	}{
+		{
+			name:          "single worker runs one job at a time",
+			maxConcurrent: 1,
+			keys:          []string{"a", "b", "c"},
+			expectedPeak:  1,
+		},
+		{
+			name:          "distinct keys run concurrently up to the limit",
+			maxConcurrent: 2,
+			keys:          []string{"a", "b", "c", "d"},
+			expectedPeak:  2,
+		},
+		{
+			name:          "same key is serialized regardless of limit",
+			maxConcurrent: 4,
+			keys:          []string{"a", "a", "a"},
+			expectedPeak:  1,
+		},
+	}
+	for _, tc := range testCases {
+		q := NewQueue(tc.maxConcurrent)
+		var mu sync.Mutex
+		current, peak := 0, 0
+		for _, k := range tc.keys {
+			q.Submit("test", k, func(ctx context.Context) (interface{}, error) {
+				mu.Lock()
+				current++
+				if current > peak {
+					peak = current
+				}
+				mu.Unlock()
+				time.Sleep(10 * time.Millisecond)
+				mu.Lock()
+				current--
+				mu.Unlock()
+				return nil, nil
+			})
+		}
+		q.Wait()
+		if peak != tc.expectedPeak {
+			t.Errorf("%s failed: expected peak concurrency %d, got %d", tc.name, tc.expectedPeak, peak)
+		}
+		if s := q.Stats(); s.Succeeded != len(tc.keys) {
+			t.Errorf("%s failed: expected %d succeeded jobs, got %d", tc.name, len(tc.keys), s.Succeeded)
+		}
+	}
+}
+
+func TestCancel(t *testing.T) {
+	q := NewQueue(1)
+	started := make(chan bool)
+	running := q.Submit("test", "a", func(ctx context.Context) (interface{}, error) {
+		started <- true
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	queued := q.Submit("test", "a", func(ctx context.Context) (interface{}, error) {
+		t.Error("cancelled queued job should never run")
+		return nil, nil
+	})
+	<-started
+
+	if job, err := q.Cancel(queued.ID); err != nil || job.Status != StatusCancelled {
+		t.Errorf("expected queued job to be cancelled, got status %s, err %v", job.Status, err)
+	}
+	if _, err := q.Cancel(running.ID); err != nil {
+		t.Errorf("expected running job to be cancellable, got %v", err)
+	}
+	q.Wait()
+	if job, _ := q.Get(running.ID); job.Status != StatusCancelled {
+		t.Errorf("expected running job to finish cancelled, got %s", job.Status)
+	}
+	if _, err := q.Cancel(running.ID); !errors.Is(err, ErrJobFinished) {
+		t.Errorf("expected ErrJobFinished cancelling a finished job, got %v", err)
+	}
+	if _, err := q.Cancel("nope"); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("expected ErrJobNotFound, got %v", err)
+	}
+}
+
+func TestOnFinish(t *testing.T) {
+	q := NewQueue(1)
+	var mu sync.Mutex
+	finished := map[string]Status{}
+	q.OnFinish(func(j Job) {
+		mu.Lock()
+		defer mu.Unlock()
+		finished[j.ID] = j.Status
+	})
+	started, release := make(chan bool), make(chan bool)
+	ok := q.Submit("test", "a", func(ctx context.Context) (interface{}, error) {
+		started <- true
+		<-release
+		return nil, nil
+	})
+	queued := q.Submit("test", "a", func(ctx context.Context) (interface{}, error) {
+		return nil, nil
+	})
+	<-started
+	q.Cancel(queued.ID)
+	failed := q.Submit("test", "b", func(ctx context.Context) (interface{}, error) {
+		return nil, errors.New("boom")
+	})
+	close(release)
+	q.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := map[string]Status{ok.ID: StatusSucceeded, queued.ID: StatusCancelled, failed.ID: StatusFailed}
+	for id, status := range expected {
+		if finished[id] != status {
+			t.Errorf("expected job %s to finish %s, got %q", id, status, finished[id])
+		}
+	}
+}
+
+func TestRetention(t *testing.T) {
+	testCases := []struct {
+		name        string
+		retention   time.Duration
+		maxFinished int
+		// advance is how long after the jobs finish they're listed
+		advance  time.Duration
+		expected []string
+	}{
+		{name: "kept within retention", retention: time.Hour, advance: 30 * time.Minute, expected: []string{"a", "b", "c"}},
+		{name: "expired", retention: time.Hour, advance: 2 * time.Hour, expected: []string{}},
+		{name: "oldest beyond the maximum", maxFinished: 2, advance: 2 * time.Hour, expected: []string{"b", "c"}},
+	}
+	for _, tc := range testCases {
+		var mu sync.Mutex
+		clock := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+		q := NewQueue(1)
+		q.Retention, q.MaxFinished = tc.retention, tc.maxFinished
+		q.now = func() time.Time {
+			mu.Lock()
+			defer mu.Unlock()
+			clock = clock.Add(time.Second)
+			return clock
+		}
+		ids := map[string]string{}
+		for _, k := range []string{"a", "b", "c"} {
+			job := q.Submit("test", k, func(ctx context.Context) (interface{}, error) { return nil, nil })
+			ids[job.ID] = k
+			q.Wait()
+		}
+		mu.Lock()
+		clock = clock.Add(tc.advance)
+		mu.Unlock()
+
+		got := []string{}
+		for _, job := range q.List() {
+			got = append(got, ids[job.ID])
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s failed: expected jobs %v listed, got %v", tc.name, tc.expected, got)
+		}
+		for id, k := range ids {
+			_, err := q.Get(id)
+			kept := false
+			for _, e := range tc.expected {
+				kept = kept || e == k
+			}
+			if kept != (err == nil) {
+				t.Errorf("%s failed: expected job %s kept %v, got %v", tc.name, k, kept, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,241 @@
+// Package journal records every track cleans remove from playlists, where it
+// was and which clean removed it, so the removals of recent cleans can be
+// undone.
+package journal
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"potentials-utils/dedupe"
+	"potentials-utils/library"
+
+	"github.com/apex/log"
+	"github.com/zmb3/spotify/v2"
+)
+
+// API is the view of the Spotify API needed to put removed tracks back
+type API interface {
+	GetPlaylist(ctx context.Context, playlistID spotify.ID) (*spotify.FullPlaylist, error)
+	AddTracksToPlaylist(ctx context.Context, playlistID spotify.ID, trackIDs ...spotify.ID) (string, error)
+	InsertTracksIntoPlaylist(ctx context.Context, playlistID spotify.ID, position int, trackIDs ...spotify.ID) (string, error)
+}
+
+// Entry records a track removed from a playlist by a clean
+type Entry struct {
+	// Run identifies the clean which removed the track
+	Run        string     `json:"run"`
+	PlaylistID spotify.ID `json:"playlistID"`
+	TrackID    spotify.ID `json:"trackID"`
+	// Track describes the track for people
+	Track string `json:"track"`
+	// Position is where the track was in the playlist
+	Position int `json:"position"`
+	// SnapshotID is the version of the playlist the track was removed from
+	SnapshotID string    `json:"snapshotID"`
+	RemovedAt  time.Time `json:"removedAt"`
+	// RestoredAt is when the track was put back, nil until it is
+	RestoredAt *time.Time `json:"restoredAt,omitempty"`
+}
+
+// Journal is a dedupe.RemovalJournal persisted as a JSON file
+type Journal struct {
+	// DryRun reports what Restore would do without doing it
+	DryRun bool
+
+	path string
+	mu   sync.Mutex
+	now  func() time.Time
+}
+
+var _ dedupe.RemovalJournal = (*Journal)(nil)
+
+// New creates a Journal persisted at path. The file is created on the first
+// removal.
+func New(path string) *Journal {
+	return &Journal{path: path, now: time.Now}
+}
+
+// Removed records the duplicates a clean removed from the playlist, as they
+// were in the version snapshotID
+func (j *Journal) Removed(ctx context.Context, playlistID spotify.ID, snapshotID string, removed []dedupe.Duplicate) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entries, err := j.load()
+	if err != nil {
+		return err
+	}
+	now := j.now()
+	run := now.UTC().Format("20060102T150405.000Z")
+	for _, d := range removed {
+		entries = append(entries, Entry{
+			Run:        run,
+			PlaylistID: playlistID,
+			TrackID:    d.Track.Track.ID,
+			Track:      library.TrackString(d.Track.Track),
+			Position:   d.Position,
+			SnapshotID: snapshotID,
+			RemovedAt:  now,
+		})
+	}
+	return j.save(entries)
+}
+
+// Entries returns every removal recorded, oldest first
+func (j *Journal) Entries() ([]Entry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.load()
+}
+
+// Runs returns the cleans removals were recorded for, oldest first
+func (j *Journal) Runs() ([]string, error) {
+	entries, err := j.Entries()
+	if err != nil {
+		return nil, err
+	}
+	return runs(entries), nil
+}
+
+// runs returns the distinct runs of entries in the order they first appear
+func runs(entries []Entry) []string {
+	seen := map[string]bool{}
+	runs := []string{}
+	for _, e := range entries {
+		if !seen[e.Run] {
+			seen[e.Run] = true
+			runs = append(runs, e.Run)
+		}
+	}
+	return runs
+}
+
+// Restore puts back the tracks removed by the last n cleans which haven't
+// been restored already, at the positions they were removed from. The most
+// recent clean is undone first, so if the playlists haven't changed since,
+// every track lands where it was. Returns the entries restored, or which
+// would be on a dry run.
+func (j *Journal) Restore(ctx context.Context, client API, n int) ([]Entry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entries, err := j.load()
+	if err != nil {
+		return nil, err
+	}
+	all := runs(entries)
+	if n < len(all) {
+		all = all[len(all)-n:]
+	}
+	restored := []Entry{}
+	for ix := len(all) - 1; ix >= 0; ix-- {
+		pending := []int{}
+		for i := range entries {
+			if entries[i].Run == all[ix] && entries[i].RestoredAt == nil {
+				pending = append(pending, i)
+			}
+		}
+		if len(pending) == 0 {
+			continue
+		}
+		if !j.DryRun {
+			if err := insert(ctx, client, entries, pending); err != nil {
+				return restored, err
+			}
+			now := j.now()
+			for _, i := range pending {
+				entries[i].RestoredAt = &now
+			}
+			if err := j.save(entries); err != nil {
+				return restored, err
+			}
+		}
+		for _, i := range pending {
+			restored = append(restored, entries[i])
+		}
+		log.FromContext(ctx).WithFields(log.Fields{"run": all[ix], "tracks": len(pending), "dryRun": j.DryRun}).Info("restored removed tracks")
+	}
+	return restored, nil
+}
+
+// insert puts the entries at indexes pending, all removed by one clean, back
+// in their playlists in order of position, so they land where they were if
+// the playlist hasn't changed since. Runs of adjacent positions are inserted
+// in one request, and positions past the end of the playlist are appended.
+func insert(ctx context.Context, client API, entries []Entry, pending []int) error {
+	byPlaylist := map[spotify.ID][]Entry{}
+	order := []spotify.ID{}
+	for _, i := range pending {
+		id := entries[i].PlaylistID
+		if _, ok := byPlaylist[id]; !ok {
+			order = append(order, id)
+		}
+		byPlaylist[id] = append(byPlaylist[id], entries[i])
+	}
+	for _, playlistID := range order {
+		playlist, err := client.GetPlaylist(ctx, playlistID)
+		if err != nil {
+			return err
+		}
+		length := int(playlist.Tracks.Total)
+		positioned := byPlaylist[playlistID]
+		sort.SliceStable(positioned, func(a, b int) bool { return positioned[a].Position < positioned[b].Position })
+		for len(positioned) > 0 {
+			start := positioned[0].Position
+			if start > length {
+				ids := []spotify.ID{}
+				for _, e := range positioned {
+					ids = append(ids, e.TrackID)
+				}
+				for len(ids) > 0 {
+					var chunk []spotify.ID
+					chunk, ids = dedupe.FirstNIDs(ids, 100)
+					if _, err := client.AddTracksToPlaylist(ctx, playlistID, chunk...); err != nil {
+						return err
+					}
+				}
+				break
+			}
+			run := []spotify.ID{positioned[0].TrackID}
+			for len(run) < len(positioned) && len(run) < 100 && positioned[len(run)].Position == start+len(run) {
+				run = append(run, positioned[len(run)].TrackID)
+			}
+			positioned = positioned[len(run):]
+			if _, err := client.InsertTracksIntoPlaylist(ctx, playlistID, start, run...); err != nil {
+				return err
+			}
+			length += len(run)
+		}
+	}
+	return nil
+}
+
+func (j *Journal) load() ([]Entry, error) {
+	entries := []Entry{}
+	slurp, err := ioutil.ReadFile(j.path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(slurp, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (j *Journal) save(entries []Entry) error {
+	bytes, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(j.path, bytes, 0644)
+}
@@ -0,0 +1,116 @@
+package journal
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"potentials-utils/dedupe"
+	"potentials-utils/spotifyclient"
+	"potentials-utils/spotifytest"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+func TestRestore(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	tracks := []spotify.FullTrack{}
+	for ix := 0; ix < 10; ix++ {
+		tracks = append(tracks, spotifytest.Track(fmt.Sprintf("t%d", ix), fmt.Sprintf("Song %d", ix), "Album", "Artist"))
+	}
+	srv.AddPlaylist("potentials", "Potentials", tracks...)
+	original := srv.PlaylistTrackIDs("potentials")
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := spotifyclient.New(srv.HTTPClient())
+	j := New(dir + "/removals.json")
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	j.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	// remove takes the tracks at positions out of the playlist as a clean
+	// would, journalling them
+	remove := func(positions ...int) {
+		ids := srv.PlaylistTrackIDs("potentials")
+		duplicates := []dedupe.Duplicate{}
+		removed := []spotify.ID{}
+		for _, pos := range positions {
+			duplicates = append(duplicates, dedupe.Duplicate{Track: spotify.PlaylistTrack{Track: tracks[indexOf(original, ids[pos])]}, Position: pos})
+			removed = append(removed, ids[pos])
+		}
+		if _, err := client.RemoveTracksFromPlaylist(ctx, "potentials", removed...); err != nil {
+			t.Fatal(err)
+		}
+		if err := j.Removed(ctx, "potentials", "snapshot", duplicates); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(time.Hour)
+	}
+	remove(2, 3)
+	remove(5)
+	if runs, err := j.Runs(); err != nil || len(runs) != 2 {
+		t.Fatalf("expected 2 runs journalled, got %v %v", runs, err)
+	}
+	removed := srv.PlaylistTrackIDs("potentials")
+
+	restoredIDs := func(entries []Entry) []spotify.ID {
+		ids := []spotify.ID{}
+		for _, e := range entries {
+			ids = append(ids, e.TrackID)
+		}
+		return ids
+	}
+
+	j.DryRun = true
+	restored, err := j.Restore(ctx, client, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := restoredIDs(restored); !reflect.DeepEqual(got, []spotify.ID{"t7", "t2", "t3"}) {
+		t.Errorf("expected a dry run to report t7, t2 and t3, got %v", got)
+	}
+	if got := srv.PlaylistTrackIDs("potentials"); !reflect.DeepEqual(got, removed) {
+		t.Errorf("expected a dry run to leave the playlist alone, got %v", got)
+	}
+	j.DryRun = false
+
+	testCases := []struct {
+		name     string
+		runs     int
+		restored []spotify.ID
+		expected []spotify.ID
+	}{
+		{name: "last run", runs: 1, restored: []spotify.ID{"t7"}, expected: []spotify.ID{"t0", "t1", "t4", "t5", "t6", "t7", "t8", "t9"}},
+		{name: "last two runs", runs: 2, restored: []spotify.ID{"t2", "t3"}, expected: original},
+		{name: "already restored", runs: 2, restored: []spotify.ID{}, expected: original},
+	}
+	for _, tc := range testCases {
+		restored, err := j.Restore(ctx, client, tc.runs)
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		if got := restoredIDs(restored); !reflect.DeepEqual(got, tc.restored) {
+			t.Errorf("%s failed: expected %v restored, got %v", tc.name, tc.restored, got)
+		}
+		if got := srv.PlaylistTrackIDs("potentials"); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s failed: expected the playlist to be %v, got %v", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func indexOf(ids []spotify.ID, id spotify.ID) int {
+	for ix, i := range ids {
+		if i == id {
+			return ix
+		}
+	}
+	return -1
+}
@@ -0,0 +1,143 @@
+// Package journald implements an apex/log handler which writes entries to the
+// systemd journal using its native protocol, preserving log levels as journal
+// priorities and log fields as structured journal fields.
+package journald
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/apex/log"
+)
+
+// SocketPath is where journald listens for native protocol datagrams
+const SocketPath = "/run/systemd/journal/socket"
+
+// syslog priorities, see syslog(3)
+const (
+	priCrit    = 2
+	priErr     = 3
+	priWarning = 4
+	priInfo    = 6
+	priDebug   = 7
+)
+
+var priorities = map[log.Level]int{
+	log.DebugLevel: priDebug,
+	log.InfoLevel:  priInfo,
+	log.WarnLevel:  priWarning,
+	log.ErrorLevel: priErr,
+	log.FatalLevel: priCrit,
+}
+
+// Handler sends log entries to the systemd journal
+type Handler struct {
+	identifier string
+	mu         sync.Mutex
+	conn       *net.UnixConn
+	addr       *net.UnixAddr
+}
+
+// New creates a Handler which tags entries with the given syslog identifier
+// and sends them to the journal socket at SocketPath.
+func New(identifier string) (*Handler, error) {
+	return NewWithSocket(identifier, SocketPath)
+}
+
+// NewWithSocket creates a Handler which sends entries to the journal socket
+// at socketPath.
+func NewWithSocket(identifier, socketPath string) (*Handler, error) {
+	if identifier == "" {
+		identifier = filepath.Base(os.Args[0])
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	h := &Handler{
+		identifier: identifier,
+		conn:       conn,
+		addr:       &net.UnixAddr{Name: socketPath, Net: "unixgram"},
+	}
+	return h, nil
+}
+
+// Available returns true if there is a journal socket at SocketPath, i.e. if
+// the process is likely running under systemd
+func Available() bool {
+	_, err := os.Stat(SocketPath)
+	return err == nil
+}
+
+// HandleLog implements log.Handler
+func (h *Handler) HandleLog(e *log.Entry) error {
+	msg := h.encode(e)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.conn.WriteToUnix(msg, h.addr)
+	return err
+}
+
+// Close closes the connection to the journal
+func (h *Handler) Close() error {
+	return h.conn.Close()
+}
+
+// encode serializes an entry in the journal native protocol, see
+// https://systemd.io/JOURNAL_NATIVE_PROTOCOL/
+func (h *Handler) encode(e *log.Entry) []byte {
+	buf := &bytes.Buffer{}
+	priority, ok := priorities[e.Level]
+	if !ok {
+		priority = priInfo
+	}
+	writeField(buf, "MESSAGE", e.Message)
+	writeField(buf, "PRIORITY", fmt.Sprint(priority))
+	writeField(buf, "SYSLOG_IDENTIFIER", h.identifier)
+	names := e.Fields.Names()
+	sort.Strings(names)
+	for _, name := range names {
+		writeField(buf, fieldName(name), fmt.Sprint(e.Fields.Get(name)))
+	}
+	return buf.Bytes()
+}
+
+// writeField writes a single KEY=value field, using the length-prefixed form
+// for values containing newlines
+func writeField(buf *bytes.Buffer, key, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", key, value)
+		return
+	}
+	buf.WriteString(key)
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// fieldName converts a log field name into a valid journal field name:
+// uppercase ASCII letters, digits, and underscores, not starting with an
+// underscore or digit.
+func fieldName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(name) {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	field := strings.TrimLeft(b.String(), "_0123456789")
+	if field == "" {
+		field = "FIELD"
+	}
+	return field
+}
@@ -0,0 +1,70 @@
+package journald
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/apex/log"
+)
+
+func TestHandleLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journald")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "socket")
+	journal, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("unix datagram sockets unavailable: %v", err)
+	}
+	defer journal.Close()
+
+	h, err := NewWithSocket("potentials-utils", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	logger := &log.Logger{Handler: h, Level: log.DebugLevel}
+	logger.WithFields(log.Fields{"numRemoved": 3, "err": "line one\nline two"}).Warn("cleaned")
+
+	buf := make([]byte, 4096)
+	n, err := journal.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(buf[:n])
+	for _, expected := range []string{
+		"MESSAGE=cleaned\n",
+		"PRIORITY=4\n",
+		"SYSLOG_IDENTIFIER=potentials-utils\n",
+		"NUMREMOVED=3\n",
+		"ERR\n",
+	} {
+		if !strings.Contains(got, expected) {
+			t.Errorf("expected datagram to contain %q, got %q", expected, got)
+		}
+	}
+	if strings.Contains(got, "ERR=") {
+		t.Errorf("expected multi-line field to use the length-prefixed form, got %q", got)
+	}
+}
+
+func TestFieldName(t *testing.T) {
+	testCases := map[string]string{
+		"numRemoved":  "NUMREMOVED",
+		"playlist-id": "PLAYLIST_ID",
+		"_private":    "PRIVATE",
+		"1st":         "ST",
+		"":            "FIELD",
+	}
+	for name, expected := range testCases {
+		if got := fieldName(name); got != expected {
+			t.Errorf("fieldName(%q): expected %q, got %q", name, expected, got)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package library
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const boltFile = "library.db"
+
+// boltTimeout is how long opening the database waits for another process,
+// e.g. a running server, to release it
+const boltTimeout = 10 * time.Second
+
+var (
+	// metaBucket holds the library's expiration, indexing time and saved
+	// albums
+	metaBucket = []byte("library")
+	// tracksBucket holds the saved tracks by ID
+	tracksBucket = []byte("tracks")
+
+	expirationKey = []byte("expiration")
+	indexedAtKey  = []byte("indexedAt")
+	albumsKey     = []byte("albums")
+)
+
+// boltStore caches the library in a bbolt database, one key per track, so
+// saving a library only writes the tracks which changed since it was last
+// saved
+type boltStore struct {
+	path string
+}
+
+func newBoltStore(cacheDir string) *boltStore {
+	return &boltStore{path: path.Join(cacheDir, boltFile)}
+}
+
+func (s *boltStore) Load() (*StoredLibrary, error) {
+	if _, err := os.Stat(s.path); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(s.path, 0644, &bolt.Options{Timeout: boltTimeout, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	stored := NewStoredLibrary()
+	err = db.View(func(tx *bolt.Tx) error {
+		meta, tracks := tx.Bucket(metaBucket), tx.Bucket(tracksBucket)
+		if meta == nil || tracks == nil {
+			return &os.PathError{Op: "load", Path: s.path, Err: os.ErrNotExist}
+		}
+		if err := stored.Expiration.UnmarshalBinary(meta.Get(expirationKey)); err != nil {
+			return err
+		}
+		if err := stored.IndexedAt.UnmarshalBinary(meta.Get(indexedAtKey)); err != nil {
+			return err
+		}
+		if albums := meta.Get(albumsKey); albums != nil {
+			if err := json.Unmarshal(albums, &stored.Albums); err != nil {
+				return err
+			}
+		}
+		stored.Tracks = make([]Track, 0, tracks.Stats().KeyN)
+		return tracks.ForEach(func(k, v []byte) error {
+			var t Track
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			stored.Tracks = append(stored.Tracks, t)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+func (s *boltStore) Save(stored *StoredLibrary) error {
+	if err := os.MkdirAll(path.Dir(s.path), os.FileMode(uint32(0755))); err != nil {
+		return err
+	}
+	db, err := bolt.Open(s.path, 0644, &bolt.Options{Timeout: boltTimeout})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		tracks, err := tx.CreateBucketIfNotExists(tracksBucket)
+		if err != nil {
+			return err
+		}
+		expiration, err := stored.Expiration.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if err := meta.Put(expirationKey, expiration); err != nil {
+			return err
+		}
+		indexedAt, err := stored.IndexedAt.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if err := meta.Put(indexedAtKey, indexedAt); err != nil {
+			return err
+		}
+		if stored.Albums == nil {
+			err = meta.Delete(albumsKey)
+		} else {
+			var albums []byte
+			if albums, err = json.Marshal(stored.Albums); err == nil {
+				err = meta.Put(albumsKey, albums)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		saved := map[string]bool{}
+		for _, t := range stored.Tracks {
+			v, err := json.Marshal(t)
+			if err != nil {
+				return err
+			}
+			k := []byte(t.ID)
+			saved[string(k)] = true
+			if bytes.Equal(tracks.Get(k), v) {
+				continue
+			}
+			if err := tracks.Put(k, v); err != nil {
+				return err
+			}
+		}
+		removed := [][]byte{}
+		err = tracks.ForEach(func(k, _ []byte) error {
+			if !saved[string(k)] {
+				removed = append(removed, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range removed {
+			if err := tracks.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Path() string {
+	return s.path
+}
@@ -0,0 +1,115 @@
+package library
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// Formats the library can be cached on disk in
+const (
+	// JSONFormat caches tracks as JSON, the default
+	JSONFormat = "json"
+	// GobFormat caches tracks gob encoded, smaller than JSONFormat and
+	// quicker to load
+	GobFormat = "gob"
+)
+
+// cacheFiles are the library's cache file names by format
+var cacheFiles = map[string]string{
+	JSONFormat: "library.json",
+	GobFormat:  "library.gob",
+}
+
+// validateFormat checks format is one the library can be cached in. Empty is
+// JSONFormat.
+func validateFormat(format string) error {
+	if _, ok := cacheFiles[format]; !ok && format != "" {
+		return fmt.Errorf("unknown cache format %q, expected %s or %s", format, JSONFormat, GobFormat)
+	}
+	return nil
+}
+
+// compactLibrary is StoredLibrary as cached in GobFormat
+type compactLibrary struct {
+	Expiration time.Time
+	IndexedAt  time.Time
+	Tracks     []Track
+	Albums     []spotify.SavedAlbum
+	// HasAlbums tells a nil Albums from an empty one, which gob doesn't
+	HasAlbums bool
+}
+
+// encodeStoredLibrary serializes a library to be cached in format
+func encodeStoredLibrary(stored *StoredLibrary, format string) ([]byte, error) {
+	if format != GobFormat {
+		versioned := *stored
+		versioned.Version = storedLibraryVersion
+		return json.Marshal(versioned)
+	}
+	compact := compactLibrary{
+		Expiration: stored.Expiration,
+		IndexedAt:  stored.IndexedAt,
+		Tracks:     stored.Tracks,
+		Albums:     stored.Albums,
+		HasAlbums:  stored.Albums != nil,
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(compact); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// legacyStoredLibrary is how the tracks of a library cached as JSON were
+// stored before they were trimmed down to Track
+type legacyStoredLibrary struct {
+	Tracks []spotify.SavedTrack `json:"tracks"`
+}
+
+// decodeStoredLibrary reads a library cached in format
+func decodeStoredLibrary(slurp []byte, format string) (*StoredLibrary, error) {
+	if format != GobFormat {
+		var stored *StoredLibrary
+		if err := json.Unmarshal(slurp, &stored); err != nil {
+			return nil, err
+		}
+		if stored == nil {
+			return NewStoredLibrary(), nil
+		}
+		if stored.Version < storedLibraryVersion {
+			var legacy legacyStoredLibrary
+			if err := json.Unmarshal(slurp, &legacy); err != nil {
+				return nil, err
+			}
+			stored.Tracks = make([]Track, 0, len(legacy.Tracks))
+			for _, t := range legacy.Tracks {
+				stored.Tracks = append(stored.Tracks, NewTrack(t))
+			}
+		}
+		return stored, nil
+	}
+	var compact compactLibrary
+	if err := gob.NewDecoder(bytes.NewReader(slurp)).Decode(&compact); err != nil {
+		return nil, err
+	}
+	stored := &StoredLibrary{
+		Expiration: compact.Expiration,
+		IndexedAt:  compact.IndexedAt,
+		Tracks:     compact.Tracks,
+	}
+	if stored.Tracks == nil {
+		stored.Tracks = []Track{}
+	}
+	if compact.HasAlbums {
+		stored.Albums = compact.Albums
+		if stored.Albums == nil {
+			stored.Albums = []spotify.SavedAlbum{}
+		}
+	}
+	return stored, nil
+}
@@ -0,0 +1,125 @@
+package library
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"potentials-utils/spotifyclient"
+	"potentials-utils/spotifytest"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+func TestGobCache(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	full := []spotify.SavedTrack{}
+	for ix := 0; ix < 50; ix++ {
+		track := spotifytest.Track(fmt.Sprintf("t%d", ix), fmt.Sprintf("Song %d", ix), "Album", "Artist", "Other Artist")
+		track.ExternalIDs = map[string]string{"isrc": fmt.Sprintf("ISRC%d", ix)}
+		track.Album.ReleaseDate = "2020-01-01"
+		track.Album.AvailableMarkets = []string{"GB", "US", "DE", "FR"}
+		track.AvailableMarkets = track.Album.AvailableMarkets
+		track.Duration = spotify.Numeric(180000 + ix)
+		track.Popularity = spotify.Numeric(ix)
+		srv.AddSavedTracks(track)
+		full = append(full, spotify.SavedTrack{AddedAt: "2020-01-01T00:00:00Z", FullTrack: track})
+	}
+	srv.AddSavedAlbums(spotify.SimpleAlbum{ID: "album", Name: "Album"})
+	dir, err := ioutil.TempDir("", "library")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := spotifyclient.New(srv.HTTPClient())
+	cfg := CacheConfig{CacheDir: dir, Lifetime: time.Hour, SavedAlbums: true}
+	if _, err := NewLibraryService(client, cfg); err != nil {
+		t.Fatal(err)
+	}
+	fromJSON, err := LoadStoredLibrary(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cache the library as it was before tracks were trimmed, whole
+	legacy, err := json.Marshal(map[string]interface{}{
+		"expiration": fromJSON.Expiration,
+		"indexedAt":  fromJSON.IndexedAt,
+		"tracks":     full,
+		"albums":     fromJSON.Albums,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonFile := path.Join(dir, "library.json")
+	if err := ioutil.WriteFile(jsonFile, legacy, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if fromJSON, err = LoadStoredLibrary(dir); err != nil || len(fromJSON.Tracks) != len(full) {
+		t.Fatalf("expected the whole tracks cached before read, got %v", err)
+	}
+
+	// Switching format reads the JSON cache, replacing it with a gob one
+	pages := libraryRequests(srv)
+	cfg.Format = GobFormat
+	lib, err := NewLibraryService(client, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := libraryRequests(srv); got != pages {
+		t.Errorf("expected the JSON cache read without calling Spotify, got %d more requests", got-pages)
+	}
+	if _, err := os.Stat(jsonFile); !os.IsNotExist(err) {
+		t.Errorf("expected the JSON cache replaced, got %v", err)
+	}
+	gobInfo, err := os.Stat(path.Join(dir, "library.gob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gobInfo.Size()*2 > int64(len(legacy)) {
+		t.Errorf("expected the gob cache less than half the size of the whole tracks, got %d and %d bytes", gobInfo.Size(), len(legacy))
+	}
+	if lib.CacheFile != path.Join(dir, "library.gob") {
+		t.Errorf("expected the service to use the gob cache, got %s", lib.CacheFile)
+	}
+
+	fromGob, err := LoadStoredLibrary(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fromGob.Expiration.Equal(fromJSON.Expiration) || !fromGob.IndexedAt.Equal(fromJSON.IndexedAt) {
+		t.Errorf("expected the expiration and indexing time kept, got %v %v", fromGob.Expiration, fromGob.IndexedAt)
+	}
+	if len(fromGob.Albums) != 1 || fromGob.Albums[0].ID != "album" {
+		t.Errorf("expected the saved album kept, got %v", fromGob.Albums)
+	}
+	byID := map[spotify.ID]Track{}
+	for _, st := range fromGob.Tracks {
+		byID[st.ID] = st
+	}
+	for _, expected := range fromJSON.Tracks {
+		got, ok := byID[expected.ID]
+		if !ok {
+			t.Errorf("expected %s in the gob cache", expected.ID)
+			continue
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected %s kept as %+v, got %+v", expected.ID, expected, got)
+		}
+	}
+	if track, err := lib.GetByISRC("ISRC7"); err != nil || len(track) != 1 || track[0].ID != "t7" {
+		t.Errorf("expected t7 looked up by ISRC, got %v, %v", track, err)
+	}
+
+	if err := ExpireStoredLibrary(dir); err != nil {
+		t.Fatal(err)
+	}
+	if expired, err := LoadStoredLibrary(dir); err != nil || expired.Expiration.After(time.Now()) || len(expired.Tracks) != 50 {
+		t.Errorf("expected the gob cache expired in place, got %v", err)
+	}
+}
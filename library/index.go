@@ -0,0 +1,414 @@
+package library
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"potentials-utils/prefixtree"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// SpotifyLibraryIndex represents an in-memory cache of the current users' spotify library. It must
+// be completely rebuilt if the current time is after the evictionTime. Yeah I
+// know this is basically a hand-tuned database, I did it for fun go read a book
+type SpotifyLibraryIndex struct {
+	tracksByID     map[spotify.ID]*spotify.SavedTrack
+	tracksByISRC   map[string][]*spotify.SavedTrack
+	tracksByArtist map[string][]*spotify.SavedTrack
+	// tracksByKey are the tracks under each index key
+	tracksByKey map[string][]*spotify.SavedTrack
+	// entries are the normalized names of each track, kept so Rebuild can
+	// reuse them
+	entries         map[spotify.ID]indexEntry
+	trackSearchTree *prefixtree.PrefixTree
+	// albums are the user's saved albums, nil unless they were indexed
+	albums     []spotify.SavedAlbum
+	albumsByID map[spotify.ID]*spotify.SavedAlbum
+	// normalizer normalizes names when tracks are indexed and looked up
+	normalizer *Normalizer
+	// key builds the composite key of each track in the search tree and
+	// tracksByKey
+	key      *IndexKey
+	lifetime time.Duration
+	// The whole cache goes stale at once, RemoveTrack only evicts tracks
+	// removed from the library
+	evictionTime time.Time
+	// indexedAt is when the tracks were last fetched from Spotify
+	indexedAt time.Time
+}
+
+// NewSpotifyLibraryIndex creates an empty SpotifyLibraryIndex which stays
+// fresh for lifetime once made fresh.
+func NewSpotifyLibraryIndex(lifetime time.Duration) *SpotifyLibraryIndex {
+	return &SpotifyLibraryIndex{
+		tracksByID:      map[spotify.ID]*spotify.SavedTrack{},
+		tracksByISRC:    map[string][]*spotify.SavedTrack{},
+		tracksByArtist:  map[string][]*spotify.SavedTrack{},
+		tracksByKey:     map[string][]*spotify.SavedTrack{},
+		entries:         map[spotify.ID]indexEntry{},
+		albumsByID:      map[spotify.ID]*spotify.SavedAlbum{},
+		trackSearchTree: prefixtree.NewPrefixTree(),
+		key:             defaultIndexKey,
+		lifetime:        lifetime,
+		evictionTime:    time.Now(), // Eviction time will be
+	}
+
+}
+
+// SetNormalizer sets the normalization applied to names when tracks are
+// indexed and looked up. It must be set before any track is indexed.
+func (i *SpotifyLibraryIndex) SetNormalizer(n *Normalizer) {
+	i.normalizer = n
+}
+
+// SetIndexKey sets the composite key tracks are indexed under. It must be set
+// before any track is indexed.
+func (i *SpotifyLibraryIndex) SetIndexKey(k *IndexKey) {
+	i.key = k
+}
+
+// Normalize normalizes a name as the index does
+func (i *SpotifyLibraryIndex) Normalize(name string) string {
+	return i.normalizer.Normalize(name)
+}
+
+func (i *SpotifyLibraryIndex) dumpTree() []string {
+	return i.trackSearchTree.Words()
+}
+
+// IndexString returns the string a track is stored under in the library's
+// search tree, given its already normalized names
+func IndexString(trackName, albumName string, artistNames []string) string {
+	return trackIndexString(trackName, albumName, append([]string{}, artistNames...))
+}
+
+// indexString normalizes a track's names and returns the string it's stored
+// under in the search tree
+func (i *SpotifyLibraryIndex) indexString(trackName, albumName string, artistNames []string) string {
+	return trackIndexString(i.normalizer.Normalize(trackName), i.normalizer.Normalize(albumName), i.normalizer.NormalizeAll(artistNames))
+}
+
+// artistKey is the key of an artist in tracksByArtist
+func (i *SpotifyLibraryIndex) artistKey(name string) string {
+	return strings.ToLower(i.normalizer.Normalize(name))
+}
+
+func trackIndexString(trackName, albumName string, artistNames []string) string {
+	var indexStrBuilder strings.Builder
+	// Song name
+	indexStrBuilder.WriteString(fmt.Sprintf("%s", trackName))
+	// Album name
+	indexStrBuilder.WriteString(fmt.Sprintf("%s", albumName))
+	// Each artist name, in alphabetical order
+	sort.Strings(artistNames)
+	for _, a := range artistNames {
+		indexStrBuilder.WriteString(fmt.Sprintf("%s", a))
+	}
+	return indexStrBuilder.String()
+}
+
+// indexEntry is what indexing a track works out from its names
+type indexEntry struct {
+	// searchTerm is the track's index key, its string in the search tree
+	// and its key in tracksByKey
+	searchTerm string
+	// artistKeys are the track's keys in tracksByArtist
+	artistKeys []string
+	// names are the track, album and artist names the entry was worked out
+	// from
+	names []string
+	// isrc and duration are the rest of what the key may be made of
+	isrc     string
+	duration int
+}
+
+// newEntry normalizes a track's names into its index entry
+func (i *SpotifyLibraryIndex) newEntry(v spotify.SavedTrack) indexEntry {
+	artists := ArtistNames(v.SimpleTrack)
+	e := indexEntry{
+		searchTerm: i.key.Key(i.normalizer, v.FullTrack),
+		names:      append([]string{v.Name, v.Album.Name}, artists...),
+		isrc:       ISRC(v.FullTrack),
+		duration:   int(v.Duration),
+	}
+	for _, a := range artists {
+		e.artistKeys = append(e.artistKeys, i.artistKey(a))
+	}
+	return e
+}
+
+// describes returns whether the entry was worked out from the track's
+// current names, ISRC and duration
+func (e indexEntry) describes(v spotify.SavedTrack) bool {
+	if e.isrc != ISRC(v.FullTrack) || e.duration != int(v.Duration) {
+		return false
+	}
+	if len(e.names) != len(v.Artists)+2 || e.names[0] != v.Name || e.names[1] != v.Album.Name {
+		return false
+	}
+	for ix, a := range v.Artists {
+		if e.names[ix+2] != a.Name {
+			return false
+		}
+	}
+	return true
+}
+
+// IndexTrack adds a track to the library index and refreshes the lifetime of
+// the index. Only the fields of Track are kept.
+func (i *SpotifyLibraryIndex) IndexTrack(k spotify.ID, v spotify.SavedTrack) {
+	v = trim(v)
+	e := i.newEntry(v)
+	i.indexTrackMaps(k, &v, e)
+	i.trackSearchTree.Add(e.searchTerm)
+}
+
+// indexTrackMaps adds a track to every lookup but the search tree
+func (i *SpotifyLibraryIndex) indexTrackMaps(k spotify.ID, v *spotify.SavedTrack, e indexEntry) {
+	i.tracksByID[k] = v
+	i.entries[k] = e
+	if isrc := ISRC(v.FullTrack); isrc != "" {
+		i.tracksByISRC[isrc] = append(i.tracksByISRC[isrc], v)
+	}
+	for _, key := range e.artistKeys {
+		i.tracksByArtist[key] = append(i.tracksByArtist[key], v)
+	}
+	i.tracksByKey[e.searchTerm] = append(i.tracksByKey[e.searchTerm], v)
+}
+
+// IndexTracks adds many tracks to the library index at once. Building the
+// search tree of an empty index in bulk is cheaper than indexing each track in
+// turn.
+func (i *SpotifyLibraryIndex) IndexTracks(tracks []spotify.SavedTrack) {
+	bulk := i.Len() == 0
+	searchTerms := []string{}
+	for _, t := range tracks {
+		if !bulk {
+			i.IndexTrack(t.ID, t)
+			continue
+		}
+		t := trim(t)
+		e := i.newEntry(t)
+		i.indexTrackMaps(t.ID, &t, e)
+		searchTerms = append(searchTerms, e.searchTerm)
+	}
+	if bulk {
+		i.trackSearchTree = prefixtree.NewPrefixTreeFromWords(searchTerms)
+	}
+}
+
+// RemoveTrack evicts a track from the library index, so a track removed from
+// the library needn't rebuild the whole index. Returns false if it wasn't
+// indexed.
+func (i *SpotifyLibraryIndex) RemoveTrack(k spotify.ID) bool {
+	v, ok := i.tracksByID[k]
+	if !ok {
+		return false
+	}
+	e := i.entries[k]
+	delete(i.tracksByID, k)
+	delete(i.entries, k)
+	if isrc := ISRC(v.FullTrack); isrc != "" {
+		i.tracksByISRC[isrc] = withoutTrack(i.tracksByISRC[isrc], k)
+		if len(i.tracksByISRC[isrc]) == 0 {
+			delete(i.tracksByISRC, isrc)
+		}
+	}
+	for _, key := range e.artistKeys {
+		i.tracksByArtist[key] = withoutTrack(i.tracksByArtist[key], k)
+		if len(i.tracksByArtist[key]) == 0 {
+			delete(i.tracksByArtist, key)
+		}
+	}
+	// the search tree holds each key once, so keep it while another track
+	// is stored under it
+	i.tracksByKey[e.searchTerm] = withoutTrack(i.tracksByKey[e.searchTerm], k)
+	if len(i.tracksByKey[e.searchTerm]) > 0 {
+		return true
+	}
+	delete(i.tracksByKey, e.searchTerm)
+	i.trackSearchTree.Remove(e.searchTerm)
+	return true
+}
+
+// withoutTrack returns tracks without the track with ID k
+func withoutTrack(tracks []*spotify.SavedTrack, k spotify.ID) []*spotify.SavedTrack {
+	kept := []*spotify.SavedTrack{}
+	for _, t := range tracks {
+		if t.ID != k {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+// Rebuild indexes tracks into a new index with the same lifetime and
+// normalization, reusing the work done by this index for tracks it holds
+// already. Only tracks which are new, or whose names changed, are normalized
+// again, and tracks which haven't changed at all keep their pointers. Returns
+// the new index and how many tracks' entries were reused.
+func (i *SpotifyLibraryIndex) Rebuild(tracks []spotify.SavedTrack) (*SpotifyLibraryIndex, int) {
+	index := NewSpotifyLibraryIndex(i.lifetime)
+	index.normalizer = i.normalizer
+	index.key = i.key
+	searchTerms := make([]string, 0, len(tracks))
+	reused := 0
+	for _, t := range tracks {
+		t := trim(t)
+		e, ok := i.entries[t.ID]
+		if ok && e.describes(t) {
+			reused++
+		} else {
+			e = index.newEntry(t)
+		}
+		v := &t
+		if prev := i.tracksByID[t.ID]; prev != nil && reflect.DeepEqual(*prev, t) {
+			v = prev
+		}
+		index.indexTrackMaps(t.ID, v, e)
+		searchTerms = append(searchTerms, e.searchTerm)
+	}
+	index.trackSearchTree = prefixtree.NewPrefixTreeFromWords(searchTerms)
+	return index, reused
+}
+
+// newestAddedAt returns when the most recently saved track in the index was
+// saved, or the zero time if the index doesn't know
+func (i *SpotifyLibraryIndex) newestAddedAt() time.Time {
+	var newest time.Time
+	for _, t := range i.tracksByID {
+		if addedAt, err := time.Parse(spotify.TimestampLayout, t.AddedAt); err == nil && addedAt.After(newest) {
+			newest = addedAt
+		}
+	}
+	return newest
+}
+
+// merge returns the tracks in the index along with added, which replace any
+// indexed tracks with the same IDs, i.e. tracks saved again since
+func (i *SpotifyLibraryIndex) merge(added []spotify.SavedTrack) []spotify.SavedTrack {
+	tracks := make([]spotify.SavedTrack, 0, len(i.tracksByID)+len(added))
+	replaced := map[spotify.ID]bool{}
+	for _, t := range added {
+		if !replaced[t.ID] {
+			replaced[t.ID] = true
+			tracks = append(tracks, t)
+		}
+	}
+	for id, t := range i.tracksByID {
+		if !replaced[id] {
+			tracks = append(tracks, *t)
+		}
+	}
+	return tracks
+}
+
+// IndexAlbums adds the user's saved albums to the index, replacing any indexed
+// before
+func (i *SpotifyLibraryIndex) IndexAlbums(albums []spotify.SavedAlbum) {
+	i.albums = append([]spotify.SavedAlbum{}, albums...)
+	i.albumsByID = map[spotify.ID]*spotify.SavedAlbum{}
+	for ix := range i.albums {
+		i.albumsByID[i.albums[ix].ID] = &i.albums[ix]
+	}
+}
+
+// MakeItFresh tells the library index it should be considered fresh
+func (i *SpotifyLibraryIndex) MakeItFresh() {
+	i.indexedAt = time.Now()
+	i.evictionTime = i.indexedAt.Add(i.lifetime)
+}
+
+// Alive returns true if the index is fresh
+func (i *SpotifyLibraryIndex) Alive() bool {
+	return time.Now().Before(i.evictionTime)
+}
+
+// Len returns the number of tracks in the index
+func (i *SpotifyLibraryIndex) Len() int {
+	return len(i.tracksByID)
+}
+
+func containsAll(list1, list2 []string) bool {
+	if len(list2) != len(list2) {
+		return false
+	}
+
+	containsAll := true
+	for _, e1 := range list1 {
+		found := false
+		for _, e2 := range list2 {
+			found = found || e1 == e2
+		}
+		containsAll = containsAll && found
+	}
+	return containsAll
+
+}
+
+// GetByID returns the saved track with the given ID, or nil if there is none.
+// Lookups in an index never fail, the error is for symmetry with
+// LibraryService.
+func (i *SpotifyLibraryIndex) GetByID(k spotify.ID) (*spotify.SavedTrack, error) {
+	return i.tracksByID[k], nil
+}
+
+// GetSavedAlbum returns the saved album with the given ID, or nil if there is
+// none or saved albums weren't indexed
+func (i *SpotifyLibraryIndex) GetSavedAlbum(id spotify.ID) (*spotify.SavedAlbum, error) {
+	return i.albumsByID[id], nil
+}
+
+// GetByISRC returns every saved track with the given International Standard
+// Recording Code
+func (i *SpotifyLibraryIndex) GetByISRC(isrc string) ([]*spotify.SavedTrack, error) {
+	return i.tracksByISRC[isrc], nil
+}
+
+// GetByArtistName returns every saved track credited to the named artist,
+// ignoring case
+func (i *SpotifyLibraryIndex) GetByArtistName(name string) ([]*spotify.SavedTrack, error) {
+	return i.tracksByArtist[i.artistKey(name)], nil
+}
+
+// GetByKey returns every saved track with the same index key as t
+func (i *SpotifyLibraryIndex) GetByKey(t spotify.FullTrack) ([]*spotify.SavedTrack, error) {
+	return i.tracksByKey[i.IndexKey(t)], nil
+}
+
+// IndexKey returns the key t is indexed under, or would be
+func (i *SpotifyLibraryIndex) IndexKey(t spotify.FullTrack) string {
+	return i.key.Key(i.normalizer, t)
+}
+
+// KeyFields returns the fields the index key is made of
+func (i *SpotifyLibraryIndex) KeyFields() []string {
+	return i.key.Fields()
+}
+
+// GetBySongAlbumArtistNames gets all tracks with the same song name, artist
+// name, and album title, once normalized
+func (i *SpotifyLibraryIndex) GetBySongAlbumArtistNames(songName, albumName string, artistNames []string) ([]*spotify.SavedTrack, error) {
+	// the search tree holds exactly these names if they're the whole key, so
+	// the tracks under the key are the matches
+	if i.key.isDefault() {
+		key := i.indexString(songName, albumName, artistNames)
+		if !i.trackSearchTree.Contains(key) {
+			return nil, nil
+		}
+		return i.tracksByKey[key], nil
+	}
+	songName, albumName, artistNames = i.normalizer.Normalize(songName), i.normalizer.Normalize(albumName), i.normalizer.NormalizeAll(artistNames)
+	// search entire cache for songs that match these fields
+	var matches []*spotify.SavedTrack
+	for _, v := range i.tracksByID {
+		if i.normalizer.Normalize(v.Name) == songName && i.normalizer.Normalize(v.Album.Name) == albumName && containsAll(i.normalizer.NormalizeAll(ArtistNames(v.SimpleTrack)), artistNames) {
+			matches = append(matches, v)
+		}
+	}
+	return matches, nil
+}
@@ -0,0 +1,373 @@
+package library
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+func savedTrack(id, name, album string, artists ...string) spotify.SavedTrack {
+	t := spotify.SavedTrack{}
+	t.ID = spotify.ID(id)
+	t.Name = name
+	t.Album.Name = album
+	for _, a := range artists {
+		t.Artists = append(t.Artists, spotify.SimpleArtist{Name: a})
+	}
+	return t
+}
+
+func TestIndexTrack(t *testing.T) {
+	testCases := []struct {
+		name        string
+		toIndex     []spotify.SavedTrack
+		searchTrack spotify.SavedTrack
+		expectFound bool
+	}{
+		{
+			name:        "empty index contains nothing",
+			searchTrack: savedTrack("1", "Song", "Album", "Artist"),
+		},
+		{
+			name:        "indexed track is searchable",
+			toIndex:     []spotify.SavedTrack{savedTrack("1", "Song", "Album", "Artist")},
+			searchTrack: savedTrack("2", "Song", "Album", "Artist"),
+			expectFound: true,
+		},
+		{
+			name:        "artist order does not matter",
+			toIndex:     []spotify.SavedTrack{savedTrack("1", "Song", "Album", "B", "A")},
+			searchTrack: savedTrack("2", "Song", "Album", "A", "B"),
+			expectFound: true,
+		},
+		{
+			name:        "prefix of an indexed track is not found",
+			toIndex:     []spotify.SavedTrack{savedTrack("1", "Song", "Album", "Artist")},
+			searchTrack: savedTrack("2", "Song", "Album", "Art"),
+		},
+		{
+			name:        "different album is not found",
+			toIndex:     []spotify.SavedTrack{savedTrack("1", "Song", "Album", "Artist")},
+			searchTrack: savedTrack("2", "Song", "Other Album", "Artist"),
+		},
+	}
+	for _, tc := range testCases {
+		index := NewSpotifyLibraryIndex(time.Hour)
+		for _, v := range tc.toIndex {
+			index.IndexTrack(v.ID, v)
+		}
+		s := tc.searchTrack
+		found := index.trackSearchTree.Contains(trackIndexString(s.Name, s.Album.Name, ArtistNames(s.SimpleTrack)))
+		if found != tc.expectFound {
+			t.Errorf("%s failed: expected found to be %v, got %v", tc.name, tc.expectFound, found)
+		}
+		if index.Len() != len(tc.toIndex) {
+			t.Errorf("%s failed: expected %d tracks in the index, got %d", tc.name, len(tc.toIndex), index.Len())
+		}
+	}
+}
+
+func TestMakeItFresh(t *testing.T) {
+	index := NewSpotifyLibraryIndex(time.Hour)
+	if index.Alive() {
+		t.Errorf("expected a new index to be stale")
+	}
+	index.MakeItFresh()
+	if !index.Alive() {
+		t.Errorf("expected index to be alive after MakeItFresh")
+	}
+}
+
+func TestIndexTracks(t *testing.T) {
+	tracks := []spotify.SavedTrack{
+		savedTrack("1", "Song", "Album", "B", "A"),
+		savedTrack("2", "Song 2", "Album", "A"),
+		savedTrack("3", "Other", "Record", "C"),
+	}
+	one := NewSpotifyLibraryIndex(time.Hour)
+	for _, v := range tracks {
+		one.IndexTrack(v.ID, v)
+	}
+	bulk := NewSpotifyLibraryIndex(time.Hour)
+	bulk.IndexTracks(tracks[:2])
+	// A second batch is added to the existing tree
+	bulk.IndexTracks(tracks[2:])
+
+	if bulk.Len() != one.Len() {
+		t.Errorf("expected %d tracks, got %d", one.Len(), bulk.Len())
+	}
+	if got, expected := bulk.trackSearchTree.String(), one.trackSearchTree.String(); got != expected {
+		t.Errorf("expected bulk indexed search tree %q, got %q", expected, got)
+	}
+	if len(bulk.tracksByArtist["a"]) != 2 {
+		t.Errorf("expected 2 tracks by artist A, got %d", len(bulk.tracksByArtist["a"]))
+	}
+}
+
+func TestNormalizer(t *testing.T) {
+	all := []string{NormalizeUnicode, NormalizeFeat, NormalizeSuffixes, NormalizeCase, NormalizeSpace}
+	testCases := []struct {
+		name     string
+		steps    []string
+		in       string
+		expected string
+	}{
+		{name: "no steps", in: "Song (Live)", expected: "Song (Live)"},
+		{name: "case", steps: []string{NormalizeCase}, in: "Song", expected: "song"},
+		{name: "unicode", steps: []string{NormalizeUnicode}, in: "Beyoncé’s Song – Part 2", expected: "Beyonce's Song - Part 2"},
+		{name: "dash suffix", steps: []string{NormalizeSuffixes}, in: "Song - Remastered 2011", expected: "Song"},
+		{name: "bracketed suffix", steps: []string{NormalizeSuffixes}, in: "Song [Live at Wembley]", expected: "Song"},
+		{name: "other brackets kept", steps: []string{NormalizeSuffixes}, in: "Song (Part 2)", expected: "Song (Part 2)"},
+		{name: "bracketed feat", steps: []string{NormalizeFeat}, in: "Song (feat. Someone)", expected: "Song"},
+		{name: "bare feat", steps: []string{NormalizeFeat}, in: "Song ft. Someone", expected: "Song"},
+		{name: "punctuation", steps: []string{NormalizePunctuation}, in: "Don't Stop (Me Now)!", expected: "Dont Stop Me Now"},
+		{name: "space", steps: []string{NormalizeSpace}, in: "  Song   Two ", expected: "Song Two"},
+		{name: "all", steps: all, in: "Café  Song (feat. Someone) - Radio Edit", expected: "cafe song"},
+	}
+	for _, tc := range testCases {
+		n, err := NewNormalizer(tc.steps)
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		if got := n.Normalize(tc.in); got != tc.expected {
+			t.Errorf("%s failed: expected %q, got %q", tc.name, tc.expected, got)
+		}
+	}
+	if _, err := NewNormalizer([]string{"soundex"}); err == nil {
+		t.Errorf("expected an unknown step to be an error")
+	}
+}
+
+func TestCollation(t *testing.T) {
+	steps := []string{NormalizeUnicode, NormalizeCase}
+	testCases := []struct {
+		name     string
+		locale   string
+		in       string
+		expected string
+	}{
+		{name: "default dotless I", in: "IŞIK", expected: "işik"},
+		{name: "turkish dotted I", locale: "tr", in: "İSTANBUL", expected: "istanbul"},
+		{name: "turkish dotless I", locale: "tr-TR", in: "IŞIK", expected: "ışık"},
+		{name: "azeri", locale: "az", in: "İLK", expected: "ilk"},
+		{name: "default umlaut", in: "Müller", expected: "muller"},
+		{name: "german umlaut", locale: "de", in: "Müller", expected: "mueller"},
+		{name: "german sharp s", locale: "de_AT", in: "STRAẞE", expected: "strasse"},
+		{name: "danish", locale: "da", in: "Ærø", expected: "aeroe"},
+		{name: "dutch", locale: "nl", in: "Ĳssel", expected: "ijssel"},
+	}
+	for _, tc := range testCases {
+		n, err := NewCollatingNormalizer(steps, tc.locale)
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		if got := n.Normalize(tc.in); got != tc.expected {
+			t.Errorf("%s failed: expected %q, got %q", tc.name, tc.expected, got)
+		}
+	}
+	if _, err := NewCollatingNormalizer(steps, "klingon"); err == nil {
+		t.Errorf("expected an unsupported locale to be an error")
+	}
+
+	n, err := NewCollatingNormalizer(steps, "tr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := NewSpotifyLibraryIndex(time.Hour)
+	index.SetNormalizer(n)
+	index.IndexTracks([]spotify.SavedTrack{savedTrack("1", "Işık", "Album", "İlkay")})
+	matches, err := index.GetBySongAlbumArtistNames("IŞIK", "ALBUM", []string{"ilkay"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 {
+		t.Errorf("expected the turkish lookup to find the track, got %d matches", len(matches))
+	}
+}
+
+func TestNormalizedLookups(t *testing.T) {
+	n, err := NewNormalizer([]string{NormalizeUnicode, NormalizeFeat, NormalizeCase})
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := NewSpotifyLibraryIndex(time.Hour)
+	index.SetNormalizer(n)
+	index.IndexTracks([]spotify.SavedTrack{savedTrack("1", "Song (feat. Someone)", "Album", "Beyoncé")})
+
+	matches, err := index.GetBySongAlbumArtistNames("SONG", "album", []string{"Beyonce"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 {
+		t.Errorf("expected the normalized lookup to find the track, got %d matches", len(matches))
+	}
+	byArtist, err := index.GetByArtistName("BEYONCE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byArtist) != 1 {
+		t.Errorf("expected the normalized artist lookup to find the track, got %d", len(byArtist))
+	}
+}
+
+func TestIndexKey(t *testing.T) {
+	saved := savedTrack("1", "Song", "Album", "B", "A")
+	saved.Duration = 180000
+	saved.ExternalIDs = map[string]string{"isrc": "usabc0000001"}
+	testCases := []struct {
+		name        string
+		fields      []string
+		lookup      func(t *spotify.FullTrack)
+		expectFound bool
+	}{
+		{name: "default key", lookup: func(t *spotify.FullTrack) {}, expectFound: true},
+		{name: "default key compares albums", lookup: func(t *spotify.FullTrack) { t.Album.Name = "Single" }, expectFound: false},
+		{name: "album excluded", fields: []string{KeyName, KeyArtists}, lookup: func(t *spotify.FullTrack) { t.Album.Name = "Single" }, expectFound: true},
+		{name: "same duration bucket", fields: []string{KeyName, KeyDuration}, lookup: func(t *spotify.FullTrack) { t.Duration = 182000 }, expectFound: true},
+		{name: "other duration bucket", fields: []string{KeyName, KeyDuration}, lookup: func(t *spotify.FullTrack) { t.Duration = 186000 }, expectFound: false},
+		{name: "isrc ignoring case", fields: []string{KeyISRC}, lookup: func(t *spotify.FullTrack) { t.ExternalIDs = map[string]string{"isrc": "USABC0000001"} }, expectFound: true},
+		{name: "isrc only", fields: []string{KeyISRC}, lookup: func(t *spotify.FullTrack) { t.Name = "Other" }, expectFound: true},
+	}
+	for _, tc := range testCases {
+		key, err := NewIndexKey(tc.fields, 0)
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		index := NewSpotifyLibraryIndex(time.Hour)
+		index.SetIndexKey(key)
+		index.IndexTracks([]spotify.SavedTrack{saved})
+		lookup := saved.FullTrack
+		tc.lookup(&lookup)
+		matches, _ := index.GetByKey(lookup)
+		if found := len(matches) == 1; found != tc.expectFound {
+			t.Errorf("%s failed: expected found to be %v, got %v", tc.name, tc.expectFound, found)
+		}
+		if !index.trackSearchTree.Contains(index.IndexKey(saved.FullTrack)) {
+			t.Errorf("%s failed: expected the search tree to hold the configured key", tc.name)
+		}
+	}
+	if _, err := NewIndexKey([]string{KeyName, "genre"}, 0); err == nil {
+		t.Errorf("expected an unknown field to be rejected")
+	}
+	if _, err := NewIndexKey([]string{KeyName, KeyName}, 0); err == nil {
+		t.Errorf("expected a repeated field to be rejected")
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	n, err := NewNormalizer([]string{NormalizeCase})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := NewSpotifyLibraryIndex(time.Hour)
+	stale.SetNormalizer(n)
+	stale.IndexTracks([]spotify.SavedTrack{
+		savedTrack("1", "Song", "Album", "A"),
+		savedTrack("2", "Song 2", "Album", "A"),
+		savedTrack("3", "Gone", "Album", "B"),
+	})
+	added := savedTrack("2", "Song 2", "Album", "A")
+	added.AddedAt = "2020-06-01T00:00:00Z"
+	tracks := []spotify.SavedTrack{
+		savedTrack("1", "Song", "Album", "A"),
+		// Saved again, so the names are unchanged but the track isn't
+		added,
+		savedTrack("4", "New", "Album", "C"),
+	}
+
+	index, reused := stale.Rebuild(tracks)
+	if reused != 2 {
+		t.Errorf("expected the entries of the 2 tracks with unchanged names to be reused, got %d", reused)
+	}
+	if index.tracksByID["1"] != stale.tracksByID["1"] {
+		t.Errorf("expected the unchanged track to keep its pointer")
+	}
+	if index.tracksByID["2"] == stale.tracksByID["2"] || index.tracksByID["2"].AddedAt != added.AddedAt {
+		t.Errorf("expected the changed track to be replaced, got %+v", index.tracksByID["2"])
+	}
+	fresh := NewSpotifyLibraryIndex(time.Hour)
+	fresh.SetNormalizer(n)
+	fresh.IndexTracks(tracks)
+	if got, expected := index.trackSearchTree.String(), fresh.trackSearchTree.String(); got != expected {
+		t.Errorf("expected the rebuilt search tree %q, got %q", expected, got)
+	}
+	if index.Len() != 3 || len(index.tracksByArtist["b"]) != 0 || len(index.tracksByArtist["a"]) != 2 {
+		t.Errorf("expected the removed track to be dropped, got %d tracks", index.Len())
+	}
+	if matches, _ := index.GetBySongAlbumArtistNames("NEW", "Album", []string{"C"}); len(matches) != 1 {
+		t.Errorf("expected the new track to be found, got %d matches", len(matches))
+	}
+}
+
+func TestRemoveTrack(t *testing.T) {
+	index := NewSpotifyLibraryIndex(time.Hour)
+	index.IndexTracks([]spotify.SavedTrack{
+		savedTrack("1", "Song", "Album", "A"),
+		// The same song saved twice shares a search term
+		savedTrack("2", "Song", "Album", "A"),
+		savedTrack("3", "Other", "Album", "B"),
+	})
+
+	if !index.RemoveTrack("3") || index.RemoveTrack("3") {
+		t.Errorf("expected track 3 removed once")
+	}
+	if index.Len() != 2 || len(index.tracksByArtist["b"]) != 0 {
+		t.Errorf("expected track 3 dropped from every lookup, got %d tracks", index.Len())
+	}
+	expected := NewSpotifyLibraryIndex(time.Hour)
+	expected.IndexTracks([]spotify.SavedTrack{savedTrack("1", "Song", "Album", "A")})
+	if got := index.trackSearchTree.String(); got != expected.trackSearchTree.String() {
+		t.Errorf("expected track 3's search term pruned, got tree %q", got)
+	}
+
+	index.RemoveTrack("1")
+	if matches, _ := index.GetBySongAlbumArtistNames("Song", "Album", []string{"A"}); len(matches) != 1 || matches[0].ID != "2" {
+		t.Errorf("expected track 2 still found after removing track 1, got %v", matches)
+	}
+	index.RemoveTrack("2")
+	if words := index.dumpTree(); len(words) != 0 {
+		t.Errorf("expected an empty search tree, got %v", words)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	index := NewSpotifyLibraryIndex(time.Hour)
+	index.IndexTracks([]spotify.SavedTrack{
+		savedTrack("1", "Holocene", "Bon Iver", "Bon Iver"),
+		savedTrack("2", "Hold On", "Album", "A"),
+		savedTrack("3", "Hold On We're Going Home", "Album", "B"),
+		savedTrack("4", "Other", "Album", "C"),
+	})
+	testCases := []struct {
+		name     string
+		query    string
+		mode     string
+		limit    int
+		expected []spotify.ID
+	}{
+		{name: "exact", query: "Hold On", mode: SearchExact, expected: []spotify.ID{"2"}},
+		{name: "prefix", query: "Hol", mode: SearchPrefix, expected: []spotify.ID{"2", "3", "1"}},
+		{name: "prefix with limit", query: "Hold", mode: SearchPrefix, limit: 1, expected: []spotify.ID{"2"}},
+		{name: "prefix miss", query: "Nothing", mode: SearchPrefix, expected: []spotify.ID{}},
+		{name: "fuzzy", query: "holocine", mode: SearchFuzzy, expected: []spotify.ID{"1"}},
+		{name: "fuzzy closest first", query: "Hold Om", mode: SearchFuzzy, expected: []spotify.ID{"2"}},
+	}
+	for _, tc := range testCases {
+		results, err := index.Search(tc.query, tc.mode, tc.limit)
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		ids := []spotify.ID{}
+		for _, r := range results {
+			ids = append(ids, r.Track.ID)
+		}
+		if !reflect.DeepEqual(ids, tc.expected) {
+			t.Errorf("%s failed: expected %v, got %v", tc.name, tc.expected, ids)
+		}
+	}
+	if _, err := index.Search("x", "regex", 0); err == nil {
+		t.Errorf("expected an unknown mode to fail")
+	}
+}
@@ -0,0 +1,107 @@
+package library
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// Index key fields, which make up the composite key tracks are indexed and
+// looked up by exactly, in the order they're configured
+const (
+	// KeyName is the track's normalized name
+	KeyName = "name"
+	// KeyAlbum is the normalized name of the track's album
+	KeyAlbum = "album"
+	// KeyArtists are the normalized names of every artist credited, in
+	// alphabetical order
+	KeyArtists = "artists"
+	// KeyISRC is the track's International Standard Recording Code
+	KeyISRC = "isrc"
+	// KeyDuration is the track's duration, rounded down to a bucket
+	KeyDuration = "duration"
+)
+
+// DefaultKeyFields make up the index key if none are configured
+var DefaultKeyFields = []string{KeyName, KeyAlbum, KeyArtists}
+
+// defaultDurationBucket is the width of duration buckets if none is
+// configured
+const defaultDurationBucket = 5 * time.Second
+
+// IndexKey builds the composite key tracks are indexed under from the
+// configured fields
+type IndexKey struct {
+	fields []string
+	bucket time.Duration
+}
+
+// NewIndexKey creates an IndexKey made of fields, DefaultKeyFields if empty.
+// Durations fall into buckets of the given width, 5 seconds if zero.
+func NewIndexKey(fields []string, bucket time.Duration) (*IndexKey, error) {
+	if len(fields) == 0 {
+		fields = DefaultKeyFields
+	}
+	if bucket == 0 {
+		bucket = defaultDurationBucket
+	} else if bucket < 0 {
+		return nil, fmt.Errorf("duration bucket must be positive, got %s", bucket)
+	}
+	seen := map[string]bool{}
+	for _, f := range fields {
+		switch f {
+		case KeyName, KeyAlbum, KeyArtists, KeyISRC, KeyDuration:
+		default:
+			return nil, fmt.Errorf("unknown index key field %q", f)
+		}
+		if seen[f] {
+			return nil, fmt.Errorf("index key field %q is repeated", f)
+		}
+		seen[f] = true
+	}
+	return &IndexKey{fields: append([]string{}, fields...), bucket: bucket}, nil
+}
+
+// NewIndexKey creates the index key configured
+func (cfg CacheConfig) NewIndexKey() (*IndexKey, error) {
+	return NewIndexKey(cfg.IndexKey, time.Duration(cfg.IndexDurationBucketSec)*time.Second)
+}
+
+// defaultIndexKey is the key of indexes which aren't configured otherwise
+var defaultIndexKey, _ = NewIndexKey(nil, 0)
+
+// Fields returns the fields the key is made of
+func (k *IndexKey) Fields() []string {
+	return append([]string{}, k.fields...)
+}
+
+// isDefault returns whether the key is made of DefaultKeyFields, so is the
+// string IndexString returns
+func (k *IndexKey) isDefault() bool {
+	return strings.Join(k.fields, ",") == strings.Join(DefaultKeyFields, ",")
+}
+
+// Key returns t's key, its names normalized by n
+func (k *IndexKey) Key(n *Normalizer, t spotify.FullTrack) string {
+	var key strings.Builder
+	for _, f := range k.fields {
+		switch f {
+		case KeyName:
+			key.WriteString(n.Normalize(t.Name))
+		case KeyAlbum:
+			key.WriteString(n.Normalize(t.Album.Name))
+		case KeyArtists:
+			artists := n.NormalizeAll(ArtistNames(t.SimpleTrack))
+			sort.Strings(artists)
+			key.WriteString(strings.Join(artists, ""))
+		case KeyISRC:
+			key.WriteString(strings.ToUpper(ISRC(t)))
+		case KeyDuration:
+			fmt.Fprintf(&key, "~%d", time.Duration(t.Duration)*time.Millisecond/k.bucket)
+		}
+	}
+	return key.String()
+}
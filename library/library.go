@@ -0,0 +1,627 @@
+// Package library maintains a locally cached, searchable index of the current
+// user's saved Spotify tracks.
+package library
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"potentials-utils/audit"
+	"potentials-utils/metrics"
+	"potentials-utils/progress"
+	"potentials-utils/tracing"
+
+	"github.com/apex/log"
+	"github.com/zmb3/spotify/v2"
+)
+
+// CacheConfig holds config options for the on-disk library cache
+type CacheConfig struct {
+	Lifetime time.Duration `yaml:"lifetimeNs"`
+	CacheDir string        `yaml:"cacheDir"`
+	// AllowStale serves lookups from an expired cache instead of rebuilding
+	// it from Spotify, e.g. when running offline
+	AllowStale bool `yaml:"allowStale"`
+	// Normalize lists the normalization steps applied, in order, to names
+	// when tracks are indexed and looked up. Names are compared as they are
+	// if empty.
+	Normalize []string `yaml:"normalize"`
+	// Collation is the locale, e.g. "tr" or "de", whose rules for comparing
+	// letters are applied along with Normalize. Names are compared without
+	// language-specific rules if empty.
+	Collation string `yaml:"collation"`
+	// IndexKey lists the fields, in order, of the composite key tracks are
+	// indexed under and the metadata matcher looks them up by: name, album,
+	// artists, isrc and duration. Defaults to name, album and artists.
+	IndexKey []string `yaml:"indexKey"`
+	// IndexDurationBucketSec is how many seconds wide the duration buckets
+	// of the index key are, default 5. Tracks match on duration if they fall
+	// in the same bucket.
+	IndexDurationBucketSec int `yaml:"indexDurationBucketSec"`
+	// SavedAlbums indexes the user's saved albums along with their saved
+	// tracks. It's set from duplicates.includeSavedAlbums rather than read
+	// from the cache config.
+	SavedAlbums bool `yaml:"-"`
+	// Progress is told how indexing the library is going. Defaults to a
+	// terminal progress bar.
+	Progress progress.Reporter `yaml:"-"`
+	// Audit, if set, records every time the cache is rebuilt from Spotify
+	Audit *audit.Log `yaml:"-"`
+	// Metrics, if set, is where the metrics of indexing the library are
+	// registered. Also read by the Spotify client and the cleaner, for
+	// theirs.
+	Metrics *metrics.Registry `yaml:"-"`
+	// FullRebuild re-downloads every saved track each time the cache
+	// expires. Otherwise only tracks saved since the cache was built are
+	// fetched and merged into it, unless tracks have been removed since.
+	FullRebuild bool `yaml:"fullRebuild"`
+	// IndexParallelism is how many pages of saved tracks are fetched at once
+	// when the whole library is indexed, default 4. 1 fetches them one after
+	// another.
+	IndexParallelism int `yaml:"indexParallelism"`
+	// EntityLifetimesNs overrides how long albums' labels, artists' genres
+	// and tracks looked up from Spotify are cached for, by kind:
+	// albumLabels, artistGenres and tracks. A kind cached for 0 isn't cached.
+	// Read by the Spotify client rather than the library.
+	EntityLifetimes map[string]time.Duration `yaml:"entityLifetimesNs"`
+	// Format is how the library is cached on disk: json, the default, or
+	// gob, a smaller file that loads faster.
+	Format string `yaml:"format"`
+	// Backend is where the library is cached: file, the default, a single
+	// file in Format, or bolt, an embedded database which only rewrites the
+	// tracks which changed, for large libraries.
+	Backend string `yaml:"backend"`
+	// WarmUp starts the service on whatever library is cached on disk,
+	// however stale, rebuilding it from Spotify in the background rather
+	// than before NewLibraryService returns. Set in server mode from
+	// server.warmUp.
+	WarmUp bool `yaml:"-"`
+}
+
+// storedLibraryVersion is the version of the StoredLibrary JSON schema.
+// Libraries cached before it was versioned stored whole Spotify saved tracks.
+const storedLibraryVersion = 1
+
+// StoredLibrary is a serialization type for storing a library on disk
+type StoredLibrary struct {
+	Version    int       `json:"version,omitempty"`
+	Expiration time.Time `json:"expiration,omitempty"`
+	// IndexedAt is when the tracks were fetched from Spotify
+	IndexedAt time.Time `json:"indexedAt,omitempty"`
+	Tracks    []Track   `json:"tracks,omitempty"`
+	// Albums are the user's saved albums, without their track listings. Nil
+	// if saved albums weren't indexed.
+	Albums []spotify.SavedAlbum `json:"albums"`
+}
+
+// NewStoredLibrary creates a new StoredLibrary with sensible defaults
+func NewStoredLibrary() *StoredLibrary {
+	return &StoredLibrary{
+		Expiration: time.Now(),
+		Tracks:     []Track{},
+	}
+}
+
+// SavedTracksAPI pages through the current user's saved tracks
+type SavedTracksAPI interface {
+	SavedTracks(ctx context.Context) (*spotify.SavedTrackPage, error)
+	NextSavedTracks(ctx context.Context, page *spotify.SavedTrackPage) error
+}
+
+// SavedAlbumsAPI pages through the current user's saved albums
+type SavedAlbumsAPI interface {
+	SavedAlbums(ctx context.Context) (*spotify.SavedAlbumPage, error)
+	NextSavedAlbums(ctx context.Context, page *spotify.SavedAlbumPage) error
+}
+
+// Service is everything a LibraryService offers: lookups of saved tracks,
+// search, and rebuilding and persisting the index. Callers needing only part
+// of it declare their own smaller interface, as dedupe.Library does.
+type Service interface {
+	GetByID(k spotify.ID) (*spotify.SavedTrack, error)
+	GetByISRC(isrc string) ([]*spotify.SavedTrack, error)
+	GetByArtistName(name string) ([]*spotify.SavedTrack, error)
+	GetByKey(t spotify.FullTrack) ([]*spotify.SavedTrack, error)
+	GetBySongAlbumArtistNames(songName, albumName string, artistNames []string) ([]*spotify.SavedTrack, error)
+	GetSavedAlbum(id spotify.ID) (*spotify.SavedAlbum, error)
+	Search(query, mode string, limit int) ([]SearchResult, error)
+	Status() IndexStatus
+	// Refresh rebuilds the index from Spotify and persists it
+	Refresh() error
+	// Persist writes the index to the cache directory
+	Persist() error
+}
+
+var _ Service = (*LibraryService)(nil)
+
+// LibraryService is responsible for interfacing with the potentials-utils local
+// spotify library
+type LibraryService struct {
+	CacheDir    string
+	CacheFile   string
+	store       Store
+	client      SavedTracksAPI
+	lifetime    time.Duration
+	allowStale  bool
+	savedAlbums bool
+	fullRebuild bool
+	parallelism int
+	// backoff is how long fetching pages first waits when rate limited,
+	// doubling on each retry
+	backoff    time.Duration
+	progress   progress.Reporter
+	normalizer *Normalizer
+	key        *IndexKey
+	// audit records cache rebuilds, nil if they aren't recorded
+	audit   *audit.Log
+	metrics *indexMetrics
+	// mu guards libraryIndex and warming, which change under lookups while
+	// the index is warmed up
+	mu           sync.RWMutex
+	libraryIndex *SpotifyLibraryIndex
+	// warming is closed once the rebuild started by WarmUp finishes, nil
+	// when no rebuild is running
+	warming chan struct{}
+}
+
+// NewLibraryService creates a new LibraryService instance backed by the given
+// authenticated client. The instance will attempt to build its cache from the
+// configured cache directory, falling back to the Spotify API.
+func NewLibraryService(client SavedTracksAPI, cfg CacheConfig) (*LibraryService, error) {
+	store, err := NewStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	normalizer, err := NewCollatingNormalizer(cfg.Normalize, cfg.Collation)
+	if err != nil {
+		return nil, err
+	}
+	key, err := cfg.NewIndexKey()
+	if err != nil {
+		return nil, err
+	}
+	libraryService := &LibraryService{
+		CacheDir:    cfg.CacheDir,
+		CacheFile:   store.Path(),
+		store:       store,
+		client:      client,
+		lifetime:    cfg.Lifetime,
+		allowStale:  cfg.AllowStale,
+		savedAlbums: cfg.SavedAlbums,
+		fullRebuild: cfg.FullRebuild,
+		parallelism: cfg.IndexParallelism,
+		backoff:     defaultBackoff,
+		progress:    cfg.Progress,
+		audit:       cfg.Audit,
+		metrics:     newIndexMetrics(cfg.Metrics),
+		normalizer:  normalizer,
+		key:         key,
+	}
+	if libraryService.progress == nil {
+		libraryService.progress = progress.NewBar()
+	}
+	if libraryService.parallelism <= 0 {
+		libraryService.parallelism = defaultParallelism
+	}
+	libraryService.libraryIndex = libraryService.newIndex()
+	if cfg.WarmUp {
+		if err := libraryService.indexFromCacheFile(); err != nil && !os.IsNotExist(err) {
+			log.WithFields(log.Fields{"err": err}).Warn("failed to build index from cache")
+		}
+		libraryService.WarmUp()
+		return libraryService, nil
+	}
+
+	err = libraryService.readyLibrary()
+	if err != nil {
+		return nil, err
+	}
+	err = libraryService.Persist()
+	if err != nil {
+		return nil, err
+	}
+	return libraryService, nil
+}
+
+// Persist writes the current index to the cache file, so the next service
+// started on the same cache directory can build its index without calling
+// Spotify. A library cached in another backend or format is replaced.
+func (s *LibraryService) Persist() error {
+	index := s.index()
+	storedLibrary := NewStoredLibrary()
+	storedLibrary.Expiration = index.evictionTime
+	storedLibrary.IndexedAt = index.indexedAt
+	storedLibrary.Albums = index.albums
+	for _, v := range index.tracksByID {
+		storedLibrary.Tracks = append(storedLibrary.Tracks, NewTrack(*v))
+	}
+	if err := s.store.Save(storedLibrary); err != nil {
+		return err
+	}
+	for _, other := range stores(s.CacheDir) {
+		if other.Path() == s.store.Path() {
+			continue
+		}
+		if err := os.Remove(other.Path()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// index returns the current library index
+func (s *LibraryService) index() *SpotifyLibraryIndex {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.libraryIndex
+}
+
+func (s *LibraryService) setIndex(index *SpotifyLibraryIndex) {
+	s.mu.Lock()
+	s.libraryIndex = index
+	s.mu.Unlock()
+}
+
+func (s *LibraryService) readyLibrary() error {
+	if s.servingWarm() {
+		return nil
+	}
+	if s.index().Alive() || s.usableStale() {
+		log.Debug("Library index is fresh.")
+		return nil
+	}
+	log.Debug("Library index is not fresh, attempting to build from local cache.")
+	if err := s.indexFromCacheFile(); err != nil {
+		log.WithFields(log.Fields{"err": err}).Warn("failed to build index from cache")
+	}
+	if s.index().Alive() {
+		s.metrics.cacheRequests.Inc("hit")
+		log.Info("built a fresh library index from disk cache.")
+		return nil
+	} else if s.usableStale() {
+		s.metrics.cacheRequests.Inc("hit")
+		log.WithFields(log.Fields{"expiredAt": s.index().evictionTime}).Warn("using a stale library index from disk cache")
+		return nil
+	} else {
+		s.metrics.cacheRequests.Inc("miss")
+		log.WithFields(log.Fields{"cacheFile": s.CacheFile}).Warn("failed to build a fresh index from local disk cache")
+		log.Info("Attempting to build cache from Spotify API...")
+		if err := s.indexFromSpotify(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// usableStale returns true if a stale index may be used instead of being
+// rebuilt
+func (s *LibraryService) usableStale() bool {
+	return s.allowStale && s.index().Len() > 0
+}
+
+// indexMetrics are the metrics of indexing the library, exposed by a running
+// server
+type indexMetrics struct {
+	buildDuration *metrics.Histogram
+	cacheRequests *metrics.Counter
+}
+
+func newIndexMetrics(r *metrics.Registry) *indexMetrics {
+	return &indexMetrics{
+		buildDuration: r.NewHistogram("potentials_library_index_build_duration_seconds", "How long rebuilding the library index from Spotify took, by kind: full or incremental.", []float64{1, 5, 15, 30, 60, 120, 300, 600}, "kind"),
+		cacheRequests: r.NewCounter("potentials_library_cache_requests_total", "Times the library index was read from the library cache, by result: hit, or miss if it had to be rebuilt from Spotify.", "result"),
+	}
+}
+
+func (s *LibraryService) indexFromSpotify() (err error) {
+	ctx, span := tracing.Start(context.Background(), "library.indexFromSpotify")
+	start := time.Now()
+	kind := "full"
+	defer func() {
+		if err == nil {
+			s.metrics.buildDuration.Observe(time.Since(start).Seconds(), kind)
+			s.audit.RecordOrWarn(audit.Event{Kind: audit.CacheRebuild, Detail: fmt.Sprintf("%s, %d tracks", kind, s.index().Len())})
+		}
+		span.RecordError(err)
+		span.End()
+	}()
+	tracks, incremental, err := s.fetchTracks(ctx)
+	if err != nil {
+		return err
+	}
+	if incremental {
+		kind = "incremental"
+	}
+	span.SetAttribute("incremental", incremental)
+	// Warm start from the stale index, if any, so only new or changed tracks
+	// are normalized again
+	index, reused := s.index().Rebuild(tracks)
+	if s.savedAlbums {
+		albums, err := s.fetchSavedAlbums(ctx)
+		if err != nil {
+			return err
+		}
+		index.IndexAlbums(albums)
+		span.SetAttribute("albums", len(albums))
+	}
+	log.WithFields(log.Fields{"tracks": index.Len(), "albums": len(index.albums), "reused": reused}).Debug("rebuilt library index")
+	span.SetAttribute("tracks", index.Len())
+	span.SetAttribute("reused", reused)
+	index.MakeItFresh()
+	s.setIndex(index)
+	return nil
+}
+
+// fetchTracks fetches the user's saved tracks. Unless full rebuilds are
+// configured, only those saved since the newest track in the current index
+// are fetched and merged into it, falling back to fetching every track if
+// the index doesn't know when its tracks were saved, or tracks have been
+// removed from the library since.
+// Returns whether the tracks were merged.
+func (s *LibraryService) fetchTracks(ctx context.Context) ([]spotify.SavedTrack, bool, error) {
+	if !s.fullRebuild && !s.index().newestAddedAt().IsZero() {
+		tracks, ok, err := s.fetchNewTracks(ctx)
+		if err != nil || ok {
+			return tracks, ok, err
+		}
+		log.Info("tracks have been removed from the library since it was indexed, fetching all of it")
+	}
+	tracks, err := s.fetchAllTracks(ctx)
+	return tracks, false, err
+}
+
+// fetchAllTracks pages through every saved track
+func (s *LibraryService) fetchAllTracks(ctx context.Context) ([]spotify.SavedTrack, error) {
+	log.Info("Rebuilding Spotify library index...")
+	_, pageSpan := tracing.Start(ctx, "spotify.CurrentUsersTracks")
+	trackPager, err := s.client.SavedTracks(ctx)
+	pageSpan.RecordError(err)
+	pageSpan.End()
+	if err != nil {
+		return nil, err
+	}
+	indexing := progress.Start(s.progress, "index", int(trackPager.Total))
+	if client, ok := s.client.(SavedTracksPagesAPI); ok && s.parallelism > 1 {
+		tracks, err := s.fetchPages(ctx, client, trackPager, indexing)
+		if err != nil {
+			return nil, err
+		}
+		indexing.Finish()
+		return tracks, nil
+	}
+	tracks := make([]spotify.SavedTrack, 0, trackPager.Total)
+	for {
+		tracks = append(tracks, trackPager.Tracks...)
+		_, pageSpan := tracing.Start(ctx, "spotify.NextPage")
+		err := s.client.NextSavedTracks(ctx, trackPager)
+		if err != spotify.ErrNoMorePages {
+			pageSpan.RecordError(err)
+		}
+		pageSpan.End()
+		if err != nil {
+			if err != spotify.ErrNoMorePages {
+				return nil, err
+			}
+			break
+		}
+		indexing.Add(int(trackPager.Limit))
+	}
+	indexing.Finish()
+	return tracks, nil
+}
+
+// fetchNewTracks pages through the saved tracks, which Spotify lists most
+// recently saved first, until reaching one saved no later than the newest
+// track in the current index, and merges those before it into the index's
+// tracks. Returns false if the merged tracks don't add up to the library's
+// total, i.e. tracks have been removed since.
+func (s *LibraryService) fetchNewTracks(ctx context.Context) ([]spotify.SavedTrack, bool, error) {
+	index := s.index()
+	newest := index.newestAddedAt()
+	log.WithFields(log.Fields{"since": newest}).Info("Updating Spotify library index with newly saved tracks...")
+	_, pageSpan := tracing.Start(ctx, "spotify.CurrentUsersTracks")
+	trackPager, err := s.client.SavedTracks(ctx)
+	pageSpan.RecordError(err)
+	pageSpan.End()
+	if err != nil {
+		return nil, false, err
+	}
+	added := []spotify.SavedTrack{}
+	for caughtUp := false; !caughtUp; {
+		for _, t := range trackPager.Tracks {
+			addedAt, err := time.Parse(spotify.TimestampLayout, t.AddedAt)
+			// Timestamps only go down to the second, so tracks saved in the
+			// same second as the newest indexed may be new too. Those which
+			// aren't are deduplicated by merge.
+			if caughtUp = err != nil || addedAt.Before(newest); caughtUp {
+				break
+			}
+			added = append(added, t)
+		}
+		if caughtUp {
+			break
+		}
+		_, pageSpan := tracing.Start(ctx, "spotify.NextPage")
+		err := s.client.NextSavedTracks(ctx, trackPager)
+		if err != spotify.ErrNoMorePages {
+			pageSpan.RecordError(err)
+		}
+		pageSpan.End()
+		if err == spotify.ErrNoMorePages {
+			break
+		} else if err != nil {
+			return nil, false, err
+		}
+	}
+	tracks := index.merge(added)
+	log.WithFields(log.Fields{"added": len(added), "tracks": len(tracks), "total": trackPager.Total}).Debug("fetched newly saved tracks")
+	return tracks, len(tracks) == int(trackPager.Total), nil
+}
+
+// fetchSavedAlbums pages through the user's saved albums, dropping their track
+// listings, which duplicate detection doesn't need
+func (s *LibraryService) fetchSavedAlbums(ctx context.Context) ([]spotify.SavedAlbum, error) {
+	client, ok := s.client.(SavedAlbumsAPI)
+	if !ok {
+		return nil, errors.New("library client can't list saved albums")
+	}
+	_, pageSpan := tracing.Start(ctx, "spotify.CurrentUsersAlbums")
+	albumPager, err := client.SavedAlbums(ctx)
+	pageSpan.RecordError(err)
+	pageSpan.End()
+	if err != nil {
+		return nil, err
+	}
+	albums := make([]spotify.SavedAlbum, 0, albumPager.Total)
+	for {
+		for _, a := range albumPager.Albums {
+			a.Tracks = spotify.SimpleTrackPage{}
+			albums = append(albums, a)
+		}
+		if err := client.NextSavedAlbums(ctx, albumPager); err == spotify.ErrNoMorePages {
+			return albums, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// newIndex creates an empty index normalizing names as configured
+func (s *LibraryService) newIndex() *SpotifyLibraryIndex {
+	index := NewSpotifyLibraryIndex(s.lifetime)
+	index.SetNormalizer(s.normalizer)
+	index.SetIndexKey(s.key)
+	return index
+}
+
+// IndexKey returns the key the library index holds t under, or would
+func (s *LibraryService) IndexKey(t spotify.FullTrack) string {
+	return s.key.Key(s.normalizer, t)
+}
+
+// KeyFields returns the fields the library index key is made of
+func (s *LibraryService) KeyFields() []string {
+	return s.key.Fields()
+}
+
+// Normalize normalizes a name as the library index does
+func (s *LibraryService) Normalize(name string) string {
+	return s.normalizer.Normalize(name)
+}
+
+// LoadStoredLibrary reads the library cached in cacheDir, without checking
+// whether it has expired
+func LoadStoredLibrary(cacheDir string) (*StoredLibrary, error) {
+	return OpenStore(cacheDir).Load()
+}
+
+// ExpireStoredLibrary marks the library cached in cacheDir as expired, so it's
+// fetched from Spotify again the next time it's used, e.g. once tracks have
+// been saved or removed behind its back. Does nothing if nothing is cached.
+func ExpireStoredLibrary(cacheDir string) error {
+	store := OpenStore(cacheDir)
+	stored, err := store.Load()
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	stored.Expiration = time.Now()
+	return store.Save(stored)
+}
+
+func (s *LibraryService) indexFromCacheFile() error {
+	index := s.newIndex()
+	storedLibrary, err := s.store.Load()
+	if os.IsNotExist(err) {
+		// Read the library cached before the backend or format was changed
+		storedLibrary, err = OpenStore(s.CacheDir).Load()
+	}
+	if err != nil {
+		return err
+	}
+	if s.savedAlbums && storedLibrary.Albums == nil {
+		return errors.New("cached library has no saved albums")
+	}
+	index.IndexTracks(storedLibrary.SavedTracks())
+	if storedLibrary.Albums != nil {
+		index.IndexAlbums(storedLibrary.Albums)
+	}
+	index.evictionTime = storedLibrary.Expiration
+	index.indexedAt = storedLibrary.IndexedAt
+	s.setIndex(index)
+	return nil
+}
+
+// IndexedAt returns when the library was last fetched from Spotify, first
+// rebuilding the index if stale
+func (s *LibraryService) IndexedAt() (time.Time, error) {
+	if err := s.readyLibrary(); err != nil {
+		return time.Time{}, err
+	}
+	return s.index().indexedAt, nil
+}
+
+// GetByID returns the corresponding SavedTrack for the provided key if it exists and the cache is
+// fresh. Will rebuild the cache if stale.
+func (s *LibraryService) GetByID(k spotify.ID) (*spotify.SavedTrack, error) {
+	err := s.readyLibrary()
+	if err != nil {
+		return nil, err
+	}
+	return s.index().GetByID(k)
+}
+
+// GetSavedAlbum returns the saved album with the given ID, or nil if there is
+// none or saved albums aren't indexed. Will rebuild the cache if stale.
+func (s *LibraryService) GetSavedAlbum(id spotify.ID) (*spotify.SavedAlbum, error) {
+	err := s.readyLibrary()
+	if err != nil {
+		return nil, err
+	}
+	return s.index().GetSavedAlbum(id)
+}
+
+// GetByISRC returns every saved track with the given International Standard
+// Recording Code. Will rebuild the cache if stale.
+func (s *LibraryService) GetByISRC(isrc string) ([]*spotify.SavedTrack, error) {
+	err := s.readyLibrary()
+	if err != nil {
+		return nil, err
+	}
+	return s.index().GetByISRC(isrc)
+}
+
+// GetByArtistName returns every saved track credited to the named artist,
+// ignoring case. Will rebuild the cache if stale.
+func (s *LibraryService) GetByArtistName(name string) ([]*spotify.SavedTrack, error) {
+	err := s.readyLibrary()
+	if err != nil {
+		return nil, err
+	}
+	return s.index().GetByArtistName(name)
+}
+
+// GetByKey returns every saved track with the same index key as t. Will
+// rebuild the cache if stale.
+func (s *LibraryService) GetByKey(t spotify.FullTrack) ([]*spotify.SavedTrack, error) {
+	err := s.readyLibrary()
+	if err != nil {
+		return nil, err
+	}
+	return s.index().GetByKey(t)
+}
+
+// GetBySongAlbumArtistNames gets all tracks with the same song name, artist name,
+// and album title. Will rebuild cache if stale.
+func (s *LibraryService) GetBySongAlbumArtistNames(songName, albumName string, artistNames []string) ([]*spotify.SavedTrack, error) {
+	err := s.readyLibrary()
+	if err != nil {
+		return nil, err
+	}
+	return s.index().GetBySongAlbumArtistNames(songName, albumName, artistNames)
+}
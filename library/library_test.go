@@ -0,0 +1,147 @@
+package library
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"potentials-utils/spotifyclient"
+	"potentials-utils/spotifytest"
+)
+
+// libraryRequests counts the saved tracks pages fetched from srv
+func libraryRequests(srv *spotifytest.Server) int {
+	n := 0
+	for _, r := range srv.Requests() {
+		if strings.HasPrefix(r, "GET /v1/me/tracks") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestIncrementalUpdate(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	saved := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for ix := 0; ix < 30; ix++ {
+		srv.SaveTracksAt(saved.Add(time.Duration(ix)*time.Second), spotifytest.Track(fmt.Sprintf("t%d", ix), fmt.Sprintf("Song %d", ix), "Album", "Artist"))
+	}
+	dir, err := ioutil.TempDir("", "library")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := spotifyclient.New(srv.HTTPClient())
+	// Cache a library which is stale straight away
+	if _, err := NewLibraryService(client, CacheConfig{CacheDir: dir, Lifetime: time.Nanosecond}); err != nil {
+		t.Fatal(err)
+	}
+	if pages := libraryRequests(srv); pages != 2 {
+		t.Fatalf("expected the first index to fetch both pages, got %d", pages)
+	}
+
+	srv.SaveTracksAt(saved.Add(24*time.Hour), spotifytest.Track("n1", "New Song", "Album", "Artist"))
+	lib, err := NewLibraryService(client, CacheConfig{CacheDir: dir, Lifetime: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pages := libraryRequests(srv); pages != 3 {
+		t.Errorf("expected only the first page fetched for newly saved tracks, got %d pages in all", pages)
+	}
+	if status := lib.Status(); status.Tracks != 31 {
+		t.Errorf("expected 31 tracks merged, got %d", status.Tracks)
+	}
+	if track, err := lib.GetByID("n1"); err != nil || track == nil {
+		t.Errorf("expected the newly saved track indexed, got %v, %v", track, err)
+	}
+
+	if err := ExpireStoredLibrary(dir); err != nil {
+		t.Fatal(err)
+	}
+	srv.RemoveSavedTracks("t0")
+	srv.SaveTracksAt(saved.Add(48*time.Hour), spotifytest.Track("n2", "Newer Song", "Album", "Artist"))
+	lib, err = NewLibraryService(client, CacheConfig{CacheDir: dir, Lifetime: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pages := libraryRequests(srv); pages != 6 {
+		t.Errorf("expected a removal to fall back to fetching every page, got %d pages in all", pages)
+	}
+	if status := lib.Status(); status.Tracks != 31 {
+		t.Errorf("expected 31 tracks after the removal, got %d", status.Tracks)
+	}
+	if track, err := lib.GetByID("t0"); err != nil || track != nil {
+		t.Errorf("expected the removed track dropped, got %v, %v", track, err)
+	}
+}
+
+func TestIncrementalUpdateSameSecond(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	saved := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	srv.SaveTracksAt(saved, spotifytest.Track("t1", "Song", "Album", "Artist"))
+	dir, err := ioutil.TempDir("", "library")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := spotifyclient.New(srv.HTTPClient())
+	if _, err := NewLibraryService(client, CacheConfig{CacheDir: dir, Lifetime: time.Nanosecond}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Saved in the same second as the newest track already indexed
+	srv.SaveTracksAt(saved, spotifytest.Track("t2", "Other Song", "Album", "Artist"))
+	lib, err := NewLibraryService(client, CacheConfig{CacheDir: dir, Lifetime: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pages := libraryRequests(srv); pages != 2 {
+		t.Errorf("expected the track merged without fetching the library again, got %d pages in all", pages)
+	}
+	if status := lib.Status(); status.Tracks != 2 {
+		t.Errorf("expected 2 tracks indexed, got %d", status.Tracks)
+	}
+	if track, err := lib.GetByID("t2"); err != nil || track == nil {
+		t.Errorf("expected the track saved in the same second indexed, got %v, %v", track, err)
+	}
+}
+
+func TestPersist(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	srv.AddSavedTracks(spotifytest.Track("t1", "Song", "Album", "Artist"))
+	dir, err := ioutil.TempDir("", "library")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := spotifyclient.New(srv.HTTPClient())
+	var lib Service
+	if lib, err = NewLibraryService(client, CacheConfig{CacheDir: dir, Lifetime: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	srv.AddSavedTracks(spotifytest.Track("t2", "Other Song", "Album", "Artist"))
+	if err := lib.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lib.Persist(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new service on the same cache reads the persisted index
+	pages := libraryRequests(srv)
+	if lib, err = NewLibraryService(client, CacheConfig{CacheDir: dir, Lifetime: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if got := libraryRequests(srv); got != pages {
+		t.Errorf("expected the persisted index read without calling Spotify, got %d more requests", got-pages)
+	}
+	if track, err := lib.GetByID("t2"); err != nil || track == nil {
+		t.Errorf("expected the refreshed track persisted, got %v, %v", track, err)
+	}
+}
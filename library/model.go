@@ -0,0 +1,118 @@
+package library
+
+import (
+	"github.com/zmb3/spotify/v2"
+)
+
+// Track is the part of a saved track potentials-utils uses: what matchers,
+// filters and reports look at. Saved tracks are trimmed down to it as they're
+// indexed, and it's what the library is cached as, so the cache doesn't
+// depend on the Spotify client's structs.
+type Track struct {
+	AddedAt    string        `json:"addedAt"`
+	ID         spotify.ID    `json:"id"`
+	Name       string        `json:"name"`
+	URI        spotify.URI   `json:"uri"`
+	Duration   int           `json:"durationMs"`
+	Popularity int           `json:"popularity"`
+	Explicit   bool          `json:"explicit,omitempty"`
+	ISRC       string        `json:"isrc,omitempty"`
+	Artists    []TrackArtist `json:"artists"`
+	Album      TrackAlbum    `json:"album"`
+}
+
+// TrackAlbum is the part of a track's album potentials-utils uses
+type TrackAlbum struct {
+	ID          spotify.ID    `json:"id"`
+	Name        string        `json:"name"`
+	AlbumType   string        `json:"albumType,omitempty"`
+	ReleaseDate string        `json:"releaseDate,omitempty"`
+	Artists     []TrackArtist `json:"artists"`
+}
+
+// TrackArtist is an artist credited on a track or album
+type TrackArtist struct {
+	ID   spotify.ID `json:"id"`
+	Name string     `json:"name"`
+}
+
+// NewTrack returns the part of t potentials-utils uses
+func NewTrack(t spotify.SavedTrack) Track {
+	return Track{
+		AddedAt:    t.AddedAt,
+		ID:         t.ID,
+		Name:       t.Name,
+		URI:        t.URI,
+		Duration:   int(t.Duration),
+		Popularity: int(t.Popularity),
+		Explicit:   t.Explicit,
+		ISRC:       t.ExternalIDs["isrc"],
+		Artists:    newTrackArtists(t.Artists),
+		Album: TrackAlbum{
+			ID:          t.Album.ID,
+			Name:        t.Album.Name,
+			AlbumType:   t.Album.AlbumType,
+			ReleaseDate: t.Album.ReleaseDate,
+			Artists:     newTrackArtists(t.Album.Artists),
+		},
+	}
+}
+
+func newTrackArtists(artists []spotify.SimpleArtist) []TrackArtist {
+	if len(artists) == 0 {
+		return nil
+	}
+	trimmed := make([]TrackArtist, 0, len(artists))
+	for _, a := range artists {
+		trimmed = append(trimmed, TrackArtist{ID: a.ID, Name: a.Name})
+	}
+	return trimmed
+}
+
+// SavedTrack returns the track as a saved track, with only the fields
+// potentials-utils uses set
+func (t Track) SavedTrack() spotify.SavedTrack {
+	s := spotify.SavedTrack{AddedAt: t.AddedAt}
+	s.ID = t.ID
+	s.Name = t.Name
+	s.URI = t.URI
+	s.Duration = spotify.Numeric(t.Duration)
+	s.Popularity = spotify.Numeric(t.Popularity)
+	s.Explicit = t.Explicit
+	if t.ISRC != "" {
+		s.ExternalIDs = map[string]string{"isrc": t.ISRC}
+	}
+	s.Artists = simpleArtists(t.Artists)
+	s.Album.ID = t.Album.ID
+	s.Album.Name = t.Album.Name
+	s.Album.AlbumType = t.Album.AlbumType
+	s.Album.ReleaseDate = t.Album.ReleaseDate
+	s.Album.Artists = simpleArtists(t.Album.Artists)
+	return s
+}
+
+func simpleArtists(trimmed []TrackArtist) []spotify.SimpleArtist {
+	if len(trimmed) == 0 {
+		return nil
+	}
+	artists := make([]spotify.SimpleArtist, 0, len(trimmed))
+	for _, a := range trimmed {
+		artists = append(artists, spotify.SimpleArtist{ID: a.ID, Name: a.Name})
+	}
+	return artists
+}
+
+// trim drops the fields of t potentials-utils doesn't use, e.g. the markets
+// it's available in, which otherwise take up most of a saved track's memory
+func trim(t spotify.SavedTrack) spotify.SavedTrack {
+	return NewTrack(t).SavedTrack()
+}
+
+// SavedTracks returns the stored tracks as saved tracks
+func (l *StoredLibrary) SavedTracks() []spotify.SavedTrack {
+	tracks := make([]spotify.SavedTrack, 0, len(l.Tracks))
+	for _, t := range l.Tracks {
+		tracks = append(tracks, t.SavedTrack())
+	}
+	return tracks
+}
@@ -0,0 +1,37 @@
+package library
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"potentials-utils/spotifytest"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+func TestIndexTrimsTracks(t *testing.T) {
+	full := spotifytest.Track("t1", "Song", "Album", "Artist")
+	full.ExternalIDs = map[string]string{"isrc": "ISRC1"}
+	full.AvailableMarkets = []string{"GB", "US"}
+	full.Album.AvailableMarkets = full.AvailableMarkets
+	full.PreviewURL = "https://p.scdn.co/mp3-preview/t1"
+	full.Duration = 180000
+	saved := spotify.SavedTrack{AddedAt: "2020-01-01T00:00:00Z", FullTrack: full}
+
+	index := NewSpotifyLibraryIndex(time.Hour)
+	index.IndexTracks([]spotify.SavedTrack{saved})
+	got, _ := index.GetByID("t1")
+	if got == nil {
+		t.Fatal("expected t1 indexed")
+	}
+	if got.AvailableMarkets != nil || got.Album.AvailableMarkets != nil || got.PreviewURL != "" {
+		t.Errorf("expected the fields no matcher uses dropped, got %+v", got)
+	}
+	if !reflect.DeepEqual(NewTrack(*got), NewTrack(saved)) {
+		t.Errorf("expected the fields matchers use kept, got %+v", NewTrack(*got))
+	}
+	if isrc, _ := index.GetByISRC("ISRC1"); len(isrc) != 1 {
+		t.Errorf("expected t1 looked up by ISRC, got %v", isrc)
+	}
+}
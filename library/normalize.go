@@ -0,0 +1,174 @@
+package library
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Normalization steps, applied to track, album and artist names in the order
+// they're configured
+const (
+	// NormalizeCase folds names to lower case
+	NormalizeCase = "case"
+	// NormalizeUnicode replaces typographic quotes and dashes with their
+	// ASCII equivalents and strips accents from Latin letters
+	NormalizeUnicode = "unicode"
+	// NormalizeSuffixes strips version suffixes such as " - Remastered 2011"
+	// and "(Live)"
+	NormalizeSuffixes = "suffixes"
+	// NormalizeFeat strips featured artist credits such as "(feat. Someone)"
+	NormalizeFeat = "feat"
+	// NormalizePunctuation strips everything but letters, digits and
+	// whitespace
+	NormalizePunctuation = "punctuation"
+	// NormalizeSpace trims names and collapses runs of whitespace
+	NormalizeSpace = "space"
+)
+
+// FuzzySteps are every normalization step, in the order fuzzy matching
+// applies them
+var FuzzySteps = []string{NormalizeUnicode, NormalizeFeat, NormalizeSuffixes, NormalizeCase, NormalizePunctuation, NormalizeSpace}
+
+var (
+	// versionSuffix matches a trailing " - ..." or bracketed version
+	// description
+	versionSuffix = regexp.MustCompile(`(?i)(\s+-\s+[^-]*(remaster|version|edit|mix|mono|stereo|live|demo|acoustic|instrumental|deluxe|edition|bonus)[^-]*|\s*[(\[][^)\]]*(remaster|version|edit|mix|mono|stereo|live|demo|acoustic|instrumental|deluxe|edition|bonus)[^)\]]*[)\]])\s*$`)
+	// featuring matches a featured artist credit, bracketed or not, up to the
+	// end of the name or the next bracket
+	featuring  = regexp.MustCompile(`(?i)\s*([(\[]\s*(feat\.?|ft\.?|featuring)\s[^)\]]*[)\]]|\s(feat\.?|ft\.?|featuring)\s[^(\[]*)`)
+	whitespace = regexp.MustCompile(`\s+`)
+	// unicodeFolds maps characters NormalizeUnicode replaces
+	unicodeFolds = strings.NewReplacer(
+		"‘", "'", "’", "'", "‚", "'", "′", "'",
+		"“", "\"", "”", "\"", "„", "\"", "″", "\"",
+		"‐", "-", "‑", "-", "‒", "-", "–", "-", "—", "-", "―", "-",
+		"…", "...", " ", " ",
+		"à", "a", "á", "a", "â", "a", "ã", "a", "ä", "a", "å", "a", "ā", "a",
+		"À", "A", "Á", "A", "Â", "A", "Ã", "A", "Ä", "A", "Å", "A", "Ā", "A",
+		"ç", "c", "ć", "c", "č", "c", "Ç", "C", "Ć", "C", "Č", "C",
+		"è", "e", "é", "e", "ê", "e", "ë", "e", "ē", "e", "ě", "e",
+		"È", "E", "É", "E", "Ê", "E", "Ë", "E", "Ē", "E", "Ě", "E",
+		"ì", "i", "í", "i", "î", "i", "ï", "i", "ī", "i",
+		"Ì", "I", "Í", "I", "Î", "I", "Ï", "I", "Ī", "I",
+		"ñ", "n", "ń", "n", "ň", "n", "Ñ", "N", "Ń", "N", "Ň", "N",
+		"ò", "o", "ó", "o", "ô", "o", "õ", "o", "ö", "o", "ø", "o", "ō", "o",
+		"Ò", "O", "Ó", "O", "Ô", "O", "Õ", "O", "Ö", "O", "Ø", "O", "Ō", "O",
+		"ù", "u", "ú", "u", "û", "u", "ü", "u", "ū", "u", "ů", "u",
+		"Ù", "U", "Ú", "U", "Û", "U", "Ü", "U", "Ū", "U", "Ů", "U",
+		"ý", "y", "ÿ", "y", "Ý", "Y",
+		"ř", "r", "Ř", "R", "š", "s", "ś", "s", "Š", "S", "Ś", "S",
+		"ž", "z", "ź", "z", "ż", "z", "Ž", "Z", "Ź", "Z", "Ż", "Z",
+		"ł", "l", "Ł", "L", "ß", "ss",
+	)
+	normalizeSteps = map[string]func(string) string{
+		NormalizeCase:        strings.ToLower,
+		NormalizeUnicode:     unicodeFolds.Replace,
+		NormalizeSuffixes:    func(s string) string { return versionSuffix.ReplaceAllString(s, "") },
+		NormalizeFeat:        func(s string) string { return featuring.ReplaceAllString(s, "") },
+		NormalizePunctuation: stripPunctuation,
+		NormalizeSpace:       func(s string) string { return strings.TrimSpace(whitespace.ReplaceAllString(s, " ")) },
+	}
+	scandinavianFolds = strings.NewReplacer("æ", "ae", "ø", "oe", "å", "aa", "Æ", "AE", "Ø", "OE", "Å", "AA")
+	turkishCase       = func(s string) string { return strings.ToLowerSpecial(unicode.TurkishCase, s) }
+	// collations maps a language to the rules for comparing names in it
+	collations = map[string]collation{
+		// German treats ß as ss and an umlaut as the vowel followed by e, so
+		// "Müller" and "Mueller" are the same name
+		"de": {fold: strings.NewReplacer("ß", "ss", "ẞ", "SS", "ä", "ae", "ö", "oe", "ü", "ue", "Ä", "AE", "Ö", "OE", "Ü", "UE")},
+		"da": {fold: scandinavianFolds},
+		"nb": {fold: scandinavianFolds},
+		"nn": {fold: scandinavianFolds},
+		"no": {fold: scandinavianFolds},
+		"nl": {fold: strings.NewReplacer("ĳ", "ij", "Ĳ", "IJ")},
+		// Turkish and Azeri lower I to dotless ı and dotted İ to i
+		"tr": {lower: turkishCase},
+		"az": {lower: turkishCase},
+	}
+)
+
+// stripPunctuation drops every rune which isn't a letter, digit or space
+func stripPunctuation(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsSpace(r) {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// collation holds the language-specific rules a Normalizer applies
+type collation struct {
+	// fold replaces letters with their equivalents before any other step
+	fold *strings.Replacer
+	// lower replaces strings.ToLower in the case step
+	lower func(string) string
+}
+
+// Normalizer is an ordered pipeline of normalization steps. The library index
+// normalizes names with the same Normalizer when indexing tracks and when
+// looking them up, so the two always agree. A nil Normalizer leaves names
+// unchanged.
+type Normalizer struct {
+	steps []func(string) string
+}
+
+// NewNormalizer creates a Normalizer applying the named steps in order
+func NewNormalizer(steps []string) (*Normalizer, error) {
+	return NewCollatingNormalizer(steps, "")
+}
+
+// NewCollatingNormalizer creates a Normalizer applying the named steps in
+// order using the collation rules of locale, e.g. "tr" or "de-AT". Letters the
+// locale treats as equivalent are folded before the first step, and the case
+// step follows the locale's case mapping. An empty locale has no special
+// rules.
+func NewCollatingNormalizer(steps []string, locale string) (*Normalizer, error) {
+	n := &Normalizer{}
+	var coll collation
+	if locale != "" {
+		language := strings.ToLower(locale)
+		if ix := strings.IndexAny(language, "-_"); ix >= 0 {
+			language = language[:ix]
+		}
+		var ok bool
+		if coll, ok = collations[language]; !ok {
+			return nil, fmt.Errorf("unsupported collation locale %q", locale)
+		}
+	}
+	if coll.fold != nil {
+		n.steps = append(n.steps, coll.fold.Replace)
+	}
+	for _, name := range steps {
+		step, ok := normalizeSteps[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown normalization step %q", name)
+		}
+		if name == NormalizeCase && coll.lower != nil {
+			step = coll.lower
+		}
+		n.steps = append(n.steps, step)
+	}
+	return n, nil
+}
+
+// Normalize applies every step to name in turn
+func (n *Normalizer) Normalize(name string) string {
+	if n == nil {
+		return name
+	}
+	for _, step := range n.steps {
+		name = step(name)
+	}
+	return name
+}
+
+// NormalizeAll normalizes each of names, returning a new slice
+func (n *Normalizer) NormalizeAll(names []string) []string {
+	normalized := make([]string, 0, len(names))
+	for _, name := range names {
+		normalized = append(normalized, n.Normalize(name))
+	}
+	return normalized
+}
@@ -0,0 +1,177 @@
+package library
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"potentials-utils/progress"
+	"potentials-utils/tracing"
+
+	"github.com/apex/log"
+	"github.com/zmb3/spotify/v2"
+)
+
+const (
+	// defaultParallelism is how many pages of saved tracks are fetched at
+	// once unless configured otherwise
+	defaultParallelism = 4
+	// defaultBackoff is how long fetching pages first waits when rate
+	// limited
+	defaultBackoff = time.Second
+	// maxRetries is how many times a rate limited page is retried before
+	// indexing fails
+	maxRetries = 6
+)
+
+// SavedTracksPagesAPI fetches pages of the current user's saved tracks by
+// offset, so they can be fetched concurrently
+type SavedTracksPagesAPI interface {
+	SavedTracksAt(ctx context.Context, offset, limit int) (*spotify.SavedTrackPage, error)
+}
+
+// fetchPages fetches the saved tracks following the first page, with
+// s.parallelism workers each requesting pages by offset, and returns every
+// saved track in the library's order
+func (s *LibraryService) fetchPages(ctx context.Context, client SavedTracksPagesAPI, first *spotify.SavedTrackPage, indexing *progress.Task) ([]spotify.SavedTrack, error) {
+	limit := int(first.Limit)
+	if limit <= 0 {
+		limit = len(first.Tracks)
+	}
+	pages := [][]spotify.SavedTrack{first.Tracks}
+	if limit > 0 {
+		for offset := int(first.Offset) + limit; offset < int(first.Total); offset += limit {
+			pages = append(pages, nil)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		page   int
+		tracks []spotify.SavedTrack
+		err    error
+	}
+	work := make(chan int)
+	results := make(chan result)
+	limiter := &rateLimiter{backoff: s.backoff}
+	var wg sync.WaitGroup
+	for w := 0; w < s.parallelism && w < len(pages)-1; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for page := range work {
+				offset := int(first.Offset) + page*limit
+				fetched, err := limiter.fetch(ctx, func() (*spotify.SavedTrackPage, error) {
+					_, pageSpan := tracing.Start(ctx, "spotify.CurrentUsersTracks")
+					defer pageSpan.End()
+					pageSpan.SetAttribute("offset", offset)
+					fetched, err := client.SavedTracksAt(ctx, offset, limit)
+					pageSpan.RecordError(err)
+					return fetched, err
+				})
+				r := result{page: page, err: err}
+				if err == nil {
+					r.tracks = fetched.Tracks
+				}
+				select {
+				case results <- r:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		defer close(work)
+		for page := 1; page < len(pages); page++ {
+			select {
+			case work <- page:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	for r := range results {
+		if r.err != nil {
+			return nil, r.err
+		}
+		pages[r.page] = r.tracks
+		indexing.Add(len(r.tracks))
+	}
+	tracks := make([]spotify.SavedTrack, 0, first.Total)
+	for _, page := range pages {
+		tracks = append(tracks, page...)
+	}
+	return tracks, nil
+}
+
+// rateLimiter retries requests Spotify rate limits, backing off exponentially,
+// and holds back every request sharing it until the wait is over, so workers
+// don't keep hitting the limit together
+type rateLimiter struct {
+	backoff time.Duration
+
+	mu    sync.Mutex
+	until time.Time
+}
+
+// fetch calls get, retrying it after a backoff while it's rate limited
+func (l *rateLimiter) fetch(ctx context.Context, get func() (*spotify.SavedTrackPage, error)) (*spotify.SavedTrackPage, error) {
+	wait := l.backoff
+	for attempt := 0; ; attempt++ {
+		if err := l.wait(ctx); err != nil {
+			return nil, err
+		}
+		page, err := get()
+		if !isRateLimited(err) || attempt == maxRetries {
+			return page, err
+		}
+		// Jitter the wait so workers don't all retry at once
+		jittered := wait + time.Duration(rand.Int63n(int64(wait)/2+1))
+		log.WithFields(log.Fields{"wait": jittered, "attempt": attempt + 1}).Warn("rate limited fetching saved tracks, backing off")
+		l.hold(jittered)
+		wait *= 2
+	}
+}
+
+// wait blocks until no backoff is in force, or ctx is done
+func (l *rateLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	d := time.Until(l.until)
+	l.mu.Unlock()
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// hold holds back requests for at least d
+func (l *rateLimiter) hold(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until := time.Now().Add(d); until.After(l.until) {
+		l.until = until
+	}
+}
+
+// isRateLimited returns true if err is Spotify refusing a request for being
+// over the rate limit
+func isRateLimited(err error) bool {
+	e, ok := err.(spotify.Error)
+	return ok && e.Status == http.StatusTooManyRequests
+}
@@ -0,0 +1,72 @@
+package library
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"potentials-utils/spotifyclient"
+	"potentials-utils/spotifytest"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+func TestFetchPagesConcurrently(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	expected := []spotify.ID{}
+	for ix := 0; ix < 105; ix++ {
+		id := spotify.ID(fmt.Sprintf("t%d", ix))
+		srv.AddSavedTracks(spotifytest.Track(string(id), fmt.Sprintf("Song %d", ix), "Album", "Artist"))
+		expected = append(expected, id)
+	}
+	dir, err := ioutil.TempDir("", "library")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lib, err := NewLibraryService(spotifyclient.New(srv.HTTPClient()), CacheConfig{CacheDir: dir, Lifetime: time.Hour, IndexParallelism: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rate limit the page at offset 40 twice, then rebuild the whole index
+	var mu sync.Mutex
+	limited := 0
+	srv.Fault = func(r *http.Request) int {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path == "/v1/me/tracks" && r.URL.Query().Get("offset") == "40" && limited < 2 {
+			limited++
+			return http.StatusTooManyRequests
+		}
+		return 0
+	}
+	lib.backoff = time.Millisecond
+	tracks, err := lib.fetchAllTracks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limited != 2 {
+		t.Errorf("expected the rate limited page retried twice, got %d", limited)
+	}
+	got := []spotify.ID{}
+	for _, track := range tracks {
+		got = append(got, track.ID)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected every track in library order, got %v", got)
+	}
+
+	// Fail once the retries run out
+	limited = -maxRetries
+	if _, err := lib.fetchAllTracks(context.Background()); err == nil || !isRateLimited(err) {
+		t.Errorf("expected rate limiting to fail the index once retries run out, got %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+package library
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/zmb3/spotify/v2"
+)
+
+// PlaylistTracksAPI pages through a playlist's tracks
+type PlaylistTracksAPI interface {
+	PlaylistTracks(ctx context.Context, playlistID spotify.ID, offset int) (*spotify.PlaylistTrackPage, error)
+	NextPlaylistTracks(ctx context.Context, page *spotify.PlaylistTrackPage) error
+}
+
+// ReferenceLibrary is the user's saved tracks along with the tracks on
+// reference playlists, e.g. an archive of past favourites, so tracks on
+// either count as in the library. The playlists are fetched on the first
+// lookup, and again once they've been held as long as the library is.
+type ReferenceLibrary struct {
+	*LibraryService
+	client    PlaylistTracksAPI
+	playlists []spotify.ID
+	// mu guards reference, nil until the playlists are first fetched
+	mu        sync.Mutex
+	reference *SpotifyLibraryIndex
+}
+
+// NewReferenceLibrary returns lib along with the tracks on playlists, which
+// are fetched through client
+func NewReferenceLibrary(lib *LibraryService, client PlaylistTracksAPI, playlists []spotify.ID) *ReferenceLibrary {
+	return &ReferenceLibrary{LibraryService: lib, client: client, playlists: playlists}
+}
+
+// references returns the index of the reference playlists' tracks, fetching
+// them if they haven't been or they've expired
+func (r *ReferenceLibrary) references() (*SpotifyLibraryIndex, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.reference != nil && r.reference.Alive() {
+		return r.reference, nil
+	}
+	index := r.newIndex()
+	for _, id := range r.playlists {
+		// The index is shared by every lookup, so isn't fetched with any
+		// one caller's context
+		tracks, err := r.fetchPlaylist(context.Background(), id)
+		if err != nil {
+			return nil, err
+		}
+		index.IndexTracks(tracks)
+	}
+	index.MakeItFresh()
+	log.WithFields(log.Fields{"playlists": len(r.playlists), "tracks": index.Len()}).Debug("indexed reference playlists")
+	r.reference = index
+	return index, nil
+}
+
+// fetchPlaylist pages through a playlist's tracks, as saved tracks added
+// when they were added to the playlist. Local files are left out.
+func (r *ReferenceLibrary) fetchPlaylist(ctx context.Context, id spotify.ID) ([]spotify.SavedTrack, error) {
+	page, err := r.client.PlaylistTracks(ctx, id, 0)
+	if err != nil {
+		return nil, err
+	}
+	tracks := []spotify.SavedTrack{}
+	for {
+		for _, t := range page.Tracks {
+			if t.IsLocal || t.Track.ID == "" {
+				continue
+			}
+			tracks = append(tracks, spotify.SavedTrack{AddedAt: t.AddedAt, FullTrack: t.Track})
+		}
+		if err := r.client.NextPlaylistTracks(ctx, page); err == spotify.ErrNoMorePages {
+			return tracks, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// GetByID returns the saved track with the given ID, or the track on a
+// reference playlist if it isn't saved, or nil if there is neither
+func (r *ReferenceLibrary) GetByID(k spotify.ID) (*spotify.SavedTrack, error) {
+	if t, err := r.LibraryService.GetByID(k); t != nil || err != nil {
+		return t, err
+	}
+	reference, err := r.references()
+	if err != nil {
+		return nil, err
+	}
+	return reference.GetByID(k)
+}
+
+// GetByISRC returns every saved or reference track with the given
+// International Standard Recording Code
+func (r *ReferenceLibrary) GetByISRC(isrc string) ([]*spotify.SavedTrack, error) {
+	return r.union(func() ([]*spotify.SavedTrack, error) {
+		return r.LibraryService.GetByISRC(isrc)
+	}, func(i *SpotifyLibraryIndex) ([]*spotify.SavedTrack, error) {
+		return i.GetByISRC(isrc)
+	})
+}
+
+// GetByArtistName returns every saved or reference track credited to the
+// named artist, ignoring case
+func (r *ReferenceLibrary) GetByArtistName(name string) ([]*spotify.SavedTrack, error) {
+	return r.union(func() ([]*spotify.SavedTrack, error) {
+		return r.LibraryService.GetByArtistName(name)
+	}, func(i *SpotifyLibraryIndex) ([]*spotify.SavedTrack, error) {
+		return i.GetByArtistName(name)
+	})
+}
+
+// GetByKey returns every saved or reference track with the same index key
+// as t
+func (r *ReferenceLibrary) GetByKey(t spotify.FullTrack) ([]*spotify.SavedTrack, error) {
+	return r.union(func() ([]*spotify.SavedTrack, error) {
+		return r.LibraryService.GetByKey(t)
+	}, func(i *SpotifyLibraryIndex) ([]*spotify.SavedTrack, error) {
+		return i.GetByKey(t)
+	})
+}
+
+// GetBySongAlbumArtistNames gets all saved or reference tracks with the same
+// song name, artist name, and album title
+func (r *ReferenceLibrary) GetBySongAlbumArtistNames(songName, albumName string, artistNames []string) ([]*spotify.SavedTrack, error) {
+	return r.union(func() ([]*spotify.SavedTrack, error) {
+		return r.LibraryService.GetBySongAlbumArtistNames(songName, albumName, artistNames)
+	}, func(i *SpotifyLibraryIndex) ([]*spotify.SavedTrack, error) {
+		return i.GetBySongAlbumArtistNames(songName, albumName, artistNames)
+	})
+}
+
+// union returns the saved tracks found by saved followed by the reference
+// tracks found by reference, leaving out reference tracks which are saved
+func (r *ReferenceLibrary) union(saved func() ([]*spotify.SavedTrack, error), reference func(*SpotifyLibraryIndex) ([]*spotify.SavedTrack, error)) ([]*spotify.SavedTrack, error) {
+	tracks, err := saved()
+	if err != nil {
+		return nil, err
+	}
+	index, err := r.references()
+	if err != nil {
+		return nil, err
+	}
+	more, err := reference(index)
+	if err != nil {
+		return nil, err
+	}
+	if len(more) == 0 {
+		return tracks, nil
+	}
+	seen := map[spotify.ID]bool{}
+	for _, t := range tracks {
+		seen[t.ID] = true
+	}
+	union := append([]*spotify.SavedTrack{}, tracks...)
+	for _, t := range more {
+		if !seen[t.ID] {
+			union = append(union, t)
+		}
+	}
+	return union, nil
+}
+
+// IndexedAt returns when the library or the reference playlists were last
+// fetched from Spotify, whichever was later
+func (r *ReferenceLibrary) IndexedAt() (time.Time, error) {
+	indexedAt, err := r.LibraryService.IndexedAt()
+	if err != nil {
+		return time.Time{}, err
+	}
+	reference, err := r.references()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if reference.indexedAt.After(indexedAt) {
+		return reference.indexedAt, nil
+	}
+	return indexedAt, nil
+}
+
+// Refresh rebuilds the library from Spotify and persists it, fetching the
+// reference playlists again on the next lookup
+func (r *ReferenceLibrary) Refresh() error {
+	r.mu.Lock()
+	r.reference = nil
+	r.mu.Unlock()
+	return r.LibraryService.Refresh()
+}
+
+var _ Service = (*ReferenceLibrary)(nil)
@@ -0,0 +1,77 @@
+package library
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"potentials-utils/spotifyclient"
+	"potentials-utils/spotifytest"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+func TestReferenceLibrary(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	saved := spotifytest.Track("t1", "Song", "Album", "Artist")
+	saved.ExternalIDs = map[string]string{"isrc": "ISRC1"}
+	archived := spotifytest.Track("t2", "Other Song", "Album", "Artist")
+	archived.ExternalIDs = map[string]string{"isrc": "ISRC1"}
+	srv.AddSavedTracks(saved)
+	srv.AddPlaylist("archive", "Archive 2023", saved, archived, spotifytest.Track("t3", "Third Song", "Other Album", "Other Artist"))
+	dir, err := ioutil.TempDir("", "library")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := spotifyclient.New(srv.HTTPClient())
+	lib, err := NewLibraryService(client, CacheConfig{CacheDir: dir, Lifetime: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := NewReferenceLibrary(lib, client, []spotify.ID{"archive"})
+	playlistRequests := func() int {
+		n := 0
+		for _, r := range srv.Requests() {
+			if strings.HasPrefix(r, "GET /v1/playlists/archive/tracks") {
+				n++
+			}
+		}
+		return n
+	}
+
+	if track, err := ref.GetByID("t1"); err != nil || track == nil {
+		t.Errorf("expected the saved track found, got %v, %v", track, err)
+	}
+	if got := playlistRequests(); got != 0 {
+		t.Errorf("expected saved tracks found without fetching the reference playlists, got %d requests", got)
+	}
+	if track, err := ref.GetByID("t3"); err != nil || track == nil {
+		t.Errorf("expected the track on the reference playlist found, got %v, %v", track, err)
+	}
+	if track, err := lib.GetByID("t3"); err != nil || track != nil {
+		t.Errorf("expected the saved tracks left alone, got %v, %v", track, err)
+	}
+	if tracks, err := ref.GetByISRC("ISRC1"); err != nil || len(tracks) != 2 || tracks[0].ID != "t1" || tracks[1].ID != "t2" {
+		t.Errorf("expected t1 saved and t2 referenced found once each, got %v, %v", tracks, err)
+	}
+	if tracks, err := ref.GetBySongAlbumArtistNames("Third Song", "Other Album", []string{"Other Artist"}); err != nil || len(tracks) != 1 {
+		t.Errorf("expected the referenced track found by name, got %v, %v", tracks, err)
+	}
+	if got := playlistRequests(); got != 1 {
+		t.Errorf("expected the reference playlists fetched once, got %d requests", got)
+	}
+
+	if err := ref.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ref.GetByID("t3"); err != nil {
+		t.Fatal(err)
+	}
+	if got := playlistRequests(); got != 2 {
+		t.Errorf("expected the reference playlists fetched again once refreshed, got %d requests", got)
+	}
+}
@@ -0,0 +1,122 @@
+package library
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// Search modes
+const (
+	// SearchExact finds tracks whose name is the query, once normalized
+	SearchExact = "exact"
+	// SearchPrefix finds tracks whose name starts with the query, once
+	// normalized, using the search tree
+	SearchPrefix = "prefix"
+	// SearchFuzzy finds tracks whose name is within a few edits of the
+	// query, ignoring case
+	SearchFuzzy = "fuzzy"
+)
+
+// SearchResult is a saved track found by a search
+type SearchResult struct {
+	Track *spotify.SavedTrack
+	// Distance is how many edits the query is from the track's name, only
+	// set by fuzzy searches
+	Distance int
+}
+
+// Search finds up to limit saved tracks whose name matches query in the given
+// mode, ordered by distance, then name
+func (i *SpotifyLibraryIndex) Search(query, mode string, limit int) ([]SearchResult, error) {
+	query = i.normalizer.Normalize(query)
+	results := []SearchResult{}
+	switch mode {
+	case SearchExact:
+		for _, t := range i.tracksByID {
+			if i.normalizer.Normalize(t.Name) == query {
+				results = append(results, SearchResult{Track: t})
+			}
+		}
+	case SearchPrefix:
+		terms := map[string]bool{}
+		for _, w := range i.trackSearchTree.WordsWithPrefix(query) {
+			terms[w] = true
+		}
+		for id, e := range i.entries {
+			// A search term starts with the track's name, then the album's
+			if terms[e.searchTerm] && strings.HasPrefix(i.normalizer.Normalize(e.names[0]), query) {
+				results = append(results, SearchResult{Track: i.tracksByID[id]})
+			}
+		}
+	case SearchFuzzy:
+		query = strings.ToLower(query)
+		max := len([]rune(query)) / 4
+		if max < 1 {
+			max = 1
+		}
+		for _, t := range i.tracksByID {
+			if d := EditDistance(query, strings.ToLower(i.normalizer.Normalize(t.Name))); d <= max {
+				results = append(results, SearchResult{Track: t, Distance: d})
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown search mode %q", mode)
+	}
+	sort.Slice(results, func(a, b int) bool {
+		if results[a].Distance != results[b].Distance {
+			return results[a].Distance < results[b].Distance
+		}
+		if results[a].Track.Name != results[b].Track.Name {
+			return results[a].Track.Name < results[b].Track.Name
+		}
+		return results[a].Track.ID < results[b].Track.ID
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// EditDistance returns the Levenshtein distance between a and b in runes
+func EditDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for ix := 1; ix <= len(ra); ix++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = ix
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[ix-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(rb)]
+}
+
+func minInt(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+// Search finds up to limit saved tracks whose name matches query in the given
+// mode. Will rebuild the cache if stale.
+func (s *LibraryService) Search(query, mode string, limit int) ([]SearchResult, error) {
+	if err := s.readyLibrary(); err != nil {
+		return nil, err
+	}
+	return s.index().Search(query, mode, limit)
+}
@@ -0,0 +1,76 @@
+package library
+
+import (
+	"context"
+	"time"
+)
+
+// IndexStatus describes how fresh the library index is
+type IndexStatus struct {
+	Tracks    int       `json:"tracks"`
+	IndexedAt time.Time `json:"indexedAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// Alive is true until the index expires
+	Alive bool `json:"alive"`
+	// Usable is true if lookups are served without first rebuilding the
+	// index, i.e. it's alive, stale indexes are allowed or it's being warmed
+	// up
+	Usable bool `json:"usable"`
+	// Warming is true while the index is rebuilt in the background
+	Warming bool `json:"warming"`
+}
+
+// ExpiresIn returns how long until the index expires, negative once it has
+func (s IndexStatus) ExpiresIn(now time.Time) time.Duration {
+	return s.ExpiresAt.Sub(now)
+}
+
+// Status reports how fresh the index is, without rebuilding it
+func (s *LibraryService) Status() IndexStatus {
+	index := s.index()
+	warming := s.Warming()
+	return IndexStatus{
+		Tracks:    index.Len(),
+		IndexedAt: index.indexedAt,
+		ExpiresAt: index.evictionTime,
+		Alive:     index.Alive(),
+		Usable:    index.Alive() || s.usableStale() || (warming && index.Len() > 0),
+		Warming:   warming,
+	}
+}
+
+// Status reports how fresh the stored library is, as of now
+func (l *StoredLibrary) Status(now time.Time) IndexStatus {
+	alive := now.Before(l.Expiration)
+	return IndexStatus{
+		Tracks:    len(l.Tracks),
+		IndexedAt: l.IndexedAt,
+		ExpiresAt: l.Expiration,
+		Alive:     alive,
+		Usable:    alive,
+	}
+}
+
+// WatchEviction calls expired once each time the index crosses its eviction
+// time, until ctx is done. While the index is stale it's checked every poll
+// for having been rebuilt, which arms the watch again.
+func (s *LibraryService) WatchEviction(ctx context.Context, poll time.Duration, expired func(IndexStatus)) {
+	var notified time.Time
+	for {
+		status := s.Status()
+		wait := poll
+		if status.Alive {
+			wait = time.Until(status.ExpiresAt)
+		} else if !status.ExpiresAt.Equal(notified) {
+			notified = status.ExpiresAt
+			expired(status)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package library
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"potentials-utils/spotifyclient"
+	"potentials-utils/spotifytest"
+)
+
+func TestWatchEviction(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	srv.AddSavedTracks(spotifytest.Track("t1", "Song", "Album", "Artist"))
+	dir, err := ioutil.TempDir("", "library")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lib, err := NewLibraryService(spotifyclient.New(srv.HTTPClient()), CacheConfig{CacheDir: dir, Lifetime: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := lib.Status(); !status.Alive || !status.Usable || status.Tracks != 1 {
+		t.Errorf("expected a fresh index of 1 track, got %+v", status)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	var expired int64
+	go func() {
+		lib.WatchEviction(ctx, 10*time.Millisecond, func(s IndexStatus) {
+			if s.Alive {
+				t.Errorf("expected an expired index, got %+v", s)
+			}
+			atomic.AddInt64(&expired, 1)
+		})
+		close(done)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadInt64(&expired); n != 1 {
+		t.Errorf("expected the expiry to be reported once, got %d", n)
+	}
+	if lib.Status().Usable {
+		t.Errorf("expected an expired index to be unusable")
+	}
+	// Rebuilding the index arms the watch again
+	if _, err := lib.GetByID("t1"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+	<-done
+	if n := atomic.LoadInt64(&expired); n != 2 {
+		t.Errorf("expected the rebuilt index's expiry to be reported, got %d", n)
+	}
+}
@@ -0,0 +1,99 @@
+package library
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// Backends the library can be cached in
+const (
+	// FileBackend caches the library in a single file, in the configured
+	// format, rewritten whole each time. The default.
+	FileBackend = "file"
+	// BoltBackend caches the library in an embedded bbolt database, only
+	// writing the tracks which changed
+	BoltBackend = "bolt"
+)
+
+// Store keeps the library between runs
+type Store interface {
+	// Load reads the stored library, failing with an error satisfying
+	// os.IsNotExist if none is stored
+	Load() (*StoredLibrary, error)
+	// Save replaces the stored library
+	Save(stored *StoredLibrary) error
+	// Path is the file the library is stored in
+	Path() string
+}
+
+// NewStore returns the store cfg caches the library in
+func NewStore(cfg CacheConfig) (Store, error) {
+	switch cfg.Backend {
+	case "", FileBackend:
+		if err := validateFormat(cfg.Format); err != nil {
+			return nil, err
+		}
+		format := cfg.Format
+		if format == "" {
+			format = JSONFormat
+		}
+		return newFileStore(cfg.CacheDir, format), nil
+	case BoltBackend:
+		return newBoltStore(cfg.CacheDir), nil
+	}
+	return nil, fmt.Errorf("unknown cache backend %q, expected %s or %s", cfg.Backend, FileBackend, BoltBackend)
+}
+
+// OpenStore returns the store holding the library cached in cacheDir,
+// whichever backend and format it was cached with. Defaults to a JSON file
+// if nothing is cached.
+func OpenStore(cacheDir string) Store {
+	all := stores(cacheDir)
+	for _, s := range all {
+		if _, err := os.Stat(s.Path()); err == nil {
+			return s
+		}
+	}
+	return all[0]
+}
+
+// stores returns every store the library may be cached in in cacheDir
+func stores(cacheDir string) []Store {
+	return []Store{newFileStore(cacheDir, JSONFormat), newFileStore(cacheDir, GobFormat), newBoltStore(cacheDir)}
+}
+
+// fileStore caches the library in a single file
+type fileStore struct {
+	path   string
+	format string
+}
+
+func newFileStore(cacheDir, format string) *fileStore {
+	return &fileStore{path: path.Join(cacheDir, cacheFiles[format]), format: format}
+}
+
+func (s *fileStore) Load() (*StoredLibrary, error) {
+	slurp, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeStoredLibrary(slurp, s.format)
+}
+
+func (s *fileStore) Save(stored *StoredLibrary) error {
+	mode := os.FileMode(uint32(0755))
+	bytes, err := encodeStoredLibrary(stored, s.format)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(s.path), mode); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path, bytes, mode)
+}
+
+func (s *fileStore) Path() string {
+	return s.path
+}
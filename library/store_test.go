@@ -0,0 +1,142 @@
+package library
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"potentials-utils/spotifyclient"
+	"potentials-utils/spotifytest"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+func TestStores(t *testing.T) {
+	track := func(id, name string) Track {
+		t := spotify.SavedTrack{AddedAt: "2020-01-01T00:00:00Z", FullTrack: spotifytest.Track(id, name, "Album", "Artist")}
+		t.ExternalIDs = map[string]string{"isrc": "ISRC" + id}
+		t.Album.ReleaseDate = "2020"
+		return NewTrack(t)
+	}
+	ids := func(stored *StoredLibrary) []spotify.ID {
+		ids := []spotify.ID{}
+		for _, t := range stored.Tracks {
+			ids = append(ids, t.ID)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		return ids
+	}
+	expiration := time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC)
+	indexedAt := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name string
+		cfg  CacheConfig
+		file string
+	}{
+		{name: "json file", cfg: CacheConfig{}, file: "library.json"},
+		{name: "gob file", cfg: CacheConfig{Format: GobFormat}, file: "library.gob"},
+		{name: "bolt", cfg: CacheConfig{Backend: BoltBackend}, file: "library.db"},
+	}
+	for _, tc := range testCases {
+		dir, err := ioutil.TempDir("", "store")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		tc.cfg.CacheDir = dir
+		store, err := NewStore(tc.cfg)
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		if store.Path() != path.Join(dir, tc.file) {
+			t.Errorf("%s failed: expected the library stored in %s, got %s", tc.name, tc.file, store.Path())
+		}
+		if _, err := store.Load(); !os.IsNotExist(err) {
+			t.Errorf("%s failed: expected nothing stored yet, got %v", tc.name, err)
+		}
+
+		stored := &StoredLibrary{Expiration: expiration, IndexedAt: indexedAt, Tracks: []Track{track("t1", "Song"), track("t2", "Other Song")}}
+		if err := store.Save(stored); err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		// Saving again replaces the tracks, dropping those no longer saved
+		stored.Tracks = []Track{track("t2", "Renamed Song"), track("t3", "New Song")}
+		stored.Albums = []spotify.SavedAlbum{{FullAlbum: spotify.FullAlbum{SimpleAlbum: spotify.SimpleAlbum{ID: "album", Name: "Album"}}}}
+		if err := store.Save(stored); err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		loaded, err := OpenStore(dir).Load()
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		if !loaded.Expiration.Equal(expiration) || !loaded.IndexedAt.Equal(indexedAt) {
+			t.Errorf("%s failed: expected the expiration and indexing time kept, got %v %v", tc.name, loaded.Expiration, loaded.IndexedAt)
+		}
+		if got := ids(loaded); !reflect.DeepEqual(got, []spotify.ID{"t2", "t3"}) {
+			t.Errorf("%s failed: expected t2 and t3 stored, got %v", tc.name, got)
+		}
+		for _, lt := range loaded.Tracks {
+			if lt.ID == "t2" && (lt.Name != "Renamed Song" || lt.ISRC != "ISRCt2" || lt.Album.ReleaseDate != "2020") {
+				t.Errorf("%s failed: expected t2 updated, got %+v", tc.name, lt)
+			}
+		}
+		if len(loaded.Albums) != 1 || loaded.Albums[0].ID != "album" {
+			t.Errorf("%s failed: expected the saved album stored, got %v", tc.name, loaded.Albums)
+		}
+	}
+
+	if _, err := NewStore(CacheConfig{Backend: "sqlite"}); err == nil {
+		t.Errorf("expected an unknown backend rejected")
+	}
+}
+
+func TestSwitchBackend(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	srv.AddSavedTracks(spotifytest.Track("t1", "Song", "Album", "Artist"), spotifytest.Track("t2", "Other Song", "Album", "Artist"))
+	dir, err := ioutil.TempDir("", "library")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := spotifyclient.New(srv.HTTPClient())
+	cfg := CacheConfig{CacheDir: dir, Lifetime: time.Hour}
+	if _, err := NewLibraryService(client, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// Switching to bolt reads the JSON cache, replacing it with a database
+	pages := libraryRequests(srv)
+	cfg.Backend = BoltBackend
+	lib, err := NewLibraryService(client, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := libraryRequests(srv); got != pages {
+		t.Errorf("expected the JSON cache read without calling Spotify, got %d more requests", got-pages)
+	}
+	if _, err := os.Stat(path.Join(dir, "library.json")); !os.IsNotExist(err) {
+		t.Errorf("expected the JSON cache replaced, got %v", err)
+	}
+	if got := OpenStore(dir).Path(); got != path.Join(dir, "library.db") {
+		t.Errorf("expected the library cached in library.db, got %s", got)
+	}
+	if track, err := lib.GetByID("t2"); err != nil || track == nil {
+		t.Errorf("expected t2 indexed, got %v, %v", track, err)
+	}
+
+	if err := ExpireStoredLibrary(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewLibraryService(client, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := libraryRequests(srv); got == pages {
+		t.Errorf("expected the expired database rebuilt from Spotify")
+	}
+}
@@ -0,0 +1,73 @@
+package library
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// TrackString prints a human-readable summary of a spotify track
+func TrackString(t spotify.FullTrack) string {
+	artistString := ""
+	for ix, a := range t.Artists {
+		if ix == len(t.Artists)-1 {
+			artistString += fmt.Sprintf("%s", a.Name)
+		} else {
+			artistString += fmt.Sprintf("%s, ", a.Name)
+		}
+	}
+	return fmt.Sprintf("%s, %s, on %s released %s, Track ID: %s", t.Name, artistString, t.Album.Name, t.Album.ReleaseDate, t.ID)
+}
+
+// openSpotifyURL is the root of the Spotify web player's links
+const openSpotifyURL = "https://open.spotify.com/"
+
+// TrackLink returns the open.spotify.com link to a track, which opens it in
+// the Spotify client if installed
+func TrackLink(id spotify.ID) string {
+	return openSpotifyURL + "track/" + string(id)
+}
+
+// ArtistNames returns the names of every artist credited on a track
+func ArtistNames(t spotify.SimpleTrack) []string {
+	var names []string
+	for _, a := range t.Artists {
+		names = append(names, a.Name)
+	}
+	return names
+}
+
+// ISRC returns the International Standard Recording Code of a track, or the
+// empty string if Spotify doesn't know it
+func ISRC(t spotify.FullTrack) string {
+	return t.ExternalIDs["isrc"]
+}
+
+// VariousArtists is the placeholder artist Spotify credits on compilations
+const VariousArtists = "Various Artists"
+
+// IsCompilation returns true if the album is a compilation, either by type or
+// because it is credited to Various Artists
+func IsCompilation(a spotify.SimpleAlbum) bool {
+	if a.AlbumType == "compilation" {
+		return true
+	}
+	for _, artist := range a.Artists {
+		if strings.EqualFold(artist.Name, VariousArtists) {
+			return true
+		}
+	}
+	return false
+}
+
+// PrimaryArtist returns the name of the first artist credited on a track,
+// skipping Various Artists
+func PrimaryArtist(t spotify.SimpleTrack) string {
+	for _, a := range t.Artists {
+		if !strings.EqualFold(a.Name, VariousArtists) {
+			return a.Name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,119 @@
+package library
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// maxIDsPerRequest is the most track IDs Spotify accepts in one lookup
+const maxIDsPerRequest = 50
+
+// VerifyAPI is the view of the Spotify API needed to check a cached library
+// against the live one
+type VerifyAPI interface {
+	SavedTracks(ctx context.Context) (*spotify.SavedTrackPage, error)
+	UserHasTracks(ctx context.Context, ids ...spotify.ID) ([]bool, error)
+	GetTracks(ctx context.Context, ids ...spotify.ID) ([]*spotify.FullTrack, error)
+}
+
+// TrackChange is a field of a cached track which no longer matches Spotify
+type TrackChange struct {
+	ID     spotify.ID `json:"id"`
+	Field  string     `json:"field"`
+	Cached string     `json:"cached"`
+	Live   string     `json:"live"`
+}
+
+// Drift is how far a cached library has diverged from the live one
+type Drift struct {
+	CachedTracks  int `json:"cachedTracks"`
+	SpotifyTracks int `json:"spotifyTracks"`
+	Sampled       int `json:"sampled"`
+	// Unsaved are sampled tracks which are no longer saved
+	Unsaved []spotify.ID `json:"unsaved,omitempty"`
+	// Unavailable are sampled tracks Spotify no longer knows
+	Unavailable []spotify.ID `json:"unavailable,omitempty"`
+	// Changed are fields of sampled tracks which differ from Spotify
+	Changed []TrackChange `json:"changed,omitempty"`
+}
+
+// Drifted returns true if any difference between the cache and Spotify was
+// found
+func (d *Drift) Drifted() bool {
+	return d.CachedTracks != d.SpotifyTracks || len(d.Unsaved) > 0 || len(d.Unavailable) > 0 || len(d.Changed) > 0
+}
+
+// Verify compares stored against the live library: the number of saved
+// tracks, and whether up to sample randomly chosen cached tracks are still
+// saved and unchanged. Every cached track is checked if sample isn't positive.
+func Verify(ctx context.Context, stored *StoredLibrary, client VerifyAPI, sample int, r *rand.Rand) (*Drift, error) {
+	d := &Drift{CachedTracks: len(stored.Tracks)}
+	page, err := client.SavedTracks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d.SpotifyTracks = int(page.Total)
+
+	tracks := stored.Tracks
+	if sample > 0 && sample < len(tracks) {
+		tracks = []Track{}
+		for _, ix := range r.Perm(len(stored.Tracks))[:sample] {
+			tracks = append(tracks, stored.Tracks[ix])
+		}
+	}
+	d.Sampled = len(tracks)
+	for len(tracks) > 0 {
+		n := len(tracks)
+		if n > maxIDsPerRequest {
+			n = maxIDsPerRequest
+		}
+		chunk := tracks[:n]
+		tracks = tracks[n:]
+		ids := []spotify.ID{}
+		for _, t := range chunk {
+			ids = append(ids, t.ID)
+		}
+		saved, err := client.UserHasTracks(ctx, ids...)
+		if err != nil {
+			return nil, err
+		}
+		live, err := client.GetTracks(ctx, ids...)
+		if err != nil {
+			return nil, err
+		}
+		for ix, t := range chunk {
+			if ix < len(saved) && !saved[ix] {
+				d.Unsaved = append(d.Unsaved, t.ID)
+			}
+			if ix >= len(live) || live[ix] == nil {
+				d.Unavailable = append(d.Unavailable, t.ID)
+				continue
+			}
+			d.Changed = append(d.Changed, trackChanges(t.SavedTrack().FullTrack, *live[ix])...)
+		}
+	}
+	return d, nil
+}
+
+// trackChanges returns the fields duplicate matching depends on which differ
+// between a cached track and its live copy
+func trackChanges(cached, live spotify.FullTrack) []TrackChange {
+	changes := []TrackChange{}
+	for _, f := range []struct {
+		name         string
+		cached, live string
+	}{
+		{"name", cached.Name, live.Name},
+		{"album", cached.Album.Name, live.Album.Name},
+		{"artists", strings.Join(ArtistNames(cached.SimpleTrack), ", "), strings.Join(ArtistNames(live.SimpleTrack), ", ")},
+		{"isrc", ISRC(cached), ISRC(live)},
+	} {
+		if f.cached != f.live {
+			changes = append(changes, TrackChange{ID: cached.ID, Field: f.name, Cached: f.cached, Live: f.live})
+		}
+	}
+	return changes
+}
@@ -0,0 +1,60 @@
+package library
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"potentials-utils/spotifyclient"
+	"potentials-utils/spotifytest"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	stored := NewStoredLibrary()
+	for ix := 0; ix < 120; ix++ {
+		track := spotifytest.Track(fmt.Sprintf("t%d", ix), fmt.Sprintf("Song %d", ix), "Album", "Artist")
+		srv.AddSavedTracks(track)
+		stored.Tracks = append(stored.Tracks, NewTrack(spotify.SavedTrack{FullTrack: track}))
+	}
+	client := spotifyclient.New(srv.HTTPClient())
+
+	d, err := Verify(ctx, stored, client, 0, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Drifted() || d.Sampled != 120 {
+		t.Errorf("expected no drift across all 120 tracks, got %+v", d)
+	}
+
+	srv.RemoveSavedTracks("t3")
+	renamed := spotifytest.Track("t7", "Song 7 (Live)", "Album", "Artist")
+	srv.RemoveSavedTracks("t7")
+	srv.AddSavedTracks(renamed)
+	d, err = Verify(ctx, stored, client, 0, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.Drifted() || d.SpotifyTracks != 119 {
+		t.Errorf("expected drift with 119 tracks on Spotify, got %+v", d)
+	}
+	if len(d.Unsaved) != 1 || d.Unsaved[0] != "t3" {
+		t.Errorf("expected t3 to be unsaved, got %v", d.Unsaved)
+	}
+	if len(d.Changed) != 1 || d.Changed[0] != (TrackChange{ID: "t7", Field: "name", Cached: "Song 7", Live: "Song 7 (Live)"}) {
+		t.Errorf("expected t7 to be renamed, got %+v", d.Changed)
+	}
+
+	d, err = Verify(ctx, stored, client, 10, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Sampled != 10 {
+		t.Errorf("expected 10 tracks to be sampled, got %d", d.Sampled)
+	}
+}
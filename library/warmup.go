@@ -0,0 +1,87 @@
+package library
+
+import (
+	"context"
+
+	"github.com/apex/log"
+)
+
+// WarmUp rebuilds a stale index from Spotify in the background, persisting it
+// once done. Until then lookups are served from the stale index, unless
+// there's none to serve, and WaitFresh waits for the rebuild.
+func (s *LibraryService) WarmUp() {
+	s.mu.Lock()
+	if s.libraryIndex.Alive() || s.warming != nil {
+		s.mu.Unlock()
+		return
+	}
+	done := make(chan struct{})
+	s.warming = done
+	s.mu.Unlock()
+	log.WithFields(log.Fields{"tracks": s.index().Len()}).Info("warming up the library index in the background")
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			s.warming = nil
+			s.mu.Unlock()
+			close(done)
+		}()
+		if err := s.indexFromSpotify(); err != nil {
+			log.WithFields(log.Fields{"err": err}).Error("failed to warm up the library index, it will be rebuilt on the next lookup")
+			return
+		}
+		if err := s.Persist(); err != nil {
+			log.WithFields(log.Fields{"err": err}).Error("failed to persist the warmed up library index")
+		}
+		log.WithFields(log.Fields{"tracks": s.index().Len()}).Info("library index warmed up")
+	}()
+}
+
+// Warming returns true while the rebuild started by WarmUp is running
+func (s *LibraryService) Warming() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.warming != nil
+}
+
+// WaitFresh waits for the rebuild started by WarmUp, if one is running, and
+// then rebuilds the index if it's still stale
+func (s *LibraryService) WaitFresh(ctx context.Context) error {
+	s.mu.RLock()
+	warming := s.warming
+	s.mu.RUnlock()
+	if warming != nil {
+		select {
+		case <-warming:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return s.readyLibrary()
+}
+
+// servingWarm returns true if lookups should be served from the stale index
+// while WarmUp rebuilds it. An empty index isn't served, the lookup waits for
+// the rebuild instead.
+func (s *LibraryService) servingWarm() bool {
+	s.mu.RLock()
+	warming, index := s.warming, s.libraryIndex
+	s.mu.RUnlock()
+	if warming == nil {
+		return false
+	}
+	if index.Len() > 0 {
+		return true
+	}
+	<-warming
+	return false
+}
+
+// Refresh rebuilds the index from Spotify, however fresh it is, and persists
+// it. Like any rebuild only newly saved tracks are fetched when that's safe.
+func (s *LibraryService) Refresh() error {
+	if err := s.indexFromSpotify(); err != nil {
+		return err
+	}
+	return s.Persist()
+}
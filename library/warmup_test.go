@@ -0,0 +1,95 @@
+package library
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"potentials-utils/spotifyclient"
+	"potentials-utils/spotifytest"
+)
+
+// gatedTransport holds every request until open is closed
+type gatedTransport struct {
+	next http.RoundTripper
+	open chan struct{}
+}
+
+func (t *gatedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	<-t.open
+	return t.next.RoundTrip(r)
+}
+
+func TestWarmUp(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	srv.AddSavedTracks(spotifytest.Track("t1", "Song", "Album", "Artist"))
+	dir, err := ioutil.TempDir("", "library")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Cache a library which is stale straight away
+	if _, err := NewLibraryService(spotifyclient.New(srv.HTTPClient()), CacheConfig{CacheDir: dir, Lifetime: time.Nanosecond}); err != nil {
+		t.Fatal(err)
+	}
+	srv.AddSavedTracks(spotifytest.Track("t2", "Other Song", "Album", "Artist"))
+
+	gate := &gatedTransport{next: srv.HTTPClient().Transport, open: make(chan struct{})}
+	client := spotifyclient.New(&http.Client{Transport: gate})
+	lib, err := NewLibraryService(client, CacheConfig{CacheDir: dir, Lifetime: time.Hour, WarmUp: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := lib.Status(); status.Alive || !status.Usable || !status.Warming || status.Tracks != 1 {
+		t.Errorf("expected the stale index to be served while warming up, got %+v", status)
+	}
+	if track, err := lib.GetByID("t1"); err != nil || track == nil {
+		t.Errorf("expected t1 from the stale index, got %v, %v", track, err)
+	}
+	if track, err := lib.GetByID("t2"); err != nil || track != nil {
+		t.Errorf("expected t2 not to be in the stale index yet, got %v, %v", track, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := lib.WaitFresh(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected waiting for the warm up to time out, got %v", err)
+	}
+
+	close(gate.open)
+	if err := lib.WaitFresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if status := lib.Status(); !status.Alive || status.Warming || status.Tracks != 2 {
+		t.Errorf("expected a fresh index of 2 tracks, got %+v", status)
+	}
+	stored, err := LoadStoredLibrary(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.Tracks) != 2 {
+		t.Errorf("expected the warmed up index to be persisted, got %d tracks", len(stored.Tracks))
+	}
+}
+
+func TestWarmUpWithoutCache(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	srv.AddSavedTracks(spotifytest.Track("t1", "Song", "Album", "Artist"))
+	dir, err := ioutil.TempDir("", "library")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lib, err := NewLibraryService(spotifyclient.New(srv.HTTPClient()), CacheConfig{CacheDir: dir, Lifetime: time.Hour, WarmUp: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// There's nothing stale to serve, so lookups wait for the warm up
+	if track, err := lib.GetByID("t1"); err != nil || track == nil {
+		t.Errorf("expected t1 once warmed up, got %v, %v", track, err)
+	}
+}
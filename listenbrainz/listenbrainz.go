@@ -0,0 +1,272 @@
+// Package listenbrainz reads a user's listen history from ListenBrainz, so
+// Potentials tracks which have been heard enough can be pruned, and submits
+// tracks promoted to the library as loved.
+package listenbrainz
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"potentials-utils/dedupe"
+	"potentials-utils/library"
+
+	"github.com/apex/log"
+	"github.com/zmb3/spotify/v2"
+)
+
+const (
+	baseURL = "https://api.listenbrainz.org"
+	// listensPerPage is the most listens ListenBrainz returns per request
+	listensPerPage = 1000
+	// MatcherName is the name the listens matcher is registered under
+	MatcherName = "listens"
+	// spotifyTrackURL prefixes the Spotify IDs players attach to listens
+	spotifyTrackURL = "https://open.spotify.com/track/"
+)
+
+// Config configures access to a ListenBrainz account
+type Config struct {
+	// User is the ListenBrainz user name. ListenBrainz is unused if empty.
+	User string `yaml:"user"`
+	// Token is the user's ListenBrainz user token, only needed to submit
+	// loved tracks
+	Token string `yaml:"token"`
+	// SubmitLoved submits every track removed from Potentials because it's
+	// in the library as loved
+	SubmitLoved bool `yaml:"submitLoved"`
+}
+
+// Enabled returns whether a ListenBrainz account is configured
+func (c Config) Enabled() bool {
+	return c.User != ""
+}
+
+// Client calls the ListenBrainz API
+type Client struct {
+	baseURL string
+	user    string
+	token   string
+	http    *http.Client
+}
+
+// New creates a Client for the account described by cfg
+func New(cfg Config) (*Client, error) {
+	if cfg.User == "" {
+		return nil, errors.New("listenBrainz.user is required")
+	}
+	if cfg.SubmitLoved && cfg.Token == "" {
+		return nil, errors.New("listenBrainz.token is required to submit loved tracks")
+	}
+	return &Client{baseURL: baseURL, user: cfg.User, token: cfg.Token, http: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+// Listen is one listen of a track
+type Listen struct {
+	ListenedAt    int64 `json:"listened_at"`
+	TrackMetadata struct {
+		ArtistName     string `json:"artist_name"`
+		TrackName      string `json:"track_name"`
+		ReleaseName    string `json:"release_name"`
+		AdditionalInfo struct {
+			SpotifyID string `json:"spotify_id"`
+		} `json:"additional_info"`
+	} `json:"track_metadata"`
+}
+
+// Listens returns the user's listens since a time, most recent first
+func (c *Client) Listens(since time.Time) ([]Listen, error) {
+	listens := []Listen{}
+	maxTS := int64(0)
+	for {
+		q := url.Values{"count": {strconv.Itoa(listensPerPage)}}
+		if maxTS > 0 {
+			q.Set("max_ts", strconv.FormatInt(maxTS, 10))
+		}
+		var resp struct {
+			Payload struct {
+				Listens []Listen `json:"listens"`
+			} `json:"payload"`
+		}
+		if err := c.do(http.MethodGet, fmt.Sprintf("/1/user/%s/listens?%s", url.PathEscape(c.user), q.Encode()), nil, &resp); err != nil {
+			return nil, err
+		}
+		if len(resp.Payload.Listens) == 0 {
+			return listens, nil
+		}
+		for _, l := range resp.Payload.Listens {
+			if l.ListenedAt < since.Unix() {
+				return listens, nil
+			}
+			listens = append(listens, l)
+		}
+		maxTS = resp.Payload.Listens[len(resp.Payload.Listens)-1].ListenedAt
+	}
+}
+
+// LookupRecording returns the MusicBrainz ID of the recording of a track by
+// an artist, or the empty string if MusicBrainz doesn't know it
+func (c *Client) LookupRecording(artist, track string) (string, error) {
+	q := url.Values{"artist_name": {artist}, "recording_name": {track}}
+	var resp struct {
+		RecordingMBID string `json:"recording_mbid"`
+	}
+	if err := c.do(http.MethodGet, "/1/metadata/lookup/?"+q.Encode(), nil, &resp); err != nil {
+		return "", err
+	}
+	return resp.RecordingMBID, nil
+}
+
+// Love submits a recording as loved
+func (c *Client) Love(mbid string) error {
+	body := map[string]interface{}{"recording_mbid": mbid, "score": 1}
+	return c.do(http.MethodPost, "/1/feedback/recording-feedback", body, nil)
+}
+
+// do sends a request to path, decoding the response into result if not nil
+func (c *Client) do(method, path string, body, result interface{}) error {
+	var reqBody []byte
+	if body != nil {
+		var err error
+		if reqBody, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, c.baseURL+path, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Token "+c.token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	slurp, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("listenbrainz %s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(slurp)))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(slurp, result)
+}
+
+// Counts is how many times each track has been listened to
+type Counts struct {
+	bySpotifyID map[spotify.ID]int
+	byName      map[string]int
+}
+
+// NewCounts counts listens by the Spotify ID of the track, where the player
+// recorded it, and by track and artist name
+func NewCounts(listens []Listen) *Counts {
+	c := &Counts{bySpotifyID: map[spotify.ID]int{}, byName: map[string]int{}}
+	for _, l := range listens {
+		m := l.TrackMetadata
+		if strings.HasPrefix(m.AdditionalInfo.SpotifyID, spotifyTrackURL) {
+			c.bySpotifyID[spotify.ID(strings.TrimPrefix(m.AdditionalInfo.SpotifyID, spotifyTrackURL))]++
+		}
+		c.byName[nameKey(m.TrackName, m.ArtistName)]++
+	}
+	return c
+}
+
+// Count returns how many times t has been listened to
+func (c *Counts) Count(t spotify.FullTrack) int {
+	n := c.bySpotifyID[t.ID]
+	for _, artist := range library.ArtistNames(t.SimpleTrack) {
+		if byName := c.byName[nameKey(t.Name, artist)]; byName > n {
+			n = byName
+		}
+	}
+	return n
+}
+
+func nameKey(track, artist string) string {
+	return strings.ToLower(strings.TrimSpace(track)) + "\x00" + strings.ToLower(strings.TrimSpace(artist))
+}
+
+// NewMatcherFactory returns a factory for the listens matcher, which matches
+// playlist tracks listened to at least the minListens option times, default
+// 5, in the last days option days, default 365. The listen history is
+// fetched from client when the pipeline is built.
+func NewMatcherFactory(client *Client) dedupe.MatcherFactory {
+	return func(opts dedupe.MatcherOptions) (dedupe.Matcher, error) {
+		minListens := int(opts.Float("minListens", 5))
+		if minListens < 1 {
+			return nil, fmt.Errorf("minListens must be at least 1, got %d", minListens)
+		}
+		days := opts.Float("days", 365)
+		listens, err := client.Listens(time.Now().Add(-time.Duration(days * float64(24*time.Hour))))
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch listens: %w", err)
+		}
+		return &listensMatcher{counts: NewCounts(listens), minListens: minListens}, nil
+	}
+}
+
+// listensMatcher matches tracks which have been heard enough
+type listensMatcher struct {
+	counts     *Counts
+	minListens int
+}
+
+func (m *listensMatcher) Match(t spotify.PlaylistTrack, index dedupe.Library) (bool, string, float64, error) {
+	n := m.counts.Count(t.Track)
+	if n < m.minListens {
+		return false, "", 0, nil
+	}
+	return true, fmt.Sprintf("listened to %d times on ListenBrainz", n), 1, nil
+}
+
+// Lover submits tracks promoted to the library as loved on ListenBrainz
+type Lover struct {
+	client *Client
+}
+
+// NewLover creates a Lover submitting through client
+func NewLover(client *Client) *Lover {
+	return &Lover{client: client}
+}
+
+// Promoted loves each track removed because it's in the library. Tracks
+// removed by the listens matcher were heard enough, not promoted, so aren't
+// loved. Tracks MusicBrainz doesn't know are skipped.
+func (l *Lover) Promoted(ctx context.Context, duplicates []dedupe.Duplicate) error {
+	logger := log.FromContext(ctx)
+	for _, d := range duplicates {
+		if d.Matcher == MatcherName {
+			continue
+		}
+		t := d.Track.Track
+		mbid, err := l.client.LookupRecording(library.PrimaryArtist(t.SimpleTrack), t.Name)
+		if err != nil {
+			return err
+		}
+		if mbid == "" {
+			logger.WithFields(log.Fields{"trackID": t.ID}).Info("no MusicBrainz recording to love")
+			continue
+		}
+		if err := l.client.Love(mbid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package listenbrainz
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"potentials-utils/dedupe"
+	"potentials-utils/spotifytest"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// fakeListenBrainz serves 2500 listens, one a minute up to now, cycling
+// through Song 0 to Song 9 by Artist. Every listen of Song 0 was made on
+// Spotify, and only Song 0 to Song 4 are in MusicBrainz.
+type fakeListenBrainz struct {
+	now   int64
+	mu    sync.Mutex
+	loved []string
+}
+
+func (f *fakeListenBrainz) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	switch r.URL.Path {
+	case "/1/user/someone/listens":
+		maxTS, _ := strconv.ParseInt(q.Get("max_ts"), 10, 64)
+		if maxTS == 0 {
+			maxTS = f.now + 1
+		}
+		listens := []map[string]interface{}{}
+		for ix := int64(0); ix < 2500 && len(listens) < listensPerPage; ix++ {
+			ts := f.now - ix*60
+			if ts >= maxTS {
+				continue
+			}
+			info := map[string]string{}
+			if ix%10 == 0 {
+				info["spotify_id"] = spotifyTrackURL + "s0"
+			}
+			listens = append(listens, map[string]interface{}{
+				"listened_at": ts,
+				"track_metadata": map[string]interface{}{
+					"artist_name":     "Artist",
+					"track_name":      fmt.Sprintf("Song %d", ix%10),
+					"additional_info": info,
+				},
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"payload": map[string]interface{}{"listens": listens}})
+	case "/1/metadata/lookup/":
+		resp := map[string]string{}
+		var n int
+		if _, err := fmt.Sscanf(q.Get("recording_name"), "Song %d", &n); err == nil && n < 5 {
+			resp["recording_mbid"] = fmt.Sprintf("mbid%d", n)
+		}
+		json.NewEncoder(w).Encode(resp)
+	case "/1/feedback/recording-feedback":
+		if r.Header.Get("Authorization") != "Token secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var body struct {
+			MBID string `json:"recording_mbid"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.mu.Lock()
+		f.loved = append(f.loved, body.MBID)
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestClient(t *testing.T) (*Client, *fakeListenBrainz, func()) {
+	fake := &fakeListenBrainz{now: time.Now().Unix()}
+	srv := httptest.NewServer(fake)
+	c, err := New(Config{User: "someone", Token: "secret", SubmitLoved: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.baseURL = srv.URL
+	return c, fake, srv.Close
+}
+
+func TestListens(t *testing.T) {
+	c, _, cleanup := newTestClient(t)
+	defer cleanup()
+
+	listens, err := c.Listens(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listens) != 2500 {
+		t.Errorf("expected every listen across 3 pages, got %d", len(listens))
+	}
+	listens, err = c.Listens(time.Now().Add(-time.Hour + time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listens) != 60 {
+		t.Errorf("expected the last hour's 60 listens, got %d", len(listens))
+	}
+}
+
+func TestListensMatcher(t *testing.T) {
+	c, _, cleanup := newTestClient(t)
+	defer cleanup()
+	r := dedupe.NewRegistry()
+	r.Register(MatcherName, NewMatcherFactory(c))
+
+	testCases := []struct {
+		name     string
+		options  dedupe.MatcherOptions
+		track    spotify.FullTrack
+		expected bool
+	}{
+		{
+			name:     "heard enough by name",
+			track:    spotifytest.Track("t1", "Song 1", "Album", "Artist"),
+			expected: true,
+		},
+		{
+			name:  "other artist",
+			track: spotifytest.Track("t1", "Song 1", "Album", "Someone Else"),
+		},
+		{
+			name:     "heard enough by Spotify ID",
+			track:    spotifytest.Track("s0", "Renamed", "Album", "Someone Else"),
+			expected: true,
+		},
+		{
+			name:    "not heard enough in the last day",
+			options: dedupe.MatcherOptions{"minListens": 150, "days": 1},
+			track:   spotifytest.Track("t1", "Song 1", "Album", "Artist"),
+		},
+		{
+			name:     "heard enough in all time",
+			options:  dedupe.MatcherOptions{"minListens": 150, "days": 3},
+			track:    spotifytest.Track("t1", "Song 1", "Album", "Artist"),
+			expected: true,
+		},
+	}
+	for _, tc := range testCases {
+		p, err := r.Pipeline([]dedupe.MatcherConfig{{Name: MatcherName, Options: tc.options}})
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		result, err := p.Match(spotify.PlaylistTrack{Track: tc.track}, nil)
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		if (result != nil) != tc.expected {
+			t.Errorf("%s failed: expected match %v, got %+v", tc.name, tc.expected, result)
+		}
+	}
+}
+
+func TestLover(t *testing.T) {
+	c, fake, cleanup := newTestClient(t)
+	defer cleanup()
+
+	duplicates := []dedupe.Duplicate{}
+	for ix, matcher := range []string{"id", "isrc", MatcherName, "metadata", "id"} {
+		track := spotifytest.Track(fmt.Sprintf("t%d", ix), fmt.Sprintf("Song %d", ix*2), "Album", "Artist")
+		d := dedupe.Duplicate{Track: spotify.PlaylistTrack{Track: track}}
+		d.Matcher = matcher
+		duplicates = append(duplicates, d)
+	}
+	if err := NewLover(c).Promoted(context.Background(), duplicates); err != nil {
+		t.Fatal(err)
+	}
+	// Song 4 was pruned by the listens matcher, Song 6 and Song 8 aren't in
+	// MusicBrainz
+	if len(fake.loved) != 2 || fake.loved[0] != "mbid0" || fake.loved[1] != "mbid2" {
+		t.Errorf("expected Song 0 and Song 2 to be loved, got %v", fake.loved)
+	}
+}
@@ -1,59 +1,100 @@
 package main
 
 import (
+	"bufio"
 	"context"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"math/rand"
-	"net/http"
 	"os"
 	"path"
-	"sort"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"gopkg.in/yaml.v2"
 
-	"potentials-utils/prefixtree"
+	"potentials-utils/applemusic"
+	"potentials-utils/audit"
+	"potentials-utils/dedupe"
+	"potentials-utils/digest"
+	"potentials-utils/journal"
+	"potentials-utils/journald"
+	"potentials-utils/library"
+	"potentials-utils/listenbrainz"
+	"potentials-utils/metricspush"
+	"potentials-utils/notify"
+	"potentials-utils/onrepeat"
+	"potentials-utils/preflight"
+	"potentials-utils/review"
+	"potentials-utils/reviewqueue"
+	"potentials-utils/schedule"
+	"potentials-utils/sentry"
+	"potentials-utils/serverless"
+	"potentials-utils/spotifyauth"
+	"potentials-utils/spotifyclient"
+	"potentials-utils/throughput"
+	"potentials-utils/tracing"
+	"potentials-utils/trash"
+	"potentials-utils/youtubemusic"
 
 	"github.com/apex/log"
-	"github.com/cheggaaa/pb/v3"
-	"github.com/zmb3/spotify"
+	"github.com/zmb3/spotify/v2"
+	spotifyoauth "github.com/zmb3/spotify/v2/auth"
 )
 
 var (
-	clientCh       = make(chan *spotify.Client)
-	auth           spotify.Authenticator
-	spClient       *spotify.Client
-	libraryService *LibraryService
-	sessionKey     string
-	config         *PotentialsUtilsConfig
-	cfgPath        string
-	runserver      bool
-	dryRun         bool
-	noCache        bool
-	logLevel       = log.WarnLevel
+	dryRun bool
+	// configPath is the default -config of every subcommand
+	configPath = "config.yaml"
+	logLevel   = log.WarnLevel
+	stdin      = bufio.NewReader(os.Stdin)
 )
 
-var SpotifyLibraryIndexCreateError = errors.New("Error creating Spotify library cache")
+// readScopes are the Spotify OAuth scopes every command requests, to look up
+// the user, their playlists and their library
+var readScopes = []string{
+	spotifyoauth.ScopeUserReadPrivate,
+	spotifyoauth.ScopePlaylistReadPrivate,
+	spotifyoauth.ScopeUserLibraryRead,
+}
+
+// playlistModifyScopes are the Spotify OAuth scopes needed to add tracks to
+// and remove them from playlists, requested by commands which modify Spotify
+var playlistModifyScopes = []string{
+	spotifyoauth.ScopePlaylistModifyPublic,
+	spotifyoauth.ScopePlaylistModifyPrivate,
+}
 
-type CacheConfig struct {
-	Lifetime time.Duration `yaml:"lifetimeNs"`
-	CacheDir string        `yaml:"cacheDir"`
+// libraryModifyScopes are the Spotify OAuth scopes needed to save and un-save
+// tracks, requested only by the commands which do
+var libraryModifyScopes = []string{
+	spotifyoauth.ScopeUserLibraryModify,
 }
 
-// DuplicatesConfig holds config options for potentials-utils' duplicate
-// detection behavior
-type DuplicatesConfig struct {
-	// Aggressive controls cleaning aggression levels. If true, enables more
-	// aggressive cleaning which will remove tracks from Potentials which match
-	// the song name, album name, and all artist names of an existing track in
-	// your library. Tracks will onlly be removed by ID otherwise.
-	Aggressive bool `yaml:"aggressive"`
+// modifyScopes are the scopes which let potentials-utils change the user's
+// Spotify account rather than just read it, never requested by commands
+// which don't
+var modifyScopes = map[string]bool{
+	spotifyoauth.ScopePlaylistModifyPublic:    true,
+	spotifyoauth.ScopePlaylistModifyPrivate:   true,
+	spotifyoauth.ScopeUserLibraryModify:       true,
+	spotifyoauth.ScopeUserModifyPlaybackState: true,
+}
+
+// tokenFile is the name of the file the Spotify OAuth token is kept in, in
+// the cache directory
+const tokenFile = "spotify-token.json"
+
+// playerScopes are the Spotify OAuth scopes needed to see what's playing and
+// control playback, requested only by the commands which do
+var playerScopes = []string{
+	spotifyoauth.ScopeUserReadPlaybackState,
+	spotifyoauth.ScopeUserModifyPlaybackState,
+	spotifyoauth.ScopeUserReadCurrentlyPlaying,
 }
 
 type SpotifyConfig struct {
@@ -63,496 +104,642 @@ type SpotifyConfig struct {
 	User                 string        `yaml:"user"`
 	PotentialsPlaylistID spotify.ID    `yaml:"potentialsPlaylistID"`
 	AuthTimeout          time.Duration `yaml:"authTimeoutNs"`
+	// Playlists are the playlists a clean cleans, by ID or by name, in
+	// place of just the Potentials playlist
+	Playlists []string `yaml:"playlists"`
+	// Retry configures retrying requests Spotify rate limited or failed
+	// transiently
+	Retry spotifyclient.RetryConfig `yaml:"retry"`
+	// Scopes, if set, are the OAuth scopes every command requests, in place
+	// of those derived from what the command does
+	Scopes []string `yaml:"scopes"`
+	// TokenFile is where the OAuth token is kept between runs, in the cache
+	// directory
+	TokenFile string `yaml:"-"`
+}
+
+// spotifyIDPattern matches Spotify IDs, which are 22 base-62 characters
+var spotifyIDPattern = regexp.MustCompile(`^[0-9A-Za-z]{22}$`)
+
+// CleanPlaylists returns the IDs of the playlists a clean cleans: Playlists,
+// looking up those given by name through client, or the Potentials playlist
+// if there are none
+func (c SpotifyConfig) CleanPlaylists(ctx context.Context, client spotifyclient.API) ([]spotify.ID, error) {
+	if len(c.Playlists) == 0 {
+		return []spotify.ID{c.PotentialsPlaylistID}, nil
+	}
+	return resolvePlaylists(ctx, client, c.Playlists)
+}
+
+// resolvePlaylists returns the IDs of playlists given by ID or by name,
+// looking up those given by name through client
+func resolvePlaylists(ctx context.Context, client spotifyclient.API, playlists []string) ([]spotify.ID, error) {
+	ids := make([]spotify.ID, len(playlists))
+	names := map[string]int{}
+	for i, p := range playlists {
+		if spotifyIDPattern.MatchString(p) {
+			ids[i] = spotify.ID(p)
+		} else {
+			names[p] = i
+		}
+	}
+	if len(names) == 0 {
+		return ids, nil
+	}
+	page, err := client.Playlists(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up playlists by name: %w", err)
+	}
+	for {
+		for _, p := range page.Playlists {
+			i, ok := names[p.Name]
+			if !ok {
+				continue
+			}
+			if ids[i] != "" && ids[i] != p.ID {
+				return nil, fmt.Errorf("more than one playlist is named %q, use its ID", p.Name)
+			}
+			ids[i] = p.ID
+		}
+		if err := client.NextPlaylists(ctx, page); err == spotify.ErrNoMorePages {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to look up playlists by name: %w", err)
+		}
+	}
+	for name, i := range names {
+		if ids[i] == "" {
+			return nil, fmt.Errorf("no playlist named %q", name)
+		}
+	}
+	return ids, nil
+}
+
+// AuthConfig returns the subset of the Spotify config needed to authenticate,
+// recording logins in auditLog
+func (c SpotifyConfig) AuthConfig(auditLog *audit.Log) spotifyauth.Config {
+	return spotifyauth.Config{
+		ID:          c.ID,
+		Secret:      c.Secret,
+		CallbackURL: c.CallbackURL,
+		AuthTimeout: c.AuthTimeout,
+		TokenFile:   c.TokenFile,
+		Audit:       auditLog,
+	}
+}
+
+// ServerConfig holds config options for running potentials-utils in server
+// mode
+type ServerConfig struct {
+	// MaxConcurrentJobs is the maximum number of jobs the server will run at
+	// once. Jobs against the same playlist always run one at a time.
+	MaxConcurrentJobs int `yaml:"maxConcurrentJobs"`
+	// EvictionWebhook, if set, is sent a JSON POST each time the library
+	// index expires
+	EvictionWebhook string `yaml:"evictionWebhook"`
+	// WarmUp starts serving straight away from the library cached on disk,
+	// however stale, while the index is rebuilt in the background
+	WarmUp bool `yaml:"warmUp"`
+	// Freshness is what each endpoint does while the index is warming up,
+	// keyed by clean, add or search: "stale" serves from the stale index,
+	// "fresh" waits for the rebuild. Cleans wait by default, adds and
+	// searches don't.
+	Freshness map[string]string `yaml:"freshness"`
+}
+
+// ServesStale returns true if endpoint is served from a stale library index
+// while it's warming up
+func (c ServerConfig) ServesStale(endpoint string) bool {
+	switch c.Freshness[endpoint] {
+	case "stale":
+		return true
+	case "fresh":
+		return false
+	}
+	return endpoint != "clean"
+}
+
+// ScheduleConfig configures the server to clean Potentials and refresh the
+// library index by itself, on cron-style schedules such as "0 */6 * * *",
+// @daily or "@every 90m"
+type ScheduleConfig struct {
+	// Clean is when to clean Potentials, never if empty. Scheduled cleans are
+	// skipped if neither the playlist nor the library have changed.
+	Clean string `yaml:"clean"`
+	// Refresh is when to rebuild the library index from Spotify, never if
+	// empty
+	Refresh string `yaml:"refresh"`
+	// JitterSec delays each scheduled run by a random number of seconds up
+	// to this
+	JitterSec int `yaml:"jitterSec"`
+	// DryRun makes scheduled cleans dry runs
+	DryRun bool `yaml:"dryRun"`
+}
+
+// Validate returns an error if either schedule is invalid
+func (c ScheduleConfig) Validate() error {
+	if c.Clean != "" {
+		if _, err := schedule.Parse(c.Clean); err != nil {
+			return fmt.Errorf("clean: %w", err)
+		}
+	}
+	if c.Refresh != "" {
+		if _, err := schedule.Parse(c.Refresh); err != nil {
+			return fmt.Errorf("refresh: %w", err)
+		}
+	}
+	if c.JitterSec < 0 {
+		return fmt.Errorf("jitterSec must not be negative, got %d", c.JitterSec)
+	}
+	return nil
 }
 
-type PotentialsUtilsConfig struct {
-	Spotify    SpotifyConfig    `yaml:"spotify"`
-	Duplicates DuplicatesConfig `yaml:"duplicates"`
-	Cache      CacheConfig      `yaml:"cache"`
-}
-
-// StoredLibrary is a serialization type for storing a library on disk
-type StoredLibrary struct {
-	Expiration time.Time            `json:"expiration,omitempty"`
-	Tracks     []spotify.SavedTrack `json:"tracks,omitempty"`
+// Jitter returns the most each scheduled run is delayed by
+func (c ScheduleConfig) Jitter() time.Duration {
+	return time.Duration(c.JitterSec) * time.Second
 }
 
-// LibraryService is responsible for interfacing with the potentials-utils local
-// spotify library
-type LibraryService struct {
-	CacheDir     string
-	CacheFile    string
-	libraryIndex *SpotifyLibraryIndex
+type PotentialsUtilsConfig struct {
+	Spotify    SpotifyConfig           `yaml:"spotify"`
+	Duplicates dedupe.DuplicatesConfig `yaml:"duplicates"`
+	Cache      library.CacheConfig     `yaml:"cache"`
+	Server     ServerConfig            `yaml:"server"`
+	// Schedule is when the server cleans and refreshes by itself
+	Schedule   ScheduleConfig    `yaml:"schedule"`
+	Tracing    tracing.Config    `yaml:"tracing"`
+	Sentry     sentry.Config     `yaml:"sentry"`
+	AppleMusic applemusic.Config `yaml:"appleMusic"`
+	// YouTubeMusic is an optional YouTube Music account crosscheck also
+	// looks Potentials tracks up in
+	YouTubeMusic youtubemusic.Config `yaml:"youtubeMusic"`
+	// ListenBrainz is an optional ListenBrainz account whose listen history
+	// the listens matcher prunes by, and which promoted tracks are loved on
+	ListenBrainz listenbrainz.Config `yaml:"listenBrainz"`
+	// Metrics are optionally pushed at the end of each clean run
+	Metrics metricspush.Config `yaml:"metrics"`
+	// Recipes are named routines of subcommands, run by `run <name>`
+	Recipes map[string]Recipe `yaml:"recipes"`
+	// Digest is the optional digest of Potentials activity the server sends
+	// every period
+	Digest digest.Config `yaml:"digest"`
+	// Notify are the channels a running server tells about every job which
+	// finishes
+	Notify notify.Config `yaml:"notify"`
+	// ReadOnly refuses every call which would modify Spotify, regardless of
+	// dry-run
+	ReadOnly bool `yaml:"readOnly"`
+	// Audit is the optional log of every change made to Spotify
+	Audit audit.Config `yaml:"audit"`
+}
+
+// loadConfig reads and parses the YAML config file at cfgPath
+func loadConfig(cfgPath string) (*PotentialsUtilsConfig, error) {
+	contents, err := ioutil.ReadFile(cfgPath)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(contents)
 }
 
-// NewStoredLibrary creates a new StoredLibrary with sensible defaults
-func NewStoredLibrary() *StoredLibrary {
-	return &StoredLibrary{
-		Expiration: time.Now(),
-		Tracks:     []spotify.SavedTrack{},
+// newAuditLog returns the audit log configured, nil if none is
+func newAuditLog(config *PotentialsUtilsConfig) *audit.Log {
+	if config.Audit.Path == "" {
+		return nil
 	}
+	return commandAuditLog(config.Audit.Path)
 }
 
-// NewLibraryService creates a new LibraryService instance. The instance will
-// attempt to build its cache from the provided cache directory.
-func NewLibraryService(cacheDir string) (*LibraryService, error) {
-	err := AuthMe()
-	if err != nil {
-		return nil, err
-	}
-	libraryService := &LibraryService{
-		CacheDir:     cacheDir,
-		CacheFile:    path.Join(cacheDir, "library.json"),
-		libraryIndex: &SpotifyLibraryIndex{},
-	}
+// commandAuditLog returns an audit log at path recording the command being
+// run with every event
+func commandAuditLog(path string) *audit.Log {
+	l := audit.New(path)
+	l.Command = strings.Join(os.Args[1:], " ")
+	return l
+}
 
-	err = libraryService.readyLibrary()
-	if err != nil {
+// parseConfig parses a YAML config
+func parseConfig(contents []byte) (*PotentialsUtilsConfig, error) {
+	var config *PotentialsUtilsConfig
+	if err := yaml.Unmarshal(contents, &config); err != nil {
 		return nil, err
 	}
-	err = libraryService.persistLibrary()
-	if err != nil {
-		return nil, err
+	if config == nil {
+		config = &PotentialsUtilsConfig{}
 	}
-	return libraryService, nil
+	// Saved albums are only fetched when duplicate detection uses them
+	config.Cache.SavedAlbums = config.Duplicates.UsesSavedAlbums()
+	config.Spotify.TokenFile = path.Join(config.Cache.CacheDir, tokenFile)
+	return config, nil
 }
 
-func (s *LibraryService) persistLibrary() error {
-	mode := os.FileMode(uint32(0755))
-	storedLibrary := NewStoredLibrary()
-	storedLibrary.Expiration = s.libraryIndex.evictionTime
-	for _, v := range s.libraryIndex.tracksByID {
-		storedLibrary.Tracks = append(storedLibrary.Tracks, *v)
-	}
-	bytes, err := json.Marshal(storedLibrary)
-	if err != nil {
-		return err
+// Scopes returns the Spotify OAuth scopes a command requests: readScopes,
+// playlistModifyScopes if it modifies Spotify, and extra, leaving out scopes
+// which modify Spotify unless it does and config isn't read-only. Overridden
+// by spotify.scopes.
+func (c *PotentialsUtilsConfig) Scopes(write bool, extra ...string) []string {
+	if len(c.Spotify.Scopes) > 0 {
+		return c.Spotify.Scopes
 	}
-	err = os.MkdirAll(s.CacheDir, mode)
-	if err != nil {
-		return err
+	write = write && !c.ReadOnly
+	scopes := append([]string{}, readScopes...)
+	if write {
+		scopes = append(scopes, playlistModifyScopes...)
 	}
-	err = ioutil.WriteFile(s.CacheFile, bytes, mode)
-	if err != nil {
-		return err
+	for _, s := range extra {
+		if write || !modifyScopes[s] {
+			scopes = append(scopes, s)
+		}
 	}
-	return nil
+	return scopes
 }
 
-func (s *LibraryService) readyLibrary() error {
-	if s.libraryIndex.Alive() {
-		log.Debug("Library index is fresh.")
-		return nil
+// preflightOptions describes the Spotify access cleaning playlists with config
+// needs. Write access isn't checked if readOnly.
+func preflightOptions(config *PotentialsUtilsConfig, auth *spotifyauth.Authenticator, playlists []spotify.ID, readOnly bool) preflight.Options {
+	playlists = append([]spotify.ID{}, playlists...)
+	if id := config.Duplicates.Policy.ArchivePlaylistID; id != "" {
+		playlists = append(playlists, id)
 	}
-	log.Debug("Library index is not fresh, attempting to build from local cache.")
-	if err := s.indexFromCacheFile(); err != nil {
-		log.WithFields(log.Fields{"err": err}).Warn("failed to build index from cache")
-	}
-	if s.libraryIndex.Alive() {
-		log.Info("built a fresh library index from disk cache.")
-		return nil
-	} else {
-		log.WithFields(log.Fields{"cacheFile": s.CacheFile}).Warn("failed to build a fresh index from local disk cache")
-		log.Info("Attempting to build cache from Spotify API...")
-		if err := s.indexFromSpotify(); err != nil {
-			return err
-		}
+	return preflight.Options{
+		Required:  auth.Scopes(),
+		Granted:   auth.GrantedScopes(),
+		Playlists: playlists,
+		ReadOnly:  readOnly,
 	}
-	return nil
 }
 
-func (s *LibraryService) indexFromSpotify() error {
-	index := NewSpotifyLibraryIndex()
-	log.Info("Rebuilding Spotify library index...")
-	trackPager, err := spClient.CurrentUsersTracks()
-	if err != nil {
-		return err
+// pushRunMetrics pushes the outcome of a clean run to the configured metrics
+// destinations, if any. Failing to push is logged rather than failing the
+// run.
+func pushRunMetrics(config *PotentialsUtilsConfig, r dedupe.Result, err error, apiCalls, retries int64) {
+	if !config.Metrics.Enabled() {
+		return
 	}
-	progressBar := pb.StartNew(trackPager.Total)
-	for {
-		for _, t := range trackPager.Tracks {
-			index.IndexTrack(t.ID, t)
-		}
-		err := spClient.NextPage(trackPager)
-		if err != nil {
-			if err != spotify.ErrNoMorePages {
-				return err
-			}
-			break
+	gauge := func(b bool) float64 {
+		if b {
+			return 1
 		}
-		progressBar.Add(trackPager.Limit)
-	}
-	index.MakeItFresh()
-	s.libraryIndex = index
-	return nil
-}
-
-func (s *LibraryService) indexFromCacheFile() error {
-	index := NewSpotifyLibraryIndex()
-	file, err := os.Open(s.CacheFile)
+		return 0
+	}
+	metrics := []metricspush.Metric{
+		{Name: "potentials_run_success", Help: "Whether the last run succeeded.", Value: gauge(err == nil)},
+		{Name: "potentials_run_timestamp_seconds", Help: "When the last run finished.", Value: float64(time.Now().Unix())},
+		{Name: "potentials_run_duration_seconds", Help: "How long the last run's clean took.", Value: r.Duration.Seconds()},
+		{Name: "potentials_run_dry_run", Help: "Whether the last run was a dry run.", Value: gauge(r.DryRun)},
+		{Name: "potentials_run_skipped", Help: "Whether the last run was skipped as nothing had changed.", Value: gauge(r.Skipped)},
+		{Name: "potentials_run_tracks_scanned", Help: "Tracks scanned by the last run.", Value: float64(r.TracksScanned)},
+		{Name: "potentials_run_duplicates_found", Help: "Duplicates found by the last run.", Value: float64(r.DuplicatesFound)},
+		{Name: "potentials_run_tracks_removed", Help: "Duplicates removed or archived by the last run.", Value: float64(r.Removed)},
+		{Name: "potentials_run_duplicates_kept", Help: "Duplicates left in the playlist by the last run.", Value: float64(r.Kept)},
+		{Name: "potentials_run_spotify_api_calls", Help: "Spotify API calls made by the last run.", Value: float64(apiCalls)},
+		{Name: "potentials_run_spotify_retries", Help: "Spotify API calls the last run retried after rate limiting or a transient error.", Value: float64(retries)},
+	}
+	if err := metricspush.New(config.Metrics).Push(metrics); err != nil {
+		log.WithFields(log.Fields{"err": err}).Warn("failed to push run metrics")
+	}
+}
+
+// newCleaner builds the Cleaner described by config, indexing the library and
+// cleaning playlists through client
+func newCleaner(ctx context.Context, config *PotentialsUtilsConfig, client spotifyclient.API) (*dedupe.Cleaner, error) {
+	libraryService, err := library.NewLibraryService(client, config.Cache)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to start the potentials-utils library service: %w", err)
 	}
-	slurp, err := ioutil.ReadAll(file)
-	if err != nil {
-		return err
+	registry := dedupe.NewRegistry()
+	var listens *listenbrainz.Client
+	if config.ListenBrainz.Enabled() {
+		if listens, err = listenbrainz.New(config.ListenBrainz); err != nil {
+			return nil, err
+		}
+		registry.Register(listenbrainz.MatcherName, listenbrainz.NewMatcherFactory(listens))
 	}
-	var storedLibrary *StoredLibrary
-	err = json.Unmarshal(slurp, &storedLibrary)
+	registry.Register(review.MatcherName, review.NewMatcherFactory(newReviewLog(config)))
+	registry.Register(onrepeat.MatcherName, onrepeat.NewMatcherFactory(client))
+	pipeline, err := registry.Pipeline(config.Duplicates.MatcherConfigs())
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("invalid duplicates.matchers config: %w", err)
 	}
-	for _, t := range storedLibrary.Tracks {
-		index.IndexTrack(t.ID, t)
+	policy, err := dedupe.NewPolicy(config.Duplicates.Policy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid duplicates.policy config: %w", err)
 	}
-	index.evictionTime = storedLibrary.Expiration
-	s.libraryIndex = index
-	return nil
-}
-
-// GetByID returns the corresponding SavedTrack for the provided key if it exists and the cache is
-// fresh. Will rebuild the cache if stale.
-func (s *LibraryService) GetByID(k spotify.ID) (*spotify.SavedTrack, error) {
-	err := s.readyLibrary()
+	var lib dedupe.Library = libraryService
+	if len(config.Duplicates.ReferencePlaylists) > 0 {
+		references, err := referencePlaylists(ctx, config, client)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duplicates.referencePlaylists config: %w", err)
+		}
+		lib = library.NewReferenceLibrary(libraryService, client, references)
+	}
+	cleaner := dedupe.NewCleaner(client, lib, pipeline, policy, config.Cache.Metrics)
+	// Running offline every clean is a dry run, so there's nothing to guard
+	if user, err := client.CurrentUser(ctx); err == nil {
+		cleaner.UserID = user.ID
+	} else if err != spotifyclient.ErrOffline {
+		return nil, fmt.Errorf("failed to look up the current user: %w", err)
+	}
+	if config.Duplicates.OwnAdditionsOnly && cleaner.UserID == "" {
+		return nil, errors.New("invalid duplicates.ownAdditionsOnly config: your additions can't be told apart without looking up your Spotify user, which can't be done offline")
+	}
+	cleaner.Metadata = client
+	cleaner.GenreFilter = config.Duplicates.GenreFilter()
+	cleaner.PopularityFilter = config.Duplicates.PopularityFilter()
+	cleaner.OwnAdditionsOnly = config.Duplicates.OwnAdditionsOnly
+	cleaner.RemoveRepeats = config.Duplicates.RemoveRepeats
+	if config.Cache.Progress != nil {
+		cleaner.Progress = config.Cache.Progress
+	}
+	cleaner.Tags = dedupe.NewFileTagStore(path.Join(config.Cache.CacheDir, "tags.json"))
+	cleaner.History = dedupe.NewFileCleanHistory(path.Join(config.Cache.CacheDir, "history.json"))
+	if config.Duplicates.TrashRetentionDays > 0 {
+		cleaner.Trash = newTrash(config, client)
+	}
+	promotions := dedupe.MultiPromotions{newThroughputLog(config)}
+	if listens != nil && config.ListenBrainz.SubmitLoved {
+		promotions = append(promotions, listenbrainz.NewLover(listens))
+	}
+	cleaner.Promotions = promotions
+	cleaner.Reviews = newReviewQueue(config)
+	cleaner.Journal = newRemovalJournal(config)
+	cleaner.Anomalies = config.Duplicates.Anomalies
+	return cleaner, nil
+}
+
+// referencePlaylists returns the IDs of the playlists whose tracks count as
+// part of the library, none of which may be cleaned
+func referencePlaylists(ctx context.Context, config *PotentialsUtilsConfig, client spotifyclient.API) ([]spotify.ID, error) {
+	references, err := resolvePlaylists(ctx, client, config.Duplicates.ReferencePlaylists)
 	if err != nil {
 		return nil, err
 	}
-	v := s.libraryIndex.tracksByID[k]
-	return v, nil
-}
-
-// GetBySongArtistAlbum gets all tracks with the same song name, artist name,
-// and album title. Will rebuild cache if stale.
-func (s *LibraryService) GetBySongAlbumArtistNames(songName, albumName string, artistNames []string) ([]*spotify.SavedTrack, error) {
-	err := s.readyLibrary()
+	cleaned, err := config.Spotify.CleanPlaylists(ctx, client)
 	if err != nil {
 		return nil, err
 	}
-	searchStr := trackIndexString(songName, albumName, artistNames)
-	if s.libraryIndex.trackSearchTree.Contains(searchStr) {
-		// search entire cache for songs that match these fields
-		var matches []*spotify.SavedTrack
-		for _, v := range s.libraryIndex.tracksByID {
-			if v.Name == songName && v.Album.Name == albumName && containsAll(getArtistNames(v.SimpleTrack), artistNames) {
-				matches = append(matches, v)
+	for _, r := range references {
+		for _, c := range cleaned {
+			if r == c {
+				return nil, fmt.Errorf("playlist %s is cleaned, so can't also be a reference", r)
 			}
 		}
-		return matches, nil
-	} else {
-		return nil, nil
 	}
-
+	return references, nil
 }
 
-// SpotifyLibraryIndex represents an in-memory cache of the current users' spotify library. It must
-// be completely rebuilt if the current time is after the evictionTime. Yeah I
-// know this is basically a hand-tuned database, I did it for fun go read a book
-type SpotifyLibraryIndex struct {
-	tracksByID      map[spotify.ID]*spotify.SavedTrack `json:"items"`
-	trackSearchTree *prefixtree.PrefixTree             `json:"searchTree"`
-	lifetime        time.Duration                      `json:"lifetime"`
-	// This cache has to be completely rebuilt, no element-wise evictions
-	evictionTime time.Time `json:"evictionTime"`
+// newNotifier returns a Notifier sending events to every configured channel
+func newNotifier(config *PotentialsUtilsConfig) (notify.Notifier, error) {
+	return notify.NewRegistry().Notifier(config.Notify)
 }
 
-func (c *SpotifyLibraryIndex) dumpTree() []string {
-	return c.trackSearchTree.Words()
+// newTrash returns the trash removed duplicates are kept in, managed through
+// client
+func newTrash(config *PotentialsUtilsConfig, client spotifyclient.API) *trash.Trash {
+	retention := time.Duration(config.Duplicates.TrashRetentionDays) * 24 * time.Hour
+	return trash.New(client, path.Join(config.Cache.CacheDir, "trash.json"), retention)
 }
 
-// NewSpotifyLibraryIndex creates a SpotifyLibraryIndex with a cache lifetime of 1 day.
-func NewSpotifyLibraryIndex() *SpotifyLibraryIndex {
-	return &SpotifyLibraryIndex{
-		tracksByID:      map[spotify.ID]*spotify.SavedTrack{},
-		trackSearchTree: prefixtree.NewPrefixTree(),
-		lifetime:        config.Cache.Lifetime,
-		evictionTime:    time.Now(), // Eviction time will be
-	}
-
+// newReviewLog returns the log of review session verdicts
+func newReviewLog(config *PotentialsUtilsConfig) *review.Log {
+	return review.NewLog(path.Join(config.Cache.CacheDir, "review.json"))
 }
 
-func trackIndexString(trackName, albumName string, artistNames []string) string {
-	var indexStrBuilder strings.Builder
-	// Song name
-	indexStrBuilder.WriteString(fmt.Sprintf("%s", trackName))
-	// Album name
-	indexStrBuilder.WriteString(fmt.Sprintf("%s", albumName))
-	// Each artist name, in alphabetical order
-	sort.Strings(artistNames)
-	for _, a := range artistNames {
-		indexStrBuilder.WriteString(fmt.Sprintf("%s", a))
-	}
-	return indexStrBuilder.String()
+// newReviewQueue returns the queue of duplicates waiting for review
+func newReviewQueue(config *PotentialsUtilsConfig) *reviewqueue.Queue {
+	return reviewqueue.NewQueue(path.Join(config.Cache.CacheDir, "review-queue.json"))
 }
 
-// addTrackToSearchTree adds tracks to the search tree using a custom track
-// string "[TrackName][AlbumName][ArtistNames...]"
-func (i *SpotifyLibraryIndex) addTrackToSearchTree(v spotify.SavedTrack) {
-	searchTerm := trackIndexString(v.Name, v.Album.Name, getArtistNames(v.SimpleTrack))
-	i.trackSearchTree.Add(searchTerm)
+// newEntityCache returns the cache of entities looked up from Spotify
+func newEntityCache(config *PotentialsUtilsConfig) *spotifyclient.EntityCache {
+	return spotifyclient.NewEntityCache(path.Join(config.Cache.CacheDir, "entities"), config.Cache.EntityLifetimes, config.Cache.Metrics)
 }
 
-// IndexTrack adds a track to the library index and refreshes the lifetime of
-// the index
-func (i *SpotifyLibraryIndex) IndexTrack(k spotify.ID, v spotify.SavedTrack) {
-	i.tracksByID[k] = &v
-	i.addTrackToSearchTree(v)
+// newRemovalJournal returns the journal of tracks removed by cleans
+func newRemovalJournal(config *PotentialsUtilsConfig) *journal.Journal {
+	return journal.New(path.Join(config.Cache.CacheDir, "removals.json"))
 }
 
-// MakeItFresh tells the library index it should be considered fresh
-func (i *SpotifyLibraryIndex) MakeItFresh() {
-	i.evictionTime = time.Now().Add(i.lifetime)
+// newThroughputLog returns the log of tracks leaving Potentials
+func newThroughputLog(config *PotentialsUtilsConfig) *throughput.Log {
+	return throughput.NewLog(path.Join(config.Cache.CacheDir, "throughput.json"))
 }
 
-func containsAll(list1, list2 []string) bool {
-	if len(list2) != len(list2) {
-		return false
+// cachedCleanPlaylists returns the cached copies of the playlists cleaned,
+// matching those configured by name against the names they were cached
+// under, so Spotify isn't called. Playlists never cached are left out.
+func cachedCleanPlaylists(config *PotentialsUtilsConfig) ([]*spotifyclient.CachedPlaylist, error) {
+	cached, err := spotifyclient.NewPlaylistCache(path.Join(config.Cache.CacheDir, "playlists")).List()
+	if err != nil {
+		return nil, err
 	}
-
-	containsAll := true
-	for _, e1 := range list1 {
-		found := false
-		for _, e2 := range list2 {
-			found = found || e1 == e2
+	configured := config.Spotify.Playlists
+	if len(configured) == 0 {
+		configured = []string{string(config.Spotify.PotentialsPlaylistID)}
+	}
+	playlists := []*spotifyclient.CachedPlaylist{}
+	for _, c := range configured {
+		for _, p := range cached {
+			if (spotifyIDPattern.MatchString(c) && p.ID == spotify.ID(c)) || p.Name == c {
+				playlists = append(playlists, p)
+				break
+			}
 		}
-		containsAll = containsAll && found
 	}
-	return containsAll
-
+	return playlists, nil
 }
 
-func (i *SpotifyLibraryIndex) Alive() bool {
-	return time.Now().Before(i.evictionTime)
-}
-
-func authServer() *http.Server {
-	mux := http.NewServeMux()
-
-	mux.HandleFunc("/callback/spotify", HandleAuthCallback)
-	mux.HandleFunc("/spotify/cleanpotentials", HandleCleanPotentials)
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		log.WithFields(log.Fields{"url": r.URL.String()}).Debug("unhandled request")
-	})
-	srv := &http.Server{
-		Addr:    ":8080",
-		Handler: mux,
+// potentialsStats summarizes how tracks move through the playlists cleaned
+// from the throughput log, the clean history and the cached copies of the
+// playlists. The last clean is the least recent of theirs, so it's zero
+// until every playlist has been cleaned. Spotify isn't called.
+func potentialsStats(config *PotentialsUtilsConfig) (throughput.Stats, error) {
+	events, err := newThroughputLog(config).Events()
+	if err != nil {
+		return throughput.Stats{}, err
 	}
-	return srv
-
-}
-
-// AuthMe authenticates with Spotify as me and creates a client or uses the current client
-// if already authenticated.
-func AuthMe() error {
-	// no auth server up, start a one-off
-	if !runserver {
-		log.Info("running one-off auth server...")
-		authSrv := authServer()
-		go func() {
-			err := authSrv.ListenAndServe()
-			if err == http.ErrServerClosed {
-			} else {
-
-			}
-		}()
-		ctx, cancelFunc := context.WithTimeout(context.Background(), config.Spotify.AuthTimeout)
-		defer cancelFunc()
-		defer authSrv.Shutdown(ctx)
-		err := authMeWithTimeout()
-		if err != nil {
-			return err
-		}
-
+	playlists, err := cachedCleanPlaylists(config)
+	if err != nil {
+		return throughput.Stats{}, err
 	}
-	if spClient == nil {
-		err := authMeWithTimeout()
-		if err != nil {
-			return err
-		}
+	pending := []spotify.PlaylistTrack{}
+	for _, p := range playlists {
+		pending = append(pending, p.Tracks...)
 	}
-	if _, err := spClient.CurrentUser(); err != nil {
-		err = authMeWithTimeout()
+	stats := throughput.Compute(events, pending, time.Now())
+	history := dedupe.NewFileCleanHistory(path.Join(config.Cache.CacheDir, "history.json"))
+	for ix, p := range playlists {
+		last, err := history.LastClean(p.ID)
 		if err != nil {
-			return err
+			return throughput.Stats{}, err
+		}
+		if last == nil {
+			stats.LastCleanedAt = time.Time{}
+			break
+		}
+		if ix == 0 || last.CleanedAt.Before(stats.LastCleanedAt) {
+			stats.LastCleanedAt = last.CleanedAt
 		}
-		// The current client works, just use it.
-		log.Info("The current Spotify client is authenticated.")
 	}
-	return nil
+	return stats, nil
 }
 
-func authMeWithTimeout() error {
-	// problems if there is ever more than one auth request in flight
-	sessionKey = fmt.Sprintf("potentials-session-key-%d", rand.Intn(10000))
-	url := auth.AuthURL(sessionKey)
-	fmt.Printf("Visit %s in a browser to complete the authentication process.\n", url)
-	timeoutCh := make(chan bool)
-	go func() {
-		time.Sleep(config.Spotify.AuthTimeout)
-		timeoutCh <- true
-	}()
-	select {
-	case c := <-clientCh:
-		spClient = c
-		fmt.Println("Authenticated successfully with Spotify.")
-		return nil
-	case <-timeoutCh:
-		return fmt.Errorf("Authentication timed out.")
-
+// compileDigest compiles the digest of the playlists cleaned from from until
+// to from the throughput log and the cached playlists and library. Spotify
+// isn't called.
+func compileDigest(config *PotentialsUtilsConfig, from, to time.Time) (digest.Digest, error) {
+	events, err := newThroughputLog(config).Events()
+	if err != nil {
+		return digest.Digest{}, err
 	}
-}
-
-// HandleAuthCallback handles the Spotify OAuth2.0 callback and passes on an auth'd client
-func HandleAuthCallback(w http.ResponseWriter, r *http.Request) {
-	// must use the same session key here that you used to generate the URL
-	token, err := auth.Token(sessionKey, r)
+	src := digest.Sources{Events: events}
+	playlists, err := cachedCleanPlaylists(config)
 	if err != nil {
-		log.WithFields(log.Fields{"sessionKey": sessionKey, "err": err}).Error("received auth callback, failed to retrieve token.")
-		http.Error(w, fmt.Sprintf("Couldn't get token from sessionkey %s, request %v", sessionKey, r), http.StatusNotFound)
-		return
+		return digest.Digest{}, err
+	}
+	for _, p := range playlists {
+		src.Pending = append(src.Pending, p.Tracks...)
+	}
+	// The library's growth is left out until it has been indexed
+	lib, err := library.LoadStoredLibrary(config.Cache.CacheDir)
+	if err != nil && !os.IsNotExist(err) {
+		return digest.Digest{}, err
 	}
-	// create a client using the specified token
-	c := auth.NewClient(token)
-	clientCh <- &c
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("200 - OK"))
-	log.WithFields(log.Fields{"token": token}).Info("created client, auth flow complete")
+	src.Library = lib
+	return digest.Compile(src, from, to), nil
 }
 
-// HandleCleanPotentials cleans my Potentials playlist. It removes all songs i have already saved in
-// my library from the playlist.
-func HandleCleanPotentials(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("200 - OK"))
-	cleaned, err := cleanPotentials(false)
-	if err != nil {
-		log.WithFields(log.Fields{"err": err}).Error("error cleaning Potentials playlist")
-		return
-	}
-	log.WithFields(log.Fields{"numRemoved": cleaned}).Info("successfully cleaned duplicate tracks from the Potentials playlist")
+// newDigestLog returns the record of when the last digest was sent
+func newDigestLog(config *PotentialsUtilsConfig) *digest.Log {
+	return digest.NewLog(path.Join(config.Cache.CacheDir, "digest.json"))
 }
 
-// cleanPotentials removes duplicate tracks from the configured spotify
-// potentials playlist
-func cleanPotentials(dryRun bool) (int, error) {
-	// Fetch the Potentials playlist
-	playlist, err := spClient.GetPlaylist(config.Spotify.PotentialsPlaylistID)
+// publishDueDigest compiles and publishes a digest if one is due at now.
+// Returns false if none was.
+func publishDueDigest(config *PotentialsUtilsConfig, now time.Time) (bool, error) {
+	sent := newDigestLog(config)
+	last, err := sent.LastSent()
+	if err != nil {
+		return false, err
+	}
+	from, due := config.Digest.Due(last, now)
+	if !due {
+		return false, nil
+	}
+	d, err := compileDigest(config, from, now)
 	if err != nil {
-		return 0, err
+		return false, err
 	}
-	log.WithFields(log.Fields{"playlistID": playlist.ID}).Info("cleaning Potentials playlist...")
-	fmt.Printf("Cleaning your Potentials playlist: %s...\n", playlist.Name)
+	if err := digest.Publish(config.Digest, d); err != nil {
+		return false, err
+	}
+	return true, sent.Sent(now)
+}
 
-	// Clean the playlist page by page cross-referencing the library cache
-	pager := &playlist.Tracks
-	progressBar := pb.StartNew(pager.Total)
-	duplicates := []spotify.PlaylistTrack{}
-	for {
-		begin := time.Now()
-		duplicatesInPage, err := getDuplicates(pager.Tracks)
-		if err != nil {
-			return 0, err
+// promptRemove returns a prompt asking the user whether a duplicate should be
+// removed. Answering for every track by its artist or on its album records a
+// rule in queue, which decides the rest of the clean and later cleans too.
+func promptRemove(queue *reviewqueue.Queue) func(d dedupe.Duplicate) (bool, error) {
+	return func(d dedupe.Duplicate) (bool, error) {
+		t := d.Track.Track
+		fmt.Printf("Remove %s (%s)? [y/N, ya/na for every track by %s, yb/nb for every track on %s] ", library.TrackString(t), d.Reason, library.PrimaryArtist(t.SimpleTrack), t.Album.Name)
+		answer, err := stdin.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return false, err
 		}
-		log.WithFields(log.Fields{"duration": time.Since(begin)}).Debug("getDuplicates")
-		duplicates = append(duplicates, duplicatesInPage...)
-		if err = spClient.NextPage(pager); err != nil {
-			if err == spotify.ErrNoMorePages {
-				break
-			}
-			return 0, err
+		answer, scope := scopedAnswer(strings.ToLower(strings.TrimSpace(answer)))
+		remove := answer == "y" || answer == "yes"
+		if scope == reviewqueue.ScopeTrack {
+			return remove, nil
 		}
-		progressBar.Add(pager.Limit)
-	}
-	progressBar.Finish()
-	ids := []spotify.ID{}
-	for _, t := range duplicates {
-		fmt.Printf("[DUPLICATE] %s\n", TrackString(t.Track))
-		ids = append(ids, t.Track.ID)
-	}
-	if !dryRun {
-		// Assuming this is atomic... the first returned value is the new playlist
-		// snapshot for future requests, unused for now. When I use the snapshot
-		// in the next Request I get an error from spotify: "Invalid playlist Id"
-		playlistID := config.Spotify.PotentialsPlaylistID
-		for {
-			// Can only remove 100 tracks per request.
-			toRemove, rest := FirstNIDs(ids, 100)
-			//if snapshot, err := spClient.RemoveTracksFromPlaylist(playlistID, toRemove...); err != nil {
-			if _, err := spClient.RemoveTracksFromPlaylist(playlistID, toRemove...); err != nil {
-				return 0, err
-			} else if len(rest) > 0 {
-				//playlistID = spotify.ID(snapshot)
-			} else { // Nothing else to remove
-				break
-			}
+		decision := reviewqueue.Keep
+		if remove {
+			decision = reviewqueue.Remove
 		}
-
+		rule, err := reviewqueue.NewRule(t, scope, decision)
+		if err != nil {
+			fmt.Printf("Deciding just this track: %v\n", err)
+			return remove, nil
+		}
+		if _, err := queue.AddRule(rule); err != nil {
+			return false, err
+		}
+		fmt.Printf("Will %s %s from now on.\n", decision, rule)
+		return remove, nil
 	}
-	return len(duplicates), nil
 }
 
-// Need to implement this because Go doesn't have generics. Returns the first n
-// IDs in the list and the rest of the list
-func FirstNIDs(ids []spotify.ID, n int) ([]spotify.ID, []spotify.ID) {
-	if len(ids) > n {
-		return ids[:n], ids[n:]
-	} else {
-		return ids, []spotify.ID{}
+// confirmAnomaly asks the user whether to go ahead with a clean which would
+// remove far more duplicates than usual
+func confirmAnomaly(a dedupe.Anomaly) (bool, error) {
+	fmt.Printf("This clean would remove far more duplicates than usual: %s. Remove them anyway? [y/N] ", a)
+	answer, err := stdin.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
 	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
 }
 
-// TrackString prints a human-readable summary of a spotify track
-func TrackString(t spotify.FullTrack) string {
-	artistString := ""
-	for ix, a := range t.Artists {
-		if ix == len(t.Artists)-1 {
-			artistString += fmt.Sprintf("%s", a.Name)
-		} else {
-			artistString += fmt.Sprintf("%s, ", a.Name)
+// promptReview asks the user what to do with the nth of total queued
+// duplicates, and whether to decide every track by its artist or on its album
+// the same way. Returns an empty decision to skip it for now, and false to
+// stop reviewing.
+func promptReview(n, total int, it reviewqueue.Item) (reviewqueue.Decision, reviewqueue.Scope, bool, error) {
+	fmt.Printf("[%d/%d] %s (%s, score %.2f by %s)\n", n, total, it.Track, it.Reason, it.Score, it.Matcher)
+	for {
+		fmt.Printf("[r]emove, [k]eep, [s]kip or [q]uit? Add a for every track by %s or b for every track on %s, e.g. ra: ", it.Artist(), it.Album)
+		answer, err := stdin.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", "", false, err
+		}
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		switch answer {
+		case "s", "skip":
+			return "", "", true, nil
+		case "q", "quit":
+			return "", "", false, nil
+		case "":
+			if err == io.EOF {
+				return "", "", false, nil
+			}
+		default:
+			answer, scope := scopedAnswer(answer)
+			if decision, err := reviewqueue.ParseDecision(answer); err == nil {
+				return decision, scope, true, nil
+			}
 		}
 	}
-	return fmt.Sprintf("%s, %s, on %s released %s, Track ID: %s", t.Name, artistString, t.Album.Name, t.Album.ReleaseDate, t.ID)
 }
 
-func getArtistNames(t spotify.SimpleTrack) []string {
-	var names []string
-	for _, a := range t.Artists {
-		names = append(names, a.Name)
+// scopedAnswer splits a two letter answer ending in a or b into its first
+// letter and the artist or album scope asked for
+func scopedAnswer(answer string) (string, reviewqueue.Scope) {
+	if len(answer) == 2 {
+		switch answer[1] {
+		case 'a':
+			return answer[:1], reviewqueue.ScopeArtist
+		case 'b':
+			return answer[:1], reviewqueue.ScopeAlbum
+		}
 	}
-	return names
+	return answer, reviewqueue.ScopeTrack
 }
 
-// getDuplicates finds all tracks in the provided list of playlist tracks which
-// are duplicated in your library. Duplication detection is by ID by default,
-// but can be done by title-artist-album by specifying `--aggressive`.
-func getDuplicates(page []spotify.PlaylistTrack) ([]spotify.PlaylistTrack, error) {
-	duplicateTracks := []spotify.PlaylistTrack{}
-	for _, playlistTrack := range page {
-		trackID := playlistTrack.Track.ID
-		// first try to get the track by ID
-		libraryTrack, err := libraryService.GetByID(trackID)
+// setLogTarget points logging at the named target
+func setLogTarget(target string) error {
+	switch target {
+	case "stderr":
+		return nil
+	case "journald":
+		h, err := journald.New("potentials-utils")
 		if err != nil {
-			return []spotify.PlaylistTrack{}, err
-		}
-		if libraryTrack != nil {
-			// track is already in our library, remove it
-			duplicateTracks = append(duplicateTracks, playlistTrack)
-			continue
-		}
-		// if aggressive cleaning, try to match the track metadata to something in our library
-		if config.Duplicates.Aggressive {
-			duplicateLibraryTracks, err := libraryService.GetBySongAlbumArtistNames(playlistTrack.Track.Name, playlistTrack.Track.Album.Name, getArtistNames(playlistTrack.Track.SimpleTrack))
-			if err != nil {
-				return []spotify.PlaylistTrack{}, err
-			}
-			// Means we found at least one library track which is a
-			// name-album-artist duplicate
-			if len(duplicateLibraryTracks) > 0 {
-				duplicateTracks = append(duplicateTracks, playlistTrack)
-			}
+			return err
 		}
+		log.SetHandler(h)
+		return nil
+	default:
+		return fmt.Errorf("unknown log target %q", target)
 	}
-
-	return duplicateTracks, nil
 }
 
 type LevelValue struct {
@@ -579,50 +766,55 @@ func (v LevelValue) Set(l string) error {
 
 }
 
-func main() {
-
-	flag.BoolVar(&runserver, "runserver", false, "runs potentials-utils in server mode")
-	flag.BoolVar(&dryRun, "dry-run", false, "prints tracks that would be deleted from Potentials instead of removing them if true")
-	flag.BoolVar(&noCache, "no-cache", false, "if true, invalidates your local spotify library cache and rebuilds it from scratch")
-	flag.StringVar(&cfgPath, "config", "config.yaml", "path to potentials-utils config file")
-	flag.Var(&LevelValue{Level: &logLevel}, "verbosity", "sets application verbosity [0-3] (default 1)")
-	flag.Parse()
-
-	log.SetLevel(logLevel)
-	log.WithFields(log.Fields{"level": logLevel}).Info("logging level")
-
-	contents, err := ioutil.ReadFile(cfgPath)
-	if err != nil {
-		log.WithFields(log.Fields{"path": cfgPath}).Fatal("config file not found")
+// shutdownTracing sends any traces still buffered by exporter, which may be
+// nil if tracing is disabled
+func shutdownTracing(exporter *tracing.Exporter) {
+	if exporter == nil {
+		return
 	}
-	err = yaml.Unmarshal(contents, &config)
-	if err != nil {
-		log.WithFields(log.Fields{"err": err}).Fatal("failed to unmarshal YAML config")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := exporter.Shutdown(ctx); err != nil {
+		log.WithFields(log.Fields{"err": err}).Warn("failed to export traces")
 	}
-	auth = spotify.NewAuthenticator(config.Spotify.CallbackURL, spotify.ScopeUserReadPrivate, spotify.ScopePlaylistReadPrivate, spotify.ScopePlaylistModifyPublic, spotify.ScopePlaylistModifyPrivate, spotify.ScopeUserLibraryRead)
-	// Stupid library reads by default from environment variables so we have to
-	// manually set credentials here.
-	auth.SetAuthInfo(config.Spotify.ID, config.Spotify.Secret)
-	rand.Seed(time.Now().UTC().UnixNano())
+}
 
-	libraryService, err = NewLibraryService(config.Cache.CacheDir)
-	if err != nil {
-		log.WithFields(log.Fields{"err": err}).Fatal("failed to start the potentials-utils library service")
+func main() {
+	// Deployed as a Lambda custom runtime's bootstrap, which is run without
+	// arguments
+	if len(os.Args) == 1 && os.Getenv(serverless.RuntimeAPIEnv) != "" {
+		os.Args = append(os.Args, "serverless")
 	}
-	if runserver {
-		log.Info("Server UP")
-		authSrv := authServer()
-		authSrv.ListenAndServe()
-	} else {
-		if dryRun {
-			fmt.Println("Running cleanPotentials in dry-run mode. No tracks will be deleted from your playlist.")
-		}
-		cleaned, err := cleanPotentials(dryRun)
-		if err != nil {
-			log.WithFields(log.Fields{"err": err}).Fatal(err.Error())
-		}
-		log.WithFields(log.Fields{"numRemoved": cleaned}).Info("removed tracks from potentials playlist")
-		fmt.Println("Potentials playlist cleaned.")
+	if runSubcommand(os.Args[1:]) {
+		return
 	}
 
+	// Without a subcommand the flags are clean's, or serve's with
+	// --runserver, as they were before there were subcommands
+	o := &runOptions{}
+	var showVersion, showDemo bool
+	flag.BoolVar(&showVersion, "version", false, "prints the version of potentials-utils and exits")
+	flag.BoolVar(&o.serve, "runserver", false, "runs potentials-utils in server mode, like the serve subcommand")
+	flag.BoolVar(&showDemo, "demo", false, "cleans a generated library and Potentials playlist held in memory to show what potentials-utils does, no Spotify account needed")
+	flag.Bool("no-cache", false, "ignored, run `potentials-utils cache rebuild` to rebuild the library cache")
+	o.commonFlags(flag.CommandLine)
+	o.cleanFlags(flag.CommandLine)
+	flag.Usage = func() {
+		printUsage()
+		fmt.Fprintln(flag.CommandLine.Output(), "\nFlags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if showVersion {
+		runVersion(nil)
+		return
+	}
+	if showDemo {
+		runDemo()
+		return
+	}
+	if err := o.run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
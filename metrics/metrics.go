@@ -0,0 +1,303 @@
+// Package metrics keeps the counters, gauges and histograms a running server
+// exposes on /metrics in the Prometheus text exposition format. The packages
+// measuring something register their metrics in the Registry they're given
+// when constructed, and record into them whether or not anything is ever
+// scraped.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the buckets of
+// histograms of short durations such as API calls
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// collector is a metric which can write itself out
+type collector interface {
+	describe() desc
+	write(w io.Writer) error
+}
+
+// Registry holds metrics in the order they were registered
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// NewRegistry creates an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// register adds c to r, returning the metric already registered under c's
+// name instead if there is one. Metrics aren't registered anywhere if r is
+// nil, but still record.
+func (r *Registry) register(c collector) collector {
+	if r == nil {
+		return c
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, registered := range r.collectors {
+		if registered.describe().name == c.describe().name {
+			return registered
+		}
+	}
+	r.collectors = append(r.collectors, c)
+	return c
+}
+
+// alreadyRegistered panics as a metric of another kind is registered under
+// name
+func alreadyRegistered(name string) {
+	panic(fmt.Sprintf("metric %s is already registered as another kind", name))
+}
+
+// WriteText writes every metric registered in the Prometheus text exposition
+// format. Nothing is written if r is nil.
+func (r *Registry) WriteText(w io.Writer) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	collectors := append([]collector{}, r.collectors...)
+	r.mu.Unlock()
+	for _, c := range collectors {
+		if err := c.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// desc is what every kind of metric has in common
+type desc struct {
+	name, help, kind string
+	labels           []string
+}
+
+// key joins label values into a map key, checking there's one per label
+func (d desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func (d desc) describe() desc {
+	return d
+}
+
+// labelString formats the labels of the series with the given key, along
+// with any extra label already formatted, e.g. a histogram bucket's le
+func (d desc) labelString(key string, extra string) string {
+	pairs := []string{}
+	if len(d.labels) > 0 {
+		for ix, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", d.labels[ix], v))
+		}
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (d desc) writeHeader(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, d.kind)
+	return err
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Counter is a count which only goes up, a series per combination of label
+// values
+type Counter struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounter registers a counter in r, or returns the counter already
+// registered under name
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{desc: desc{name: name, help: help, kind: "counter", labels: labels}, values: map[string]float64{}}
+	if len(labels) == 0 {
+		c.values[""] = 0
+	}
+	registered, ok := r.register(c).(*Counter)
+	if !ok {
+		alreadyRegistered(name)
+	}
+	return registered
+}
+
+// Add adds v, which mustn't be negative, to the series with the given label
+// values
+func (c *Counter) Add(v float64, labelValues ...string) {
+	k := c.key(labelValues)
+	c.mu.Lock()
+	c.values[k] += v
+	c.mu.Unlock()
+}
+
+// Inc adds one to the series with the given label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Value returns the series with the given label values
+func (c *Counter) Value(labelValues ...string) float64 {
+	k := c.key(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[k]
+}
+
+func (c *Counter) write(w io.Writer) error {
+	return writeValues(w, c.desc, &c.mu, c.values)
+}
+
+// Gauge is a value which goes up and down, a series per combination of label
+// values
+type Gauge struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewGauge registers a gauge in r, or returns the gauge already registered
+// under name. Gauges without labels aren't written out
+// until they're first set.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{desc: desc{name: name, help: help, kind: "gauge", labels: labels}, values: map[string]float64{}}
+	registered, ok := r.register(g).(*Gauge)
+	if !ok {
+		alreadyRegistered(name)
+	}
+	return registered
+}
+
+// Set sets the series with the given label values to v
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	k := g.key(labelValues)
+	g.mu.Lock()
+	g.values[k] = v
+	g.mu.Unlock()
+}
+
+func (g *Gauge) write(w io.Writer) error {
+	return writeValues(w, g.desc, &g.mu, g.values)
+}
+
+// writeValues writes a counter's or gauge's series
+func writeValues(w io.Writer, d desc, mu *sync.Mutex, values map[string]float64) error {
+	if err := d.writeHeader(w); err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// Sorted so the output is stable between scrapes
+	keys := []string{}
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", d.name, d.labelString(k, ""), formatFloat(values[k])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Histogram counts observations into buckets, a series per combination of
+// label values
+type Histogram struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	// counts are the observations in each bucket, not cumulative
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers a histogram in r with buckets of the given upper
+// bounds, DefaultBuckets if nil, or returns the histogram already registered
+// under name
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+	h := &Histogram{desc: desc{name: name, help: help, kind: "histogram", labels: labels}, buckets: buckets, series: map[string]*histogramSeries{}}
+	registered, ok := r.register(h).(*Histogram)
+	if !ok {
+		alreadyRegistered(name)
+	}
+	return registered
+}
+
+// Observe counts v into the series with the given label values
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	k := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[k]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[k] = s
+	}
+	if ix := sort.SearchFloat64s(h.buckets, v); ix < len(h.buckets) {
+		s.counts[ix]++
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *Histogram) write(w io.Writer) error {
+	if err := h.writeHeader(w); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := []string{}
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := h.series[k]
+		var cumulative uint64
+		for ix, bound := range h.buckets {
+			cumulative += s.counts[ix]
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(k, fmt.Sprintf("le=%q", formatFloat(bound))), cumulative); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+			h.name, h.labelString(k, `le="+Inf"`), s.count,
+			h.name, h.labelString(k, ""), formatFloat(s.sum),
+			h.name, h.labelString(k, ""), s.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
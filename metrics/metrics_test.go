@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	runs := r.NewCounter("runs_total", "Runs, by outcome.", "status")
+	scanned := r.NewCounter("scanned_total", "Tracks scanned.")
+	last := r.NewGauge("last_success_timestamp_seconds", "When the last run succeeded.")
+	latency := r.NewHistogram("request_duration_seconds", "Request latency.", []float64{1, 0.1}, "method")
+	runs.Inc("succeeded")
+	runs.Inc("failed")
+	runs.Inc("succeeded")
+	latency.Observe(0.05, "GET")
+	latency.Observe(0.5, "GET")
+	latency.Observe(2, "GET")
+
+	b := &bytes.Buffer{}
+	if err := r.WriteText(b); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP runs_total Runs, by outcome.
+# TYPE runs_total counter
+runs_total{status="failed"} 1
+runs_total{status="succeeded"} 2
+# HELP scanned_total Tracks scanned.
+# TYPE scanned_total counter
+scanned_total 0
+# HELP last_success_timestamp_seconds When the last run succeeded.
+# TYPE last_success_timestamp_seconds gauge
+# HELP request_duration_seconds Request latency.
+# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{method="GET",le="0.1"} 1
+request_duration_seconds_bucket{method="GET",le="1"} 2
+request_duration_seconds_bucket{method="GET",le="+Inf"} 3
+request_duration_seconds_sum{method="GET"} 2.55
+request_duration_seconds_count{method="GET"} 3
+`
+	if b.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, b.String())
+	}
+
+	scanned.Add(150)
+	last.Set(1600000000)
+	if scanned.Value() != 150 || runs.Value("succeeded") != 2 {
+		t.Errorf("expected 150 scanned and 2 succeeded, got %g and %g", scanned.Value(), runs.Value("succeeded"))
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	r := NewRegistry()
+	hits := r.NewCounter("hits_total", "Hits.", "cache")
+	hits.Inc("entities")
+	if again := r.NewCounter("hits_total", "Hits.", "cache"); again != hits {
+		t.Error("expected the counter already registered")
+	}
+	b := &bytes.Buffer{}
+	if err := r.WriteText(b); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "# HELP hits_total Hits.\n# TYPE hits_total counter\nhits_total{cache=\"entities\"} 1\n"; b.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, b.String())
+	}
+
+	var unregistered *Registry
+	unregistered.NewGauge("last_success_timestamp_seconds", "When the last run succeeded.").Set(1)
+	b.Reset()
+	if err := unregistered.WriteText(b); err != nil || b.Len() > 0 {
+		t.Errorf("expected nothing written by a nil registry, got %q, %v", b.String(), err)
+	}
+}
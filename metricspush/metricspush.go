@@ -0,0 +1,114 @@
+// Package metricspush pushes the metrics of a one-off run to a Prometheus
+// Pushgateway or a StatsD server, so scheduled runs land in monitoring without
+// running the HTTP server for it to scrape.
+package metricspush
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// defaultJob is the Pushgateway job metrics are grouped under if none is
+// configured
+const defaultJob = "potentials-utils"
+
+// Config configures pushing metrics at the end of each run
+type Config struct {
+	// PushgatewayURL is the base URL of a Prometheus Pushgateway, e.g.
+	// http://localhost:9091. Metrics aren't pushed to a Pushgateway if empty.
+	PushgatewayURL string `yaml:"pushgatewayURL"`
+	// Job is the Pushgateway job metrics are grouped under, defaulting to
+	// potentials-utils. Each push replaces the job's previous metrics.
+	Job string `yaml:"job"`
+	// StatsDAddr is the host:port of a StatsD server metrics are sent to as
+	// gauges over UDP. Metrics aren't sent to StatsD if empty.
+	StatsDAddr string `yaml:"statsdAddr"`
+}
+
+// Enabled returns true if metrics are pushed anywhere
+func (c Config) Enabled() bool {
+	return c.PushgatewayURL != "" || c.StatsDAddr != ""
+}
+
+// Metric is a gauge measured by a run
+type Metric struct {
+	Name  string
+	Help  string
+	Value float64
+}
+
+// Pusher pushes metrics to the configured destinations
+type Pusher struct {
+	cfg  Config
+	http *http.Client
+}
+
+// New creates a Pusher for cfg
+func New(cfg Config) *Pusher {
+	if cfg.Job == "" {
+		cfg.Job = defaultJob
+	}
+	return &Pusher{cfg: cfg, http: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Push sends metrics to every configured destination, returning the first
+// error. A failure to push to one destination doesn't stop the other.
+func (p *Pusher) Push(metrics []Metric) error {
+	var first error
+	if p.cfg.PushgatewayURL != "" {
+		first = p.pushgateway(metrics)
+	}
+	if p.cfg.StatsDAddr != "" {
+		if err := p.statsd(metrics); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// pushgateway replaces the job's metrics on the Pushgateway
+func (p *Pusher) pushgateway(metrics []Metric) error {
+	body := &bytes.Buffer{}
+	for _, m := range metrics {
+		fmt.Fprintf(body, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", m.Name, m.Help, m.Name, m.Name, m.Value)
+	}
+	target := fmt.Sprintf("%s/metrics/job/%s", strings.TrimSuffix(p.cfg.PushgatewayURL, "/"), url.PathEscape(p.cfg.Job))
+	req, err := http.NewRequest(http.MethodPut, target, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to push metrics to the Pushgateway: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("the Pushgateway refused metrics: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// statsd sends every metric as a gauge in a single UDP packet
+func (p *Pusher) statsd(metrics []Metric) error {
+	conn, err := net.Dial("udp", p.cfg.StatsDAddr)
+	if err != nil {
+		return fmt.Errorf("failed to reach StatsD: %w", err)
+	}
+	defer conn.Close()
+	lines := []string{}
+	for _, m := range metrics {
+		lines = append(lines, fmt.Sprintf("%s:%g|g", m.Name, m.Value))
+	}
+	if _, err := conn.Write([]byte(strings.Join(lines, "\n"))); err != nil {
+		return fmt.Errorf("failed to send metrics to StatsD: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package metricspush
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPush(t *testing.T) {
+	var method, path, body string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		method, path, body = r.Method, r.URL.Path, string(b)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+	statsd, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer statsd.Close()
+
+	p := New(Config{PushgatewayURL: gateway.URL + "/", StatsDAddr: statsd.LocalAddr().String()})
+	metrics := []Metric{
+		{Name: "potentials_run_tracks_removed", Help: "Tracks removed.", Value: 3},
+		{Name: "potentials_run_duration_seconds", Help: "Run duration.", Value: 1.5},
+	}
+	if err := p.Push(metrics); err != nil {
+		t.Fatal(err)
+	}
+	if method != http.MethodPut || path != "/metrics/job/potentials-utils" {
+		t.Errorf("expected a PUT to the default job, got %s %s", method, path)
+	}
+	expected := "# HELP potentials_run_tracks_removed Tracks removed.\n# TYPE potentials_run_tracks_removed gauge\npotentials_run_tracks_removed 3\n"
+	if !strings.HasPrefix(body, expected) || !strings.Contains(body, "potentials_run_duration_seconds 1.5\n") {
+		t.Errorf("unexpected Pushgateway body %q", body)
+	}
+	buf := make([]byte, 1024)
+	statsd.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := statsd.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "potentials_run_tracks_removed:3|g\npotentials_run_duration_seconds:1.5|g" {
+		t.Errorf("unexpected StatsD packet %q", got)
+	}
+
+	refusing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad metrics", http.StatusBadRequest)
+	}))
+	defer refusing.Close()
+	if err := New(Config{PushgatewayURL: refusing.URL}).Push(metrics); err == nil || !strings.Contains(err.Error(), "bad metrics") {
+		t.Errorf("expected the Pushgateway's refusal as an error, got %v", err)
+	}
+}
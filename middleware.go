@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/apex/log"
+)
+
+// requestIDHeader carries the ID of each request, both from clients which
+// already have one and back to the client in responses
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the longest inbound request ID accepted
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// requestID returns the ID assigned to r by withRequestID
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID returns true if an inbound request ID is safe to log and
+// echo back: non-empty, not too long, and printable ASCII
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestID assigns every request an ID, reusing the client's
+// X-Request-ID if it sent a valid one. The ID is available to handlers through
+// requestID, is a field of the logger from log.FromContext(r.Context()), and
+// is returned to the client in the X-Request-ID header.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		ctx = log.NewContext(ctx, log.WithFields(log.Fields{"requestID": id}))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// errorResponse is the body of every error response from the server
+type errorResponse struct {
+	Error     string `json:"error"`
+	RequestID string `json:"requestID"`
+}
+
+// writeError responds to r with a JSON error body
+func writeError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	writeJSON(w, status, errorResponse{Error: msg, RequestID: requestID(r)})
+}
+
+// responseRecorder remembers whether a response has been started
+type responseRecorder struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	rr.wroteHeader = true
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	rr.wroteHeader = true
+	return rr.ResponseWriter.Write(b)
+}
+
+// recoverPanics keeps the server alive when a handler panics, logging the
+// stack and responding with a 500 if the handler hadn't started responding
+func (s *server) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rr := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			stack := debug.Stack()
+			eventID := s.reporter.CapturePanic(v, stack, map[string]string{
+				"requestID": requestID(r),
+				"path":      r.URL.Path,
+			})
+			log.FromContext(r.Context()).WithFields(log.Fields{
+				"url":     r.URL.String(),
+				"panic":   v,
+				"stack":   string(stack),
+				"eventID": eventID,
+			}).Error("handler panicked")
+			if !rr.wroteHeader {
+				writeError(rr, r, http.StatusInternalServerError, "internal server error")
+			}
+		}()
+		next.ServeHTTP(rr, r)
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRecoverPanics(t *testing.T) {
+	s := &server{}
+	h := withRequestID(s.recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/jobs", nil))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected status 500, got %d", rec.Code)
+	}
+	var body errorResponse
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.RequestID == "" || body.RequestID != rec.Header().Get(requestIDHeader) {
+		t.Errorf("expected error body to carry the request ID %q, got %+v", rec.Header().Get(requestIDHeader), body)
+	}
+	if body.Error != "internal server error" {
+		t.Errorf("expected internal server error, got %q", body.Error)
+	}
+}
+
+func TestWithRequestID(t *testing.T) {
+	testCases := []struct {
+		name       string
+		inbound    string
+		expectSame bool
+	}{
+		{name: "no inbound ID", inbound: ""},
+		{name: "valid inbound ID is kept", inbound: "abc-123", expectSame: true},
+		{name: "inbound ID with spaces is replaced", inbound: "abc 123"},
+		{name: "overlong inbound ID is replaced", inbound: strings.Repeat("a", maxRequestIDLength+1)},
+	}
+	for _, tc := range testCases {
+		var seen string
+		h := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen = requestID(r)
+		}))
+		req := httptest.NewRequest(http.MethodGet, "/jobs", nil)
+		if tc.inbound != "" {
+			req.Header.Set(requestIDHeader, tc.inbound)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		got := rec.Header().Get(requestIDHeader)
+		if got == "" || got != seen {
+			t.Errorf("%s failed: expected handler and response to share an ID, got %q and %q", tc.name, seen, got)
+		}
+		if (got == tc.inbound) != tc.expectSame {
+			t.Errorf("%s failed: inbound %q, got %q", tc.name, tc.inbound, got)
+		}
+	}
+}
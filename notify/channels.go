@@ -0,0 +1,196 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// client sends every HTTP notification
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// postJSON POSTs v as JSON to url, naming the channel in errors
+func postJSON(ctx context.Context, channel, url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to send %s notification: %w", channel, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s notification responded %s", channel, resp.Status)
+	}
+	return nil
+}
+
+// webhook POSTs each event as JSON to a URL. Options are:
+//
+//	url  where to POST events
+type webhook struct {
+	url string
+}
+
+func newWebhook(opts Options) (Notifier, error) {
+	u, err := opts.Required("url")
+	if err != nil {
+		return nil, err
+	}
+	return webhook{url: u}, nil
+}
+
+func (w webhook) Notify(ctx context.Context, e Event) error {
+	return postJSON(ctx, "webhook", w.url, e)
+}
+
+// slack posts each event as a message to a Slack incoming webhook. Options
+// are:
+//
+//	url  the incoming webhook's URL
+type slack struct {
+	url string
+}
+
+func newSlack(opts Options) (Notifier, error) {
+	u, err := opts.Required("url")
+	if err != nil {
+		return nil, err
+	}
+	return slack{url: u}, nil
+}
+
+func (s slack) Notify(ctx context.Context, e Event) error {
+	return postJSON(ctx, "slack", s.url, map[string]string{"text": e.Text()})
+}
+
+// telegramAPI is where Telegram's bot API is served
+var telegramAPI = "https://api.telegram.org"
+
+// telegram sends each event as a message from a Telegram bot. Options are:
+//
+//	token   the bot's token
+//	chatID  the chat the bot sends to
+type telegram struct {
+	token, chatID string
+}
+
+func newTelegram(opts Options) (Notifier, error) {
+	token, err := opts.Required("token")
+	if err != nil {
+		return nil, err
+	}
+	chatID, err := opts.Required("chatID")
+	if err != nil {
+		return nil, err
+	}
+	return telegram{token: token, chatID: chatID}, nil
+}
+
+func (t telegram) Notify(ctx context.Context, e Event) error {
+	u := fmt.Sprintf("%s/bot%s/sendMessage", telegramAPI, url.PathEscape(t.token))
+	return postJSON(ctx, "telegram", u, map[string]string{"chat_id": t.chatID, "text": e.Text()})
+}
+
+// email sends each event as an email over SMTP. Options are:
+//
+//	addr      the SMTP server's host:port
+//	from      the sender's address
+//	to        comma separated recipient addresses
+//	username  and password authenticate with the server if set
+type email struct {
+	addr, from string
+	to         []string
+	auth       smtp.Auth
+}
+
+func newEmail(opts Options) (Notifier, error) {
+	e := email{}
+	var err error
+	if e.addr, err = opts.Required("addr"); err != nil {
+		return nil, err
+	}
+	if e.from, err = opts.Required("from"); err != nil {
+		return nil, err
+	}
+	to, err := opts.Required("to")
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range strings.Split(to, ",") {
+		e.to = append(e.to, strings.TrimSpace(addr))
+	}
+	if opts["username"] != "" {
+		host := e.addr
+		if ix := strings.LastIndex(host, ":"); ix >= 0 {
+			host = host[:ix]
+		}
+		e.auth = smtp.PlainAuth("", opts["username"], opts["password"], host)
+	}
+	return e, nil
+}
+
+// message returns ev as an email message
+func (e email) message(ev Event) []byte {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.to, ", "))
+	fmt.Fprintf(&msg, "Subject: [potentials-utils] %s\r\n", ev.Title)
+	fmt.Fprintf(&msg, "Date: %s\r\n", ev.At.Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(ev.Text(), "\n", "\r\n"))
+	msg.WriteString("\r\n")
+	return msg.Bytes()
+}
+
+func (e email) Notify(ctx context.Context, ev Event) error {
+	if err := smtp.SendMail(e.addr, e.auth, e.from, e.to, e.message(ev)); err != nil {
+		return fmt.Errorf("failed to send email notification: %w", err)
+	}
+	return nil
+}
+
+// desktop shows each event as a notification on the desktop of the machine
+// potentials-utils runs on, with notify-send on Linux and osascript on macOS.
+// It takes no options.
+type desktop struct {
+	goos string
+}
+
+func newDesktop(Options) (Notifier, error) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		return nil, fmt.Errorf("desktop notifications aren't supported on %s", runtime.GOOS)
+	}
+	return desktop{goos: runtime.GOOS}, nil
+}
+
+// desktopCommand returns the command which shows e on goos' desktop
+func desktopCommand(goos string, e Event) (string, []string) {
+	if goos == "darwin" {
+		script := fmt.Sprintf("display notification %q with title %q", e.Body, e.Title)
+		return "osascript", []string{"-e", script}
+	}
+	return "notify-send", []string{"--app-name=potentials-utils", e.Title, e.Body}
+}
+
+func (d desktop) Notify(ctx context.Context, e Event) error {
+	name, args := desktopCommand(d.goos, e)
+	if out, err := exec.CommandContext(ctx, name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to show desktop notification: %w: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+// Package notify tells people about things potentials-utils did, such as a
+// clean finishing or failing, over whichever channels are configured:
+// webhooks, Slack, email, desktop notifications or Telegram.
+package notify
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Event is something worth telling someone about
+type Event struct {
+	// Name is what happened, e.g. clean.succeeded or refresh.failed
+	Name string `json:"event"`
+	// Title is a one line description of what happened
+	Title string `json:"title"`
+	// Body is the detail, if any
+	Body string    `json:"body,omitempty"`
+	At   time.Time `json:"at"`
+	// JobID is the ID of the job the event is about, if any
+	JobID string `json:"jobID,omitempty"`
+}
+
+// Text returns the event as a plain text message
+func (e Event) Text() string {
+	if e.Body == "" {
+		return e.Title
+	}
+	return e.Title + "\n" + e.Body
+}
+
+// Notifier sends events over a channel
+type Notifier interface {
+	Notify(ctx context.Context, e Event) error
+}
+
+// Options are a channel's configured options
+type Options map[string]string
+
+// Required returns the option named key, or an error if it isn't set
+func (o Options) Required(key string) (string, error) {
+	v := strings.TrimSpace(o[key])
+	if v == "" {
+		return "", fmt.Errorf("%s option is required", key)
+	}
+	return v, nil
+}
+
+// Factory builds a Notifier from its configured options
+type Factory func(opts Options) (Notifier, error)
+
+// ChannelConfig configures a channel events are sent over
+type ChannelConfig struct {
+	// Type is the name the channel's Notifier was registered under
+	Type string `yaml:"type"`
+	// Events are the names of the events sent, which may be patterns like
+	// *.failed. Every event is sent if empty.
+	Events  []string `yaml:"events"`
+	Options Options  `yaml:"options"`
+}
+
+// Config configures every channel events are sent over
+type Config struct {
+	Channels []ChannelConfig `yaml:"channels"`
+}
+
+// Enabled returns true if any channel is configured
+func (c Config) Enabled() bool {
+	return len(c.Channels) > 0
+}
+
+// Registry maps channel types to the factories which build their Notifiers
+type Registry struct {
+	factories map[string]Factory
+}
+
+// NewRegistry creates a Registry with every built-in channel registered
+func NewRegistry() *Registry {
+	r := &Registry{factories: map[string]Factory{}}
+	r.Register("webhook", newWebhook)
+	r.Register("slack", newSlack)
+	r.Register("email", newEmail)
+	r.Register("desktop", newDesktop)
+	r.Register("telegram", newTelegram)
+	return r
+}
+
+// Register makes a channel type available to configure, replacing any
+// registered under the same name
+func (r *Registry) Register(name string, f Factory) {
+	r.factories[name] = f
+}
+
+// Notifier builds a Notifier sending each event to every channel configured
+// to receive it
+func (r *Registry) Notifier(cfg Config) (Notifier, error) {
+	multi := Multi{}
+	for ix, c := range cfg.Channels {
+		f, ok := r.factories[c.Type]
+		if !ok {
+			return nil, fmt.Errorf("channel %d: unknown type %q, expected one of %s", ix, c.Type, strings.Join(r.names(), ", "))
+		}
+		n, err := f(c.Options)
+		if err != nil {
+			return nil, fmt.Errorf("channel %d (%s): %w", ix, c.Type, err)
+		}
+		for _, pattern := range c.Events {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("channel %d (%s): invalid event pattern %q", ix, c.Type, pattern)
+			}
+		}
+		multi = append(multi, filtered{Notifier: n, events: c.Events})
+	}
+	return multi, nil
+}
+
+// names returns the registered channel types in alphabetical order
+func (r *Registry) names() []string {
+	names := []string{}
+	for name := range r.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// filtered is a Notifier only sent events matching one of its patterns, or
+// every event if it has none
+type filtered struct {
+	Notifier
+	events []string
+}
+
+func (f filtered) Notify(ctx context.Context, e Event) error {
+	if len(f.events) == 0 {
+		return f.Notifier.Notify(ctx, e)
+	}
+	for _, pattern := range f.events {
+		if ok, _ := path.Match(pattern, e.Name); ok {
+			return f.Notifier.Notify(ctx, e)
+		}
+	}
+	return nil
+}
+
+// Multi sends each event to every one of its Notifiers
+type Multi []Notifier
+
+// Notify sends e to every Notifier, even if some fail, returning the first
+// error
+func (m Multi) Notify(ctx context.Context, e Event) error {
+	var first error
+	for _, n := range m {
+		if err := n.Notify(ctx, e); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
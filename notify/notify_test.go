@@ -0,0 +1,97 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNotifier(t *testing.T) {
+	var mu sync.Mutex
+	received := map[string][]map[string]interface{}{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		received[r.URL.Path] = append(received[r.URL.Path], body)
+	}))
+	defer srv.Close()
+	telegramAPI = srv.URL
+
+	n, err := NewRegistry().Notifier(Config{Channels: []ChannelConfig{
+		{Type: "webhook", Options: Options{"url": srv.URL + "/webhook"}},
+		{Type: "slack", Events: []string{"*.failed"}, Options: Options{"url": srv.URL + "/slack"}},
+		{Type: "telegram", Events: []string{"clean.succeeded"}, Options: Options{"token": "t0ken", "chatID": "42"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, e := range []Event{
+		{Name: "clean.succeeded", Title: "Clean job succeeded", Body: "3 removed.", At: at},
+		{Name: "refresh.failed", Title: "Refresh job failed", At: at},
+	} {
+		if err := n.Notify(context.Background(), e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		path     string
+		key      string
+		expected []string
+	}{
+		{name: "webhook gets every event", path: "/webhook", key: "event", expected: []string{"clean.succeeded", "refresh.failed"}},
+		{name: "slack gets failures", path: "/slack", key: "text", expected: []string{"Refresh job failed"}},
+		{name: "telegram gets successful cleans", path: "/bott0ken/sendMessage", key: "text", expected: []string{"Clean job succeeded\n3 removed."}},
+	}
+	for _, tc := range testCases {
+		got := []string{}
+		for _, body := range received[tc.path] {
+			got = append(got, body[tc.key].(string))
+		}
+		if strings.Join(got, "|") != strings.Join(tc.expected, "|") {
+			t.Errorf("%s failed: expected %q, got %q", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestNotifierConfig(t *testing.T) {
+	testCases := []struct {
+		name    string
+		channel ChannelConfig
+		err     string
+	}{
+		{name: "unknown type", channel: ChannelConfig{Type: "pager"}, err: `unknown type "pager"`},
+		{name: "missing option", channel: ChannelConfig{Type: "email", Options: Options{"addr": "localhost:25", "from": "me@example.com"}}, err: "to option is required"},
+		{name: "invalid pattern", channel: ChannelConfig{Type: "webhook", Events: []string{"[clean"}, Options: Options{"url": "http://localhost"}}, err: "invalid event pattern"},
+	}
+	for _, tc := range testCases {
+		_, err := NewRegistry().Notifier(Config{Channels: []ChannelConfig{tc.channel}})
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s failed: expected an error containing %q, got %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+func TestEmailMessage(t *testing.T) {
+	n, err := newEmail(Options{"addr": "localhost:25", "from": "me@example.com", "to": "you@example.com, them@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(n.(email).message(Event{Title: "Clean job failed", Body: "Error: boom", At: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}))
+	for _, expected := range []string{"To: you@example.com, them@example.com\r\n", "Subject: [potentials-utils] Clean job failed\r\n", "\r\n\r\nClean job failed\r\nError: boom\r\n"} {
+		if !strings.Contains(msg, expected) {
+			t.Errorf("expected the message to contain %q, got %q", expected, msg)
+		}
+	}
+}
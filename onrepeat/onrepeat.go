@@ -0,0 +1,164 @@
+// Package onrepeat matches Potentials tracks against the playlists Spotify
+// generates from what the user plays most, such as On Repeat and Repeat
+// Rewind, so tracks already on repeat can be cleaned from Potentials.
+package onrepeat
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"potentials-utils/dedupe"
+	"potentials-utils/library"
+
+	"github.com/apex/log"
+	"github.com/zmb3/spotify/v2"
+)
+
+const (
+	// MatcherName is the name the on repeat matcher is registered under
+	MatcherName = "onRepeat"
+	// spotifyUser owns the playlists Spotify generates
+	spotifyUser = "spotify"
+)
+
+// DefaultPlaylists are the names of the generated playlists matched against
+// unless configured otherwise
+var DefaultPlaylists = []string{"On Repeat", "Repeat Rewind"}
+
+// API is the view of the Spotify API needed to read generated playlists
+type API interface {
+	Playlists(ctx context.Context) (*spotify.SimplePlaylistPage, error)
+	NextPlaylists(ctx context.Context, page *spotify.SimplePlaylistPage) error
+	PlaylistTracks(ctx context.Context, playlistID spotify.ID, offset int) (*spotify.PlaylistTrackPage, error)
+	NextPlaylistTracks(ctx context.Context, page *spotify.PlaylistTrackPage) error
+}
+
+// NewMatcherFactory returns a factory for the on repeat matcher, which matches
+// playlist tracks on any of the playlists Spotify generated for the user whose
+// names match the playlists option, patterns like "Your Top Songs *",
+// default On Repeat and Repeat Rewind, or whose IDs are in the playlistIDs
+// option. Tracks match by ID or ISRC. Generated playlists are only found by
+// name if the user follows them. The playlists are read from client the first
+// time a track is matched, so building the pipeline doesn't call Spotify.
+func NewMatcherFactory(client API) dedupe.MatcherFactory {
+	return func(opts dedupe.MatcherOptions) (dedupe.Matcher, error) {
+		names := opts.Strings("playlists", DefaultPlaylists)
+		for _, pattern := range names {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid playlist pattern %q", pattern)
+			}
+		}
+		ids := []spotify.ID{}
+		for _, id := range opts.Strings("playlistIDs", nil) {
+			ids = append(ids, spotify.ID(id))
+		}
+		return &matcher{client: client, names: names, ids: ids}, nil
+	}
+}
+
+// matcher matches tracks on generated playlists
+type matcher struct {
+	client API
+	names  []string
+	ids    []spotify.ID
+
+	once sync.Once
+	err  error
+	// byID and byISRC are the names of the playlists each track is on
+	byID   map[spotify.ID]string
+	byISRC map[string]string
+}
+
+func (m *matcher) Match(t spotify.PlaylistTrack, index dedupe.Library) (bool, string, float64, error) {
+	// Loaded once for every clean, so not with any one clean's context
+	m.once.Do(func() { m.err = m.load(context.Background()) })
+	if m.err != nil {
+		return false, "", 0, m.err
+	}
+	name, ok := m.byID[t.Track.ID]
+	if !ok {
+		if isrc := library.ISRC(t.Track); isrc != "" {
+			name, ok = m.byISRC[isrc]
+		}
+	}
+	if !ok {
+		return false, "", 0, nil
+	}
+	return true, fmt.Sprintf("on Spotify's %s playlist", name), 1, nil
+}
+
+// load reads the tracks on every generated playlist matched
+func (m *matcher) load(ctx context.Context) error {
+	playlists, err := m.playlists(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to find generated playlists: %w", err)
+	}
+	m.byID, m.byISRC = map[spotify.ID]string{}, map[string]string{}
+	for id, name := range playlists {
+		page, err := m.client.PlaylistTracks(ctx, id, 0)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		for {
+			for _, t := range page.Tracks {
+				m.byID[t.Track.ID] = name
+				if isrc := library.ISRC(t.Track); isrc != "" {
+					m.byISRC[isrc] = name
+				}
+			}
+			if err := m.client.NextPlaylistTracks(ctx, page); err == spotify.ErrNoMorePages {
+				break
+			} else if err != nil {
+				return fmt.Errorf("failed to read %s: %w", name, err)
+			}
+		}
+	}
+	log.WithFields(log.Fields{"playlists": len(playlists), "tracks": len(m.byID)}).Debug("read generated playlists")
+	return nil
+}
+
+// playlists returns the names of the generated playlists matched against by
+// ID: those Spotify owns among the user's playlists whose names match, and
+// those configured by ID
+func (m *matcher) playlists(ctx context.Context) (map[spotify.ID]string, error) {
+	found := map[spotify.ID]string{}
+	for _, id := range m.ids {
+		found[id] = string(id)
+	}
+	if len(m.names) == 0 {
+		return found, nil
+	}
+	page, err := m.client.Playlists(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		for _, p := range page.Playlists {
+			if p.Owner.ID == spotifyUser && matchesAny(m.names, p.Name) {
+				found[p.ID] = p.Name
+			}
+		}
+		if err := m.client.NextPlaylists(ctx, page); err == spotify.ErrNoMorePages {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if len(found) == 0 {
+		log.WithFields(log.Fields{"playlists": strings.Join(m.names, ", ")}).Warn("no generated playlists found, follow them in Spotify to match against them")
+	}
+	return found, nil
+}
+
+// matchesAny returns true if name matches any of patterns, ignoring case
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(name)); ok {
+			return true
+		}
+	}
+	return false
+}
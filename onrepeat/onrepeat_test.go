@@ -0,0 +1,63 @@
+package onrepeat
+
+import (
+	"strings"
+	"testing"
+
+	"potentials-utils/dedupe"
+	"potentials-utils/spotifyclient"
+	"potentials-utils/spotifytest"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+func TestMatch(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	withISRC := func(t spotify.FullTrack, isrc string) spotify.FullTrack {
+		t.ExternalIDs = map[string]string{"isrc": isrc}
+		return t
+	}
+	srv.AddPlaylist("onrepeat", "On Repeat", spotifytest.Track("r1", "Repeated", "Album", "Artist"), withISRC(spotifytest.Track("r2", "Re-released", "Album", "Artist"), "ISRC2"))
+	srv.SetPlaylistOwner("onrepeat", "spotify")
+	srv.AddPlaylist("topsongs", "Your Top Songs 2021", spotifytest.Track("y1", "Top Song", "Album", "Artist"))
+	srv.SetPlaylistOwner("topsongs", "spotify")
+	// The user's own playlists aren't generated, whatever they're called
+	srv.AddPlaylist("mine", "On Repeat", spotifytest.Track("m1", "Mine", "Album", "Artist"))
+	srv.AddPlaylist("rewind", "Rewind", spotifytest.Track("w1", "Rewound", "Album", "Artist"))
+	client := spotifyclient.New(srv.HTTPClient())
+
+	testCases := []struct {
+		name     string
+		opts     dedupe.MatcherOptions
+		track    spotify.FullTrack
+		expected string
+	}{
+		{name: "on repeat by ID", track: spotifytest.Track("r1", "Repeated", "Album", "Artist"), expected: "on Spotify's On Repeat playlist"},
+		{name: "on repeat by ISRC", track: withISRC(spotifytest.Track("x2", "Re-released", "Other Album", "Artist"), "ISRC2"), expected: "on Spotify's On Repeat playlist"},
+		{name: "user's own playlist", track: spotifytest.Track("m1", "Mine", "Album", "Artist")},
+		{name: "not a default playlist", track: spotifytest.Track("y1", "Top Song", "Album", "Artist")},
+		{name: "pattern", opts: dedupe.MatcherOptions{"playlists": []interface{}{"your top songs *"}}, track: spotifytest.Track("y1", "Top Song", "Album", "Artist"), expected: "on Spotify's Your Top Songs 2021 playlist"},
+		{name: "ID", opts: dedupe.MatcherOptions{"playlists": []interface{}{}, "playlistIDs": "rewind"}, track: spotifytest.Track("w1", "Rewound", "Album", "Artist"), expected: "on Spotify's rewind playlist"},
+	}
+	for _, tc := range testCases {
+		m, err := NewMatcherFactory(client)(tc.opts)
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		matched, reason, _, err := m.Match(spotify.PlaylistTrack{Track: tc.track}, nil)
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		if matched != (tc.expected != "") || reason != tc.expected {
+			t.Errorf("%s failed: expected %q, got %v %q", tc.name, tc.expected, matched, reason)
+		}
+	}
+}
+
+func TestInvalidPattern(t *testing.T) {
+	_, err := NewMatcherFactory(nil)(dedupe.MatcherOptions{"playlists": "[On Repeat"})
+	if err == nil || !strings.Contains(err.Error(), "invalid playlist pattern") {
+		t.Errorf("expected an invalid pattern error, got %v", err)
+	}
+}
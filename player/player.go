@@ -0,0 +1,75 @@
+// Package player controls playback on the user's Spotify devices, so a
+// candidate duplicate can be auditioned before deciding what to do with it.
+package player
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+var (
+	// ErrNoDevice is returned when no device is named and none is active
+	ErrNoDevice = errors.New("no active Spotify device, start playing something or name a device")
+	// ErrUnknownDevice is returned when the device named isn't one of the
+	// user's
+	ErrUnknownDevice = errors.New("no such Spotify device")
+)
+
+// API is the view of the Spotify API needed to control playback
+type API interface {
+	PlayerDevices(ctx context.Context) ([]spotify.PlayerDevice, error)
+	PlayOpt(ctx context.Context, opt *spotify.PlayOptions) error
+	PauseOpt(ctx context.Context, opt *spotify.PlayOptions) error
+}
+
+// Device returns the device with the given ID or name, ignoring case, or the
+// active device if device is empty
+func Device(ctx context.Context, client API, device string) (*spotify.PlayerDevice, error) {
+	devices, err := client.PlayerDevices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i, d := range devices {
+		if device == "" && d.Active {
+			return &devices[i], nil
+		}
+		if device != "" && (string(d.ID) == device || strings.EqualFold(d.Name, device)) {
+			return &devices[i], nil
+		}
+	}
+	if device == "" {
+		return nil, ErrNoDevice
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownDevice, device)
+}
+
+// Play plays a track from positionMs on the device with the given ID or name,
+// or the active device if device is empty, returning the device
+func Play(ctx context.Context, client API, device string, trackID spotify.ID, positionMs int) (*spotify.PlayerDevice, error) {
+	d, err := Device(ctx, client, device)
+	if err != nil {
+		return nil, err
+	}
+	if d.Restricted {
+		return nil, fmt.Errorf("%s can't be controlled through the Spotify API", d.Name)
+	}
+	opt := &spotify.PlayOptions{DeviceID: &d.ID, URIs: []spotify.URI{spotify.URI("spotify:track:" + trackID)}, PositionMs: spotify.Numeric(positionMs)}
+	if err := client.PlayOpt(ctx, opt); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Pause pauses playback on the device with the given ID or name, or the
+// active device if device is empty
+func Pause(ctx context.Context, client API, device string) error {
+	d, err := Device(ctx, client, device)
+	if err != nil {
+		return err
+	}
+	return client.PauseOpt(ctx, &spotify.PlayOptions{DeviceID: &d.ID})
+}
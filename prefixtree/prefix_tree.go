@@ -3,6 +3,7 @@ package prefixtree
 import (
     "strings"
     "bytes"
+    "sort"
 )
 
 
@@ -18,20 +19,25 @@ type PrefixTree struct {
 type prefixNode struct {
     data rune
     children map[rune]*prefixNode
+    // end is true if a string added to the tree ends at this node
+    end bool
 }
 
+// childPrefixes returns the runes of the node's children in ascending order
 func (p *prefixNode) childPrefixes() []rune {
     keys := []rune{}
     for k, _ := range p.children {
         keys = append(keys, k)
     }
+    sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
     return keys
 }
 
+// childNodes returns the node's children in ascending order of their runes
 func (p *prefixNode) childNodes() []*prefixNode {
     vals := []*prefixNode{}
-    for _, v := range p.children {
-        vals = append(vals, v)
+    for _, k := range p.childPrefixes() {
+        vals = append(vals, p.children[k])
     }
     return vals
 }
@@ -49,6 +55,47 @@ func NewPrefixTree() *PrefixTree {
     }
 }
 
+// NewPrefixTreeFromWords creates a prefix tree holding every word in words.
+// The words are inserted in sorted order so each word can resume from the
+// path of the previous word at the end of their shared prefix instead of
+// walking down from the root. words is not modified.
+func NewPrefixTreeFromWords(words []string) *PrefixTree {
+    p := NewPrefixTree()
+    sorted := make([]string, len(words))
+    copy(sorted, words)
+    sort.Strings(sorted)
+
+    // path[i] is the node reached after the first i runes of the previous
+    // word, path[0] being the root
+    path := []*prefixNode{p.Root}
+    prev := []rune{}
+    for _, w := range sorted {
+        runes := []rune(w)
+        shared := 0
+        for shared < len(runes) && shared < len(prev) && runes[shared] == prev[shared] {
+            shared++
+        }
+        path = path[:shared+1]
+        next := path[shared]
+        for _, c := range runes[shared:] {
+            n, ok := next.children[c]
+            if !ok {
+                n = newPrefixNode(c)
+                next.children[c] = n
+            }
+            next = n
+            path = append(path, next)
+        }
+        next.end = true
+        prev = runes
+    }
+    return p
+}
+
+// Clear removes every string from the prefix tree
+func (p *PrefixTree) Clear() {
+    p.Root = newPrefixNode(p.Root.data)
+}
 
 // Add adds the given string to the prefix tree. Every nth character in the
 // provided string will occur in the nth level of the tree.
@@ -64,12 +111,15 @@ func (p *PrefixTree) Add(s string) {
             next = n
         }
     }
+    next.end = true
 }
 
-
-// Contains returns true if there is a traversal from the root of the tree to a
-// node in the tree whose prefixes form the given string, false otherwise
-func (p *PrefixTree) Contains(s string) bool {
+// Remove removes the given string from the prefix tree and prunes the nodes
+// which no longer lead to any string. Returns false if the string was never
+// added.
+func (p *PrefixTree) Remove(s string) bool {
+    // path[i] is the node reached after the first i runes of s
+    path := []*prefixNode{p.Root}
     next := p.Root
     for _, c := range s {
         n, ok := next.children[c]
@@ -77,58 +127,113 @@ func (p *PrefixTree) Contains(s string) bool {
             return false
         }
         next = n
+        path = append(path, next)
+    }
+    if !next.end {
+        return false
+    }
+    next.end = false
+    // walk back up until reaching a node another string still needs
+    for i := len(path) - 1; i > 0; i-- {
+        n := path[i]
+        if n.end || len(n.children) > 0 {
+            break
+        }
+        delete(path[i-1].children, n.data)
     }
     return true
 }
 
-// String prints a BFS of the prefix tree. The only ordering guaranteed is that a rune at level
-// n will be printed before a rune at level n+1
-func (p *PrefixTree) String() string {
+// Contains returns true if the given string was added to the tree as a whole
+// word, false otherwise. Prefixes of added words aren't contained unless they
+// were added themselves.
+func (p *PrefixTree) Contains(s string) bool {
+    n := p.find(s)
+    return n != nil && n.end
+}
+
+// HasPrefix returns true if there is a traversal from the root of the tree to
+// a node in the tree whose prefixes form the given string, i.e. some word
+// added starts with it, false otherwise
+func (p *PrefixTree) HasPrefix(s string) bool {
+    return p.find(s) != nil
+}
+
+// find returns the node reached by following the runes of s down from the
+// root, or nil if there's no such traversal
+func (p *PrefixTree) find(s string) *prefixNode {
     next := p.Root
-    q := next.childNodes()
+    for _, c := range s {
+        n, ok := next.children[c]
+        if !ok {
+            return nil
+        }
+        next = n
+    }
+    return next
+}
+
+// String prints a BFS of the prefix tree, each rune followed by a comma. Runes
+// at level n are printed before runes at level n+1, and the children of a node
+// are printed in ascending order.
+func (p *PrefixTree) String() string {
+    q := p.Root.childNodes()
     str := strings.Builder{}
     for len(q) > 0 {
-        childPrefixes := next.childPrefixes()
-        for _, p := range childPrefixes {
-            str.WriteRune(p)
-            str.WriteRune(',')
-        }
         // queue pop
-        next, q = q[len(q)-1], q[:len(q)-1]
+        var next *prefixNode
+        next, q = q[0], q[1:]
+        str.WriteRune(next.data)
+        str.WriteRune(',')
         q = append(q, next.childNodes()...)
     }
     return str.String()
 }
 
 
-// Words prints a list of all words present in the prefix tree
+// Words returns every word added to the prefix tree in lexicographic order
 func (p *PrefixTree) Words() []string {
     words := []string{}
     for _, n := range p.Root.childNodes() {
-        words = append(words, p.wordsHelper(n, &bytes.Buffer{})...)
+        words = p.wordsHelper(n, &bytes.Buffer{}, words)
     }
     return words
 }
 
-func (p *PrefixTree) wordsHelper(n *prefixNode, word *bytes.Buffer) []string {
-    // no error is returned from bytes.Buffer.WriteRune
-    word.WriteRune(n.data)
-    if len(n.children) == 0 {
-        return []string{word.String()}
-    } else {
-        words := []string{}
-        for _, c := range n.childNodes() {
-            words = append(words, p.wordsHelper(c, bytes.NewBuffer(word.Bytes()))...)
+// WordsWithPrefix returns every word added to the prefix tree which starts
+// with prefix, in lexicographic order
+func (p *PrefixTree) WordsWithPrefix(prefix string) []string {
+    words := []string{}
+    next := p.Root
+    for _, c := range prefix {
+        n, ok := next.children[c]
+        if !ok {
+            return words
         }
-        return words
+        next = n
     }
+    if next == p.Root {
+        return p.Words()
+    }
+    word := &bytes.Buffer{}
+    word.WriteString(prefix)
+    // wordsHelper writes the node's own rune, which is already in prefix
+    word.Truncate(word.Len() - len(string(next.data)))
+    return p.wordsHelper(next, word, words)
 }
 
-// the docs say not to do this
-func copyStringBuilder(b strings.Builder) strings.Builder {
-    var newBuilder strings.Builder
-    for _, c := range b.String() {
-        newBuilder.WriteRune(c)
+// wordsHelper appends every word in the subtree rooted at n, each prefixed by
+// word, to words in a depth first traversal
+func (p *PrefixTree) wordsHelper(n *prefixNode, word *bytes.Buffer, words []string) []string {
+    // no error is returned from bytes.Buffer.WriteRune
+    word.WriteRune(n.data)
+    if n.end {
+        words = append(words, word.String())
     }
-    return b
+    for _, c := range n.childNodes() {
+        words = p.wordsHelper(c, word, words)
+    }
+    // backtrack so siblings share the prefix but not this rune
+    word.Truncate(word.Len() - len(string(n.data)))
+    return words
 }
@@ -1,6 +1,7 @@
 package prefixtree
 
 import (
+    "strings"
     "testing"
 )
 
@@ -41,3 +42,283 @@ func TestAdd(t *testing.T) {
 
     }
 }
+
+func TestWords(t *testing.T) {
+    testCases := []struct{
+        name string
+        toAdd []string
+        expectedWords []string
+    }{
+        {
+            name: "empty tree has no words",
+            toAdd: []string{},
+            expectedWords: []string{},
+        },
+        {
+            name: "words are sorted",
+            toAdd: []string{"word", "bird", "acab"},
+            expectedWords: []string{"acab", "bird", "word"},
+        },
+        {
+            name: "words sharing a prefix are kept separate",
+            toAdd: []string{"word", "woken", "token", "tolkien"},
+            expectedWords: []string{"token", "tolkien", "woken", "word"},
+        },
+        {
+            name: "word which is a prefix of another word is kept",
+            toAdd: []string{"abracadabra", "abra", "abra"},
+            expectedWords: []string{"abra", "abracadabra"},
+        },
+        {
+            name: "multi-byte runes",
+            toAdd: []string{"björk", "bjorn"},
+            expectedWords: []string{"bjorn", "björk"},
+        },
+    }
+    for _, tc := range testCases {
+        tree := NewPrefixTree()
+        for _, s := range tc.toAdd {
+            tree.Add(s)
+        }
+        words := tree.Words()
+        if strings.Join(words, ",") != strings.Join(tc.expectedWords, ",") || len(words) != len(tc.expectedWords) {
+            t.Errorf("%s failed: expected words %v, got %v", tc.name, tc.expectedWords, words)
+        }
+    }
+}
+
+func TestWordsWithPrefix(t *testing.T) {
+    tree := NewPrefixTreeFromWords([]string{"token", "tolkien", "woken", "word", "to"})
+    testCases := []struct{
+        name string
+        prefix string
+        expectedWords []string
+    }{
+        {
+            name: "empty prefix is every word",
+            prefix: "",
+            expectedWords: []string{"to", "token", "tolkien", "woken", "word"},
+        },
+        {
+            name: "shared prefix",
+            prefix: "to",
+            expectedWords: []string{"to", "token", "tolkien"},
+        },
+        {
+            name: "whole word",
+            prefix: "word",
+            expectedWords: []string{"word"},
+        },
+        {
+            name: "missing prefix",
+            prefix: "bird",
+            expectedWords: []string{},
+        },
+    }
+    for _, tc := range testCases {
+        words := tree.WordsWithPrefix(tc.prefix)
+        if strings.Join(words, ",") != strings.Join(tc.expectedWords, ",") || len(words) != len(tc.expectedWords) {
+            t.Errorf("%s failed: expected words %v, got %v", tc.name, tc.expectedWords, words)
+        }
+    }
+}
+
+func TestString(t *testing.T) {
+    testCases := []struct{
+        name string
+        toAdd []string
+        expectedString string
+    }{
+        {
+            name: "empty tree",
+            toAdd: []string{},
+            expectedString: "",
+        },
+        {
+            name: "levels are printed in order, children sorted",
+            toAdd: []string{"ca", "ab", "cb"},
+            expectedString: "a,c,b,a,b,",
+        },
+        {
+            name: "shallower levels first",
+            toAdd: []string{"abc", "d"},
+            expectedString: "a,d,b,c,",
+        },
+    }
+    for _, tc := range testCases {
+        tree := NewPrefixTree()
+        for _, s := range tc.toAdd {
+            tree.Add(s)
+        }
+        if got := tree.String(); got != tc.expectedString {
+            t.Errorf("%s failed: expected %q, got %q", tc.name, tc.expectedString, got)
+        }
+    }
+}
+
+func TestNewPrefixTreeFromWords(t *testing.T) {
+    testCases := []struct{
+        name string
+        words []string
+    }{
+        {
+            name: "no words",
+            words: []string{},
+        },
+        {
+            name: "unsorted words sharing prefixes",
+            words: []string{"word", "woken", "bird", "token", "tolkien", "abracadabra", "abra", "acab", "abra"},
+        },
+        {
+            name: "multi-byte runes",
+            words: []string{"björk", "bjorn", "bj"},
+        },
+    }
+    for _, tc := range testCases {
+        bulk := NewPrefixTreeFromWords(tc.words)
+        added := NewPrefixTree()
+        for _, w := range tc.words {
+            added.Add(w)
+        }
+        if bulk.String() != added.String() {
+            t.Errorf("%s failed: expected tree %q, got %q", tc.name, added.String(), bulk.String())
+        }
+        if strings.Join(bulk.Words(), ",") != strings.Join(added.Words(), ",") {
+            t.Errorf("%s failed: expected words %v, got %v", tc.name, added.Words(), bulk.Words())
+        }
+    }
+}
+
+func TestClear(t *testing.T) {
+    tree := NewPrefixTreeFromWords([]string{"word", "woken"})
+    tree.Clear()
+    if tree.HasPrefix("w") || len(tree.Words()) != 0 {
+        t.Errorf("expected cleared tree to be empty, got words %v", tree.Words())
+    }
+    tree.Add("bird")
+    if !tree.Contains("bird") {
+        t.Errorf("expected cleared tree to accept new words")
+    }
+}
+
+func TestRemove(t *testing.T) {
+    testCases := []struct{
+        name string
+        words []string
+        toRemove string
+        expectedRemoved bool
+        expectedWords []string
+    }{
+        {
+            name: "only word",
+            words: []string{"word"},
+            toRemove: "word",
+            expectedRemoved: true,
+            expectedWords: []string{},
+        },
+        {
+            name: "word sharing a prefix",
+            words: []string{"word", "woken", "bird"},
+            toRemove: "woken",
+            expectedRemoved: true,
+            expectedWords: []string{"bird", "word"},
+        },
+        {
+            name: "word which prefixes another",
+            words: []string{"abra", "abracadabra"},
+            toRemove: "abra",
+            expectedRemoved: true,
+            expectedWords: []string{"abracadabra"},
+        },
+        {
+            name: "word prefixed by another",
+            words: []string{"abra", "abracadabra"},
+            toRemove: "abracadabra",
+            expectedRemoved: true,
+            expectedWords: []string{"abra"},
+        },
+        {
+            name: "prefix never added",
+            words: []string{"word"},
+            toRemove: "wor",
+            expectedRemoved: false,
+            expectedWords: []string{"word"},
+        },
+        {
+            name: "word never added",
+            words: []string{"word"},
+            toRemove: "bird",
+            expectedRemoved: false,
+            expectedWords: []string{"word"},
+        },
+        {
+            name: "multi-byte runes",
+            words: []string{"björk", "bjorn"},
+            toRemove: "björk",
+            expectedRemoved: true,
+            expectedWords: []string{"bjorn"},
+        },
+    }
+    for _, tc := range testCases {
+        tree := NewPrefixTreeFromWords(tc.words)
+        if removed := tree.Remove(tc.toRemove); removed != tc.expectedRemoved {
+            t.Errorf("%s failed: expected removed %t, got %t", tc.name, tc.expectedRemoved, removed)
+        }
+        if strings.Join(tree.Words(), ",") != strings.Join(tc.expectedWords, ",") {
+            t.Errorf("%s failed: expected words %v, got %v", tc.name, tc.expectedWords, tree.Words())
+        }
+        // orphaned nodes are pruned, leaving the tree the remaining words build
+        if expected := NewPrefixTreeFromWords(tc.expectedWords).String(); tree.String() != expected {
+            t.Errorf("%s failed: expected tree %q, got %q", tc.name, expected, tree.String())
+        }
+    }
+}
+
+func TestContains(t *testing.T) {
+    tree := NewPrefixTreeFromWords([]string{"abra", "abracadabra", "bird"})
+    testCases := []struct{
+        name string
+        s string
+        expectContains bool
+        expectHasPrefix bool
+    }{
+        {
+            name: "added word",
+            s: "abracadabra",
+            expectContains: true,
+            expectHasPrefix: true,
+        },
+        {
+            name: "added word which prefixes another",
+            s: "abra",
+            expectContains: true,
+            expectHasPrefix: true,
+        },
+        {
+            name: "prefix of an added word",
+            s: "abrac",
+            expectContains: false,
+            expectHasPrefix: true,
+        },
+        {
+            name: "longer than an added word",
+            s: "birds",
+            expectContains: false,
+            expectHasPrefix: false,
+        },
+        {
+            name: "never added",
+            s: "word",
+            expectContains: false,
+            expectHasPrefix: false,
+        },
+    }
+    for _, tc := range testCases {
+        if contains := tree.Contains(tc.s); contains != tc.expectContains {
+            t.Errorf("%s failed: expected Contains to be %t, got %t", tc.name, tc.expectContains, contains)
+        }
+        if hasPrefix := tree.HasPrefix(tc.s); hasPrefix != tc.expectHasPrefix {
+            t.Errorf("%s failed: expected HasPrefix to be %t, got %t", tc.name, tc.expectHasPrefix, hasPrefix)
+        }
+    }
+}
@@ -0,0 +1,159 @@
+package preflight
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"potentials-utils/library"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// MaxClockSkew is how far the local clock may drift from Spotify's before
+// CheckClock fails
+const MaxClockSkew = time.Minute
+
+// probeTimeout bounds every network request a diagnostic makes
+const probeTimeout = 10 * time.Second
+
+// CheckCredentials checks Spotify accepts the app's client ID and secret, by
+// requesting a client credentials token from tokenURL
+func CheckCredentials(id, secret, tokenURL string) Check {
+	if id == "" || secret == "" {
+		return failed("credentials", "spotify.id or spotify.secret isn't set",
+			"copy them from your app at https://developer.spotify.com/dashboard")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	cfg := &clientcredentials.Config{ClientID: id, ClientSecret: secret, TokenURL: tokenURL}
+	if _, err := cfg.Token(ctx); err != nil {
+		if _, ok := err.(*oauth2.RetrieveError); ok {
+			return failed("credentials", fmt.Sprintf("Spotify rejected the client ID and secret: %v", err),
+				"check spotify.id and spotify.secret match your app at https://developer.spotify.com/dashboard")
+		}
+		return failed("credentials", fmt.Sprintf("can't reach Spotify: %v", err), "check your network connection")
+	}
+	return Check{Name: "credentials"}
+}
+
+// CheckCache checks the cache directory is writable and any cached library is
+// readable
+func CheckCache(cacheDir string) Check {
+	if cacheDir == "" {
+		return failed("cache", "cache.cacheDir isn't set", "set cache.cacheDir in your config")
+	}
+	if err := os.MkdirAll(cacheDir, os.FileMode(uint32(0755))); err != nil {
+		return failed("cache", fmt.Sprintf("can't create %s: %v", cacheDir, err), "set cache.cacheDir to a writable directory")
+	}
+	probe, err := ioutil.TempFile(cacheDir, "doctor")
+	if err != nil {
+		return failed("cache", fmt.Sprintf("can't write to %s: %v", cacheDir, err), "set cache.cacheDir to a writable directory")
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+
+	stored, err := library.LoadStoredLibrary(cacheDir)
+	if os.IsNotExist(err) {
+		return Check{Name: "cache", Detail: "no library cached yet"}
+	} else if err != nil {
+		return failed("cache", fmt.Sprintf("can't read the cached library: %v", err),
+			fmt.Sprintf("delete %s to rebuild it on the next run", library.OpenStore(cacheDir).Path()))
+	}
+	detail := fmt.Sprintf("%d tracks cached, fresh until %s", len(stored.Tracks), stored.Expiration.Format(time.RFC3339))
+	if time.Now().After(stored.Expiration) {
+		detail = fmt.Sprintf("%d tracks cached, expired %s so rebuilt on the next run", len(stored.Tracks), stored.Expiration.Format(time.RFC3339))
+	}
+	return Check{Name: "cache", Detail: detail}
+}
+
+// CheckToken checks the access token from authenticating is usable and
+// hasn't expired. tokenErr is the error getting the token, if any.
+func CheckToken(token *oauth2.Token, tokenErr error) Check {
+	if tokenErr != nil {
+		return failed("token", fmt.Sprintf("can't get an access token: %v", tokenErr), reauthorize)
+	}
+	if !token.Valid() {
+		return failed("token", fmt.Sprintf("the access token expired at %s and couldn't be refreshed", token.Expiry.Format(time.RFC3339)), reauthorize)
+	}
+	if token.Expiry.IsZero() {
+		return Check{Name: "token", Detail: "never expires"}
+	}
+	return Check{Name: "token", Detail: fmt.Sprintf("expires in %s", time.Until(token.Expiry).Round(time.Second))}
+}
+
+// CheckCallback checks the OAuth callback URL reaches this machine, by serving
+// a probe on listenAddr, as the one-off auth server would, and requesting it
+// through callbackURL. If listenAddr is taken, e.g. by a running
+// potentials-utils server, any answer from callbackURL passes.
+func CheckCallback(callbackURL, listenAddr string) Check {
+	u, err := url.Parse(callbackURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return failed("callback", fmt.Sprintf("spotify.callbackURL %q isn't an http(s) URL", callbackURL),
+			"set spotify.callbackURL to the redirect URI registered for your app, e.g. http://localhost:8080/callback/spotify")
+	}
+	const probe = "potentials-utils-doctor"
+	client := &http.Client{Timeout: probeTimeout}
+	l, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		resp, getErr := client.Get(callbackURL)
+		if getErr != nil {
+			return failed("callback", fmt.Sprintf("%s is in use and %s can't be reached: %v", listenAddr, callbackURL, getErr),
+				fmt.Sprintf("stop whatever is listening on %s", listenAddr))
+		}
+		resp.Body.Close()
+		return Check{Name: "callback", Detail: fmt.Sprintf("%s is served by whatever is listening on %s", callbackURL, listenAddr)}
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(probe))
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+	resp, err := client.Get(callbackURL)
+	if err != nil {
+		return failed("callback", fmt.Sprintf("can't reach %s: %v", callbackURL, err),
+			fmt.Sprintf("point spotify.callbackURL at this machine on %s", listenAddr))
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(body) != probe {
+		return failed("callback", fmt.Sprintf("%s is answered by something other than potentials-utils", callbackURL),
+			fmt.Sprintf("point spotify.callbackURL at this machine on %s", listenAddr))
+	}
+	return Check{Name: "callback"}
+}
+
+// CheckClock checks the local clock is within MaxClockSkew of the Date header
+// of a response from apiURL
+func CheckClock(apiURL string) Check {
+	client := &http.Client{Timeout: probeTimeout}
+	sent := time.Now()
+	resp, err := client.Get(apiURL)
+	if err != nil {
+		return failed("clock", fmt.Sprintf("can't reach %s: %v", apiURL, err), "check your network connection")
+	}
+	resp.Body.Close()
+	received := time.Now()
+	remote, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return Check{Name: "clock", Detail: "Spotify didn't say what time it is"}
+	}
+	// The Date header is somewhere in the request's round trip, and only has
+	// second precision
+	local := sent.Add(received.Sub(sent) / 2)
+	skew := local.Sub(remote)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > MaxClockSkew+time.Second {
+		return failed("clock", fmt.Sprintf("the local clock is %s off Spotify's", skew.Round(time.Second)),
+			"sync the clock, e.g. by enabling NTP")
+	}
+	return Check{Name: "clock", Detail: fmt.Sprintf("within %s of Spotify", skew.Round(time.Second))}
+}
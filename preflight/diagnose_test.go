@@ -0,0 +1,133 @@
+package preflight
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestCheckCredentials(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, _ := r.BasicAuth(); id != "id" || secret != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_client"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token": "token", "token_type": "bearer", "expires_in": 3600}`))
+	}))
+	defer srv.Close()
+	testCases := []struct {
+		name   string
+		id     string
+		secret string
+		url    string
+		ok     bool
+	}{
+		{name: "valid", id: "id", secret: "secret", url: srv.URL, ok: true},
+		{name: "rejected", id: "id", secret: "wrong", url: srv.URL},
+		{name: "unset", id: "id", url: srv.URL},
+		{name: "unreachable", id: "id", secret: "secret", url: "http://127.0.0.1:1/token"},
+	}
+	for _, tc := range testCases {
+		if c := CheckCredentials(tc.id, tc.secret, tc.url); c.OK() != tc.ok {
+			t.Errorf("%s failed: expected ok to be %t, got %+v", tc.name, tc.ok, c)
+		}
+	}
+}
+
+func TestCheckCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "preflight")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if c := CheckCache(dir); !c.OK() || c.Detail != "no library cached yet" {
+		t.Errorf("expected an empty cache to pass, got %+v", c)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "library.json"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if c := CheckCache(dir); c.OK() {
+		t.Errorf("expected a corrupt library cache to fail")
+	}
+	if c := CheckCache(""); c.OK() {
+		t.Errorf("expected an unset cache directory to fail")
+	}
+}
+
+func TestCheckToken(t *testing.T) {
+	testCases := []struct {
+		name  string
+		token *oauth2.Token
+		err   error
+		ok    bool
+	}{
+		{name: "fresh", token: &oauth2.Token{AccessToken: "a", Expiry: time.Now().Add(time.Hour)}, ok: true},
+		{name: "expired", token: &oauth2.Token{AccessToken: "a", Expiry: time.Now().Add(-time.Hour)}},
+		{name: "refresh failed", err: errors.New("invalid_grant")},
+	}
+	for _, tc := range testCases {
+		if c := CheckToken(tc.token, tc.err); c.OK() != tc.ok {
+			t.Errorf("%s failed: expected ok to be %t, got %+v", tc.name, tc.ok, c)
+		}
+	}
+}
+
+func TestCheckCallback(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	callback := fmt.Sprintf("http://%s/callback/spotify", addr)
+	if c := CheckCallback(callback, addr); !c.OK() {
+		t.Errorf("expected the callback to be reachable, got %+v", c)
+	}
+	if c := CheckCallback("localhost:8080/callback", addr); c.OK() {
+		t.Errorf("expected a callback URL without a scheme to fail")
+	}
+	// Served by something else, e.g. a running server
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	busy := srv.Listener.Addr().String()
+	if c := CheckCallback(srv.URL+"/callback/spotify", busy); !c.OK() {
+		t.Errorf("expected a callback answered by a running server to pass, got %+v", c)
+	}
+	if c := CheckCallback(callback, busy); c.OK() {
+		t.Errorf("expected an unreachable callback on a busy address to fail")
+	}
+}
+
+func TestCheckClock(t *testing.T) {
+	testCases := []struct {
+		name   string
+		offset time.Duration
+		ok     bool
+	}{
+		{name: "synced", ok: true},
+		{name: "behind", offset: -5 * time.Minute},
+		{name: "ahead", offset: 5 * time.Minute},
+	}
+	for _, tc := range testCases {
+		offset := tc.offset
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Date", time.Now().Add(offset).UTC().Format(http.TimeFormat))
+			w.WriteHeader(http.StatusUnauthorized)
+		}))
+		if c := CheckClock(srv.URL); c.OK() != tc.ok {
+			t.Errorf("%s failed: expected ok to be %t, got %+v", tc.name, tc.ok, c)
+		}
+		srv.Close()
+	}
+}
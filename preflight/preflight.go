@@ -0,0 +1,171 @@
+// Package preflight checks potentials-utils has the Spotify access it needs
+// before a clean begins, so missing permissions are reported up front with
+// how to fix them rather than as API errors part way through a run. It also
+// diagnoses the local setup: credentials, caches, the auth callback and the
+// clock.
+package preflight
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/zmb3/spotify/v2"
+	spotifyoauth "github.com/zmb3/spotify/v2/auth"
+)
+
+// API is the view of the Spotify API needed to check access
+type API interface {
+	CurrentUser(ctx context.Context) (*spotify.PrivateUser, error)
+	SavedTracks(ctx context.Context) (*spotify.SavedTrackPage, error)
+	GetPlaylist(ctx context.Context, playlistID spotify.ID) (*spotify.FullPlaylist, error)
+}
+
+// Options configures which checks are run
+type Options struct {
+	// Required are the OAuth scopes potentials-utils requests
+	Required []string
+	// Granted are the OAuth scopes Spotify granted. Scopes aren't checked
+	// if nil, e.g. when Spotify didn't report them.
+	Granted []string
+	// Playlists must be readable, and modifiable unless ReadOnly
+	Playlists []spotify.ID
+	// ReadOnly skips the checks for write access
+	ReadOnly bool
+}
+
+// Check is the outcome of one pre-flight check
+type Check struct {
+	Name string `json:"name"`
+	// Detail is what a passing check found, if worth saying
+	Detail string `json:"detail,omitempty"`
+	// Problem is what's wrong, empty if the check passed
+	Problem string `json:"problem,omitempty"`
+	// Remedy is how to fix the problem
+	Remedy string `json:"remedy,omitempty"`
+}
+
+// OK returns true if the check passed
+func (c Check) OK() bool {
+	return c.Problem == ""
+}
+
+// reauthorize is the remedy for a missing scope or a revoked token
+const reauthorize = "authenticate again and approve every permission potentials-utils asks for"
+
+// Run runs every check, in order. Checks after the current user can't be
+// looked up are skipped, since nothing else would work either.
+func Run(ctx context.Context, client API, opts Options) []Check {
+	checks := []Check{}
+	if opts.Granted != nil {
+		checks = append(checks, checkScopes(opts.Required, opts.Granted))
+	}
+	user, err := client.CurrentUser(ctx)
+	if err != nil {
+		return append(checks, failed("user", fmt.Sprintf("can't look up the current user: %v", err),
+			"check spotify.id and spotify.secret, then "+reauthorize))
+	}
+	checks = append(checks, Check{Name: "user"})
+	checks = append(checks, checkLibrary(ctx, client))
+	for _, id := range opts.Playlists {
+		checks = append(checks, checkPlaylist(ctx, client, opts, user.ID, id))
+	}
+	return checks
+}
+
+// Failed returns an error describing every failed check, or nil if all passed
+func Failed(checks []Check) error {
+	problems := []string{}
+	for _, c := range checks {
+		if !c.OK() {
+			problems = append(problems, fmt.Sprintf("%s: %s (%s)", c.Name, c.Problem, c.Remedy))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("pre-flight checks failed: %s", strings.Join(problems, "; "))
+}
+
+func failed(name, problem, remedy string) Check {
+	return Check{Name: name, Problem: problem, Remedy: remedy}
+}
+
+// checkScopes checks every required scope was granted
+func checkScopes(required, granted []string) Check {
+	missing := missingScopes(required, granted)
+	if len(missing) > 0 {
+		return failed("scopes", fmt.Sprintf("not granted %s", strings.Join(missing, ", ")), reauthorize)
+	}
+	return Check{Name: "scopes"}
+}
+
+func missingScopes(required, granted []string) []string {
+	has := map[string]bool{}
+	for _, s := range granted {
+		has[s] = true
+	}
+	missing := []string{}
+	for _, s := range required {
+		if !has[s] {
+			missing = append(missing, s)
+		}
+	}
+	return missing
+}
+
+// checkLibrary checks the user's saved tracks can be read
+func checkLibrary(ctx context.Context, client API) Check {
+	if _, err := client.SavedTracks(ctx); err != nil {
+		return failed("library", fmt.Sprintf("can't read your saved tracks: %v", err), remedyFor(err, reauthorize))
+	}
+	return Check{Name: "library"}
+}
+
+// checkPlaylist checks a playlist can be read and, unless read-only, that the
+// user may modify it
+func checkPlaylist(ctx context.Context, client API, opts Options, userID string, id spotify.ID) Check {
+	name := fmt.Sprintf("playlist %s", id)
+	playlist, err := client.GetPlaylist(ctx, id)
+	if err != nil {
+		return failed(name, fmt.Sprintf("can't read the playlist: %v", err),
+			remedyFor(err, "check the playlist ID in your config"))
+	}
+	if opts.ReadOnly {
+		return Check{Name: name}
+	}
+	if playlist.Owner.ID != userID && !playlist.Collaborative {
+		return failed(name, fmt.Sprintf("%q is owned by %s and isn't collaborative", playlist.Name, playlist.Owner.ID),
+			"use a playlist you own, ask the owner to make it collaborative, or run read-only")
+	}
+	if opts.Granted != nil {
+		scope := spotifyoauth.ScopePlaylistModifyPrivate
+		if playlist.IsPublic {
+			scope = spotifyoauth.ScopePlaylistModifyPublic
+		}
+		if len(missingScopes([]string{scope}, opts.Granted)) > 0 {
+			return failed(name, fmt.Sprintf("can't modify %q without %s", playlist.Name, scope), reauthorize)
+		}
+	}
+	return Check{Name: name}
+}
+
+// remedyFor returns the remedy for a Spotify API error, or def if there's no
+// more specific one
+func remedyFor(err error, def string) string {
+	var apiErr spotify.Error
+	if !errors.As(err, &apiErr) {
+		return def
+	}
+	switch apiErr.Status {
+	case http.StatusUnauthorized:
+		return reauthorize
+	case http.StatusForbidden:
+		return "potentials-utils lacks a permission it needs, " + reauthorize
+	case http.StatusNotFound:
+		return "check the ID in your config and that the playlist hasn't been deleted"
+	}
+	return def
+}
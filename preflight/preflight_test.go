@@ -0,0 +1,64 @@
+package preflight
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"potentials-utils/spotifyclient"
+	"potentials-utils/spotifytest"
+
+	"github.com/zmb3/spotify/v2"
+	spotifyoauth "github.com/zmb3/spotify/v2/auth"
+)
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	srv.AddPlaylist("mine", "Mine")
+	srv.AddPlaylist("followed", "Followed")
+	srv.SetPlaylistOwner("followed", "someoneelse")
+	client := spotifyclient.New(srv.HTTPClient())
+	all := []string{spotifyoauth.ScopeUserLibraryRead, spotifyoauth.ScopePlaylistModifyPrivate}
+
+	testCases := []struct {
+		name   string
+		opts   Options
+		failed []string
+	}{
+		{name: "all granted", opts: Options{Required: all, Granted: all, Playlists: []spotify.ID{"mine"}}},
+		{name: "scopes unknown", opts: Options{Required: all, Playlists: []spotify.ID{"mine"}}},
+		{
+			name:   "missing scope",
+			opts:   Options{Required: all, Granted: all[:1], Playlists: []spotify.ID{"mine"}},
+			failed: []string{"scopes", "playlist mine"},
+		},
+		{
+			name:   "missing scope read-only",
+			opts:   Options{Required: all, Granted: all[:1], Playlists: []spotify.ID{"mine"}, ReadOnly: true},
+			failed: []string{"scopes"},
+		},
+		{name: "followed", opts: Options{Playlists: []spotify.ID{"followed"}}, failed: []string{"playlist followed"}},
+		{name: "followed read-only", opts: Options{Playlists: []spotify.ID{"followed"}, ReadOnly: true}},
+		{name: "missing playlist", opts: Options{Playlists: []spotify.ID{"gone"}}, failed: []string{"playlist gone"}},
+	}
+	for _, tc := range testCases {
+		checks := Run(ctx, client, tc.opts)
+		failed := []string{}
+		for _, c := range checks {
+			if !c.OK() {
+				failed = append(failed, c.Name)
+				if c.Remedy == "" {
+					t.Errorf("%s failed: expected a remedy for %s", tc.name, c.Name)
+				}
+			}
+		}
+		if strings.Join(failed, ",") != strings.Join(tc.failed, ",") {
+			t.Errorf("%s failed: expected %v to fail, got %+v", tc.name, tc.failed, checks)
+		}
+		if err := Failed(checks); (err != nil) != (len(tc.failed) > 0) {
+			t.Errorf("%s failed: unexpected error %v", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// Package progress reports the progress of long-running tasks, like indexing
+// the library and cleaning a playlist, as a stream of events which can be
+// shown as a terminal bar, logged, written as JSON or ignored, so the CLI and
+// server mode report the same progress.
+package progress
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/cheggaaa/pb/v3"
+)
+
+// Event is the progress of a task at a point in time
+type Event struct {
+	// Task names the task, e.g. "index" or "clean"
+	Task    string `json:"task"`
+	Current int    `json:"current"`
+	Total   int    `json:"total"`
+	// Done is true for the last event of a task
+	Done bool      `json:"done"`
+	Time time.Time `json:"time"`
+}
+
+// Percent returns how much of the task is done, from 0 to 100
+func (e Event) Percent() int {
+	if e.Total <= 0 {
+		if e.Done {
+			return 100
+		}
+		return 0
+	}
+	return e.Current * 100 / e.Total
+}
+
+// Reporter is told about the progress of tasks
+type Reporter interface {
+	Report(e Event)
+}
+
+// ReporterFunc adapts a function to a Reporter
+type ReporterFunc func(e Event)
+
+// Report calls f(e)
+func (f ReporterFunc) Report(e Event) {
+	f(e)
+}
+
+// Nop ignores progress
+var Nop Reporter = ReporterFunc(func(Event) {})
+
+// Task tracks the progress of one task, reporting every change
+type Task struct {
+	r       Reporter
+	name    string
+	current int
+	total   int
+}
+
+// Start reports the start of a task with total steps
+func Start(r Reporter, name string, total int) *Task {
+	if r == nil {
+		r = Nop
+	}
+	t := &Task{r: r, name: name, total: total}
+	t.report(false)
+	return t
+}
+
+// Set reports current steps done
+func (t *Task) Set(current int) {
+	t.current = current
+	if t.current > t.total {
+		t.current = t.total
+	}
+	t.report(false)
+}
+
+// Add reports n more steps done
+func (t *Task) Add(n int) {
+	t.Set(t.current + n)
+}
+
+// Finish reports the task done
+func (t *Task) Finish() {
+	t.report(true)
+}
+
+func (t *Task) report(done bool) {
+	t.r.Report(Event{Task: t.name, Current: t.current, Total: t.total, Done: done, Time: time.Now()})
+}
+
+// bar shows progress as a terminal progress bar per task
+type bar struct {
+	mu   sync.Mutex
+	bars map[string]*pb.ProgressBar
+}
+
+// NewBar returns a Reporter which draws a progress bar for each task on the
+// terminal
+func NewBar() Reporter {
+	return &bar{bars: map[string]*pb.ProgressBar{}}
+}
+
+func (b *bar) Report(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	progressBar, ok := b.bars[e.Task]
+	if !ok {
+		progressBar = pb.StartNew(e.Total)
+		b.bars[e.Task] = progressBar
+	}
+	progressBar.SetCurrent(int64(e.Current))
+	if e.Done {
+		progressBar.Finish()
+		delete(b.bars, e.Task)
+	}
+}
+
+// logLine logs progress every tenth of a task
+type logLine struct {
+	mu     sync.Mutex
+	logger log.Interface
+	logged map[string]int
+}
+
+// NewLog returns a Reporter which logs the start and end of each task and
+// every ten percent of progress in between
+func NewLog(logger log.Interface) Reporter {
+	return &logLine{logger: logger, logged: map[string]int{}}
+}
+
+func (l *logLine) Report(e Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	step, started := l.logged[e.Task]
+	percent := e.Percent()
+	if started && !e.Done && percent/10 <= step {
+		return
+	}
+	l.logged[e.Task] = percent / 10
+	if e.Done {
+		delete(l.logged, e.Task)
+	}
+	l.logger.WithFields(log.Fields{"task": e.Task, "current": e.Current, "total": e.Total, "percent": percent, "done": e.Done}).Info("progress")
+}
+
+// jsonLines writes each event as a line of JSON
+type jsonLines struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSON returns a Reporter which writes every event to w as a line of JSON
+func NewJSON(w io.Writer) Reporter {
+	return &jsonLines{enc: json.NewEncoder(w)}
+}
+
+func (j *jsonLines) Report(e Event) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.enc.Encode(e); err != nil {
+		log.WithFields(log.Fields{"err": err}).Warn("failed to write progress event")
+	}
+}
+
+// New returns the Reporter named kind: bar, log, json (written to w) or none
+func New(kind string, w io.Writer) (Reporter, error) {
+	switch kind {
+	case "bar":
+		return NewBar(), nil
+	case "log":
+		return NewLog(log.Log), nil
+	case "json":
+		return NewJSON(w), nil
+	case "none":
+		return Nop, nil
+	}
+	return nil, fmt.Errorf("unknown progress reporter %q, expected bar, log, json or none", kind)
+}
@@ -0,0 +1,89 @@
+package progress
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/memory"
+)
+
+func TestTask(t *testing.T) {
+	events := []Event{}
+	task := Start(ReporterFunc(func(e Event) { events = append(events, e) }), "clean", 120)
+	task.Set(50)
+	task.Add(50)
+	task.Add(50)
+	task.Finish()
+	expected := []Event{
+		{Task: "clean", Current: 0, Total: 120},
+		{Task: "clean", Current: 50, Total: 120},
+		{Task: "clean", Current: 100, Total: 120},
+		{Task: "clean", Current: 120, Total: 120},
+		{Task: "clean", Current: 120, Total: 120, Done: true},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %+v", len(expected), events)
+	}
+	for i, e := range events {
+		e.Time = expected[i].Time
+		if e != expected[i] {
+			t.Errorf("expected event %d to be %+v, got %+v", i, expected[i], e)
+		}
+	}
+}
+
+func TestLog(t *testing.T) {
+	handler := memory.New()
+	r := NewLog(&log.Logger{Handler: handler, Level: log.InfoLevel})
+	task := Start(r, "index", 1000)
+	for i := 0; i < 20; i++ {
+		task.Add(50)
+	}
+	task.Finish()
+	percents := []int{}
+	for _, entry := range handler.Entries {
+		percents = append(percents, entry.Fields["percent"].(int))
+	}
+	expected := []int{0, 10, 20, 30, 40, 50, 60, 70, 80, 90, 100, 100}
+	if len(percents) != len(expected) {
+		t.Fatalf("expected progress logged at %v, got %v", expected, percents)
+	}
+	for i := range expected {
+		if percents[i] != expected[i] {
+			t.Errorf("expected progress logged at %v, got %v", expected, percents)
+			break
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	out := &bytes.Buffer{}
+	task := Start(NewJSON(out), "index", 2)
+	task.Add(2)
+	task.Finish()
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected a line per event, got %q", out.String())
+	}
+	var last Event
+	if err := json.Unmarshal([]byte(lines[2]), &last); err != nil {
+		t.Fatal(err)
+	}
+	if last.Task != "index" || last.Current != 2 || !last.Done {
+		t.Errorf("unexpected last event %+v", last)
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, kind := range []string{"bar", "log", "json", "none"} {
+		if _, err := New(kind, &bytes.Buffer{}); err != nil {
+			t.Errorf("%s failed: %v", kind, err)
+		}
+	}
+	if _, err := New("spinner", &bytes.Buffer{}); err == nil {
+		t.Errorf("expected an unknown reporter to fail")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// Recipe is a named routine of subcommands, run in order by `run <name>`
+type Recipe struct {
+	// Steps are subcommands with their arguments, as they'd be typed after
+	// potentials-utils, e.g. "clean --force" or "trash purge". Arguments
+	// are split on spaces and can't be quoted.
+	Steps []string `yaml:"steps"`
+	// ContinueOnError runs the remaining steps after one fails, rather than
+	// stopping
+	ContinueOnError bool `yaml:"continueOnError"`
+	// Webhook, if set, is sent a JSON POST of how every step went once the
+	// recipe finishes
+	Webhook string `yaml:"webhook"`
+}
+
+// StepResult is how one step of a recipe went
+type StepResult struct {
+	Step     string        `json:"step"`
+	Error    string        `json:"error,omitempty"`
+	Skipped  bool          `json:"skipped,omitempty"`
+	Duration time.Duration `json:"durationNs"`
+}
+
+// run is registered on init as it runs the other subcommands
+func init() {
+	subcommands["run"] = subcommand{runRecipe, "run a recipe of subcommands named in the config file"}
+}
+
+// runRecipe runs the recipe named by args[0] from the config file
+func runRecipe(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	list := fs.Bool("list", false, "list the recipes in the config file")
+	fs.Parse(args)
+
+	config, err := loadConfig(*cfgPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config file %s: %w", *cfgPath, err)
+	}
+	if *list {
+		names := []string{}
+		for name := range config.Recipes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%s: %s\n", name, strings.Join(config.Recipes[name].Steps, " + "))
+		}
+		return nil
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: potentials-utils run [-config path] [-list] <recipe>")
+	}
+	name := fs.Arg(0)
+	recipe, ok := config.Recipes[name]
+	if !ok {
+		return fmt.Errorf("no recipe named %q in %s", name, *cfgPath)
+	}
+	// Every step reads the same config file as the recipe
+	configPath = *cfgPath
+	results, err := runSteps(recipe, subcommands)
+	if recipe.Webhook != "" {
+		if hookErr := sendRecipeWebhook(recipe.Webhook, name, results, err); hookErr != nil {
+			log.WithFields(log.Fields{"recipe": name, "err": hookErr}).Error("failed to send recipe webhook")
+		}
+	}
+	return err
+}
+
+// runSteps runs every step of recipe with cmds, returning how each went and
+// the first error
+func runSteps(recipe Recipe, cmds map[string]subcommand) ([]StepResult, error) {
+	results := []StepResult{}
+	var first error
+	for _, step := range recipe.Steps {
+		result := StepResult{Step: step}
+		if first != nil && !recipe.ContinueOnError {
+			result.Skipped = true
+			results = append(results, result)
+			continue
+		}
+		fmt.Printf("==> %s\n", step)
+		begin := time.Now()
+		err := runStep(step, cmds)
+		result.Duration = time.Since(begin)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", step, err)
+			result.Error = err.Error()
+			fmt.Println(err)
+			if first == nil {
+				first = err
+			}
+		}
+		results = append(results, result)
+	}
+	return results, first
+}
+
+// runStep runs one step of a recipe
+func runStep(step string, cmds map[string]subcommand) error {
+	args := strings.Fields(step)
+	if len(args) == 0 {
+		return errors.New("empty step")
+	}
+	if args[0] == "run" {
+		return errors.New("recipes can't run other recipes")
+	}
+	cmd, ok := cmds[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown subcommand %q", args[0])
+	}
+	return cmd.run(args[1:])
+}
+
+// sendRecipeWebhook POSTs how every step of a recipe went to url
+func sendRecipeWebhook(url, name string, results []StepResult, runErr error) error {
+	event := map[string]interface{}{"event": "recipe.finished", "recipe": name, "steps": results, "ok": runErr == nil}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRunSteps(t *testing.T) {
+	ran := []string{}
+	cmds := map[string]subcommand{
+		"clean": {func(args []string) error {
+			ran = append(ran, "clean "+strings.Join(args, " "))
+			return nil
+		}, ""},
+		"trash": {func(args []string) error {
+			ran = append(ran, "trash "+strings.Join(args, " "))
+			return errors.New("purge failed")
+		}, ""},
+		"backup": {func(args []string) error {
+			ran = append(ran, "backup "+strings.Join(args, " "))
+			return nil
+		}, ""},
+	}
+	testCases := []struct {
+		name            string
+		recipe          Recipe
+		expectedRan     []string
+		expectedSkipped int
+		expectErr       bool
+	}{
+		{
+			name:        "all succeed",
+			recipe:      Recipe{Steps: []string{"clean --force", "backup all --out backups"}},
+			expectedRan: []string{"clean --force", "backup all --out backups"},
+		},
+		{
+			name:            "stops at a failure",
+			recipe:          Recipe{Steps: []string{"clean", "trash purge", "backup all"}},
+			expectedRan:     []string{"clean ", "trash purge"},
+			expectedSkipped: 1,
+			expectErr:       true,
+		},
+		{
+			name:        "continues after a failure",
+			recipe:      Recipe{Steps: []string{"trash purge", "backup all"}, ContinueOnError: true},
+			expectedRan: []string{"trash purge", "backup all"},
+			expectErr:   true,
+		},
+		{
+			name:      "unknown subcommand",
+			recipe:    Recipe{Steps: []string{"prune"}},
+			expectErr: true,
+		},
+		{
+			name:      "nested recipe",
+			recipe:    Recipe{Steps: []string{"run weekly"}},
+			expectErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		ran = []string{}
+		results, err := runSteps(tc.recipe, cmds)
+		if (err != nil) != tc.expectErr {
+			t.Errorf("%s failed: expected error %v, got %v", tc.name, tc.expectErr, err)
+		}
+		expectedRan := tc.expectedRan
+		if expectedRan == nil {
+			expectedRan = []string{}
+		}
+		if !reflect.DeepEqual(ran, expectedRan) {
+			t.Errorf("%s failed: expected %v to run, got %v", tc.name, expectedRan, ran)
+		}
+		skipped := 0
+		for _, r := range results {
+			if r.Skipped {
+				skipped++
+			}
+		}
+		if len(results) != len(tc.recipe.Steps) || skipped != tc.expectedSkipped {
+			t.Errorf("%s failed: expected a result per step with %d skipped, got %+v", tc.name, tc.expectedSkipped, results)
+		}
+	}
+}
+
+func TestSendRecipeWebhook(t *testing.T) {
+	var event struct {
+		Event  string       `json:"event"`
+		Recipe string       `json:"recipe"`
+		OK     bool         `json:"ok"`
+		Steps  []StepResult `json:"steps"`
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&event)
+	}))
+	defer srv.Close()
+	results := []StepResult{{Step: "clean"}, {Step: "trash purge", Error: "trash purge: failed"}}
+	if err := sendRecipeWebhook(srv.URL, "weekly", results, errors.New("trash purge: failed")); err != nil {
+		t.Fatal(err)
+	}
+	if event.Event != "recipe.finished" || event.Recipe != "weekly" || event.OK || len(event.Steps) != 2 {
+		t.Errorf("unexpected webhook event %+v", event)
+	}
+}
@@ -0,0 +1,307 @@
+// Package review runs listening sessions over the Potentials playlist: it
+// queues tracks nobody has reviewed yet to the user's active Spotify device
+// and records which were skipped and which were listened to the end, so the
+// review matcher can prune tracks accordingly.
+package review
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"potentials-utils/dedupe"
+	"potentials-utils/library"
+
+	"github.com/apex/log"
+	"github.com/zmb3/spotify/v2"
+)
+
+// MatcherName is the name the review matcher is registered under
+const MatcherName = "review"
+
+// FinishedFraction is how much of a track must be heard for it to count as
+// finished rather than skipped
+const FinishedFraction = 0.9
+
+// ErrNoDevice is returned queueing tracks when the user isn't playing on any
+// device
+var ErrNoDevice = errors.New("no active Spotify device, start playing something first")
+
+// API is the view of the Spotify API needed to run a review session
+type API interface {
+	PlaylistTracks(ctx context.Context, playlistID spotify.ID, offset int) (*spotify.PlaylistTrackPage, error)
+	NextPlaylistTracks(ctx context.Context, page *spotify.PlaylistTrackPage) error
+	PlayerDevices(ctx context.Context) ([]spotify.PlayerDevice, error)
+	PlayerCurrentlyPlaying(ctx context.Context) (*spotify.CurrentlyPlaying, error)
+	QueueSong(ctx context.Context, trackID spotify.ID) error
+}
+
+// Outcome is how a reviewed track was listened to
+type Outcome string
+
+const (
+	// Finished tracks were heard at least FinishedFraction of the way through
+	Finished Outcome = "finished"
+	// Skipped tracks were moved on from before that
+	Skipped Outcome = "skipped"
+)
+
+// Verdict is one listen to a track during a review session
+type Verdict struct {
+	TrackID spotify.ID `json:"trackID"`
+	// Track describes the track for people
+	Track      string    `json:"track"`
+	Outcome    Outcome   `json:"outcome"`
+	HeardMs    int       `json:"heardMs"`
+	DurationMs int       `json:"durationMs"`
+	At         time.Time `json:"at"`
+}
+
+// Log records every verdict, persisted as a JSON file
+type Log struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewLog creates a Log persisted at path. The file is created on the first
+// write.
+func NewLog(path string) *Log {
+	return &Log{path: path}
+}
+
+// Verdicts returns every verdict recorded, by track
+func (l *Log) Verdicts() (map[spotify.ID][]Verdict, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.load()
+}
+
+// Add records verdicts
+func (l *Log) Add(verdicts ...Verdict) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	all, err := l.load()
+	if err != nil {
+		return err
+	}
+	for _, v := range verdicts {
+		all[v.TrackID] = append(all[v.TrackID], v)
+	}
+	bytes, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(l.path, bytes, 0644)
+}
+
+func (l *Log) load() (map[spotify.ID][]Verdict, error) {
+	all := map[spotify.ID][]Verdict{}
+	bytes, err := ioutil.ReadFile(l.path)
+	if os.IsNotExist(err) {
+		return all, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bytes, &all); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// Counts returns how many times a track was skipped and finished
+func Counts(verdicts []Verdict) (skipped, finished int) {
+	for _, v := range verdicts {
+		if v.Outcome == Finished {
+			finished++
+		} else {
+			skipped++
+		}
+	}
+	return skipped, finished
+}
+
+// Unreviewed returns up to n tracks of a playlist, in playlist order, with no
+// verdict recorded
+func Unreviewed(ctx context.Context, client API, playlistID spotify.ID, verdicts map[spotify.ID][]Verdict, n int) ([]spotify.FullTrack, error) {
+	page, err := client.PlaylistTracks(ctx, playlistID, 0)
+	if err != nil {
+		return nil, err
+	}
+	tracks := []spotify.FullTrack{}
+	for {
+		for _, t := range page.Tracks {
+			if t.IsLocal || len(verdicts[t.Track.ID]) > 0 {
+				continue
+			}
+			tracks = append(tracks, t.Track)
+			if len(tracks) == n {
+				return tracks, nil
+			}
+		}
+		if err := client.NextPlaylistTracks(ctx, page); err == spotify.ErrNoMorePages {
+			return tracks, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Queue adds tracks to the playback queue of the user's active device,
+// returning the device
+func Queue(ctx context.Context, client API, tracks []spotify.FullTrack) (*spotify.PlayerDevice, error) {
+	devices, err := client.PlayerDevices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var active *spotify.PlayerDevice
+	for i := range devices {
+		if devices[i].Active && !devices[i].Restricted {
+			active = &devices[i]
+		}
+	}
+	if active == nil {
+		return nil, ErrNoDevice
+	}
+	for _, t := range tracks {
+		if err := client.QueueSong(ctx, t.ID); err != nil {
+			return nil, fmt.Errorf("failed to queue %s: %w", library.TrackString(t), err)
+		}
+	}
+	return active, nil
+}
+
+// Session tells which of the tracks queued for review were skipped and
+// which were finished, from what the user is playing
+type Session struct {
+	queued map[spotify.ID]spotify.FullTrack
+	// playing is the queued track playing when last observed, heard how
+	// far it had got
+	playing *spotify.FullTrack
+	heard   int
+	judged  map[spotify.ID]bool
+}
+
+// NewSession starts a session reviewing tracks
+func NewSession(tracks []spotify.FullTrack) *Session {
+	queued := map[spotify.ID]spotify.FullTrack{}
+	for _, t := range tracks {
+		queued[t.ID] = t
+	}
+	return &Session{queued: queued, judged: map[spotify.ID]bool{}}
+}
+
+// Done returns true once every queued track has a verdict
+func (s *Session) Done() bool {
+	return len(s.judged) == len(s.queued)
+}
+
+// Observe takes what the user is playing at now, which may be nil if
+// nothing is, and returns the verdict on the queued track playing before, if
+// it has stopped
+func (s *Session) Observe(current *spotify.CurrentlyPlaying, now time.Time) []Verdict {
+	var item *spotify.FullTrack
+	progress := 0
+	if current != nil && current.Item != nil {
+		item, progress = current.Item, int(current.Progress)
+	}
+	verdicts := []Verdict{}
+	if s.playing != nil {
+		if item != nil && item.ID == s.playing.ID && progress >= s.heard {
+			s.heard = progress
+			return verdicts
+		}
+		// Moved on, or started the track over
+		verdicts = append(verdicts, s.verdict(now))
+	}
+	s.playing, s.heard = nil, 0
+	if item != nil {
+		if _, ok := s.queued[item.ID]; ok && !s.judged[item.ID] {
+			s.playing, s.heard = item, progress
+		}
+	}
+	return verdicts
+}
+
+func (s *Session) verdict(now time.Time) Verdict {
+	t := *s.playing
+	s.judged[t.ID] = true
+	outcome := Skipped
+	if t.Duration > 0 && float64(s.heard) >= FinishedFraction*float64(t.Duration) {
+		outcome = Finished
+	}
+	return Verdict{TrackID: t.ID, Track: library.TrackString(t), Outcome: outcome, HeardMs: s.heard, DurationMs: int(t.Duration), At: now}
+}
+
+// Watch polls what the user is playing every poll, recording a verdict in
+// reviews for each queued track as it stops, until every queued track has one
+// or ctx is done
+func (s *Session) Watch(ctx context.Context, client API, reviews *Log, poll time.Duration, judged func(Verdict)) error {
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	for !s.Done() {
+		current, err := client.PlayerCurrentlyPlaying(ctx)
+		if err != nil {
+			log.WithFields(log.Fields{"err": err}).Warn("failed to check what's playing")
+		} else if verdicts := s.Observe(current, time.Now()); len(verdicts) > 0 {
+			if err := reviews.Add(verdicts...); err != nil {
+				return err
+			}
+			for _, v := range verdicts {
+				judged(v)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// NewMatcherFactory returns a factory for the review matcher, which matches
+// playlist tracks skipped in review sessions at least the minSkipped option
+// times, default 2, and never finished. With the minFinished option it also
+// matches tracks finished at least that many times, having heard them
+// enough.
+func NewMatcherFactory(reviews *Log) dedupe.MatcherFactory {
+	return func(opts dedupe.MatcherOptions) (dedupe.Matcher, error) {
+		minSkipped := int(opts.Float("minSkipped", 2))
+		if minSkipped < 1 {
+			return nil, fmt.Errorf("minSkipped must be at least 1, got %d", minSkipped)
+		}
+		minFinished := int(opts.Float("minFinished", 0))
+		verdicts, err := reviews.Verdicts()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read review verdicts: %w", err)
+		}
+		return &reviewMatcher{verdicts: verdicts, minSkipped: minSkipped, minFinished: minFinished}, nil
+	}
+}
+
+// reviewMatcher matches tracks reviewed to a verdict
+type reviewMatcher struct {
+	verdicts    map[spotify.ID][]Verdict
+	minSkipped  int
+	minFinished int
+}
+
+func (m *reviewMatcher) Match(t spotify.PlaylistTrack, index dedupe.Library) (bool, string, float64, error) {
+	skipped, finished := Counts(m.verdicts[t.Track.ID])
+	if finished == 0 && skipped >= m.minSkipped {
+		return true, fmt.Sprintf("skipped %d times in review", skipped), 1, nil
+	}
+	if m.minFinished > 0 && finished >= m.minFinished {
+		return true, fmt.Sprintf("finished %d times in review", finished), 1, nil
+	}
+	return false, "", 0, nil
+}
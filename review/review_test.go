@@ -0,0 +1,189 @@
+package review
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"potentials-utils/dedupe"
+	"potentials-utils/spotifyclient"
+	"potentials-utils/spotifytest"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// fakePlayer serves playlists from a spotifytest server and fakes the player
+type fakePlayer struct {
+	spotifyclient.API
+	devices []spotify.PlayerDevice
+	queued  []spotify.ID
+}
+
+func (p *fakePlayer) PlayerDevices(ctx context.Context) ([]spotify.PlayerDevice, error) {
+	return p.devices, nil
+}
+
+func (p *fakePlayer) QueueSong(ctx context.Context, trackID spotify.ID) error {
+	p.queued = append(p.queued, trackID)
+	return nil
+}
+
+func tempLog(t *testing.T) (*Log, func()) {
+	dir, err := ioutil.TempDir("", "review")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewLog(filepath.Join(dir, "review.json")), func() { os.RemoveAll(dir) }
+}
+
+func TestUnreviewedAndQueue(t *testing.T) {
+	ctx := context.Background()
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	srv.AddPlaylist("potentials", "Potentials",
+		spotifytest.Track("t1", "One", "Album", "Artist"),
+		spotifytest.Track("t2", "Two", "Album", "Artist"),
+		spotifytest.Track("t3", "Three", "Album", "Artist"),
+		spotifytest.Track("t4", "Four", "Album", "Artist"))
+	player := &fakePlayer{API: spotifyclient.New(srv.HTTPClient())}
+	verdicts := map[spotify.ID][]Verdict{"t2": {{TrackID: "t2", Outcome: Skipped}}}
+
+	tracks, err := Unreviewed(ctx, player, "potentials", verdicts, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 2 || tracks[0].ID != "t1" || tracks[1].ID != "t3" {
+		t.Fatalf("expected t1 and t3 unreviewed, got %v", tracks)
+	}
+	if _, err := Queue(ctx, player, tracks); err != ErrNoDevice {
+		t.Errorf("expected ErrNoDevice with no active device, got %v", err)
+	}
+	player.devices = []spotify.PlayerDevice{{Name: "Phone"}, {Name: "Laptop", Active: true}}
+	device, err := Queue(ctx, player, tracks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.Name != "Laptop" {
+		t.Errorf("expected to queue to the active device, got %s", device.Name)
+	}
+	if len(player.queued) != 2 || player.queued[0] != "t1" || player.queued[1] != "t3" {
+		t.Errorf("expected t1 and t3 queued, got %v", player.queued)
+	}
+}
+
+func playing(track spotify.FullTrack, progress int) *spotify.CurrentlyPlaying {
+	return &spotify.CurrentlyPlaying{Item: &track, Progress: spotify.Numeric(progress), Playing: true}
+}
+
+func TestObserve(t *testing.T) {
+	one := spotifytest.Track("t1", "One", "Album", "Artist")
+	one.Duration = 200000
+	two := spotifytest.Track("t2", "Two", "Album", "Artist")
+	two.Duration = 200000
+	other := spotifytest.Track("t9", "Other", "Album", "Artist")
+	testCases := []struct {
+		name     string
+		observed []*spotify.CurrentlyPlaying
+		expected []Outcome
+		done     bool
+	}{
+		{
+			name:     "skipped early",
+			observed: []*spotify.CurrentlyPlaying{playing(one, 1000), playing(one, 20000), playing(two, 0)},
+			expected: []Outcome{Skipped},
+		},
+		{
+			name:     "finished",
+			observed: []*spotify.CurrentlyPlaying{playing(one, 1000), playing(one, 195000), playing(two, 0)},
+			expected: []Outcome{Finished},
+		},
+		{
+			name:     "stopped playing",
+			observed: []*spotify.CurrentlyPlaying{playing(one, 1000), nil},
+			expected: []Outcome{Skipped},
+		},
+		{
+			name:     "restarted",
+			observed: []*spotify.CurrentlyPlaying{playing(one, 50000), playing(one, 0)},
+			expected: []Outcome{Skipped},
+		},
+		{
+			name:     "tracks not queued are ignored",
+			observed: []*spotify.CurrentlyPlaying{playing(other, 1000), playing(other, 190000), nil},
+			expected: []Outcome{},
+		},
+		{
+			name:     "all reviewed",
+			observed: []*spotify.CurrentlyPlaying{playing(one, 1000), playing(two, 1000), playing(two, 199000), playing(other, 0)},
+			expected: []Outcome{Skipped, Finished},
+			done:     true,
+		},
+	}
+	for _, tc := range testCases {
+		s := NewSession([]spotify.FullTrack{one, two})
+		outcomes := []Outcome{}
+		for _, cp := range tc.observed {
+			for _, v := range s.Observe(cp, time.Now()) {
+				outcomes = append(outcomes, v.Outcome)
+			}
+		}
+		if len(outcomes) != len(tc.expected) {
+			t.Errorf("%s failed: expected %v, got %v", tc.name, tc.expected, outcomes)
+			continue
+		}
+		for i := range outcomes {
+			if outcomes[i] != tc.expected[i] {
+				t.Errorf("%s failed: expected %v, got %v", tc.name, tc.expected, outcomes)
+			}
+		}
+		if s.Done() != tc.done {
+			t.Errorf("%s failed: expected done %t, got %t", tc.name, tc.done, s.Done())
+		}
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	reviews, cleanup := tempLog(t)
+	defer cleanup()
+	err := reviews.Add(
+		Verdict{TrackID: "skipped", Outcome: Skipped},
+		Verdict{TrackID: "skipped", Outcome: Skipped},
+		Verdict{TrackID: "once", Outcome: Skipped},
+		Verdict{TrackID: "mixed", Outcome: Skipped},
+		Verdict{TrackID: "mixed", Outcome: Skipped},
+		Verdict{TrackID: "mixed", Outcome: Finished},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name     string
+		opts     dedupe.MatcherOptions
+		track    spotify.ID
+		expected bool
+	}{
+		{name: "skipped twice", track: "skipped", expected: true},
+		{name: "skipped once", track: "once", expected: false},
+		{name: "skipped once with minSkipped 1", opts: dedupe.MatcherOptions{"minSkipped": 1}, track: "once", expected: true},
+		{name: "finished once", track: "mixed", expected: false},
+		{name: "finished once with minFinished 1", opts: dedupe.MatcherOptions{"minFinished": 1}, track: "mixed", expected: true},
+		{name: "never reviewed", track: "new", expected: false},
+	}
+	for _, tc := range testCases {
+		m, err := NewMatcherFactory(reviews)(tc.opts)
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		track := spotify.PlaylistTrack{Track: spotify.FullTrack{SimpleTrack: spotify.SimpleTrack{ID: tc.track}}}
+		matched, _, _, err := m.Match(track, nil)
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		if matched != tc.expected {
+			t.Errorf("%s failed: expected matched %t, got %t", tc.name, tc.expected, matched)
+		}
+	}
+}
@@ -0,0 +1,451 @@
+// Package reviewqueue keeps the duplicates a clean wasn't confident enough to
+// act on until someone reviews them, and remembers each decision as a
+// per-track allow or deny list which later cleans follow. Decisions can also
+// be made for every track by an artist or on an album at once, which are kept
+// as rules.
+package reviewqueue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"potentials-utils/dedupe"
+	"potentials-utils/library"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// ErrNotQueued is returned deciding a track which isn't queued for review
+var ErrNotQueued = errors.New("track is not queued for review")
+
+// Decision is what a reviewer decided about a queued duplicate
+type Decision string
+
+const (
+	// Remove judges the track a duplicate, so cleans remove it
+	Remove Decision = "remove"
+	// Keep judges the track not a duplicate, so cleans leave it be
+	Keep Decision = "keep"
+)
+
+// Scope is which tracks a decision is made for
+type Scope string
+
+const (
+	// ScopeTrack decides just the track reviewed
+	ScopeTrack Scope = "track"
+	// ScopeArtist decides every track by the track's artist
+	ScopeArtist Scope = "artist"
+	// ScopeAlbum decides every track on the track's album
+	ScopeAlbum Scope = "album"
+)
+
+// Item is a duplicate waiting for review
+type Item struct {
+	PlaylistID spotify.ID `json:"playlistID"`
+	TrackID    spotify.ID `json:"trackID"`
+	// Track describes the track for people
+	Track    string     `json:"track"`
+	Artists  []string   `json:"artists,omitempty"`
+	AlbumID  spotify.ID `json:"albumID,omitempty"`
+	Album    string     `json:"album,omitempty"`
+	Matcher  string     `json:"matcher"`
+	Reason   string     `json:"reason"`
+	Score    float64    `json:"score"`
+	QueuedAt time.Time  `json:"queuedAt"`
+}
+
+// Artist returns the item's primary artist, skipping "Various Artists"
+func (it Item) Artist() string {
+	for _, a := range it.Artists {
+		if !strings.EqualFold(a, library.VariousArtists) {
+			return a
+		}
+	}
+	return ""
+}
+
+// Verdict is a decision recorded for a track
+type Verdict struct {
+	Decision  Decision  `json:"decision"`
+	DecidedAt time.Time `json:"decidedAt"`
+}
+
+// Rule is a decision recorded for every track by an artist or on an album
+type Rule struct {
+	Scope Scope `json:"scope"`
+	// Artist is the artist decided for, if Scope is ScopeArtist
+	Artist string `json:"artist,omitempty"`
+	// AlbumID is the album decided for, if Scope is ScopeAlbum, with its
+	// name in Album for people
+	AlbumID   spotify.ID `json:"albumID,omitempty"`
+	Album     string     `json:"album,omitempty"`
+	Decision  Decision   `json:"decision"`
+	DecidedAt time.Time  `json:"decidedAt"`
+}
+
+// NewRule returns the rule deciding every track by t's primary artist or on
+// t's album, depending on scope
+func NewRule(t spotify.FullTrack, scope Scope, decision Decision) (Rule, error) {
+	return newRule(scope, library.PrimaryArtist(t.SimpleTrack), t.Album.ID, t.Album.Name, decision)
+}
+
+func newRule(scope Scope, artist string, albumID spotify.ID, album string, decision Decision) (Rule, error) {
+	switch scope {
+	case ScopeArtist:
+		if artist == "" {
+			return Rule{}, errors.New("track has no artist to decide for")
+		}
+		return Rule{Scope: scope, Artist: artist, Decision: decision}, nil
+	case ScopeAlbum:
+		if albumID == "" {
+			return Rule{}, errors.New("track has no album to decide for")
+		}
+		return Rule{Scope: scope, AlbumID: albumID, Album: album, Decision: decision}, nil
+	}
+	return Rule{}, fmt.Errorf("a rule can't be scoped to a %s", scope)
+}
+
+// String describes the tracks the rule decides
+func (r Rule) String() string {
+	if r.Scope == ScopeAlbum {
+		return fmt.Sprintf("every track on %s", r.Album)
+	}
+	return fmt.Sprintf("every track by %s", r.Artist)
+}
+
+// matches returns whether the rule decides a track by artists on albumID
+func (r Rule) matches(artists []string, albumID spotify.ID) bool {
+	switch r.Scope {
+	case ScopeArtist:
+		for _, a := range artists {
+			if strings.EqualFold(a, r.Artist) {
+				return true
+			}
+		}
+	case ScopeAlbum:
+		return albumID == r.AlbumID
+	}
+	return false
+}
+
+// Matches returns whether the rule decides a track
+func (r Rule) Matches(t spotify.FullTrack) bool {
+	return r.matches(library.ArtistNames(t.SimpleTrack), t.Album.ID)
+}
+
+// MatchesItem returns whether the rule decides a queued item
+func (r Rule) MatchesItem(it Item) bool {
+	return r.matches(it.Artists, it.AlbumID)
+}
+
+// state is what's kept in the queue file
+type state struct {
+	Pending []Item `json:"pending"`
+	// Verdicts are the allow and deny lists, by track
+	Verdicts map[spotify.ID]Verdict `json:"verdicts"`
+	// Rules decide tracks by artist or album, album rules taking precedence
+	// over artist rules, and both giving way to a verdict for the track
+	Rules []Rule `json:"rules,omitempty"`
+}
+
+// Queue is a dedupe.ReviewQueue persisted as a JSON file
+type Queue struct {
+	path string
+	mu   sync.Mutex
+	now  func() time.Time
+}
+
+var _ dedupe.ReviewQueue = (*Queue)(nil)
+
+// NewQueue creates a Queue persisted at path. The file is created on the
+// first write.
+func NewQueue(path string) *Queue {
+	return &Queue{path: path, now: time.Now}
+}
+
+// ParseDecision parses a decision, accepting its first letter too
+func ParseDecision(s string) (Decision, error) {
+	switch s {
+	case "remove", "r":
+		return Remove, nil
+	case "keep", "k":
+		return Keep, nil
+	}
+	return "", fmt.Errorf("unknown decision %q, expected remove or keep", s)
+}
+
+// ParseScope parses a scope, treating the empty string as ScopeTrack
+func ParseScope(s string) (Scope, error) {
+	switch Scope(s) {
+	case "", ScopeTrack:
+		return ScopeTrack, nil
+	case ScopeArtist, ScopeAlbum:
+		return Scope(s), nil
+	}
+	return "", fmt.Errorf("unknown scope %q, expected track, artist or album", s)
+}
+
+// Reviewed returns whether a track has been reviewed, or is decided by a
+// rule, and if so whether it was judged a duplicate to remove
+func (q *Queue) Reviewed(t spotify.FullTrack) (bool, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s, err := q.load()
+	if err != nil {
+		return false, false, err
+	}
+	if v, ok := s.Verdicts[t.ID]; ok {
+		return true, v.Decision == Remove, nil
+	}
+	for _, scope := range []Scope{ScopeAlbum, ScopeArtist} {
+		for _, r := range s.Rules {
+			if r.Scope == scope && r.Matches(t) {
+				return true, r.Decision == Remove, nil
+			}
+		}
+	}
+	return false, false, nil
+}
+
+// Enqueue queues duplicates found in a playlist for review. Tracks already
+// queued in the playlist aren't queued again.
+func (q *Queue) Enqueue(playlistID spotify.ID, duplicates []dedupe.Duplicate) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s, err := q.load()
+	if err != nil {
+		return err
+	}
+	queued := map[spotify.ID]bool{}
+	for _, it := range s.Pending {
+		if it.PlaylistID == playlistID {
+			queued[it.TrackID] = true
+		}
+	}
+	now := q.now()
+	for _, d := range duplicates {
+		id := d.Track.Track.ID
+		if queued[id] {
+			continue
+		}
+		queued[id] = true
+		s.Pending = append(s.Pending, Item{
+			PlaylistID: playlistID,
+			TrackID:    id,
+			Track:      library.TrackString(d.Track.Track),
+			Artists:    library.ArtistNames(d.Track.Track.SimpleTrack),
+			AlbumID:    d.Track.Track.Album.ID,
+			Album:      d.Track.Track.Album.Name,
+			Matcher:    d.Matcher,
+			Reason:     d.Reason,
+			Score:      d.Score,
+			QueuedAt:   now,
+		})
+	}
+	return q.save(s)
+}
+
+// Pending returns the duplicates waiting for review, oldest first
+func (q *Queue) Pending() ([]Item, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s, err := q.load()
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(s.Pending, func(i, j int) bool { return s.Pending[i].QueuedAt.Before(s.Pending[j].QueuedAt) })
+	return s.Pending, nil
+}
+
+// Verdicts returns the decision recorded for every track reviewed
+func (q *Queue) Verdicts() (map[spotify.ID]Verdict, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s, err := q.load()
+	if err != nil {
+		return nil, err
+	}
+	return s.Verdicts, nil
+}
+
+// Decide records the decision for a track, taking it out of the queue of
+// every playlist it's queued in. Returns ErrNotQueued if it isn't queued.
+func (q *Queue) Decide(trackID spotify.ID, decision Decision) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s, err := q.load()
+	if err != nil {
+		return err
+	}
+	pending := []Item{}
+	for _, it := range s.Pending {
+		if it.TrackID != trackID {
+			pending = append(pending, it)
+		}
+	}
+	if len(pending) == len(s.Pending) {
+		return fmt.Errorf("%w: %s", ErrNotQueued, trackID)
+	}
+	s.Pending = pending
+	s.Verdicts[trackID] = Verdict{Decision: decision, DecidedAt: q.now()}
+	return q.save(s)
+}
+
+// DecideAll records the decision for every track in scope of a queued track:
+// just the track, every track by its artist or every track on its album.
+// Artist and album decisions are kept as a rule which later cleans follow.
+// Returns the rule recorded, if any, and how many queued duplicates were
+// decided, or ErrNotQueued if the track isn't queued.
+func (q *Queue) DecideAll(trackID spotify.ID, decision Decision, scope Scope) (Rule, int, error) {
+	if scope == ScopeTrack {
+		return Rule{}, 1, q.Decide(trackID, decision)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s, err := q.load()
+	if err != nil {
+		return Rule{}, 0, err
+	}
+	for _, it := range s.Pending {
+		if it.TrackID != trackID {
+			continue
+		}
+		rule, err := newRule(scope, it.Artist(), it.AlbumID, it.Album, decision)
+		if err != nil {
+			return Rule{}, 0, err
+		}
+		decided, err := q.addRule(s, rule)
+		return rule, decided, err
+	}
+	return Rule{}, 0, fmt.Errorf("%w: %s", ErrNotQueued, trackID)
+}
+
+// AddRule records a rule, replacing any made before for the same artist or
+// album, and takes the queued duplicates it decides out of the queue.
+// Returns how many were decided.
+func (q *Queue) AddRule(rule Rule) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s, err := q.load()
+	if err != nil {
+		return 0, err
+	}
+	return q.addRule(s, rule)
+}
+
+func (q *Queue) addRule(s *state, rule Rule) (int, error) {
+	rule.DecidedAt = q.now()
+	rules := []Rule{rule}
+	for _, r := range s.Rules {
+		if r.Scope != rule.Scope || r.key() != rule.key() {
+			rules = append(rules, r)
+		}
+	}
+	s.Rules = rules
+	pending := []Item{}
+	for _, it := range s.Pending {
+		if !rule.MatchesItem(it) {
+			pending = append(pending, it)
+		}
+	}
+	decided := len(s.Pending) - len(pending)
+	s.Pending = pending
+	return decided, q.save(s)
+}
+
+// key identifies what a rule decides within its scope: the artist's name,
+// ignoring case, or the album's ID
+func (r Rule) key() string {
+	if r.Scope == ScopeAlbum {
+		return string(r.AlbumID)
+	}
+	return strings.ToLower(r.Artist)
+}
+
+// Rules returns the artist and album rules recorded, newest first
+func (q *Queue) Rules() ([]Rule, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s, err := q.load()
+	if err != nil {
+		return nil, err
+	}
+	return s.Rules, nil
+}
+
+// ForgetRule drops the rule recorded for an artist's name or an album's ID,
+// depending on scope, so their tracks are queued again. Returns false if
+// there was none.
+func (q *Queue) ForgetRule(scope Scope, key string) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s, err := q.load()
+	if err != nil {
+		return false, err
+	}
+	forgotten := Rule{Scope: scope, Artist: key, AlbumID: spotify.ID(key)}
+	rules := []Rule{}
+	for _, r := range s.Rules {
+		if r.Scope != scope || r.key() != forgotten.key() {
+			rules = append(rules, r)
+		}
+	}
+	if len(rules) == len(s.Rules) {
+		return false, nil
+	}
+	s.Rules = rules
+	return true, q.save(s)
+}
+
+// Forget drops the decision recorded for a track, so it's queued again the
+// next time it's found a duplicate. Returns false if there was none.
+func (q *Queue) Forget(trackID spotify.ID) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s, err := q.load()
+	if err != nil {
+		return false, err
+	}
+	if _, ok := s.Verdicts[trackID]; !ok {
+		return false, nil
+	}
+	delete(s.Verdicts, trackID)
+	return true, q.save(s)
+}
+
+func (q *Queue) load() (*state, error) {
+	s := &state{Pending: []Item{}, Verdicts: map[spotify.ID]Verdict{}}
+	bytes, err := ioutil.ReadFile(q.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bytes, s); err != nil {
+		return nil, err
+	}
+	if s.Verdicts == nil {
+		s.Verdicts = map[spotify.ID]Verdict{}
+	}
+	return s, nil
+}
+
+func (q *Queue) save(s *state) error {
+	bytes, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(q.path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(q.path, bytes, 0644)
+}
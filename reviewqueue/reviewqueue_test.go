@@ -0,0 +1,155 @@
+package reviewqueue
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"potentials-utils/dedupe"
+	"potentials-utils/spotifytest"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+func duplicate(id spotify.ID, score float64) dedupe.Duplicate {
+	return duplicateOn(id, "Album", "Artist", score)
+}
+
+func duplicateOn(id spotify.ID, album, artist string, score float64) dedupe.Duplicate {
+	return dedupe.Duplicate{
+		Track:       spotify.PlaylistTrack{Track: spotifytest.Track(string(id), "Song", album, artist)},
+		MatchResult: dedupe.MatchResult{Matcher: "metadata", Reason: "same name", Score: score},
+	}
+}
+
+func TestQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reviewqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q := NewQueue(filepath.Join(dir, "review-queue.json"))
+
+	if err := q.Enqueue("potentials", []dedupe.Duplicate{duplicate("t1", 0.7), duplicate("t2", 0.6)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Enqueue("potentials", []dedupe.Duplicate{duplicate("t1", 0.7)}); err != nil {
+		t.Fatal(err)
+	}
+	pending, err := q.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0].TrackID != "t1" || pending[0].Score != 0.7 {
+		t.Fatalf("expected t1 and t2 queued once each, got %v", pending)
+	}
+
+	if err := q.Decide("t1", Remove); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Decide("t2", Keep); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Decide("t3", Keep); !errors.Is(err, ErrNotQueued) {
+		t.Errorf("expected ErrNotQueued deciding a track not queued, got %v", err)
+	}
+	if pending, _ := q.Pending(); len(pending) != 0 {
+		t.Errorf("expected decided tracks taken out of the queue, got %v", pending)
+	}
+	testCases := []struct {
+		name     string
+		track    spotify.ID
+		reviewed bool
+		remove   bool
+	}{
+		{name: "denied", track: "t1", reviewed: true, remove: true},
+		{name: "allowed", track: "t2", reviewed: true, remove: false},
+		{name: "never queued", track: "t3", reviewed: false, remove: false},
+	}
+	for _, tc := range testCases {
+		reviewed, remove, err := q.Reviewed(spotifytest.Track(string(tc.track), "Song", "Album", "Artist"))
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		if reviewed != tc.reviewed || remove != tc.remove {
+			t.Errorf("%s failed: expected reviewed %t and remove %t, got %t and %t", tc.name, tc.reviewed, tc.remove, reviewed, remove)
+		}
+	}
+
+	if forgotten, err := q.Forget("t2"); err != nil || !forgotten {
+		t.Fatalf("expected t2's decision forgotten, got %t, %v", forgotten, err)
+	}
+	if reviewed, _, _ := q.Reviewed(spotifytest.Track("t2", "Song", "Album", "Artist")); reviewed {
+		t.Errorf("expected t2 unreviewed once forgotten")
+	}
+}
+
+func TestRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reviewqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q := NewQueue(filepath.Join(dir, "review-queue.json"))
+	queued := []dedupe.Duplicate{
+		duplicateOn("a1", "First", "Band", 0.7),
+		duplicateOn("a2", "First", "Band", 0.7),
+		duplicateOn("b1", "Second", "Band", 0.7),
+		duplicateOn("c1", "Third", "Singer", 0.7),
+	}
+	if err := q.Enqueue("potentials", queued); err != nil {
+		t.Fatal(err)
+	}
+
+	rule, decided, err := q.DecideAll("a1", Keep, ScopeAlbum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decided != 2 || rule.String() != "every track on First" {
+		t.Errorf("expected both tracks on First decided, got %d by %s", decided, rule)
+	}
+	if _, decided, err = q.DecideAll("b1", Remove, ScopeArtist); err != nil || decided != 1 {
+		t.Errorf("expected the one track left by Band decided, got %d, %v", decided, err)
+	}
+	if pending, _ := q.Pending(); len(pending) != 1 || pending[0].TrackID != "c1" {
+		t.Errorf("expected only c1 left in the queue, got %v", pending)
+	}
+	if _, _, err := q.DecideAll("a1", Keep, ScopeAlbum); !errors.Is(err, ErrNotQueued) {
+		t.Errorf("expected ErrNotQueued deciding a track decided by a rule, got %v", err)
+	}
+
+	testCases := []struct {
+		name     string
+		track    spotify.FullTrack
+		reviewed bool
+		remove   bool
+	}{
+		{name: "album rule over artist rule", track: spotifytest.Track("a3", "Song", "First", "Band"), reviewed: true, remove: false},
+		{name: "artist rule", track: spotifytest.Track("d1", "Song", "Fourth", "Singer", "band"), reviewed: true, remove: true},
+		{name: "no rule", track: spotifytest.Track("c2", "Song", "Third", "Singer"), reviewed: false, remove: false},
+	}
+	for _, tc := range testCases {
+		reviewed, remove, err := q.Reviewed(tc.track)
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		if reviewed != tc.reviewed || remove != tc.remove {
+			t.Errorf("%s failed: expected reviewed %t and remove %t, got %t and %t", tc.name, tc.reviewed, tc.remove, reviewed, remove)
+		}
+	}
+
+	if _, err := q.AddRule(Rule{Scope: ScopeArtist, Artist: "BAND", Decision: Keep}); err != nil {
+		t.Fatal(err)
+	}
+	if rules, _ := q.Rules(); len(rules) != 2 || rules[0].Decision != Keep {
+		t.Errorf("expected the new Band rule to replace the old, got %v", rules)
+	}
+	if forgotten, err := q.ForgetRule(ScopeAlbum, "first"); err != nil || !forgotten {
+		t.Fatalf("expected the rule for First forgotten, got %t, %v", forgotten, err)
+	}
+	if forgotten, _ := q.ForgetRule(ScopeAlbum, "first"); forgotten {
+		t.Errorf("expected nothing left to forget for First")
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"potentials-utils/cleanreport"
+	"potentials-utils/dedupe"
+	"potentials-utils/metrics"
+	"potentials-utils/preflight"
+	"potentials-utils/progress"
+	"potentials-utils/sentry"
+	"potentials-utils/spotifyauth"
+	"potentials-utils/spotifyclient"
+	"potentials-utils/tracing"
+
+	"github.com/apex/log"
+	"github.com/zmb3/spotify/v2"
+)
+
+// runOptions are the flags of the clean and serve subcommands
+type runOptions struct {
+	cfgPath   string
+	dryRun    bool
+	force     bool
+	offset    int
+	offline   bool
+	readOnly  bool
+	maxCalls  int64
+	logTarget string
+	progress  string
+	// interactive asks before removing each duplicate
+	interactive bool
+	// reportFormat, if set, is the format of the report of every decision
+	// written to reportFile
+	reportFormat string
+	reportFile   string
+	// serve runs the server rather than a clean
+	serve bool
+}
+
+// commonFlags defines the flags shared by clean and serve on fs
+func (o *runOptions) commonFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.cfgPath, "config", configPath, "path to potentials-utils config file")
+	fs.BoolVar(&o.readOnly, "read-only", false, "refuse every call which would modify Spotify, even when not in dry-run mode")
+	fs.Var(&LevelValue{Level: &logLevel}, "verbosity", "sets application verbosity [0-3] (default 1)")
+	fs.StringVar(&o.logTarget, "log-target", "stderr", "where logs are written: stderr or journald")
+	fs.StringVar(&o.progress, "progress", "", "how progress is reported: bar, log, json (to stderr) or none (default bar, or log when serving)")
+}
+
+// cleanFlags defines the flags only clean has on fs
+func (o *runOptions) cleanFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&o.dryRun, "dry-run", dryRun, "prints tracks that would be deleted from Potentials instead of removing them if true")
+	fs.BoolVar(&o.force, "force", false, "cleans even if neither the playlist nor the library have changed since the last clean")
+	fs.IntVar(&o.offset, "offset", 0, "playlist offset to start cleaning from, e.g. to resume an incomplete clean")
+	fs.BoolVar(&o.interactive, "interactive", false, "ask whether to keep or remove each duplicate, or every track by its artist, before removing any")
+	fs.BoolVar(&o.offline, "offline", false, "never call the Spotify API, dry-run cleaning against the cached library and the playlist cached by the last online clean")
+	fs.Int64Var(&o.maxCalls, "max-api-calls", 0, "stop reading from Spotify after this many API calls, still cleaning the duplicates found so far, unlimited if 0")
+	fs.StringVar(&o.reportFormat, "report-format", "", "write what was decided for every duplicate as json, csv or text, e.g. to review a dry run")
+	fs.StringVar(&o.reportFile, "report-file", "", "file the report is written to (default clean-report.<format>)")
+}
+
+// runClean cleans the Potentials playlist once
+func runClean(args []string) error {
+	o := &runOptions{}
+	fs := flag.NewFlagSet("clean", flag.ExitOnError)
+	o.commonFlags(fs)
+	o.cleanFlags(fs)
+	fs.Parse(args)
+	return o.run()
+}
+
+// runServe runs potentials-utils as an HTTP server
+func runServe(args []string) error {
+	o := &runOptions{serve: true}
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	o.commonFlags(fs)
+	fs.Parse(args)
+	return o.run()
+}
+
+// run sets up for a clean or the server as described by o, then runs it
+func (o *runOptions) run() error {
+	ctx := context.Background()
+	if err := setLogTarget(o.logTarget); err != nil {
+		return fmt.Errorf("failed to set log target %s: %w", o.logTarget, err)
+	}
+	log.SetLevel(logLevel)
+	log.WithFields(log.Fields{"level": logLevel}).Info("logging level")
+	if o.reportFormat != "" {
+		// Better to find out before a long clean than after
+		if err := cleanreport.CheckFormat(o.reportFormat); err != nil {
+			return err
+		}
+	}
+
+	config, err := loadConfig(o.cfgPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config file %s: %w", o.cfgPath, err)
+	}
+	if o.progress == "" {
+		// There's no terminal to draw a bar on in server mode
+		o.progress = "bar"
+		if o.serve {
+			o.progress = "log"
+		}
+	}
+	if config.Cache.Progress, err = progress.New(o.progress, os.Stderr); err != nil {
+		return err
+	}
+	rand.Seed(time.Now().UTC().UnixNano())
+	var exporter *tracing.Exporter
+	if config.Tracing.Endpoint != "" {
+		exporter = tracing.NewExporter(config.Tracing)
+		tracing.SetExporter(exporter)
+	}
+
+	if o.serve && o.maxCalls > 0 {
+		return errors.New("--max-api-calls can't be used when serving")
+	}
+	usage := &spotifyclient.Usage{Max: o.maxCalls}
+	retrier, err := spotifyclient.NewRetrier(config.Spotify.Retry)
+	if err != nil {
+		return fmt.Errorf("invalid spotify.retry config: %w", err)
+	}
+	if o.serve {
+		// Only the server exposes the metrics of cleans, caches and API calls
+		config.Cache.Metrics = metrics.NewRegistry()
+	}
+	playlistCache := spotifyclient.NewPlaylistCache(path.Join(config.Cache.CacheDir, "playlists"))
+	auditLog := newAuditLog(config)
+	config.Cache.Audit = auditLog
+	var auth *spotifyauth.Authenticator
+	var client spotifyclient.API
+	if o.offline {
+		if o.serve {
+			return errors.New("--offline can't be used when serving")
+		}
+		if !o.dryRun {
+			fmt.Println("Running offline, forcing dry-run mode.")
+			o.dryRun = true
+		}
+		config.Cache.AllowStale = true
+		client = spotifyclient.NewOffline(playlistCache)
+	} else {
+		var scopes []string
+		if o.serve {
+			// The server's player endpoints control playback
+			scopes = playerScopes
+		}
+		auth = spotifyauth.New(config.Spotify.AuthConfig(auditLog), config.Scopes(!o.dryRun && !o.readOnly, scopes...)...)
+		if _, err := auth.AuthenticateWithServer(ctx, serverAddr); err != nil {
+			return fmt.Errorf("failed to authenticate with Spotify: %w", err)
+		}
+		client = spotifyclient.WithPlaylistCache(spotifyclient.Audited(spotifyclient.New(retrier.HTTPClient(usage.HTTPClient(auth.HTTPClient(), config.Cache.Metrics))), auditLog), playlistCache, config.Cache.Metrics)
+		client = spotifyclient.Coalesce(spotifyclient.WithEntityCache(client, newEntityCache(config)))
+		playlists, err := config.Spotify.CleanPlaylists(ctx, client)
+		if err != nil {
+			return err
+		}
+		checks := preflight.Run(ctx, client, preflightOptions(config, auth, playlists, o.dryRun || o.readOnly || config.ReadOnly))
+		if err := preflight.Failed(checks); err != nil {
+			log.WithFields(log.Fields{"err": err}).Error("Spotify access is missing, run `potentials-utils doctor` for details")
+			return err
+		}
+	}
+	config.Cache.WarmUp = o.serve && config.Server.WarmUp
+	if o.readOnly || config.ReadOnly {
+		log.Info("read-only mode, Spotify will not be modified")
+		client = spotifyclient.ReadOnly(client)
+	}
+	cleaner, err := newCleaner(ctx, config, client)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err, "spotifyAPICalls": usage.Calls()}).Error("failed to set up cleaning")
+		return err
+	}
+
+	if o.serve {
+		var reporter *sentry.Client
+		if config.Sentry.DSN != "" {
+			if reporter, err = sentry.New(config.Sentry); err != nil {
+				return fmt.Errorf("invalid sentry config: %w", err)
+			}
+		}
+		if err := config.Schedule.Validate(); err != nil {
+			return fmt.Errorf("invalid schedule config: %w", err)
+		}
+		if _, err := newNotifier(config); err != nil {
+			return fmt.Errorf("invalid notify config: %w", err)
+		}
+		log.Info("Server UP")
+		srv := newServer(config, auth, client, cleaner, usage, retrier, reporter)
+		return srv.ListenAndServe()
+	}
+	queue := newReviewQueue(config)
+	cleaner.Reviews = queue
+	cleaner.Prompt = promptRemove(queue)
+	cleaner.Interactive = o.interactive
+	cleaner.ConfirmAnomaly = confirmAnomaly
+	return o.clean(config, client, cleaner, usage, retrier, exporter)
+}
+
+// clean cleans every playlist configured in turn, reporting how each went,
+// and stops at the first which fails
+func (o *runOptions) clean(config *PotentialsUtilsConfig, client spotifyclient.API, cleaner *dedupe.Cleaner, usage *spotifyclient.Usage, retrier *spotifyclient.Retrier, exporter *tracing.Exporter) error {
+	if o.dryRun {
+		fmt.Println("Running cleanPotentials in dry-run mode. No tracks will be deleted from your playlist.")
+	}
+	playlists, err := config.Spotify.CleanPlaylists(context.Background(), client)
+	if err != nil {
+		return err
+	}
+	if o.offset > 0 && len(playlists) > 1 {
+		return errors.New("--offset can't be used cleaning more than one playlist")
+	}
+	var recorder *cleanreport.Recorder
+	if o.reportFormat != "" {
+		recorder = &cleanreport.Recorder{}
+		cleaner.Decisions = recorder
+	}
+	logger := log.WithFields(log.Fields{"runID": newRequestID()})
+	total := dedupe.Result{Skipped: true, DryRun: o.dryRun}
+	for _, id := range playlists {
+		var cleaned dedupe.Result
+		cleaned, err = o.cleanPlaylist(logger.WithFields(log.Fields{"playlist": id}), cleaner, id, len(playlists) > 1)
+		total.Add(cleaned)
+		if err != nil {
+			break
+		}
+	}
+	if recorder != nil {
+		// Whatever was decided before a failure is still worth reviewing
+		if reportErr := o.writeReport(recorder); reportErr != nil {
+			log.WithFields(log.Fields{"err": reportErr}).Error("failed to write the clean report")
+			if err == nil {
+				err = reportErr
+			}
+		}
+	}
+	shutdownTracing(exporter)
+	pushRunMetrics(config, total, err, usage.Calls(), retrier.Retries())
+	if retries := retrier.Retries(); retries > 0 {
+		fmt.Printf("Made %d Spotify API calls, %d of them retries.\n", usage.Calls(), retries)
+	} else {
+		fmt.Printf("Made %d Spotify API calls.\n", usage.Calls())
+	}
+	if errors.Is(err, spotifyclient.ErrBudgetExceeded) {
+		fmt.Printf("Stopped reading from Spotify after the --max-api-calls budget of %d calls ran out.\n", o.maxCalls)
+	}
+	if err == nil && len(playlists) > 1 {
+		fmt.Printf("%d tracks removed across %d playlists.\n", total.Removed, len(playlists))
+	}
+	return err
+}
+
+// writeReport writes every decision recorded to the report file
+func (o *runOptions) writeReport(recorder *cleanreport.Recorder) error {
+	name := o.reportFile
+	if name == "" {
+		name = "clean-report." + o.reportFormat
+		if o.reportFormat == "text" {
+			name = "clean-report.txt"
+		}
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	entries := recorder.Entries()
+	if err := cleanreport.Write(f, o.reportFormat, entries); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote what was decided for %d duplicates to %s.\n", len(entries), name)
+	return nil
+}
+
+// cleanPlaylist cleans one playlist and reports how it went, prefixed with
+// the playlist's ID if named
+func (o *runOptions) cleanPlaylist(logger log.Interface, cleaner *dedupe.Cleaner, playlistID spotify.ID, named bool) (dedupe.Result, error) {
+	ctx := log.NewContext(context.Background(), logger)
+	var cleaned dedupe.Result
+	var err error
+	if o.force || o.offset > 0 {
+		cleaned, err = cleaner.CleanFrom(ctx, playlistID, o.offset, o.dryRun)
+	} else {
+		cleaned, err = cleaner.CleanChanged(ctx, playlistID, o.dryRun)
+	}
+	if named {
+		fmt.Printf("%s: ", playlistID)
+	}
+	if err != nil {
+		if cleaned.PagesScanned > 0 && !cleaned.Complete {
+			fmt.Println(cleaned.Summary())
+			if !named {
+				fmt.Printf("Rerun with -offset %d to resume.\n", cleaned.ResumeOffset)
+			}
+		} else {
+			fmt.Println(err)
+		}
+		logger.WithFields(log.Fields{"err": err}).Error("failed to clean the playlist")
+		return cleaned, err
+	}
+	if cleaned.Skipped {
+		fmt.Println("Playlist unchanged since the last clean, rerun with --force to clean anyway.")
+		return cleaned, nil
+	}
+	logger.WithFields(log.Fields{"result": cleaned}).Info("removed tracks from the playlist")
+	fmt.Println(cleaned.Summary())
+	return cleaned, nil
+}
+
+// runAuth authenticates with Spotify and reports who as and with which
+// permissions, so the OAuth flow can be run on its own, e.g. when setting up,
+// storing the token for later runs
+func runAuth(args []string) error {
+	if len(args) > 0 && args[0] == "status" {
+		return runAuthStatus(args[1:])
+	}
+	fs := flag.NewFlagSet("auth", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	reset := fs.Bool("reset", false, "forget the stored token and authorize again")
+	fs.Parse(args)
+
+	log.SetLevel(logLevel)
+	config, err := loadConfig(*cfgPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config file %s: %w", *cfgPath, err)
+	}
+	// Enough for every command but the player's, so the token stored
+	// needn't be authorized again
+	auth := spotifyauth.New(config.Spotify.AuthConfig(newAuditLog(config)), config.Scopes(true, libraryModifyScopes...)...)
+	if *reset {
+		if err := auth.Forget(); err != nil {
+			return fmt.Errorf("failed to forget the stored token: %w", err)
+		}
+	}
+	ctx := context.Background()
+	client, err := auth.AuthenticateWithServer(ctx, serverAddr)
+	if err != nil {
+		return fmt.Errorf("failed to authenticate with Spotify: %w", err)
+	}
+	user, err := client.CurrentUser(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to look up the current user: %w", err)
+	}
+	fmt.Printf("Authenticated as %s (%s)\n", user.DisplayName, user.ID)
+	granted := map[string]bool{}
+	for _, s := range auth.GrantedScopes() {
+		granted[s] = true
+	}
+	for _, s := range auth.Scopes() {
+		if len(granted) > 0 && !granted[s] {
+			fmt.Printf("Not granted %s, run auth again and approve every permission.\n", s)
+		}
+	}
+	return nil
+}
+
+// runAuthStatus reports whether the stored token works, when it expires, the
+// scopes granted with it and who it authenticates as, without ever running
+// the OAuth flow, so permission problems can be looked into without a clean
+func runAuthStatus(args []string) error {
+	fs := flag.NewFlagSet("auth status", flag.ExitOnError)
+	cfgPath := configFlag(fs)
+	fs.Parse(args)
+
+	log.SetLevel(logLevel)
+	config, err := loadConfig(*cfgPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config file %s: %w", *cfgPath, err)
+	}
+	auth := spotifyauth.New(config.Spotify.AuthConfig(newAuditLog(config)), config.Scopes(true, libraryModifyScopes...)...)
+	status, err := auth.Status(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to read the stored token: %w", err)
+	}
+	fmt.Printf("Token file: %s\n", config.Spotify.TokenFile)
+	if !status.Stored {
+		return errors.New("no stored token, run auth to authorize potentials-utils")
+	}
+	if status.Valid {
+		fmt.Printf("Valid, expires %s (in %s)\n", status.Expiry.Format(time.RFC3339), time.Until(status.Expiry).Round(time.Second))
+	} else {
+		fmt.Printf("Invalid: %v\n", status.Err)
+	}
+	if status.Granted == nil {
+		fmt.Println("Granted scopes: unknown")
+	} else {
+		fmt.Printf("Granted scopes: %s\n", strings.Join(status.Granted, " "))
+	}
+	for _, s := range status.Missing {
+		fmt.Printf("Not granted %s, run auth again and approve every permission.\n", s)
+	}
+	if !status.Valid {
+		return errors.New("the stored token no longer works, run auth -reset to authorize again")
+	}
+	fmt.Printf("Authenticated as %s (%s)\n", status.User.DisplayName, status.User.ID)
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"potentials-utils/dedupe"
+	"potentials-utils/demo"
+	"potentials-utils/library"
+	"potentials-utils/spotifyclient"
+	"potentials-utils/spotifytest"
+
+	"github.com/apex/log"
+)
+
+// demoSeed seeds the demo library so every demo run is the same
+const demoSeed = 1
+
+// runDemo cleans a generated Potentials playlist against a generated library,
+// both served from memory, to show what potentials-utils does without
+// connecting a Spotify account
+func runDemo() {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	planted := demo.Populate(srv, demoSeed)
+	cacheDir, err := ioutil.TempDir("", "potentials-utils-demo")
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Fatal("failed to create demo cache dir")
+	}
+	defer os.RemoveAll(cacheDir)
+
+	fmt.Printf("Demo library: %d saved tracks.\n", planted.LibraryTracks)
+	fmt.Printf("Demo Potentials playlist: %d tracks, including %d saved tracks, %d remasters, %d re-releases and %d compilation appearances of saved tracks.\n\n",
+		planted.PlaylistTracks, planted.SameID, planted.Remasters, planted.SameMetadata, planted.Compilations)
+
+	client := spotifyclient.New(srv.HTTPClient())
+	libraryService, err := library.NewLibraryService(client, library.CacheConfig{CacheDir: cacheDir, Lifetime: time.Hour})
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Fatal("failed to index the demo library")
+	}
+	pipeline, err := dedupe.NewRegistry().Pipeline(demo.Matchers)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Fatal("invalid demo matchers")
+	}
+	policy, err := dedupe.NewPolicy(dedupe.PolicyConfig{})
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Fatal("invalid demo policy")
+	}
+	cleaner := dedupe.NewCleaner(client, libraryService, pipeline, policy, nil)
+	cleaner.Metadata = client
+	cleaned, err := cleaner.Clean(context.Background(), demo.PlaylistID, dryRun)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Fatal("demo clean failed")
+	}
+	fmt.Printf("\nDemo finished: found %d duplicates in %d tracks, the playlist now has %d tracks.\n",
+		cleaned.DuplicatesFound, cleaned.TracksScanned, len(srv.PlaylistTrackIDs(demo.PlaylistID)))
+	fmt.Println("Nothing in your Spotify account was touched. Point --config at your own config.yaml to clean your real Potentials playlist.")
+}
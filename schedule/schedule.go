@@ -0,0 +1,190 @@
+// Package schedule works out when cron-style schedules next come round and
+// runs jobs on them, so the server can clean and refresh by itself.
+package schedule
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// Schedule says when a job next runs
+type Schedule interface {
+	// Next returns the first time the job runs after after, or the zero time
+	// if it never does
+	Next(after time.Time) time.Time
+}
+
+// descriptors are the cron expressions the @ shorthands stand for
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse parses a schedule: a five field cron expression of minute, hour, day
+// of month, month and day of week, e.g. "30 */6 * * 1-5", one of the
+// shorthands @yearly, @monthly, @weekly, @daily and @hourly, or "@every d"
+// for every duration d, e.g. "@every 90m". Cron expressions are in local
+// time.
+func Parse(expr string) (Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if strings.HasPrefix(expr, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(expr, "@every ")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %w", expr, err)
+		}
+		if d < time.Minute {
+			return nil, fmt.Errorf("invalid schedule %q: must be at least a minute apart", expr)
+		}
+		return every(d), nil
+	}
+	if e, ok := descriptors[expr]; ok {
+		expr = e
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q: expected 5 fields, got %d", expr, len(fields))
+	}
+	c := &cron{}
+	var err error
+	for ix, f := range []struct {
+		set      *uint64
+		min, max int
+	}{{&c.minutes, 0, 59}, {&c.hours, 0, 23}, {&c.days, 1, 31}, {&c.months, 1, 12}, {&c.weekdays, 0, 7}} {
+		if *f.set, err = parseField(fields[ix], f.min, f.max); err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %w", expr, err)
+		}
+	}
+	// 7 is Sunday as well as 0
+	if c.weekdays&(1<<7) != 0 {
+		c.weekdays |= 1
+	}
+	c.anyDay, c.anyWeekday = strings.HasPrefix(fields[2], "*"), strings.HasPrefix(fields[4], "*")
+	return c, nil
+}
+
+// parseField parses a comma separated list of values, ranges like 1-5, and
+// steps like */15 or 0-30/10 into a set of values between min and max
+func parseField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if ix := strings.Index(part, "/"); ix >= 0 {
+			n, err := strconv.Atoi(part[ix+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			step, part = n, part[:ix]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid range %q", part)
+				}
+			} else if step > 1 {
+				// 5/15 counts from 5 to the end of the range
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// cron is a parsed cron expression, each field a set of the values it
+// matches
+type cron struct {
+	minutes, hours, days, months, weekdays uint64
+	// anyDay and anyWeekday are true if the day of month or week was *, as
+	// when both are restricted either may match
+	anyDay, anyWeekday bool
+}
+
+// maxSearch is how far ahead Next looks before giving up on expressions
+// which never match, like the 31st of February
+const maxSearch = 5 * 366 * 24 * time.Hour
+
+func (c *cron) Next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(maxSearch)
+	for t.Before(limit) {
+		switch {
+		case c.months&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hours&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minutes&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// dayMatches returns whether t's day of month and day of week match
+func (c *cron) dayMatches(t time.Time) bool {
+	day := c.days&(1<<uint(t.Day())) != 0
+	weekday := c.weekdays&(1<<uint(t.Weekday())) != 0
+	if !c.anyDay && !c.anyWeekday {
+		return day || weekday
+	}
+	return day && weekday
+}
+
+// every is a schedule running at a fixed interval
+type every time.Duration
+
+func (e every) Next(after time.Time) time.Time {
+	return after.Add(time.Duration(e))
+}
+
+// Run calls run each time sched comes round, each run delayed by a random
+// amount up to jitter so many installs don't all call Spotify at once, until
+// ctx is done or sched never comes round again. name identifies the job in
+// logs.
+func Run(ctx context.Context, name string, sched Schedule, jitter time.Duration, run func(ctx context.Context)) {
+	for {
+		next := sched.Next(time.Now())
+		if next.IsZero() {
+			log.WithFields(log.Fields{"job": name}).Warn("schedule never comes round again, stopping")
+			return
+		}
+		if jitter > 0 {
+			next = next.Add(time.Duration(rand.Int63n(int64(jitter))))
+		}
+		log.WithFields(log.Fields{"job": name, "next": next}).Info("scheduled next run")
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		run(ctx)
+	}
+}
@@ -0,0 +1,44 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	// A Friday
+	after := time.Date(2021, 1, 1, 10, 30, 15, 0, time.UTC)
+	testCases := []struct {
+		name     string
+		expr     string
+		expected time.Time
+	}{
+		{name: "every minute", expr: "* * * * *", expected: time.Date(2021, 1, 1, 10, 31, 0, 0, time.UTC)},
+		{name: "step of hours", expr: "0 */6 * * *", expected: time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)},
+		{name: "list of minutes", expr: "15,45 * * * *", expected: time.Date(2021, 1, 1, 10, 45, 0, 0, time.UTC)},
+		{name: "range of weekdays", expr: "0 9 * * 1-5", expected: time.Date(2021, 1, 4, 9, 0, 0, 0, time.UTC)},
+		{name: "sunday as 7", expr: "0 0 * * 7", expected: time.Date(2021, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{name: "day of month or week", expr: "0 0 15 * 6", expected: time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{name: "next month", expr: "0 0 1 2 *", expected: time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "daily", expr: "@daily", expected: time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{name: "every", expr: "@every 90m", expected: time.Date(2021, 1, 1, 12, 0, 15, 0, time.UTC)},
+		{name: "never", expr: "0 0 31 2 *", expected: time.Time{}},
+	}
+	for _, tc := range testCases {
+		sched, err := Parse(tc.expr)
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		if next := sched.Next(after); !next.Equal(tc.expected) {
+			t.Errorf("%s failed: expected %s, got %s", tc.name, tc.expected, next)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "0 0 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *", "@every 10s", "@every soon", "@fortnightly"} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("expected %q to be invalid", expr)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+// Package selfupdate replaces the running potentials-utils binary with the
+// latest release published on GitHub, after verifying its checksum and,
+// when a release signing key is configured, the signature of the checksums.
+package selfupdate
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultRepo is the GitHub repository releases are fetched from
+	DefaultRepo = "paulangton/potentials-utils"
+	// DefaultAPIURL is the root of the GitHub API
+	DefaultAPIURL = "https://api.github.com"
+	// checksumsAsset lists the SHA-256 of every other asset in a release
+	checksumsAsset = "checksums.txt"
+	// signatureAsset is the base64 ed25519 signature of checksumsAsset
+	signatureAsset = "checksums.txt.sig"
+)
+
+// PublicKey is the base64 ed25519 key releases are signed with. Set at build
+// time with -ldflags -X; signatures aren't checked if empty.
+var PublicKey = ""
+
+// ErrUpToDate is returned by Update when the latest release is no newer than
+// the running version
+var ErrUpToDate = errors.New("already up to date")
+
+// Release is a published release of potentials-utils
+type Release struct {
+	Tag    string  `json:"tag_name"`
+	Assets []Asset `json:"assets"`
+}
+
+// Asset is a file attached to a release
+type Asset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+}
+
+// asset returns the release asset with the given name
+func (r *Release) asset(name string) (Asset, bool) {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a, true
+		}
+	}
+	return Asset{}, false
+}
+
+// AssetName is the name of the release asset built for the given platform,
+// e.g. potentials-utils_linux_amd64
+func AssetName(goos, goarch string) string {
+	return fmt.Sprintf("potentials-utils_%s_%s", goos, goarch)
+}
+
+// Updater fetches releases and installs them
+type Updater struct {
+	// Repo is the GitHub repository releases are fetched from, defaults to
+	// DefaultRepo
+	Repo string
+	// APIURL is the root of the GitHub API, defaults to DefaultAPIURL
+	APIURL string
+	// PublicKey verifies release signatures, signatures aren't checked if
+	// nil
+	PublicKey ed25519.PublicKey
+	// Current is the version of the running binary
+	Current string
+	// Force installs the latest release even if it isn't newer than Current
+	Force bool
+
+	client *http.Client
+}
+
+// New creates an Updater for the running binary at version current, using
+// the release signing key in PublicKey if set
+func New(current string) (*Updater, error) {
+	u := &Updater{
+		Repo:    DefaultRepo,
+		APIURL:  DefaultAPIURL,
+		Current: current,
+		client:  &http.Client{Timeout: 5 * time.Minute},
+	}
+	if PublicKey != "" {
+		key, err := base64.StdEncoding.DecodeString(PublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid release public key")
+		}
+		u.PublicKey = key
+	}
+	return u, nil
+}
+
+// Latest returns the latest published release
+func (u *Updater) Latest() (*Release, error) {
+	body, err := u.fetch(fmt.Sprintf("%s/repos/%s/releases/latest", strings.TrimRight(u.APIURL, "/"), u.Repo))
+	if err != nil {
+		return nil, err
+	}
+	r := &Release{}
+	if err := json.Unmarshal(body, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// NeedsUpdate returns true if release r should replace the running version
+func (u *Updater) NeedsUpdate(r *Release) bool {
+	if u.Force {
+		return true
+	}
+	return newer(r.Tag, u.Current)
+}
+
+// Update replaces the binary at exe with the latest release for this
+// platform. Returns the release installed, or ErrUpToDate.
+func (u *Updater) Update(exe string) (*Release, error) {
+	r, err := u.Latest()
+	if err != nil {
+		return nil, err
+	}
+	if !u.NeedsUpdate(r) {
+		return r, ErrUpToDate
+	}
+	name := AssetName(runtime.GOOS, runtime.GOARCH)
+	binary, ok := r.asset(name)
+	if !ok {
+		return nil, fmt.Errorf("release %s has no build for %s/%s", r.Tag, runtime.GOOS, runtime.GOARCH)
+	}
+	sums, err := u.checksums(r)
+	if err != nil {
+		return nil, err
+	}
+	expected, ok := sums[name]
+	if !ok {
+		return nil, fmt.Errorf("release %s has no checksum for %s", r.Tag, name)
+	}
+	b, err := u.fetch(binary.URL)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(b)
+	if got := hex.EncodeToString(sum[:]); got != expected {
+		return nil, fmt.Errorf("checksum mismatch for %s: expected %s, got %s", name, expected, got)
+	}
+	if err := replace(exe, b); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// checksums fetches and, if a public key is set, verifies the release's
+// checksums, keyed by asset name
+func (u *Updater) checksums(r *Release) (map[string]string, error) {
+	a, ok := r.asset(checksumsAsset)
+	if !ok {
+		return nil, fmt.Errorf("release %s has no %s", r.Tag, checksumsAsset)
+	}
+	b, err := u.fetch(a.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.PublicKey != nil {
+		sigAsset, ok := r.asset(signatureAsset)
+		if !ok {
+			return nil, fmt.Errorf("release %s is not signed", r.Tag)
+		}
+		encoded, err := u.fetch(sigAsset.URL)
+		if err != nil {
+			return nil, err
+		}
+		sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid signature: %v", err)
+		}
+		if !ed25519.Verify(u.PublicKey, b, sig) {
+			return nil, fmt.Errorf("release %s has a bad signature", r.Tag)
+		}
+	}
+	return parseChecksums(b), nil
+}
+
+// parseChecksums parses sha256sum output, "<hex>  <name>" per line
+func parseChecksums(b []byte) map[string]string {
+	sums := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 {
+			sums[strings.TrimPrefix(fields[1], "*")] = strings.ToLower(fields[0])
+		}
+	}
+	return sums
+}
+
+func (u *Updater) fetch(url string) ([]byte, error) {
+	client := u.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("GET %s: %s: %s", url, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// replace atomically swaps the file at exe for b, keeping its permissions
+func replace(exe string, b []byte) error {
+	info, err := os.Stat(exe)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(exe), ".potentials-utils-update-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), exe)
+}
+
+// newer returns true if version a is a newer semantic version than b. A b
+// which isn't a release version, such as "dev", is never older.
+func newer(a, b string) bool {
+	va, okA := parseVersion(a)
+	vb, okB := parseVersion(b)
+	if !okA || !okB {
+		return false
+	}
+	for ix := range va {
+		if va[ix] != vb[ix] {
+			return va[ix] > vb[ix]
+		}
+	}
+	return false
+}
+
+// parseVersion parses "v1.2.3" into its numeric parts, ignoring any
+// pre-release or build suffix
+func parseVersion(v string) ([3]int, bool) {
+	var parts [3]int
+	v = strings.TrimPrefix(v, "v")
+	if ix := strings.IndexAny(v, "-+"); ix >= 0 {
+		v = v[:ix]
+	}
+	fields := strings.Split(v, ".")
+	if len(fields) != 3 {
+		return parts, false
+	}
+	for ix, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			return parts, false
+		}
+		parts[ix] = n
+	}
+	return parts, true
+}
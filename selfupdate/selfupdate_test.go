@@ -0,0 +1,121 @@
+package selfupdate
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// newReleaseServer serves a latest release tagged tag containing binary, with
+// checksums signed by priv if it's non-nil
+func newReleaseServer(t *testing.T, tag string, binary []byte, checksum string, priv ed25519.PrivateKey) *httptest.Server {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	name := AssetName(runtime.GOOS, runtime.GOARCH)
+	if checksum == "" {
+		sum := sha256.Sum256(binary)
+		checksum = hex.EncodeToString(sum[:])
+	}
+	checksums := []byte(fmt.Sprintf("%s  %s\n", checksum, name))
+	release := Release{Tag: tag, Assets: []Asset{
+		{Name: name, URL: srv.URL + "/download/" + name},
+		{Name: checksumsAsset, URL: srv.URL + "/download/" + checksumsAsset},
+	}}
+	if priv != nil {
+		release.Assets = append(release.Assets, Asset{Name: signatureAsset, URL: srv.URL + "/download/" + signatureAsset})
+		mux.HandleFunc("/download/"+signatureAsset, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(base64.StdEncoding.EncodeToString(ed25519.Sign(priv, checksums))))
+		})
+	}
+	mux.HandleFunc("/repos/"+DefaultRepo+"/releases/latest", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(release)
+	})
+	mux.HandleFunc("/download/"+name, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(binary)
+	})
+	mux.HandleFunc("/download/"+checksumsAsset, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(checksums)
+	})
+	return srv
+}
+
+func TestUpdate(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPriv, _ := ed25519.GenerateKey(nil)
+	testCases := []struct {
+		name        string
+		current     string
+		tag         string
+		checksum    string
+		signWith    ed25519.PrivateKey
+		expectErr   bool
+		expectNewer bool
+	}{
+		{name: "newer signed release is installed", current: "v1.0.0", tag: "v1.1.0", signWith: priv, expectNewer: true},
+		{name: "same version is up to date", current: "v1.1.0", tag: "v1.1.0", signWith: priv, expectErr: true},
+		{name: "bad checksum is rejected", current: "v1.0.0", tag: "v1.1.0", checksum: "00", signWith: priv, expectErr: true},
+		{name: "bad signature is rejected", current: "v1.0.0", tag: "v1.1.0", signWith: otherPriv, expectErr: true},
+		{name: "unsigned release is rejected", current: "v1.0.0", tag: "v1.1.0", expectErr: true},
+	}
+	for _, tc := range testCases {
+		srv := newReleaseServer(t, tc.tag, []byte("new binary"), tc.checksum, tc.signWith)
+		dir, err := ioutil.TempDir("", "selfupdate")
+		if err != nil {
+			t.Fatal(err)
+		}
+		exe := filepath.Join(dir, "potentials-utils")
+		if err := ioutil.WriteFile(exe, []byte("old binary"), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		u := &Updater{Repo: DefaultRepo, APIURL: srv.URL, PublicKey: pub, Current: tc.current}
+		_, err = u.Update(exe)
+		if tc.expectErr && err == nil {
+			t.Errorf("%s failed: expected an error", tc.name)
+		}
+		if !tc.expectErr && err != nil {
+			t.Errorf("%s failed: %v", tc.name, err)
+		}
+		b, _ := ioutil.ReadFile(exe)
+		if got := string(b) == "new binary"; got != tc.expectNewer {
+			t.Errorf("%s failed: expected binary replaced to be %v, got %q", tc.name, tc.expectNewer, b)
+		}
+		if info, err := os.Stat(exe); err != nil || info.Mode().Perm() != 0755 {
+			t.Errorf("%s failed: expected binary to stay executable, got %v %v", tc.name, info, err)
+		}
+		srv.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestNewer(t *testing.T) {
+	testCases := []struct {
+		a, b     string
+		expected bool
+	}{
+		{"v1.2.0", "v1.1.9", true},
+		{"v1.10.0", "v1.9.0", true},
+		{"v1.1.0", "v1.1.0", false},
+		{"v1.0.0", "v1.1.0", false},
+		{"v2.0.0-rc1", "v1.9.9", true},
+		{"v1.0.0", "dev", false},
+	}
+	for _, tc := range testCases {
+		if got := newer(tc.a, tc.b); got != tc.expected {
+			t.Errorf("newer(%q, %q): expected %v, got %v", tc.a, tc.b, tc.expected, got)
+		}
+	}
+}
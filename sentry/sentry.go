@@ -0,0 +1,179 @@
+// Package sentry reports errors and panics to Sentry, or any service which
+// accepts events through Sentry's store API such as GlitchTip.
+package sentry
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// clientName identifies potentials-utils to Sentry
+const clientName = "potentials-utils/1.0"
+
+// Config configures error reporting
+type Config struct {
+	// DSN is the Sentry project's client key URL, e.g.
+	// https://<key>@o0.ingest.sentry.io/<project>. Error reporting is disabled
+	// if empty.
+	DSN string `yaml:"dsn"`
+	// Environment is reported with every event, e.g. production
+	Environment string `yaml:"environment"`
+}
+
+// Client sends events to a Sentry project. A nil *Client discards every event
+// so callers needn't check whether reporting is enabled.
+type Client struct {
+	storeURL    string
+	auth        string
+	environment string
+	serverName  string
+	http        *http.Client
+	wg          sync.WaitGroup
+}
+
+// New creates a Client reporting to the project identified by cfg.DSN
+func New(cfg Config) (*Client, error) {
+	dsn, err := url.Parse(cfg.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sentry DSN: %v", err)
+	}
+	if dsn.User == nil || dsn.User.Username() == "" {
+		return nil, fmt.Errorf("invalid sentry DSN: missing public key")
+	}
+	path := strings.Trim(dsn.Path, "/")
+	ix := strings.LastIndex(path, "/")
+	prefix, project := "", path
+	if ix >= 0 {
+		prefix, project = "/"+path[:ix], path[ix+1:]
+	}
+	if project == "" {
+		return nil, fmt.Errorf("invalid sentry DSN: missing project ID")
+	}
+	hostname, _ := os.Hostname()
+	return &Client{
+		storeURL:    fmt.Sprintf("%s://%s%s/api/%s/store/", dsn.Scheme, dsn.Host, prefix, project),
+		auth:        fmt.Sprintf("Sentry sentry_version=7, sentry_client=%s, sentry_key=%s", clientName, dsn.User.Username()),
+		environment: cfg.Environment,
+		serverName:  hostname,
+		http:        &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// event is the subset of the Sentry event payload potentials-utils sends, see
+// https://develop.sentry.dev/sdk/event-payloads/
+type event struct {
+	EventID     string                 `json:"event_id"`
+	Timestamp   string                 `json:"timestamp"`
+	Level       string                 `json:"level"`
+	Platform    string                 `json:"platform"`
+	Environment string                 `json:"environment,omitempty"`
+	ServerName  string                 `json:"server_name,omitempty"`
+	Tags        map[string]string      `json:"tags,omitempty"`
+	Extra       map[string]interface{} `json:"extra,omitempty"`
+	Exception   struct {
+		Values []exception `json:"values"`
+	} `json:"exception"`
+}
+
+type exception struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// CaptureError reports a non-fatal error with tags describing what was being
+// done when it happened. Returns the ID of the reported event.
+func (c *Client) CaptureError(err error, tags map[string]string) string {
+	if c == nil || err == nil {
+		return ""
+	}
+	return c.capture("error", reflect.TypeOf(err).String(), err.Error(), tags, nil)
+}
+
+// CapturePanic reports a recovered panic value v and the stack it was raised
+// from. Returns the ID of the reported event.
+func (c *Client) CapturePanic(v interface{}, stack []byte, tags map[string]string) string {
+	if c == nil {
+		return ""
+	}
+	return c.capture("fatal", "panic", fmt.Sprint(v), tags, map[string]interface{}{"stack": string(stack)})
+}
+
+// Flush waits up to timeout for events still being sent
+func (c *Client) Flush(timeout time.Duration) {
+	if c == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+func (c *Client) capture(level, typ, value string, tags map[string]string, extra map[string]interface{}) string {
+	e := event{
+		EventID:     newEventID(),
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+		Level:       level,
+		Platform:    "go",
+		Environment: c.environment,
+		ServerName:  c.serverName,
+		Tags:        tags,
+		Extra:       extra,
+	}
+	e.Exception.Values = []exception{{Type: typ, Value: value}}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		if err := c.send(e); err != nil {
+			log.WithFields(log.Fields{"eventID": e.EventID, "err": err}).Warn("failed to report error to sentry")
+		}
+	}()
+	return e.EventID
+}
+
+func (c *Client) send(e event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.storeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", c.auth)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("sentry: POST %s: %s: %s", c.storeURL, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func newEventID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
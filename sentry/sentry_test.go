@@ -0,0 +1,98 @@
+package sentry
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	testCases := []struct {
+		name             string
+		dsn              string
+		expectedStoreURL string
+		expectErr        bool
+	}{
+		{
+			name:             "sentry.io DSN",
+			dsn:              "https://abc123@o1.ingest.sentry.io/42",
+			expectedStoreURL: "https://o1.ingest.sentry.io/api/42/store/",
+		},
+		{
+			name:             "self-hosted DSN with a path prefix",
+			dsn:              "http://abc123@localhost:9000/sentry/7",
+			expectedStoreURL: "http://localhost:9000/sentry/api/7/store/",
+		},
+		{
+			name:      "missing key",
+			dsn:       "https://o1.ingest.sentry.io/42",
+			expectErr: true,
+		},
+		{
+			name:      "missing project",
+			dsn:       "https://abc123@o1.ingest.sentry.io/",
+			expectErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		c, err := New(Config{DSN: tc.dsn})
+		if tc.expectErr {
+			if err == nil {
+				t.Errorf("%s failed: expected an error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s failed: %v", tc.name, err)
+			continue
+		}
+		if c.storeURL != tc.expectedStoreURL {
+			t.Errorf("%s failed: expected store URL %s, got %s", tc.name, tc.expectedStoreURL, c.storeURL)
+		}
+	}
+}
+
+func TestCaptureError(t *testing.T) {
+	events := make(chan event, 1)
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("X-Sentry-Auth")
+		var e event
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Error(err)
+		}
+		events <- e
+	}))
+	defer srv.Close()
+
+	c, err := New(Config{DSN: strings.Replace(srv.URL, "http://", "http://key@", 1) + "/1", Environment: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := c.CaptureError(errors.New("boom"), map[string]string{"playlist": "p1"})
+	c.Flush(time.Second)
+
+	e := <-events
+	if e.EventID != id || e.Level != "error" || e.Environment != "test" || e.Tags["playlist"] != "p1" {
+		t.Errorf("unexpected event %+v", e)
+	}
+	if len(e.Exception.Values) != 1 || e.Exception.Values[0].Value != "boom" {
+		t.Errorf("expected exception boom, got %+v", e.Exception.Values)
+	}
+	if !strings.Contains(auth, "sentry_key=key") {
+		t.Errorf("expected auth header with key, got %q", auth)
+	}
+}
+
+func TestNilClient(t *testing.T) {
+	var c *Client
+	if id := c.CaptureError(errors.New("ignored"), nil); id != "" {
+		t.Errorf("expected nil client to discard events, got ID %s", id)
+	}
+	c.CapturePanic("ignored", nil, nil)
+	c.Flush(time.Second)
+}
@@ -0,0 +1,873 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"potentials-utils/bulkadd"
+	"potentials-utils/dedupe"
+	"potentials-utils/jobs"
+	"potentials-utils/library"
+	"potentials-utils/notify"
+	"potentials-utils/player"
+	"potentials-utils/reviewqueue"
+	"potentials-utils/schedule"
+	"potentials-utils/sentry"
+	"potentials-utils/spotifyauth"
+	"potentials-utils/spotifyclient"
+	"potentials-utils/throughput"
+	"potentials-utils/version"
+
+	"github.com/apex/log"
+	"github.com/zmb3/spotify/v2"
+)
+
+// serverAddr is the address the potentials-utils HTTP server, and the one-off
+// auth server, listen on
+const serverAddr = ":8080"
+
+// server serves the potentials-utils HTTP API
+type server struct {
+	config  *PotentialsUtilsConfig
+	auth    *spotifyauth.Authenticator
+	client  spotifyclient.API
+	cleaner *dedupe.Cleaner
+	jobs    *jobs.Queue
+	// usage counts the Spotify API calls made by the server
+	usage *spotifyclient.Usage
+	// retrier retries the server's rate limited and transiently failed
+	// Spotify API calls, nil if they aren't retried
+	retrier *spotifyclient.Retrier
+	// reporter receives errors and panics from jobs, nil if error
+	// reporting is disabled
+	reporter *sentry.Client
+	// expirations counts the times the library index has expired since the
+	// server started
+	expirations int64
+	// reviews is the queue of duplicates waiting for review, shared with
+	// the cleaner
+	reviews *reviewqueue.Queue
+	// notifier is told about every job which finishes, nil if no channels
+	// are configured
+	notifier notify.Notifier
+	// playlists are the playlists cleaned, resolved from the config the
+	// first time they're needed
+	playlists   []spotify.ID
+	playlistsMu sync.Mutex
+}
+
+// cleanPlaylists returns the IDs of the playlists cleaned, looking up those
+// configured by name only once
+func (s *server) cleanPlaylists(ctx context.Context) ([]spotify.ID, error) {
+	s.playlistsMu.Lock()
+	defer s.playlistsMu.Unlock()
+	if s.playlists == nil {
+		playlists, err := s.config.Spotify.CleanPlaylists(ctx, s.client)
+		if err != nil {
+			return nil, err
+		}
+		s.playlists = playlists
+	}
+	return s.playlists, nil
+}
+
+// cleanResult is the result of a clean job, totalled across the playlists
+// cleaned, with each playlist's own result
+type cleanResult struct {
+	dedupe.Result
+	Playlists []playlistResult `json:"playlists"`
+}
+
+// playlistResult is the result of cleaning one of a clean job's playlists
+type playlistResult struct {
+	PlaylistID spotify.ID `json:"playlistID"`
+	dedupe.Result
+}
+
+// Summary describes the result of each playlist cleaned, or just the
+// result if only one was
+func (r cleanResult) Summary() string {
+	if len(r.Playlists) == 1 {
+		return r.Playlists[0].Summary()
+	}
+	summaries := []string{}
+	for _, p := range r.Playlists {
+		summaries = append(summaries, fmt.Sprintf("%s: %s", p.PlaylistID, p.Summary()))
+	}
+	return strings.Join(summaries, " ")
+}
+
+// watchedLibrary is a Library which reports how fresh its index is and can be
+// watched for the index expiring
+type watchedLibrary interface {
+	Status() library.IndexStatus
+	WatchEviction(ctx context.Context, poll time.Duration, expired func(library.IndexStatus))
+}
+
+// warmingLibrary is a Library whose index can be warmed up in the background,
+// which lookups can wait for
+type warmingLibrary interface {
+	Warming() bool
+	WaitFresh(ctx context.Context) error
+}
+
+// refreshableLibrary is a Library whose index can be rebuilt on demand
+type refreshableLibrary interface {
+	Refresh() error
+	Status() library.IndexStatus
+}
+
+// searchableLibrary is a Library which can be searched by track name
+type searchableLibrary interface {
+	Search(query, mode string, limit int) ([]library.SearchResult, error)
+}
+
+// searchResult is a track found by a library search
+type searchResult struct {
+	ID       spotify.ID  `json:"id"`
+	URI      spotify.URI `json:"uri"`
+	Name     string      `json:"name"`
+	Album    string      `json:"album"`
+	Artists  []string    `json:"artists"`
+	AddedAt  string      `json:"addedAt"`
+	Distance int         `json:"distance"`
+}
+
+// defaultSearchLimit is how many results a library search responds with when
+// no limit is given, maxSearchLimit the most it will respond with
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+func newServer(config *PotentialsUtilsConfig, auth *spotifyauth.Authenticator, client spotifyclient.API, cleaner *dedupe.Cleaner, usage *spotifyclient.Usage, retrier *spotifyclient.Retrier, reporter *sentry.Client) *http.Server {
+	s := &server{
+		config:   config,
+		auth:     auth,
+		client:   client,
+		cleaner:  cleaner,
+		jobs:     jobs.NewQueue(config.Server.MaxConcurrentJobs),
+		usage:    usage,
+		retrier:  retrier,
+		reporter: reporter,
+		reviews:  newReviewQueue(config),
+	}
+	cleaner.Reviews = s.reviews
+	if config.Notify.Enabled() {
+		notifier, err := newNotifier(config)
+		if err != nil {
+			log.WithFields(log.Fields{"err": err}).Error("invalid notify config, no notifications will be sent")
+		} else {
+			s.notifier = notifier
+			s.jobs.OnFinish(s.notifyJob)
+		}
+	}
+	// The library is watched for as long as the server runs
+	go s.watchEviction(context.Background())
+	go s.sendDigests(context.Background())
+	go s.runSchedules(context.Background())
+	return &http.Server{
+		Addr:    serverAddr,
+		Handler: withRequestID(s.recoverPanics(s.routes())),
+	}
+}
+
+func (s *server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc(s.auth.CallbackPath(), s.auth.HandleCallback)
+	mux.HandleFunc("/spotify/cleanpotentials", s.HandleCleanPotentials)
+	mux.HandleFunc("/api/v1/potentials/tracks", s.HandleAddPotentials)
+	mux.HandleFunc("/api/v1/library/search", s.HandleLibrarySearch)
+	mux.HandleFunc("/api/v1/player/devices", s.HandlePlayerDevices)
+	mux.HandleFunc("/api/v1/player/play", s.HandlePlayerPlay)
+	mux.HandleFunc("/api/v1/player/pause", s.HandlePlayerPause)
+	mux.HandleFunc("/api/v1/review/duplicates", s.HandleReviewDuplicates)
+	mux.HandleFunc("/jobs", s.HandleJobs)
+	mux.HandleFunc("/jobs/", s.HandleJob)
+	mux.HandleFunc("/version", s.HandleVersion)
+	mux.HandleFunc("/metrics", s.HandleMetrics)
+	mux.HandleFunc("/readyz", s.HandleReady)
+	mux.HandleFunc("/", s.HandleDashboard)
+	return mux
+}
+
+// HandleCleanPotentials queues a cleaning of my Potentials playlist, or of
+// every playlist in spotify.playlists. The clean removes all songs i have
+// already saved in my library from the playlists. Responds with the queued
+// job, which can be polled at /jobs/{id}. An incomplete clean of a single
+// playlist can be resumed by passing the resumeOffset from its result as
+// ?offset=. A clean from the start is skipped if neither the playlist nor the
+// library have changed since the last one, unless ?force=true.
+func (s *server) HandleCleanPotentials(w http.ResponseWriter, r *http.Request) {
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+	force := r.URL.Query().Get("force") == "true"
+	offset := 0
+	if v := r.URL.Query().Get("offset"); v != "" {
+		var err error
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			writeError(w, r, http.StatusBadRequest, "offset must be a non-negative integer")
+			return
+		}
+	}
+	reqLogger := log.FromContext(r.Context())
+	job := s.submitClean(requestID(r), reqLogger, dryRun, force, offset)
+	reqLogger.WithFields(log.Fields{"jobID": job.ID, "queue": s.jobs.Stats()}).Info("queued clean job")
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// submitClean queues a job cleaning each playlist cleaned in turn, from
+// offset if it's non-zero or from the start if forced, otherwise only those
+// whose playlist or library have changed since their last clean. reqID tags
+// errors reported from the job and reqLogger logs it.
+func (s *server) submitClean(reqID string, reqLogger log.Interface, dryRun, force bool, offset int) jobs.Job {
+	return s.jobs.Submit("clean", "playlists", func(ctx context.Context) (result interface{}, err error) {
+		jobID := jobs.IDFromContext(ctx)
+		logger := reqLogger.WithFields(log.Fields{"jobID": jobID})
+		ctx = log.NewContext(ctx, logger)
+		tags := map[string]string{"requestID": reqID, "job": jobID, "dryRun": strconv.FormatBool(dryRun)}
+		defer func() {
+			if v := recover(); v != nil {
+				eventID := s.reporter.CapturePanic(v, debug.Stack(), tags)
+				logger.WithFields(log.Fields{"panic": v, "eventID": eventID}).Error("clean job panicked")
+				result, err = nil, fmt.Errorf("panic: %v", v)
+			}
+		}()
+		playlists, err := s.cleanPlaylists(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if offset > 0 && len(playlists) > 1 {
+			return nil, errors.New("offset can't be used cleaning more than one playlist")
+		}
+		if err := s.awaitLibrary(ctx, "clean"); err != nil {
+			return nil, err
+		}
+		total := cleanResult{Result: dedupe.Result{Skipped: true, DryRun: dryRun, Complete: true}, Playlists: []playlistResult{}}
+		for _, playlistID := range playlists {
+			cleaned, err := s.cleanPlaylist(ctx, playlistID, dryRun, force, offset, tags)
+			total.Add(cleaned)
+			total.Playlists = append(total.Playlists, playlistResult{PlaylistID: playlistID, Result: cleaned})
+			if !cleaned.Complete {
+				total.Complete, total.ResumeOffset = false, cleaned.ResumeOffset
+			}
+			if err != nil {
+				if total.PagesScanned > 0 {
+					return total, err
+				}
+				return nil, err
+			}
+		}
+		return total, nil
+	})
+}
+
+// cleanPlaylist cleans one of a clean job's playlists, logging and reporting
+// the outcome tagged with tags
+func (s *server) cleanPlaylist(ctx context.Context, playlistID spotify.ID, dryRun, force bool, offset int, tags map[string]string) (cleaned dedupe.Result, err error) {
+	logger := log.FromContext(ctx).WithFields(log.Fields{"playlist": playlistID})
+	if force || offset > 0 {
+		cleaned, err = s.cleaner.CleanFrom(ctx, playlistID, offset, dryRun)
+	} else {
+		cleaned, err = s.cleaner.CleanChanged(ctx, playlistID, dryRun)
+	}
+	if err != nil {
+		eventID := ""
+		if ctx.Err() == nil {
+			playlistTags := map[string]string{"playlist": string(playlistID)}
+			for k, v := range tags {
+				playlistTags[k] = v
+			}
+			eventID = s.reporter.CaptureError(err, cleanErrorTags(err, playlistTags))
+		}
+		logger.WithFields(log.Fields{"err": err, "eventID": eventID, "result": cleaned, "spotifyAPICalls": s.usage.Calls()}).Error("error cleaning playlist")
+		return cleaned, err
+	}
+	logger.WithFields(log.Fields{"result": cleaned, "summary": cleaned.Summary(), "spotifyAPICalls": s.usage.Calls()}).Info("successfully cleaned duplicate tracks from the playlist")
+	return cleaned, nil
+}
+
+// addTracksRequest is the body of a request to add tracks to Potentials
+type addTracksRequest struct {
+	// URIs are spotify:track: URIs, open.spotify.com links or track IDs
+	URIs []string `json:"uris"`
+}
+
+// skippedTrack is a track HandleAddPotentials didn't add, and why
+type skippedTrack struct {
+	URI    string `json:"uri"`
+	Reason string `json:"reason"`
+}
+
+// HandleAddPotentials adds the tracks in the request body to Potentials,
+// skipping those which are already saved in the library or in the playlist,
+// and responds with which tracks were added and which were skipped. Nothing is
+// added if ?dryRun=true.
+func (s *server) HandleAddPotentials(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req addTracksRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+	ids, uris := []spotify.ID{}, map[spotify.ID]string{}
+	skipped := []skippedTrack{}
+	for _, uri := range req.URIs {
+		id, ok := bulkadd.ParseTrackID(strings.TrimSpace(uri))
+		if !ok {
+			skipped = append(skipped, skippedTrack{URI: uri, Reason: "not a track"})
+			continue
+		}
+		if _, ok := uris[id]; !ok {
+			ids = append(ids, id)
+			uris[id] = uri
+		}
+	}
+	if err := s.awaitLibrary(r.Context(), "add"); err != nil {
+		writeError(w, r, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	added, err := bulkadd.Add(r.Context(), s.client, s.cleaner.Library(), s.config.Spotify.PotentialsPlaylistID, ids, dryRun)
+	if err != nil {
+		log.FromContext(r.Context()).WithFields(log.Fields{"err": err, "added": len(added.Added)}).Error("error adding tracks to the Potentials playlist")
+		writeError(w, r, http.StatusBadGateway, err.Error())
+		return
+	}
+	for _, id := range added.InLibrary {
+		skipped = append(skipped, skippedTrack{URI: uris[id], Reason: "in library"})
+	}
+	for _, id := range added.InPlaylist {
+		skipped = append(skipped, skippedTrack{URI: uris[id], Reason: "in playlist"})
+	}
+	addedURIs := []string{}
+	for _, id := range added.Added {
+		addedURIs = append(addedURIs, uris[id])
+	}
+	log.FromContext(r.Context()).WithFields(log.Fields{"added": len(addedURIs), "skipped": len(skipped), "dryRun": dryRun}).Info("added tracks to the Potentials playlist")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"added":   addedURIs,
+		"skipped": skipped,
+		"dryRun":  dryRun,
+	})
+}
+
+// HandleLibrarySearch responds with the saved tracks whose names match ?q=,
+// looked up in the local library index. ?mode= is one of exact, prefix (the
+// default) or fuzzy, and ?limit= caps the number of results.
+func (s *server) HandleLibrarySearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	query := r.URL.Query()
+	q := strings.TrimSpace(query.Get("q"))
+	if q == "" {
+		writeError(w, r, http.StatusBadRequest, "q is required")
+		return
+	}
+	mode := query.Get("mode")
+	if mode == "" {
+		mode = library.SearchPrefix
+	}
+	limit := defaultSearchLimit
+	if l := query.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			writeError(w, r, http.StatusBadRequest, "limit must be a positive number")
+			return
+		}
+		limit = n
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+	switch mode {
+	case library.SearchExact, library.SearchPrefix, library.SearchFuzzy:
+	default:
+		writeError(w, r, http.StatusBadRequest, "mode must be one of exact, prefix or fuzzy")
+		return
+	}
+	lib, ok := s.cleaner.Library().(searchableLibrary)
+	if !ok {
+		writeError(w, r, http.StatusNotImplemented, "library can't be searched")
+		return
+	}
+	if err := s.awaitLibrary(r.Context(), "search"); err != nil {
+		writeError(w, r, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	found, err := lib.Search(q, mode, limit)
+	if err != nil {
+		log.FromContext(r.Context()).WithFields(log.Fields{"err": err, "q": q, "mode": mode}).Error("error searching the library")
+		writeError(w, r, http.StatusBadGateway, err.Error())
+		return
+	}
+	results := []searchResult{}
+	for _, f := range found {
+		results = append(results, searchResult{
+			ID:       f.Track.ID,
+			URI:      f.Track.URI,
+			Name:     f.Track.Name,
+			Album:    f.Track.Album.Name,
+			Artists:  library.ArtistNames(f.Track.SimpleTrack),
+			AddedAt:  f.Track.AddedAt,
+			Distance: f.Distance,
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"query":   q,
+		"mode":    mode,
+		"results": results,
+	})
+}
+
+// playRequest is the body of a request to play a track, or with no track to
+// pause
+type playRequest struct {
+	// Track is a spotify:track: URI, open.spotify.com link or track ID
+	Track string `json:"track"`
+	// Device is the ID or name of the device to play on, the active device
+	// if empty
+	Device     string `json:"device"`
+	PositionMs int    `json:"positionMs"`
+}
+
+// HandlePlayerDevices responds with the devices Spotify can play on
+func (s *server) HandlePlayerDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	devices, err := s.client.PlayerDevices(r.Context())
+	if err != nil {
+		writePlayerError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"devices": devices})
+}
+
+// HandlePlayerPlay plays the track in the request body on a device, to
+// audition it, e.g. before deciding what to do with a duplicate
+func (s *server) HandlePlayerPlay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req playRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	trackID, ok := bulkadd.ParseTrackID(strings.TrimSpace(req.Track))
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, "track must be a Spotify track")
+		return
+	}
+	if req.PositionMs < 0 {
+		writeError(w, r, http.StatusBadRequest, "positionMs must be a non-negative integer")
+		return
+	}
+	device, err := player.Play(r.Context(), s.client, req.Device, trackID, req.PositionMs)
+	if err != nil {
+		writePlayerError(w, r, err)
+		return
+	}
+	log.FromContext(r.Context()).WithFields(log.Fields{"track": trackID, "device": device.Name}).Info("playing track")
+	writeJSON(w, http.StatusOK, map[string]interface{}{"track": trackID, "device": device})
+}
+
+// HandlePlayerPause pauses playback on the device in the request body, or
+// the active device if the body is empty or names none
+func (s *server) HandlePlayerPause(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req playRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeError(w, r, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	if err := player.Pause(r.Context(), s.client, req.Device); err != nil {
+		writePlayerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writePlayerError responds with an error from controlling playback
+func writePlayerError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, player.ErrUnknownDevice):
+		writeError(w, r, http.StatusNotFound, err.Error())
+	case errors.Is(err, player.ErrNoDevice):
+		writeError(w, r, http.StatusConflict, err.Error())
+	case errors.Is(err, spotifyclient.ErrReadOnly):
+		writeError(w, r, http.StatusForbidden, err.Error())
+	default:
+		log.FromContext(r.Context()).WithFields(log.Fields{"err": err}).Error("error controlling playback")
+		writeError(w, r, http.StatusBadGateway, err.Error())
+	}
+}
+
+// reviewRequest is the body of a request deciding a queued duplicate, and
+// optionally every track by its artist or on its album
+type reviewRequest struct {
+	Track    string `json:"track"`
+	Decision string `json:"decision"`
+	Scope    string `json:"scope"`
+}
+
+// HandleReviewDuplicates lists the duplicates queued for review and the
+// artist and album rules on GET, and records the decision in the request body
+// for one of them on POST
+func (s *server) HandleReviewDuplicates(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		pending, err := s.reviews.Pending()
+		if err != nil {
+			log.FromContext(r.Context()).WithFields(log.Fields{"err": err}).Error("error reading review queue")
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		rules, err := s.reviews.Rules()
+		if err != nil {
+			log.FromContext(r.Context()).WithFields(log.Fields{"err": err}).Error("error reading review queue")
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"pending": pending, "rules": rules})
+	case http.MethodPost:
+		var req reviewRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid request body: "+err.Error())
+			return
+		}
+		trackID, ok := bulkadd.ParseTrackID(strings.TrimSpace(req.Track))
+		if !ok {
+			writeError(w, r, http.StatusBadRequest, "track must be a Spotify track")
+			return
+		}
+		decision, err := reviewqueue.ParseDecision(req.Decision)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		scope, err := reviewqueue.ParseScope(req.Scope)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		_, decided, err := s.reviews.DecideAll(trackID, decision, scope)
+		if errors.Is(err, reviewqueue.ErrNotQueued) {
+			writeError(w, r, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			log.FromContext(r.Context()).WithFields(log.Fields{"err": err}).Error("error recording review decision")
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		log.FromContext(r.Context()).WithFields(log.Fields{"track": trackID, "decision": decision, "scope": scope, "decided": decided}).Info("reviewed duplicate")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// HandleJobs lists every job known to the server along with queue depth
+// metrics and the number of Spotify API calls made since the server started
+func (s *server) HandleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"stats":           s.jobs.Stats(),
+		"jobs":            s.jobs.List(),
+		"spotifyAPICalls": s.usage.Calls(),
+		"spotifyRetries":  s.retrier.Retries(),
+	})
+}
+
+// HandleJob fetches (GET) or cancels (DELETE) the job at /jobs/{id}
+func (s *server) HandleJob(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	var job jobs.Job
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		job, err = s.jobs.Get(id)
+	case http.MethodDelete:
+		job, err = s.jobs.Cancel(id)
+		if err == nil {
+			log.FromContext(r.Context()).WithFields(log.Fields{"jobID": id}).Info("cancelled job")
+		}
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	switch err {
+	case nil:
+		writeJSON(w, http.StatusOK, job)
+	case jobs.ErrJobNotFound:
+		writeError(w, r, http.StatusNotFound, err.Error())
+	case jobs.ErrJobFinished:
+		writeError(w, r, http.StatusConflict, err.Error())
+	default:
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// HandleVersion responds with the build info of the running server
+func (s *server) HandleVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, version.Get())
+}
+
+// HandleMetrics responds with Potentials throughput metrics, and those of the
+// cleans, Spotify API calls and caches since the server started, in the
+// Prometheus text format
+func (s *server) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	stats, err := potentialsStats(s.config)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := throughput.WriteMetrics(w, stats); err != nil {
+		log.FromContext(r.Context()).WithFields(log.Fields{"err": err}).Error("failed to write metrics")
+		return
+	}
+	if err := s.config.Cache.Metrics.WriteText(w); err != nil {
+		log.FromContext(r.Context()).WithFields(log.Fields{"err": err}).Error("failed to write metrics")
+		return
+	}
+	fmt.Fprintf(w, "# HELP potentials_spotify_retries_total Spotify API calls retried after rate limiting or a transient error since the server started.\n# TYPE potentials_spotify_retries_total counter\npotentials_spotify_retries_total %d\n", s.retrier.Retries())
+	fmt.Fprintf(w, "# HELP potentials_spotify_rate_limited_total Spotify API calls retried after rate limiting since the server started.\n# TYPE potentials_spotify_rate_limited_total counter\npotentials_spotify_rate_limited_total %d\n", s.retrier.RateLimited())
+	lib, ok := s.cleaner.Library().(watchedLibrary)
+	if !ok {
+		return
+	}
+	status := lib.Status()
+	alive := 0
+	if status.Alive {
+		alive = 1
+	}
+	fmt.Fprintf(w, "# HELP potentials_library_index_alive Whether the library index is fresh.\n# TYPE potentials_library_index_alive gauge\npotentials_library_index_alive %d\n", alive)
+	fmt.Fprintf(w, "# HELP potentials_library_index_expires_in_seconds Seconds until the library index expires, negative once it has.\n# TYPE potentials_library_index_expires_in_seconds gauge\npotentials_library_index_expires_in_seconds %d\n", int64(status.ExpiresIn(time.Now()).Seconds()))
+	fmt.Fprintf(w, "# HELP potentials_library_index_expirations_total Times the library index has expired since the server started.\n# TYPE potentials_library_index_expirations_total counter\npotentials_library_index_expirations_total %d\n", atomic.LoadInt64(&s.expirations))
+}
+
+// HandleReady responds with the freshness of the library index, with status
+// 503 if lookups would have to wait for the index to be rebuilt
+func (s *server) HandleReady(w http.ResponseWriter, r *http.Request) {
+	lib, ok := s.cleaner.Library().(watchedLibrary)
+	if !ok {
+		writeJSON(w, http.StatusOK, map[string]interface{}{})
+		return
+	}
+	status := lib.Status()
+	code := http.StatusOK
+	if !status.Usable {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, map[string]interface{}{
+		"library":          status,
+		"expiresInSeconds": int64(status.ExpiresIn(time.Now()).Seconds()),
+	})
+}
+
+// awaitLibrary waits for the library index to warm up, unless endpoint is
+// configured to be served from the stale index meanwhile
+func (s *server) awaitLibrary(ctx context.Context, endpoint string) error {
+	lib, ok := s.cleaner.Library().(warmingLibrary)
+	if !ok || !lib.Warming() || s.config.Server.ServesStale(endpoint) {
+		return nil
+	}
+	if err := lib.WaitFresh(ctx); err != nil {
+		return fmt.Errorf("library index isn't ready: %w", err)
+	}
+	return nil
+}
+
+// watchEviction reports each time the library index expires until ctx is
+// done
+func (s *server) watchEviction(ctx context.Context) {
+	lib, ok := s.cleaner.Library().(watchedLibrary)
+	if !ok {
+		return
+	}
+	lib.WatchEviction(ctx, time.Minute, s.indexExpired)
+}
+
+// sendDigests publishes a digest each time one is due, checking hourly, if
+// digests are configured
+func (s *server) sendDigests(ctx context.Context) {
+	if !s.config.Digest.Enabled() {
+		return
+	}
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if sent, err := publishDueDigest(s.config, time.Now()); err != nil {
+			log.WithFields(log.Fields{"err": err}).Error("failed to send digest")
+		} else if sent {
+			log.Info("sent digest")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runSchedules cleans Potentials and refreshes the library on the configured
+// schedules until ctx is done. Runs are queued as jobs like any other, so
+// they're listed at /jobs and never overlap a clean of the same playlist.
+func (s *server) runSchedules(ctx context.Context) {
+	cfg := s.config.Schedule
+	if cfg.Clean != "" {
+		sched, err := schedule.Parse(cfg.Clean)
+		if err != nil {
+			log.WithFields(log.Fields{"err": err}).Error("invalid clean schedule, Potentials won't be cleaned by schedule")
+		} else {
+			go schedule.Run(ctx, "clean", sched, cfg.Jitter(), s.scheduledClean)
+		}
+	}
+	if cfg.Refresh != "" {
+		sched, err := schedule.Parse(cfg.Refresh)
+		if err != nil {
+			log.WithFields(log.Fields{"err": err}).Error("invalid refresh schedule, the library won't be refreshed by schedule")
+		} else {
+			go schedule.Run(ctx, "refresh", sched, cfg.Jitter(), s.scheduledRefresh)
+		}
+	}
+}
+
+// scheduledClean queues a scheduled clean of Potentials
+func (s *server) scheduledClean(ctx context.Context) {
+	logger := log.WithFields(log.Fields{"scheduled": true})
+	job := s.submitClean("schedule", logger, s.config.Schedule.DryRun, false, 0)
+	logger.WithFields(log.Fields{"jobID": job.ID, "dryRun": s.config.Schedule.DryRun, "queue": s.jobs.Stats()}).Info("queued scheduled clean job")
+}
+
+// scheduledRefresh queues a scheduled rebuild of the library index
+func (s *server) scheduledRefresh(ctx context.Context) {
+	lib, ok := s.cleaner.Library().(refreshableLibrary)
+	if !ok {
+		return
+	}
+	logger := log.WithFields(log.Fields{"scheduled": true})
+	job := s.jobs.Submit("refresh", "library", func(ctx context.Context) (result interface{}, err error) {
+		jobID := jobs.IDFromContext(ctx)
+		logger := logger.WithFields(log.Fields{"jobID": jobID})
+		defer func() {
+			if v := recover(); v != nil {
+				eventID := s.reporter.CapturePanic(v, debug.Stack(), map[string]string{"requestID": "schedule", "job": jobID})
+				logger.WithFields(log.Fields{"panic": v, "eventID": eventID}).Error("refresh job panicked")
+				result, err = nil, fmt.Errorf("panic: %v", v)
+			}
+		}()
+		start := time.Now()
+		if err := lib.Refresh(); err != nil {
+			logger.WithFields(log.Fields{"err": err, "spotifyAPICalls": s.usage.Calls()}).Error("error refreshing the library index")
+			return nil, err
+		}
+		status := lib.Status()
+		logger.WithFields(log.Fields{"tracks": status.Tracks, "took": time.Since(start).String(), "spotifyAPICalls": s.usage.Calls()}).Info("refreshed the library index")
+		return status, nil
+	})
+	logger.WithFields(log.Fields{"jobID": job.ID, "queue": s.jobs.Stats()}).Info("queued scheduled refresh job")
+}
+
+// notifyJob tells the configured channels a job has finished, as an event
+// named by its kind and status, e.g. clean.failed
+func (s *server) notifyJob(j jobs.Job) {
+	e := notify.Event{
+		Name:  j.Kind + "." + string(j.Status),
+		Title: fmt.Sprintf("%s job %s", strings.Title(j.Kind), j.Status),
+		Body:  jobSummary(j),
+		At:    j.FinishedAt,
+		JobID: j.ID,
+	}
+	if j.Error != "" {
+		e.Body = strings.TrimSpace(e.Body + " Error: " + j.Error)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := s.notifier.Notify(ctx, e); err != nil {
+		log.WithFields(log.Fields{"err": err, "event": e.Name, "jobID": j.ID}).Error("failed to send notification")
+	}
+}
+
+// indexExpired logs and counts the library index expiring, and sends the
+// eviction webhook if one is configured
+func (s *server) indexExpired(status library.IndexStatus) {
+	atomic.AddInt64(&s.expirations, 1)
+	logger := log.WithFields(log.Fields{"indexedAt": status.IndexedAt, "expiredAt": status.ExpiresAt, "tracks": status.Tracks})
+	logger.Warn("library index expired, it will be rebuilt on the next lookup")
+	if s.config.Server.EvictionWebhook == "" {
+		return
+	}
+	body, err := json.Marshal(map[string]interface{}{"event": "library.index.expired", "library": status})
+	if err != nil {
+		logger.WithFields(log.Fields{"err": err}).Error("failed to encode eviction webhook")
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(s.config.Server.EvictionWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.WithFields(log.Fields{"err": err}).Error("failed to send eviction webhook")
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logger.WithFields(log.Fields{"status": resp.Status}).Error("eviction webhook failed")
+	}
+}
+
+// cleanErrorTags adds where in the playlist a clean failed to tags, and
+// whether it was held back as an anomaly
+func cleanErrorTags(err error, tags map[string]string) map[string]string {
+	var ce *dedupe.CleanError
+	if !errors.As(err, &ce) {
+		return tags
+	}
+	withContext := map[string]string{}
+	for k, v := range tags {
+		withContext[k] = v
+	}
+	if errors.Is(err, dedupe.ErrAnomalous) {
+		withContext["anomaly"] = "true"
+	}
+	if ce.Page > 0 {
+		withContext["page"] = strconv.Itoa(ce.Page)
+	}
+	if ce.TrackID != "" {
+		withContext["track"] = string(ce.TrackID)
+	}
+	return withContext
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("failed to write JSON response")
+	}
+}
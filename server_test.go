@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"potentials-utils/dedupe"
+	"potentials-utils/jobs"
+	"potentials-utils/library"
+	"potentials-utils/reviewqueue"
+	"potentials-utils/spotifyclient"
+	"potentials-utils/spotifytest"
+
+	"github.com/apex/log"
+	"github.com/zmb3/spotify/v2"
+)
+
+func TestHandleAddPotentials(t *testing.T) {
+	const (
+		saved  = "0000000000000000saved0"
+		queued = "000000000000000queued0"
+		fresh  = "0000000000000000fresh0"
+	)
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	srv.AddSavedTracks(spotifytest.Track(saved, "Saved", "Album", "Artist"))
+	srv.AddPlaylist("potentials", "Potentials", spotifytest.Track(queued, "Queued", "Album", "Artist"))
+	dir, err := ioutil.TempDir("", "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := spotifyclient.New(srv.HTTPClient())
+	lib, err := library.NewLibraryService(client, library.CacheConfig{CacheDir: dir, Lifetime: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := dedupe.NewRegistry().Pipeline([]dedupe.MatcherConfig{{Name: "id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := dedupe.NewPolicy(dedupe.PolicyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{
+		config:  &PotentialsUtilsConfig{Spotify: SpotifyConfig{PotentialsPlaylistID: "potentials"}},
+		client:  client,
+		cleaner: dedupe.NewCleaner(client, lib, pipeline, policy, nil),
+	}
+
+	testCases := []struct {
+		name          string
+		method        string
+		query         string
+		body          string
+		expectedCode  int
+		expectedAdded int
+		expectedTotal int
+	}{
+		{name: "wrong method", method: http.MethodGet, expectedCode: http.StatusMethodNotAllowed, expectedTotal: 1},
+		{name: "bad body", method: http.MethodPost, body: "uris", expectedCode: http.StatusBadRequest, expectedTotal: 1},
+		{
+			name:          "dry run",
+			method:        http.MethodPost,
+			query:         "?dryRun=true",
+			body:          `{"uris": ["spotify:track:` + fresh + `"]}`,
+			expectedCode:  http.StatusOK,
+			expectedAdded: 1,
+			expectedTotal: 1,
+		},
+		{
+			name:          "skips duplicates",
+			method:        http.MethodPost,
+			body:          `{"uris": ["spotify:track:` + saved + `", "https://open.spotify.com/track/` + queued + `?si=x", "spotify:album:x", "spotify:track:` + fresh + `"]}`,
+			expectedCode:  http.StatusOK,
+			expectedAdded: 1,
+			expectedTotal: 2,
+		},
+		{
+			name:          "already added",
+			method:        http.MethodPost,
+			body:          `{"uris": ["spotify:track:` + fresh + `"]}`,
+			expectedCode:  http.StatusOK,
+			expectedTotal: 2,
+		},
+	}
+	for _, tc := range testCases {
+		rec := httptest.NewRecorder()
+		s.HandleAddPotentials(rec, httptest.NewRequest(tc.method, "/api/v1/potentials/tracks"+tc.query, strings.NewReader(tc.body)))
+		if rec.Code != tc.expectedCode {
+			t.Errorf("%s failed: expected status %d, got %d: %s", tc.name, tc.expectedCode, rec.Code, rec.Body)
+			continue
+		}
+		if got := len(srv.PlaylistTrackIDs("potentials")); got != tc.expectedTotal {
+			t.Errorf("%s failed: expected %d tracks in the playlist, got %d", tc.name, tc.expectedTotal, got)
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+		var body struct {
+			Added   []string       `json:"added"`
+			Skipped []skippedTrack `json:"skipped"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		if len(body.Added) != tc.expectedAdded {
+			t.Errorf("%s failed: expected %d added, got %+v", tc.name, tc.expectedAdded, body)
+		}
+		if tc.name == "skips duplicates" && (len(body.Skipped) != 3 || body.Skipped[0].Reason != "not a track" || body.Skipped[1].Reason != "in library" || body.Skipped[2].Reason != "in playlist") {
+			t.Errorf("%s failed: expected the album, saved and queued tracks skipped, got %+v", tc.name, body.Skipped)
+		}
+	}
+}
+
+func TestHandleLibrarySearch(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	srv.AddSavedTracks(
+		spotifytest.Track("t1", "Holocene", "Bon Iver", "Bon Iver"),
+		spotifytest.Track("t2", "Hold On", "Album", "Artist"),
+	)
+	dir, err := ioutil.TempDir("", "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := spotifyclient.New(srv.HTTPClient())
+	lib, err := library.NewLibraryService(client, library.CacheConfig{CacheDir: dir, Lifetime: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := dedupe.NewRegistry().Pipeline([]dedupe.MatcherConfig{{Name: "id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := dedupe.NewPolicy(dedupe.PolicyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{cleaner: dedupe.NewCleaner(client, lib, pipeline, policy, nil)}
+
+	testCases := []struct {
+		name         string
+		method       string
+		query        string
+		expectedCode int
+		expectedIDs  []string
+	}{
+		{name: "wrong method", method: http.MethodPost, query: "?q=Hol", expectedCode: http.StatusMethodNotAllowed},
+		{name: "no query", method: http.MethodGet, expectedCode: http.StatusBadRequest},
+		{name: "bad mode", method: http.MethodGet, query: "?q=Hol&mode=regex", expectedCode: http.StatusBadRequest},
+		{name: "bad limit", method: http.MethodGet, query: "?q=Hol&limit=none", expectedCode: http.StatusBadRequest},
+		{name: "prefix by default", method: http.MethodGet, query: "?q=Hol", expectedCode: http.StatusOK, expectedIDs: []string{"t2", "t1"}},
+		{name: "limit", method: http.MethodGet, query: "?q=Hol&limit=1", expectedCode: http.StatusOK, expectedIDs: []string{"t2"}},
+		{name: "exact", method: http.MethodGet, query: "?q=Holocene&mode=exact", expectedCode: http.StatusOK, expectedIDs: []string{"t1"}},
+		{name: "fuzzy", method: http.MethodGet, query: "?q=holocine&mode=fuzzy", expectedCode: http.StatusOK, expectedIDs: []string{"t1"}},
+		{name: "no match", method: http.MethodGet, query: "?q=Nothing", expectedCode: http.StatusOK, expectedIDs: []string{}},
+	}
+	for _, tc := range testCases {
+		rec := httptest.NewRecorder()
+		s.HandleLibrarySearch(rec, httptest.NewRequest(tc.method, "/api/v1/library/search"+tc.query, nil))
+		if rec.Code != tc.expectedCode {
+			t.Errorf("%s failed: expected status %d, got %d: %s", tc.name, tc.expectedCode, rec.Code, rec.Body)
+			continue
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+		var body struct {
+			Results []searchResult `json:"results"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		ids := []string{}
+		for _, r := range body.Results {
+			ids = append(ids, string(r.ID))
+		}
+		if strings.Join(ids, ",") != strings.Join(tc.expectedIDs, ",") {
+			t.Errorf("%s failed: expected %v, got %v", tc.name, tc.expectedIDs, ids)
+		}
+	}
+}
+
+func TestSubmitCleanPlaylists(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	saved := spotifytest.Track("saved", "Saved", "Album", "Artist")
+	srv.AddSavedTracks(saved)
+	srv.AddPlaylist("potentials", "Potentials", saved, spotifytest.Track("new", "New", "Album", "Artist"))
+	srv.AddPlaylist("discover", "Discover", saved, saved)
+	dir, err := ioutil.TempDir("", "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := spotifyclient.New(srv.HTTPClient())
+	lib, err := library.NewLibraryService(client, library.CacheConfig{CacheDir: dir, Lifetime: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := dedupe.NewRegistry().Pipeline([]dedupe.MatcherConfig{{Name: "id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := dedupe.NewPolicy(dedupe.PolicyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleaner := dedupe.NewCleaner(client, lib, pipeline, policy, nil)
+	cleaner.Out = ioutil.Discard
+	cleaner.History = dedupe.NewFileCleanHistory(filepath.Join(dir, "history.json"))
+	s := &server{
+		config:  &PotentialsUtilsConfig{Spotify: SpotifyConfig{Playlists: []string{"Potentials", "Discover"}}},
+		client:  client,
+		cleaner: cleaner,
+		jobs:    jobs.NewQueue(1),
+		usage:   &spotifyclient.Usage{},
+	}
+
+	s.submitClean("test", log.Log, false, false, 0)
+	s.jobs.Wait()
+	job := s.jobs.List()[0]
+	result, ok := job.Result.(cleanResult)
+	if job.Status != jobs.StatusSucceeded || !ok {
+		t.Fatalf("expected the clean to succeed, got %+v", job)
+	}
+	if result.Removed != 3 || len(result.Playlists) != 2 || result.Playlists[0].PlaylistID != "potentials" || result.Playlists[0].Removed != 1 || result.Playlists[1].Removed != 2 {
+		t.Errorf("expected 1 duplicate removed from potentials and 2 from discover, got %+v", result)
+	}
+	if !strings.Contains(jobSummary(job), "discover: ") {
+		t.Errorf("expected the summary to break the result down by playlist, got %q", jobSummary(job))
+	}
+	d, err := s.dashboard(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.LastCleans) != 2 || d.LastCleans[0].Record == nil || d.LastCleans[1].Record == nil {
+		t.Errorf("expected the last clean of both playlists on the dashboard, got %+v", d.LastCleans)
+	}
+
+	s.submitClean("test", log.Log, false, false, 10)
+	s.jobs.Wait()
+	if job := s.jobs.List()[1]; job.Status != jobs.StatusFailed {
+		t.Errorf("expected resuming from an offset refused for two playlists, got %+v", job)
+	}
+}
+
+// panickingLibrary is a library whose refreshes panic
+type panickingLibrary struct {
+	dedupe.Library
+}
+
+func (panickingLibrary) Refresh() error {
+	panic("boom")
+}
+
+func (panickingLibrary) Status() library.IndexStatus {
+	return library.IndexStatus{}
+}
+
+func TestScheduledRefreshRecoversPanics(t *testing.T) {
+	pipeline, err := dedupe.NewRegistry().Pipeline([]dedupe.MatcherConfig{{Name: "id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := dedupe.NewPolicy(dedupe.PolicyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{
+		cleaner: dedupe.NewCleaner(nil, panickingLibrary{}, pipeline, policy, nil),
+		jobs:    jobs.NewQueue(1),
+	}
+	s.scheduledRefresh(context.Background())
+	s.jobs.Wait()
+
+	list := s.jobs.List()
+	if len(list) != 1 || list[0].Status != jobs.StatusFailed || list[0].Error != "panic: boom" {
+		t.Errorf("expected the refresh job to fail with the panic, got %+v", list)
+	}
+}
+
+func TestHandlePlayer(t *testing.T) {
+	const track = "0000000000000000track0"
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	client := spotifyclient.New(srv.HTTPClient())
+	s := &server{client: client}
+
+	testCases := []struct {
+		name           string
+		handler        http.HandlerFunc
+		method         string
+		body           string
+		expectedCode   int
+		expectedDevice spotify.ID
+	}{
+		{name: "no devices", handler: s.HandlePlayerPlay, method: http.MethodPost, body: `{"track": "spotify:track:` + track + `"}`, expectedCode: http.StatusConflict},
+		{name: "unknown device", handler: s.HandlePlayerPlay, method: http.MethodPost, body: `{"track": "` + track + `", "device": "Kitchen"}`, expectedCode: http.StatusNotFound},
+		{name: "not a track", handler: s.HandlePlayerPlay, method: http.MethodPost, body: `{"track": "spotify:album:x", "device": "Laptop"}`, expectedCode: http.StatusBadRequest},
+		{name: "wrong method", handler: s.HandlePlayerDevices, method: http.MethodPost, expectedCode: http.StatusMethodNotAllowed},
+		{name: "devices", handler: s.HandlePlayerDevices, method: http.MethodGet, expectedCode: http.StatusOK},
+		{name: "play by name", handler: s.HandlePlayerPlay, method: http.MethodPost, body: `{"track": "https://open.spotify.com/track/` + track + `", "device": "laptop", "positionMs": 30000}`, expectedCode: http.StatusOK, expectedDevice: "laptop1"},
+		{name: "pause the active device", handler: s.HandlePlayerPause, method: http.MethodPost, expectedCode: http.StatusNoContent, expectedDevice: "laptop1"},
+	}
+	for _, tc := range testCases {
+		if tc.name == "unknown device" {
+			srv.AddDevice(spotify.PlayerDevice{ID: "phone1", Name: "Phone"})
+			srv.AddDevice(spotify.PlayerDevice{ID: "laptop1", Name: "Laptop"})
+		}
+		rec := httptest.NewRecorder()
+		tc.handler(rec, httptest.NewRequest(tc.method, "/api/v1/player", strings.NewReader(tc.body)))
+		if rec.Code != tc.expectedCode {
+			t.Errorf("%s failed: expected status %d, got %d: %s", tc.name, tc.expectedCode, rec.Code, rec.Body)
+			continue
+		}
+		if tc.expectedDevice == "" {
+			continue
+		}
+		playing := srv.Playing()
+		if playing == nil || playing.DeviceID != tc.expectedDevice || playing.TrackID != track || playing.PositionMs != 30000 {
+			t.Errorf("%s failed: expected %s playing on %s from 30s, got %+v", tc.name, track, tc.expectedDevice, playing)
+		}
+		if tc.name == "pause the active device" && !playing.Paused {
+			t.Errorf("%s failed: expected playback paused", tc.name)
+		}
+	}
+	s.client = spotifyclient.ReadOnly(client)
+	rec := httptest.NewRecorder()
+	s.HandlePlayerPlay(rec, httptest.NewRequest(http.MethodPost, "/api/v1/player/play", strings.NewReader(`{"track": "`+track+`"}`)))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected status %d playing in read-only mode, got %d", http.StatusForbidden, rec.Code)
+	}
+}
+
+func TestHandleReviewDuplicates(t *testing.T) {
+	const track = "0000000000000000track0"
+	dir, err := ioutil.TempDir("", "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := &server{reviews: reviewqueue.NewQueue(filepath.Join(dir, "review-queue.json"))}
+	d := dedupe.Duplicate{Track: spotify.PlaylistTrack{Track: spotifytest.Track(track, "Song", "Album", "Artist")}}
+	if err := s.reviews.Enqueue("potentials", []dedupe.Duplicate{d}); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name         string
+		method       string
+		body         string
+		expectedCode int
+	}{
+		{name: "list", method: http.MethodGet, expectedCode: http.StatusOK},
+		{name: "not a track", method: http.MethodPost, body: `{"track": "spotify:album:x", "decision": "keep"}`, expectedCode: http.StatusBadRequest},
+		{name: "unknown decision", method: http.MethodPost, body: `{"track": "` + track + `", "decision": "maybe"}`, expectedCode: http.StatusBadRequest},
+		{name: "unknown scope", method: http.MethodPost, body: `{"track": "` + track + `", "decision": "keep", "scope": "label"}`, expectedCode: http.StatusBadRequest},
+		{name: "decide", method: http.MethodPost, body: `{"track": "spotify:track:` + track + `", "decision": "remove"}`, expectedCode: http.StatusNoContent},
+		{name: "already decided", method: http.MethodPost, body: `{"track": "` + track + `", "decision": "keep"}`, expectedCode: http.StatusNotFound},
+		{name: "wrong method", method: http.MethodDelete, expectedCode: http.StatusMethodNotAllowed},
+	}
+	for _, tc := range testCases {
+		rec := httptest.NewRecorder()
+		s.HandleReviewDuplicates(rec, httptest.NewRequest(tc.method, "/api/v1/review/duplicates", strings.NewReader(tc.body)))
+		if rec.Code != tc.expectedCode {
+			t.Errorf("%s failed: expected status %d, got %d: %s", tc.name, tc.expectedCode, rec.Code, rec.Body)
+		}
+		if tc.name == "list" && !strings.Contains(rec.Body.String(), track) {
+			t.Errorf("%s failed: expected %s pending, got %s", tc.name, track, rec.Body)
+		}
+	}
+	if reviewed, remove, err := s.reviews.Reviewed(d.Track.Track); err != nil || !reviewed || !remove {
+		t.Errorf("expected %s judged a duplicate, got %t, %t, %v", track, reviewed, remove, err)
+	}
+}
+
+func TestHandleDashboard(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	srv.AddSavedTracks(spotifytest.Track("saved", "Saved", "Album", "Artist"))
+	dir, err := ioutil.TempDir("", "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := spotifyclient.New(srv.HTTPClient())
+	lib, err := library.NewLibraryService(client, library.CacheConfig{CacheDir: dir, Lifetime: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := dedupe.NewRegistry().Pipeline([]dedupe.MatcherConfig{{Name: "id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := dedupe.NewPolicy(dedupe.PolicyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleaner := dedupe.NewCleaner(client, lib, pipeline, policy, nil)
+	cleaner.History = dedupe.NewFileCleanHistory(filepath.Join(dir, "history.json"))
+	s := &server{
+		config:  &PotentialsUtilsConfig{Spotify: SpotifyConfig{PotentialsPlaylistID: "potentials"}, Schedule: ScheduleConfig{Clean: "@daily"}},
+		client:  client,
+		cleaner: cleaner,
+		jobs:    jobs.NewQueue(1),
+		usage:   &spotifyclient.Usage{},
+	}
+
+	rec := httptest.NewRecorder()
+	s.HandleDashboard(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Never cleaned") {
+		t.Errorf("expected a dashboard of a playlist never cleaned, got %d: %s", rec.Code, rec.Body)
+	}
+
+	result := dedupe.Result{Removed: 3, TracksScanned: 40, DuplicatesFound: 3, MatchedByID: 3, Complete: true}
+	if err := cleaner.History.RecordClean("potentials", dedupe.CleanRecord{CleanedAt: time.Now(), Result: &result}); err != nil {
+		t.Fatal(err)
+	}
+	job := s.jobs.Submit("clean", "potentials", func(ctx context.Context) (interface{}, error) {
+		return dedupe.Result{DryRun: true, TracksScanned: 40, Complete: true}, nil
+	})
+	s.jobs.Wait()
+	rec = httptest.NewRecorder()
+	s.HandleDashboard(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	body := rec.Body.String()
+	for _, expected := range []string{"1 tracks", result.Summary(), job.ID, "0 would have been removed", "<code>@daily</code>"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected the dashboard to show %q, got %s", expected, body)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	s.HandleDashboard(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected POSTs refused, got %d", rec.Code)
+	}
+}
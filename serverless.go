@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"potentials-utils/dedupe"
+	"potentials-utils/progress"
+	"potentials-utils/serverless"
+	"potentials-utils/spotifyauth"
+	"potentials-utils/spotifyclient"
+	"potentials-utils/tracing"
+
+	"github.com/apex/log"
+	"github.com/zmb3/spotify/v2"
+)
+
+// Environment variables a serverless clean is configured by. Anything else
+// can be set in POTENTIALS_CONFIG, which holds a whole YAML config.
+const (
+	envConfig        = "POTENTIALS_CONFIG"
+	envSpotifyID     = "POTENTIALS_SPOTIFY_ID"
+	envSpotifySecret = "POTENTIALS_SPOTIFY_SECRET"
+	envRefreshToken  = "POTENTIALS_SPOTIFY_REFRESH_TOKEN"
+	envPlaylistID    = "POTENTIALS_PLAYLIST_ID"
+	envCacheDir      = "POTENTIALS_CACHE_DIR"
+	envDryRun        = "POTENTIALS_DRY_RUN"
+)
+
+// serverlessEvent is what a serverless clean may be invoked with, e.g. from a
+// test invocation. Scheduled invocations' events are ignored.
+type serverlessEvent struct {
+	// DryRun overrides POTENTIALS_DRY_RUN
+	DryRun *bool `json:"dryRun"`
+	// Force cleans even if nothing has changed since the last clean
+	Force bool `json:"force"`
+}
+
+// configFromEnv builds the config of a serverless clean from the environment:
+// the YAML config in POTENTIALS_CONFIG, if any, overridden by the other
+// variables. The cache defaults to a directory in the system's temporary
+// directory, the only one a Lambda function can write to.
+func configFromEnv() (*PotentialsUtilsConfig, error) {
+	config, err := parseConfig([]byte(os.Getenv(envConfig)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", envConfig, err)
+	}
+	if id := os.Getenv(envSpotifyID); id != "" {
+		config.Spotify.ID = id
+	}
+	if secret := os.Getenv(envSpotifySecret); secret != "" {
+		config.Spotify.Secret = secret
+	}
+	if id := os.Getenv(envPlaylistID); id != "" {
+		config.Spotify.PotentialsPlaylistID = spotify.ID(id)
+		config.Spotify.Playlists = nil
+	}
+	if dir := os.Getenv(envCacheDir); dir != "" {
+		config.Cache.CacheDir = dir
+	} else if config.Cache.CacheDir == "" {
+		config.Cache.CacheDir = filepath.Join(os.TempDir(), "potentials-utils")
+	}
+	config.Spotify.TokenFile = path.Join(config.Cache.CacheDir, tokenFile)
+	if config.Spotify.ID == "" || config.Spotify.Secret == "" {
+		return nil, fmt.Errorf("%s and %s are required", envSpotifyID, envSpotifySecret)
+	}
+	if os.Getenv(envRefreshToken) == "" {
+		return nil, fmt.Errorf("%s is required, run auth and copy the refresh token from %s", envRefreshToken, tokenFile)
+	}
+	if config.Spotify.PotentialsPlaylistID == "" && len(config.Spotify.Playlists) == 0 {
+		return nil, fmt.Errorf("%s is required", envPlaylistID)
+	}
+	return config, nil
+}
+
+// serverlessClean cleans every playlist configured by the environment once,
+// for one invocation of a serverless function
+func serverlessClean(ctx context.Context, event []byte) (interface{}, error) {
+	config, err := configFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	var e serverlessEvent
+	if len(event) > 0 {
+		if err := json.Unmarshal(event, &e); err != nil {
+			return nil, fmt.Errorf("invalid event: %w", err)
+		}
+	}
+	dryRun := false
+	if s := os.Getenv(envDryRun); s != "" {
+		if dryRun, err = strconv.ParseBool(s); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", envDryRun, err)
+		}
+	}
+	if e.DryRun != nil {
+		dryRun = *e.DryRun
+	}
+	// There's no terminal to draw a bar on
+	if config.Cache.Progress, err = progress.New("log", os.Stderr); err != nil {
+		return nil, err
+	}
+	var exporter *tracing.Exporter
+	if config.Tracing.Endpoint != "" {
+		exporter = tracing.NewExporter(config.Tracing)
+		tracing.SetExporter(exporter)
+		defer shutdownTracing(exporter)
+	}
+
+	auditLog := newAuditLog(config)
+	config.Cache.Audit = auditLog
+	auth := spotifyauth.New(config.Spotify.AuthConfig(auditLog), config.Scopes(!dryRun)...)
+	if _, err := auth.AuthenticateWithRefreshToken(ctx, os.Getenv(envRefreshToken)); err != nil {
+		return nil, fmt.Errorf("failed to authenticate with Spotify: %w", err)
+	}
+	usage := &spotifyclient.Usage{}
+	retrier, err := spotifyclient.NewRetrier(config.Spotify.Retry)
+	if err != nil {
+		return nil, fmt.Errorf("invalid spotify.retry config: %w", err)
+	}
+	playlistCache := spotifyclient.NewPlaylistCache(path.Join(config.Cache.CacheDir, "playlists"))
+	client := spotifyclient.WithPlaylistCache(spotifyclient.Audited(spotifyclient.New(retrier.HTTPClient(usage.HTTPClient(auth.HTTPClient(), config.Cache.Metrics))), auditLog), playlistCache, config.Cache.Metrics)
+	client = spotifyclient.Coalesce(spotifyclient.WithEntityCache(client, newEntityCache(config)))
+	if dryRun || config.ReadOnly {
+		client = spotifyclient.ReadOnly(client)
+	}
+	cleaner, err := newCleaner(ctx, config, client)
+	if err != nil {
+		return nil, err
+	}
+	playlists, err := config.Spotify.CleanPlaylists(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = log.NewContext(ctx, log.WithFields(log.Fields{"runID": newRequestID()}))
+	total := dedupe.Result{Skipped: true, DryRun: dryRun}
+	for _, id := range playlists {
+		var cleaned dedupe.Result
+		if e.Force {
+			cleaned, err = cleaner.CleanFrom(ctx, id, 0, dryRun)
+		} else {
+			cleaned, err = cleaner.CleanChanged(ctx, id, dryRun)
+		}
+		total.Add(cleaned)
+		if err != nil {
+			log.WithFields(log.Fields{"playlist": id, "err": err}).Error("failed to clean the playlist")
+			break
+		}
+		log.WithFields(log.Fields{"playlist": id, "result": cleaned}).Info("cleaned the playlist")
+	}
+	pushRunMetrics(config, total, err, usage.Calls(), retrier.Retries())
+	return total, err
+}
+
+// runServerless cleans once per invocation of a serverless function, as an
+// AWS Lambda custom runtime if run by Lambda, otherwise as an HTTP function,
+// e.g. a Google Cloud Function, listening on PORT
+func runServerless(args []string) error {
+	fs := flag.NewFlagSet("serverless", flag.ExitOnError)
+	fs.Var(&LevelValue{Level: &logLevel}, "verbosity", "sets application verbosity [0-3] (default 1)")
+	fs.Parse(args)
+
+	log.SetLevel(logLevel)
+	if api := os.Getenv(serverless.RuntimeAPIEnv); api != "" {
+		lambda := serverless.NewLambda(api, serverlessClean)
+		// Better to fail every invocation up front than each in turn
+		if _, err := configFromEnv(); err != nil {
+			if initErr := lambda.InitError(err); initErr != nil {
+				log.WithFields(log.Fields{"err": initErr}).Error("failed to report the invalid config to Lambda")
+			}
+			return err
+		}
+		return lambda.Run()
+	}
+	port := os.Getenv("PORT")
+	if port == "" {
+		return errors.New("PORT is required outside Lambda")
+	}
+	log.WithFields(log.Fields{"port": port}).Info("serving the clean function")
+	return http.ListenAndServe(":"+port, serverless.HTTPHandler(serverlessClean))
+}
@@ -0,0 +1,144 @@
+// Package serverless runs a handler once per invocation of a serverless
+// function: as an AWS Lambda custom runtime, talking to the Lambda runtime
+// API, or as an HTTP function such as a Google Cloud Function or Cloud Run
+// service.
+package serverless
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// RuntimeAPIEnv is the environment variable Lambda sets to the address of the
+// runtime API
+const RuntimeAPIEnv = "AWS_LAMBDA_RUNTIME_API"
+
+// runtimeAPIVersion prefixes every path of the runtime API
+const runtimeAPIVersion = "/2018-06-01/runtime"
+
+// Handler handles one invocation with the event it was invoked with, empty if
+// none, returning what to respond with as JSON
+type Handler func(ctx context.Context, event []byte) (interface{}, error)
+
+// functionError is how the runtime API expects errors reported
+type functionError struct {
+	Message string `json:"errorMessage"`
+	Type    string `json:"errorType"`
+}
+
+// Lambda runs handler for each invocation the Lambda runtime API at api hands
+// out, one at a time, until fetching the next fails
+type Lambda struct {
+	api     string
+	handler Handler
+	client  *http.Client
+}
+
+// NewLambda creates a Lambda taking invocations from the runtime API at api,
+// the host and port in RuntimeAPIEnv
+func NewLambda(api string, handler Handler) *Lambda {
+	// No timeout, fetching the next invocation blocks until there is one
+	return &Lambda{api: api, handler: handler, client: &http.Client{}}
+}
+
+// Run handles invocations until fetching the next fails
+func (l *Lambda) Run() error {
+	for {
+		if err := l.next(); err != nil {
+			return err
+		}
+	}
+}
+
+// next waits for the next invocation and handles it. Only failing to talk to
+// the runtime API is returned, the handler failing is reported to Lambda.
+func (l *Lambda) next() error {
+	resp, err := l.client.Get(l.url("/invocation/next"))
+	if err != nil {
+		return fmt.Errorf("failed to fetch the next invocation: %w", err)
+	}
+	event, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read the next invocation: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch the next invocation: %s", resp.Status)
+	}
+	requestID := resp.Header.Get("Lambda-Runtime-Aws-Request-Id")
+	ctx := context.Background()
+	if ms, err := strconv.ParseInt(resp.Header.Get("Lambda-Runtime-Deadline-Ms"), 10, 64); err == nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, time.Unix(0, ms*int64(time.Millisecond)))
+		defer cancel()
+	}
+	log.WithFields(log.Fields{"requestID": requestID}).Info("handling Lambda invocation")
+	response, err := l.handler(ctx, event)
+	if err != nil {
+		log.WithFields(log.Fields{"requestID": requestID, "err": err}).Error("Lambda invocation failed")
+		return l.post("/invocation/"+requestID+"/error", functionError{Message: err.Error(), Type: "Error"})
+	}
+	return l.post("/invocation/"+requestID+"/response", response)
+}
+
+// InitError reports to the runtime API that the function failed to start,
+// e.g. as its config is invalid
+func (l *Lambda) InitError(err error) error {
+	return l.post("/init/error", functionError{Message: err.Error(), Type: "InitError"})
+}
+
+func (l *Lambda) url(path string) string {
+	return "http://" + l.api + runtimeAPIVersion + path
+}
+
+func (l *Lambda) post(path string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, l.url(path), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	if fe, ok := body.(functionError); ok {
+		req.Header.Set("Lambda-Runtime-Function-Error-Type", fe.Type)
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to report to the Lambda runtime API: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("failed to report to the Lambda runtime API: %s", resp.Status)
+	}
+	return nil
+}
+
+// HTTPHandler runs handler for each request, with the request body as the
+// event, responding with what it returns as JSON, or a 500 and the error
+func HTTPHandler(handler Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		response, err := handler(r.Context(), event)
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			log.WithFields(log.Fields{"err": err}).Error("function invocation failed")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(functionError{Message: err.Error(), Type: "Error"})
+			return
+		}
+		json.NewEncoder(w).Encode(response)
+	})
+}
@@ -0,0 +1,90 @@
+package serverless
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLambda(t *testing.T) {
+	events := []string{`{"n":1}`, `{"fail":true}`}
+	var mu sync.Mutex
+	served := 0
+	posted := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method == http.MethodGet && r.URL.Path == runtimeAPIVersion+"/invocation/next" {
+			if len(events) == 0 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Lambda-Runtime-Aws-Request-Id", fmt.Sprintf("req%d", served))
+			w.Header().Set("Lambda-Runtime-Deadline-Ms", "4102444800000")
+			w.Write([]byte(events[0]))
+			events = events[1:]
+			served++
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		posted[r.URL.Path] = string(body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	handler := func(ctx context.Context, event []byte) (interface{}, error) {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Errorf("expected the invocation's deadline on the context")
+		}
+		if strings.Contains(string(event), "fail") {
+			return nil, errors.New("clean failed")
+		}
+		return map[string]int{"removed": 2}, nil
+	}
+	if err := NewLambda(strings.TrimPrefix(srv.URL, "http://"), handler).Run(); err == nil {
+		t.Errorf("expected Run to stop once fetching the next invocation failed")
+	}
+	testCases := []struct {
+		path     string
+		expected string
+	}{
+		{path: runtimeAPIVersion + "/invocation/req0/response", expected: `{"removed":2}`},
+		{path: runtimeAPIVersion + "/invocation/req1/error", expected: `{"errorMessage":"clean failed","errorType":"Error"}`},
+	}
+	for _, tc := range testCases {
+		if got := posted[tc.path]; got != tc.expected {
+			t.Errorf("%s failed: expected %s, got %s", tc.path, tc.expected, got)
+		}
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	handler := HTTPHandler(func(ctx context.Context, event []byte) (interface{}, error) {
+		if len(event) == 0 {
+			return nil, errors.New("no event")
+		}
+		return string(event), nil
+	})
+	testCases := []struct {
+		name     string
+		body     string
+		status   int
+		expected string
+	}{
+		{name: "ok", body: "hi", status: http.StatusOK, expected: "\"hi\"\n"},
+		{name: "failed", body: "", status: http.StatusInternalServerError, expected: "{\"errorMessage\":\"no event\",\"errorType\":\"Error\"}\n"},
+	}
+	for _, tc := range testCases {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body)))
+		if w.Code != tc.status || w.Body.String() != tc.expected {
+			t.Errorf("%s failed: expected %d %q, got %d %q", tc.name, tc.status, tc.expected, w.Code, w.Body.String())
+		}
+	}
+}
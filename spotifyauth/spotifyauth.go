@@ -0,0 +1,317 @@
+// Package spotifyauth runs the Spotify OAuth2.0 authorization code flow and
+// hands out authenticated Spotify clients.
+package spotifyauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"potentials-utils/audit"
+
+	"github.com/apex/log"
+	"github.com/zmb3/spotify/v2"
+	spotifyoauth "github.com/zmb3/spotify/v2/auth"
+	"golang.org/x/oauth2"
+)
+
+// DefaultCallbackPath is the path the callback handler is served on when the
+// configured callback URL can't be parsed
+const DefaultCallbackPath = "/callback/spotify"
+
+// ErrAuthTimeout is returned when the user does not complete the interactive
+// auth flow within the configured timeout
+var ErrAuthTimeout = errors.New("Authentication timed out.")
+
+// Config holds the Spotify app credentials used to authenticate
+type Config struct {
+	ID          string
+	Secret      string
+	CallbackURL string
+	// AuthTimeout is how long to wait for the user to complete the
+	// interactive auth flow
+	AuthTimeout time.Duration
+	// TokenFile, if set, is where the token is kept between runs, so the
+	// interactive auth flow is only needed when there's no usable token
+	TokenFile string
+	// Audit, if set, records every login and every token forgotten
+	Audit *audit.Log
+}
+
+// Authenticator authenticates with Spotify as the current user and holds on
+// to the resulting client
+type Authenticator struct {
+	// Out is where instructions for the interactive auth flow are printed.
+	// Defaults to os.Stdout.
+	Out io.Writer
+
+	cfg         Config
+	auth        *spotifyoauth.Authenticator
+	oauthConfig *oauth2.Config
+	clientCh    chan authResult
+
+	mu         sync.Mutex
+	sessionKey string
+	// granted are the scopes Spotify granted, nil if it didn't say
+	granted     []string
+	tokenSource oauth2.TokenSource
+	httpClient  *http.Client
+	client      *spotify.Client
+}
+
+// authResult is what the callback handler hands the auth flow waiting on it
+type authResult struct {
+	client      *http.Client
+	tokenSource oauth2.TokenSource
+	granted     []string
+}
+
+// New creates an Authenticator requesting the given scopes
+func New(cfg Config, scopes ...string) *Authenticator {
+	return &Authenticator{
+		Out: os.Stdout,
+		cfg: cfg,
+		// The library falls back on credentials in environment variables,
+		// so they're always set explicitly
+		auth: spotifyoauth.New(
+			spotifyoauth.WithClientID(cfg.ID),
+			spotifyoauth.WithClientSecret(cfg.Secret),
+			spotifyoauth.WithRedirectURL(cfg.CallbackURL),
+			spotifyoauth.WithScopes(scopes...),
+		),
+		oauthConfig: &oauth2.Config{
+			ClientID:     cfg.ID,
+			ClientSecret: cfg.Secret,
+			RedirectURL:  cfg.CallbackURL,
+			Scopes:       scopes,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  spotifyoauth.AuthURL,
+				TokenURL: spotifyoauth.TokenURL,
+			},
+		},
+		clientCh: make(chan authResult),
+	}
+}
+
+// CallbackPath is the path of the configured callback URL, which
+// HandleCallback must be served on
+func (a *Authenticator) CallbackPath() string {
+	u, err := url.Parse(a.cfg.CallbackURL)
+	if err != nil || u.Path == "" {
+		return DefaultCallbackPath
+	}
+	return u.Path
+}
+
+// Client returns the current authenticated client, or nil if not yet
+// authenticated
+func (a *Authenticator) Client() *spotify.Client {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.client
+}
+
+// HTTPClient returns the authenticated HTTP client underlying Client, for
+// Spotify API calls the client library doesn't support. Returns nil if not
+// yet authenticated.
+func (a *Authenticator) HTTPClient() *http.Client {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.httpClient
+}
+
+// Scopes returns the scopes requested
+func (a *Authenticator) Scopes() []string {
+	return a.oauthConfig.Scopes
+}
+
+// GrantedScopes returns the scopes Spotify granted when the user last
+// authenticated, or nil if it didn't say or the user hasn't authenticated
+func (a *Authenticator) GrantedScopes() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.granted
+}
+
+// Token returns the current access token, refreshing it first if it has
+// expired
+func (a *Authenticator) Token() (*oauth2.Token, error) {
+	a.mu.Lock()
+	ts := a.tokenSource
+	a.mu.Unlock()
+	if ts == nil {
+		return nil, errors.New("not authenticated")
+	}
+	return ts.Token()
+}
+
+// Authenticate makes sure there is a working authenticated client, reusing
+// the token kept in the token file if there is one, and otherwise running the
+// interactive auth flow. The callback handler must already be served for the
+// interactive flow to complete. ctx bounds the calls checking the token
+// works, not the interactive flow, which has its own timeout.
+func (a *Authenticator) Authenticate(ctx context.Context) (*spotify.Client, error) {
+	if c := a.Client(); c != nil {
+		if _, err := c.CurrentUser(ctx); err == nil {
+			// The current client works, just use it.
+			log.Info("The current Spotify client is authenticated.")
+			return c, nil
+		}
+	}
+	c, err := a.restore(ctx)
+	if err != nil {
+		log.WithFields(log.Fields{"tokenFile": a.cfg.TokenFile, "err": err}).Warn("can't use the stored Spotify token, authenticating again")
+	}
+	if c != nil {
+		return c, nil
+	}
+	return a.authWithTimeout()
+}
+
+// restore authenticates with the token in the token file. Returns nil if
+// there's no token file, or its token wasn't granted every scope requested.
+func (a *Authenticator) restore(ctx context.Context) (*spotify.Client, error) {
+	if a.cfg.TokenFile == "" {
+		return nil, nil
+	}
+	stored, err := loadToken(a.cfg.TokenFile)
+	if err != nil || stored == nil {
+		return nil, err
+	}
+	if missing := missingScopes(a.oauthConfig.Scopes, stored.Granted); len(missing) > 0 {
+		log.WithFields(log.Fields{"missing": missing}).Info("the stored Spotify token lacks scopes, authenticating again")
+		return nil, nil
+	}
+	ts := a.persist(a.oauthConfig.TokenSource(context.Background(), stored.Token), stored.Granted)
+	result := authResult{client: oauth2.NewClient(context.Background(), ts), tokenSource: ts, granted: stored.Granted}
+	c := spotify.New(result.client)
+	// Refreshes the token if it has expired
+	if _, err := c.CurrentUser(ctx); err != nil {
+		return nil, fmt.Errorf("the stored token no longer works: %w", err)
+	}
+	log.Info("authenticated with the stored Spotify token")
+	a.cfg.Audit.RecordOrWarn(audit.Event{Kind: audit.AuthLogin, Detail: "stored token"})
+	return a.use(result), nil
+}
+
+// AuthenticateWithRefreshToken authenticates with a refresh token provisioned
+// beforehand, e.g. in a serverless function which can't run the interactive
+// auth flow. The scopes granted with it aren't known.
+func (a *Authenticator) AuthenticateWithRefreshToken(ctx context.Context, refreshToken string) (*spotify.Client, error) {
+	if refreshToken == "" {
+		return nil, errors.New("no refresh token")
+	}
+	ts := a.persist(a.oauthConfig.TokenSource(context.Background(), &oauth2.Token{RefreshToken: refreshToken}), nil)
+	result := authResult{client: oauth2.NewClient(context.Background(), ts), tokenSource: ts}
+	c := spotify.New(result.client)
+	if _, err := c.CurrentUser(ctx); err != nil {
+		return nil, fmt.Errorf("the refresh token doesn't work: %w", err)
+	}
+	a.cfg.Audit.RecordOrWarn(audit.Event{Kind: audit.AuthLogin, Detail: "refresh token"})
+	return a.use(result), nil
+}
+
+// Forget drops the current client and deletes the token file, so the next
+// Authenticate runs the interactive auth flow
+func (a *Authenticator) Forget() error {
+	a.mu.Lock()
+	a.client, a.httpClient, a.tokenSource, a.granted = nil, nil, nil, nil
+	a.mu.Unlock()
+	a.cfg.Audit.RecordOrWarn(audit.Event{Kind: audit.AuthForget})
+	if a.cfg.TokenFile == "" {
+		return nil
+	}
+	if err := os.Remove(a.cfg.TokenFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// use makes the client in result the current one
+func (a *Authenticator) use(result authResult) *spotify.Client {
+	c := spotify.New(result.client)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.httpClient = result.client
+	a.granted = result.granted
+	a.tokenSource = result.tokenSource
+	a.client = c
+	return c
+}
+
+// AuthenticateWithServer runs a one-off server on addr serving only the
+// callback handler for the duration of Authenticate.
+func (a *Authenticator) AuthenticateWithServer(ctx context.Context, addr string) (*spotify.Client, error) {
+	log.Info("running one-off auth server...")
+	mux := http.NewServeMux()
+	mux.HandleFunc(a.CallbackPath(), a.HandleCallback)
+	authSrv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := authSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.WithFields(log.Fields{"err": err}).Error("one-off auth server failed")
+		}
+	}()
+	shutdownCtx, cancelFunc := context.WithTimeout(context.Background(), a.cfg.AuthTimeout)
+	defer cancelFunc()
+	defer authSrv.Shutdown(shutdownCtx)
+	return a.Authenticate(ctx)
+}
+
+func (a *Authenticator) authWithTimeout() (*spotify.Client, error) {
+	a.mu.Lock()
+	// problems if there is ever more than one auth request in flight
+	a.sessionKey = fmt.Sprintf("potentials-session-key-%d", rand.Intn(10000))
+	url := a.auth.AuthURL(a.sessionKey)
+	a.mu.Unlock()
+	fmt.Fprintf(a.Out, "Visit %s in a browser to complete the authentication process.\n", url)
+	timer := time.NewTimer(a.cfg.AuthTimeout)
+	defer timer.Stop()
+	select {
+	case result := <-a.clientCh:
+		c := a.use(result)
+		a.cfg.Audit.RecordOrWarn(audit.Event{Kind: audit.AuthLogin, Detail: "authorized in the browser"})
+		fmt.Fprintln(a.Out, "Authenticated successfully with Spotify.")
+		return c, nil
+	case <-timer.C:
+		return nil, ErrAuthTimeout
+	}
+}
+
+// HandleCallback handles the Spotify OAuth2.0 callback and passes on an auth'd client
+func (a *Authenticator) HandleCallback(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	sessionKey := a.sessionKey
+	a.mu.Unlock()
+	// must use the same session key here that you used to generate the URL
+	token, err := a.auth.Token(r.Context(), sessionKey, r)
+	if err != nil {
+		log.WithFields(log.Fields{"sessionKey": sessionKey, "err": err}).Error("received auth callback, failed to retrieve token.")
+		http.Error(w, fmt.Sprintf("Couldn't get token from sessionkey %s, request %v", sessionKey, r), http.StatusNotFound)
+		return
+	}
+	var granted []string
+	if scope, ok := token.Extra("scope").(string); ok {
+		granted = strings.Fields(scope)
+	}
+	// create a client using the specified token, refreshing it as needed
+	ts := a.persist(a.oauthConfig.TokenSource(context.Background(), token), granted)
+	result := authResult{client: oauth2.NewClient(context.Background(), ts), tokenSource: ts, granted: granted}
+	select {
+	case a.clientCh <- result:
+	default:
+		log.Warn("received auth callback with no auth flow in progress")
+		http.Error(w, "no auth flow in progress", http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("200 - OK"))
+	log.Info("created client, auth flow complete")
+}
@@ -0,0 +1,62 @@
+package spotifyauth
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/zmb3/spotify/v2"
+	"golang.org/x/oauth2"
+)
+
+// TokenStatus describes the token kept in the token file
+type TokenStatus struct {
+	// Stored is false if there's no token file or it holds no usable token
+	Stored bool
+	// Expiry is when the access token expires, after refreshing it if it had.
+	// It's refreshed as needed for as long as the refresh token works.
+	Expiry time.Time
+	// Valid is true if Spotify accepted the token
+	Valid bool
+	// Err is why the token doesn't work, if it doesn't
+	Err error
+	// Granted are the scopes granted with the token, nil if Spotify didn't say
+	Granted []string
+	// Missing are the scopes asked for which weren't granted
+	Missing []string
+	// User is who the token authenticates as, if it's valid
+	User *spotify.PrivateUser
+}
+
+// Status checks the token kept in the token file with Spotify, refreshing it
+// if it has expired, without ever running the interactive auth flow. Requests
+// are sent with the oauth2.HTTPClient in ctx, if there is one.
+func (a *Authenticator) Status(ctx context.Context) (*TokenStatus, error) {
+	if a.cfg.TokenFile == "" {
+		return nil, errors.New("no token file to check")
+	}
+	stored, err := loadToken(a.cfg.TokenFile)
+	if err != nil {
+		return nil, err
+	}
+	status := &TokenStatus{}
+	if stored == nil {
+		return status, nil
+	}
+	status.Stored, status.Granted, status.Expiry = true, stored.Granted, stored.Token.Expiry
+	status.Missing = missingScopes(a.oauthConfig.Scopes, stored.Granted)
+	ts := a.persist(a.oauthConfig.TokenSource(ctx, stored.Token), stored.Granted)
+	token, err := ts.Token()
+	if err != nil {
+		status.Err = err
+		return status, nil
+	}
+	status.Expiry = token.Expiry
+	c := spotify.New(oauth2.NewClient(ctx, ts))
+	if status.User, err = c.CurrentUser(ctx); err != nil {
+		status.User, status.Err = nil, err
+		return status, nil
+	}
+	status.Valid = true
+	return status, nil
+}
@@ -0,0 +1,55 @@
+package spotifyauth
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"potentials-utils/spotifytest"
+
+	"golang.org/x/oauth2"
+)
+
+func TestStatus(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "spotifyauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token.json")
+	a := New(Config{TokenFile: path}, "a", "b")
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, srv.HTTPClient())
+
+	status, err := a.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Stored || status.Valid {
+		t.Errorf("expected no stored token, got %+v", status)
+	}
+
+	expiry := time.Now().Add(time.Hour).Round(time.Second)
+	token := &oauth2.Token{AccessToken: "access", RefreshToken: "refresh", Expiry: expiry}
+	if err := saveToken(path, &storedToken{Token: token, Granted: []string{"a"}}); err != nil {
+		t.Fatal(err)
+	}
+	status, err = a.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Stored || !status.Valid || status.Err != nil || !status.Expiry.Equal(expiry) {
+		t.Errorf("expected a valid token expiring at %v, got %+v", expiry, status)
+	}
+	if status.User == nil || status.User.ID != spotifytest.UserID {
+		t.Errorf("expected the token to authenticate as %s, got %+v", spotifytest.UserID, status.User)
+	}
+	if !reflect.DeepEqual(status.Missing, []string{"b"}) {
+		t.Errorf("expected b not granted, got %v", status.Missing)
+	}
+}
@@ -0,0 +1,112 @@
+package spotifyauth
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/apex/log"
+	"golang.org/x/oauth2"
+)
+
+// storedToken is what's kept in the token file
+type storedToken struct {
+	Token *oauth2.Token `json:"token"`
+	// Granted are the scopes Spotify granted with the token, nil if it
+	// didn't say
+	Granted []string `json:"granted"`
+}
+
+// loadToken reads the token file at path. Returns nil if there isn't one.
+func loadToken(path string) (*storedToken, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var stored storedToken
+	if err := json.Unmarshal(bytes, &stored); err != nil {
+		return nil, err
+	}
+	if stored.Token == nil || stored.Token.RefreshToken == "" {
+		return nil, nil
+	}
+	return &stored, nil
+}
+
+// saveToken writes the token file at path, readable only by the user as it
+// holds credentials
+func saveToken(path string, stored *storedToken) error {
+	bytes, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, bytes, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// missingScopes returns the scopes requested which weren't granted. None are
+// missing if Spotify didn't say which it granted.
+func missingScopes(requested, granted []string) []string {
+	if granted == nil {
+		return nil
+	}
+	has := map[string]bool{}
+	for _, s := range granted {
+		has[s] = true
+	}
+	missing := []string{}
+	for _, s := range requested {
+		if !has[s] {
+			missing = append(missing, s)
+		}
+	}
+	return missing
+}
+
+// persistingTokenSource writes every new token from its source to the token
+// file
+type persistingTokenSource struct {
+	source  oauth2.TokenSource
+	path    string
+	granted []string
+
+	mu    sync.Mutex
+	saved string
+}
+
+// persist wraps ts so the tokens it hands out are kept in the token file, if
+// there is one
+func (a *Authenticator) persist(ts oauth2.TokenSource, granted []string) oauth2.TokenSource {
+	if a.cfg.TokenFile == "" {
+		return ts
+	}
+	return &persistingTokenSource{source: ts, path: a.cfg.TokenFile, granted: granted}
+}
+
+func (p *persistingTokenSource) Token() (*oauth2.Token, error) {
+	token, err := p.source.Token()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if token.AccessToken != p.saved {
+		// Failing to save only costs an interactive auth next run
+		if err := saveToken(p.path, &storedToken{Token: token, Granted: p.granted}); err != nil {
+			log.WithFields(log.Fields{"tokenFile": p.path, "err": err}).Warn("failed to store the Spotify token")
+		} else {
+			p.saved = token.AccessToken
+		}
+	}
+	return token, nil
+}
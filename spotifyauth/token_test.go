@@ -0,0 +1,79 @@
+package spotifyauth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// sequenceSource hands out a new access token each call
+type sequenceSource struct {
+	tokens []string
+}
+
+func (s *sequenceSource) Token() (*oauth2.Token, error) {
+	token := &oauth2.Token{AccessToken: s.tokens[0], RefreshToken: "refresh", Expiry: time.Now().Add(time.Hour)}
+	if len(s.tokens) > 1 {
+		s.tokens = s.tokens[1:]
+	}
+	return token, nil
+}
+
+func TestPersistToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spotifyauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache", "token.json")
+	a := New(Config{TokenFile: path}, "a", "b")
+
+	if stored, err := loadToken(path); stored != nil || err != nil {
+		t.Fatalf("expected no stored token, got %v, %v", stored, err)
+	}
+	ts := a.persist(&sequenceSource{tokens: []string{"first", "refreshed"}}, []string{"a", "b"})
+	for _, expected := range []string{"first", "refreshed"} {
+		if _, err := ts.Token(); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := loadToken(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored == nil || stored.Token.AccessToken != expected || !reflect.DeepEqual(stored.Granted, []string{"a", "b"}) {
+			t.Errorf("expected %s stored, got %+v", expected, stored)
+		}
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected the token file readable only by its owner, got %v, %v", info, err)
+	}
+
+	if err := a.Forget(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected Forget to delete the token file, got %v", err)
+	}
+}
+
+func TestMissingScopes(t *testing.T) {
+	testCases := []struct {
+		name     string
+		granted  []string
+		expected []string
+	}{
+		{name: "unknown", granted: nil, expected: nil},
+		{name: "all granted", granted: []string{"b", "a", "c"}, expected: []string{}},
+		{name: "missing", granted: []string{"a"}, expected: []string{"b"}},
+	}
+	for _, tc := range testCases {
+		if got := missingScopes([]string{"a", "b"}, tc.granted); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s failed: expected %v, got %v", tc.name, tc.expected, got)
+		}
+	}
+}
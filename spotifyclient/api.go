@@ -0,0 +1,173 @@
+package spotifyclient
+
+import (
+	"context"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// API is every Spotify Web API call potentials-utils makes. Client calls the
+// real API; the offline and read-only wrappers in this package implement it
+// over a cache or on top of another API.
+type API interface {
+	CurrentUser(ctx context.Context) (*spotify.PrivateUser, error)
+	// Playlists returns the first page of the playlists the user owns or
+	// follows
+	Playlists(ctx context.Context) (*spotify.SimplePlaylistPage, error)
+	// NextPlaylists replaces page with the page following it, or returns
+	// spotify.ErrNoMorePages
+	NextPlaylists(ctx context.Context, page *spotify.SimplePlaylistPage) error
+	GetPlaylist(ctx context.Context, playlistID spotify.ID) (*spotify.FullPlaylist, error)
+	// PlaylistTracks returns the page of a playlist's tracks starting at
+	// offset
+	PlaylistTracks(ctx context.Context, playlistID spotify.ID, offset int) (*spotify.PlaylistTrackPage, error)
+	// NextPlaylistTracks replaces page with the page following it, or
+	// returns spotify.ErrNoMorePages
+	NextPlaylistTracks(ctx context.Context, page *spotify.PlaylistTrackPage) error
+	// SavedTracks returns the first page of the user's saved tracks
+	SavedTracks(ctx context.Context) (*spotify.SavedTrackPage, error)
+	// NextSavedTracks replaces page with the page following it, or returns
+	// spotify.ErrNoMorePages
+	NextSavedTracks(ctx context.Context, page *spotify.SavedTrackPage) error
+	// SavedTracksAt returns the page of up to limit saved tracks starting at
+	// offset
+	SavedTracksAt(ctx context.Context, offset, limit int) (*spotify.SavedTrackPage, error)
+	// SavedAlbums returns the first page of the user's saved albums
+	SavedAlbums(ctx context.Context) (*spotify.SavedAlbumPage, error)
+	// NextSavedAlbums replaces page with the page following it, or returns
+	// spotify.ErrNoMorePages
+	NextSavedAlbums(ctx context.Context, page *spotify.SavedAlbumPage) error
+	AddTracksToPlaylist(ctx context.Context, playlistID spotify.ID, trackIDs ...spotify.ID) (string, error)
+	RemoveTracksFromPlaylist(ctx context.Context, playlistID spotify.ID, trackIDs ...spotify.ID) (string, error)
+	// RemoveTracksFromPlaylistOpt removes up to 100 tracks from particular
+	// positions in the version snapshotID of a playlist, leaving any other
+	// occurrences of them
+	RemoveTracksFromPlaylistOpt(ctx context.Context, playlistID spotify.ID, tracks []spotify.TrackToRemove, snapshotID string) (string, error)
+	// InsertTracksIntoPlaylist adds up to 100 tracks to a playlist, the
+	// first at the 0-based position and the rest after it
+	InsertTracksIntoPlaylist(ctx context.Context, playlistID spotify.ID, position int, trackIDs ...spotify.ID) (string, error)
+	CreatePlaylistForUser(ctx context.Context, userID, playlistName, description string, public bool) (*spotify.FullPlaylist, error)
+	// AddTracksToLibrary saves up to 50 tracks to the user's library
+	AddTracksToLibrary(ctx context.Context, ids ...spotify.ID) error
+	// RemoveTracksFromLibrary un-saves up to 50 tracks from the user's
+	// library
+	RemoveTracksFromLibrary(ctx context.Context, ids ...spotify.ID) error
+	// UserHasTracks returns whether each of up to 50 tracks is saved in the
+	// user's library
+	UserHasTracks(ctx context.Context, ids ...spotify.ID) ([]bool, error)
+	// GetTracks looks up to 50 tracks up by ID. Unknown tracks are nil.
+	GetTracks(ctx context.Context, ids ...spotify.ID) ([]*spotify.FullTrack, error)
+	// ArtistAlbums returns the first page of an artist's albums and singles
+	ArtistAlbums(ctx context.Context, artistID spotify.ID) (*spotify.SimpleAlbumPage, error)
+	// NextArtistAlbums replaces page with the page following it, or returns
+	// spotify.ErrNoMorePages
+	NextArtistAlbums(ctx context.Context, page *spotify.SimpleAlbumPage) error
+	// AlbumTracks returns the first page of an album's tracks
+	AlbumTracks(ctx context.Context, albumID spotify.ID) (*spotify.SimpleTrackPage, error)
+	// NextAlbumTracks replaces page with the page following it, or returns
+	// spotify.ErrNoMorePages
+	NextAlbumTracks(ctx context.Context, page *spotify.SimpleTrackPage) error
+	AlbumLabels(ctx context.Context, ids ...spotify.ID) (map[spotify.ID]string, error)
+	ArtistGenres(ctx context.Context, ids ...spotify.ID) (map[spotify.ID][]string, error)
+	// PlayerDevices lists the devices the user can play on
+	PlayerDevices(ctx context.Context) ([]spotify.PlayerDevice, error)
+	// PlayerCurrentlyPlaying returns what the user is playing now
+	PlayerCurrentlyPlaying(ctx context.Context) (*spotify.CurrentlyPlaying, error)
+	// QueueSong adds a track to the end of the user's playback queue on
+	// their active device
+	QueueSong(ctx context.Context, trackID spotify.ID) error
+	// PlayOpt starts playback, of the URIs or context in opt if set, on
+	// opt's device or the active one
+	PlayOpt(ctx context.Context, opt *spotify.PlayOptions) error
+	// PauseOpt pauses playback on opt's device or the active one
+	PauseOpt(ctx context.Context, opt *spotify.PlayOptions) error
+}
+
+var _ API = (*Client)(nil)
+
+// Playlists returns the first page of the playlists the user owns or follows
+func (c *Client) Playlists(ctx context.Context) (*spotify.SimplePlaylistPage, error) {
+	return c.CurrentUsersPlaylists(ctx)
+}
+
+// NextPlaylists replaces page with the page following it
+func (c *Client) NextPlaylists(ctx context.Context, page *spotify.SimplePlaylistPage) error {
+	return c.NextPage(ctx, page)
+}
+
+// GetPlaylist looks a playlist up by ID
+func (c *Client) GetPlaylist(ctx context.Context, playlistID spotify.ID) (*spotify.FullPlaylist, error) {
+	return c.Client.GetPlaylist(ctx, playlistID)
+}
+
+// PlaylistTracks returns the page of a playlist's tracks starting at offset
+func (c *Client) PlaylistTracks(ctx context.Context, playlistID spotify.ID, offset int) (*spotify.PlaylistTrackPage, error) {
+	return c.GetPlaylistTracks(ctx, playlistID, spotify.Offset(offset))
+}
+
+// NextPlaylistTracks replaces page with the page following it
+func (c *Client) NextPlaylistTracks(ctx context.Context, page *spotify.PlaylistTrackPage) error {
+	return c.NextPage(ctx, page)
+}
+
+// SavedTracks returns the first page of the user's saved tracks
+func (c *Client) SavedTracks(ctx context.Context) (*spotify.SavedTrackPage, error) {
+	return c.CurrentUsersTracks(ctx)
+}
+
+// NextSavedTracks replaces page with the page following it
+func (c *Client) NextSavedTracks(ctx context.Context, page *spotify.SavedTrackPage) error {
+	return c.NextPage(ctx, page)
+}
+
+// SavedTracksAt returns the page of up to limit saved tracks starting at
+// offset
+func (c *Client) SavedTracksAt(ctx context.Context, offset, limit int) (*spotify.SavedTrackPage, error) {
+	return c.CurrentUsersTracks(ctx, spotify.Offset(offset), spotify.Limit(limit))
+}
+
+// SavedAlbums returns the first page of the user's saved albums
+func (c *Client) SavedAlbums(ctx context.Context) (*spotify.SavedAlbumPage, error) {
+	return c.CurrentUsersAlbums(ctx, spotify.Limit(50))
+}
+
+// NextSavedAlbums replaces page with the page following it
+func (c *Client) NextSavedAlbums(ctx context.Context, page *spotify.SavedAlbumPage) error {
+	return c.NextPage(ctx, page)
+}
+
+// CreatePlaylistForUser creates a playlist owned by userID which isn't
+// collaborative
+func (c *Client) CreatePlaylistForUser(ctx context.Context, userID, playlistName, description string, public bool) (*spotify.FullPlaylist, error) {
+	return c.Client.CreatePlaylistForUser(ctx, userID, playlistName, description, public, false)
+}
+
+// GetTracks looks up to 50 tracks up by ID
+func (c *Client) GetTracks(ctx context.Context, ids ...spotify.ID) ([]*spotify.FullTrack, error) {
+	return c.Client.GetTracks(ctx, ids)
+}
+
+// ArtistAlbums returns the first page of an artist's albums and singles
+func (c *Client) ArtistAlbums(ctx context.Context, artistID spotify.ID) (*spotify.SimpleAlbumPage, error) {
+	return c.GetArtistAlbums(ctx, artistID, []spotify.AlbumType{spotify.AlbumTypeAlbum, spotify.AlbumTypeSingle}, spotify.Limit(50))
+}
+
+// NextArtistAlbums replaces page with the page following it
+func (c *Client) NextArtistAlbums(ctx context.Context, page *spotify.SimpleAlbumPage) error {
+	return c.NextPage(ctx, page)
+}
+
+// AlbumTracks returns the first page of an album's tracks
+func (c *Client) AlbumTracks(ctx context.Context, albumID spotify.ID) (*spotify.SimpleTrackPage, error) {
+	return c.GetAlbumTracks(ctx, albumID, spotify.Limit(50))
+}
+
+// NextAlbumTracks replaces page with the page following it
+func (c *Client) NextAlbumTracks(ctx context.Context, page *spotify.SimpleTrackPage) error {
+	return c.NextPage(ctx, page)
+}
+
+// PlayerCurrentlyPlaying returns what the user is playing now
+func (c *Client) PlayerCurrentlyPlaying(ctx context.Context) (*spotify.CurrentlyPlaying, error) {
+	return c.Client.PlayerCurrentlyPlaying(ctx)
+}
@@ -0,0 +1,77 @@
+package spotifyclient
+
+import (
+	"context"
+	"strings"
+
+	"potentials-utils/audit"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// auditedClient is an API recording every call which modifies the user's
+// playlists or library in the audit log. Playback isn't recorded.
+type auditedClient struct {
+	API
+	log *audit.Log
+}
+
+// Audited wraps api so every change it makes to the user's playlists or
+// library is recorded in l, whether or not it succeeds. Nothing is recorded
+// if l is nil.
+func Audited(api API, l *audit.Log) API {
+	return &auditedClient{API: api, log: l}
+}
+
+func (c *auditedClient) AddTracksToPlaylist(ctx context.Context, playlistID spotify.ID, trackIDs ...spotify.ID) (string, error) {
+	snapshot, err := c.API.AddTracksToPlaylist(ctx, playlistID, trackIDs...)
+	c.log.RecordOrWarn(audit.Event{Kind: audit.PlaylistAdd, PlaylistID: playlistID, SnapshotID: snapshot, Tracks: trackIDs, Error: audit.ErrorString(err)})
+	return snapshot, err
+}
+
+func (c *auditedClient) RemoveTracksFromPlaylist(ctx context.Context, playlistID spotify.ID, trackIDs ...spotify.ID) (string, error) {
+	snapshot, err := c.API.RemoveTracksFromPlaylist(ctx, playlistID, trackIDs...)
+	c.log.RecordOrWarn(audit.Event{Kind: audit.PlaylistRemove, PlaylistID: playlistID, SnapshotID: snapshot, Tracks: trackIDs, Error: audit.ErrorString(err)})
+	return snapshot, err
+}
+
+func (c *auditedClient) RemoveTracksFromPlaylistOpt(ctx context.Context, playlistID spotify.ID, tracks []spotify.TrackToRemove, snapshotID string) (string, error) {
+	snapshot, err := c.API.RemoveTracksFromPlaylistOpt(ctx, playlistID, tracks, snapshotID)
+	e := audit.Event{Kind: audit.PlaylistRemove, PlaylistID: playlistID, SnapshotID: snapshot, Detail: "from snapshot " + snapshotID, Error: audit.ErrorString(err)}
+	for _, t := range tracks {
+		for _, p := range t.Positions {
+			e.Tracks = append(e.Tracks, spotify.ID(strings.TrimPrefix(t.URI, "spotify:track:")))
+			e.Positions = append(e.Positions, p)
+		}
+	}
+	c.log.RecordOrWarn(e)
+	return snapshot, err
+}
+
+func (c *auditedClient) InsertTracksIntoPlaylist(ctx context.Context, playlistID spotify.ID, position int, trackIDs ...spotify.ID) (string, error) {
+	snapshot, err := c.API.InsertTracksIntoPlaylist(ctx, playlistID, position, trackIDs...)
+	c.log.RecordOrWarn(audit.Event{Kind: audit.PlaylistAdd, PlaylistID: playlistID, SnapshotID: snapshot, Tracks: trackIDs, Positions: []int{position}, Error: audit.ErrorString(err)})
+	return snapshot, err
+}
+
+func (c *auditedClient) CreatePlaylistForUser(ctx context.Context, userID, playlistName, description string, public bool) (*spotify.FullPlaylist, error) {
+	playlist, err := c.API.CreatePlaylistForUser(ctx, userID, playlistName, description, public)
+	e := audit.Event{Kind: audit.PlaylistCreate, Detail: playlistName, Error: audit.ErrorString(err)}
+	if playlist != nil {
+		e.PlaylistID, e.SnapshotID = playlist.ID, playlist.SnapshotID
+	}
+	c.log.RecordOrWarn(e)
+	return playlist, err
+}
+
+func (c *auditedClient) AddTracksToLibrary(ctx context.Context, ids ...spotify.ID) error {
+	err := c.API.AddTracksToLibrary(ctx, ids...)
+	c.log.RecordOrWarn(audit.Event{Kind: audit.LibrarySave, Tracks: ids, Error: audit.ErrorString(err)})
+	return err
+}
+
+func (c *auditedClient) RemoveTracksFromLibrary(ctx context.Context, ids ...spotify.ID) error {
+	err := c.API.RemoveTracksFromLibrary(ctx, ids...)
+	c.log.RecordOrWarn(audit.Event{Kind: audit.LibraryRemove, Tracks: ids, Error: audit.ErrorString(err)})
+	return err
+}
@@ -0,0 +1,57 @@
+package spotifyclient
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"potentials-utils/audit"
+	"potentials-utils/spotifytest"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+func TestAudited(t *testing.T) {
+	ctx := context.Background()
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	track := spotifytest.Track("t1", "Song", "Album", "Artist")
+	srv.AddPlaylist("potentials", "Potentials", track, spotifytest.Track("t2", "Other Song", "Album", "Artist"), track)
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l := audit.New(filepath.Join(dir, "audit.jsonl"))
+	api := Audited(New(srv.HTTPClient()), l)
+
+	playlist, err := api.GetPlaylist(ctx, "potentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := api.RemoveTracksFromPlaylistOpt(ctx, "potentials", []spotify.TrackToRemove{spotify.NewTrackToRemove("t1", []int{2})}, playlist.SnapshotID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api.RemoveTracksFromPlaylist(ctx, "missing", "t2"); err == nil {
+		t.Errorf("expected removing from a missing playlist to fail")
+	}
+
+	events, err := l.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected the two changes recorded and nothing else, got %+v", events)
+	}
+	e := events[0]
+	if e.Kind != audit.PlaylistRemove || e.PlaylistID != "potentials" || e.SnapshotID != snapshot || !reflect.DeepEqual(e.Tracks, []spotify.ID{"t1"}) || !reflect.DeepEqual(e.Positions, []int{2}) {
+		t.Errorf("expected the positional removal recorded, got %+v", e)
+	}
+	if e := events[1]; e.Kind != audit.PlaylistRemove || e.Error == "" {
+		t.Errorf("expected the failed removal recorded with its error, got %+v", e)
+	}
+}
@@ -0,0 +1,126 @@
+package spotifyclient
+
+import (
+	"context"
+	"sync"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// lookup is a lookup of one entity, which callers wanting the same entity
+// wait for rather than looking it up again
+type lookup struct {
+	done  chan struct{}
+	value interface{}
+	found bool
+	err   error
+}
+
+// coalescingClient is an API which coalesces concurrent lookups of albums'
+// labels and artists' genres, so an entity several callers want at once is
+// requested once, in a batch with everything else the caller first asking
+// for it wants
+type coalescingClient struct {
+	API
+
+	mu sync.Mutex
+	// labels and genres are the lookups in flight by ID
+	labels map[spotify.ID]*lookup
+	genres map[spotify.ID]*lookup
+}
+
+// Coalesce wraps api to coalesce concurrent lookups of the same albums'
+// labels and artists' genres, e.g. by jobs cleaning at once. Lookups are
+// batched up to the API's limits by api.
+func Coalesce(api API) API {
+	return &coalescingClient{API: api, labels: map[spotify.ID]*lookup{}, genres: map[spotify.ID]*lookup{}}
+}
+
+// coalesce looks up ids, those no one is looking up already with one call to
+// fetch, and waits for the rest until ctx is done. Lookups are made with the
+// context of the caller first asking, so fail for everyone waiting on them if
+// it's cancelled.
+func (c *coalescingClient) coalesce(ctx context.Context, inflight map[spotify.ID]*lookup, ids []spotify.ID, fetch func(ids []spotify.ID) (map[spotify.ID]interface{}, error)) (map[spotify.ID]interface{}, error) {
+	c.mu.Lock()
+	waiting := map[spotify.ID]*lookup{}
+	mine := map[spotify.ID]*lookup{}
+	missing := []spotify.ID{}
+	for _, id := range ids {
+		if _, ok := waiting[id]; ok {
+			continue
+		}
+		if l, ok := inflight[id]; ok {
+			waiting[id] = l
+			continue
+		}
+		l := &lookup{done: make(chan struct{})}
+		inflight[id], waiting[id], mine[id] = l, l, l
+		missing = append(missing, id)
+	}
+	c.mu.Unlock()
+
+	if len(missing) > 0 {
+		fetched, err := fetch(missing)
+		c.mu.Lock()
+		for id, l := range mine {
+			l.value, l.found = fetched[id]
+			l.err = err
+			delete(inflight, id)
+			close(l.done)
+		}
+		c.mu.Unlock()
+	}
+	values := map[spotify.ID]interface{}{}
+	for id, l := range waiting {
+		select {
+		case <-l.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if l.err != nil {
+			return nil, l.err
+		}
+		if l.found {
+			values[id] = l.value
+		}
+	}
+	return values, nil
+}
+
+func (c *coalescingClient) AlbumLabels(ctx context.Context, ids ...spotify.ID) (map[spotify.ID]string, error) {
+	values, err := c.coalesce(ctx, c.labels, ids, func(ids []spotify.ID) (map[spotify.ID]interface{}, error) {
+		labels, err := c.API.AlbumLabels(ctx, ids...)
+		values := map[spotify.ID]interface{}{}
+		for id, label := range labels {
+			values[id] = label
+		}
+		return values, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	labels := map[spotify.ID]string{}
+	for id, v := range values {
+		labels[id] = v.(string)
+	}
+	return labels, nil
+}
+
+func (c *coalescingClient) ArtistGenres(ctx context.Context, ids ...spotify.ID) (map[spotify.ID][]string, error) {
+	values, err := c.coalesce(ctx, c.genres, ids, func(ids []spotify.ID) (map[spotify.ID]interface{}, error) {
+		genres, err := c.API.ArtistGenres(ctx, ids...)
+		values := map[spotify.ID]interface{}{}
+		for id, g := range genres {
+			values[id] = g
+		}
+		return values, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	genres := map[spotify.ID][]string{}
+	for id, v := range values {
+		genres[id] = v.([]string)
+	}
+	return genres, nil
+}
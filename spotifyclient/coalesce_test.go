@@ -0,0 +1,94 @@
+package spotifyclient
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// slowLabels is an API whose label lookups block until released, recording
+// the IDs of each
+type slowLabels struct {
+	API
+	started chan struct{}
+	release chan struct{}
+
+	mu    sync.Mutex
+	calls [][]spotify.ID
+}
+
+func (s *slowLabels) AlbumLabels(ctx context.Context, ids ...spotify.ID) (map[spotify.ID]string, error) {
+	s.mu.Lock()
+	s.calls = append(s.calls, ids)
+	s.mu.Unlock()
+	s.started <- struct{}{}
+	<-s.release
+	labels := map[spotify.ID]string{}
+	for _, id := range ids {
+		if id != "unknown" {
+			labels[id] = "label " + string(id)
+		}
+	}
+	return labels, nil
+}
+
+func TestCoalesce(t *testing.T) {
+	ctx := context.Background()
+	api := &slowLabels{started: make(chan struct{}), release: make(chan struct{})}
+	client := Coalesce(api)
+
+	results := make([]map[spotify.ID]string, 2)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0], _ = client.AlbumLabels(ctx, "a1", "a2", "a1")
+	}()
+	// Wait for the first lookup to be in flight before overlapping it
+	<-api.started
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[1], _ = client.AlbumLabels(ctx, "a2", "a3", "unknown")
+	}()
+	<-api.started
+	close(api.release)
+	wg.Wait()
+
+	for _, ids := range api.calls {
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	}
+	if expected := [][]spotify.ID{{"a1", "a2"}, {"a3", "unknown"}}; !reflect.DeepEqual(api.calls, expected) {
+		t.Errorf("expected each album looked up once, got %v", api.calls)
+	}
+	expected := []map[spotify.ID]string{
+		{"a1": "label a1", "a2": "label a2"},
+		{"a2": "label a2", "a3": "label a3"},
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("expected %v, got %v", expected, results)
+	}
+}
+
+func TestCoalesceCancelled(t *testing.T) {
+	api := &slowLabels{started: make(chan struct{}), release: make(chan struct{})}
+	client := Coalesce(api)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client.AlbumLabels(context.Background(), "a1")
+	}()
+	<-api.started
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.AlbumLabels(ctx, "a1"); err != context.Canceled {
+		t.Errorf("expected waiting for a lookup to stop once cancelled, got %v", err)
+	}
+	close(api.release)
+	<-done
+}
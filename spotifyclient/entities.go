@@ -0,0 +1,267 @@
+package spotifyclient
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"potentials-utils/metrics"
+
+	"github.com/apex/log"
+	"github.com/zmb3/spotify/v2"
+)
+
+// Kinds of entity cached by WithEntityCache
+const (
+	AlbumLabelsEntity  = "albumLabels"
+	ArtistGenresEntity = "artistGenres"
+	TracksEntity       = "tracks"
+)
+
+// DefaultEntityLifetimes are how long each kind of entity is cached for
+// unless configured otherwise. Labels hardly ever change, genres and
+// tracks' popularity drift.
+var DefaultEntityLifetimes = map[string]time.Duration{
+	AlbumLabelsEntity:  30 * 24 * time.Hour,
+	ArtistGenresEntity: 7 * 24 * time.Hour,
+	TracksEntity:       24 * time.Hour,
+}
+
+// newCacheRequests registers the count of lookups in the entity and playlist
+// caches in r, shared by both
+func newCacheRequests(r *metrics.Registry) *metrics.Counter {
+	return r.NewCounter("potentials_cache_requests_total", "Lookups in the entity and playlist caches, by cache and result: hit or miss.", "cache", "result")
+}
+
+// cachedEntity is an entity stored on disk
+type cachedEntity struct {
+	Value    json.RawMessage `json:"value"`
+	CachedAt time.Time       `json:"cachedAt"`
+}
+
+// EntityCache is a read-through cache of Spotify entities on disk, one file of
+// entities keyed by ID per kind, each kind kept for its own lifetime
+type EntityCache struct {
+	Dir string
+
+	lifetimes map[string]time.Duration
+	now       func() time.Time
+	requests  *metrics.Counter
+	mu        sync.Mutex
+	// kinds holds the entities of each kind read from disk so far
+	kinds map[string]map[spotify.ID]cachedEntity
+}
+
+// NewEntityCache creates an EntityCache storing entities in dir. lifetimes
+// override DefaultEntityLifetimes by kind, and a kind with a lifetime of zero
+// or less isn't cached. Lookups are counted in r, if not nil.
+func NewEntityCache(dir string, lifetimes map[string]time.Duration, r *metrics.Registry) *EntityCache {
+	c := &EntityCache{Dir: dir, lifetimes: map[string]time.Duration{}, now: time.Now, requests: newCacheRequests(r), kinds: map[string]map[spotify.ID]cachedEntity{}}
+	for kind, lifetime := range DefaultEntityLifetimes {
+		c.lifetimes[kind] = lifetime
+	}
+	for kind, lifetime := range lifetimes {
+		c.lifetimes[kind] = lifetime
+	}
+	return c
+}
+
+func (c *EntityCache) path(kind string) string {
+	return filepath.Join(c.Dir, kind+".json")
+}
+
+// entities returns the entities of kind, reading them from disk the first
+// time. The caller must hold mu.
+func (c *EntityCache) entities(kind string) map[spotify.ID]cachedEntity {
+	if entities, ok := c.kinds[kind]; ok {
+		return entities
+	}
+	entities := map[spotify.ID]cachedEntity{}
+	if b, err := ioutil.ReadFile(c.path(kind)); err == nil {
+		if err := json.Unmarshal(b, &entities); err != nil {
+			log.WithFields(log.Fields{"kind": kind, "err": err}).Warn("ignoring unreadable entity cache")
+			entities = map[spotify.ID]cachedEntity{}
+		}
+	} else if !os.IsNotExist(err) {
+		log.WithFields(log.Fields{"kind": kind, "err": err}).Warn("failed to read entity cache")
+	}
+	c.kinds[kind] = entities
+	return entities
+}
+
+// Get decodes the entity of kind with ID id into v, returning false if it
+// isn't cached or has expired
+func (c *EntityCache) Get(kind string, id spotify.ID, v interface{}) bool {
+	lifetime := c.lifetimes[kind]
+	if lifetime <= 0 {
+		return false
+	}
+	c.mu.Lock()
+	e, ok := c.entities(kind)[id]
+	c.mu.Unlock()
+	if !ok || c.now().Sub(e.CachedAt) >= lifetime || json.Unmarshal(e.Value, v) != nil {
+		c.requests.Inc(kind, "miss")
+		return false
+	}
+	c.requests.Inc(kind, "hit")
+	return true
+}
+
+// Put caches entities of kind by ID, dropping any expired along the way
+func (c *EntityCache) Put(kind string, entities map[spotify.ID]interface{}) error {
+	lifetime := c.lifetimes[kind]
+	if lifetime <= 0 || len(entities) == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached := c.entities(kind)
+	now := c.now()
+	for id, e := range cached {
+		if now.Sub(e.CachedAt) >= lifetime {
+			delete(cached, id)
+		}
+	}
+	for id, v := range entities {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		cached[id] = cachedEntity{Value: b, CachedAt: now}
+	}
+	b, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.path(kind), b, 0644)
+}
+
+// Len returns how many entities of kind are cached and unexpired
+func (c *EntityCache) Len(kind string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	now := c.now()
+	for _, e := range c.entities(kind) {
+		if now.Sub(e.CachedAt) < c.lifetimes[kind] {
+			n++
+		}
+	}
+	return n
+}
+
+// entityCachingClient is an API which reads albums' labels, artists' genres
+// and tracks through an EntityCache, only asking Spotify for those it
+// doesn't hold
+type entityCachingClient struct {
+	API
+	cache *EntityCache
+}
+
+// WithEntityCache wraps api to read albums' labels, artists' genres and
+// tracks through cache
+func WithEntityCache(api API, cache *EntityCache) API {
+	return &entityCachingClient{API: api, cache: cache}
+}
+
+// put caches entities, logging rather than failing if it can't
+func (c *entityCachingClient) put(kind string, entities map[spotify.ID]interface{}) {
+	if err := c.cache.Put(kind, entities); err != nil {
+		log.WithFields(log.Fields{"kind": kind, "err": err}).Warn("failed to cache entities")
+	}
+}
+
+func (c *entityCachingClient) AlbumLabels(ctx context.Context, ids ...spotify.ID) (map[spotify.ID]string, error) {
+	labels := map[spotify.ID]string{}
+	missing := []spotify.ID{}
+	for _, id := range ids {
+		var label string
+		if c.cache.Get(AlbumLabelsEntity, id, &label) {
+			labels[id] = label
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return labels, nil
+	}
+	fetched, err := c.API.AlbumLabels(ctx, missing...)
+	if err != nil {
+		return nil, err
+	}
+	put := map[spotify.ID]interface{}{}
+	for id, label := range fetched {
+		labels[id], put[id] = label, label
+	}
+	c.put(AlbumLabelsEntity, put)
+	return labels, nil
+}
+
+func (c *entityCachingClient) ArtistGenres(ctx context.Context, ids ...spotify.ID) (map[spotify.ID][]string, error) {
+	genres := map[spotify.ID][]string{}
+	missing := []spotify.ID{}
+	for _, id := range ids {
+		var g []string
+		if c.cache.Get(ArtistGenresEntity, id, &g) {
+			genres[id] = g
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return genres, nil
+	}
+	fetched, err := c.API.ArtistGenres(ctx, missing...)
+	if err != nil {
+		return nil, err
+	}
+	put := map[spotify.ID]interface{}{}
+	for id, g := range fetched {
+		genres[id], put[id] = g, g
+	}
+	c.put(ArtistGenresEntity, put)
+	return genres, nil
+}
+
+// GetTracks returns cached tracks in place, looking the rest up in one call.
+// Unknown tracks are nil, and aren't cached.
+func (c *entityCachingClient) GetTracks(ctx context.Context, ids ...spotify.ID) ([]*spotify.FullTrack, error) {
+	tracks := make([]*spotify.FullTrack, len(ids))
+	missing := []spotify.ID{}
+	for ix, id := range ids {
+		t := &spotify.FullTrack{}
+		if c.cache.Get(TracksEntity, id, t) {
+			tracks[ix] = t
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return tracks, nil
+	}
+	fetched, err := c.API.GetTracks(ctx, missing...)
+	if err != nil {
+		return nil, err
+	}
+	byID := map[spotify.ID]*spotify.FullTrack{}
+	put := map[spotify.ID]interface{}{}
+	for ix, t := range fetched {
+		if t != nil && ix < len(missing) {
+			byID[missing[ix]], put[missing[ix]] = t, t
+		}
+	}
+	for ix, id := range ids {
+		if tracks[ix] == nil {
+			tracks[ix] = byID[id]
+		}
+	}
+	c.put(TracksEntity, put)
+	return tracks, nil
+}
@@ -0,0 +1,86 @@
+package spotifyclient
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"potentials-utils/spotifytest"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+func TestEntityCache(t *testing.T) {
+	ctx := context.Background()
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	srv.SetAlbumLabel("a1", "Warp")
+	srv.SetAlbumLabel("a2", "Ninja Tune")
+	srv.AddArtist(spotify.FullArtist{SimpleArtist: spotify.SimpleArtist{ID: "r1", Name: "Artist"}, Genres: []string{"idm"}})
+	srv.AddTracks(spotifytest.Track("t1", "Song", "Album", "Artist"))
+	dir, err := ioutil.TempDir("", "entities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	newClient := func() API {
+		cache := NewEntityCache(dir, map[string]time.Duration{ArtistGenresEntity: time.Hour, TracksEntity: 0}, nil)
+		cache.now = func() time.Time { return now }
+		return WithEntityCache(New(srv.HTTPClient()), cache)
+	}
+	requests := func(prefix string) int {
+		n := 0
+		for _, r := range srv.Requests() {
+			if strings.HasPrefix(r, prefix) {
+				n++
+			}
+		}
+		return n
+	}
+
+	client := newClient()
+	if labels, err := client.AlbumLabels(ctx, "a1"); err != nil || labels["a1"] != "Warp" {
+		t.Fatalf("expected a1's label, got %v %v", labels, err)
+	}
+	// Only the album not cached yet is looked up, and the cache survives
+	// a new client
+	client = newClient()
+	labels, err := client.AlbumLabels(ctx, "a1", "a2")
+	if err != nil || !reflect.DeepEqual(labels, map[spotify.ID]string{"a1": "Warp", "a2": "Ninja Tune"}) {
+		t.Errorf("expected both labels, got %v %v", labels, err)
+	}
+	if !strings.HasSuffix(srv.Requests()[len(srv.Requests())-1], "ids=a2") {
+		t.Errorf("expected only a2 looked up, got %v", srv.Requests())
+	}
+
+	for ix := 0; ix < 2; ix++ {
+		if genres, err := client.ArtistGenres(ctx, "r1"); err != nil || !reflect.DeepEqual(genres["r1"], []string{"idm"}) {
+			t.Fatalf("expected r1's genres, got %v %v", genres, err)
+		}
+	}
+	if n := requests("GET /v1/artists"); n != 1 {
+		t.Errorf("expected genres looked up once while cached, got %d", n)
+	}
+	now = now.Add(2 * time.Hour)
+	if _, err := client.ArtistGenres(ctx, "r1"); err != nil {
+		t.Fatal(err)
+	}
+	if n := requests("GET /v1/artists"); n != 2 {
+		t.Errorf("expected expired genres looked up again, got %d lookups", n)
+	}
+
+	// Tracks are configured not to be cached
+	for ix := 0; ix < 2; ix++ {
+		if tracks, err := client.GetTracks(ctx, "t1", "unknown"); err != nil || len(tracks) != 2 || tracks[0].ID != "t1" {
+			t.Fatalf("expected t1, got %v %v", tracks, err)
+		}
+	}
+	if n := requests("GET /v1/tracks"); n != 2 {
+		t.Errorf("expected uncached tracks looked up every time, got %d lookups", n)
+	}
+}
@@ -0,0 +1,419 @@
+package spotifyclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"potentials-utils/metrics"
+
+	"github.com/apex/log"
+	"github.com/zmb3/spotify/v2"
+)
+
+// ErrOffline is returned by calls which need the Spotify API when running
+// offline
+var ErrOffline = errors.New("not available offline, this needs the Spotify API")
+
+// CachedPlaylist is a copy of a playlist stored on disk
+type CachedPlaylist struct {
+	ID   spotify.ID `json:"id"`
+	Name string     `json:"name"`
+	// SnapshotID is the version of the playlist the copy was taken from
+	SnapshotID string                  `json:"snapshotID,omitempty"`
+	CachedAt   time.Time               `json:"cachedAt"`
+	Tracks     []spotify.PlaylistTrack `json:"tracks"`
+}
+
+// PlaylistCache stores copies of playlists on disk, one file per playlist
+type PlaylistCache struct {
+	Dir string
+}
+
+// NewPlaylistCache creates a PlaylistCache storing playlists in dir
+func NewPlaylistCache(dir string) *PlaylistCache {
+	return &PlaylistCache{Dir: dir}
+}
+
+func (c *PlaylistCache) path(id spotify.ID) string {
+	return filepath.Join(c.Dir, string(id)+".json")
+}
+
+// Save stores a copy of a playlist
+func (c *PlaylistCache) Save(p CachedPlaylist) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.path(p.ID), b, 0644)
+}
+
+// Load returns the stored copy of a playlist
+func (c *PlaylistCache) Load(id spotify.ID) (*CachedPlaylist, error) {
+	b, err := ioutil.ReadFile(c.path(id))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("playlist %s has not been cached, run a clean online first", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p := &CachedPlaylist{}
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// List returns every stored playlist copy, ordered by name
+func (c *PlaylistCache) List() ([]*CachedPlaylist, error) {
+	files, err := ioutil.ReadDir(c.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	playlists := []*CachedPlaylist{}
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		p, err := c.Load(spotify.ID(strings.TrimSuffix(f.Name(), ".json")))
+		if err != nil {
+			return nil, err
+		}
+		playlists = append(playlists, p)
+	}
+	sort.Slice(playlists, func(i, j int) bool { return playlists[i].Name < playlists[j].Name })
+	return playlists, nil
+}
+
+// cachingClient is an API which saves a copy of every playlist fully paged
+// through from the start, and pages through the copy instead of Spotify while
+// the playlist's snapshot ID is unchanged
+type cachingClient struct {
+	API
+	cache    *PlaylistCache
+	requests *metrics.Counter
+
+	mu sync.Mutex
+	// pending holds the tracks paged through so far by page being fetched
+	pending map[*spotify.PlaylistTrackPage]*CachedPlaylist
+	// current holds the cached copies matching the snapshot ID last fetched
+	// from Spotify
+	current map[spotify.ID]*CachedPlaylist
+}
+
+// WithPlaylistCache wraps api to save a copy of every playlist it pages
+// through in full to cache, for use offline. Tracks of a playlist whose
+// snapshot ID matches its cached copy are read from the copy rather than
+// downloaded again. Lookups in the cache are counted in r, if not nil.
+func WithPlaylistCache(api API, cache *PlaylistCache, r *metrics.Registry) API {
+	return &cachingClient{
+		API:      api,
+		cache:    cache,
+		requests: newCacheRequests(r),
+		pending:  map[*spotify.PlaylistTrackPage]*CachedPlaylist{},
+		current:  map[spotify.ID]*CachedPlaylist{},
+	}
+}
+
+func (c *cachingClient) GetPlaylist(ctx context.Context, playlistID spotify.ID) (*spotify.FullPlaylist, error) {
+	p, err := c.API.GetPlaylist(ctx, playlistID)
+	if err != nil {
+		return nil, err
+	}
+	if cached, err := c.cache.Load(p.ID); err == nil && cached.SnapshotID != "" && cached.SnapshotID == p.SnapshotID {
+		c.requests.Inc("playlists", "hit")
+		log.WithFields(log.Fields{"playlistID": p.ID, "snapshotID": p.SnapshotID}).Debug("playlist unchanged, reading tracks from cache")
+		c.mu.Lock()
+		c.current[p.ID] = cached
+		c.mu.Unlock()
+		p.Tracks = *offlinePage(cached, 0)
+		return p, nil
+	}
+	c.requests.Inc("playlists", "miss")
+	c.mu.Lock()
+	delete(c.current, p.ID)
+	c.mu.Unlock()
+	c.track(&p.Tracks, &CachedPlaylist{ID: p.ID, Name: p.Name, SnapshotID: p.SnapshotID})
+	return p, nil
+}
+
+func (c *cachingClient) PlaylistTracks(ctx context.Context, playlistID spotify.ID, offset int) (*spotify.PlaylistTrackPage, error) {
+	c.mu.Lock()
+	cached, ok := c.current[playlistID]
+	c.mu.Unlock()
+	if ok {
+		return offlinePage(cached, offset), nil
+	}
+	return c.API.PlaylistTracks(ctx, playlistID, offset)
+}
+
+func (c *cachingClient) AddTracksToPlaylist(ctx context.Context, playlistID spotify.ID, trackIDs ...spotify.ID) (string, error) {
+	c.mu.Lock()
+	delete(c.current, playlistID)
+	c.mu.Unlock()
+	return c.API.AddTracksToPlaylist(ctx, playlistID, trackIDs...)
+}
+
+func (c *cachingClient) InsertTracksIntoPlaylist(ctx context.Context, playlistID spotify.ID, position int, trackIDs ...spotify.ID) (string, error) {
+	c.mu.Lock()
+	delete(c.current, playlistID)
+	c.mu.Unlock()
+	return c.API.InsertTracksIntoPlaylist(ctx, playlistID, position, trackIDs...)
+}
+
+func (c *cachingClient) RemoveTracksFromPlaylistOpt(ctx context.Context, playlistID spotify.ID, tracks []spotify.TrackToRemove, snapshotID string) (string, error) {
+	c.mu.Lock()
+	delete(c.current, playlistID)
+	c.mu.Unlock()
+	return c.API.RemoveTracksFromPlaylistOpt(ctx, playlistID, tracks, snapshotID)
+}
+
+// RemoveTracksFromPlaylist removes the tracks from the cached copy too if it
+// was current, so the next run needn't download the playlist again
+func (c *cachingClient) RemoveTracksFromPlaylist(ctx context.Context, playlistID spotify.ID, trackIDs ...spotify.ID) (string, error) {
+	snapshotID, err := c.API.RemoveTracksFromPlaylist(ctx, playlistID, trackIDs...)
+	c.mu.Lock()
+	cached, ok := c.current[playlistID]
+	delete(c.current, playlistID)
+	c.mu.Unlock()
+	if err != nil || !ok {
+		return snapshotID, err
+	}
+	remove := map[spotify.ID]bool{}
+	for _, id := range trackIDs {
+		remove[id] = true
+	}
+	kept := []spotify.PlaylistTrack{}
+	for _, t := range cached.Tracks {
+		if !remove[t.Track.ID] {
+			kept = append(kept, t)
+		}
+	}
+	updated := *cached
+	updated.Tracks, updated.SnapshotID, updated.CachedAt = kept, snapshotID, time.Now()
+	if saveErr := c.cache.Save(updated); saveErr != nil {
+		log.WithFields(log.Fields{"playlistID": playlistID, "err": saveErr}).Warn("failed to cache playlist")
+	} else {
+		c.mu.Lock()
+		c.current[playlistID] = &updated
+		c.mu.Unlock()
+	}
+	return snapshotID, nil
+}
+
+func (c *cachingClient) NextPlaylistTracks(ctx context.Context, page *spotify.PlaylistTrackPage) error {
+	err := c.API.NextPlaylistTracks(ctx, page)
+	c.mu.Lock()
+	p, ok := c.pending[page]
+	if !ok {
+		c.mu.Unlock()
+		return err
+	}
+	switch err {
+	case nil:
+		p.Tracks = append(p.Tracks, page.Tracks...)
+		c.mu.Unlock()
+		return nil
+	case spotify.ErrNoMorePages:
+		delete(c.pending, page)
+		c.mu.Unlock()
+		p.CachedAt = time.Now()
+		if saveErr := c.cache.Save(*p); saveErr != nil {
+			log.WithFields(log.Fields{"playlistID": p.ID, "err": saveErr}).Warn("failed to cache playlist")
+		} else {
+			c.mu.Lock()
+			c.current[p.ID] = p
+			c.mu.Unlock()
+		}
+		return err
+	default:
+		delete(c.pending, page)
+		c.mu.Unlock()
+		return err
+	}
+}
+
+// track starts recording the tracks paged through from the first page
+func (c *cachingClient) track(page *spotify.PlaylistTrackPage, p *CachedPlaylist) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Forget abandoned runs through the same playlist
+	for pg, pending := range c.pending {
+		if pending.ID == p.ID {
+			delete(c.pending, pg)
+		}
+	}
+	p.Tracks = append(p.Tracks, page.Tracks...)
+	c.pending[page] = p
+}
+
+// offlineClient is an API answering from cached playlists, and failing with
+// ErrOffline on everything else
+type offlineClient struct {
+	cache *PlaylistCache
+}
+
+// NewOffline creates an API which never calls Spotify. Playlists are read
+// from cache, mutations and other reads fail with ErrOffline.
+func NewOffline(cache *PlaylistCache) API {
+	return &offlineClient{cache: cache}
+}
+
+func (c *offlineClient) CurrentUser(ctx context.Context) (*spotify.PrivateUser, error) {
+	return nil, ErrOffline
+}
+
+func (c *offlineClient) Playlists(ctx context.Context) (*spotify.SimplePlaylistPage, error) {
+	return nil, ErrOffline
+}
+
+func (c *offlineClient) NextPlaylists(ctx context.Context, page *spotify.SimplePlaylistPage) error {
+	return ErrOffline
+}
+
+func (c *offlineClient) GetPlaylist(ctx context.Context, playlistID spotify.ID) (*spotify.FullPlaylist, error) {
+	p, err := c.cache.Load(playlistID)
+	if err != nil {
+		return nil, err
+	}
+	playlist := &spotify.FullPlaylist{}
+	playlist.ID, playlist.Name = p.ID, p.Name
+	playlist.Tracks = *offlinePage(p, 0)
+	return playlist, nil
+}
+
+func (c *offlineClient) PlaylistTracks(ctx context.Context, playlistID spotify.ID, offset int) (*spotify.PlaylistTrackPage, error) {
+	p, err := c.cache.Load(playlistID)
+	if err != nil {
+		return nil, err
+	}
+	return offlinePage(p, offset), nil
+}
+
+// offlinePage returns every cached track from offset on as a single page
+func offlinePage(p *CachedPlaylist, offset int) *spotify.PlaylistTrackPage {
+	if offset > len(p.Tracks) {
+		offset = len(p.Tracks)
+	}
+	page := &spotify.PlaylistTrackPage{Tracks: p.Tracks[offset:]}
+	page.Offset, page.Limit, page.Total = spotify.Numeric(offset), spotify.Numeric(len(page.Tracks)), spotify.Numeric(len(p.Tracks))
+	return page
+}
+
+func (c *offlineClient) NextPlaylistTracks(ctx context.Context, page *spotify.PlaylistTrackPage) error {
+	return spotify.ErrNoMorePages
+}
+
+func (c *offlineClient) SavedTracks(ctx context.Context) (*spotify.SavedTrackPage, error) {
+	return nil, ErrOffline
+}
+
+func (c *offlineClient) NextSavedTracks(ctx context.Context, page *spotify.SavedTrackPage) error {
+	return ErrOffline
+}
+
+func (c *offlineClient) SavedTracksAt(ctx context.Context, offset, limit int) (*spotify.SavedTrackPage, error) {
+	return nil, ErrOffline
+}
+
+func (c *offlineClient) SavedAlbums(ctx context.Context) (*spotify.SavedAlbumPage, error) {
+	return nil, ErrOffline
+}
+
+func (c *offlineClient) NextSavedAlbums(ctx context.Context, page *spotify.SavedAlbumPage) error {
+	return ErrOffline
+}
+
+func (c *offlineClient) AddTracksToPlaylist(ctx context.Context, playlistID spotify.ID, trackIDs ...spotify.ID) (string, error) {
+	return "", ErrOffline
+}
+
+func (c *offlineClient) InsertTracksIntoPlaylist(ctx context.Context, playlistID spotify.ID, position int, trackIDs ...spotify.ID) (string, error) {
+	return "", ErrOffline
+}
+
+func (c *offlineClient) RemoveTracksFromPlaylist(ctx context.Context, playlistID spotify.ID, trackIDs ...spotify.ID) (string, error) {
+	return "", ErrOffline
+}
+
+func (c *offlineClient) RemoveTracksFromPlaylistOpt(ctx context.Context, playlistID spotify.ID, tracks []spotify.TrackToRemove, snapshotID string) (string, error) {
+	return "", ErrOffline
+}
+
+func (c *offlineClient) CreatePlaylistForUser(ctx context.Context, userID, playlistName, description string, public bool) (*spotify.FullPlaylist, error) {
+	return nil, ErrOffline
+}
+
+func (c *offlineClient) AddTracksToLibrary(ctx context.Context, ids ...spotify.ID) error {
+	return ErrOffline
+}
+
+func (c *offlineClient) RemoveTracksFromLibrary(ctx context.Context, ids ...spotify.ID) error {
+	return ErrOffline
+}
+
+func (c *offlineClient) UserHasTracks(ctx context.Context, ids ...spotify.ID) ([]bool, error) {
+	return nil, ErrOffline
+}
+
+func (c *offlineClient) GetTracks(ctx context.Context, ids ...spotify.ID) ([]*spotify.FullTrack, error) {
+	return nil, ErrOffline
+}
+
+func (c *offlineClient) ArtistAlbums(ctx context.Context, artistID spotify.ID) (*spotify.SimpleAlbumPage, error) {
+	return nil, ErrOffline
+}
+
+func (c *offlineClient) NextArtistAlbums(ctx context.Context, page *spotify.SimpleAlbumPage) error {
+	return ErrOffline
+}
+
+func (c *offlineClient) AlbumTracks(ctx context.Context, albumID spotify.ID) (*spotify.SimpleTrackPage, error) {
+	return nil, ErrOffline
+}
+
+func (c *offlineClient) NextAlbumTracks(ctx context.Context, page *spotify.SimpleTrackPage) error {
+	return ErrOffline
+}
+
+func (c *offlineClient) AlbumLabels(ctx context.Context, ids ...spotify.ID) (map[spotify.ID]string, error) {
+	return nil, ErrOffline
+}
+
+func (c *offlineClient) ArtistGenres(ctx context.Context, ids ...spotify.ID) (map[spotify.ID][]string, error) {
+	return nil, ErrOffline
+}
+
+func (c *offlineClient) PlayerDevices(ctx context.Context) ([]spotify.PlayerDevice, error) {
+	return nil, ErrOffline
+}
+
+func (c *offlineClient) PlayerCurrentlyPlaying(ctx context.Context) (*spotify.CurrentlyPlaying, error) {
+	return nil, ErrOffline
+}
+
+func (c *offlineClient) QueueSong(ctx context.Context, trackID spotify.ID) error {
+	return ErrOffline
+}
+
+func (c *offlineClient) PlayOpt(ctx context.Context, opt *spotify.PlayOptions) error {
+	return ErrOffline
+}
+
+func (c *offlineClient) PauseOpt(ctx context.Context, opt *spotify.PlayOptions) error {
+	return ErrOffline
+}
@@ -0,0 +1,141 @@
+package spotifyclient
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"potentials-utils/spotifytest"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+func TestOffline(t *testing.T) {
+	ctx := context.Background()
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	tracks := []spotify.FullTrack{}
+	for ix := 0; ix < 150; ix++ {
+		tracks = append(tracks, spotifytest.Track(fmt.Sprintf("t%d", ix), "Song", "Album", "Artist"))
+	}
+	srv.AddPlaylist("potentials", "Potentials", tracks...)
+	dir, err := ioutil.TempDir("", "playlists")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := NewPlaylistCache(dir)
+
+	offline := NewOffline(cache)
+	if _, err := offline.GetPlaylist(ctx, "potentials"); err == nil {
+		t.Errorf("expected an error for a playlist which hasn't been cached")
+	}
+
+	// Paging through the playlist online caches it
+	online := WithPlaylistCache(New(srv.HTTPClient()), cache, nil)
+	p, err := online.GetPlaylist(ctx, "potentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if err := online.NextPlaylistTracks(ctx, &p.Tracks); err == spotify.ErrNoMorePages {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p, err = offline.GetPlaylist(ctx, "potentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "Potentials" || len(p.Tracks.Tracks) != 150 || p.Tracks.Tracks[149].Track.ID != "t149" {
+		t.Errorf("expected the cached playlist in one page, got %s with %d tracks", p.Name, len(p.Tracks.Tracks))
+	}
+	if err := offline.NextPlaylistTracks(ctx, &p.Tracks); err != spotify.ErrNoMorePages {
+		t.Errorf("expected no more pages offline, got %v", err)
+	}
+	page, err := offline.PlaylistTracks(ctx, "potentials", 140)
+	if err != nil || len(page.Tracks) != 10 || page.Offset != 140 {
+		t.Errorf("expected the last 10 tracks from offset 140, got %+v %v", page, err)
+	}
+	if _, err := offline.RemoveTracksFromPlaylist(ctx, "potentials", "t1"); err != ErrOffline {
+		t.Errorf("expected removal to fail offline, got %v", err)
+	}
+	if _, err := offline.SavedTracks(ctx); err != ErrOffline {
+		t.Errorf("expected saved tracks to be unavailable offline, got %v", err)
+	}
+	if cached, err := cache.List(); err != nil || len(cached) != 1 || cached[0].ID != "potentials" {
+		t.Errorf("expected the cached playlist to be listed, got %v %v", cached, err)
+	}
+	requests := len(srv.Requests())
+	offline.GetPlaylist(ctx, "potentials")
+	if len(srv.Requests()) != requests {
+		t.Errorf("expected offline client not to call Spotify")
+	}
+}
+
+func TestPlaylistCacheSnapshots(t *testing.T) {
+	ctx := context.Background()
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	tracks := []spotify.FullTrack{}
+	for ix := 0; ix < 250; ix++ {
+		tracks = append(tracks, spotifytest.Track(fmt.Sprintf("t%d", ix), "Song", "Album", "Artist"))
+	}
+	srv.AddPlaylist("potentials", "Potentials", tracks...)
+	dir, err := ioutil.TempDir("", "playlists")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := NewPlaylistCache(dir)
+
+	// pageThrough pages through the whole playlist, returning how many
+	// tracks were seen and how many requests Spotify served
+	pageThrough := func(api API) (int, int) {
+		before := len(srv.Requests())
+		p, err := api.GetPlaylist(ctx, "potentials")
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := len(p.Tracks.Tracks)
+		for {
+			if err := api.NextPlaylistTracks(ctx, &p.Tracks); err == spotify.ErrNoMorePages {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			n += len(p.Tracks.Tracks)
+		}
+		return n, len(srv.Requests()) - before
+	}
+
+	if n, requests := pageThrough(WithPlaylistCache(New(srv.HTTPClient()), cache, nil)); n != 250 || requests != 3 {
+		t.Errorf("expected 250 tracks downloaded in 3 requests, got %d in %d", n, requests)
+	}
+	api := WithPlaylistCache(New(srv.HTTPClient()), cache, nil)
+	if n, requests := pageThrough(api); n != 250 || requests != 1 {
+		t.Errorf("expected 250 tracks of an unchanged playlist in 1 request, got %d in %d", n, requests)
+	}
+	page, err := api.PlaylistTracks(ctx, "potentials", 200)
+	if err != nil || len(page.Tracks) != 50 {
+		t.Errorf("expected the last 50 tracks of an unchanged playlist from cache, got %+v %v", page, err)
+	}
+
+	// Removing through the client keeps the cache current
+	if _, err := api.RemoveTracksFromPlaylist(ctx, "potentials", "t0", "t1"); err != nil {
+		t.Fatal(err)
+	}
+	if n, requests := pageThrough(api); n != 248 || requests != 1 {
+		t.Errorf("expected 248 tracks after removal in 1 request, got %d in %d", n, requests)
+	}
+
+	// Changes made elsewhere invalidate the cache
+	srv.AddPlaylist("potentials", "Potentials", tracks[:120]...)
+	if n, requests := pageThrough(api); n != 120 || requests != 2 {
+		t.Errorf("expected 120 tracks of a changed playlist downloaded in 2 requests, got %d in %d", n, requests)
+	}
+}
@@ -0,0 +1,63 @@
+package spotifyclient
+
+import (
+	"context"
+	"errors"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// ErrReadOnly is returned by calls which would modify the user's Spotify
+// account in read-only mode
+var ErrReadOnly = errors.New("refusing to modify Spotify in read-only mode")
+
+// readOnlyClient is an API which refuses every mutating call
+type readOnlyClient struct {
+	API
+}
+
+// ReadOnly wraps api so every call which would modify the user's Spotify
+// account fails with ErrReadOnly, whatever the caller intended
+func ReadOnly(api API) API {
+	return &readOnlyClient{API: api}
+}
+
+func (c *readOnlyClient) AddTracksToPlaylist(ctx context.Context, playlistID spotify.ID, trackIDs ...spotify.ID) (string, error) {
+	return "", ErrReadOnly
+}
+
+func (c *readOnlyClient) RemoveTracksFromPlaylist(ctx context.Context, playlistID spotify.ID, trackIDs ...spotify.ID) (string, error) {
+	return "", ErrReadOnly
+}
+
+func (c *readOnlyClient) RemoveTracksFromPlaylistOpt(ctx context.Context, playlistID spotify.ID, tracks []spotify.TrackToRemove, snapshotID string) (string, error) {
+	return "", ErrReadOnly
+}
+
+func (c *readOnlyClient) InsertTracksIntoPlaylist(ctx context.Context, playlistID spotify.ID, position int, trackIDs ...spotify.ID) (string, error) {
+	return "", ErrReadOnly
+}
+
+func (c *readOnlyClient) CreatePlaylistForUser(ctx context.Context, userID, playlistName, description string, public bool) (*spotify.FullPlaylist, error) {
+	return nil, ErrReadOnly
+}
+
+func (c *readOnlyClient) AddTracksToLibrary(ctx context.Context, ids ...spotify.ID) error {
+	return ErrReadOnly
+}
+
+func (c *readOnlyClient) RemoveTracksFromLibrary(ctx context.Context, ids ...spotify.ID) error {
+	return ErrReadOnly
+}
+
+func (c *readOnlyClient) QueueSong(ctx context.Context, trackID spotify.ID) error {
+	return ErrReadOnly
+}
+
+func (c *readOnlyClient) PlayOpt(ctx context.Context, opt *spotify.PlayOptions) error {
+	return ErrReadOnly
+}
+
+func (c *readOnlyClient) PauseOpt(ctx context.Context, opt *spotify.PlayOptions) error {
+	return ErrReadOnly
+}
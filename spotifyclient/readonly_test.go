@@ -0,0 +1,43 @@
+package spotifyclient
+
+import (
+	"context"
+	"testing"
+
+	"potentials-utils/spotifytest"
+)
+
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	srv.AddPlaylist("potentials", "Potentials", spotifytest.Track("t1", "Song", "Album", "Artist"))
+	api := ReadOnly(New(srv.HTTPClient()))
+
+	if _, err := api.GetPlaylist(ctx, "potentials"); err != nil {
+		t.Errorf("expected reads to pass through, got %v", err)
+	}
+	if _, err := api.RemoveTracksFromPlaylist(ctx, "potentials", "t1"); err != ErrReadOnly {
+		t.Errorf("expected removal to be refused, got %v", err)
+	}
+	if _, err := api.AddTracksToPlaylist(ctx, "potentials", "t2"); err != ErrReadOnly {
+		t.Errorf("expected addition to be refused, got %v", err)
+	}
+	if _, err := api.CreatePlaylistForUser(ctx, spotifytest.UserID, "New", "", false); err != ErrReadOnly {
+		t.Errorf("expected playlist creation to be refused, got %v", err)
+	}
+	if err := api.AddTracksToLibrary(ctx, "t1"); err != ErrReadOnly {
+		t.Errorf("expected saving tracks to be refused, got %v", err)
+	}
+	if err := api.RemoveTracksFromLibrary(ctx, "t1"); err != ErrReadOnly {
+		t.Errorf("expected un-saving tracks to be refused, got %v", err)
+	}
+	if ids := srv.PlaylistTrackIDs("potentials"); len(ids) != 1 {
+		t.Errorf("expected playlist to be untouched, got %v", ids)
+	}
+	for _, r := range srv.Requests() {
+		if r[:3] != "GET" {
+			t.Errorf("expected only reads to reach Spotify, got %s", r)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package spotifyclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/apex/log"
+)
+
+const (
+	defaultMaxRetries = 5
+	defaultBackoff    = time.Second
+	defaultMaxWait    = time.Minute
+	// maxMaxRetries bounds MaxRetries, past which a request would be retried
+	// for hours
+	maxMaxRetries = 20
+)
+
+// RetryConfig configures retrying Spotify API requests which were rate
+// limited or failed transiently
+type RetryConfig struct {
+	// MaxRetries is how many times a request is retried, default 5 and at
+	// most 20. Requests aren't retried if negative.
+	MaxRetries int `yaml:"maxRetries"`
+	// BackoffMs is how long the first retry of a failed request waits,
+	// doubling with each retry, default 1000. Rate limited requests wait as
+	// long as Spotify's Retry-After says instead.
+	BackoffMs int `yaml:"backoffMs"`
+	// MaxWaitSec is the longest a request waits to be retried, default 60.
+	// Requests Spotify says to retry later than that fail instead.
+	MaxWaitSec int `yaml:"maxWaitSec"`
+}
+
+// Retrier retries Spotify API requests which were rate limited or failed with
+// a transient 5xx error, and counts the retries. It's safe for concurrent use.
+type Retrier struct {
+	maxRetries int
+	backoff    time.Duration
+	maxWait    time.Duration
+	// sleep waits d, or until ctx is done
+	sleep func(ctx context.Context, d time.Duration) error
+
+	retries     int64
+	rateLimited int64
+}
+
+// NewRetrier creates a Retrier configured by cfg
+func NewRetrier(cfg RetryConfig) (*Retrier, error) {
+	if cfg.MaxRetries > maxMaxRetries {
+		return nil, fmt.Errorf("maxRetries must be at most %d, got %d", maxMaxRetries, cfg.MaxRetries)
+	}
+	r := &Retrier{
+		maxRetries: cfg.MaxRetries,
+		backoff:    time.Duration(cfg.BackoffMs) * time.Millisecond,
+		maxWait:    time.Duration(cfg.MaxWaitSec) * time.Second,
+		sleep:      sleep,
+	}
+	if r.maxRetries == 0 {
+		r.maxRetries = defaultMaxRetries
+	}
+	if r.backoff <= 0 {
+		r.backoff = defaultBackoff
+	}
+	if r.maxWait <= 0 {
+		r.maxWait = defaultMaxWait
+	}
+	return r, nil
+}
+
+// Retries returns how many requests have been retried. A nil Retrier never
+// retries.
+func (r *Retrier) Retries() int64 {
+	if r == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&r.retries)
+}
+
+// RateLimited returns how many of the retries were of rate limited requests
+func (r *Retrier) RateLimited() int64 {
+	if r == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&r.rateLimited)
+}
+
+// HTTPClient returns a copy of c whose requests are retried by r
+func (r *Retrier) HTTPClient(c *http.Client) *http.Client {
+	retried := *c
+	next := c.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	retried.Transport = &retryTransport{retrier: r, next: next}
+	return &retried
+}
+
+// wait returns how long to wait before retrying req after resp, the
+// attempt'th retry, and false if it shouldn't be retried. Rate limited
+// requests are always retried, as Spotify didn't act on them, but only
+// idempotent requests are retried after a 5xx error, which may have been
+// acted on.
+func (r *Retrier) wait(req *http.Request, resp *http.Response, attempt int) (time.Duration, bool) {
+	if attempt >= r.maxRetries || (req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+		return 0, false
+	}
+	backoff := r.backoff
+	for i := 0; i < attempt && backoff < r.maxWait; i++ {
+		backoff *= 2
+	}
+	if backoff > r.maxWait {
+		backoff = r.maxWait
+	}
+	// Jitter the backoff so concurrent requests don't all retry at once
+	backoff += time.Duration(rand.Int63n(int64(backoff)/2 + 1))
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+			backoff = time.Duration(seconds) * time.Second
+		}
+		return backoff, backoff <= r.maxWait
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		if req.Method == http.MethodPost {
+			return 0, false
+		}
+		if backoff > r.maxWait {
+			backoff = r.maxWait
+		}
+		return backoff, true
+	}
+	return 0, false
+}
+
+// sleep waits d, or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryTransport retries requests as its Retrier says
+type retryTransport struct {
+	retrier *Retrier
+	next    http.RoundTripper
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attempt := req
+	for n := 0; ; n++ {
+		resp, err := t.next.RoundTrip(attempt)
+		if err != nil {
+			return nil, err
+		}
+		wait, ok := t.retrier.wait(req, resp, n)
+		if !ok {
+			return resp, nil
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		atomic.AddInt64(&t.retrier.retries, 1)
+		if resp.StatusCode == http.StatusTooManyRequests {
+			atomic.AddInt64(&t.retrier.rateLimited, 1)
+		}
+		log.WithFields(log.Fields{"method": req.Method, "path": req.URL.Path, "status": resp.StatusCode, "wait": wait.String(), "retry": n + 1}).Warn("retrying Spotify API request")
+		if err := t.retrier.sleep(req.Context(), wait); err != nil {
+			return nil, err
+		}
+		attempt = req.Clone(req.Context())
+		if req.GetBody != nil {
+			if attempt.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
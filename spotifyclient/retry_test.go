@@ -0,0 +1,124 @@
+package spotifyclient
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetrier(t *testing.T) {
+	testCases := []struct {
+		name string
+		// responses are the statuses served in turn, with a Retry-After of
+		// the number after a colon
+		responses   []string
+		method      string
+		status      int
+		attempts    int
+		waits       []time.Duration
+		rateLimited int64
+	}{
+		{name: "rate limited", responses: []string{"429:3", "429:1", "200"}, method: http.MethodGet, status: 200, attempts: 3, waits: []time.Duration{3 * time.Second, time.Second}, rateLimited: 2},
+		{name: "rate limited POST", responses: []string{"429:2", "201"}, method: http.MethodPost, status: 201, attempts: 2, waits: []time.Duration{2 * time.Second}, rateLimited: 1},
+		{name: "retry after too long", responses: []string{"429:3600", "200"}, method: http.MethodGet, status: 429, attempts: 1},
+		{name: "transient", responses: []string{"503", "502", "200"}, method: http.MethodDelete, status: 200, attempts: 3, waits: []time.Duration{time.Second, 2 * time.Second}},
+		{name: "transient POST", responses: []string{"500", "201"}, method: http.MethodPost, status: 500, attempts: 1},
+		{name: "client error", responses: []string{"404"}, method: http.MethodGet, status: 404, attempts: 1},
+		{name: "retries run out", responses: []string{"503", "503", "503", "200"}, method: http.MethodGet, status: 503, attempts: 3, waits: []time.Duration{time.Second, 2 * time.Second}},
+	}
+	for _, tc := range testCases {
+		attempts := 0
+		bodies := []string{}
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			bodies = append(bodies, string(body))
+			parts := strings.SplitN(tc.responses[attempts], ":", 2)
+			attempts++
+			if len(parts) == 2 {
+				w.Header().Set("Retry-After", parts[1])
+			}
+			switch parts[0] {
+			case "200":
+				w.WriteHeader(http.StatusOK)
+			case "201":
+				w.WriteHeader(http.StatusCreated)
+			case "404":
+				w.WriteHeader(http.StatusNotFound)
+			case "429":
+				w.WriteHeader(http.StatusTooManyRequests)
+			case "500":
+				w.WriteHeader(http.StatusInternalServerError)
+			case "502":
+				w.WriteHeader(http.StatusBadGateway)
+			case "503":
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+		r, err := NewRetrier(RetryConfig{MaxRetries: 2, BackoffMs: 1000})
+		if err != nil {
+			t.Fatal(err)
+		}
+		waits := []time.Duration{}
+		r.sleep = func(ctx context.Context, d time.Duration) error {
+			// Drop the jitter
+			waits = append(waits, d.Truncate(time.Second))
+			return nil
+		}
+		req, err := http.NewRequest(tc.method, srv.URL, strings.NewReader("body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := r.HTTPClient(&http.Client{}).Do(req)
+		srv.Close()
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status || attempts != tc.attempts {
+			t.Errorf("%s failed: expected %d after %d attempts, got %d after %d", tc.name, tc.status, tc.attempts, resp.StatusCode, attempts)
+		}
+		if strings.Join(durations(waits), ",") != strings.Join(durations(tc.waits), ",") {
+			t.Errorf("%s failed: expected waits %v, got %v", tc.name, tc.waits, waits)
+		}
+		if r.Retries() != int64(len(tc.waits)) || r.RateLimited() != tc.rateLimited {
+			t.Errorf("%s failed: expected %d retries, %d rate limited, got %d, %d", tc.name, len(tc.waits), tc.rateLimited, r.Retries(), r.RateLimited())
+		}
+		for _, body := range bodies {
+			if body != "body" {
+				t.Errorf("%s failed: expected every attempt to send the body, got %q", tc.name, bodies)
+			}
+		}
+	}
+}
+
+func TestRetrierBackoff(t *testing.T) {
+	if _, err := NewRetrier(RetryConfig{MaxRetries: 100}); err == nil {
+		t.Errorf("expected maxRetries over %d to be rejected", maxMaxRetries)
+	}
+	r, err := NewRetrier(RetryConfig{MaxRetries: maxMaxRetries, BackoffMs: 1000, MaxWaitSec: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	resp := &http.Response{StatusCode: http.StatusServiceUnavailable}
+	// Past 63 doublings an uncapped backoff overflows
+	for _, attempt := range []int{0, 6, 40, 70} {
+		r.maxRetries = attempt + 1
+		wait, ok := r.wait(req, resp, attempt)
+		if !ok || wait < time.Second || wait > time.Minute {
+			t.Errorf("attempt %d failed: expected a wait between 1s and 1m, got %s, %t", attempt, wait, ok)
+		}
+	}
+}
+
+func durations(ds []time.Duration) []string {
+	s := []string{}
+	for _, d := range ds {
+		s = append(s, d.String())
+	}
+	return s
+}
@@ -0,0 +1,145 @@
+// Package spotifyclient wraps the Spotify client library with the Web API
+// calls potentials-utils needs that the library doesn't support.
+package spotifyclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// BaseURL is the root of the Spotify Web API
+const BaseURL = "https://api.spotify.com/v1/"
+
+const (
+	// maxAlbumsPerRequest is the most albums the API returns in one request
+	maxAlbumsPerRequest = 20
+	// maxArtistsPerRequest is the most artists the API returns in one request
+	maxArtistsPerRequest = 50
+)
+
+// Client is a Spotify client with a few extra API calls
+type Client struct {
+	*spotify.Client
+	http *http.Client
+}
+
+// New creates a Client making requests through an authenticated HTTP client
+func New(httpClient *http.Client) *Client {
+	return &Client{
+		Client: spotify.New(httpClient),
+		http:   httpClient,
+	}
+}
+
+// AlbumLabels returns the record label of each of the given albums, keyed by
+// album ID. Albums Spotify doesn't know are left out.
+func (c *Client) AlbumLabels(ctx context.Context, ids ...spotify.ID) (map[spotify.ID]string, error) {
+	labels := map[spotify.ID]string{}
+	for len(ids) > 0 {
+		n := maxAlbumsPerRequest
+		if len(ids) < n {
+			n = len(ids)
+		}
+		var chunk []string
+		for _, id := range ids[:n] {
+			chunk = append(chunk, string(id))
+		}
+		ids = ids[n:]
+
+		var resp struct {
+			Albums []*struct {
+				ID    spotify.ID `json:"id"`
+				Label string     `json:"label"`
+			} `json:"albums"`
+		}
+		if err := c.get(ctx, BaseURL+"albums?ids="+strings.Join(chunk, ","), &resp); err != nil {
+			return nil, err
+		}
+		for _, a := range resp.Albums {
+			if a != nil {
+				labels[a.ID] = a.Label
+			}
+		}
+	}
+	return labels, nil
+}
+
+// ArtistGenres returns the genres Spotify associates with each of the given
+// artists, keyed by artist ID
+func (c *Client) ArtistGenres(ctx context.Context, ids ...spotify.ID) (map[spotify.ID][]string, error) {
+	genres := map[spotify.ID][]string{}
+	for len(ids) > 0 {
+		n := maxArtistsPerRequest
+		if len(ids) < n {
+			n = len(ids)
+		}
+		artists, err := c.GetArtists(ctx, ids[:n]...)
+		if err != nil {
+			return nil, err
+		}
+		ids = ids[n:]
+		for _, a := range artists {
+			if a != nil {
+				genres[a.ID] = a.Genres
+			}
+		}
+	}
+	return genres, nil
+}
+
+// InsertTracksIntoPlaylist adds tracks to a playlist starting at position,
+// which the client library's AddTracksToPlaylist can't do
+func (c *Client) InsertTracksIntoPlaylist(ctx context.Context, playlistID spotify.ID, position int, trackIDs ...spotify.ID) (string, error) {
+	uris := []string{}
+	for _, id := range trackIDs {
+		uris = append(uris, "spotify:track:"+string(id))
+	}
+	body, err := json.Marshal(map[string]interface{}{"uris": uris, "position": position})
+	if err != nil {
+		return "", err
+	}
+	url := fmt.Sprintf("%splaylists/%s/tracks", BaseURL, playlistID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("spotify: POST %s: %s: %s", url, resp.Status, strings.TrimSpace(string(body)))
+	}
+	var result struct {
+		SnapshotID string `json:"snapshot_id"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	return result.SnapshotID, err
+}
+
+func (c *Client) get(ctx context.Context, url string, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("spotify: GET %s: %s: %s", url, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
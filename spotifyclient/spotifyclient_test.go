@@ -0,0 +1,46 @@
+package spotifyclient
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"potentials-utils/spotifytest"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+func TestAlbumLabels(t *testing.T) {
+	ctx := context.Background()
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	ids := []spotify.ID{}
+	for ix := 0; ix < 25; ix++ {
+		id := spotify.ID(fmt.Sprintf("album%d", ix))
+		ids = append(ids, id)
+		if ix != 3 {
+			srv.SetAlbumLabel(id, fmt.Sprintf("Label %d", ix))
+		}
+	}
+
+	labels, err := New(srv.HTTPClient()).AlbumLabels(ctx, ids...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(labels) != 24 || labels["album24"] != "Label 24" {
+		t.Errorf("expected labels for every known album, got %v", labels)
+	}
+	if _, ok := labels["album3"]; ok {
+		t.Errorf("expected unknown album to be left out, got %v", labels)
+	}
+	albumRequests := 0
+	for _, r := range srv.Requests() {
+		if strings.HasPrefix(r, "GET /v1/albums") {
+			albumRequests++
+		}
+	}
+	if albumRequests != 2 {
+		t.Errorf("expected 25 albums to take 2 requests, got %d", albumRequests)
+	}
+}
@@ -0,0 +1,78 @@
+package spotifyclient
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"potentials-utils/metrics"
+)
+
+// ErrBudgetExceeded is returned instead of making a request once a Usage's
+// budget of API calls has been spent
+var ErrBudgetExceeded = errors.New("Spotify API call budget exceeded")
+
+// Usage counts the requests made to the Spotify API and optionally limits
+// them. It's safe for concurrent use.
+type Usage struct {
+	// Max is the most requests which may be made, unlimited if zero.
+	// Requests which modify Spotify are always made, so duplicates found
+	// before the budget ran out can still be cleaned, but are counted.
+	Max   int64
+	calls int64
+}
+
+// Calls returns how many requests have been made
+func (u *Usage) Calls() int64 {
+	return atomic.LoadInt64(&u.calls)
+}
+
+// Exceeded returns true if the budget has been spent
+func (u *Usage) Exceeded() bool {
+	return u.Max > 0 && u.Calls() >= u.Max
+}
+
+// HTTPClient returns a copy of c whose requests are counted against u, and
+// timed in r if not nil
+func (u *Usage) HTTPClient(c *http.Client, r *metrics.Registry) *http.Client {
+	counted := *c
+	next := c.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	counted.Transport = &usageTransport{
+		usage:    u,
+		next:     next,
+		duration: r.NewHistogram("potentials_spotify_request_duration_seconds", "Latency of Spotify API calls, retries included, by HTTP method and status code, or error if the call failed.", nil, "method", "code"),
+	}
+	return &counted
+}
+
+// usageTransport counts and times requests, refusing reads once the budget
+// is spent
+type usageTransport struct {
+	usage    *Usage
+	next     http.RoundTripper
+	duration *metrics.Histogram
+}
+
+func (t *usageTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	n := atomic.AddInt64(&t.usage.calls, 1)
+	if t.usage.Max > 0 && n > t.usage.Max && r.Method == http.MethodGet {
+		atomic.AddInt64(&t.usage.calls, -1)
+		if r.Body != nil {
+			r.Body.Close()
+		}
+		return nil, ErrBudgetExceeded
+	}
+	start := time.Now()
+	resp, err := t.next.RoundTrip(r)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	t.duration.Observe(time.Since(start).Seconds(), r.Method, code)
+	return resp, err
+}
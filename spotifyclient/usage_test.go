@@ -0,0 +1,39 @@
+package spotifyclient
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"potentials-utils/spotifytest"
+)
+
+func TestUsage(t *testing.T) {
+	ctx := context.Background()
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	srv.AddPlaylist("potentials", "Potentials", spotifytest.Track("t1", "Song", "Album", "Artist"))
+	usage := &Usage{Max: 2}
+	api := New(usage.HTTPClient(srv.HTTPClient(), nil))
+
+	for i := 0; i < 2; i++ {
+		if _, err := api.GetPlaylist(ctx, "potentials"); err != nil {
+			t.Fatalf("expected call %d to be within budget, got %v", i+1, err)
+		}
+	}
+	if !usage.Exceeded() {
+		t.Errorf("expected budget to be spent after %d calls", usage.Calls())
+	}
+	if _, err := api.GetPlaylist(ctx, "potentials"); !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("expected read over budget to be refused, got %v", err)
+	}
+	if _, err := api.RemoveTracksFromPlaylist(ctx, "potentials", "t1"); err != nil {
+		t.Errorf("expected removal over budget to be made, got %v", err)
+	}
+	if usage.Calls() != 3 {
+		t.Errorf("expected 3 calls to be counted, got %d", usage.Calls())
+	}
+	if n := len(srv.Requests()); n != 3 {
+		t.Errorf("expected 3 requests to reach Spotify, got %d", n)
+	}
+}
@@ -0,0 +1,776 @@
+// Package spotifytest serves an in-memory fake of the parts of the Spotify Web
+// API potentials-utils uses, so the clean and library index flows can be
+// exercised end-to-end without real credentials.
+package spotifytest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+const (
+	// apiHost is the host real Spotify API requests are sent to
+	apiHost = "api.spotify.com"
+	// UserID is the ID of the user the fake server is authenticated as
+	UserID = "testuser"
+	// defaultLibraryLimit and maxLibraryLimit are the page sizes of the saved
+	// tracks endpoint
+	defaultLibraryLimit = 20
+	maxLibraryLimit     = 50
+	// defaultPlaylistsLimit and maxPlaylistsLimit are the page sizes of the
+	// user's playlists endpoint
+	defaultPlaylistsLimit = 20
+	maxPlaylistsLimit     = 50
+	// defaultAlbumLimit and maxAlbumLimit are the page sizes of the artist
+	// albums and album tracks endpoints
+	defaultAlbumLimit = 20
+	maxAlbumLimit     = 50
+	// defaultPlaylistLimit and maxPlaylistLimit are the page sizes of the
+	// playlist tracks endpoint
+	defaultPlaylistLimit = 100
+	maxPlaylistLimit     = 100
+)
+
+// Playlist is a playlist held by the fake server
+type Playlist struct {
+	ID   spotify.ID
+	Name string
+	// Owner is the ID of the user who owns the playlist, UserID if empty
+	Owner string
+	// Collaborative playlists can be modified by users other than the owner
+	Collaborative bool
+	// SnapshotID changes every time the playlist is modified
+	SnapshotID string
+	Tracks     []spotify.PlaylistTrack
+
+	version int
+}
+
+// modified gives p a new snapshot ID
+func (p *Playlist) modified() {
+	p.version++
+	p.SnapshotID = fmt.Sprintf("snapshot%d", p.version)
+}
+
+// Server is a fake Spotify Web API. It's safe for concurrent use.
+type Server struct {
+	*httptest.Server
+	// Fault, if set, is called before every request is served and may return
+	// an HTTP status to fail the request with instead, or zero to serve it
+	Fault func(r *http.Request) int
+
+	mu        sync.Mutex
+	library   []spotify.SavedTrack
+	albums    []spotify.SavedAlbum
+	playlists map[spotify.ID]*Playlist
+	// order is the IDs of playlists in the order they were added
+	order    []spotify.ID
+	labels   map[spotify.ID]string
+	artists  map[spotify.ID]spotify.FullArtist
+	catalog  map[spotify.ID]spotify.FullTrack
+	requests []string
+	devices  []spotify.PlayerDevice
+	// playing is the track playing, if any
+	playing *Playback
+}
+
+// Playback is what the fake player is playing
+type Playback struct {
+	DeviceID   spotify.ID
+	TrackID    spotify.ID
+	PositionMs int
+	Paused     bool
+}
+
+// NewServer starts a Server with an empty library. Stop it with Close.
+func NewServer() *Server {
+	s := &Server{
+		playlists: map[spotify.ID]*Playlist{},
+		labels:    map[spotify.ID]string{},
+		artists:   map[spotify.ID]spotify.FullArtist{},
+		catalog:   map[spotify.ID]spotify.FullTrack{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// HTTPClient returns a client which sends requests for the real Spotify API to
+// the fake server instead
+func (s *Server) HTTPClient() *http.Client {
+	return &http.Client{Transport: &rewriteTransport{target: s.URL}}
+}
+
+// Client returns a Spotify client talking to the fake server
+func (s *Server) Client() *spotify.Client {
+	return spotify.New(s.HTTPClient())
+}
+
+// AddSavedTracks saves tracks to the user's library
+func (s *Server) AddSavedTracks(tracks ...spotify.FullTrack) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range tracks {
+		s.library = append(s.library, spotify.SavedTrack{AddedAt: "2020-01-01T00:00:00Z", FullTrack: t})
+	}
+}
+
+// SaveTracksAt saves tracks to the user's library at the given time, so like
+// Spotify the last ends up first in the library
+func (s *Server) SaveTracksAt(at time.Time, tracks ...spotify.FullTrack) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range tracks {
+		saved := spotify.SavedTrack{AddedAt: at.UTC().Format(spotify.TimestampLayout), FullTrack: t}
+		s.library = append([]spotify.SavedTrack{saved}, s.library...)
+	}
+}
+
+// AddSavedAlbums saves albums to the user's library
+func (s *Server) AddSavedAlbums(albums ...spotify.SimpleAlbum) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range albums {
+		s.albums = append(s.albums, spotify.SavedAlbum{AddedAt: "2020-01-01T00:00:00Z", FullAlbum: spotify.FullAlbum{SimpleAlbum: a}})
+	}
+}
+
+// RemoveSavedTracks removes tracks from the user's library
+func (s *Server) RemoveSavedTracks(ids ...spotify.ID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeSavedTracks(ids)
+}
+
+func (s *Server) removeSavedTracks(ids []spotify.ID) {
+	remove := map[spotify.ID]bool{}
+	for _, id := range ids {
+		remove[id] = true
+	}
+	kept := []spotify.SavedTrack{}
+	for _, t := range s.library {
+		if !remove[t.ID] {
+			kept = append(kept, t)
+		}
+	}
+	s.library = kept
+}
+
+// AddPlaylist creates a playlist holding tracks, replacing any playlist with
+// the same ID
+func (s *Server) AddPlaylist(id spotify.ID, name string, tracks ...spotify.FullTrack) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := &Playlist{ID: id, Name: name}
+	for _, t := range tracks {
+		p.Tracks = append(p.Tracks, spotify.PlaylistTrack{AddedAt: "2020-01-01T00:00:00Z", AddedBy: spotify.User{ID: UserID}, Track: t})
+	}
+	if old, ok := s.playlists[id]; ok {
+		p.version, p.Owner = old.version, old.Owner
+	} else {
+		s.order = append(s.order, id)
+	}
+	p.modified()
+	s.playlists[id] = p
+}
+
+// AddTracks makes tracks available from the catalog without saving them or
+// adding them to a playlist
+func (s *Server) AddTracks(tracks ...spotify.FullTrack) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range tracks {
+		s.catalog[t.ID] = t
+	}
+}
+
+// SetPlaylistOwner makes a playlist one the user follows but someone else
+// owns
+func (s *Server) SetPlaylistOwner(id spotify.ID, owner string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.playlists[id]; ok {
+		p.Owner = owner
+	}
+}
+
+// SetAddedBy credits every entry of a track in a playlist to another user, as
+// if they'd added it to a collaborative playlist
+func (s *Server) SetAddedBy(id, trackID spotify.ID, user string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.playlists[id]; ok {
+		for ix := range p.Tracks {
+			if p.Tracks[ix].Track.ID == trackID {
+				p.Tracks[ix].AddedBy = spotify.User{ID: user}
+			}
+		}
+	}
+}
+
+// SetAddedByAt credits the entry at position in a playlist to another user,
+// leaving other entries of the same track as they were
+func (s *Server) SetAddedByAt(id spotify.ID, position int, user string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.playlists[id]; ok && position < len(p.Tracks) {
+		p.Tracks[position].AddedBy = spotify.User{ID: user}
+	}
+}
+
+// SetPlaylistCollaborative lets users other than the owner modify a playlist
+func (s *Server) SetPlaylistCollaborative(id spotify.ID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.playlists[id]; ok {
+		p.Collaborative = true
+	}
+}
+
+// SetAlbumLabel sets the record label of an album
+func (s *Server) SetAlbumLabel(albumID spotify.ID, label string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.labels[albumID] = label
+}
+
+// AddArtist makes an artist's full profile, including genres, available
+func (s *Server) AddArtist(a spotify.FullArtist) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.artists[a.ID] = a
+}
+
+// PlaylistTrackIDs returns the IDs of the tracks currently in a playlist, in
+// order
+func (s *Server) PlaylistTrackIDs(id spotify.ID) []spotify.ID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.playlists[id]
+	if !ok {
+		return nil
+	}
+	ids := []spotify.ID{}
+	for _, t := range p.Tracks {
+		ids = append(ids, t.Track.ID)
+	}
+	return ids
+}
+
+// SavedTrackIDs returns the IDs of the tracks in the user's library, most
+// recently saved first
+func (s *Server) SavedTrackIDs() []spotify.ID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := []spotify.ID{}
+	for _, t := range s.library {
+		ids = append(ids, t.ID)
+	}
+	return ids
+}
+
+// Requests returns every request served so far as "METHOD /path?query"
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+// AddDevice adds a device the user can play on
+func (s *Server) AddDevice(d spotify.PlayerDevice) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.devices = append(s.devices, d)
+}
+
+// Playing returns what the player is playing, nil if it has never played
+func (s *Server) Playing() *Playback {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.playing == nil {
+		return nil
+	}
+	p := *s.playing
+	return &p
+}
+
+// Track builds a track with an album and artists, deriving the album and
+// artist IDs from their names
+func Track(id, name, album string, artists ...string) spotify.FullTrack {
+	t := spotify.FullTrack{
+		SimpleTrack: spotify.SimpleTrack{ID: spotify.ID(id), Name: name, URI: spotify.URI("spotify:track:" + id)},
+		Album:       spotify.SimpleAlbum{ID: nameID(album), Name: album},
+	}
+	for _, a := range artists {
+		artist := spotify.SimpleArtist{ID: nameID(a), Name: a}
+		t.Artists = append(t.Artists, artist)
+		t.Album.Artists = append(t.Album.Artists, artist)
+	}
+	return t
+}
+
+func nameID(name string) spotify.ID {
+	return spotify.ID(strings.ToLower(strings.Replace(name, " ", "", -1)))
+}
+
+// rewriteTransport sends requests for the real Spotify API to target
+type rewriteTransport struct {
+	target string
+}
+
+func (t *rewriteTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Host == apiHost {
+		target, err := url.Parse(t.target)
+		if err != nil {
+			return nil, err
+		}
+		r = r.Clone(r.Context())
+		r.URL.Scheme, r.URL.Host, r.Host = target.Scheme, target.Host, target.Host
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.RequestURI())
+	s.mu.Unlock()
+	if s.Fault != nil {
+		if status := s.Fault(r); status != 0 {
+			writeError(w, status, "injected fault")
+			return
+		}
+	}
+
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1"), "/"), "/")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case r.Method == http.MethodGet && len(path) == 1 && path[0] == "me":
+		writeJSON(w, http.StatusOK, spotify.PrivateUser{User: spotify.User{ID: UserID}})
+	case r.Method == http.MethodGet && len(path) == 2 && path[0] == "me" && path[1] == "playlists":
+		s.serveUserPlaylists(w, r)
+	case r.Method == http.MethodGet && len(path) == 2 && path[0] == "me" && path[1] == "tracks":
+		s.serveLibrary(w, r)
+	case r.Method == http.MethodPut && len(path) == 2 && path[0] == "me" && path[1] == "tracks":
+		s.saveTracks(w, r)
+	case r.Method == http.MethodDelete && len(path) == 2 && path[0] == "me" && path[1] == "tracks":
+		ids := []spotify.ID{}
+		for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+			ids = append(ids, spotify.ID(id))
+		}
+		s.removeSavedTracks(ids)
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodGet && len(path) == 2 && path[0] == "me" && path[1] == "albums":
+		s.serveSavedAlbums(w, r)
+	case r.Method == http.MethodGet && len(path) == 3 && path[0] == "me" && path[1] == "tracks" && path[2] == "contains":
+		s.serveLibraryContains(w, r)
+	case r.Method == http.MethodPost && len(path) == 3 && path[0] == "users" && path[2] == "playlists":
+		s.createPlaylist(w, r, path[1])
+	case r.Method == http.MethodGet && len(path) == 2 && path[0] == "playlists":
+		s.servePlaylist(w, r, spotify.ID(path[1]))
+	case len(path) == 3 && path[0] == "playlists" && path[2] == "tracks":
+		s.servePlaylistTracks(w, r, spotify.ID(path[1]))
+	case r.Method == http.MethodGet && len(path) == 1 && path[0] == "tracks":
+		s.serveTracks(w, r)
+	case r.Method == http.MethodGet && len(path) == 3 && path[0] == "artists" && path[2] == "albums":
+		s.serveArtistAlbums(w, r, spotify.ID(path[1]))
+	case r.Method == http.MethodGet && len(path) == 3 && path[0] == "albums" && path[2] == "tracks":
+		s.serveAlbumTracks(w, r, spotify.ID(path[1]))
+	case r.Method == http.MethodGet && len(path) == 1 && path[0] == "albums":
+		s.serveAlbums(w, r)
+	case r.Method == http.MethodGet && len(path) == 1 && path[0] == "artists":
+		s.serveArtists(w, r)
+	case r.Method == http.MethodGet && len(path) == 3 && path[0] == "me" && path[1] == "player" && path[2] == "devices":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"devices": s.devices})
+	case r.Method == http.MethodPut && len(path) == 3 && path[0] == "me" && path[1] == "player" && path[2] == "play":
+		s.play(w, r)
+	case r.Method == http.MethodPut && len(path) == 3 && path[0] == "me" && path[1] == "player" && path[2] == "pause":
+		if s.playing == nil {
+			writeError(w, http.StatusNotFound, "nothing playing")
+			return
+		}
+		s.playing.Paused = true
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotFound, "unknown endpoint "+r.URL.Path)
+	}
+}
+
+// pageBounds returns the offset and limit of a paged request, and the URL of
+// the following page if there is one
+func (s *Server) pageBounds(r *http.Request, total, defaultLimit, maxLimit int) (offset, limit int, next string) {
+	q := r.URL.Query()
+	offset, _ = strconv.Atoi(q.Get("offset"))
+	limit, _ = strconv.Atoi(q.Get("limit"))
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+	if offset > total {
+		offset = total
+	}
+	if offset+limit < total {
+		q.Set("offset", strconv.Itoa(offset+limit))
+		q.Set("limit", strconv.Itoa(limit))
+		next = fmt.Sprintf("%s%s?%s", s.URL, r.URL.Path, q.Encode())
+	}
+	return offset, limit, next
+}
+
+func (s *Server) serveLibraryContains(w http.ResponseWriter, r *http.Request) {
+	saved := map[spotify.ID]bool{}
+	for _, t := range s.library {
+		saved[t.ID] = true
+	}
+	contains := []bool{}
+	for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		contains = append(contains, saved[spotify.ID(id)])
+	}
+	writeJSON(w, http.StatusOK, contains)
+}
+
+// saveTracks saves each track in turn, so like Spotify the last ends up
+// first in the library
+func (s *Server) saveTracks(w http.ResponseWriter, r *http.Request) {
+	for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		saved := spotify.SavedTrack{AddedAt: "2020-01-01T00:00:00Z", FullTrack: s.findTrack(spotify.ID(id))}
+		s.library = append([]spotify.SavedTrack{saved}, s.library...)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) serveLibrary(w http.ResponseWriter, r *http.Request) {
+	offset, limit, next := s.pageBounds(r, len(s.library), defaultLibraryLimit, maxLibraryLimit)
+	page := spotify.SavedTrackPage{Tracks: s.library[offset:min(offset+limit, len(s.library))]}
+	page.Limit, page.Offset, page.Total, page.Next = spotify.Numeric(limit), spotify.Numeric(offset), spotify.Numeric(len(s.library)), next
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (s *Server) serveSavedAlbums(w http.ResponseWriter, r *http.Request) {
+	offset, limit, next := s.pageBounds(r, len(s.albums), defaultLibraryLimit, maxLibraryLimit)
+	page := spotify.SavedAlbumPage{Albums: s.albums[offset:min(offset+limit, len(s.albums))]}
+	page.Limit, page.Offset, page.Total, page.Next = spotify.Numeric(limit), spotify.Numeric(offset), spotify.Numeric(len(s.albums)), next
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (s *Server) playlistTrackPage(r *http.Request, p *Playlist) spotify.PlaylistTrackPage {
+	offset, limit, next := s.pageBounds(r, len(p.Tracks), defaultPlaylistLimit, maxPlaylistLimit)
+	page := spotify.PlaylistTrackPage{Tracks: p.Tracks[offset:min(offset+limit, len(p.Tracks))]}
+	page.Limit, page.Offset, page.Total, page.Next = spotify.Numeric(limit), spotify.Numeric(offset), spotify.Numeric(len(p.Tracks)), next
+	// The first page embedded in a playlist links to the tracks endpoint
+	if page.Next != "" && !strings.HasSuffix(r.URL.Path, "/tracks") {
+		page.Next = strings.Replace(page.Next, r.URL.Path, r.URL.Path+"/tracks", 1)
+	}
+	return page
+}
+
+func (s *Server) servePlaylist(w http.ResponseWriter, r *http.Request, id spotify.ID) {
+	p, ok := s.playlists[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Invalid playlist Id")
+		return
+	}
+	playlist := spotify.FullPlaylist{
+		SimplePlaylist: simplePlaylist(p),
+		Tracks:         s.playlistTrackPage(r, p),
+	}
+	writeJSON(w, http.StatusOK, playlist)
+}
+
+func (s *Server) createPlaylist(w http.ResponseWriter, r *http.Request, user string) {
+	if user != UserID {
+		writeError(w, http.StatusForbidden, "You cannot create a playlist for another user")
+		return
+	}
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	p := &Playlist{ID: spotify.ID(fmt.Sprintf("created%d", len(s.order)+1)), Name: body.Name}
+	p.modified()
+	s.playlists[p.ID] = p
+	s.order = append(s.order, p.ID)
+	writeJSON(w, http.StatusCreated, spotify.FullPlaylist{SimplePlaylist: simplePlaylist(p)})
+}
+
+func simplePlaylist(p *Playlist) spotify.SimplePlaylist {
+	owner := p.Owner
+	if owner == "" {
+		owner = UserID
+	}
+	return spotify.SimplePlaylist{
+		ID:            p.ID,
+		Name:          p.Name,
+		Owner:         spotify.User{ID: owner},
+		Collaborative: p.Collaborative,
+		SnapshotID:    p.SnapshotID,
+		Tracks:        spotify.PlaylistTracks{Total: spotify.Numeric(len(p.Tracks))},
+	}
+}
+
+func (s *Server) serveUserPlaylists(w http.ResponseWriter, r *http.Request) {
+	offset, limit, next := s.pageBounds(r, len(s.order), defaultPlaylistsLimit, maxPlaylistsLimit)
+	page := spotify.SimplePlaylistPage{Playlists: []spotify.SimplePlaylist{}}
+	for _, id := range s.order[offset:min(offset+limit, len(s.order))] {
+		page.Playlists = append(page.Playlists, simplePlaylist(s.playlists[id]))
+	}
+	page.Limit, page.Offset, page.Total, page.Next = spotify.Numeric(limit), spotify.Numeric(offset), spotify.Numeric(len(s.order)), next
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (s *Server) servePlaylistTracks(w http.ResponseWriter, r *http.Request, id spotify.ID) {
+	p, ok := s.playlists[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Invalid playlist Id")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.playlistTrackPage(r, p))
+	case http.MethodPost:
+		var body struct {
+			URIs     []string `json:"uris"`
+			Position *int     `json:"position"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		added := []spotify.PlaylistTrack{}
+		for _, uri := range body.URIs {
+			added = append(added, spotify.PlaylistTrack{AddedBy: spotify.User{ID: UserID}, Track: s.findTrack(uriID(uri))})
+		}
+		position := len(p.Tracks)
+		if body.Position != nil {
+			if *body.Position < 0 || *body.Position > len(p.Tracks) {
+				writeError(w, http.StatusBadRequest, "Index out of bounds")
+				return
+			}
+			position = *body.Position
+		}
+		p.Tracks = append(p.Tracks[:position], append(added, p.Tracks[position:]...)...)
+		p.modified()
+		writeJSON(w, http.StatusCreated, map[string]string{"snapshot_id": p.SnapshotID})
+	case http.MethodDelete:
+		var body struct {
+			Tracks []struct {
+				URI       string `json:"uri"`
+				Positions []int  `json:"positions"`
+			} `json:"tracks"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		// Tracks given positions are only removed from those, the rest
+		// wherever they are
+		remove, removeAt := map[spotify.ID]bool{}, map[int]bool{}
+		for _, t := range body.Tracks {
+			if len(t.Positions) == 0 {
+				remove[uriID(t.URI)] = true
+			}
+			for _, pos := range t.Positions {
+				if pos < 0 || pos >= len(p.Tracks) || p.Tracks[pos].Track.ID != uriID(t.URI) {
+					writeError(w, http.StatusBadRequest, "Could not remove tracks, please check parameters.")
+					return
+				}
+				removeAt[pos] = true
+			}
+		}
+		kept := []spotify.PlaylistTrack{}
+		for ix, t := range p.Tracks {
+			if !remove[t.Track.ID] && !removeAt[ix] {
+				kept = append(kept, t)
+			}
+		}
+		p.Tracks = kept
+		p.modified()
+		writeJSON(w, http.StatusOK, map[string]string{"snapshot_id": p.SnapshotID})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// findTrack looks a track up by ID in the library, every playlist and the
+// catalog, returning a track with only an ID if it's unknown
+func (s *Server) findTrack(id spotify.ID) spotify.FullTrack {
+	if t, ok := s.lookupTrack(id); ok {
+		return t
+	}
+	return spotify.FullTrack{SimpleTrack: spotify.SimpleTrack{ID: id}}
+}
+
+func (s *Server) lookupTrack(id spotify.ID) (spotify.FullTrack, bool) {
+	for _, t := range s.library {
+		if t.ID == id {
+			return t.FullTrack, true
+		}
+	}
+	for _, p := range s.playlists {
+		for _, t := range p.Tracks {
+			if t.Track.ID == id {
+				return t.Track, true
+			}
+		}
+	}
+	t, ok := s.catalog[id]
+	return t, ok
+}
+
+func (s *Server) serveTracks(w http.ResponseWriter, r *http.Request) {
+	tracks := []*spotify.FullTrack{}
+	for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if t, ok := s.lookupTrack(spotify.ID(id)); ok {
+			tracks = append(tracks, &t)
+		} else {
+			tracks = append(tracks, nil)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"tracks": tracks})
+}
+
+// knownTracks returns every track in the library, playlists and catalog
+// once, ordered by ID
+func (s *Server) knownTracks() []spotify.FullTrack {
+	byID := map[spotify.ID]spotify.FullTrack{}
+	for _, t := range s.library {
+		byID[t.ID] = t.FullTrack
+	}
+	for _, p := range s.playlists {
+		for _, t := range p.Tracks {
+			byID[t.Track.ID] = t.Track
+		}
+	}
+	for id, t := range s.catalog {
+		byID[id] = t
+	}
+	tracks := []spotify.FullTrack{}
+	for _, t := range byID {
+		tracks = append(tracks, t)
+	}
+	sort.Slice(tracks, func(i, j int) bool { return tracks[i].ID < tracks[j].ID })
+	return tracks
+}
+
+// serveArtistAlbums serves the albums of every known track credited to the
+// artist
+func (s *Server) serveArtistAlbums(w http.ResponseWriter, r *http.Request, id spotify.ID) {
+	albums, seen := []spotify.SimpleAlbum{}, map[spotify.ID]bool{}
+	for _, t := range s.knownTracks() {
+		for _, a := range t.Album.Artists {
+			if a.ID == id && !seen[t.Album.ID] {
+				albums = append(albums, t.Album)
+				seen[t.Album.ID] = true
+			}
+		}
+	}
+	offset, limit, next := s.pageBounds(r, len(albums), defaultAlbumLimit, maxAlbumLimit)
+	page := spotify.SimpleAlbumPage{Albums: albums[offset:min(offset+limit, len(albums))]}
+	page.Limit, page.Offset, page.Total, page.Next = spotify.Numeric(limit), spotify.Numeric(offset), spotify.Numeric(len(albums)), next
+	writeJSON(w, http.StatusOK, page)
+}
+
+// serveAlbumTracks serves every known track on the album
+func (s *Server) serveAlbumTracks(w http.ResponseWriter, r *http.Request, id spotify.ID) {
+	tracks := []spotify.SimpleTrack{}
+	for _, t := range s.knownTracks() {
+		if t.Album.ID == id {
+			tracks = append(tracks, t.SimpleTrack)
+		}
+	}
+	offset, limit, next := s.pageBounds(r, len(tracks), defaultAlbumLimit, maxAlbumLimit)
+	page := spotify.SimpleTrackPage{Tracks: tracks[offset:min(offset+limit, len(tracks))]}
+	page.Limit, page.Offset, page.Total, page.Next = spotify.Numeric(limit), spotify.Numeric(offset), spotify.Numeric(len(tracks)), next
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (s *Server) serveAlbums(w http.ResponseWriter, r *http.Request) {
+	type album struct {
+		ID    spotify.ID `json:"id"`
+		Label string     `json:"label"`
+	}
+	albums := []*album{}
+	for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if label, ok := s.labels[spotify.ID(id)]; ok {
+			albums = append(albums, &album{ID: spotify.ID(id), Label: label})
+		} else {
+			albums = append(albums, nil)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"albums": albums})
+}
+
+func (s *Server) serveArtists(w http.ResponseWriter, r *http.Request) {
+	artists := []*spotify.FullArtist{}
+	for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if a, ok := s.artists[spotify.ID(id)]; ok {
+			artists = append(artists, &a)
+		} else {
+			artists = append(artists, nil)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"artists": artists})
+}
+
+// play plays the first track URI in the body on the device in the query,
+// making it the active device
+func (s *Server) play(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		URIs       []string `json:"uris"`
+		PositionMs int      `json:"position_ms"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.URIs) == 0 {
+		writeError(w, http.StatusBadRequest, "uris are required")
+		return
+	}
+	deviceID := spotify.ID(r.URL.Query().Get("device_id"))
+	found := false
+	for i := range s.devices {
+		s.devices[i].Active = s.devices[i].ID == deviceID
+		found = found || s.devices[i].Active
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, "device not found")
+		return
+	}
+	s.playing = &Playback{DeviceID: deviceID, TrackID: uriID(body.URIs[0]), PositionMs: body.PositionMs}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func uriID(uri string) spotify.ID {
+	return spotify.ID(uri[strings.LastIndex(uri, ":")+1:])
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError responds in the Spotify Web API's error format
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error": map[string]interface{}{"status": status, "message": msg},
+	})
+}
@@ -0,0 +1,249 @@
+// Package state bundles everything potentials-utils keeps on disk, the library
+// and playlist caches, tags, trash, undo logs and run history, into a single
+// archive, so a setup can be moved to another machine without fetching it all
+// from Spotify again.
+package state
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FormatVersion is the version of the archive format written by this package
+const FormatVersion = 1
+
+const (
+	manifestFile = "manifest.json"
+	// cachePrefix is where the cache directory's files are in the archive
+	cachePrefix = "cache/"
+	configFile  = "config.yaml"
+)
+
+// Manifest describes the contents of a state archive
+type Manifest struct {
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exportedAt"`
+	// ExportedBy is the version of potentials-utils which wrote the archive
+	ExportedBy string `json:"exportedBy"`
+	// Files are the cache files in the archive, relative to the cache
+	// directory
+	Files []string `json:"files"`
+	// Config is true if the archive includes the config file, and with it
+	// the credentials and tokens it holds
+	Config bool `json:"config"`
+}
+
+// ExportOptions configures what's exported
+type ExportOptions struct {
+	// ConfigPath is the config file to include, holding credentials and
+	// tokens. The config isn't exported if empty.
+	ConfigPath string
+	// ExportedBy is recorded in the manifest
+	ExportedBy string
+	// Exclude are cache files, relative to the cache directory, to leave
+	// out, e.g. those holding credentials
+	Exclude []string
+}
+
+// Export writes every file under cacheDir, and optionally the config file, to
+// w as a gzipped tar archive
+func Export(w io.Writer, cacheDir string, opts ExportOptions) (*Manifest, error) {
+	m := &Manifest{Version: FormatVersion, ExportedAt: time.Now().UTC(), ExportedBy: opts.ExportedBy, Files: []string{}}
+	excluded := map[string]bool{}
+	for _, f := range opts.Exclude {
+		excluded[filepath.ToSlash(filepath.Clean(f))] = true
+	}
+	err := filepath.Walk(cacheDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(cacheDir, p)
+		if err != nil {
+			return err
+		}
+		if excluded[filepath.ToSlash(rel)] {
+			return nil
+		}
+		m.Files = append(m.Files, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", cacheDir, err)
+	}
+	m.Config = opts.ConfigPath != ""
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	// The manifest goes first so importing can check it before anything else
+	if err := writeFile(tw, manifestFile, manifest, 0644); err != nil {
+		return nil, err
+	}
+	for _, f := range m.Files {
+		if err := copyFile(tw, cachePrefix+f, filepath.Join(cacheDir, filepath.FromSlash(f))); err != nil {
+			return nil, err
+		}
+	}
+	if m.Config {
+		if err := copyFile(tw, configFile, opts.ConfigPath); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func writeFile(tw *tar.Writer, name string, contents []byte, mode int64) error {
+	hdr := &tar.Header{Name: name, Mode: mode, Size: int64(len(contents)), ModTime: time.Now()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(contents)
+	return err
+}
+
+func copyFile(tw *tar.Writer, name, src string) error {
+	contents, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	return writeFile(tw, name, contents, int64(info.Mode().Perm()))
+}
+
+// ErrNotEmpty is returned importing into a cache directory which already holds
+// state, unless overwriting is allowed
+var ErrNotEmpty = errors.New("the cache directory already holds potentials-utils state")
+
+// ImportOptions configures what's imported
+type ImportOptions struct {
+	// ConfigPath is where an archived config file is written. The config
+	// isn't imported if empty.
+	ConfigPath string
+	// Overwrite replaces existing state, including an existing config file
+	Overwrite bool
+	// Exclude are cache files, relative to the cache directory, not to
+	// import
+	Exclude []string
+}
+
+// Import restores the state archived by Export from r into cacheDir, and the
+// config file to opts.ConfigPath if both it and the archive have one
+func Import(r io.Reader, cacheDir string, opts ImportOptions) (*Manifest, error) {
+	if !opts.Overwrite {
+		files, err := ioutil.ReadDir(cacheDir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if len(files) > 0 {
+			return nil, ErrNotEmpty
+		}
+		if opts.ConfigPath != "" {
+			if _, err := os.Stat(opts.ConfigPath); err == nil {
+				return nil, fmt.Errorf("%s already exists", opts.ConfigPath)
+			}
+		}
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("not a state archive: %w", err)
+	}
+	defer gz.Close()
+	excluded := map[string]bool{}
+	for _, f := range opts.Exclude {
+		excluded[path.Clean(filepath.ToSlash(f))] = true
+	}
+	tr := tar.NewReader(gz)
+	var m *Manifest
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if m == nil {
+			if m, err = readManifest(hdr, tr); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var dest string
+		switch {
+		case hdr.Name == configFile:
+			if opts.ConfigPath == "" {
+				continue
+			}
+			dest = opts.ConfigPath
+		case strings.HasPrefix(hdr.Name, cachePrefix):
+			rel := path.Clean(strings.TrimPrefix(hdr.Name, cachePrefix))
+			if path.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, "../") {
+				return nil, fmt.Errorf("refusing to import %s from outside the cache directory", hdr.Name)
+			}
+			if excluded[rel] {
+				continue
+			}
+			dest = filepath.Join(cacheDir, filepath.FromSlash(rel))
+		default:
+			continue
+		}
+		if err := extract(tr, dest, os.FileMode(hdr.Mode).Perm()); err != nil {
+			return nil, err
+		}
+	}
+	if m == nil {
+		return nil, errors.New("not a state archive: no manifest")
+	}
+	return m, nil
+}
+
+func readManifest(hdr *tar.Header, r io.Reader) (*Manifest, error) {
+	if hdr.Name != manifestFile {
+		return nil, errors.New("not a state archive: no manifest")
+	}
+	var m Manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if m.Version > FormatVersion {
+		return nil, fmt.Errorf("the archive is format version %d, this version of potentials-utils reads up to %d", m.Version, FormatVersion)
+	}
+	return &m, nil
+}
+
+func extract(r io.Reader, dest string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(dest), os.FileMode(uint32(0755))); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,140 @@
+package state
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestExportImport(t *testing.T) {
+	from := tempDir(t)
+	defer os.RemoveAll(from)
+	files := map[string]string{
+		"library.json":              `{"tracks": []}`,
+		"tags.json":                 `{}`,
+		"removals.json":             `[]`,
+		"playlists/potentials.json": `{"id": "potentials"}`,
+	}
+	for name, contents := range files {
+		p := filepath.Join(from, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := filepath.Join(from, "..", filepath.Base(from)+".yaml")
+	if err := ioutil.WriteFile(cfg, []byte("spotify:\n    secret: s\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(cfg)
+
+	archive := &bytes.Buffer{}
+	m, err := Export(archive, from, ExportOptions{ConfigPath: cfg, ExportedBy: "v1.2.3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(m.Files)
+	expectedFiles := []string{"library.json", "playlists/potentials.json", "removals.json", "tags.json"}
+	if !reflect.DeepEqual(m.Files, expectedFiles) || !m.Config {
+		t.Errorf("unexpected manifest %+v", m)
+	}
+
+	to := tempDir(t)
+	defer os.RemoveAll(to)
+	importedCfg := filepath.Join(to, "config.yaml")
+	cacheDir := filepath.Join(to, "cache")
+	imported, err := Import(bytes.NewReader(archive.Bytes()), cacheDir, ImportOptions{ConfigPath: importedCfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.ExportedBy != "v1.2.3" || len(imported.Files) != len(files) {
+		t.Errorf("unexpected imported manifest %+v", imported)
+	}
+	for name, contents := range files {
+		got, err := ioutil.ReadFile(filepath.Join(cacheDir, name))
+		if err != nil || string(got) != contents {
+			t.Errorf("expected %s to be imported as %q, got %q, %v", name, contents, got, err)
+		}
+	}
+	if info, err := os.Stat(importedCfg); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected the config to be imported readable only by its owner, got %v, %v", info, err)
+	}
+
+	if _, err := Import(bytes.NewReader(archive.Bytes()), cacheDir, ImportOptions{}); err != ErrNotEmpty {
+		t.Errorf("expected importing over existing state to fail, got %v", err)
+	}
+	if _, err := Import(bytes.NewReader(archive.Bytes()), cacheDir, ImportOptions{Overwrite: true}); err != nil {
+		t.Errorf("expected overwriting existing state to succeed, got %v", err)
+	}
+
+	os.Remove(filepath.Join(cacheDir, "removals.json"))
+	if _, err := Import(bytes.NewReader(archive.Bytes()), cacheDir, ImportOptions{Overwrite: true, Exclude: []string{"removals.json"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "removals.json")); !os.IsNotExist(err) {
+		t.Errorf("expected an excluded file not to be imported, got %v", err)
+	}
+	m, err = Export(&bytes.Buffer{}, from, ExportOptions{Exclude: []string{"tags.json", "playlists/potentials.json"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(m.Files)
+	if !reflect.DeepEqual(m.Files, []string{"library.json", "removals.json"}) {
+		t.Errorf("expected excluded files left out of the export, got %v", m.Files)
+	}
+}
+
+func TestImportInvalid(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	archive := func(names ...string) []byte {
+		b := &bytes.Buffer{}
+		gz := gzip.NewWriter(b)
+		tw := tar.NewWriter(gz)
+		for _, name := range names {
+			contents := []byte("{}")
+			if name == manifestFile {
+				contents = []byte(`{"version": 1}`)
+			}
+			writeFile(tw, name, contents, 0644)
+		}
+		tw.Close()
+		gz.Close()
+		return b.Bytes()
+	}
+	testCases := []struct {
+		name     string
+		archive  []byte
+		expected string
+	}{
+		{name: "not gzipped", archive: []byte("state"), expected: "not a state archive"},
+		{name: "no manifest", archive: archive("cache/library.json"), expected: "no manifest"},
+		{name: "escapes the cache", archive: archive(manifestFile, "cache/../../evil.json"), expected: "outside the cache directory"},
+	}
+	for _, tc := range testCases {
+		_, err := Import(bytes.NewReader(tc.archive), filepath.Join(dir, "cache"), ImportOptions{})
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("%s failed: expected an error containing %q, got %v", tc.name, tc.expected, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "evil.json")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be written outside the cache directory")
+	}
+}
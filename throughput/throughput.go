@@ -0,0 +1,269 @@
+// Package throughput records how long tracks spend in Potentials before
+// they're promoted to the library or removed, and summarizes it as an aging
+// curve and throughput metrics.
+package throughput
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"potentials-utils/dedupe"
+	"potentials-utils/library"
+	"potentials-utils/listenbrainz"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+const day = 24 * time.Hour
+
+// Event is a track leaving a playlist
+type Event struct {
+	TrackID spotify.ID `json:"trackID"`
+	// Track describes the track for people
+	Track string `json:"track"`
+	// Matcher is the matcher which found the track a duplicate
+	Matcher string `json:"matcher"`
+	// AddedAt is when the track was added to the playlist, i.e. first seen
+	AddedAt   time.Time `json:"addedAt"`
+	RemovedAt time.Time `json:"removedAt"`
+}
+
+// Promoted returns whether the track left because it was saved to the
+// library, rather than because it had been heard enough
+func (e Event) Promoted() bool {
+	return e.Matcher != listenbrainz.MatcherName
+}
+
+// Days returns how many days the track was in the playlist
+func (e Event) Days() float64 {
+	return e.RemovedAt.Sub(e.AddedAt).Hours() / 24
+}
+
+// Log is a dedupe.Promotions recording every track promoted or removed out of
+// a playlist in a JSON file
+type Log struct {
+	path string
+	mu   sync.Mutex
+	now  func() time.Time
+}
+
+var _ dedupe.Promotions = (*Log)(nil)
+
+// NewLog creates a Log persisted at path. The file is created on the first
+// write.
+func NewLog(path string) *Log {
+	return &Log{path: path, now: time.Now}
+}
+
+// Promoted records each duplicate leaving the playlist now. Duplicates whose
+// added time Spotify didn't report can't be aged, so are skipped.
+func (l *Log) Promoted(ctx context.Context, duplicates []dedupe.Duplicate) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	events, err := l.load()
+	if err != nil {
+		return err
+	}
+	now := l.now()
+	for _, d := range duplicates {
+		addedAt, err := time.Parse(spotify.TimestampLayout, d.Track.AddedAt)
+		if err != nil {
+			continue
+		}
+		events = append(events, Event{
+			TrackID:   d.Track.Track.ID,
+			Track:     library.TrackString(d.Track.Track),
+			Matcher:   d.Matcher,
+			AddedAt:   addedAt,
+			RemovedAt: now,
+		})
+	}
+	bytes, err := json.MarshalIndent(events, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(l.path, bytes, 0644)
+}
+
+// Events returns everything recorded, oldest first
+func (l *Log) Events() ([]Event, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.load()
+}
+
+func (l *Log) load() ([]Event, error) {
+	events := []Event{}
+	slurp, err := ioutil.ReadFile(l.path)
+	if os.IsNotExist(err) {
+		return events, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(slurp, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// AgeBucket counts the tracks in a playlist added within an age range
+type AgeBucket struct {
+	// MaxDays is the upper bound of the range, or 0 for the oldest bucket
+	MaxDays int
+	Tracks  int
+}
+
+// ageBuckets are the upper bounds in days of every AgeBucket but the last
+var ageBuckets = []int{7, 30, 90, 180, 365}
+
+// Stats summarizes how tracks move through a playlist
+type Stats struct {
+	Promoted int
+	Removed  int
+	// MedianDaysToPromotion and MedianDaysToRemoval are zero without any
+	// promotions or removals respectively
+	MedianDaysToPromotion float64
+	MedianDaysToRemoval   float64
+	// PromotedLast30Days and RemovedLast30Days count recent events
+	PromotedLast30Days int
+	RemovedLast30Days  int
+	// Pending is how many tracks are in the playlist
+	Pending int
+	// Ages is the aging curve of the tracks in the playlist, youngest first
+	Ages []AgeBucket
+	// LastCleanedAt is when the playlist was last completely cleaned, zero
+	// if never
+	LastCleanedAt time.Time
+}
+
+// Compute summarizes events and the tracks still in the playlist as of now
+func Compute(events []Event, pending []spotify.PlaylistTrack, now time.Time) Stats {
+	s := Stats{Pending: len(pending)}
+	promoted, removed := []float64{}, []float64{}
+	for _, e := range events {
+		recent := now.Sub(e.RemovedAt) <= 30*day
+		if e.Promoted() {
+			promoted = append(promoted, e.Days())
+			if recent {
+				s.PromotedLast30Days++
+			}
+		} else {
+			removed = append(removed, e.Days())
+			if recent {
+				s.RemovedLast30Days++
+			}
+		}
+	}
+	s.Promoted, s.MedianDaysToPromotion = len(promoted), median(promoted)
+	s.Removed, s.MedianDaysToRemoval = len(removed), median(removed)
+
+	for _, max := range ageBuckets {
+		s.Ages = append(s.Ages, AgeBucket{MaxDays: max})
+	}
+	s.Ages = append(s.Ages, AgeBucket{})
+	for _, t := range pending {
+		addedAt, err := time.Parse(spotify.TimestampLayout, t.AddedAt)
+		if err != nil {
+			continue
+		}
+		days := now.Sub(addedAt).Hours() / 24
+		ix := 0
+		for ix < len(ageBuckets) && days > float64(ageBuckets[ix]) {
+			ix++
+		}
+		s.Ages[ix].Tracks++
+	}
+	return s
+}
+
+// median returns the median of values, or 0 if there are none
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// WriteMetrics writes s in the Prometheus text exposition format
+func WriteMetrics(w io.Writer, s Stats) error {
+	type metric struct {
+		name, help, kind string
+		samples          []string
+	}
+	metrics := []metric{
+		{
+			name: "potentials_tracks_left_total", help: "Tracks which left Potentials, by outcome.", kind: "counter",
+			samples: []string{
+				fmt.Sprintf(`{outcome="promoted"} %d`, s.Promoted),
+				fmt.Sprintf(`{outcome="removed"} %d`, s.Removed),
+			},
+		},
+		{
+			name: "potentials_median_days_in_playlist", help: "Median days tracks spent in Potentials before leaving, by outcome.", kind: "gauge",
+			samples: []string{
+				fmt.Sprintf(`{outcome="promoted"} %g`, s.MedianDaysToPromotion),
+				fmt.Sprintf(`{outcome="removed"} %g`, s.MedianDaysToRemoval),
+			},
+		},
+		{
+			name: "potentials_tracks_left_last_30_days", help: "Tracks which left Potentials in the last 30 days, by outcome.", kind: "gauge",
+			samples: []string{
+				fmt.Sprintf(`{outcome="promoted"} %d`, s.PromotedLast30Days),
+				fmt.Sprintf(`{outcome="removed"} %d`, s.RemovedLast30Days),
+			},
+		},
+		{
+			name: "potentials_pending_tracks", help: "Tracks in Potentials, by days since they were added.", kind: "gauge",
+			samples: ageSamples(s.Ages),
+		},
+	}
+	if !s.LastCleanedAt.IsZero() {
+		metrics = append(metrics, metric{
+			name: "potentials_last_clean_timestamp_seconds", help: "When Potentials was last completely cleaned.", kind: "gauge",
+			samples: []string{fmt.Sprintf(" %d", s.LastCleanedAt.Unix())},
+		})
+	}
+	for _, m := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind); err != nil {
+			return err
+		}
+		for _, sample := range m.samples {
+			if _, err := fmt.Fprintf(w, "%s%s\n", m.name, sample); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ageSamples labels each age bucket with the range of days it covers
+func ageSamples(ages []AgeBucket) []string {
+	samples := []string{}
+	min := 0
+	for _, a := range ages {
+		label := fmt.Sprintf("%d+", min)
+		if a.MaxDays > 0 {
+			label = fmt.Sprintf("%d-%d", min, a.MaxDays)
+			min = a.MaxDays
+		}
+		samples = append(samples, fmt.Sprintf(`{age_days="%s"} %d`, label, a.Tracks))
+	}
+	return samples
+}
@@ -0,0 +1,112 @@
+package throughput
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"potentials-utils/dedupe"
+	"potentials-utils/listenbrainz"
+	"potentials-utils/spotifytest"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+func daysAgo(now time.Time, days int) string {
+	return now.Add(-time.Duration(days) * day).Format(spotify.TimestampLayout)
+}
+
+func TestLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "throughput")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	l := NewLog(filepath.Join(dir, "throughput.json"))
+	l.now = func() time.Time { return now }
+
+	duplicates := []dedupe.Duplicate{}
+	for ix, added := range []string{daysAgo(now, 10), "", daysAgo(now, 40)} {
+		d := dedupe.Duplicate{Track: spotify.PlaylistTrack{AddedAt: added, Track: spotifytest.Track(string(rune('a'+ix)), "Song", "Album", "Artist")}}
+		d.Matcher = "id"
+		duplicates = append(duplicates, d)
+	}
+	duplicates[2].Matcher = listenbrainz.MatcherName
+	if err := l.Promoted(context.Background(), duplicates); err != nil {
+		t.Fatal(err)
+	}
+	events, err := l.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected the 2 tracks with an added time to be recorded, got %+v", events)
+	}
+	if !events[0].Promoted() || events[0].Days() != 10 {
+		t.Errorf("expected a promotion after 10 days, got %+v", events[0])
+	}
+	if events[1].Promoted() || events[1].Days() != 40 {
+		t.Errorf("expected a removal after 40 days, got %+v", events[1])
+	}
+}
+
+func TestCompute(t *testing.T) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	event := func(matcher string, addedDaysAgo, removedDaysAgo int) Event {
+		return Event{
+			Matcher:   matcher,
+			AddedAt:   now.Add(-time.Duration(addedDaysAgo) * day),
+			RemovedAt: now.Add(-time.Duration(removedDaysAgo) * day),
+		}
+	}
+	events := []Event{
+		event("id", 100, 90),
+		event("isrc", 30, 10),
+		event("metadata", 5, 1),
+		event("id", 60, 0),
+		event(listenbrainz.MatcherName, 200, 20),
+	}
+	pending := []spotify.PlaylistTrack{}
+	for _, days := range []int{1, 2, 20, 100, 400, 800} {
+		pending = append(pending, spotify.PlaylistTrack{AddedAt: daysAgo(now, days)})
+	}
+
+	s := Compute(events, pending, now)
+	if s.Promoted != 4 || s.Removed != 1 || s.PromotedLast30Days != 3 || s.RemovedLast30Days != 1 {
+		t.Errorf("unexpected counts %+v", s)
+	}
+	// Promoted after 4, 10, 20 and 60 days
+	if s.MedianDaysToPromotion != 15 || s.MedianDaysToRemoval != 180 {
+		t.Errorf("expected medians of 15 and 180 days, got %v and %v", s.MedianDaysToPromotion, s.MedianDaysToRemoval)
+	}
+	expected := []int{2, 1, 0, 1, 0, 2}
+	for ix, a := range s.Ages {
+		if a.Tracks != expected[ix] {
+			t.Errorf("expected %d tracks in age bucket %d, got %d", expected[ix], ix, a.Tracks)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := WriteMetrics(&buf, s); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`potentials_tracks_left_total{outcome="promoted"} 4`,
+		`potentials_median_days_in_playlist{outcome="removed"} 180`,
+		`potentials_pending_tracks{age_days="0-7"} 2`,
+		`potentials_pending_tracks{age_days="365+"} 2`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("expected metrics to contain %q, got:\n%s", line, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), "potentials_last_clean_timestamp_seconds") {
+		t.Errorf("expected no last clean metric before any clean")
+	}
+}
@@ -0,0 +1,248 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+)
+
+const (
+	// DefaultServiceName is the service.name spans are reported under
+	DefaultServiceName = "potentials-utils"
+	// defaultBatchSize is how many spans are buffered before they're sent
+	defaultBatchSize = 512
+	// defaultFlushInterval is the longest a span is buffered before it's sent
+	defaultFlushInterval = 5 * time.Second
+)
+
+// OTLP span kinds and status codes, see
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/trace/v1/trace.proto
+const (
+	spanKindInternal = 1
+	statusCodeOK     = 1
+	statusCodeError  = 2
+)
+
+// Config configures export of traces to an OpenTelemetry collector
+type Config struct {
+	// Endpoint is the base URL of an OTLP/HTTP collector, e.g.
+	// http://localhost:4318. Tracing is disabled if empty.
+	Endpoint string `yaml:"endpoint"`
+	// ServiceName is reported as the service.name resource attribute.
+	// Defaults to DefaultServiceName.
+	ServiceName string `yaml:"serviceName"`
+}
+
+// Exporter batches finished spans and sends them to an OTLP/HTTP collector
+// as JSON
+type Exporter struct {
+	url         string
+	serviceName string
+	client      *http.Client
+
+	mu      sync.Mutex
+	pending []*Span
+	flushCh chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// NewExporter creates an Exporter sending spans to the collector in cfg and
+// starts its background flush loop. Stop it with Shutdown.
+func NewExporter(cfg Config) *Exporter {
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = DefaultServiceName
+	}
+	e := &Exporter{
+		url:         strings.TrimRight(cfg.Endpoint, "/") + "/v1/traces",
+		serviceName: cfg.ServiceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		flushCh:     make(chan struct{}, 1),
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	go e.loop()
+	return e
+}
+
+// Shutdown sends any buffered spans and stops the exporter
+func (e *Exporter) Shutdown(ctx context.Context) error {
+	close(e.done)
+	select {
+	case <-e.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return e.flush(ctx)
+}
+
+func (e *Exporter) enqueue(s *Span) {
+	e.mu.Lock()
+	e.pending = append(e.pending, s)
+	full := len(e.pending) >= defaultBatchSize
+	e.mu.Unlock()
+	if full {
+		select {
+		case e.flushCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (e *Exporter) loop() {
+	defer close(e.stopped)
+	ticker := time.NewTicker(defaultFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-ticker.C:
+		case <-e.flushCh:
+		}
+		if err := e.flush(context.Background()); err != nil {
+			log.WithFields(log.Fields{"err": err}).Warn("Failed to export traces")
+		}
+	}
+}
+
+func (e *Exporter) flush(ctx context.Context) error {
+	e.mu.Lock()
+	spans := e.pending
+	e.pending = nil
+	e.mu.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(e.encode(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("tracing: POST %s: %s: %s", e.url, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// The types below mirror the OTLP/JSON encoding of an
+// ExportTraceServiceRequest
+
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope      `json:"scope"`
+	Spans []spanJSON `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type spanJSON struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	Status            status     `json:"status"`
+}
+
+type status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func (e *Exporter) encode(spans []*Span) exportRequest {
+	var out []spanJSON
+	for _, s := range spans {
+		s.mu.Lock()
+		sj := spanJSON{
+			TraceID:           s.traceID,
+			SpanID:            s.spanID,
+			ParentSpanID:      s.parentID,
+			Name:              s.name,
+			Kind:              spanKindInternal,
+			StartTimeUnixNano: fmt.Sprint(s.start.UnixNano()),
+			EndTimeUnixNano:   fmt.Sprint(s.end.UnixNano()),
+			Status:            status{Code: statusCodeOK},
+		}
+		for k, v := range s.attributes {
+			sj.Attributes = append(sj.Attributes, keyValue{Key: k, Value: toAnyValue(v)})
+		}
+		if s.err != nil {
+			sj.Status = status{Code: statusCodeError, Message: s.err.Error()}
+		}
+		s.mu.Unlock()
+		out = append(out, sj)
+	}
+	return exportRequest{ResourceSpans: []resourceSpans{{
+		Resource:   resource{Attributes: []keyValue{{Key: "service.name", Value: toAnyValue(e.serviceName)}}},
+		ScopeSpans: []scopeSpans{{Scope: scope{Name: DefaultServiceName}, Spans: out}},
+	}}}
+}
+
+func toAnyValue(v interface{}) anyValue {
+	switch v := v.(type) {
+	case string:
+		return anyValue{StringValue: &v}
+	case bool:
+		return anyValue{BoolValue: &v}
+	case int:
+		s := fmt.Sprint(v)
+		return anyValue{IntValue: &s}
+	case int64:
+		s := fmt.Sprint(v)
+		return anyValue{IntValue: &s}
+	case float64:
+		return anyValue{DoubleValue: &v}
+	default:
+		s := fmt.Sprint(v)
+		return anyValue{StringValue: &s}
+	}
+}
@@ -0,0 +1,116 @@
+// Package tracing records spans of work and exports them to an OpenTelemetry
+// collector over OTLP/HTTP. Tracing is a no-op until an Exporter is installed
+// with SetExporter.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+type spanKey struct{}
+
+var (
+	exporterMu sync.RWMutex
+	exporter   *Exporter
+)
+
+// SetExporter installs the exporter finished spans are sent to. Passing nil
+// disables tracing.
+func SetExporter(e *Exporter) {
+	exporterMu.Lock()
+	defer exporterMu.Unlock()
+	exporter = e
+}
+
+func currentExporter() *Exporter {
+	exporterMu.RLock()
+	defer exporterMu.RUnlock()
+	return exporter
+}
+
+// Span is a single timed operation within a trace
+type Span struct {
+	exporter *Exporter
+
+	mu         sync.Mutex
+	traceID    string
+	spanID     string
+	parentID   string
+	name       string
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+	err        error
+	ended      bool
+}
+
+// Start starts a span named name as a child of the span in ctx, if any, and
+// returns a context carrying the new span. The span must be ended with End.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	e := currentExporter()
+	if e == nil {
+		return ctx, &Span{}
+	}
+	s := &Span{
+		exporter:   e,
+		spanID:     randomID(8),
+		name:       name,
+		start:      time.Now(),
+		attributes: map[string]interface{}{},
+	}
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok && parent.exporter != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		s.traceID = randomID(16)
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// SetAttribute records a key-value attribute on the span. Values should be
+// strings, bools, ints or float64s.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s.exporter == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+// RecordError marks the span as failed with err. A nil err is ignored.
+func (s *Span) RecordError(err error) {
+	if s.exporter == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// End finishes the span and queues it for export. Calls after the first are
+// ignored.
+func (s *Span) End() {
+	if s.exporter == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	s.exporter.enqueue(s)
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,70 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	var got exportRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("expected a POST to /v1/traces, got %s %s", r.Method, r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer srv.Close()
+
+	e := NewExporter(Config{Endpoint: srv.URL + "/"})
+	SetExporter(e)
+	defer SetExporter(nil)
+
+	ctx, parent := Start(context.Background(), "clean")
+	parent.SetAttribute("dry_run", true)
+	_, child := Start(ctx, "spotify.NextPage")
+	child.RecordError(errors.New("boom"))
+	child.End()
+	parent.End()
+	parent.End()
+	if err := e.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got.ResourceSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("expected one resource and scope, got %+v", got)
+	}
+	if name := *got.ResourceSpans[0].Resource.Attributes[0].Value.StringValue; name != DefaultServiceName {
+		t.Errorf("expected service name %q, got %q", DefaultServiceName, name)
+	}
+	spans := got.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	c, p := spans[0], spans[1]
+	if c.TraceID != p.TraceID || c.ParentSpanID != p.SpanID || p.ParentSpanID != "" {
+		t.Errorf("expected %s to be a child of %s, got %+v and %+v", c.Name, p.Name, c, p)
+	}
+	if c.Status.Code != statusCodeError || c.Status.Message != "boom" {
+		t.Errorf("expected child span to have error status, got %+v", c.Status)
+	}
+	if len(p.Attributes) != 1 || p.Attributes[0].Key != "dry_run" || !*p.Attributes[0].Value.BoolValue {
+		t.Errorf("expected dry_run attribute on parent span, got %+v", p.Attributes)
+	}
+}
+
+func TestStartWithoutExporter(t *testing.T) {
+	ctx := context.Background()
+	got, span := Start(ctx, "noop")
+	if got != ctx {
+		t.Errorf("expected context to be unchanged when tracing is disabled")
+	}
+	span.SetAttribute("k", "v")
+	span.RecordError(errors.New("ignored"))
+	span.End()
+}
@@ -0,0 +1,329 @@
+// Package trash keeps tracks removed from playlists in a managed trash
+// playlist for a retention period, so any removal can be undone until the
+// trash is purged.
+package trash
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"potentials-utils/dedupe"
+	"potentials-utils/library"
+
+	"github.com/apex/log"
+	"github.com/zmb3/spotify/v2"
+)
+
+// PlaylistName is the name of the trash playlist created in the user's
+// account
+const PlaylistName = "Potentials Trash"
+
+// API is the view of the Spotify API needed to manage the trash
+type API interface {
+	CurrentUser(ctx context.Context) (*spotify.PrivateUser, error)
+	CreatePlaylistForUser(ctx context.Context, userID, playlistName, description string, public bool) (*spotify.FullPlaylist, error)
+	AddTracksToPlaylist(ctx context.Context, playlistID spotify.ID, trackIDs ...spotify.ID) (string, error)
+	RemoveTracksFromPlaylist(ctx context.Context, playlistID spotify.ID, trackIDs ...spotify.ID) (string, error)
+	GetPlaylist(ctx context.Context, playlistID spotify.ID) (*spotify.FullPlaylist, error)
+	InsertTracksIntoPlaylist(ctx context.Context, playlistID spotify.ID, position int, trackIDs ...spotify.ID) (string, error)
+}
+
+// Item is a track in the trash
+type Item struct {
+	TrackID spotify.ID `json:"trackID"`
+	// Track describes the track for people
+	Track string `json:"track"`
+	// From is the playlist the track was removed from
+	From spotify.ID `json:"from"`
+	// Position is where the track was in that playlist, nil for items
+	// trashed before positions were recorded
+	Position  *int      `json:"position,omitempty"`
+	Reason    string    `json:"reason"`
+	TrashedAt time.Time `json:"trashedAt"`
+}
+
+// state is the trash as persisted
+type state struct {
+	// PlaylistID is the trash playlist, created on first use
+	PlaylistID spotify.ID `json:"playlistID"`
+	Items      []Item     `json:"items"`
+}
+
+// Trash is a dedupe.Trash backed by a playlist, with its items recorded in a
+// JSON file
+type Trash struct {
+	// Retention is how long items are kept before Purge drops them
+	Retention time.Duration
+	// DryRun reports what Purge and Restore would do without doing it
+	DryRun bool
+	// KeepPositions restores items to the positions they were removed from
+	// instead of appending them to their playlists
+	KeepPositions bool
+
+	client API
+	path   string
+	mu     sync.Mutex
+	now    func() time.Time
+}
+
+var _ dedupe.Trash = (*Trash)(nil)
+
+// New creates a Trash managed through client, with its state persisted at
+// path. The trash playlist is created the first time a track is trashed.
+func New(client API, path string, retention time.Duration) *Trash {
+	return &Trash{Retention: retention, client: client, path: path, now: time.Now}
+}
+
+// Items returns everything in the trash, oldest first
+func (t *Trash) Items() ([]Item, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, err := t.load()
+	if err != nil {
+		return nil, err
+	}
+	return s.Items, nil
+}
+
+// Put adds duplicates to the trash playlist and records where they came from
+func (t *Trash) Put(ctx context.Context, playlistID spotify.ID, duplicates []dedupe.Duplicate) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, err := t.load()
+	if err != nil {
+		return err
+	}
+	if s.PlaylistID == "" {
+		user, err := t.client.CurrentUser(ctx)
+		if err != nil {
+			return err
+		}
+		p, err := t.client.CreatePlaylistForUser(ctx, user.ID, PlaylistName, "Tracks removed by potentials-utils, kept for a while in case you want them back", false)
+		if err != nil {
+			return err
+		}
+		s.PlaylistID = p.ID
+		log.FromContext(ctx).WithFields(log.Fields{"playlistID": p.ID}).Info("created trash playlist")
+	}
+	// Each track is in the trash playlist once, however often it's trashed
+	trashed := map[spotify.ID]bool{}
+	for _, i := range s.Items {
+		trashed[i.TrackID] = true
+	}
+	ids := []spotify.ID{}
+	now := t.now()
+	for _, d := range duplicates {
+		position := d.Position
+		if !trashed[d.Track.Track.ID] {
+			ids = append(ids, d.Track.Track.ID)
+			trashed[d.Track.Track.ID] = true
+		}
+		s.Items = append(s.Items, Item{
+			TrackID:   d.Track.Track.ID,
+			Track:     library.TrackString(d.Track.Track),
+			From:      playlistID,
+			Position:  &position,
+			Reason:    d.Reason,
+			TrashedAt: now,
+		})
+	}
+	for len(ids) > 0 {
+		var chunk []spotify.ID
+		chunk, ids = dedupe.FirstNIDs(ids, 100)
+		if _, err := t.client.AddTracksToPlaylist(ctx, s.PlaylistID, chunk...); err != nil {
+			return err
+		}
+	}
+	return t.save(s)
+}
+
+// Purge drops every item trashed longer ago than the retention period from
+// the trash playlist
+func (t *Trash) Purge(ctx context.Context) (int, error) {
+	cutoff := t.now().Add(-t.Retention)
+	purged, err := t.take(ctx, func(i Item) bool { return i.TrashedAt.Before(cutoff) })
+	if err != nil {
+		return 0, err
+	}
+	if len(purged) > 0 {
+		log.FromContext(ctx).WithFields(log.Fields{"tracks": len(purged), "dryRun": t.DryRun}).Info("purged trash")
+	}
+	return len(purged), nil
+}
+
+// Restore puts the trashed items with the given track IDs, or every item if
+// none are given, back in the playlists they were removed from and takes
+// them out of the trash
+func (t *Trash) Restore(ctx context.Context, ids ...spotify.ID) ([]Item, error) {
+	wanted := map[spotify.ID]bool{}
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	restored, err := t.take(ctx, func(i Item) bool {
+		return len(wanted) == 0 || wanted[i.TrackID]
+	}, func(items []Item) error {
+		byPlaylist := map[spotify.ID][]Item{}
+		order := []spotify.ID{}
+		for _, i := range items {
+			if _, ok := byPlaylist[i.From]; !ok {
+				order = append(order, i.From)
+			}
+			byPlaylist[i.From] = append(byPlaylist[i.From], i)
+		}
+		for _, playlistID := range order {
+			if t.KeepPositions {
+				if err := t.insert(ctx, playlistID, byPlaylist[playlistID]); err != nil {
+					return err
+				}
+				continue
+			}
+			ids := []spotify.ID{}
+			for _, i := range byPlaylist[playlistID] {
+				ids = append(ids, i.TrackID)
+			}
+			if err := t.add(ctx, playlistID, ids); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(restored) > 0 {
+		log.FromContext(ctx).WithFields(log.Fields{"tracks": len(restored), "dryRun": t.DryRun}).Info("restored from trash")
+	}
+	return restored, nil
+}
+
+// add appends tracks to a playlist, 100 at a time
+func (t *Trash) add(ctx context.Context, playlistID spotify.ID, ids []spotify.ID) error {
+	for len(ids) > 0 {
+		var chunk []spotify.ID
+		chunk, ids = dedupe.FirstNIDs(ids, 100)
+		if _, err := t.client.AddTracksToPlaylist(ctx, playlistID, chunk...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insert puts items back in a playlist at the positions they were removed
+// from. Items are inserted in order of position, so tracks removed together
+// by one clean land where they were if the playlist hasn't changed since, and
+// runs of adjacent positions are inserted in one request. Positions past the
+// end of the playlist, and items without one, are appended.
+func (t *Trash) insert(ctx context.Context, playlistID spotify.ID, items []Item) error {
+	playlist, err := t.client.GetPlaylist(ctx, playlistID)
+	if err != nil {
+		return err
+	}
+	length := int(playlist.Tracks.Total)
+	positioned, appended := []Item{}, []spotify.ID{}
+	for _, i := range items {
+		if i.Position == nil {
+			appended = append(appended, i.TrackID)
+		} else {
+			positioned = append(positioned, i)
+		}
+	}
+	sort.SliceStable(positioned, func(a, b int) bool { return *positioned[a].Position < *positioned[b].Position })
+	for len(positioned) > 0 {
+		start := *positioned[0].Position
+		if start > length {
+			for _, i := range positioned {
+				appended = append(appended, i.TrackID)
+			}
+			break
+		}
+		run := []spotify.ID{positioned[0].TrackID}
+		for len(run) < len(positioned) && len(run) < 100 && *positioned[len(run)].Position == start+len(run) {
+			run = append(run, positioned[len(run)].TrackID)
+		}
+		positioned = positioned[len(run):]
+		if _, err := t.client.InsertTracksIntoPlaylist(ctx, playlistID, start, run...); err != nil {
+			return err
+		}
+		length += len(run)
+	}
+	return t.add(ctx, playlistID, appended)
+}
+
+// take removes the items matching from the trash, first calling each of
+// before with them. Tracks are only removed from the trash playlist once no
+// item refers to them. Nothing changes on a dry run.
+func (t *Trash) take(ctx context.Context, matching func(Item) bool, before ...func([]Item) error) ([]Item, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, err := t.load()
+	if err != nil {
+		return nil, err
+	}
+	taken, kept := []Item{}, []Item{}
+	for _, i := range s.Items {
+		if matching(i) {
+			taken = append(taken, i)
+		} else {
+			kept = append(kept, i)
+		}
+	}
+	if len(taken) == 0 || t.DryRun {
+		return taken, nil
+	}
+	for _, f := range before {
+		if err := f(taken); err != nil {
+			return nil, err
+		}
+	}
+	stillTrashed := map[spotify.ID]bool{}
+	for _, i := range kept {
+		stillTrashed[i.TrackID] = true
+	}
+	ids, seen := []spotify.ID{}, map[spotify.ID]bool{}
+	for _, i := range taken {
+		if !stillTrashed[i.TrackID] && !seen[i.TrackID] {
+			ids = append(ids, i.TrackID)
+			seen[i.TrackID] = true
+		}
+	}
+	for len(ids) > 0 {
+		var chunk []spotify.ID
+		chunk, ids = dedupe.FirstNIDs(ids, 100)
+		if _, err := t.client.RemoveTracksFromPlaylist(ctx, s.PlaylistID, chunk...); err != nil {
+			return nil, err
+		}
+	}
+	s.Items = kept
+	return taken, t.save(s)
+}
+
+func (t *Trash) load() (*state, error) {
+	s := &state{}
+	slurp, err := ioutil.ReadFile(t.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(slurp, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (t *Trash) save(s *state) error {
+	bytes, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(t.path, bytes, 0644)
+}
@@ -0,0 +1,130 @@
+package trash
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"potentials-utils/dedupe"
+	"potentials-utils/spotifyclient"
+	"potentials-utils/spotifytest"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+func TestTrash(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	tracks := []spotify.FullTrack{}
+	for ix := 0; ix < 10; ix++ {
+		tracks = append(tracks, spotifytest.Track(fmt.Sprintf("t%d", ix), fmt.Sprintf("Song %d", ix), "Album", "Artist"))
+	}
+	srv.AddPlaylist("potentials", "Potentials", tracks...)
+	dir, err := ioutil.TempDir("", "trash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	trash := New(spotifyclient.New(srv.HTTPClient()), dir+"/trash.json", 30*24*time.Hour)
+	now := time.Now()
+	trash.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	put := func(ids ...int) {
+		duplicates := []dedupe.Duplicate{}
+		for _, ix := range ids {
+			duplicates = append(duplicates, dedupe.Duplicate{Track: spotify.PlaylistTrack{Track: tracks[ix]}})
+		}
+		if err := trash.Put(ctx, "potentials", duplicates); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(0, 1, 2)
+	now = now.Add(20 * 24 * time.Hour)
+	put(2, 3)
+	// The trash playlist is created once, and holds each track once
+	trashID := spotify.ID("created2")
+	if ids := srv.PlaylistTrackIDs(trashID); len(ids) != 4 {
+		t.Fatalf("expected 4 tracks in the trash playlist, got %v", ids)
+	}
+
+	now = now.Add(15 * 24 * time.Hour)
+	trash.DryRun = true
+	if purged, err := trash.Purge(ctx); err != nil || purged != 3 {
+		t.Errorf("expected a dry run to report 3 tracks to purge, got %d %v", purged, err)
+	}
+	if ids := srv.PlaylistTrackIDs(trashID); len(ids) != 4 {
+		t.Errorf("expected a dry run to leave the trash alone, got %v", ids)
+	}
+	trash.DryRun = false
+	if purged, err := trash.Purge(ctx); err != nil || purged != 3 {
+		t.Errorf("expected 3 tracks purged, got %d %v", purged, err)
+	}
+	// t2 was trashed again since, so stays in the playlist
+	if ids := srv.PlaylistTrackIDs(trashID); len(ids) != 2 || ids[0] != "t2" || ids[1] != "t3" {
+		t.Errorf("expected t2 and t3 left in the trash playlist, got %v", ids)
+	}
+
+	restored, err := trash.Restore(ctx, "t3")
+	if err != nil || len(restored) != 1 || restored[0].From != "potentials" {
+		t.Fatalf("expected t3 to be restored to Potentials, got %+v %v", restored, err)
+	}
+	if ids := srv.PlaylistTrackIDs("potentials"); len(ids) != 11 || ids[10] != "t3" {
+		t.Errorf("expected t3 back at the end of Potentials, got %v", ids)
+	}
+	items, err := trash.Items()
+	if err != nil || len(items) != 1 || items[0].TrackID != "t2" {
+		t.Errorf("expected only t2 left in the trash, got %+v %v", items, err)
+	}
+}
+
+func TestRestoreKeepPositions(t *testing.T) {
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	tracks := []spotify.FullTrack{}
+	for ix := 0; ix < 8; ix++ {
+		tracks = append(tracks, spotifytest.Track(fmt.Sprintf("t%d", ix), fmt.Sprintf("Song %d", ix), "Album", "Artist"))
+	}
+	srv.AddPlaylist("potentials", "Potentials", tracks...)
+	dir, err := ioutil.TempDir("", "trash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := spotifyclient.New(srv.HTTPClient())
+	trash := New(client, dir+"/trash.json", 30*24*time.Hour)
+	trash.KeepPositions = true
+	ctx := context.Background()
+
+	// Tracks 1, 2 and 6 are cleaned from the playlist, as a clean would
+	duplicates := []dedupe.Duplicate{}
+	for _, ix := range []int{1, 2, 6} {
+		duplicates = append(duplicates, dedupe.Duplicate{Track: spotify.PlaylistTrack{Track: tracks[ix]}, Position: ix})
+	}
+	if err := trash.Put(ctx, "potentials", duplicates); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.RemoveTracksFromPlaylist(ctx, "potentials", "t1", "t2", "t6"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := trash.Restore(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expected := []spotify.ID{"t0", "t1", "t2", "t3", "t4", "t5", "t6", "t7"}
+	if ids := srv.PlaylistTrackIDs("potentials"); fmt.Sprint(ids) != fmt.Sprint(expected) {
+		t.Errorf("expected the tracks back where they were, got %v", ids)
+	}
+	inserts := 0
+	for _, r := range srv.Requests() {
+		if r == "POST /v1/playlists/potentials/tracks" {
+			inserts++
+		}
+	}
+	if inserts != 2 {
+		t.Errorf("expected adjacent tracks to be inserted together in 2 requests, got %d", inserts)
+	}
+}
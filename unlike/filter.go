@@ -0,0 +1,130 @@
+package unlike
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"potentials-utils/library"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// Filter selects saved tracks by one of their fields, e.g. "artist=Drake",
+// "name~remix", "added<2018-01-01" or "popularity<10". Text fields, name,
+// album and artist, compare ignoring case with = (equals), != (doesn't equal)
+// or ~ (contains); a track matches an artist filter if any of its artists do.
+// added, the date a track was saved, and popularity compare with =, !=, < or
+// >.
+type Filter struct {
+	Field string
+	Op    string
+	Value string
+
+	added      time.Time
+	popularity int
+}
+
+// ops are the filter operators, two character operators first so they're
+// found before their prefixes
+var ops = []string{"!=", "=", "~", "<", ">"}
+
+// ParseFilter parses a filter expression, "<field><op><value>"
+func ParseFilter(expr string) (Filter, error) {
+	for ix := range expr {
+		for _, op := range ops {
+			if !strings.HasPrefix(expr[ix:], op) {
+				continue
+			}
+			f := Filter{
+				Field: strings.ToLower(strings.TrimSpace(expr[:ix])),
+				Op:    op,
+				Value: strings.TrimSpace(expr[ix+len(op):]),
+			}
+			return f, f.parseValue()
+		}
+	}
+	return Filter{}, fmt.Errorf("filter %q has no operator, expected one of %s", expr, strings.Join(ops, " "))
+}
+
+// parseValue checks the operator suits the field and parses the value of
+// date and number fields
+func (f *Filter) parseValue() error {
+	var err error
+	switch f.Field {
+	case "name", "album", "artist":
+		if f.Op == "<" || f.Op == ">" {
+			return fmt.Errorf("%s filters can't use %s", f.Field, f.Op)
+		}
+	case "added":
+		if f.Op == "~" {
+			return fmt.Errorf("added filters can't use ~")
+		}
+		if f.added, err = time.Parse("2006-01-02", f.Value); err != nil {
+			return fmt.Errorf("added filters expect a date like 2006-01-02, got %q", f.Value)
+		}
+	case "popularity":
+		if f.Op == "~" {
+			return fmt.Errorf("popularity filters can't use ~")
+		}
+		if f.popularity, err = strconv.Atoi(f.Value); err != nil {
+			return fmt.Errorf("popularity filters expect a number, got %q", f.Value)
+		}
+	default:
+		return fmt.Errorf("unknown filter field %q, expected one of name, album, artist, added or popularity", f.Field)
+	}
+	return nil
+}
+
+// String returns the filter as an expression
+func (f Filter) String() string {
+	return f.Field + f.Op + f.Value
+}
+
+// Matches returns true if the saved track passes the filter
+func (f Filter) Matches(t spotify.SavedTrack) bool {
+	var texts []string
+	switch f.Field {
+	case "name":
+		texts = []string{t.Name}
+	case "album":
+		texts = []string{t.Album.Name}
+	case "artist":
+		texts = library.ArtistNames(t.SimpleTrack)
+	case "added":
+		addedAt, err := time.Parse(spotify.TimestampLayout, t.AddedAt)
+		if err != nil {
+			return false
+		}
+		day := addedAt.Truncate(24 * time.Hour)
+		return compare(day.Unix(), f.added.Unix(), f.Op)
+	case "popularity":
+		return compare(int64(t.Popularity), int64(f.popularity), f.Op)
+	}
+	found := false
+	for _, text := range texts {
+		text, v := strings.ToLower(text), strings.ToLower(f.Value)
+		if f.Op == "~" {
+			found = found || strings.Contains(text, v)
+		} else {
+			found = found || text == v
+		}
+	}
+	// != matches tracks none of whose texts equal the value
+	return found != (f.Op == "!=")
+}
+
+func compare(a, b int64, op string) bool {
+	switch op {
+	case "=":
+		return a == b
+	case "!=":
+		return a != b
+	case "<":
+		return a < b
+	case ">":
+		return a > b
+	}
+	return false
+}
@@ -0,0 +1,271 @@
+// Package unlike removes tracks from the user's saved tracks in bulk. A
+// removal is planned first, so it can be reviewed or saved and applied later,
+// then applied in chunks, with every removed track recorded in the audit log
+// so the removal can be undone.
+package unlike
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"potentials-utils/audit"
+	"potentials-utils/dedupe"
+	"potentials-utils/library"
+
+	"github.com/apex/log"
+	"github.com/zmb3/spotify/v2"
+)
+
+// chunkSize is the most tracks the library endpoints accept at once
+const chunkSize = 50
+
+// API is the view of the Spotify API needed to un-like tracks and undo it
+type API interface {
+	SavedTracks(ctx context.Context) (*spotify.SavedTrackPage, error)
+	NextSavedTracks(ctx context.Context, page *spotify.SavedTrackPage) error
+	RemoveTracksFromLibrary(ctx context.Context, ids ...spotify.ID) error
+	AddTracksToLibrary(ctx context.Context, ids ...spotify.ID) error
+}
+
+// PlannedTrack is a saved track a plan un-likes
+type PlannedTrack struct {
+	ID spotify.ID `json:"id"`
+	// Track describes the track for people
+	Track   string `json:"track"`
+	AddedAt string `json:"addedAt"`
+}
+
+// Plan is the tracks a removal un-likes, written as JSON so it can be
+// reviewed before it's applied
+type Plan struct {
+	CreatedAt time.Time `json:"createdAt"`
+	// Filters are the filter expressions the tracks were selected by
+	Filters []string       `json:"filters,omitempty"`
+	Tracks  []PlannedTrack `json:"tracks"`
+	// NotSaved are the requested tracks which aren't saved, so can't be
+	// removed
+	NotSaved []spotify.ID `json:"notSaved,omitempty"`
+}
+
+// NewPlan selects the saved tracks to un-like: those with the given IDs, if
+// any, which match every filter. Either IDs or filters are required, so a
+// plan never un-likes the whole library by accident.
+func NewPlan(ctx context.Context, client API, ids []spotify.ID, filters []Filter) (*Plan, error) {
+	if len(ids) == 0 && len(filters) == 0 {
+		return nil, errors.New("tracks to remove must be given by ID or by filter")
+	}
+	requested := map[spotify.ID]bool{}
+	for _, id := range ids {
+		requested[id] = true
+	}
+	plan := &Plan{CreatedAt: time.Now(), Tracks: []PlannedTrack{}}
+	for _, f := range filters {
+		plan.Filters = append(plan.Filters, f.String())
+	}
+	saved := map[spotify.ID]bool{}
+	page, err := client.SavedTracks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		for _, t := range page.Tracks {
+			saved[t.ID] = true
+			if len(ids) > 0 && !requested[t.ID] {
+				continue
+			}
+			if matchesAll(t, filters) {
+				plan.Tracks = append(plan.Tracks, PlannedTrack{ID: t.ID, Track: library.TrackString(t.FullTrack), AddedAt: t.AddedAt})
+			}
+		}
+		if err := client.NextSavedTracks(ctx, page); err == spotify.ErrNoMorePages {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	for _, id := range ids {
+		if !saved[id] {
+			plan.NotSaved = append(plan.NotSaved, id)
+		}
+	}
+	return plan, nil
+}
+
+func matchesAll(t spotify.SavedTrack, filters []Filter) bool {
+	for _, f := range filters {
+		if !f.Matches(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// LoadPlan reads a plan written by Save
+func LoadPlan(path string) (*Plan, error) {
+	slurp, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var plan Plan
+	if err := json.Unmarshal(slurp, &plan); err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// Save writes the plan to path as JSON
+func (p *Plan) Save(path string) error {
+	bytes, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, bytes, 0644)
+}
+
+// Removal is a track un-liked by potentials-utils, as recorded in the audit
+// log
+type Removal struct {
+	// Batch identifies the removal the track was un-liked by, so it can be
+	// undone as a whole
+	Batch   string
+	TrackID spotify.ID
+	// AddedAt is when the track was originally saved
+	AddedAt   string
+	RemovedAt time.Time
+	// UndoneAt is when the track was saved again, nil until it's undone
+	UndoneAt *time.Time
+}
+
+// Removals returns every track un-liked recorded in l, oldest first
+func Removals(l *audit.Log) ([]Removal, error) {
+	events, err := l.Events()
+	if err != nil {
+		return nil, err
+	}
+	removals := []Removal{}
+	// recorded is the position in removals of each track of each batch
+	recorded := map[string]int{}
+	for _, e := range events {
+		switch e.Kind {
+		case audit.LibraryUnlike:
+			for ix, id := range e.Tracks {
+				r := Removal{Batch: e.Batch, TrackID: id, RemovedAt: e.Time}
+				if ix < len(e.AddedAt) {
+					r.AddedAt = e.AddedAt[ix]
+				}
+				recorded[e.Batch+"/"+string(id)] = len(removals)
+				removals = append(removals, r)
+			}
+		case audit.LibraryUndoUnlike:
+			undoneAt := e.Time
+			for _, id := range e.Tracks {
+				if ix, ok := recorded[e.Batch+"/"+string(id)]; ok && removals[ix].UndoneAt == nil {
+					removals[ix].UndoneAt = &undoneAt
+				}
+			}
+		}
+	}
+	return removals, nil
+}
+
+// LastBatch returns the batch of the most recent removal recorded in l, or ""
+// if nothing has been removed
+func LastBatch(l *audit.Log) (string, error) {
+	removals, err := Removals(l)
+	if err != nil || len(removals) == 0 {
+		return "", err
+	}
+	return removals[len(removals)-1].Batch, nil
+}
+
+// Apply un-likes the plan's tracks, 50 at a time, recording each chunk in the
+// audit log l as soon as it's removed so a removal which fails part way can
+// still be undone. Returns the batch the removals were recorded under and the
+// tracks removed. Nothing is removed or recorded on a dry run.
+func Apply(ctx context.Context, client API, l *audit.Log, plan *Plan, dryRun bool) (string, []PlannedTrack, error) {
+	if dryRun {
+		return "", plan.Tracks, nil
+	}
+	if l == nil {
+		return "", nil, errors.New("tracks can't be un-liked without an audit log to undo the removal from")
+	}
+	batch := time.Now().UTC().Format("20060102T150405Z")
+	removed := []PlannedTrack{}
+	tracks := plan.Tracks
+	for len(tracks) > 0 {
+		n := chunkSize
+		if len(tracks) < n {
+			n = len(tracks)
+		}
+		chunk := tracks[:n]
+		tracks = tracks[n:]
+		e := audit.Event{Kind: audit.LibraryUnlike, Batch: batch}
+		for _, t := range chunk {
+			e.Tracks = append(e.Tracks, t.ID)
+			e.AddedAt = append(e.AddedAt, t.AddedAt)
+		}
+		if err := client.RemoveTracksFromLibrary(ctx, e.Tracks...); err != nil {
+			return batch, removed, err
+		}
+		for _, t := range chunk {
+			log.WithFields(log.Fields{"batch": batch, "trackID": t.ID, "track": t.Track, "addedAt": t.AddedAt}).Info("removed track from library")
+		}
+		if err := l.Record(e); err != nil {
+			return batch, removed, err
+		}
+		removed = append(removed, chunk...)
+	}
+	return batch, removed, nil
+}
+
+// Undo saves the tracks removed by a batch again, 50 at a time, oldest
+// originally saved first so they keep their relative order in the library.
+// Spotify dates them as saved now; their original dates stay in the audit
+// log l. Tracks of the batch already saved again are skipped. Returns the
+// removals undone, or which would be on a dry run.
+func Undo(ctx context.Context, client API, l *audit.Log, batch string, dryRun bool) ([]Removal, error) {
+	removals, err := Removals(l)
+	if err != nil {
+		return nil, err
+	}
+	pending := []Removal{}
+	found := false
+	for _, r := range removals {
+		if r.Batch != batch {
+			continue
+		}
+		found = true
+		if r.UndoneAt == nil {
+			pending = append(pending, r)
+		}
+	}
+	if !found {
+		return nil, errors.New("no removals recorded for batch " + batch)
+	}
+	sort.SliceStable(pending, func(i, j int) bool { return pending[i].AddedAt < pending[j].AddedAt })
+	if dryRun {
+		return pending, nil
+	}
+	ids := []spotify.ID{}
+	for _, r := range pending {
+		ids = append(ids, r.TrackID)
+	}
+	undone := []Removal{}
+	for len(ids) > 0 {
+		var chunk []spotify.ID
+		chunk, ids = dedupe.FirstNIDs(ids, chunkSize)
+		if err := client.AddTracksToLibrary(ctx, chunk...); err != nil {
+			return undone, err
+		}
+		if err := l.Record(audit.Event{Kind: audit.LibraryUndoUnlike, Batch: batch, Tracks: chunk}); err != nil {
+			return undone, err
+		}
+		undone = append(undone, pending[len(undone):len(undone)+len(chunk)]...)
+		log.WithFields(log.Fields{"batch": batch, "tracks": len(chunk)}).Info("saved removed tracks to library again")
+	}
+	return undone, nil
+}
@@ -0,0 +1,152 @@
+package unlike
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"potentials-utils/audit"
+	"potentials-utils/spotifyclient"
+	"potentials-utils/spotifytest"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+func TestFilter(t *testing.T) {
+	track := spotify.SavedTrack{AddedAt: "2017-06-01T12:00:00Z", FullTrack: spotifytest.Track("t1", "Song (Remix)", "Album", "Drake", "Rihanna")}
+	track.Popularity = 5
+	testCases := []struct {
+		expr     string
+		expected bool
+	}{
+		{expr: "artist=drake", expected: true},
+		{expr: "artist = Rihanna", expected: true},
+		{expr: "artist!=Drake", expected: false},
+		{expr: "artist!=Future", expected: true},
+		{expr: "name~remix", expected: true},
+		{expr: "name=Song", expected: false},
+		{expr: "album!=Album", expected: false},
+		{expr: "added<2018-01-01", expected: true},
+		{expr: "added>2018-01-01", expected: false},
+		{expr: "added=2017-06-01", expected: true},
+		{expr: "popularity<10", expected: true},
+		{expr: "popularity>10", expected: false},
+	}
+	for _, tc := range testCases {
+		f, err := ParseFilter(tc.expr)
+		if err != nil {
+			t.Errorf("%s failed: %v", tc.expr, err)
+			continue
+		}
+		if got := f.Matches(track); got != tc.expected {
+			t.Errorf("%s failed: expected %t, got %t", tc.expr, tc.expected, got)
+		}
+	}
+	for _, expr := range []string{"artist", "genre=pop", "name<a", "added<yesterday", "popularity~1"} {
+		if _, err := ParseFilter(expr); err == nil {
+			t.Errorf("expected %q to be invalid", expr)
+		}
+	}
+}
+
+func TestApplyAndUndo(t *testing.T) {
+	ctx := context.Background()
+	srv := spotifytest.NewServer()
+	defer srv.Close()
+	tracks := []spotify.FullTrack{spotifytest.Track("keep", "Keep", "Album", "Other")}
+	for ix := 0; ix < 60; ix++ {
+		tracks = append(tracks, spotifytest.Track(fmt.Sprintf("t%d", ix), fmt.Sprintf("Song %d", ix), "Album", "Artist"))
+	}
+	srv.AddSavedTracks(tracks...)
+	dir, err := ioutil.TempDir("", "unlike")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := spotifyclient.New(srv.HTTPClient())
+	l := audit.New(filepath.Join(dir, "audit.jsonl"))
+
+	if _, err := NewPlan(ctx, client, nil, nil); err == nil {
+		t.Errorf("expected a plan without IDs or filters to be refused")
+	}
+	byID, err := NewPlan(ctx, client, []spotify.ID{"t1", "missing"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byID.Tracks) != 1 || byID.Tracks[0].ID != "t1" || !reflect.DeepEqual(byID.NotSaved, []spotify.ID{"missing"}) {
+		t.Errorf("expected t1 planned and missing not saved, got %+v", byID)
+	}
+	artist, err := ParseFilter("artist=Artist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := NewPlan(ctx, client, nil, []Filter{artist})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Tracks) != 60 {
+		t.Fatalf("expected 60 tracks planned, got %d", len(plan.Tracks))
+	}
+	planPath := filepath.Join(dir, "plan.json")
+	if err := plan.Save(planPath); err != nil {
+		t.Fatal(err)
+	}
+	if plan, err = LoadPlan(planPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, removed, err := Apply(ctx, client, l, plan, true); err != nil || len(removed) != 60 || len(srv.SavedTrackIDs()) != 61 {
+		t.Errorf("expected a dry run to remove nothing, got %d removed, %d saved, %v", len(removed), len(srv.SavedTrackIDs()), err)
+	}
+	if _, _, err := Apply(ctx, client, nil, plan, false); err == nil || len(srv.SavedTrackIDs()) != 61 {
+		t.Errorf("expected removing without an audit log to undo from refused, got %v", err)
+	}
+	batch, removed, err := Apply(ctx, client, l, plan, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 60 || !reflect.DeepEqual(srv.SavedTrackIDs(), []spotify.ID{"keep"}) {
+		t.Errorf("expected every track but keep removed, got %v", srv.SavedTrackIDs())
+	}
+	deletes := 0
+	for _, r := range srv.Requests() {
+		if strings.HasPrefix(r, "DELETE /v1/me/tracks") {
+			deletes++
+		}
+	}
+	if deletes != 2 {
+		t.Errorf("expected removals in 2 chunks, got %d", deletes)
+	}
+	if last, err := LastBatch(l); err != nil || last != batch {
+		t.Errorf("expected batch %s to be the last, got %s, %v", batch, last, err)
+	}
+
+	if _, err := Undo(ctx, client, l, "nope", false); err == nil {
+		t.Errorf("expected undoing an unknown batch to fail")
+	}
+	undone, err := Undo(ctx, client, l, batch, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(undone) != 60 || len(srv.SavedTrackIDs()) != 61 {
+		t.Errorf("expected 60 tracks saved again, got %d undone, %d saved", len(undone), len(srv.SavedTrackIDs()))
+	}
+	// Undoing again saves nothing more
+	if undone, err := Undo(ctx, client, l, batch, false); err != nil || len(undone) != 0 {
+		t.Errorf("expected nothing left to undo, got %d, %v", len(undone), err)
+	}
+	removals, err := Removals(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range removals {
+		if r.UndoneAt == nil || r.AddedAt == "" {
+			t.Errorf("expected %s to be recorded as undone with its saved date, got %+v", r.TrackID, r)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+// Package version reports the build of potentials-utils that is running. The
+// variables are set at build time by the Makefile, e.g.
+//
+//	go build -ldflags "-X potentials-utils/version.Version=v1.2.0"
+package version
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Set at build time with -ldflags -X
+var (
+	// Version is the release version, or "dev" for unreleased builds
+	Version = "dev"
+	// Commit is the git commit the binary was built from
+	Commit = "unknown"
+	// BuildDate is when the binary was built, in RFC 3339 format
+	BuildDate = "unknown"
+)
+
+// Info describes a build of potentials-utils
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+}
+
+// Get returns the build info of the running binary
+func Get() Info {
+	return Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+	}
+}
+
+// String formats the build info on one line, e.g.
+// "potentials-utils v1.2.0 (commit abc123, built 2020-06-01T00:00:00Z, go1.14.3)"
+func (i Info) String() string {
+	return fmt.Sprintf("potentials-utils %s (commit %s, built %s, %s)", i.Version, i.Commit, i.BuildDate, i.GoVersion)
+}
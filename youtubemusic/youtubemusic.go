@@ -0,0 +1,182 @@
+// Package youtubemusic reads the songs a user has liked on YouTube Music, so
+// Potentials tracks can be checked against a YouTube Music library as well as
+// a Spotify one.
+package youtubemusic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"potentials-utils/library"
+
+	"github.com/zmb3/spotify/v2"
+	"golang.org/x/oauth2"
+)
+
+const (
+	baseURL  = "https://www.googleapis.com/youtube/v3"
+	tokenURL = "https://oauth2.googleapis.com/token"
+	// likedMusicPlaylist is the ID of the playlist YouTube Music keeps a
+	// user's liked songs in
+	likedMusicPlaylist = "LM"
+	// topicSuffix ends the names of the channels YouTube generates for
+	// artists, e.g. "Radiohead - Topic"
+	topicSuffix = " - Topic"
+)
+
+// Config configures access to a YouTube Music account through the YouTube
+// Data API
+type Config struct {
+	// ClientID and ClientSecret identify a Google OAuth client with the
+	// YouTube Data API enabled
+	ClientID     string `yaml:"clientID"`
+	ClientSecret string `yaml:"clientSecret"`
+	// RefreshToken is a refresh token for the account, granted the
+	// youtube.readonly scope
+	RefreshToken string `yaml:"refreshToken"`
+}
+
+// Enabled returns whether a YouTube Music account is configured
+func (c Config) Enabled() bool {
+	return c.RefreshToken != ""
+}
+
+// Client calls the YouTube Data API
+type Client struct {
+	baseURL string
+	http    *http.Client
+}
+
+// New creates a Client for the account described by cfg
+func New(cfg Config) (*Client, error) {
+	if cfg.ClientID == "" || cfg.ClientSecret == "" || cfg.RefreshToken == "" {
+		return nil, errors.New("youtubeMusic.clientID, youtubeMusic.clientSecret and youtubeMusic.refreshToken are required")
+	}
+	oauthConfig := &oauth2.Config{
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		Endpoint:     oauth2.Endpoint{TokenURL: tokenURL},
+	}
+	token := &oauth2.Token{RefreshToken: cfg.RefreshToken}
+	return &Client{baseURL: baseURL, http: oauthConfig.Client(context.Background(), token)}, nil
+}
+
+// Song is a song liked on YouTube Music
+type Song struct {
+	VideoID string
+	Title   string
+	// Artist is the name of the channel which uploaded the song, for most
+	// songs the artist
+	Artist string
+}
+
+// playlistItems is a page of the playlistItems endpoint
+type playlistItems struct {
+	NextPageToken string `json:"nextPageToken"`
+	Items         []struct {
+		Snippet struct {
+			Title                  string `json:"title"`
+			VideoOwnerChannelTitle string `json:"videoOwnerChannelTitle"`
+			ResourceID             struct {
+				VideoID string `json:"videoId"`
+			} `json:"resourceId"`
+		} `json:"snippet"`
+	} `json:"items"`
+}
+
+// LikedSongs returns every song the user has liked on YouTube Music
+func (c *Client) LikedSongs() ([]Song, error) {
+	songs := []Song{}
+	pageToken := ""
+	for {
+		q := url.Values{"part": {"snippet"}, "playlistId": {likedMusicPlaylist}, "maxResults": {"50"}}
+		if pageToken != "" {
+			q.Set("pageToken", pageToken)
+		}
+		var page playlistItems
+		if err := c.get("/playlistItems?"+q.Encode(), &page); err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			songs = append(songs, Song{
+				VideoID: item.Snippet.ResourceID.VideoID,
+				Title:   item.Snippet.Title,
+				Artist:  strings.TrimSuffix(item.Snippet.VideoOwnerChannelTitle, topicSuffix),
+			})
+		}
+		if page.NextPageToken == "" {
+			return songs, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+func (c *Client) get(path string, result interface{}) error {
+	resp, err := c.http.Get(c.baseURL + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	slurp, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("youtube GET %s: %s: %s", path, resp.Status, strings.TrimSpace(string(slurp)))
+	}
+	return json.Unmarshal(slurp, result)
+}
+
+// Library is an index of liked songs by title and artist
+type Library struct {
+	songs map[string]Song
+}
+
+// NewLibrary indexes songs
+func NewLibrary(songs []Song) *Library {
+	l := &Library{songs: map[string]Song{}}
+	for _, s := range songs {
+		l.songs[key(s.Title, s.Artist)] = s
+	}
+	return l
+}
+
+// Len returns the number of songs in the library
+func (l *Library) Len() int {
+	return len(l.songs)
+}
+
+// Find returns the liked song which is the Spotify track t, matched by title
+// and any of its artists
+func (l *Library) Find(t spotify.FullTrack) (Song, bool) {
+	for _, artist := range library.ArtistNames(t.SimpleTrack) {
+		if s, ok := l.songs[key(t.Name, artist)]; ok {
+			return s, true
+		}
+	}
+	return Song{}, false
+}
+
+// key normalizes a title and artist, dropping anything bracketed from the
+// title such as "(Remastered)" or "[Official Audio]"
+func key(title, artist string) string {
+	var b strings.Builder
+	depth := 0
+	for _, r := range strings.ToLower(title) {
+		switch {
+		case r == '(' || r == '[':
+			depth++
+		case (r == ')' || r == ']') && depth > 0:
+			depth--
+		case depth == 0:
+			b.WriteRune(r)
+		}
+	}
+	return strings.Join(strings.Fields(b.String()), " ") + "\x00" + strings.ToLower(strings.TrimSpace(artist))
+}
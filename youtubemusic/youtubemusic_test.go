@@ -0,0 +1,75 @@
+package youtubemusic
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"potentials-utils/spotifytest"
+)
+
+func TestLikedSongs(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/playlistItems" || r.URL.Query().Get("playlistId") != "LM" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		// Two pages of songs
+		page := map[string]interface{}{}
+		start := 0
+		if r.URL.Query().Get("pageToken") == "next" {
+			start = 50
+		} else {
+			page["nextPageToken"] = "next"
+		}
+		items := []interface{}{}
+		for ix := start; ix < start+50 && ix < 70; ix++ {
+			items = append(items, map[string]interface{}{"snippet": map[string]interface{}{
+				"title":                  fmt.Sprintf("Song %d", ix),
+				"videoOwnerChannelTitle": "Artist - Topic",
+				"resourceId":             map[string]string{"videoId": fmt.Sprintf("v%d", ix)},
+			}})
+		}
+		page["items"] = items
+		json.NewEncoder(w).Encode(page)
+	}))
+	defer srv.Close()
+	c := &Client{baseURL: srv.URL, http: srv.Client()}
+
+	songs, err := c.LikedSongs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(songs) != 70 || songs[69] != (Song{VideoID: "v69", Title: "Song 69", Artist: "Artist"}) {
+		t.Errorf("expected 70 liked songs, got %d ending %+v", len(songs), songs[len(songs)-1])
+	}
+}
+
+func TestFind(t *testing.T) {
+	lib := NewLibrary([]Song{
+		{VideoID: "v1", Title: "Paranoid Android", Artist: "Radiohead"},
+		{VideoID: "v2", Title: "Karma Police (Remastered)", Artist: "Radiohead"},
+		{VideoID: "v3", Title: "Get Lucky [Official Audio]", Artist: "Daft Punk"},
+	})
+	testCases := []struct {
+		name     string
+		title    string
+		artists  []string
+		expected string
+	}{
+		{name: "exact", title: "Paranoid Android", artists: []string{"Radiohead"}, expected: "v1"},
+		{name: "case", title: "paranoid android", artists: []string{"RADIOHEAD"}, expected: "v1"},
+		{name: "bracketed suffix on youtube", title: "Karma Police", artists: []string{"Radiohead"}, expected: "v2"},
+		{name: "featured artist", title: "Get Lucky (feat. Pharrell Williams)", artists: []string{"Pharrell Williams", "Daft Punk"}, expected: "v3"},
+		{name: "other artist", title: "Paranoid Android", artists: []string{"Brad Mehldau"}},
+		{name: "other song", title: "No Surprises", artists: []string{"Radiohead"}},
+	}
+	for _, tc := range testCases {
+		s, ok := lib.Find(spotifytest.Track("t", tc.title, "Album", tc.artists...))
+		if ok != (tc.expected != "") || s.VideoID != tc.expected {
+			t.Errorf("%s failed: expected %q, got %q", tc.name, tc.expected, s.VideoID)
+		}
+	}
+}